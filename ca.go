@@ -7,66 +7,199 @@
 package easycert
 
 import (
+	"crypto"
 	"crypto/rand"
+	"crypto/x509"
+	"errors"
 	"fmt"
-	"log"
-	"math/big"
+	"io/fs"
 	"time"
 
-	"github.com/tredoe/easycert/go13/x509"
+	"github.com/tredoe/easycert/store"
 )
 
-// GenerateCert generate certificate for a TLS server. Outputs to 'cert.pem' and
-// 'key.pem' and will overwrite existing files.
-//
-// + isCA:
-//   whether this cert should be its own Certificate Authority
-// + subject:
-//   a X.509 distinguished name
-// + validFor:
-//   duration that certificate is valid for
-// + host:
-//   comma-separated hostnames and IPs to generate a certificate for
-func GenerateCert(isCA bool, subject pkix.Name, validFor time.Duration) {
-	// Use 256-bit random numbers
-	serialNumberLimit := new(big.Int).Lsh(big.NewInt(1), 256) // 2^256
-	serialNumber, err := rand.Int(rand.Reader, serialNumberLimit)
+// CA represents the certification authority of a certificates directory,
+// which signs the certificate requests.
+type CA struct {
+	Cert *x509.Certificate
+
+	key   crypto.Signer
+	store *Store
+}
+
+// CreateCA creates the CA's private key, encrypted with the passphrase of the
+// options, and its self-signed certificate. The common name of the subject is
+// the organization followed by "CA", whether it is empty.
+func (s *Store) CreateCA(subject Name, opts *CAOptions) (*CA, error) {
+	if opts == nil || opts.Passphrase == "" {
+		return nil, errors.New("the CA's private key needs a passphrase")
+	}
+	if err := s.checkNoCA(); err != nil {
+		return nil, err
+	}
+	key, err := GenerateKey(opts.Key)
 	if err != nil {
-		log.Fatal("Failed to generate serial number:", err)
+		return nil, err
 	}
+	if err = s.writeKey(store.NAME_CA, key, opts.Passphrase); err != nil {
+		return nil, err
+	}
+	return s.CreateCASigner(subject, key, opts.Days)
+}
 
-	// Validity
-	notBefore := time.Now()
-
-	template := x509.Certificate{
-		SerialNumber: serialNumber,
-		Subject:   subject,
-		NotBefore: notBefore,
-		NotAfter:  notBefore.Add(validFor),
+// CreateCASigner is like CreateCA, but the CA's private key is `key`, like one
+// in a KMS, which is not written to the store. The validity is of `days`, or
+// DEFAULT_CA_DAYS whether it is zero.
+func (s *Store) CreateCASigner(subject Name, key crypto.Signer, days int) (*CA, error) {
+	if err := s.checkNoCA(); err != nil {
+		return nil, err
+	}
+	if subject.CommonName == "" {
+		subject.CommonName = "CA"
+		if subject.Organization != "" {
+			subject.CommonName = subject.Organization + " CA"
+		}
+	}
+	if days == 0 {
+		days = DEFAULT_CA_DAYS
+	}
 
-		//KeyUsage: x509.KeyUsageKeyEncipherment | x509.KeyUsageDigitalSignature,
-		ExtKeyUsage: []x509.ExtKeyUsage{
-			x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth
-		},
+	rawSubject, err := subject.Marshal()
+	if err != nil {
+		return nil, err
+	}
+	id, err := KeyID(key.Public())
+	if err != nil {
+		return nil, err
+	}
+	serial, err := s.readSerial()
+	if err != nil {
+		return nil, err
+	}
 
+	now := time.Now().UTC().Truncate(time.Second)
+	tmpl := &x509.Certificate{
+		SerialNumber:          serial,
+		RawSubject:            rawSubject,
+		NotBefore:             now,
+		NotAfter:              now.AddDate(0, 0, days),
 		BasicConstraintsValid: true,
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		SubjectKeyId:          id,
+		AuthorityKeyId:        id,
 	}
-	if *isCA {
-		template.IsCA = true
-		template.MaxPathLen = 0
-		template.KeyUsage |= x509.KeyUsageCertSign | x509.KeyUsageCRLSign
-	} else {
-		
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, key.Public(), key)
+	if err != nil {
+		return nil, err
 	}
 
-/*
-SerialNumber, Subject, NotBefore, NotAfter, KeyUsage, ExtKeyUsage, UnknownExtKeyUsage, BasicConstraintsValid, IsCA, MaxPathLen, SubjectKeyId, DNSNames, PermittedDNSDomainsCritical, PermittedDNSDomains. 
-*/
+	cert, err := s.record(der, store.NAME_CA)
+	if err != nil {
+		return nil, err
+	}
+	return &CA{Cert: cert, key: key, store: s}, nil
+}
+
+// checkNoCA fails whether the certificate of the CA exists.
+func (s *Store) checkNoCA() error {
+	if _, err := fs.Stat(s.fs, store.CertFile(store.NAME_CA)); err == nil {
+		return errors.New("the CA exists")
+	}
+	return nil
+}
 
-	cert, err := x509.CreateCertificate(rand.Reader, &template, &template, &priv.PublicKey, priv)
+// LoadCA returns the CA, with its private key decrypted with the passphrase.
+func (s *Store) LoadCA(pass string) (*CA, error) {
+	cert, err := s.Cert(store.NAME_CA)
 	if err != nil {
-		log.Fatal("Failed to create certificate:", err)
+		return nil, err
 	}
+	key, err := s.Key(store.NAME_CA, pass)
+	if err != nil {
+		return nil, err
+	}
+	return &CA{Cert: cert, key: key, store: s}, nil
+}
 
+// LoadCASigner returns the CA with its private key in `key`, like one in a
+// KMS, which has to be the one of the CA's certificate.
+func (s *Store) LoadCASigner(key crypto.Signer) (*CA, error) {
+	cert, err := s.Cert(store.NAME_CA)
+	if err != nil {
+		return nil, err
+	}
+	if pub, ok := cert.PublicKey.(interface{ Equal(crypto.PublicKey) bool }); !ok || !pub.Equal(key.Public()) {
+		return nil, errors.New("the private key is not the one of the CA")
+	}
+	return &CA{Cert: cert, key: key, store: s}, nil
 }
 
+// Sign signs the certificate request, which is written like the certificate
+// of the request's name and recorded in the database. The subject keeps the
+// attributes of the policy "policy_anything" of OpenSSL, and the subject
+// alternative names are the ones of the request.
+func (ca *CA) Sign(req *Request, opts *SignOptions) (*x509.Certificate, error) {
+	if opts == nil {
+		opts = &SignOptions{}
+	}
+	if err := req.CSR.CheckSignature(); err != nil {
+		return nil, fmt.Errorf("request %q: %s", req.Name, err)
+	}
+
+	subject := opts.Subject
+	if subject == nil {
+		var err error
+		if subject, err = PolicySubject(req.CSR.RawSubject); err != nil {
+			return nil, err
+		}
+	}
+	oneline, err := NameOneline(subject)
+	if err != nil {
+		return nil, err
+	}
+	if err = ca.store.checkUniqueSubject(oneline); err != nil {
+		return nil, err
+	}
+	id, err := KeyID(req.CSR.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+	serial, err := ca.store.readSerial()
+	if err != nil {
+		return nil, err
+	}
+
+	tmpl := &x509.Certificate{
+		KeyUsage:    opts.KeyUsage,
+		ExtKeyUsage: opts.ExtKeyUsage,
+		DNSNames:    req.CSR.DNSNames,
+		IPAddresses: req.CSR.IPAddresses,
+	}
+	if opts.Template != nil {
+		t := *opts.Template
+		tmpl = &t
+	} else if tmpl.KeyUsage == 0 && len(tmpl.ExtKeyUsage) == 0 {
+		tmpl.KeyUsage = x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment
+		tmpl.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth}
+	}
+
+	now := time.Now().UTC().Truncate(time.Second)
+	tmpl.SerialNumber = serial
+	tmpl.RawSubject = subject
+	tmpl.NotBefore = now
+	tmpl.NotAfter = opts.NotAfter.UTC().Truncate(time.Second)
+	if opts.NotAfter.IsZero() {
+		tmpl.NotAfter = now.AddDate(0, 0, opts.days())
+	}
+	tmpl.BasicConstraintsValid = true
+	tmpl.IsCA = false
+	tmpl.SubjectKeyId = id
+	tmpl.AuthorityKeyId = ca.Cert.SubjectKeyId
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.Cert, req.CSR.PublicKey, ca.key)
+	if err != nil {
+		return nil, err
+	}
+	return ca.store.record(der, req.Name)
+}
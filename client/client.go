@@ -0,0 +1,218 @@
+// Copyright 2014 Jonas mg
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+// Package client is a client of the REST API of the portal of EasyCert
+// ("easycert-wrap serve"), to submit certificate requests, review them,
+// download the certificates issued and revoke them.
+//
+// The API is described in OpenAPI by the portal, at "/api/v1/openapi.json".
+package client
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// API_PATH is the path of the API in the portal.
+const API_PATH = "/api/v1"
+
+// Status of the requests.
+const (
+	STATUS_PENDING  = "pending"
+	STATUS_APPROVED = "approved"
+	STATUS_DENIED   = "denied"
+)
+
+// Status of the certificates.
+const (
+	CERT_VALID   = "valid"
+	CERT_REVOKED = "revoked"
+	CERT_EXPIRED = "expired"
+)
+
+// Request represents a certificate request in the queue of the portal.
+type Request struct {
+	ID        string    `json:"id"`
+	Name      string    `json:"name"` // Name of the certificate.
+	Subject   string    `json:"subject"`
+	Source    string    `json:"source"`
+	Status    string    `json:"status"`
+	Submitted time.Time `json:"submitted"`
+	Updated   time.Time `json:"updated"`
+
+	// An attestation statement of the key was submitted with the request.
+	Attestation bool `json:"attestation,omitempty"`
+}
+
+// Submission represents a certificate request to submit.
+type Submission struct {
+	Name        string `json:"name"`                  // Name of the certificate.
+	CSR         string `json:"csr"`                   // Request in PEM format.
+	Attestation string `json:"attestation,omitempty"` // Statement of the key.
+}
+
+// Certificate represents a certificate of the certificates directory of the
+// portal.
+type Certificate struct {
+	Name     string    `json:"name"`
+	Subject  string    `json:"subject"`
+	Serial   string    `json:"serial"` // In hexadecimal.
+	NotAfter time.Time `json:"not_after"`
+	Status   string    `json:"status"`
+}
+
+// Revocation represents the revocation of a certificate.
+type Revocation struct {
+	Reason string `json:"reason,omitempty"` // "unspecified" by default.
+}
+
+// Error represents an error returned by the API.
+type Error struct {
+	StatusCode int    `json:"-"`
+	Message    string `json:"error"`
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%d %s: %s", e.StatusCode, http.StatusText(e.StatusCode), e.Message)
+}
+
+// Client is a client of the API of a portal.
+type Client struct {
+	URL   string // URL of the portal, i.e. "https://ca.example.com:8080".
+	Token string // Token of the administrators, to approve or deny requests.
+
+	// HTTPClient is used to send the requests; http.DefaultClient whether it
+	// is nil. It holds the client certificate which identifies the operator.
+	HTTPClient *http.Client
+}
+
+// New returns a client of the portal at `url`.
+func New(url, token string) *Client {
+	return &Client{URL: strings.TrimSuffix(url, "/"), Token: token}
+}
+
+// List returns the requests of the queue.
+func (c *Client) List() ([]*Request, error) {
+	var list []*Request
+	err := c.do("GET", "/requests", nil, &list)
+	return list, err
+}
+
+// Submit adds a certificate request to the queue, pending of approval.
+func (c *Client) Submit(s Submission) (*Request, error) {
+	req := new(Request)
+	err := c.do("POST", "/requests", s, req)
+	return req, err
+}
+
+// Get returns the request `id`.
+func (c *Client) Get(id string) (*Request, error) {
+	req := new(Request)
+	err := c.do("GET", "/requests/"+url.PathEscape(id), nil, req)
+	return req, err
+}
+
+// Approve signs the request `id`; it needs the token.
+func (c *Client) Approve(id string) (*Request, error) {
+	req := new(Request)
+	err := c.do("POST", "/requests/"+url.PathEscape(id)+"/approve", nil, req)
+	return req, err
+}
+
+// Deny denies the request `id`; it needs the token.
+func (c *Client) Deny(id string) (*Request, error) {
+	req := new(Request)
+	err := c.do("POST", "/requests/"+url.PathEscape(id)+"/deny", nil, req)
+	return req, err
+}
+
+// Cert returns the certificate issued for the request `id`, in PEM format.
+func (c *Client) Cert(id string) ([]byte, error) {
+	var cert []byte
+	err := c.do("GET", "/requests/"+url.PathEscape(id)+"/cert", nil, &cert)
+	return cert, err
+}
+
+// Certificates returns the certificates of the portal.
+func (c *Client) Certificates() ([]*Certificate, error) {
+	var list []*Certificate
+	err := c.do("GET", "/certs", nil, &list)
+	return list, err
+}
+
+// Certificate returns the certificate `name`, in PEM format.
+func (c *Client) Certificate(name string) ([]byte, error) {
+	var cert []byte
+	err := c.do("GET", "/certs/"+url.PathEscape(name), nil, &cert)
+	return cert, err
+}
+
+// Revoke revokes the certificate `name` with the reason given, and the portal
+// generates its revocation list; it needs the token.
+func (c *Client) Revoke(name, reason string) (*Certificate, error) {
+	cert := new(Certificate)
+	err := c.do("POST", "/certs/"+url.PathEscape(name)+"/revoke", Revocation{reason}, cert)
+	return cert, err
+}
+
+// do sends a request to the API with `in` in JSON format, whether it is not
+// nil, and decodes the response into `out`; a pointer to []byte gets the body
+// as is.
+func (c *Client) do(method, path string, in, out interface{}) error {
+	var body io.Reader
+	if in != nil {
+		data, err := json.Marshal(in)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(data)
+	}
+
+	req, err := http.NewRequest(method, c.URL+API_PATH+path, body)
+	if err != nil {
+		return err
+	}
+	if in != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if c.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.Token)
+	}
+
+	client := c.HTTPClient
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode/100 != 2 {
+		e := &Error{StatusCode: resp.StatusCode}
+		if json.Unmarshal(data, e) != nil || e.Message == "" {
+			e.Message = strings.TrimSpace(string(data))
+		}
+		return e
+	}
+
+	if b, ok := out.(*[]byte); ok {
+		*b = data
+		return nil
+	}
+	return json.Unmarshal(data, out)
+}
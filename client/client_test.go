@@ -0,0 +1,91 @@
+// Copyright 2014 Jonas mg
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package client
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestClient(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method + " " + r.URL.Path {
+		case "GET " + API_PATH + "/requests":
+			json.NewEncoder(w).Encode([]*Request{{ID: "1", Status: STATUS_PENDING}})
+		case "POST " + API_PATH + "/requests":
+			var s Submission
+			if err := json.NewDecoder(r.Body).Decode(&s); err != nil || s.CSR == "" {
+				w.WriteHeader(http.StatusBadRequest)
+				json.NewEncoder(w).Encode(Error{Message: "no request"})
+				return
+			}
+			w.WriteHeader(http.StatusCreated)
+			json.NewEncoder(w).Encode(Request{ID: "2", Name: s.Name, Status: STATUS_PENDING})
+		case "POST " + API_PATH + "/requests/2/approve":
+			if r.Header.Get("Authorization") != "Bearer secret" {
+				w.WriteHeader(http.StatusUnauthorized)
+				json.NewEncoder(w).Encode(Error{Message: "invalid token"})
+				return
+			}
+			json.NewEncoder(w).Encode(Request{ID: "2", Status: STATUS_APPROVED})
+		case "GET " + API_PATH + "/requests/2/cert":
+			w.Write([]byte("-----BEGIN CERTIFICATE-----\n"))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+
+	c := New(srv.URL+"/", "")
+
+	list, err := c.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 1 || list[0].ID != "1" {
+		t.Errorf("list: got %+v", list)
+	}
+
+	if _, err = c.Submit(Submission{Name: "dev"}); err == nil {
+		t.Error("submit without request: got no error")
+	} else if e := err.(*Error); e.StatusCode != http.StatusBadRequest || e.Message != "no request" {
+		t.Errorf("submit without request: got error %q", e)
+	}
+	req, err := c.Submit(Submission{Name: "dev", CSR: "csr"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if req.ID != "2" || req.Name != "dev" {
+		t.Errorf("submit: got %+v", req)
+	}
+
+	if _, err = c.Approve(req.ID); err == nil || err.(*Error).StatusCode != http.StatusUnauthorized {
+		t.Errorf("approve without token: got %v, want status 401", err)
+	}
+	c.Token = "secret"
+	if req, err = c.Approve(req.ID); err != nil {
+		t.Fatal(err)
+	}
+	if req.Status != STATUS_APPROVED {
+		t.Errorf("approve: got status %q", req.Status)
+	}
+
+	cert, err := c.Cert(req.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(cert) != "-----BEGIN CERTIFICATE-----\n" {
+		t.Errorf("cert: got %q", cert)
+	}
+
+	// An error without a body in JSON.
+	if _, err = c.Get("3"); err == nil || err.(*Error).Message != "404 page not found" {
+		t.Errorf("get of missing request: got %v", err)
+	}
+}
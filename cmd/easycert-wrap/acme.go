@@ -0,0 +1,399 @@
+// Copyright 2014 Jonas mg
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+// Client of the ACME protocol (RFC 8555), to get certificates from Let's
+// Encrypt or any other ACME server.
+
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// DEFAULT_ACME_DIRECTORY is the directory of the production server of Let's
+// Encrypt.
+const DEFAULT_ACME_DIRECTORY = "https://acme-v02.api.letsencrypt.org/directory"
+
+// Types of challenges.
+const (
+	ACME_HTTP01 = "http-01"
+	ACME_DNS01  = "dns-01"
+)
+
+// Status of the orders, authorizations and challenges.
+const (
+	ACME_PENDING    = "pending"
+	ACME_READY      = "ready"
+	ACME_PROCESSING = "processing"
+	ACME_VALID      = "valid"
+	ACME_INVALID    = "invalid"
+)
+
+// _ACME_BAD_NONCE is the type of the error returned with a nonce rejected,
+// whose request has to be retried.
+const _ACME_BAD_NONCE = "urn:ietf:params:acme:error:badNonce"
+
+// Time between the checks of the status of an order or authorization, and
+// number of checks until to give up.
+var (
+	acmePollInterval = 2 * time.Second
+	acmePollTries    = 90
+)
+
+// acmeDirectory holds the URLs of the resources of the server.
+type acmeDirectory struct {
+	NewNonce   string `json:"newNonce"`
+	NewAccount string `json:"newAccount"`
+	NewOrder   string `json:"newOrder"`
+}
+
+// acmeIdentifier is the identifier of a domain.
+type acmeIdentifier struct {
+	Type  string `json:"type"`
+	Value string `json:"value"`
+}
+
+// acmeProblem is an error returned by the server (RFC 7807).
+type acmeProblem struct {
+	Type   string `json:"type"`
+	Detail string `json:"detail"`
+	Status int    `json:"status"`
+}
+
+func (p *acmeProblem) Error() string {
+	return fmt.Sprintf("acme: %s (%s)", p.Detail, p.Type)
+}
+
+// acmeOrder is the order of a certificate.
+type acmeOrder struct {
+	URL            string           `json:"-"`
+	Status         string           `json:"status"`
+	Identifiers    []acmeIdentifier `json:"identifiers"`
+	Authorizations []string         `json:"authorizations"`
+	Finalize       string           `json:"finalize"`
+	Certificate    string           `json:"certificate,omitempty"`
+	Error          *acmeProblem     `json:"error,omitempty"`
+}
+
+// acmeAuthz is the authorization of an identifier, with its challenges.
+type acmeAuthz struct {
+	Status     string          `json:"status"`
+	Identifier acmeIdentifier  `json:"identifier"`
+	Challenges []acmeChallenge `json:"challenges"`
+	Wildcard   bool            `json:"wildcard,omitempty"`
+}
+
+// acmeChallenge is a challenge to prove the control of an identifier.
+type acmeChallenge struct {
+	Type   string       `json:"type"`
+	URL    string       `json:"url"`
+	Token  string       `json:"token"`
+	Status string       `json:"status"`
+	Error  *acmeProblem `json:"error,omitempty"`
+}
+
+// challenge returns the challenge of the type, or nil.
+func (a *acmeAuthz) challenge(typ string) *acmeChallenge {
+	for i, v := range a.Challenges {
+		if v.Type == typ {
+			return &a.Challenges[i]
+		}
+	}
+	return nil
+}
+
+// acmeClient is the client of an ACME server, with the key of the account.
+type acmeClient struct {
+	dir    acmeDirectory
+	key    *ecdsa.PrivateKey
+	kid    string // URL of the account, once it is registered.
+	nonces []string
+	client *http.Client
+}
+
+// newACMEClient gets the directory of the server at the URL.
+func newACMEClient(directory string, key *ecdsa.PrivateKey) (*acmeClient, error) {
+	c := &acmeClient{
+		key:    key,
+		client: &http.Client{Timeout: 30 * time.Second},
+	}
+
+	resp, err := c.client.Get(directory)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("acme: directory %s: %s", directory, resp.Status)
+	}
+	if err = json.NewDecoder(resp.Body).Decode(&c.dir); err != nil {
+		return nil, fmt.Errorf("acme: directory %s: %s", directory, err)
+	}
+	if c.dir.NewNonce == "" || c.dir.NewAccount == "" || c.dir.NewOrder == "" {
+		return nil, fmt.Errorf("acme: directory %s is incomplete", directory)
+	}
+	return c, nil
+}
+
+// b64 encodes in base64url without padding, like the JWS.
+func b64(data []byte) string {
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// jwk returns the public key of the account like a JSON Web Key, with its
+// members in lexicographic order, as required to get its thumbprint.
+func (c *acmeClient) jwk() string {
+	size := (c.key.Curve.Params().BitSize + 7) / 8
+	return fmt.Sprintf(`{"crv":"P-256","kty":"EC","x":"%s","y":"%s"}`,
+		b64(c.key.X.FillBytes(make([]byte, size))),
+		b64(c.key.Y.FillBytes(make([]byte, size))),
+	)
+}
+
+// keyAuthorization returns the key authorization of the token of a challenge.
+func (c *acmeClient) keyAuthorization(token string) string {
+	sum := sha256.Sum256([]byte(c.jwk()))
+	return token + "." + b64(sum[:])
+}
+
+// dnsValue returns the value of the TXT record of a challenge DNS-01.
+func (c *acmeClient) dnsValue(token string) string {
+	sum := sha256.Sum256([]byte(c.keyAuthorization(token)))
+	return b64(sum[:])
+}
+
+// nonce returns a fresh nonce, got from the last response or else requested.
+func (c *acmeClient) nonce() (string, error) {
+	if n := len(c.nonces); n != 0 {
+		v := c.nonces[n-1]
+		c.nonces = c.nonces[:n-1]
+		return v, nil
+	}
+
+	resp, err := c.client.Head(c.dir.NewNonce)
+	if err != nil {
+		return "", err
+	}
+	resp.Body.Close()
+
+	v := resp.Header.Get("Replay-Nonce")
+	if v == "" {
+		return "", errors.New("acme: no nonce from the server")
+	}
+	return v, nil
+}
+
+// sign returns the request in JWS with the payload, identified by the key
+// whether the account is not registered yet. An empty payload is a
+// "POST-as-GET".
+func (c *acmeClient) sign(url string, payload []byte) ([]byte, error) {
+	nonce, err := c.nonce()
+	if err != nil {
+		return nil, err
+	}
+	protected := fmt.Sprintf(`{"alg":"ES256","nonce":%q,"url":%q,`, nonce, url)
+	if c.kid == "" {
+		protected += `"jwk":` + c.jwk() + "}"
+	} else {
+		protected += fmt.Sprintf(`"kid":%q}`, c.kid)
+	}
+
+	input := b64([]byte(protected)) + "." + b64(payload)
+	sum := sha256.Sum256([]byte(input))
+	r, s, err := ecdsa.Sign(rand.Reader, c.key, sum[:])
+	if err != nil {
+		return nil, err
+	}
+	sig := make([]byte, 64)
+	r.FillBytes(sig[:32])
+	s.FillBytes(sig[32:])
+
+	return json.Marshal(map[string]string{
+		"protected": b64([]byte(protected)),
+		"payload":   b64(payload),
+		"signature": b64(sig),
+	})
+}
+
+// post sends the payload to the URL, decoding the response into `out`
+// whether it is not nil; it retries once whether the nonce is rejected.
+func (c *acmeClient) post(url string, in, out interface{}) (*http.Response, []byte, error) {
+	var payload []byte
+	if in != nil {
+		var err error
+		if payload, err = json.Marshal(in); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	for retry := 0; ; retry++ {
+		body, err := c.sign(url, payload)
+		if err != nil {
+			return nil, nil, err
+		}
+		resp, err := c.client.Post(url, "application/jose+json", bytes.NewReader(body))
+		if err != nil {
+			return nil, nil, err
+		}
+		data, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			return nil, nil, err
+		}
+		if v := resp.Header.Get("Replay-Nonce"); v != "" {
+			c.nonces = append(c.nonces, v)
+		}
+
+		if resp.StatusCode >= 400 {
+			problem := &acmeProblem{Status: resp.StatusCode}
+			if json.Unmarshal(data, problem) != nil || problem.Detail == "" {
+				problem.Detail = resp.Status
+			}
+			if problem.Type == _ACME_BAD_NONCE && retry == 0 {
+				continue
+			}
+			return nil, nil, problem
+		}
+		if out != nil {
+			if err = json.Unmarshal(data, out); err != nil {
+				return nil, nil, fmt.Errorf("acme: %s: %s", url, err)
+			}
+		}
+		return resp, data, nil
+	}
+}
+
+// register creates the account of the key, or gets it whether it already
+// exists, agreeing the terms of service.
+func (c *acmeClient) register(email string) error {
+	account := map[string]interface{}{"termsOfServiceAgreed": true}
+	if email != "" {
+		account["contact"] = []string{"mailto:" + email}
+	}
+
+	resp, _, err := c.post(c.dir.NewAccount, account, nil)
+	if err != nil {
+		return err
+	}
+	if c.kid = resp.Header.Get("Location"); c.kid == "" {
+		return errors.New("acme: no URL of the account")
+	}
+	return nil
+}
+
+// newOrder requests a certificate for the domains.
+func (c *acmeClient) newOrder(domains []string) (*acmeOrder, error) {
+	ids := make([]acmeIdentifier, len(domains))
+	for i, v := range domains {
+		ids[i] = acmeIdentifier{Type: "dns", Value: v}
+	}
+
+	order := new(acmeOrder)
+	resp, _, err := c.post(c.dir.NewOrder, map[string]interface{}{"identifiers": ids}, order)
+	if err != nil {
+		return nil, err
+	}
+	order.URL = resp.Header.Get("Location")
+	return order, nil
+}
+
+// authz returns the authorization at the URL.
+func (c *acmeClient) authz(url string) (*acmeAuthz, error) {
+	authz := new(acmeAuthz)
+	if _, _, err := c.post(url, nil, authz); err != nil {
+		return nil, err
+	}
+	return authz, nil
+}
+
+// accept tells the server that the challenge is ready to be validated, and
+// waits until the authorization is valid.
+func (c *acmeClient) accept(authzURL string, chal *acmeChallenge) error {
+	if _, _, err := c.post(chal.URL, struct{}{}, nil); err != nil {
+		return err
+	}
+
+	for i := 0; i < acmePollTries; i++ {
+		authz, err := c.authz(authzURL)
+		if err != nil {
+			return err
+		}
+		switch authz.Status {
+		case ACME_VALID:
+			return nil
+		case ACME_PENDING:
+		default:
+			if v := authz.challenge(chal.Type); v != nil && v.Error != nil {
+				return fmt.Errorf("%s of %s: %s", chal.Type, authz.Identifier.Value, v.Error)
+			}
+			return fmt.Errorf("acme: authorization of %s is %s", authz.Identifier.Value, authz.Status)
+		}
+		time.Sleep(acmePollInterval)
+	}
+	return fmt.Errorf("acme: timeout validating %s", chal.URL)
+}
+
+// finalize sends the certificate request in DER format, waits until the
+// certificate is issued and returns it with its chain, in PEM format.
+func (c *acmeClient) finalize(order *acmeOrder, csr []byte) ([]byte, error) {
+	if _, _, err := c.post(order.Finalize, map[string]string{"csr": b64(csr)}, order); err != nil {
+		return nil, err
+	}
+
+	for i := 0; order.Status != ACME_VALID; i++ {
+		if order.Status == ACME_INVALID {
+			if order.Error != nil {
+				return nil, order.Error
+			}
+			return nil, errors.New("acme: order is invalid")
+		}
+		if i == acmePollTries {
+			return nil, errors.New("acme: timeout waiting for the certificate")
+		}
+		time.Sleep(acmePollInterval)
+		if _, _, err := c.post(order.URL, nil, order); err != nil {
+			return nil, err
+		}
+	}
+
+	_, data, err := c.post(order.Certificate, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	if !strings.Contains(string(data), "-----BEGIN CERTIFICATE") {
+		return nil, errors.New("acme: the certificate is not in PEM format")
+	}
+	return data, nil
+}
+
+// newACMEAccountKey generates the key of an account.
+func newACMEAccountKey() (crypto.Signer, error) {
+	return ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+}
+
+// acmeAccountKey returns the key like the one of an account, which has to be
+// ECDSA with the curve P-256 to sign with ES256.
+func acmeAccountKey(key crypto.Signer) (*ecdsa.PrivateKey, error) {
+	k, ok := key.(*ecdsa.PrivateKey)
+	if !ok || k.Curve != elliptic.P256() {
+		return nil, errors.New("acme: the key of the account has to be ECDSA P-256")
+	}
+	return k, nil
+}
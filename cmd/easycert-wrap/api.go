@@ -0,0 +1,471 @@
+// Copyright 2014 Jonas mg
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"crypto/subtle"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/tredoe/easycert"
+	"github.com/tredoe/easycert/client"
+)
+
+// REST API of the portal, in JSON format, used by the package "client". Its
+// description in OpenAPI is generated from the routes.
+
+// _API_MAX_BODY is the maximum size of the body of a request to the API.
+const _API_MAX_BODY = 1 << 20
+
+var (
+	errInvalidToken = errors.New("invalid token")
+	errCertName     = errors.New("certificate not found")
+)
+
+// apiRoute is a route of the API.
+type apiRoute struct {
+	method  string
+	path    string // relative to client.API_PATH, with a parameter like "{id}"
+	id      string // operationId of OpenAPI
+	summary string
+	admin   bool   // requires the token of the administrators
+	body    string // schema of the body of the request
+	resp    string // schema of the response; PEM whether it is empty
+	status  int    // status code on success
+	handler http.HandlerFunc
+}
+
+var apiRoutes = []apiRoute{
+	{"GET", "/requests", "listRequests", "List the requests of the queue",
+		false, "", "RequestList", http.StatusOK, apiList},
+	{"POST", "/requests", "submitRequest", "Submit a certificate request, pending of approval",
+		false, "Submission", "Request", http.StatusCreated, apiSubmit},
+	{"GET", "/requests/{id}", "getRequest", "Get a request",
+		false, "", "Request", http.StatusOK, apiGet},
+	{"POST", "/requests/{id}/approve", "approveRequest", "Approve a pending request, signing it",
+		true, "", "Request", http.StatusOK, apiReview},
+	{"POST", "/requests/{id}/deny", "denyRequest", "Deny a pending request",
+		true, "", "Request", http.StatusOK, apiReview},
+	{"GET", "/requests/{id}/cert", "getCert", "Download the certificate issued for an approved request",
+		false, "", "", http.StatusOK, apiCert},
+	{"GET", "/certs", "listCertificates", "List the certificates",
+		false, "", "CertificateList", http.StatusOK, apiCerts},
+	{"GET", "/certs/{name}", "getCertificate", "Download a certificate",
+		false, "", "", http.StatusOK, apiCertificate},
+	{"POST", "/certs/{name}/revoke", "revokeCertificate", "Revoke a certificate, generating the revocation list",
+		true, "Revocation", "Certificate", http.StatusOK, apiRevoke},
+}
+
+// apiSchemas are the types of the schemas of the API.
+var apiSchemas = map[string]reflect.Type{
+	"Request":     reflect.TypeOf(client.Request{}),
+	"Submission":  reflect.TypeOf(client.Submission{}),
+	"Certificate": reflect.TypeOf(client.Certificate{}),
+	"Revocation":  reflect.TypeOf(client.Revocation{}),
+	"Error":       reflect.TypeOf(client.Error{}),
+}
+
+// apiParams are the descriptions of the parameters of the paths.
+var apiParams = map[string]string{
+	"id":   "ID of the request",
+	"name": "Name of the certificate",
+}
+
+// apiHandle adds the routes of the API to the multiplexer, and the description
+// in OpenAPI. The routes are matched here, since the patterns with method and
+// wildcards of http.ServeMux depend on the version of Go of the module.
+func apiHandle(mux *http.ServeMux) {
+	handlers := make([]http.HandlerFunc, len(apiRoutes))
+	for i, v := range apiRoutes {
+		handlers[i] = traced(client.API_PATH+v.path, v.handler)
+	}
+
+	mux.HandleFunc(client.API_PATH+"/", func(w http.ResponseWriter, r *http.Request) {
+		path := strings.TrimPrefix(r.URL.Path, client.API_PATH)
+		if path == "/openapi.json" && r.Method == "GET" {
+			w.Header().Set("Content-Type", "application/json")
+			w.Write(openAPISpec())
+			return
+		}
+
+		found := false
+		for i, v := range apiRoutes {
+			param, value, ok := apiMatch(v.path, path)
+			if !ok {
+				continue
+			}
+			if v.method != r.Method {
+				found = true
+				continue
+			}
+			if v.admin && !apiAdmin(r) {
+				w.Header().Set("WWW-Authenticate", "Bearer")
+				apiError(w, http.StatusUnauthorized, errInvalidToken)
+				return
+			}
+			if param != "" {
+				r.SetPathValue(param, value)
+			}
+			handlers[i](w, r)
+			return
+		}
+		if found {
+			apiError(w, http.StatusMethodNotAllowed, errors.New(http.StatusText(http.StatusMethodNotAllowed)))
+			return
+		}
+		apiError(w, http.StatusNotFound, errors.New(http.StatusText(http.StatusNotFound)))
+	})
+}
+
+// apiMatch reports whether the path matches the pattern of a route, returning
+// the name and the value of its parameter.
+func apiMatch(pattern, path string) (param, value string, ok bool) {
+	pp := strings.Split(pattern, "/")
+	p := strings.Split(path, "/")
+	if len(pp) != len(p) {
+		return "", "", false
+	}
+	for i := range pp {
+		switch {
+		case strings.HasPrefix(pp[i], "{") && p[i] != "":
+			param, value = strings.Trim(pp[i], "{}"), p[i]
+		case pp[i] != p[i]:
+			return "", "", false
+		}
+	}
+	return param, value, true
+}
+
+// apiAdmin reports whether the request has the token of the administrators
+// like bearer token.
+func apiAdmin(r *http.Request) bool {
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return subtle.ConstantTimeCompare([]byte(token), []byte(*Token)) == 1
+}
+
+func apiJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Print(err)
+	}
+}
+
+func apiError(w http.ResponseWriter, status int, err error) {
+	apiJSON(w, status, client.Error{Message: err.Error()})
+}
+
+// apiErrorStatus returns the status code of the errors of the queue.
+func apiErrorStatus(err error) int {
+	switch err {
+	case errQueueID:
+		return http.StatusNotFound
+	case errQueueDone:
+		return http.StatusConflict
+	}
+	return http.StatusBadRequest
+}
+
+func apiList(w http.ResponseWriter, r *http.Request) {
+	list, err := listQueue()
+	if err != nil {
+		apiError(w, http.StatusInternalServerError, err)
+		return
+	}
+	apiJSON(w, http.StatusOK, list)
+}
+
+func apiSubmit(w http.ResponseWriter, r *http.Request) {
+	var s client.Submission
+
+	if err := json.NewDecoder(io.LimitReader(r.Body, _API_MAX_BODY)).Decode(&s); err != nil {
+		apiError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	var attestation []byte
+	if s.Attestation != "" {
+		attestation = []byte(s.Attestation)
+	}
+	var req *queueReq
+	err := traceStep(spanOf(r), "queue.add", func() (err error) {
+		req, err = addQueue(s.Name, []byte(s.CSR), attestation, "api", portalOperator(r))
+		return err
+	})
+	if err != nil {
+		apiError(w, http.StatusBadRequest, err)
+		return
+	}
+	apiJSON(w, http.StatusCreated, req)
+}
+
+func apiGet(w http.ResponseWriter, r *http.Request) {
+	req, err := getQueue(r.PathValue("id"))
+	if err != nil {
+		apiError(w, apiErrorStatus(err), err)
+		return
+	}
+	apiJSON(w, http.StatusOK, req)
+}
+
+// apiReview approves or denies a request.
+func apiReview(w http.ResponseWriter, r *http.Request) {
+	operator, err := portalReviewer(r)
+	if err != nil {
+		apiError(w, http.StatusForbidden, err)
+		return
+	}
+
+	req, err := getQueue(r.PathValue("id"))
+	if err == nil {
+		req.span = spanOf(r)
+		if strings.HasSuffix(r.URL.Path, "/approve") {
+			err = req.approve(operator)
+		} else {
+			err = req.deny(operator)
+		}
+	}
+	if err != nil {
+		apiError(w, apiErrorStatus(err), err)
+		return
+	}
+	apiJSON(w, http.StatusOK, req)
+}
+
+func apiCert(w http.ResponseWriter, r *http.Request) {
+	req, err := getQueue(r.PathValue("id"))
+	if err == nil && req.Status != STATUS_APPROVED {
+		err = errQueueDone
+	}
+	if err != nil {
+		apiError(w, http.StatusNotFound, err)
+		return
+	}
+
+	data, err := os.ReadFile(req.certFile())
+	if err != nil {
+		apiError(w, http.StatusInternalServerError, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/x-pem-file")
+	w.Write(data)
+}
+
+func apiCerts(w http.ResponseWriter, r *http.Request) {
+	entries, err := readIndex()
+	if err != nil {
+		apiError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	list := make([]*client.Certificate, 0)
+	for _, v := range loadCerts() {
+		list = append(list, apiCertificateOf(v.Name, v.Cert, findIndex(entries, v.Cert.SerialNumber)))
+	}
+	apiJSON(w, http.StatusOK, list)
+}
+
+func apiCertificate(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+	if !validName.MatchString(name) {
+		apiError(w, http.StatusNotFound, errCertName)
+		return
+	}
+
+	data, err := os.ReadFile(filepath.Join(Dir.Cert, name+EXT_CERT))
+	if err != nil {
+		if os.IsNotExist(err) {
+			apiError(w, http.StatusNotFound, errCertName)
+		} else {
+			apiError(w, http.StatusInternalServerError, err)
+		}
+		return
+	}
+	w.Header().Set("Content-Type", "application/x-pem-file")
+	w.Write(data)
+}
+
+func apiRevoke(w http.ResponseWriter, r *http.Request) {
+	var rev client.Revocation
+
+	if err := json.NewDecoder(io.LimitReader(r.Body, _API_MAX_BODY)).Decode(&rev); err != nil {
+		apiError(w, http.StatusBadRequest, err)
+		return
+	}
+	if rev.Reason == "" {
+		rev.Reason = REASON_UNSPECIFIED
+	}
+
+	name := r.PathValue("name")
+	if !validName.MatchString(name) {
+		apiError(w, http.StatusNotFound, errCertName)
+		return
+	}
+	operator, err := portalReviewer(r)
+	if err != nil {
+		apiError(w, http.StatusForbidden, err)
+		return
+	}
+	entry, err := revokeName(name, rev.Reason, operator)
+	if err != nil {
+		apiError(w, http.StatusBadRequest, err)
+		return
+	}
+	cert, err := parseCertFile(filepath.Join(Dir.Cert, name+EXT_CERT))
+	if err != nil {
+		apiError(w, http.StatusInternalServerError, err)
+		return
+	}
+	apiJSON(w, http.StatusOK, apiCertificateOf(name, cert, entry))
+}
+
+// apiCertificateOf returns the certificate of the API, with the status of its
+// entry in the database of the CA.
+func apiCertificateOf(name string, cert *x509.Certificate, entry *indexEntry) *client.Certificate {
+	c := &client.Certificate{
+		Name:     name,
+		Subject:  cert.Subject.String(),
+		Serial:   easycert.SerialHex(cert.SerialNumber),
+		NotAfter: cert.NotAfter,
+		Status:   client.CERT_VALID,
+	}
+	switch {
+	case entry != nil && entry.Status == INDEX_REVOKED:
+		c.Status = client.CERT_REVOKED
+	case entry != nil && entry.Status == INDEX_EXPIRED, time.Now().After(cert.NotAfter):
+		c.Status = client.CERT_EXPIRED
+	}
+	return c
+}
+
+// == OpenAPI
+//
+
+// openAPISpec returns the description of the API in OpenAPI 3, in JSON format.
+func openAPISpec() []byte {
+	type object = map[string]interface{}
+
+	ref := func(name string) object { return object{"$ref": "#/components/schemas/" + name} }
+	content := func(schema object) object {
+		return object{"application/json": object{"schema": schema}}
+	}
+
+	paths := make(object)
+	for _, v := range apiRoutes {
+		op := object{
+			"operationId": v.id,
+			"summary":     v.summary,
+		}
+		for _, seg := range strings.Split(v.path, "/") {
+			if param := strings.Trim(seg, "{}"); param != seg {
+				op["parameters"] = []object{{
+					"name": param, "in": "path", "required": true,
+					"description": apiParams[param],
+					"schema":      object{"type": "string"},
+				}}
+			}
+		}
+		if v.body != "" {
+			op["requestBody"] = object{"required": true, "content": content(ref(v.body))}
+		}
+
+		success := object{"description": http.StatusText(v.status)}
+		switch v.resp {
+		case "":
+			success["content"] = object{"application/x-pem-file": object{"schema": object{"type": "string"}}}
+		case "RequestList":
+			success["content"] = content(object{"type": "array", "items": ref("Request")})
+		case "CertificateList":
+			success["content"] = content(object{"type": "array", "items": ref("Certificate")})
+		default:
+			success["content"] = content(ref(v.resp))
+		}
+		responses := object{
+			strconv.Itoa(v.status): success,
+			"default":              object{"description": "Error", "content": content(ref("Error"))},
+		}
+		if v.admin {
+			op["security"] = []object{{"token": []string{}}}
+		}
+		op["responses"] = responses
+
+		path, _ := paths[client.API_PATH+v.path].(object)
+		if path == nil {
+			path = make(object)
+			paths[client.API_PATH+v.path] = path
+		}
+		path[strings.ToLower(v.method)] = op
+	}
+
+	schemas := make(object)
+	for name, t := range apiSchemas {
+		schemas[name] = openAPISchema(t)
+	}
+
+	spec := object{
+		"openapi": "3.0.3",
+		"info": object{
+			"title":       PROGRAM + " portal",
+			"description": "Queue of certificate requests of the portal (\"" + PROGRAM + " serve\").",
+			"version":     "1",
+		},
+		"paths": paths,
+		"components": object{
+			"schemas": schemas,
+			"securitySchemes": object{
+				"token": object{"type": "http", "scheme": "bearer", "description": "Token of the administrators"},
+			},
+		},
+	}
+	data, err := json.MarshalIndent(spec, "", "  ")
+	if err != nil {
+		panic(err)
+	}
+	return append(data, '\n')
+}
+
+// openAPISchema returns the schema of the structure, from the JSON tags of its
+// fields.
+func openAPISchema(t reflect.Type) map[string]interface{} {
+	props := make(map[string]interface{})
+	var required []string
+
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		name, opts, _ := strings.Cut(f.Tag.Get("json"), ",")
+		if name == "-" || name == "" {
+			continue
+		}
+
+		var prop map[string]interface{}
+		switch {
+		case f.Type == reflect.TypeOf(time.Time{}):
+			prop = map[string]interface{}{"type": "string", "format": "date-time"}
+		case f.Type.Kind() == reflect.Bool:
+			prop = map[string]interface{}{"type": "boolean"}
+		case f.Type.Kind() == reflect.Int:
+			prop = map[string]interface{}{"type": "integer"}
+		default:
+			prop = map[string]interface{}{"type": "string"}
+		}
+		props[name] = prop
+		if opts != "omitempty" {
+			required = append(required, name)
+		}
+	}
+	return map[string]interface{}{"type": "object", "properties": props, "required": required}
+}
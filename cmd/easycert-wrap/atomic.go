@@ -0,0 +1,134 @@
+// Copyright 2014 Jonas mg
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+// Atomic writes, so a crash never leaves a truncated file in the certificates
+// directory.
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+)
+
+// tempFile creates an empty temporary file, only accessible by the owner, in the
+// directory of `file`, so it can be renamed to `file` once it is written.
+//
+// The temporary file, and the file committed, are recorded in the issuance in
+// progress.
+func tempFile(file string) (string, error) {
+	f, err := os.CreateTemp(filepath.Dir(file), "."+filepath.Base(file)+".tmp-")
+	if err != nil {
+		return "", err
+	}
+	if err = f.Close(); err != nil {
+		os.Remove(f.Name())
+		return "", err
+	}
+	curIssuance.addFile(f.Name())
+	return f.Name(), nil
+}
+
+// mustTempFile is like tempFile but exits on error, rolling back the issuance
+// in progress.
+func mustTempFile(file string) string {
+	tmp, err := tempFile(file)
+	if err != nil {
+		fatal(err)
+	}
+	return tmp
+}
+
+// commitFile flushes the temporary file to disk and renames it to `file`,
+// setting its permissions.
+func commitFile(tmp, file string, perm os.FileMode) error {
+	err := syncFiles(tmp)
+	if err == nil {
+		err = os.Chmod(tmp, perm)
+	}
+	if err == nil {
+		err = os.Rename(tmp, file)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	curIssuance.addFile(file)
+	return syncDir(filepath.Dir(file))
+}
+
+// mustCommitFile is like commitFile but exits on error, rolling back the
+// issuance in progress.
+func mustCommitFile(tmp, file string, perm os.FileMode) {
+	if err := commitFile(tmp, file, perm); err != nil {
+		fatal(err)
+	}
+}
+
+// writeFileAtomic writes the data to a temporary file which is renamed to
+// `file`, once it is on disk.
+func writeFileAtomic(file string, data []byte, perm os.FileMode) error {
+	tmp, err := tempFile(file)
+	if err != nil {
+		return err
+	}
+	if err = os.WriteFile(tmp, data, 0600); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return commitFile(tmp, file, perm)
+}
+
+// syncFiles flushes the files to disk, skipping the ones which do not exist.
+func syncFiles(files ...string) error {
+	for _, v := range files {
+		f, err := os.OpenFile(v, os.O_RDWR, 0)
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return err
+		}
+		err = f.Sync()
+		if errClose := f.Close(); err == nil {
+			err = errClose
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// syncDir flushes the directory to disk, so a rename is durable.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	err = d.Sync()
+	if errClose := d.Close(); err == nil {
+		err = errClose
+	}
+	return err
+}
+
+// syncDatabase flushes to disk the database of the CA, updated by OpenSSL when
+// a certificate is signed, and stores it into the database of the CA.
+func syncDatabase() error {
+	err := syncFiles(File.Index, File.Index+".attr", File.Serial, File.CRLNumber, File.CRL)
+	if err == nil {
+		err = syncDir(Dir.NewCert)
+	}
+	if err == nil {
+		err = syncDir(Dir.Root)
+	}
+	// The database keeps the one of the root CA.
+	if err == nil && issuerCA == NAME_CA {
+		err = storeDatabase()
+	}
+	return err
+}
@@ -0,0 +1,230 @@
+// Copyright 2014 Jonas mg
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"crypto"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+)
+
+// HOOK_ATTEST is the hook which verifies the attestation of the key of a
+// request whose statement is not a chain of certificates (i.e. TPM); an exit
+// status non-zero rejects it. The chains of Android and Apple are verified
+// against the roots of Google and Apple, without the hook.
+// The statement is passed in EASYCERT_ATTESTATION and the request in
+// EASYCERT_REQUEST; the public key of the request, which the statement has to
+// attest, is passed in EASYCERT_SPKI (DER in base64) and EASYCERT_SPKI_SHA256.
+const HOOK_ATTEST = "verify-attestation"
+
+// ATTEST_MAX_SIZE is the maximum size of an attestation statement.
+const ATTEST_MAX_SIZE = 1 << 20
+
+var AttestFile = flag.String("attestation", "", "file with the attestation statement of the key")
+
+var (
+	errNoAttestation = errors.New("the store requires an attestation of the key (\"require_attestation\")")
+	errNoVerifier    = errors.New("attestation without verifier: the hook \"" + HOOK_ATTEST + "\" does not exist")
+	errAttestSize    = errors.New("attestation statement too big")
+	errAttestKey     = errors.New("the attested key is not the one of the request")
+	errAttestChain   = errors.New("attestation chain not issued by the roots of Google nor Apple")
+)
+
+// oidKeyDescription is the extension of the attestation of Android, in the
+// certificate of the attested key.
+var oidKeyDescription = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 11129, 2, 1, 17}
+
+// keyDescription is the start of the extension of the attestation of Android;
+// the rest of fields are not checked.
+type keyDescription struct {
+	AttestationVersion       int
+	AttestationSecurityLevel asn1.Enumerated
+	KeymasterVersion         int
+	KeymasterSecurityLevel   asn1.Enumerated
+}
+
+// _SECURITY_SOFTWARE is the security level of the keys of Android out of the
+// secure hardware (TEE or StrongBox).
+const _SECURITY_SOFTWARE = 0
+
+// attestVendor verifies the chains of attestation of a vendor.
+type attestVendor struct {
+	name  string
+	roots *x509.CertPool
+	// check checks the certificate of the attested key, if any.
+	check func(*x509.Certificate) error
+}
+
+var attestVendors = []attestVendor{
+	{"Android", newCertPool(rootsAndroid), checkKeyDescription},
+	{"Apple", newCertPool(rootsApple), nil},
+}
+
+func newCertPool(certs []string) *x509.CertPool {
+	pool := x509.NewCertPool()
+	for _, v := range certs {
+		if !pool.AppendCertsFromPEM([]byte(v)) {
+			panic("attestation root: wrong PEM")
+		}
+	}
+	return pool
+}
+
+func (r *queueReq) fileAttestation() string { return filepath.Join(Dir.Queue, r.ID+".att") }
+
+// checkAttestation checks the size of the attestation statement and, whether it
+// is a chain of certificates, that the first one is of the key of the request
+// and that the chain is issued by the roots of a vendor. It reports whether the
+// statement was verified, else it is left to the hook.
+func checkAttestation(data []byte, req *x509.CertificateRequest) (verified bool, err error) {
+	if len(data) > ATTEST_MAX_SIZE {
+		return false, errAttestSize
+	}
+	chain, err := attestChain(data)
+	if err != nil || chain == nil {
+		return false, err
+	}
+	if pub, ok := chain[0].PublicKey.(interface{ Equal(crypto.PublicKey) bool }); !ok || !pub.Equal(req.PublicKey) {
+		return false, errAttestKey
+	}
+	if err = verifyAttestChain(chain); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// attestChain returns the chain of certificates of the statement, in PEM or
+// DER, the first one of the attested key like in the statements of Android and
+// Apple; it is nil for the other formats (i.e. TPM).
+func attestChain(data []byte) ([]*x509.Certificate, error) {
+	if block, rest := pem.Decode(data); block != nil {
+		if block.Type != "CERTIFICATE" {
+			return nil, nil
+		}
+		var chain []*x509.Certificate
+
+		for ; block != nil; block, rest = pem.Decode(rest) {
+			if block.Type != "CERTIFICATE" {
+				continue
+			}
+			cert, err := x509.ParseCertificate(block.Bytes)
+			if err != nil {
+				return nil, fmt.Errorf("attestation statement: %s", err)
+			}
+			chain = append(chain, cert)
+		}
+		return chain, nil
+	}
+	if chain, err := x509.ParseCertificates(data); err == nil && len(chain) != 0 {
+		return chain, nil
+	}
+	return nil, nil
+}
+
+// verifyAttestChain verifies the chain against the roots of each vendor.
+func verifyAttestChain(chain []*x509.Certificate) error {
+	inter := x509.NewCertPool()
+	for _, v := range chain[1:] {
+		inter.AddCert(v)
+	}
+
+	for _, v := range attestVendors {
+		_, err := chain[0].Verify(x509.VerifyOptions{
+			Roots:         v.roots,
+			Intermediates: inter,
+			KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+		})
+		if err != nil {
+			continue
+		}
+		if v.check != nil {
+			if err = v.check(chain[0]); err != nil {
+				return fmt.Errorf("attestation of %s: %s", v.name, err)
+			}
+		}
+		return nil
+	}
+	return errAttestChain
+}
+
+// checkKeyDescription checks that the key of Android is in secure hardware.
+func checkKeyDescription(cert *x509.Certificate) error {
+	for _, ext := range cert.Extensions {
+		if !ext.Id.Equal(oidKeyDescription) {
+			continue
+		}
+		var desc keyDescription
+		if _, err := asn1.Unmarshal(ext.Value, &desc); err != nil {
+			return fmt.Errorf("key description: %s", err)
+		}
+		if desc.AttestationSecurityLevel == _SECURITY_SOFTWARE ||
+			desc.KeymasterSecurityLevel == _SECURITY_SOFTWARE {
+			return errors.New("key out of secure hardware")
+		}
+		return nil
+	}
+	return errors.New("no key description")
+}
+
+// verifyAttestation verifies the attestation statement of the request, whether
+// it was submitted or the store requires it; the statements which are not a
+// chain of certificates are verified by the hook.
+func (r *queueReq) verifyAttestation() error {
+	if !r.Attestation {
+		if loadStoreConfig().RequireAttestation {
+			return errNoAttestation
+		}
+		return nil
+	}
+
+	data, err := os.ReadFile(r.fileCSR())
+	if err != nil {
+		return err
+	}
+	_, req, err := parseQueueCSR(r.Name, data)
+	if err != nil {
+		return err
+	}
+	if data, err = os.ReadFile(r.fileAttestation()); err != nil {
+		return err
+	}
+	verified, err := checkAttestation(data, req)
+	if err != nil || verified {
+		return err
+	}
+	if _, err = os.Stat(filepath.Join(Dir.Hook, HOOK_ATTEST)); os.IsNotExist(err) {
+		return errNoVerifier
+	}
+	sum := sha256.Sum256(req.RawSubjectPublicKeyInfo)
+
+	return runHook(HOOK_ATTEST, map[string]string{
+		"NAME":        r.Name,
+		"ROOT":        Dir.Root,
+		"REQUEST":     r.fileCSR(),
+		"ATTESTATION": r.fileAttestation(),
+		"SPKI":        base64.StdEncoding.EncodeToString(req.RawSubjectPublicKeyInfo),
+		"SPKI_SHA256": hex.EncodeToString(sum[:]),
+	})
+}
+
+// mustAttestationNotRequired exits whether the store requires an attestation,
+// since the requests out of the queue have not one.
+func mustAttestationNotRequired() {
+	if loadStoreConfig().RequireAttestation {
+		log.Fatalf("%s\n\n  Add the request through \"queue -attestation file FILE NAME\"", errNoAttestation)
+	}
+}
@@ -0,0 +1,75 @@
+// Copyright 2014 Jonas mg
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"flag"
+	"os"
+	"strings"
+)
+
+var IsBatch = flag.Bool("batch", false, "never prompt, failing instead")
+
+// batchMode reports whether the prompts are not allowed: with the flag
+// "-batch", or whether the standard input is closed or it is the null device,
+// like in the daemons, since the prompts of OpenSSL would not be answered.
+//
+// A standard input which is not a terminal, like a pipe, is still used to
+// answer the prompts.
+func batchMode() bool {
+	if *IsBatch {
+		return true
+	}
+
+	info, err := os.Stdin.Stat()
+	if err != nil {
+		return true
+	}
+	null, err := os.Stat(os.DevNull)
+	return err == nil && os.SameFile(info, null)
+}
+
+// batchArgs returns the OpenSSL's option to not prompt, in batch mode. Then
+// the subject of a request has the default values of the configuration, and
+// the signing is not confirmed.
+func batchArgs() []string {
+	if batchMode() {
+		return []string{"-batch"}
+	}
+	return nil
+}
+
+// caBatchSubject returns the subject of the CA in batch mode, in the format of
+// OpenSSL, with the default values of the subject.
+func caBatchSubject() string {
+	return batchSubject(strings.TrimSpace(Subject.Organization+" CA"), "")
+}
+
+// batchSubject returns a subject in the format of OpenSSL, with the default
+// values of the subject plus the common name and the serial number, whether
+// they are not empty.
+func batchSubject(commonName, serialNumber string) string {
+	fields := []struct{ key, value string }{
+		{"C", Subject.Country},
+		{"ST", Subject.State},
+		{"L", Subject.Locality},
+		{"O", Subject.Organization},
+		{"OU", Subject.Unit},
+		{"CN", commonName},
+		{"serialNumber", serialNumber},
+	}
+
+	var b strings.Builder
+	for _, f := range fields {
+		if f.value == "" {
+			continue
+		}
+		v := strings.NewReplacer(`\`, `\\`, "/", `\/`).Replace(f.value)
+		b.WriteString("/" + f.key + "=" + v)
+	}
+	return b.String()
+}
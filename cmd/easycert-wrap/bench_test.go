@@ -0,0 +1,188 @@
+// Copyright 2014 Jonas mg
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"testing"
+)
+
+// useStore sets the directory structure of the program into the store, to
+// run the functions in the process of the test.
+func useStore(b testing.TB, s *testStore) {
+	dir, file := Dir, File
+	setRoot(File.Cmd, s.root)
+	b.Cleanup(func() { Dir, File = dir, file })
+
+	b.Setenv(ENV_CA_PASS, testCAPass)
+	b.Setenv(ENV_OPERATOR, "tester")
+}
+
+// newCSR generates a request, in PEM format, with OpenSSL.
+func newCSR(b testing.TB, name string) []byte {
+	out, err := exec.Command("openssl", "req", "-new", "-nodes",
+		"-newkey", "ec", "-pkeyopt", "ec_paramgen_curve:P-256",
+		"-subj", "/CN="+name, "-keyout", os.DevNull).Output()
+	if err != nil {
+		b.Fatal(err)
+	}
+	return out
+}
+
+// == Key generation and signing
+//
+
+func BenchmarkKeygenRSA(b *testing.B) {
+	for _, size := range []int{2048, 4096} {
+		b.Run(strconv.Itoa(size), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				openssl("genpkey", "-quiet", "-algorithm", "RSA", "-pkeyopt",
+					"rsa_keygen_bits:"+strconv.Itoa(size), "-out", os.DevNull)
+			}
+		})
+	}
+}
+
+// BenchmarkReq measures the command "req", with the start of the process.
+func BenchmarkReq(b *testing.B) {
+	s := newTestStore(b, true)
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		name := "req" + strconv.Itoa(i)
+		s.mustRun(dnInput(name), "req", name)
+	}
+}
+
+// BenchmarkSign measures the command "sign", with the start of the process.
+func BenchmarkSign(b *testing.B) {
+	s := newTestStore(b, true)
+	for i := 0; i < b.N; i++ {
+		name := "sign" + strconv.Itoa(i)
+		s.mustRun(dnInput(name), "req", name)
+	}
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		s.mustRun(signInput, "sign", "sign"+strconv.Itoa(i))
+	}
+}
+
+// BenchmarkApprove measures the issuance path of the portal, which runs in a
+// single process, with every backend.
+func BenchmarkApprove(b *testing.B) {
+	for _, backend := range []string{BACKEND_OPENSSL, BACKEND_NATIVE} {
+		b.Run(backend, func(b *testing.B) {
+			s := newTestStore(b, true)
+			useStore(b, s)
+			setBackend(b, backend)
+
+			list := make([]*queueReq, b.N)
+			for i := range list {
+				name := "dev" + strconv.Itoa(i)
+				r, err := addQueue(name, newCSR(b, name), nil, "bench", "tester")
+				if err != nil {
+					b.Fatal(err)
+				}
+				list[i] = r
+			}
+			b.ResetTimer()
+
+			for _, r := range list {
+				if err := r.approve("tester"); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// setBackend sets the backend of the certificates, in the process of the test.
+func setBackend(b testing.TB, backend string) {
+	old := *Backend
+	*Backend = backend
+	b.Cleanup(func() { *Backend = old })
+}
+
+// == Store
+//
+
+// newBenchStore returns a store with `n` certificates signed by the CA.
+func newBenchStore(b *testing.B, n int) *testStore {
+	s := newTestStore(b, true)
+	s.issue("cert")
+	useStore(b, s)
+
+	data, err := os.ReadFile(s.file("certs", "cert"+EXT_CERT))
+	if err != nil {
+		b.Fatal(err)
+	}
+	for i := 0; i < n; i++ {
+		file := filepath.Join(Dir.Cert, "cert"+strconv.Itoa(i)+EXT_CERT)
+		if err = os.WriteFile(file, data, 0644); err != nil {
+			b.Fatal(err)
+		}
+	}
+	return s
+}
+
+func BenchmarkLoadCerts(b *testing.B) {
+	newBenchStore(b, 500)
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		certs := loadCerts()
+		for _, v := range certs {
+			chainOf(v.Cert, certs)
+		}
+	}
+}
+
+func BenchmarkParseCertFile(b *testing.B) {
+	s := newBenchStore(b, 0)
+	file := s.file("certs", NAME_CA+EXT_CERT)
+
+	b.Run("Cached", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			if _, err := parseCertFile(file); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("Uncached", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			fileCacheMu.Lock()
+			delete(fileCache, file)
+			fileCacheMu.Unlock()
+
+			if _, err := parseCertFile(file); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func BenchmarkListQueue(b *testing.B) {
+	newBenchStore(b, 0)
+
+	csr := newCSR(b, "dev")
+	for i := 0; i < 200; i++ {
+		if _, err := addQueue("dev"+strconv.Itoa(i), csr, nil, "bench", "tester"); err != nil {
+			b.Fatal(err)
+		}
+	}
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		if _, err := listQueue(); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,152 @@
+// Copyright 2014 Jonas mg
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+)
+
+var (
+	IsDedup    = flag.Bool("dedup", false, "store the chains of the certificates once")
+	IsWithRoot = flag.Bool("with-root", false, "send the root CA in the chain of the server")
+)
+
+// issuerFile returns the path of the issuer in the chains directory, named by
+// the SHA-256 fingerprint of the certificate.
+func issuerFile(cert *x509.Certificate) string {
+	return filepath.Join(Dir.Chain, hex.EncodeToString(sha256Sum(cert.Raw))+EXT_CERT)
+}
+
+// storeIssuer stores the certificate of an issuer in the chains directory,
+// whether it is not already in the certificates directory. It returns the path
+// of the file, or an empty string when it is not stored.
+func storeIssuer(cert *x509.Certificate, certs []*storeCert) (string, error) {
+	for _, v := range certs {
+		if bytes.Equal(v.Cert.Raw, cert.Raw) {
+			return "", nil
+		}
+	}
+
+	file := issuerFile(cert)
+	if _, err := os.Stat(file); err == nil {
+		return "", nil
+	}
+	if err := os.MkdirAll(Dir.Chain, 0755); err != nil {
+		return "", err
+	}
+
+	data := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})
+	if err := writeFileAtomic(file, data, 0644); err != nil {
+		return "", err
+	}
+	return file, nil
+}
+
+// splitChain returns the first certificate of `certs`, in PEM format, storing
+// the rest ones like issuers in the chains directory.
+func splitChain(certs [][]byte) ([]byte, error) {
+	stored := loadCerts()
+
+	for _, v := range certs[1:] {
+		block, _ := pem.Decode(v)
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+
+		file, err := storeIssuer(cert, stored)
+		if err != nil {
+			return nil, err
+		}
+		if file != "" {
+			fmt.Printf("- Issuer:\t%q\n", file)
+		}
+	}
+	return certs[0], nil
+}
+
+// loadIssuers returns the certificates of the chains directory, named by their
+// fingerprint.
+func loadIssuers() []*storeCert {
+	match, err := filepath.Glob(filepath.Join(Dir.Chain, "*"+EXT_CERT))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	certs := make([]*storeCert, 0, len(match))
+	for _, v := range match {
+		cert, err := parseCertFile(v)
+		if err != nil {
+			log.Printf("%s: %s", v, err)
+			continue
+		}
+
+		name := filepath.Base(v)
+		certs = append(certs, &storeCert{
+			Name: name[:len(name)-len(EXT_CERT)],
+			File: v,
+			Cert: cert,
+		})
+	}
+	return certs
+}
+
+// chainCerts returns the certificates which can be part of a chain: the ones
+// of the certificates directory and the issuers of the chains directory.
+func chainCerts() []*storeCert {
+	return append(loadCerts(), loadIssuers()...)
+}
+
+// servedChain returns the CA certificates sent by a server with the certificate:
+// its chain without the root CA, which the clients have to trust already, unless
+// it is used "-with-root".
+func servedChain(cert *x509.Certificate) []*storeCert {
+	var chain []*storeCert
+	for _, v := range chainOf(cert, chainCerts()) {
+		if bytes.Equal(v.Cert.RawIssuer, v.Cert.RawSubject) && !*IsWithRoot {
+			continue
+		}
+		chain = append(chain, v)
+	}
+	if *IsWithRoot {
+		fmt.Fprint(os.Stderr, "* Root CA sent in the chain: the clients have to trust it by their own store, not by the server\n")
+	}
+	return chain
+}
+
+// DedupChains moves the chains stored into the certificate files to the chains
+// directory, so every issuer is stored once.
+func DedupChains() {
+	for _, c := range loadCerts() {
+		data, err := os.ReadFile(c.File)
+		if err != nil {
+			log.Fatal(err)
+		}
+		certs := splitCerts(data)
+		if len(certs) < 2 {
+			continue
+		}
+
+		fmt.Printf("\n== %s\n", c.Name)
+		leaf, err := splitChain(certs)
+		if err != nil {
+			log.Fatalf("%s: %s", c.File, err)
+		}
+		if err = writeFileAtomic(c.File, leaf, 0644); err != nil {
+			log.Fatal(err)
+		}
+		fmt.Printf("- Certificate:\t%q\n", c.File)
+	}
+}
@@ -9,9 +9,18 @@
 package main
 
 import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
 	"errors"
 	"flag"
+	"fmt"
 	"strconv"
+	"strings"
+
+	"github.com/tredoe/flagplus"
 )
 
 var (
@@ -19,6 +28,83 @@ var (
 	errSize    = errors.New("key size must be multiple of 1024")
 )
 
+// Types of key to generate.
+const (
+	KEY_TYPE_RSA   = "rsa"
+	KEY_TYPE_ECDSA = "ecdsa"
+)
+
+// curves maps the names of the flag "-curve" to the elliptic curves.
+var curves = map[string]elliptic.Curve{
+	"p256": elliptic.P256(),
+	"p384": elliptic.P384(),
+	"p521": elliptic.P521(),
+}
+
+// keySpec represents the keys to generate: the type, and the size for RSA or
+// the curve for ECDSA.
+type keySpec struct {
+	Type    string
+	RSASize int
+	Curve   string
+}
+
+// check checks the parameters of the type of key.
+func (k *keySpec) check() error {
+	switch k.Type {
+	case KEY_TYPE_RSA:
+		if k.RSASize < 2048 {
+			return errMinSize
+		}
+		if k.RSASize%1024 != 0 {
+			return errSize
+		}
+	case KEY_TYPE_ECDSA:
+		if _, ok := curves[k.Curve]; !ok {
+			return fmt.Errorf("invalid curve %q: it has to be p256, p384 or p521", k.Curve)
+		}
+	default:
+		return fmt.Errorf("invalid key type %q: it has to be %q or %q", k.Type, KEY_TYPE_RSA, KEY_TYPE_ECDSA)
+	}
+	return nil
+}
+
+// String returns the description of the key, like "RSA key of 2048 bits".
+func (k *keySpec) String() string {
+	if k.Type == KEY_TYPE_ECDSA {
+		return "ECDSA key on the curve " + curves[k.Curve].Params().Name
+	}
+	return fmt.Sprintf("RSA key of %d bits", k.RSASize)
+}
+
+// newkeyArgs returns the options of "openssl req" to generate the key.
+func (k *keySpec) newkeyArgs() []string {
+	if k.Type == KEY_TYPE_ECDSA {
+		return []string{"-newkey", "ec", "-pkeyopt", k.curveOpt()}
+	}
+	return []string{"-newkey", "rsa:" + strconv.Itoa(k.RSASize)}
+}
+
+// genpkeyArgs returns the options of "openssl genpkey" to generate the key.
+func (k *keySpec) genpkeyArgs() []string {
+	if k.Type == KEY_TYPE_ECDSA {
+		return []string{"-algorithm", "EC", "-pkeyopt", k.curveOpt()}
+	}
+	return []string{"-algorithm", "RSA", "-pkeyopt", "rsa_keygen_bits:" + strconv.Itoa(k.RSASize)}
+}
+
+func (k *keySpec) curveOpt() string {
+	return "ec_paramgen_curve:" + curves[k.Curve].Params().Name
+}
+
+// generate generates a key in Go.
+func (k *keySpec) generate() (crypto.Signer, error) {
+	if k.Type == KEY_TYPE_ECDSA {
+		return ecdsa.GenerateKey(curves[k.Curve], rand.Reader)
+	}
+	return rsa.GenerateKey(rand.Reader, k.RSASize)
+}
+
 // rsaSizeFlag represents the size in bits of RSA key to generate.
 type rsaSizeFlag int
 
@@ -31,20 +117,46 @@ func (s *rsaSizeFlag) Set(value string) error {
 	if err != nil {
 		return err
 	}
+	if err = (&keySpec{Type: KEY_TYPE_RSA, RSASize: i}).check(); err != nil {
+		return err
+	}
+	*s = rsaSizeFlag(i)
+	return nil
+}
+
+// keyTypeFlag represents the type of key to generate.
+type keyTypeFlag string
 
-	if i < 2048 {
-		return errMinSize
+func (t *keyTypeFlag) String() string { return string(*t) }
+
+func (t *keyTypeFlag) Set(value string) error {
+	value = strings.ToLower(value)
+	if value != KEY_TYPE_RSA && value != KEY_TYPE_ECDSA {
+		return fmt.Errorf("it has to be %q or %q", KEY_TYPE_RSA, KEY_TYPE_ECDSA)
 	}
-	if i%1024 != 0 {
-		return errSize
+	*t = keyTypeFlag(value)
+	return nil
+}
+
+// curveFlag represents the elliptic curve of the ECDSA key to generate.
+type curveFlag string
+
+func (c *curveFlag) String() string { return string(*c) }
+
+func (c *curveFlag) Set(value string) error {
+	value = strings.ToLower(value)
+	if err := (&keySpec{Type: KEY_TYPE_ECDSA, Curve: value}).check(); err != nil {
+		return err
 	}
-	*s = rsaSizeFlag(i)
+	*c = curveFlag(value)
 	return nil
 }
 
-var (
-	RSASize rsaSizeFlag = 2048 // default
+// KeySpec is the key to generate, set by the flags "-key-type", "-rsa-size"
+// and "-curve".
+var KeySpec = keySpec{Type: KEY_TYPE_RSA, RSASize: 2048, Curve: "p256"}
 
+var (
 	Years = flag.Int("years", 1, "number of years a certificate generated is valid")
 
 	IsRequest = flag.Bool("req", false, "request")
@@ -53,5 +165,17 @@ var (
 )
 
 func init() {
-	flag.Var(&RSASize, "rsa-size", "size in bits for the RSA key")
+	flag.Var((*rsaSizeFlag)(&KeySpec.RSASize), "rsa-size", "size in bits for the RSA key")
+	flag.Var((*keyTypeFlag)(&KeySpec.Type), "key-type", "type of key: rsa or ecdsa")
+	flag.Var((*curveFlag)(&KeySpec.Curve), "curve", "elliptic curve of the ECDSA key: p256, p384 or p521")
+}
+
+// cmdFlags holds the names of the flags used by every subcommand, so they can
+// be documented.
+var cmdFlags = make(map[*flagplus.Subcommand][]string)
+
+// addFlags adds the flags to the subcommand, registering them to document it.
+func addFlags(cmd *flagplus.Subcommand, names ...string) {
+	cmd.AddFlags(names...)
+	cmdFlags[cmd] = append(cmdFlags[cmd], names...)
 }
@@ -0,0 +1,412 @@
+// Copyright 2014 Jonas mg
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/tredoe/flagplus"
+)
+
+var cmdACME = &flagplus.Subcommand{
+	UsageLine: "acme -domain names [-http | -dns] [-directory url] [-email address] [-listen addr | -webroot dir] [-reissue] [NAME]",
+	Short:     "get a certificate from Let's Encrypt or another ACME server",
+	Long: `
+"acme" gets a certificate for the comma-separated list of domains of "-domain"
+from an ACME server (RFC 8555), by default the one of Let's Encrypt; the flag
+"-directory" sets the URL of the directory of another server, like the staging
+one of Let's Encrypt:
+
+	https://acme-staging-v02.api.letsencrypt.org/directory
+
+The private key is generated in the host like in "req" ("-key-type", "-rsa-size"
+and "-curve"), and the certificate is stored like NAME, the first domain by
+default, into the certificates directory, next to the ones issued by the CA; its
+issuers are stored into the directory "chains", like in "import".
+
+The account is registered the first time, agreeing the terms of service of the
+server, with the contact address of "-email"; its key is kept into the directory
+"private/acme", by host of the server.
+
+The control of the domains is proved with the challenge HTTP-01 by default
+("-http"): a server answers the challenges in the address of "-listen" (":80"),
+or they are written into the directory ".well-known/acme-challenge" of the web
+root of "-webroot". With "-dns", the challenge DNS-01 is used, required by the
+wildcard domains: the TXT record "_acme-challenge.DOMAIN" is published by the
+hook "acme-dns", whether it exists, else it is shown to add it by hand. The hook
+gets the variables EASYCERT_ACTION ("present" or "cleanup"), EASYCERT_DOMAIN,
+EASYCERT_RECORD and EASYCERT_VALUE.
+
+The flag "-reissue" gets a new certificate for NAME, keeping the current one
+like a previous version.
+`,
+	Run: runACME,
+}
+
+var (
+	ACMEDirectory = flag.String("directory", DEFAULT_ACME_DIRECTORY, "URL of the directory of the ACME server")
+	Email         = flag.String("email", "", "contact address of the ACME account")
+	IsHTTP01      = flag.Bool("http", false, "prove the control of the domains with the challenge HTTP-01")
+	IsDNS01       = flag.Bool("dns", false, "prove the control of the domains with the challenge DNS-01")
+	Listen        = flag.String("listen", ":80", "address where to answer the challenges HTTP-01")
+	Webroot       = flag.String("webroot", "", "web root where to write the challenges HTTP-01")
+)
+
+func init() {
+	addFlags(cmdACME, "domain", "http", "dns", "directory", "email", "listen", "webroot", "reissue",
+		"key-type", "rsa-size", "curve", "batch")
+}
+
+// _ACME_CHALLENGE_PATH is the path where the challenges HTTP-01 are served.
+const _ACME_CHALLENGE_PATH = "/.well-known/acme-challenge/"
+
+func runACME(cmd *flagplus.Subcommand, args []string) {
+	if *Domain == "" || len(args) > 1 {
+		log.Print("Missing required flag: -domain")
+		cmd.Usage()
+	}
+	if *IsHTTP01 && *IsDNS01 {
+		log.Fatal("Flags -http and -dns are exclusive")
+	}
+	if *IsDNS01 && *Webroot != "" {
+		log.Fatal("Flag -webroot is only used by the challenge HTTP-01")
+	}
+	domains := acmeDomains(*Domain)
+	for _, v := range domains {
+		if strings.HasPrefix(v, "*.") && !*IsDNS01 {
+			log.Fatalf("The wildcard domain %q needs the challenge DNS-01 (\"-dns\")", v)
+		}
+	}
+
+	operator := mustRole(ACTION_REQUEST)
+	if loadStoreConfig().NoServerKeygen {
+		log.Fatal("The private keys can not be generated in this host (\"no_server_keygen\")")
+	}
+	fipsCheckKeySpec(&KeySpec)
+
+	name := strings.TrimPrefix(domains[0], "*.")
+	if len(args) == 1 {
+		name = args[0]
+	}
+	setCertPath(name)
+	if _, err := os.Stat(File.Cert); !os.IsNotExist(err) && !*IsReissue {
+		log.Fatalf("Certificate already exists: %q\n\n  Use \"-reissue\" to keep it like a previous version", File.Cert)
+	}
+
+	client, err := acmeLogin(*ACMEDirectory, *Email)
+	if err != nil {
+		log.Fatal(err)
+	}
+	order, err := client.newOrder(domains)
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Print("\n== Challenges\n")
+	if err = acmeAuthorize(client, order); err != nil {
+		log.Fatal(err)
+	}
+
+	beginIssuance()
+	if *IsReissue {
+		if err = archiveVersion(name, true); err != nil {
+			fatal(err)
+		}
+	}
+	keyFile := createKeyFile(File.Key)
+	key, err := nativeGenerateKey()
+	if err != nil {
+		fatal(err)
+	}
+	if err = writeKeyFile(keyFile, key, ""); err != nil {
+		fatal(err)
+	}
+	tmpl := &x509.CertificateRequest{DNSNames: domains}
+	if len(domains[0]) <= 64 {
+		tmpl.Subject = pkix.Name{CommonName: domains[0]}
+	}
+	csr, err := x509.CreateCertificateRequest(rand.Reader, tmpl, key)
+	if err != nil {
+		fatal(err)
+	}
+
+	chain, err := client.finalize(order, csr)
+	if err != nil {
+		fatal(err)
+	}
+	certs := splitCerts(chain)
+	if len(certs) == 0 {
+		fatal("No certificate got from the ACME server")
+	}
+
+	fmt.Print("\n== Generated\n")
+	leaf, err := splitChain(certs)
+	if err != nil {
+		fatal(err)
+	}
+	certFile := mustTempFile(File.Cert)
+	if err = os.WriteFile(certFile, leaf, 0644); err != nil {
+		fatal(err)
+	}
+	mustCommitFile(keyFile, File.Key, 0400)
+	mustCommitFile(certFile, File.Cert, 0644)
+	commitIssuance()
+	if *IsReissue {
+		pruneVersions(name)
+	}
+
+	fmt.Printf("- Certificate:\t%q\n- Private key:\t%q\n", File.Cert, File.Key)
+	escrowKey(name)
+	audit(operator, ACTION_REQUEST, name, "acme "+*ACMEDirectory)
+}
+
+// acmeAccountFile returns the path of the key of the account in the server of
+// the directory.
+func acmeAccountFile(directory string) string {
+	host := "default"
+	if u, err := url.Parse(directory); err == nil && u.Host != "" {
+		host = strings.ReplaceAll(u.Host, ":", "_")
+	}
+	return filepath.Join(Dir.Key, "acme", host+EXT_KEY)
+}
+
+// acmeLogin returns the client of the server of the directory, with the
+// account registered. The key of the account is generated the first time.
+func acmeLogin(directory, email string) (*acmeClient, error) {
+	file := acmeAccountFile(directory)
+
+	if _, err := os.Stat(file); os.IsNotExist(err) {
+		if err = os.MkdirAll(filepath.Dir(file), 0700); err != nil {
+			return nil, err
+		}
+		key, err := newACMEAccountKey()
+		if err != nil {
+			return nil, err
+		}
+		tmp, err := tempFile(file)
+		if err != nil {
+			return nil, err
+		}
+		if err = writeKeyFile(tmp, key, ""); err != nil {
+			os.Remove(tmp)
+			return nil, err
+		}
+		if err = commitFile(tmp, file, 0400); err != nil {
+			return nil, err
+		}
+		fmt.Printf("- Account key:\t%q\n", file)
+	}
+
+	signer, err := loadKeyFile(file, "")
+	if err != nil {
+		return nil, err
+	}
+	key, err := acmeAccountKey(signer)
+	if err != nil {
+		return nil, err
+	}
+	client, err := newACMEClient(directory, key)
+	if err != nil {
+		return nil, err
+	}
+	if err = client.register(email); err != nil {
+		return nil, err
+	}
+	return client, nil
+}
+
+// acmeAuthorize proves the control of the domains of the order, with the
+// challenge set in the flags.
+func acmeAuthorize(c *acmeClient, order *acmeOrder) error {
+	typ := ACME_HTTP01
+	if *IsDNS01 {
+		typ = ACME_DNS01
+	}
+
+	var solver acmeSolver
+	if typ == ACME_DNS01 {
+		solver = new(dnsSolver)
+	} else if *Webroot != "" {
+		solver = &webrootSolver{dir: filepath.Join(*Webroot, filepath.FromSlash(_ACME_CHALLENGE_PATH))}
+	} else {
+		s, err := newHTTPSolver(*Listen)
+		if err != nil {
+			return err
+		}
+		defer s.close()
+		solver = s
+	}
+
+	for _, url := range order.Authorizations {
+		authz, err := c.authz(url)
+		if err != nil {
+			return err
+		}
+		if authz.Status == ACME_VALID {
+			continue
+		}
+		domain := authz.Identifier.Value
+		chal := authz.challenge(typ)
+		if chal == nil {
+			return fmt.Errorf("acme: the server does not offer %s for %s", typ, domain)
+		}
+		// It is used like file name in the web root.
+		if !validToken.MatchString(chal.Token) {
+			return fmt.Errorf("acme: wrong token of %s for %s: %q", typ, domain, chal.Token)
+		}
+
+		if err = solver.present(c, domain, chal.Token); err != nil {
+			return err
+		}
+		err = c.accept(url, chal)
+		if err2 := solver.cleanup(c, domain, chal.Token); err == nil {
+			err = err2
+		}
+		if err != nil {
+			return err
+		}
+		fmt.Printf("- %s:\t%s\n", domain, typ)
+	}
+	return nil
+}
+
+// validToken matches the token of a challenge, in base64url without padding
+// (RFC 8555, section 8.1).
+var validToken = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// acmeSolver publishes the answer of the challenges, and removes it once they
+// are validated.
+type acmeSolver interface {
+	present(c *acmeClient, domain, token string) error
+	cleanup(c *acmeClient, domain, token string) error
+}
+
+// httpSolver answers the challenges HTTP-01 from its own server.
+type httpSolver struct {
+	mu      sync.Mutex
+	answers map[string]string // key authorization by token
+	ln      net.Listener
+}
+
+func newHTTPSolver(addr string) (*httpSolver, error) {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	s := &httpSolver{answers: make(map[string]string), ln: ln}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc(_ACME_CHALLENGE_PATH, func(w http.ResponseWriter, r *http.Request) {
+		s.mu.Lock()
+		answer, ok := s.answers[strings.TrimPrefix(r.URL.Path, _ACME_CHALLENGE_PATH)]
+		s.mu.Unlock()
+
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "application/octet-stream")
+		fmt.Fprint(w, answer)
+	})
+	go http.Serve(ln, mux)
+	return s, nil
+}
+
+func (s *httpSolver) present(c *acmeClient, domain, token string) error {
+	s.mu.Lock()
+	s.answers[token] = c.keyAuthorization(token)
+	s.mu.Unlock()
+	return nil
+}
+
+func (s *httpSolver) cleanup(c *acmeClient, domain, token string) error {
+	s.mu.Lock()
+	delete(s.answers, token)
+	s.mu.Unlock()
+	return nil
+}
+
+func (s *httpSolver) close() { s.ln.Close() }
+
+// webrootSolver writes the challenges HTTP-01 into the web root of a server.
+type webrootSolver struct {
+	dir string
+}
+
+func (s *webrootSolver) present(c *acmeClient, domain, token string) error {
+	if err := os.MkdirAll(s.dir, 0755); err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(s.dir, token), []byte(c.keyAuthorization(token)), 0644)
+}
+
+func (s *webrootSolver) cleanup(c *acmeClient, domain, token string) error {
+	return os.Remove(filepath.Join(s.dir, token))
+}
+
+// dnsSolver publishes the TXT records of the challenges DNS-01 through the
+// hook "acme-dns", or else asks to add them by hand.
+type dnsSolver struct {
+	stdin *bufio.Reader
+}
+
+// hasHook reports whether the hook to publish the records exists.
+func (s *dnsSolver) hasHook() bool {
+	_, err := os.Stat(filepath.Join(Dir.Hook, HOOK_ACME_DNS))
+	return err == nil
+}
+
+// meta returns the variables of the hook.
+func (s *dnsSolver) meta(action string, c *acmeClient, domain, token string) map[string]string {
+	return map[string]string{
+		"ACTION": action,
+		"DOMAIN": domain,
+		"RECORD": "_acme-challenge." + strings.TrimPrefix(domain, "*.") + ".",
+		"VALUE":  c.dnsValue(token),
+	}
+}
+
+func (s *dnsSolver) present(c *acmeClient, domain, token string) error {
+	meta := s.meta("present", c, domain, token)
+	if s.hasHook() {
+		return runHook(HOOK_ACME_DNS, meta)
+	}
+	if batchMode() {
+		return fmt.Errorf("no hook %q to publish the challenge DNS-01 of %s", HOOK_ACME_DNS, domain)
+	}
+
+	fmt.Printf("\nAdd the record, and press Enter once it is published:\n\n\t%s 300 IN TXT %q\n\n",
+		meta["RECORD"], meta["VALUE"])
+	if s.stdin == nil {
+		s.stdin = bufio.NewReader(os.Stdin)
+	}
+	if _, err := s.stdin.ReadString('\n'); err != nil {
+		return errors.New("challenge DNS-01 not confirmed")
+	}
+	return nil
+}
+
+func (s *dnsSolver) cleanup(c *acmeClient, domain, token string) error {
+	if s.hasHook() {
+		return runHook(HOOK_ACME_DNS, s.meta("cleanup", c, domain, token))
+	}
+	return nil
+}
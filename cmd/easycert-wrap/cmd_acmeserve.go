@@ -0,0 +1,1006 @@
+// Copyright 2014 Jonas mg
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tredoe/flagplus"
+)
+
+var cmdACMEServe = &flagplus.Subcommand{
+	UsageLine: "acme-serve [-addr host:port] [-server name] [-domain names] [-passin source]",
+	Short:     "serve an ACME endpoint which issues certificates of the CA",
+	Long: `
+"acme-serve" runs a server of the ACME protocol (RFC 8555), so the standard
+clients like certbot, Caddy or cert-manager get certificates signed by the CA.
+Its directory is at "/directory":
+
+	certbot certonly --server https://ca.example.com:8443/directory ...
+
+The control of the domains is proved with the challenge HTTP-01, getting the key
+authorization from the port 80 of the domain, or with DNS-01, looking up the TXT
+record "_acme-challenge.DOMAIN", required by the wildcard domains. The flag
+"-domain" restricts the domains to the ones of its comma-separated list and to
+their subdomains.
+
+The certificates are signed like in "sign", with the domains like subject
+alternative names and the first one like common name, whatever the subject of
+the request is. They are stored like "acme-DOMAIN" ("acme-wildcard.DOMAIN" for
+"*.DOMAIN"), keeping the current certificate like a previous version; the hooks
+are run and they are recorded in the audit log, like done by the operator which
+runs the server. The returned chain has the intermediate CAs, but not the root.
+
+The accounts are kept into the directory "acme-accounts", but the orders in
+progress are lost whether the server is restarted.
+
+Whether it is used the flag "-server", the endpoint is served over TLS with that
+certificate; else, the clients have to allow plain HTTP. The passphrase of the
+CA's private key is got from the environment variable EASYCERT_CA_PASS, or from
+the source of "-passin" (see "ca"), unless the key is in a KMS.
+`,
+	Run: runACMEServe,
+}
+
+func init() {
+	addFlags(cmdACMEServe, "addr", "server", "domain", "passin")
+}
+
+// DIR_ACME_ACCOUNTS is the directory of the accounts of the ACME server.
+const DIR_ACME_ACCOUNTS = "acme-accounts"
+
+// _ACME_ERROR is the prefix of the types of the errors of ACME.
+const _ACME_ERROR = "urn:ietf:params:acme:error:"
+
+// _ACME_LIFETIME is the time to complete an order since it is created.
+const _ACME_LIFETIME = 24 * time.Hour
+
+// Time to use a nonce since it is issued, and maximum number of nonces kept;
+// the oldest ones are dropped beyond it.
+const (
+	_ACME_NONCE_LIFETIME = 10 * time.Minute
+	_ACME_MAX_NONCES     = 10000
+)
+
+// _ACME_PRUNE_INTERVAL is the time between the pruning of the orders expired.
+const _ACME_PRUNE_INTERVAL = time.Hour
+
+// Port where the challenges HTTP-01 are got, and resolver of the TXT records
+// of the challenges DNS-01.
+var (
+	acmeHTTPPort  = "80"
+	acmeLookupTXT = net.LookupTXT
+)
+
+func runACMEServe(cmd *flagplus.Subcommand, args []string) {
+	if len(args) != 0 {
+		log.Print("Too many arguments")
+		cmd.Usage()
+	}
+	operator := mustRole(ACTION_SIGN)
+	if *PassIn != "" {
+		if err := checkPassIn(*PassIn); err != nil {
+			log.Fatal(err)
+		}
+	} else if loadKMS() == "" && os.Getenv(ENV_CA_PASS) == "" {
+		log.Fatalf("The passphrase of the CA's private key has to be set in %s or -passin", ENV_CA_PASS)
+	}
+	if l := openSysLog(); l != nil {
+		log.SetOutput(sysLogWriter{l})
+		log.SetPrefix("")
+	}
+
+	acme := newACMEServer(operator, acmeDomains(*Domain))
+	go func() {
+		for range time.Tick(_ACME_PRUNE_INTERVAL) {
+			acme.mu.Lock()
+			acme.prune(time.Now())
+			acme.mu.Unlock()
+		}
+	}()
+	srv := &http.Server{Addr: *Addr, Handler: acme}
+
+	if *ServerCert == "" {
+		fmt.Printf("* Serving ACME on http://%s/directory\n", *Addr)
+		log.Fatal(srv.ListenAndServe())
+	}
+	fmt.Printf("* Serving ACME on https://%s/directory\n", *Addr)
+	log.Fatal(srv.ListenAndServeTLS(
+		filepath.Join(Dir.Cert, *ServerCert+EXT_CERT),
+		filepath.Join(Dir.Key, *ServerCert+EXT_KEY),
+	))
+}
+
+// acmeDomains returns the domains of the comma-separated list, in lower case.
+func acmeDomains(list string) []string {
+	var domains []string
+	for _, v := range strings.Split(list, ",") {
+		if v = strings.ToLower(strings.TrimSpace(v)); v != "" {
+			domains = append(domains, v)
+		}
+	}
+	return domains
+}
+
+// acmeAccount is an account of the server, stored by the thumbprint of its key.
+type acmeAccount struct {
+	Key       json.RawMessage `json:"key"` // JWK
+	Contact   []string        `json:"contact,omitempty"`
+	CreatedAt time.Time       `json:"created_at"`
+
+	id  string
+	pub crypto.PublicKey
+}
+
+func (a *acmeAccount) file() string {
+	return filepath.Join(Dir.Root, DIR_ACME_ACCOUNTS, a.id+".json")
+}
+
+func (a *acmeAccount) save() error {
+	if err := os.MkdirAll(filepath.Dir(a.file()), 0700); err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(a, "", "\t")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(a.file(), append(data, '\n'), 0600)
+}
+
+// loadACMEAccount returns the account with the identifier, or nil whether it
+// does not exist.
+func loadACMEAccount(id string) (*acmeAccount, error) {
+	a := &acmeAccount{id: id}
+	data, err := os.ReadFile(a.file())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	if err = json.Unmarshal(data, a); err != nil {
+		return nil, fmt.Errorf("%s: %s", a.file(), err)
+	}
+	if a.pub, _, err = parseJWK(a.Key); err != nil {
+		return nil, fmt.Errorf("%s: %s", a.file(), err)
+	}
+	return a, nil
+}
+
+// parseJWK returns the public key of a JSON Web Key, ECDSA P-256 or RSA, and
+// its thumbprint (RFC 7638).
+func parseJWK(data []byte) (crypto.PublicKey, string, error) {
+	var k struct {
+		Kty, Crv, X, Y, N, E string
+	}
+	if err := json.Unmarshal(data, &k); err != nil {
+		return nil, "", err
+	}
+	dec := base64.RawURLEncoding.DecodeString
+
+	var pub crypto.PublicKey
+	var members string
+	switch k.Kty {
+	case "EC":
+		x, err1 := dec(k.X)
+		y, err2 := dec(k.Y)
+		if k.Crv != "P-256" || err1 != nil || err2 != nil {
+			return nil, "", errors.New("the key EC has to be P-256")
+		}
+		key := &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		if !key.Curve.IsOnCurve(key.X, key.Y) {
+			return nil, "", errors.New("the point is not on the curve P-256")
+		}
+		pub = key
+		members = fmt.Sprintf(`{"crv":"P-256","kty":"EC","x":%q,"y":%q}`, k.X, k.Y)
+	case "RSA":
+		n, err1 := dec(k.N)
+		e, err2 := dec(k.E)
+		if err1 != nil || err2 != nil || len(e) == 0 || len(e) > 4 {
+			return nil, "", errors.New("wrong key RSA")
+		}
+		key := &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+		if key.N.BitLen() < 2048 {
+			return nil, "", errors.New("the key RSA has to have 2048 bits at least")
+		}
+		pub = key
+		members = fmt.Sprintf(`{"e":%q,"kty":"RSA","n":%q}`, k.E, k.N)
+	default:
+		return nil, "", fmt.Errorf("unsupported key type %q", k.Kty)
+	}
+
+	sum := sha256.Sum256([]byte(members))
+	return pub, b64(sum[:]), nil
+}
+
+// acmeServerOrder is an order in the server.
+type acmeServerOrder struct {
+	acmeOrder
+	Expires string `json:"expires"`
+
+	id      string
+	account string
+	authzs  []*acmeServerAuthz
+	cert    []byte
+}
+
+// acmeServerAuthz is an authorization in the server.
+type acmeServerAuthz struct {
+	acmeAuthz
+	Expires string `json:"expires"`
+
+	id      string
+	account string
+}
+
+// acmeServer is the ACME server, which issues the certificates with the CA.
+type acmeServer struct {
+	operator string
+	allowed  []string // Domains allowed, with their subdomains.
+
+	mu     sync.Mutex
+	nonces map[string]time.Time // issued and not used yet, with their time
+	queue  []string             // nonces by time of issue, to drop the oldest
+	orders map[string]*acmeServerOrder
+	authzs map[string]*acmeServerAuthz
+	client *http.Client
+}
+
+func newACMEServer(operator string, allowed []string) *acmeServer {
+	return &acmeServer{
+		operator: operator,
+		allowed:  allowed,
+		nonces:   make(map[string]time.Time),
+		orders:   make(map[string]*acmeServerOrder),
+		authzs:   make(map[string]*acmeServerAuthz),
+		client:   &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+// acmeID returns a random identifier in base64url.
+func acmeID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		log.Fatal(err)
+	}
+	return b64(b)
+}
+
+// baseURL returns the URL of the server like the client sees it.
+func (s *acmeServer) baseURL(r *http.Request) string {
+	if r.TLS != nil {
+		return "https://" + r.Host
+	}
+	return "http://" + r.Host
+}
+
+func (s *acmeServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	path := r.URL.Path
+	switch {
+	case path == "/directory":
+		base := s.baseURL(r)
+		json.NewEncoder(w).Encode(acmeDirectory{
+			NewNonce:   base + "/acme/new-nonce",
+			NewAccount: base + "/acme/new-account",
+			NewOrder:   base + "/acme/new-order",
+		})
+		return
+	case path == "/acme/new-nonce":
+		s.mu.Lock()
+		nonce := s.newNonce()
+		s.mu.Unlock()
+		w.Header().Set("Replay-Nonce", nonce)
+		w.Header().Set("Cache-Control", "no-store")
+		if r.Method == "GET" {
+			w.WriteHeader(http.StatusNoContent)
+		}
+		return
+	}
+	if r.Method != "POST" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if path == "/acme/new-account" {
+		s.newAccount(w, r)
+		return
+	}
+	req, account := s.verify(w, r, false)
+	if account == nil {
+		return
+	}
+	if path == "/acme/new-order" {
+		s.newOrder(w, r, req, account)
+		return
+	}
+
+	resource, id := filepath.Split(path)
+	switch resource {
+	case "/acme/orders/":
+		if id == account.id {
+			s.reply(w, r, http.StatusOK, s.accountOrders(r, account))
+			return
+		}
+		s.fail(w, r, http.StatusForbidden, "unauthorized", "account of other key")
+		return
+	case "/acme/acct/":
+		if id == account.id {
+			s.reply(w, r, http.StatusOK, s.accountStatus(r, account))
+			return
+		}
+		s.fail(w, r, http.StatusForbidden, "unauthorized", "account of other key")
+		return
+	case "/acme/order/", "/acme/finalize/", "/acme/cert/":
+		o := s.orders[id]
+		if o == nil || o.account != account.id {
+			break
+		}
+		switch resource {
+		case "/acme/order/":
+			s.reply(w, r, http.StatusOK, s.orderStatus(r, o))
+		case "/acme/finalize/":
+			s.finalize(w, r, req, o)
+		case "/acme/cert/":
+			if o.cert == nil {
+				break
+			}
+			w.Header().Set("Replay-Nonce", s.newNonce())
+			w.Header().Set("Content-Type", "application/pem-certificate-chain")
+			w.Write(o.cert)
+		}
+		return
+	case "/acme/authz/":
+		if a := s.authzs[id]; a != nil && a.account == account.id {
+			s.reply(w, r, http.StatusOK, s.authzStatus(r, a))
+			return
+		}
+	case "/acme/chall/":
+		authzID, typ, _ := strings.Cut(id, ".")
+		if a := s.authzs[authzID]; a != nil && a.account == account.id {
+			if ch := a.challenge(typ); ch != nil {
+				s.accept(w, r, req, account, a, ch)
+				return
+			}
+		}
+	}
+	s.fail(w, r, http.StatusNotFound, "malformed", "resource not found")
+}
+
+// newNonce returns a new nonce, valid once. The nonces expired are dropped, and
+// the oldest ones whether there are too many.
+func (s *acmeServer) newNonce() string {
+	now := time.Now()
+	for len(s.queue) != 0 {
+		t, ok := s.nonces[s.queue[0]]
+		if ok && now.Sub(t) < _ACME_NONCE_LIFETIME && len(s.queue) < _ACME_MAX_NONCES {
+			break
+		}
+		delete(s.nonces, s.queue[0])
+		s.queue = s.queue[1:]
+	}
+
+	nonce := acmeID()
+	s.nonces[nonce] = now
+	s.queue = append(s.queue, nonce)
+	return nonce
+}
+
+// reply sends the resource in JSON format, with a new nonce.
+func (s *acmeServer) reply(w http.ResponseWriter, r *http.Request, status int, v interface{}) {
+	w.Header().Set("Replay-Nonce", s.newNonce())
+	w.Header().Add("Link", "<"+s.baseURL(r)+"/directory>;rel=\"index\"")
+	if _, ok := v.(*acmeProblem); ok {
+		w.Header().Set("Content-Type", "application/problem+json")
+	} else {
+		w.Header().Set("Content-Type", "application/json")
+	}
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// fail sends the error of the type, without its prefix.
+func (s *acmeServer) fail(w http.ResponseWriter, r *http.Request, status int, typ, detail string) {
+	s.reply(w, r, status, &acmeProblem{Type: _ACME_ERROR + typ, Detail: detail, Status: status})
+}
+
+// acmeRequest is a request verified, with the key which signed it in JWK.
+type acmeRequest struct {
+	payload []byte
+	jwk     json.RawMessage
+	pub     crypto.PublicKey
+	id      string // thumbprint of the key
+}
+
+// verify checks the request in JWS: its nonce, URL and signature, by the
+// account of "kid" or, with `withJWK`, by the key of "jwk". The account is nil
+// whether the request is not valid, once the error is sent.
+func (s *acmeServer) verify(w http.ResponseWriter, r *http.Request, withJWK bool) (*acmeRequest, *acmeAccount) {
+	var jws struct {
+		Protected, Payload, Signature string
+	}
+	var header struct {
+		Alg   string          `json:"alg"`
+		Nonce string          `json:"nonce"`
+		URL   string          `json:"url"`
+		JWK   json.RawMessage `json:"jwk"`
+		KID   string          `json:"kid"`
+	}
+	data, err := io.ReadAll(io.LimitReader(r.Body, 1<<16))
+	if err != nil {
+		s.fail(w, r, http.StatusBadRequest, "malformed", err.Error())
+		return nil, nil
+	}
+	dec := base64.RawURLEncoding.DecodeString
+	if err = json.Unmarshal(data, &jws); err == nil {
+		if data, err = dec(jws.Protected); err == nil {
+			err = json.Unmarshal(data, &header)
+		}
+	}
+	req := new(acmeRequest)
+	var sig []byte
+	if err == nil {
+		if req.payload, err = dec(jws.Payload); err == nil {
+			sig, err = dec(jws.Signature)
+		}
+	}
+	if err != nil {
+		s.fail(w, r, http.StatusBadRequest, "malformed", "wrong JWS: "+err.Error())
+		return nil, nil
+	}
+
+	if t, ok := s.nonces[header.Nonce]; !ok || time.Since(t) >= _ACME_NONCE_LIFETIME {
+		delete(s.nonces, header.Nonce)
+		s.fail(w, r, http.StatusBadRequest, "badNonce", "nonce not valid")
+		return nil, nil
+	}
+	delete(s.nonces, header.Nonce)
+	if header.URL != s.baseURL(r)+r.URL.Path {
+		s.fail(w, r, http.StatusUnauthorized, "unauthorized", "the URL does not match the request")
+		return nil, nil
+	}
+
+	var account *acmeAccount
+	if withJWK {
+		if header.JWK == nil || header.KID != "" {
+			s.fail(w, r, http.StatusBadRequest, "malformed", "the request has to be signed with \"jwk\"")
+			return nil, nil
+		}
+		if req.pub, req.id, err = parseJWK(header.JWK); err != nil {
+			s.fail(w, r, http.StatusBadRequest, "badPublicKey", err.Error())
+			return nil, nil
+		}
+		req.jwk = header.JWK
+		account = &acmeAccount{Key: header.JWK, id: req.id, pub: req.pub}
+	} else {
+		prefix := s.baseURL(r) + "/acme/acct/"
+		if header.JWK != nil || !strings.HasPrefix(header.KID, prefix) {
+			s.fail(w, r, http.StatusBadRequest, "malformed", "the request has to be signed with \"kid\"")
+			return nil, nil
+		}
+		id := strings.TrimPrefix(header.KID, prefix)
+		if b, err := base64.RawURLEncoding.DecodeString(id); err != nil || len(b) != sha256.Size {
+			s.fail(w, r, http.StatusBadRequest, "accountDoesNotExist", "account not found")
+			return nil, nil
+		}
+		if account, err = loadACMEAccount(id); err != nil {
+			log.Printf("acme: %s", err)
+			s.fail(w, r, http.StatusInternalServerError, "serverInternal", "account not readable")
+			return nil, nil
+		}
+		if account == nil {
+			s.fail(w, r, http.StatusBadRequest, "accountDoesNotExist", "account not found")
+			return nil, nil
+		}
+		req.pub, req.id = account.pub, account.id
+	}
+
+	sum := sha256.Sum256([]byte(jws.Protected + "." + jws.Payload))
+	ok := false
+	switch pub := req.pub.(type) {
+	case *ecdsa.PublicKey:
+		ok = header.Alg == "ES256" && len(sig) == 64 &&
+			ecdsa.Verify(pub, sum[:], new(big.Int).SetBytes(sig[:32]), new(big.Int).SetBytes(sig[32:]))
+	case *rsa.PublicKey:
+		ok = header.Alg == "RS256" && rsa.VerifyPKCS1v15(pub, crypto.SHA256, sum[:], sig) == nil
+	}
+	if !ok {
+		s.fail(w, r, http.StatusBadRequest, "badSignatureAlgorithm", "signature not valid, with ES256 or RS256")
+		return nil, nil
+	}
+	return req, account
+}
+
+// accountStatus returns the account like a resource.
+func (s *acmeServer) accountStatus(r *http.Request, a *acmeAccount) interface{} {
+	return map[string]interface{}{
+		"status":  ACME_VALID,
+		"contact": a.Contact,
+		"orders":  s.baseURL(r) + "/acme/orders/" + a.id,
+	}
+}
+
+// accountOrders returns the list of the orders of the account.
+func (s *acmeServer) accountOrders(r *http.Request, a *acmeAccount) interface{} {
+	orders := []string{}
+	for id, o := range s.orders {
+		if o.account == a.id {
+			orders = append(orders, s.baseURL(r)+"/acme/order/"+id)
+		}
+	}
+	sort.Strings(orders)
+	return map[string][]string{"orders": orders}
+}
+
+func (s *acmeServer) newAccount(w http.ResponseWriter, r *http.Request) {
+	req, account := s.verify(w, r, true)
+	if account == nil {
+		return
+	}
+	var in struct {
+		Contact              []string `json:"contact"`
+		TermsOfServiceAgreed bool     `json:"termsOfServiceAgreed"`
+		OnlyReturnExisting   bool     `json:"onlyReturnExisting"`
+	}
+	if err := json.Unmarshal(req.payload, &in); err != nil {
+		s.fail(w, r, http.StatusBadRequest, "malformed", err.Error())
+		return
+	}
+
+	status := http.StatusOK
+	existing, err := loadACMEAccount(req.id)
+	if err != nil {
+		log.Printf("acme: %s", err)
+		s.fail(w, r, http.StatusInternalServerError, "serverInternal", "account not readable")
+		return
+	}
+	if existing != nil {
+		account = existing
+	} else {
+		if in.OnlyReturnExisting {
+			s.fail(w, r, http.StatusBadRequest, "accountDoesNotExist", "account not found")
+			return
+		}
+		account.Contact = in.Contact
+		account.CreatedAt = time.Now().UTC().Truncate(time.Second)
+		if err = account.save(); err != nil {
+			log.Printf("acme: %s", err)
+			s.fail(w, r, http.StatusInternalServerError, "serverInternal", "account not saved")
+			return
+		}
+		status = http.StatusCreated
+	}
+
+	w.Header().Set("Location", s.baseURL(r)+"/acme/acct/"+account.id)
+	s.reply(w, r, status, s.accountStatus(r, account))
+}
+
+// checkIdentifier returns the error whether the identifier can not be issued.
+func (s *acmeServer) checkIdentifier(id acmeIdentifier) error {
+	if id.Type != "dns" {
+		return fmt.Errorf("unsupported identifier type %q", id.Type)
+	}
+	v := id.Value
+	if v != strings.ToLower(v) || strings.HasSuffix(v, ".") ||
+		!validDNS.MatchString(v) && !validShortName.MatchString(v) {
+		return fmt.Errorf("%q is not a domain name in lower case", v)
+	}
+	if len(s.allowed) == 0 {
+		return nil
+	}
+	v = strings.TrimPrefix(v, "*.")
+	for _, d := range s.allowed {
+		if v == d || strings.HasSuffix(v, "."+d) {
+			return nil
+		}
+	}
+	return fmt.Errorf("%q is not in the allowed domains", id.Value)
+}
+
+func (s *acmeServer) newOrder(w http.ResponseWriter, r *http.Request, req *acmeRequest, account *acmeAccount) {
+	var in struct {
+		Identifiers []acmeIdentifier `json:"identifiers"`
+	}
+	if err := json.Unmarshal(req.payload, &in); err != nil || len(in.Identifiers) == 0 {
+		s.fail(w, r, http.StatusBadRequest, "malformed", "no identifiers")
+		return
+	}
+	seen := make(map[string]bool)
+	for _, v := range in.Identifiers {
+		if err := s.checkIdentifier(v); err != nil {
+			s.fail(w, r, http.StatusBadRequest, "rejectedIdentifier", err.Error())
+			return
+		}
+		if seen[v.Value] {
+			s.fail(w, r, http.StatusBadRequest, "malformed", fmt.Sprintf("duplicated identifier %q", v.Value))
+			return
+		}
+		seen[v.Value] = true
+	}
+
+	now := time.Now()
+	s.prune(now)
+
+	expires := now.Add(_ACME_LIFETIME).UTC().Format(time.RFC3339)
+	o := &acmeServerOrder{id: acmeID(), account: account.id, Expires: expires}
+	o.Status = ACME_PENDING
+	o.Identifiers = in.Identifiers
+
+	for _, v := range in.Identifiers {
+		a := &acmeServerAuthz{id: acmeID(), account: account.id, Expires: expires}
+		a.Status = ACME_PENDING
+		a.Identifier = v
+		token := acmeID() + acmeID()
+
+		if strings.HasPrefix(v.Value, "*.") {
+			a.Identifier.Value = strings.TrimPrefix(v.Value, "*.")
+			a.Wildcard = true
+		} else {
+			a.Challenges = append(a.Challenges, acmeChallenge{Type: ACME_HTTP01, Token: token, Status: ACME_PENDING})
+		}
+		a.Challenges = append(a.Challenges, acmeChallenge{Type: ACME_DNS01, Token: token, Status: ACME_PENDING})
+
+		s.authzs[a.id] = a
+		o.authzs = append(o.authzs, a)
+	}
+	s.orders[o.id] = o
+
+	w.Header().Set("Location", s.baseURL(r)+"/acme/order/"+o.id)
+	s.reply(w, r, http.StatusCreated, s.orderStatus(r, o))
+}
+
+// prune drops the orders expired at `now`, with their authorizations.
+func (s *acmeServer) prune(now time.Time) {
+	for id, o := range s.orders {
+		if t, _ := time.Parse(time.RFC3339, o.Expires); now.After(t) {
+			for _, a := range o.authzs {
+				delete(s.authzs, a.id)
+			}
+			delete(s.orders, id)
+		}
+	}
+}
+
+// orderStatus updates the status of the order from its authorizations, and
+// returns it like a resource.
+func (s *acmeServer) orderStatus(r *http.Request, o *acmeServerOrder) *acmeServerOrder {
+	base := s.baseURL(r)
+	if o.Status == ACME_PENDING {
+		ready := true
+		for _, a := range o.authzs {
+			switch a.Status {
+			case ACME_INVALID:
+				o.Status = ACME_INVALID
+				o.Error = &acmeProblem{Type: _ACME_ERROR + "unauthorized", Detail: "authorization of " + a.Identifier.Value + " is invalid"}
+			case ACME_PENDING:
+				ready = false
+			}
+		}
+		if ready && o.Status == ACME_PENDING {
+			o.Status = ACME_READY
+		}
+	}
+
+	o.Authorizations = o.Authorizations[:0]
+	for _, a := range o.authzs {
+		o.Authorizations = append(o.Authorizations, base+"/acme/authz/"+a.id)
+	}
+	o.Finalize = base + "/acme/finalize/" + o.id
+	if o.cert != nil {
+		o.Certificate = base + "/acme/cert/" + o.id
+	}
+	return o
+}
+
+// authzStatus returns the authorization like a resource.
+func (s *acmeServer) authzStatus(r *http.Request, a *acmeServerAuthz) *acmeServerAuthz {
+	for i, v := range a.Challenges {
+		a.Challenges[i].URL = s.baseURL(r) + "/acme/chall/" + a.id + "." + v.Type
+	}
+	return a
+}
+
+// accept starts the validation of the challenge, whether it is the first time.
+func (s *acmeServer) accept(w http.ResponseWriter, r *http.Request, req *acmeRequest, account *acmeAccount, a *acmeServerAuthz, ch *acmeChallenge) {
+	s.authzStatus(r, a)
+	if len(req.payload) != 0 && a.Status == ACME_PENDING && ch.Status == ACME_PENDING {
+		ch.Status = ACME_PROCESSING
+		keyAuth := ch.Token + "." + account.id
+		go s.validate(a, ch, keyAuth)
+	}
+	w.Header().Add("Link", "<"+s.baseURL(r)+"/acme/authz/"+a.id+">;rel=\"up\"")
+	s.reply(w, r, http.StatusOK, ch)
+}
+
+// validate checks the challenge, setting its status and the one of its
+// authorization.
+func (s *acmeServer) validate(a *acmeServerAuthz, ch *acmeChallenge, keyAuth string) {
+	domain := a.Identifier.Value
+	var err error
+
+	switch ch.Type {
+	case ACME_HTTP01:
+		err = s.validateHTTP01(domain, ch.Token, keyAuth)
+	case ACME_DNS01:
+		err = validateDNS01(domain, keyAuth)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err != nil {
+		log.Printf("acme: %s of %s: %s", ch.Type, domain, err)
+		ch.Status = ACME_INVALID
+		ch.Error = &acmeProblem{Type: _ACME_ERROR + "incorrectResponse", Detail: err.Error()}
+		a.Status = ACME_INVALID
+		return
+	}
+	ch.Status = ACME_VALID
+	a.Status = ACME_VALID
+}
+
+// validateHTTP01 checks the key authorization served by the domain.
+func (s *acmeServer) validateHTTP01(domain, token, keyAuth string) error {
+	resp, err := s.client.Get("http://" + net.JoinHostPort(domain, acmeHTTPPort) + _ACME_CHALLENGE_PATH + token)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("got status %s", resp.Status)
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, 1024))
+	if err != nil {
+		return err
+	}
+	if string(bytes.TrimSpace(data)) != keyAuth {
+		return errors.New("the key authorization does not match")
+	}
+	return nil
+}
+
+// validateDNS01 checks the TXT record of the challenge of the domain.
+func validateDNS01(domain, keyAuth string) error {
+	records, err := acmeLookupTXT("_acme-challenge." + domain)
+	if err != nil {
+		return err
+	}
+	sum := sha256.Sum256([]byte(keyAuth))
+	for _, v := range records {
+		if v == b64(sum[:]) {
+			return nil
+		}
+	}
+	return errors.New("no TXT record with the key authorization")
+}
+
+// finalize issues the certificate of the order, with its request. The lock of
+// the server is released while it is signed.
+func (s *acmeServer) finalize(w http.ResponseWriter, r *http.Request, req *acmeRequest, o *acmeServerOrder) {
+	if s.orderStatus(r, o).Status != ACME_READY {
+		s.fail(w, r, http.StatusForbidden, "orderNotReady", "the order is "+o.Status)
+		return
+	}
+	var in struct {
+		CSR string `json:"csr"`
+	}
+	var csr *x509.CertificateRequest
+	var der []byte
+	err := json.Unmarshal(req.payload, &in)
+	if err == nil {
+		if der, err = base64.RawURLEncoding.DecodeString(in.CSR); err == nil {
+			if csr, err = x509.ParseCertificateRequest(der); err == nil {
+				err = csr.CheckSignature()
+			}
+		}
+	}
+	if err == nil {
+		err = checkACMERequest(csr, o.Identifiers)
+	}
+	if err != nil {
+		s.fail(w, r, http.StatusBadRequest, "badCSR", err.Error())
+		return
+	}
+
+	var domains []string
+	for _, v := range o.Identifiers {
+		domains = append(domains, v.Value)
+	}
+	name := "acme-" + strings.Replace(domains[0], "*.", "wildcard.", 1)
+
+	o.Status = ACME_PROCESSING
+	s.mu.Unlock()
+	cert, err := acmeSign(s.operator, req.id, name, der, domains)
+	s.mu.Lock()
+
+	if err != nil {
+		log.Printf("acme: %s: %s", name, err)
+		o.Status = ACME_INVALID
+		o.Error = &acmeProblem{Type: _ACME_ERROR + "serverInternal", Detail: "the certificate could not be issued"}
+	} else {
+		o.Status = ACME_VALID
+		o.cert = cert
+	}
+	s.reply(w, r, http.StatusOK, s.orderStatus(r, o))
+}
+
+// checkACMERequest checks that the request is only for the identifiers of the
+// order, all of them.
+func checkACMERequest(csr *x509.CertificateRequest, ids []acmeIdentifier) error {
+	if len(csr.IPAddresses) != 0 || len(csr.EmailAddresses) != 0 || len(csr.URIs) != 0 {
+		return errors.New("the request has names which are not domains")
+	}
+	want := make([]string, len(ids))
+	for i, v := range ids {
+		want[i] = v.Value
+	}
+	got := make(map[string]bool)
+	for _, v := range csr.DNSNames {
+		got[strings.ToLower(v)] = true
+	}
+	if cn := csr.Subject.CommonName; cn != "" && !got[strings.ToLower(cn)] {
+		got[strings.ToLower(cn)] = true
+	}
+	names := make([]string, 0, len(got))
+	for v := range got {
+		names = append(names, v)
+	}
+	sort.Strings(names)
+	sort.Strings(want)
+
+	if strings.Join(names, ",") != strings.Join(want, ",") {
+		return fmt.Errorf("the names of the request %q are not the ones of the order %q", names, want)
+	}
+	if pub, ok := csr.PublicKey.(*rsa.PublicKey); ok && pub.N.BitLen() < 2048 {
+		return errors.New("the key RSA has to have 2048 bits at least")
+	}
+	return nil
+}
+
+// acmeSign signs the request in DER format like "sign" with "-reissue", with
+// the domains, and returns the certificate with its chain in PEM format.
+func acmeSign(operator, account, name string, csr []byte, domains []string) ([]byte, error) {
+	queueMu.Lock()
+	defer queueMu.Unlock()
+
+	if err := checkRole(loadStoreConfig(), operator, ACTION_SIGN); err != nil {
+		return nil, err
+	}
+	setCertPath(name)
+
+	tx := beginIssuance()
+	if err := acmeIssue(tx, csr, domains); err != nil {
+		tx.rollback()
+		return nil, err
+	}
+	commitIssuance()
+	pruneVersions(name)
+
+	for _, v := range []string{File.Request, File.SrvConfig} {
+		if err := os.Remove(v); err != nil {
+			log.Print(err)
+		}
+	}
+
+	cert, err := parseCertFile(File.Cert)
+	if err != nil {
+		return nil, err
+	}
+	data := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})
+	if file, err := writeFullChain(cert, name); err != nil {
+		log.Print(err)
+	} else if file != "" {
+		if data, err = os.ReadFile(file); err != nil {
+			return nil, err
+		}
+	}
+
+	meta := hookMeta()
+	audit(operator, ACTION_SIGN, name, "serial "+meta["SERIAL"]+", acme account "+account)
+	if _, err = writeReceipt(name, operator); err != nil {
+		log.Print(err)
+	}
+	if err = runHook(HOOK_POST_SIGN, meta); err != nil {
+		log.Print(err)
+	}
+	return data, nil
+}
+
+// acmeIssue signs the request into the issuance in progress, keeping the
+// current certificate like a previous version.
+func acmeIssue(tx *issuance, csr []byte, domains []string) error {
+	if err := archiveVersion(certName(), false); err != nil {
+		return err
+	}
+
+	err := os.WriteFile(File.Request, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: csr}), 0600)
+	if err != nil {
+		return err
+	}
+	tx.addFile(File.Request)
+	sans := make([]string, len(domains))
+	for i, v := range domains {
+		sans[i] = "DNS:" + v
+	}
+	if err = writeRequestConfig(requestTemplate{
+		HostName:       domains[0],
+		SubjectAltName: "subjectAltName = " + strings.Join(sans, ","),
+	}); err != nil {
+		return err
+	}
+
+	if err = fipsCheckRequest(File.Request); err != nil {
+		return err
+	}
+	if err = runHook(HOOK_PRE_SIGN, hookMeta()); err != nil {
+		return err
+	}
+	if err = tx.saveDatabase(); err != nil {
+		return err
+	}
+	certFile, err := tempFile(File.Cert)
+	if err != nil {
+		return err
+	}
+
+	if nativeBackend() || loadKMS() != "" {
+		var subject []byte
+		if subject, err = asn1.Marshal(pkix.Name{CommonName: domains[0]}.ToRDNSequence()); err == nil {
+			err = nativeIssue(subject, File.SrvConfig, certFile)
+		}
+	} else {
+		config, done, err1 := resolveConfig(File.SrvConfig)
+		if err1 != nil {
+			return err1
+		}
+		defer done()
+
+		args := []string{"ca", "-batch", "-policy", "policy_anything", "-subj", "/CN=" + domains[0],
+			"-config", config, "-in", File.Request, "-out", certFile,
+		}
+		args = append(args, validityArgs()...)
+		args = append(args, fipsDigestArgs("ca")...)
+		args = append(args, caKeyArgs("-keyfile", "")...)
+		_, err = opensslNoFatal(args...)
+	}
+	if err != nil {
+		return err
+	}
+
+	if err = commitFile(certFile, File.Cert, 0644); err != nil {
+		return err
+	}
+	return syncDatabase()
+}
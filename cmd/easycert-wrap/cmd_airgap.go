@@ -0,0 +1,479 @@
+// Copyright 2014 Jonas mg
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/tredoe/flagplus"
+)
+
+var cmdAirgap = &flagplus.Subcommand{
+	UsageLine: "airgap [-cert] [-out file] [-qr dir] export NAME... | airgap import FILE...",
+	Short:     "exchange requests and certificates with an offline CA",
+	Long: `
+"airgap" carries the certificate requests to a CA in a machine without network,
+like the root CA of a ceremony, and the certificates signed back, through a
+single file or QR codes, so neither network nor USB devices are needed.
+
+	export  writes the requests NAME, or the certificates NAME with "-cert", in
+	        a bundle: in the file given in "-out", in the standard output by
+	        default, and like QR codes in PNG format in the directory given in
+	        "-qr", through the program "qrencode"
+	import  reads the bundles from the files; the images (PNG or JPEG) are
+	        decoded through the program "zbarimg", and the text files can have
+	        the content of the QR codes, one per line
+
+The requests imported are signed by "sign" in the offline machine, and then its
+certificates are exported with "-cert". The certificates imported must match
+the public key of the requests of the directory, which are removed, and they
+are verified with the CA whether it is in the directory.
+
+The bundle is compressed, and it is identified by its SHA-256 digest, printed
+by both commands, so it can be compared by the operators of both machines.
+`,
+	Run: runAirgap,
+}
+
+// Kinds of bundles.
+const (
+	AIRGAP_REQUESTS = "requests"
+	AIRGAP_CERTS    = "certificates"
+)
+
+const (
+	// AIRGAP_PEM is the type of the block in PEM format of a bundle.
+	AIRGAP_PEM = "EASYCERT BUNDLE"
+
+	// AIRGAP_QR_PREFIX starts the content of every QR code, followed by its
+	// index, the number of codes and the digest of the bundle, i.e.
+	// "EASYCERT:1/3:0a1b2c3d4e5f6a7b:...".
+	AIRGAP_QR_PREFIX = "EASYCERT:"
+
+	// _AIRGAP_QR_SIZE is the size of the data of every QR code, in Base64,
+	// small enough to be scanned from a screen.
+	_AIRGAP_QR_SIZE = 1200
+
+	// _AIRGAP_MAX_SIZE is the maximum size of a bundle decompressed.
+	_AIRGAP_MAX_SIZE = 10 << 20
+)
+
+var errAirgapQR = errors.New("wrong QR codes of the bundle")
+
+// airgapBundle represents the requests or the certificates to exchange.
+type airgapBundle struct {
+	Kind  string       `json:"kind"`
+	Items []airgapItem `json:"items"`
+}
+
+type airgapItem struct {
+	Name string `json:"name"`
+	PEM  string `json:"pem"`
+	// Extensions of the certificate set by "req" in the configuration of the
+	// request, which has the paths of the directory.
+	Extensions string `json:"extensions,omitempty"`
+}
+
+var QRDir = flag.String("qr", "", "directory of the QR codes")
+
+func init() {
+	addFlags(cmdAirgap, "cert", "out", "qr")
+}
+
+func runAirgap(cmd *flagplus.Subcommand, args []string) {
+	if len(args) < 2 || (args[0] != "export" && args[0] != "import") {
+		log.Print("Missing required arguments: export NAME... | import FILE...")
+		cmd.Usage()
+	}
+
+	if args[0] == "export" {
+		AirgapExport(args[1:], *IsCert)
+		return
+	}
+	bundles, err := readBundles(args[1:])
+	if err != nil {
+		log.Fatal(err)
+	}
+	for _, v := range bundles {
+		AirgapImport(v)
+	}
+}
+
+// AirgapExport writes the bundle of the requests, or of the certificates
+// whether `isCert` is set.
+func AirgapExport(names []string, isCert bool) {
+	b := airgapBundle{Kind: AIRGAP_REQUESTS}
+	if isCert {
+		b.Kind = AIRGAP_CERTS
+	}
+
+	for _, name := range names {
+		setCertPath(name)
+		item := airgapItem{Name: name}
+
+		file := File.Request
+		if isCert {
+			file = File.Cert
+		}
+		data, err := os.ReadFile(file)
+		if err != nil {
+			log.Fatal(err)
+		}
+		item.PEM = string(data)
+
+		if !isCert {
+			if item.Extensions, err = requestExtensions(File.SrvConfig); err != nil && !os.IsNotExist(err) {
+				log.Fatal(err)
+			}
+		}
+		b.Items = append(b.Items, item)
+	}
+
+	data, digest := b.encode()
+
+	if *Out == "" && *QRDir == "" {
+		os.Stdout.Write(b.pem(data))
+		return
+	}
+	fmt.Print("== Exported\n")
+	if *Out != "" {
+		if err := writeFileAtomic(*Out, b.pem(data), 0644); err != nil {
+			log.Fatal(err)
+		}
+		fmt.Printf("- Bundle:\t%q\n", *Out)
+	}
+	if *QRDir != "" {
+		fmt.Printf("- QR codes:\t%d in %q\n", writeQR(*QRDir, data, digest), *QRDir)
+	}
+	if isCert {
+		fmt.Printf("- Certificates:\t%d\n", len(b.Items))
+	} else {
+		fmt.Printf("- Requests:\t%d\n", len(b.Items))
+	}
+	fmt.Printf("- Digest:\t%s\n", digest)
+}
+
+// AirgapImport writes the requests or the certificates of the bundle
+// compressed into the certificates directory.
+func AirgapImport(data []byte) {
+	b, digest, err := decodeBundle(data)
+	if err != nil {
+		log.Fatalf("Bundle: %s", err)
+	}
+
+	for _, v := range b.Items {
+		if !validName.MatchString(v.Name) || v.Name == NAME_CA {
+			log.Fatalf("Bundle %s: wrong name: %q", digest, v.Name)
+		}
+	}
+
+	fmt.Print("== Imported\n")
+	switch b.Kind {
+	case AIRGAP_REQUESTS:
+		for _, v := range b.Items {
+			importAirgapRequest(v)
+		}
+		fmt.Printf("- Requests:\t%d\n", len(b.Items))
+	case AIRGAP_CERTS:
+		for _, v := range b.Items {
+			importAirgapCert(v)
+		}
+		fmt.Printf("- Certificates:\t%d\n", len(b.Items))
+	default:
+		log.Fatalf("Bundle %s: unknown kind: %q", digest, b.Kind)
+	}
+	fmt.Printf("- Digest:\t%s\n", digest)
+}
+
+// importAirgapRequest writes the request to be signed by "sign".
+func importAirgapRequest(item airgapItem) {
+	setCertPath(item.Name)
+
+	if _, err := os.Stat(File.Request); !os.IsNotExist(err) {
+		log.Fatalf("Certificate request already exists: %q", File.Request)
+	}
+	if _, err := parseRequestPEM([]byte(item.PEM)); err != nil {
+		log.Fatalf("%s: %s", item.Name, err)
+	}
+
+	if item.Extensions != "" {
+		err := writeRequestConfig(requestTemplate{HostName: item.Name, SubjectAltName: item.Extensions})
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	if err := writeFileAtomic(File.Request, []byte(item.PEM), 0644); err != nil {
+		log.Fatal(err)
+	}
+	fmt.Printf("- Request:\t%q\n", File.Request)
+}
+
+// importAirgapCert writes the certificate of a request of the directory, which
+// is removed.
+func importAirgapCert(item airgapItem) {
+	setCertPath(item.Name)
+
+	if _, err := os.Stat(File.Cert); !os.IsNotExist(err) {
+		log.Fatalf("Certificate already exists: %q", File.Cert)
+	}
+	block, _ := pem.Decode([]byte(item.PEM))
+	if block == nil || block.Type != "CERTIFICATE" {
+		log.Fatalf("%s: no certificate in PEM format", item.Name)
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		log.Fatalf("%s: %s", item.Name, err)
+	}
+
+	data, err := os.ReadFile(File.Request)
+	if err != nil {
+		log.Fatalf("%s: no request for the certificate: %s", item.Name, err)
+	}
+	req, err := parseRequestPEM(data)
+	if err != nil {
+		log.Fatalf("%s: %s", File.Request, err)
+	}
+	if !bytes.Equal(cert.RawSubjectPublicKeyInfo, req.RawSubjectPublicKeyInfo) {
+		log.Fatalf("%s: the certificate does not match the public key of the request", item.Name)
+	}
+
+	if _, err = os.Stat(caFile("")); os.IsNotExist(err) {
+		log.Printf("%s: no CA in the directory to verify the certificate", item.Name)
+	} else {
+		ca, err := parseCertFile(caFile(""))
+		if err != nil {
+			log.Fatal(err)
+		}
+		if err = cert.CheckSignatureFrom(ca); err != nil {
+			log.Fatalf("%s: not signed by the CA: %s", item.Name, err)
+		}
+	}
+
+	if err = writeFileAtomic(File.Cert, []byte(item.PEM), 0644); err != nil {
+		log.Fatal(err)
+	}
+	for _, v := range []string{File.Request, File.SrvConfig} {
+		if err = os.Remove(v); err != nil && !os.IsNotExist(err) {
+			log.Print(err)
+		}
+	}
+	fmt.Printf("- Certificate:\t%q\n", File.Cert)
+}
+
+// parseRequestPEM returns the certificate request in PEM format.
+func parseRequestPEM(data []byte) (*x509.CertificateRequest, error) {
+	block, _ := pem.Decode(data)
+	if block == nil || !strings.HasSuffix(block.Type, "CERTIFICATE REQUEST") {
+		return nil, errors.New("no certificate request in PEM format")
+	}
+	req, err := x509.ParseCertificateRequest(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	return req, req.CheckSignature()
+}
+
+// == Encoding
+//
+
+// encode returns the bundle in JSON format compressed with gzip, and its
+// digest in hexadecimal.
+func (b *airgapBundle) encode() ([]byte, string) {
+	data, err := json.Marshal(b)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	w, _ := gzip.NewWriterLevel(&buf, gzip.BestCompression)
+	w.Write(data)
+	if err = w.Close(); err != nil {
+		log.Fatal(err)
+	}
+	return buf.Bytes(), bundleDigest(buf.Bytes())
+}
+
+// decodeBundle returns the bundle compressed, and its digest.
+func decodeBundle(data []byte) (*airgapBundle, string, error) {
+	r, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, "", err
+	}
+	js, err := io.ReadAll(io.LimitReader(r, _AIRGAP_MAX_SIZE))
+	if err != nil {
+		return nil, "", err
+	}
+
+	b := new(airgapBundle)
+	if err = json.Unmarshal(js, b); err != nil {
+		return nil, "", err
+	}
+	return b, bundleDigest(data), nil
+}
+
+func bundleDigest(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// pem returns the bundle compressed in PEM format.
+func (b *airgapBundle) pem(data []byte) []byte {
+	return pem.EncodeToMemory(&pem.Block{
+		Type: AIRGAP_PEM,
+		Headers: map[string]string{
+			"Kind":  b.Kind,
+			"Count": strconv.Itoa(len(b.Items)),
+		},
+		Bytes: data,
+	})
+}
+
+// writeQR writes the bundle like QR codes in the directory, returning the
+// number of codes.
+func writeQR(dir string, data []byte, digest string) int {
+	qrencode := lookTool("qrencode")
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		log.Fatal(err)
+	}
+
+	chunks := qrChunks(data, digest)
+	for i, v := range chunks {
+		file := filepath.Join(dir, fmt.Sprintf("bundle-%02d.png", i+1))
+		execCmd(strings.NewReader(v), qrencode, "-l", "M", "-o", file)
+	}
+	return len(chunks)
+}
+
+// qrChunks returns the content of the QR codes of the bundle.
+func qrChunks(data []byte, digest string) []string {
+	enc := base64.StdEncoding.EncodeToString(data)
+	n := (len(enc) + _AIRGAP_QR_SIZE - 1) / _AIRGAP_QR_SIZE
+
+	chunks := make([]string, 0, n)
+	for i := 0; i < n; i++ {
+		end := (i + 1) * _AIRGAP_QR_SIZE
+		if end > len(enc) {
+			end = len(enc)
+		}
+		chunks = append(chunks, fmt.Sprintf("%s%d/%d:%s:%s",
+			AIRGAP_QR_PREFIX, i+1, n, digest[:16], enc[i*_AIRGAP_QR_SIZE:end]))
+	}
+	return chunks
+}
+
+// readBundles returns the bundles compressed of the files in PEM format, and
+// of the content of the QR codes, in images or in lines of text, whose codes
+// can be split across the files.
+func readBundles(files []string) ([][]byte, error) {
+	var bundles [][]byte
+	var lines []string
+
+	for _, file := range files {
+		var data []byte
+		var err error
+
+		switch strings.ToLower(filepath.Ext(file)) {
+		case ".png", ".jpg", ".jpeg":
+			data = execCmd(nil, lookTool("zbarimg"), "--raw", "-q", file)
+		default:
+			if data, err = os.ReadFile(file); err != nil {
+				return nil, err
+			}
+		}
+
+		if !bytes.Contains(data, []byte("-----BEGIN "+AIRGAP_PEM)) {
+			lines = append(lines, strings.Split(string(data), "\n")...)
+			continue
+		}
+		for {
+			var block *pem.Block
+			if block, data = pem.Decode(data); block == nil {
+				break
+			}
+			if block.Type == AIRGAP_PEM {
+				bundles = append(bundles, block.Bytes)
+			}
+		}
+	}
+
+	qr, err := joinQRChunks(lines)
+	if err != nil {
+		return nil, err
+	}
+	if bundles = append(bundles, qr...); len(bundles) == 0 {
+		return nil, errors.New("no bundle found")
+	}
+	return bundles, nil
+}
+
+// joinQRChunks returns the bundles compressed from the content of their QR
+// codes, in any order; the lines without the prefix are skipped.
+func joinQRChunks(lines []string) ([][]byte, error) {
+	var digests []string
+	parts := make(map[string][]string)
+
+	for _, line := range lines {
+		line = strings.TrimSpace(line)
+		if !strings.HasPrefix(line, AIRGAP_QR_PREFIX) {
+			continue
+		}
+		field := strings.SplitN(line[len(AIRGAP_QR_PREFIX):], ":", 3)
+		if len(field) != 3 {
+			return nil, errAirgapQR
+		}
+		index, total, ok := strings.Cut(field[0], "/")
+		i, err1 := strconv.Atoi(index)
+		n, err2 := strconv.Atoi(total)
+		if !ok || err1 != nil || err2 != nil || i < 1 || i > n {
+			return nil, errAirgapQR
+		}
+
+		digest := field[1]
+		if parts[digest] == nil {
+			parts[digest] = make([]string, n)
+			digests = append(digests, digest)
+		} else if len(parts[digest]) != n {
+			return nil, fmt.Errorf("%s %s: wrong number of codes", errAirgapQR, digest)
+		}
+		parts[digest][i-1] = field[2]
+	}
+
+	bundles := make([][]byte, 0, len(digests))
+	for _, digest := range digests {
+		for i, v := range parts[digest] {
+			if v == "" {
+				return nil, fmt.Errorf("%s %s: missing the code %d of %d", errAirgapQR, digest, i+1, len(parts[digest]))
+			}
+		}
+
+		data, err := base64.StdEncoding.DecodeString(strings.Join(parts[digest], ""))
+		if err != nil {
+			return nil, fmt.Errorf("%s %s: %s", errAirgapQR, digest, err)
+		}
+		if !strings.HasPrefix(bundleDigest(data), digest) {
+			return nil, fmt.Errorf("%s %s: wrong digest", errAirgapQR, digest)
+		}
+		bundles = append(bundles, data)
+	}
+	return bundles, nil
+}
@@ -0,0 +1,95 @@
+// Copyright 2014 Jonas mg
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"github.com/tredoe/flagplus"
+)
+
+var cmdAudit = &flagplus.Subcommand{
+	UsageLine: "audit [-all]",
+	Short:     "show the audit log",
+	Long: `
+"audit" shows who did every action on the certificates directory, the last
+fifty events or all of them using "-all".
+
+The operator is the user of the system, or the name set in the environment
+variable EASYCERT_OPERATOR; in the portal it is the common name of the client
+certificate, or "portal" without it. The roles are enforced whether the field
+"operators" is set in the file "store.json":
+
+	{
+		"operators": {
+			"alice": "admin",
+			"bob": "issuer",
+			"carol": "auditor"
+		}
+	}
+
+An "admin" can do everything, an "issuer" creates, signs and reviews requests,
+and an "auditor" can only read. Since anyone can set EASYCERT_OPERATOR, it is
+refused then; and the portal requires a client certificate to approve, deny or
+revoke.
+
+Whether the field "syslog" of "store.json" is set to "journald" or "syslog",
+the events are sent too to the journal of systemd or to the local syslog, so
+the pipelines of logs capture them without reading the audit log. The events
+have the fields EASYCERT_ACTION, EASYCERT_OPERATOR, EASYCERT_NAME and
+EASYCERT_DETAIL in the journal, and the pairs "action=", "operator=", "name="
+and "detail=" after of the message in syslog:
+
+	{
+		"syslog": "journald"
+	}
+`,
+	Run: runAudit,
+}
+
+func init() {
+	addFlags(cmdAudit, "all", "readonly")
+}
+
+func runAudit(cmd *flagplus.Subcommand, args []string) {
+	file, err := os.Open(File.Audit)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return
+		}
+		log.Fatal(err)
+	}
+	defer file.Close()
+
+	var events []auditEvent
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var ev auditEvent
+
+		if err = json.Unmarshal(scanner.Bytes(), &ev); err != nil {
+			log.Fatalf("Corrupted audit log: %s", err)
+		}
+		events = append(events, ev)
+	}
+	if err = scanner.Err(); err != nil {
+		log.Fatal(err)
+	}
+
+	if !*IsAll && len(events) > 50 {
+		events = events[len(events)-50:]
+	}
+	for _, ev := range events {
+		fmt.Printf("%s  %-12s %-8s %-20s %s\n",
+			ev.Time.Local().Format(time.RFC822), ev.Operator, ev.Action, ev.Name, ev.Detail)
+	}
+}
@@ -0,0 +1,225 @@
+// Copyright 2014 Jonas mg
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"crypto"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/tredoe/flagplus"
+)
+
+var cmdAuditKeys = &flagplus.Subcommand{
+	UsageLine: "audit-keys [-json] [-readonly]",
+	Short:     "look for weak or shared keys",
+	Long: `
+"audit-keys" scans the private keys of the certificates directory and the public
+keys of its certificates, the current and the previous versions, looking for:
+
+	keys shared by several names, since a key used by different services is
+	exposed whether any of them is compromised
+	weak keys, like in "chk -key": too small, with a wrong exponent, or with the
+	fingerprint of the keys vulnerable to ROCA or generated by the OpenSSL of
+	Debian with a predictable random generator
+
+The encrypted private keys are not read, but the public keys of their
+certificates are checked. It fails whether something is found, printing the
+findings in JSON format whether it is used the flag "-json".
+`,
+	Run: runAuditKeys,
+}
+
+func init() {
+	addFlags(cmdAuditKeys, "json", "readonly")
+}
+
+// keyUse represents a file of the certificates directory with a key.
+type keyUse struct {
+	Name string `json:"name"`
+	File string `json:"file"`
+}
+
+// keyFinding represents a key which is weak or shared by several names.
+type keyFinding struct {
+	Fingerprint string   `json:"fingerprint_sha256"` // Of the public key (SPKI).
+	Uses        []keyUse `json:"uses"`
+	Problems    []string `json:"problems"`
+}
+
+func runAuditKeys(cmd *flagplus.Subcommand, args []string) {
+	if len(args) != 0 {
+		log.Print("Too many arguments")
+		cmd.Usage()
+	}
+
+	findings, err := auditKeys()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if *IsJSON {
+		data, err := json.MarshalIndent(findings, "", "\t")
+		if err != nil {
+			log.Fatal(err)
+		}
+		fmt.Printf("%s\n", data)
+	} else if len(findings) == 0 {
+		fmt.Println("No weak or shared keys")
+	} else {
+		for _, f := range findings {
+			fmt.Printf("\n== Key %s\n", f.Fingerprint)
+			for _, v := range f.Uses {
+				fmt.Printf("- %s\t%q\n", v.Name, v.File)
+			}
+			for _, v := range f.Problems {
+				fmt.Printf("* %s\n", v)
+			}
+		}
+		fmt.Println()
+	}
+
+	if len(findings) != 0 {
+		log.Fatalf("Found %d weak or shared keys", len(findings))
+	}
+}
+
+// auditKeys returns the keys of the certificates directory which are weak or
+// used by several names, in the order they are found.
+func auditKeys() ([]*keyFinding, error) {
+	type storeKey struct {
+		pub  crypto.PublicKey
+		uses []keyUse
+	}
+	keys := make(map[string]*storeKey)
+	var order []string
+
+	add := func(name, file string, pub crypto.PublicKey) error {
+		spki, err := x509.MarshalPKIXPublicKey(pub)
+		if err != nil {
+			return fmt.Errorf("%s: %s", file, err)
+		}
+		sum := sha256.Sum256(spki)
+		fingerprint := hex.EncodeToString(sum[:])
+
+		k, ok := keys[fingerprint]
+		if !ok {
+			k = &storeKey{pub: pub}
+			keys[fingerprint] = k
+			order = append(order, fingerprint)
+		}
+		k.uses = append(k.uses, keyUse{Name: name, File: file})
+		return nil
+	}
+
+	certs := loadCerts()
+	history, err := filepath.Glob(filepath.Join(Dir.Cert, DIR_HISTORY, "*"+EXT_CERT))
+	if err != nil {
+		return nil, err
+	}
+	for _, v := range history {
+		cert, err := parseCertFile(v)
+		if err != nil {
+			log.Printf("%s: %s", v, err)
+			continue
+		}
+		certs = append(certs, &storeCert{
+			Name: strings.TrimSuffix(filepath.Base(v), EXT_CERT),
+			File: v,
+			Cert: cert,
+		})
+	}
+	for _, c := range certs {
+		if err = add(c.Name, c.File, c.Cert.PublicKey); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, dir := range []string{Dir.Key, filepath.Join(Dir.Key, DIR_HISTORY)} {
+		match, err := filepath.Glob(filepath.Join(dir, "*"+EXT_KEY))
+		if err != nil {
+			return nil, err
+		}
+		for _, v := range match {
+			pub, err := readPublicKey(v)
+			if err != nil {
+				log.Printf("%s: %s", v, err)
+				continue
+			}
+			if pub == nil { // encrypted
+				continue
+			}
+			if err = add(strings.TrimSuffix(filepath.Base(v), EXT_KEY), v, pub); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	findings := make([]*keyFinding, 0)
+
+	for _, fingerprint := range order {
+		k := keys[fingerprint]
+		f := &keyFinding{Fingerprint: fingerprint, Uses: k.uses}
+
+		// The versions of a certificate can keep the same key.
+		names := make(map[string]bool)
+		for _, v := range k.uses {
+			names[strings.SplitN(v.Name, "@", 2)[0]] = true
+		}
+		if len(names) > 1 {
+			f.Problems = append(f.Problems, fmt.Sprintf("key shared by %d names", len(names)))
+		}
+
+		if r, err := checkPublicKey(k.pub); err != nil {
+			f.Problems = append(f.Problems, err.Error())
+		} else {
+			f.Problems = append(f.Problems, r.Problems...)
+		}
+
+		if len(f.Problems) != 0 {
+			findings = append(findings, f)
+		}
+	}
+	return findings, nil
+}
+
+// readPublicKey returns the public key of the private key file, or nil whether
+// the private key is encrypted.
+func readPublicKey(file string) (crypto.PublicKey, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	defer zero(data)
+
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("no private key in PEM format: %q", file)
+	}
+	if isEncryptedKey(block) {
+		return nil, nil
+	}
+	defer zero(block.Bytes)
+
+	key, err := parsePrivateKey(block)
+	if err != nil {
+		return nil, err
+	}
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, errKeyType
+	}
+	return signer.Public(), nil
+}
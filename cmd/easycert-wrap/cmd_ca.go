@@ -16,20 +16,107 @@ import (
 )
 
 var cmdCA = &flagplus.Subcommand{
-	UsageLine: "ca [-rsa-size bits] [-years number]",
+	UsageLine: "ca [-intermediate name [-parent name] | -yubikey [-slot name] | -kms-uri uri] [-passin source] [-key-type rsa|ecdsa] [-rsa-size bits] [-curve name] [-years number] [-backend name] [-fips] [-batch]",
 	Short:     "create certification authority",
 	Long: `
 "ca" creates a certification authority (CA) and makes the directories and files
 to handle the certificates signed by this CA.
+
+The private key is RSA of the size given in "-rsa-size" (2048 bits by default),
+or ECDSA with "-key-type ecdsa" on the curve given in "-curve" ("p256" by
+default; "p384" or "p521"). A CA with a key of a type can sign requests with
+keys of the other one.
+
+The CA's private key is encrypted in AES-256 with a passphrase, which is got
+from the environment variable EASYCERT_CA_PASS whether it is set, instead of
+being prompted; it is also used by "sign", "approve" and the rest of commands
+which sign with the CA. With "-passin", it is got from another source, like in
+OpenSSL: "env:VAR", an environment variable, or "file:PATH", the first line of
+a file; it can not be given in the command line.
+
+With "-batch", the commands never prompt: the subject has the default values of
+the configuration, or of the file of defaults of the user for the CA, whose
+common name is the organization followed by " CA" (see "init"), and they fail
+whether the passphrase is needed but it is not in EASYCERT_CA_PASS nor in
+"-passin", instead of
+waiting for an answer. It is also used whether the standard input is closed or
+it is the null device, like in the daemons; any other standard input, like a
+pipe, is used to answer the prompts. In batch mode, a spinner is shown while the
+key is generated whether the standard error output is a terminal.
+
+With "-intermediate NAME", an intermediate CA is created instead, signed by
+the CA given in "-parent" (the root CA by default, or another intermediate CA).
+It is placed in the directory "intermediates/NAME" with the same layout than the
+certificates directory: its certificate, its private key (encrypted with the
+passphrase of EASYCERT_CA_PASS too) and its database, where the certificates
+signed by it are recorded. Its certificate is stored in the chains directory
+too, to build the chains of the certificates issued by it (see "sign -ca"). In
+batch mode, its common name is the organization followed by NAME and " CA". The
+native backend does not support the intermediate CAs.
+
+In FIPS mode ("-fips", the environment variable EASYCERT_FIPS, the field
+"fips" of "store.json", or built with the tag "boringcrypto"), the key sizes,
+curves and signature algorithms are restricted to those approved by FIPS, and
+the operations outside them are refused.
+
+With "-yubikey", the private key of the root CA is generated into the slot PIV
+of "-slot" ("9c", for digital signatures, by default) of the YubiKey connected,
+through "ykman", and it is never written in the private directory: it is
+replaced by "ca.yubikey", with the serial number of the YubiKey and the slot.
+The key requires the PIN at every use, so "sign", "approve", "revoke" and the
+rest of commands which sign with the CA prompt for it, or get it from the
+environment variable EASYCERT_YUBIKEY_PIN. OpenSSL signs through the provider
+"pkcs11" (pkcs11-provider) with the PKCS#11 module of the variable
+PKCS11_PROVIDER_MODULE, or else "libykcs11.so" of yubico-piv-tool. The
+YubiKey supports RSA keys up to 4096 bits and the curves p256 and p384; the
+native backend and "ocsp-serve" can not sign with it.
+
+With "-kms-uri URI", the private key of the root CA is the one of a cloud KMS,
+already created with a purpose of signing: "awskms:///KEY" (its ID, ARN or
+alias), or "awskms://REGION/KEY", for AWS KMS; "gcpkms://projects/.../
+cryptoKeyVersions/N", for GCP Cloud KMS; or "azurekms://VAULT.vault.azure.net/
+keys/NAME/VERSION", for Azure Key Vault. The URI is stored in "ca.kms", in
+place of the key, and the certificates and CRLs of the root CA are signed in Go,
+like by the native backend, where the KMS signs the digests: with the
+credentials of the command "aws" for AWS, and with the access tokens of "gcloud"
+or "az" for the others, so the key never leaves the KMS. "sign -kms-uri" signs
+with a KMS a CA whose key is in a file, to migrate it, whether it is the same
+key. The extensions of the requests are the ones of the native backend, and a
+root CA in a KMS does not sign intermediate CAs nor files.
+
+With "-backend native", the CA is created in Go instead of executing OpenSSL,
+so it is not needed: the subject is the one of batch mode, and the private key
+is encrypted in PKCS#8 with the passphrase of EASYCERT_CA_PASS or "-passin",
+which is required. The files and the database are the same than with OpenSSL, so both
+backends can be mixed. The backend by default can be set in the section
+"[flags]" of the file of defaults of the user (see "init"), or in the
+environment variable EASYCERT_FLAG_BACKEND.
 `,
 	Run: runCA,
 }
 
 func init() {
-	cmdCA.AddFlags("rsa-size", "years")
+	addFlags(cmdCA, "intermediate", "parent", "yubikey", "slot", "kms-uri", "passin", "key-type", "rsa-size", "curve", "years", "backend", "fips", "batch")
 }
 
 func runCA(cmd *flagplus.Subcommand, args []string) {
+	if len(args) != 0 {
+		log.Print("Too many arguments")
+		cmd.Usage()
+	}
+	if err := checkYubiKey(); err != nil {
+		log.Fatal(err)
+	}
+	if err := checkKMS(); err != nil {
+		log.Fatal(err)
+	}
+	if *Intermediate != "" {
+		CreateIntermediate(*Intermediate, *Parent)
+		return
+	}
+
+	operator := mustRole(ACTION_CA)
+	fipsCheckKeySpec(&KeySpec)
 	setCertPath(NAME_CA)
 
 	_, err := os.Stat(File.Cert)
@@ -37,55 +124,111 @@ func runCA(cmd *flagplus.Subcommand, args []string) {
 		log.Fatal("The certification authority's certificate exists")
 	}
 
+	tx := beginIssuance()
+	if err = tx.saveDatabase(); err != nil {
+		log.Fatal(err)
+	}
+
 	// New directories and files.
 
 	for _, v := range []string{Dir.NewCert, Dir.Revok} {
 		if err = os.Mkdir(v, 0755); err != nil {
-			log.Fatal(err)
+			fatal(err)
 		}
+		tx.addFile(v)
 	}
 
-	file, err := os.Create(File.Index)
-	if err != nil {
-		log.Fatal(err)
+	if err = writeFileAtomic(File.Index, nil, 0644); err != nil {
+		fatal(err)
 	}
-	file.Close()
-
-	file, err = os.Create(File.Serial)
-	if err != nil {
-		log.Fatal(err)
+	if err = writeFileAtomic(File.Serial, []byte{'0', '1', '\n'}, 0644); err != nil {
+		fatal(err)
 	}
-	_, err = file.Write([]byte{'0', '1', '\n'})
-	file.Close()
-	if err != nil {
-		log.Fatal(err)
+	if err = writeFileAtomic(File.CRLNumber, []byte{'0', '1', '\n'}, 0644); err != nil {
+		fatal(err)
 	}
 
 	// CA
 
 	fmt.Print("\n== Build Certification Authority\n\n")
 
-	opensslArgs := []string{"req", "-new",
-		"-config", File.Config, "-out", File.Request, "-keyout", File.Key,
-		"-newkey", "rsa:" + RSASize.String(),
+	keyFile := ""
+	if !*IsYubiKey && *KMSURI == "" {
+		keyFile = createKeyFile(File.Key)
 	}
-	fmt.Printf("%s", openssl(opensslArgs...))
+	certFile := mustTempFile(File.Cert)
+
+	if *IsYubiKey {
+		config, done := mustResolveConfig(File.Config)
+		defer done()
+		tx.addFile(File.Request)
+
+		newYubiKeyCA(tx, config, certFile)
+	} else if *KMSURI != "" {
+		key, err := newKMSSigner(*KMSURI)
+		if err != nil {
+			fatal(err)
+		}
+		if err = nativeCACert(key, certFile); err != nil {
+			fatal(err)
+		}
+		if err = writeFileAtomic(kmsFile(), []byte(*KMSURI+"\n"), 0644); err != nil {
+			fatal(err)
+		}
+		tx.addFile(kmsFile())
+	} else if nativeBackend() {
+		if err = nativeCA(keyFile, certFile); err != nil {
+			fatal(err)
+		}
+	} else {
+		config, done := mustResolveConfig(File.Config)
+		defer done()
+		tx.addFile(File.Request)
+
+		genEncryptedKey(keyFile, caPassArgs("-pass"))
+
+		opensslArgs := []string{"req", "-new",
+			"-config", config, "-out", File.Request, "-key", keyFile,
+		}
+		opensslArgs = append(opensslArgs, fipsDigestArgs("req")...)
+		if batchMode() {
+			opensslArgs = append(opensslArgs, "-batch", "-subj", caBatchSubject())
+		}
+		opensslArgs = append(opensslArgs, caPassArgs("-passin")...)
+		fmt.Printf("%s", openssl(opensslArgs...))
 
-	fmt.Print("\n== Sign\n\n")
+		fmt.Print("\n== Sign\n\n")
 
-	opensslArgs = []string{"ca", "-selfsign", "-batch", "-create_serial",
-		"-config", File.Config, "-keyfile", File.Key, "-in", File.Request, "-out", File.Cert,
-		"-days", strconv.Itoa(365 * *Years),
-		"-extensions", "v3_ca",
+		opensslArgs = []string{"ca", "-selfsign", "-batch", "-create_serial",
+			"-config", config, "-keyfile", keyFile, "-in", File.Request, "-out", certFile,
+			"-days", strconv.Itoa(365 * *Years),
+			"-extensions", "v3_ca",
+		}
+		opensslArgs = append(opensslArgs, fipsDigestArgs("ca")...)
+		opensslArgs = append(opensslArgs, caPassArgs("-passin")...)
+		fmt.Printf("%s", openssl(opensslArgs...))
 	}
-	fmt.Printf("%s", openssl(opensslArgs...))
 
-	if err = os.Remove(File.Request); err != nil {
-		log.Print(err)
+	if keyFile != "" {
+		mustCommitFile(keyFile, File.Key, 0400)
 	}
-	if err = os.Chmod(File.Key, 0400); err != nil {
+	mustCommitFile(certFile, File.Cert, 0644)
+	if err = syncDatabase(); err != nil {
+		fatal(err)
+	}
+	commitIssuance()
+
+	if err = os.Remove(File.Request); err != nil && !os.IsNotExist(err) {
 		log.Print(err)
 	}
 
-	fmt.Printf("\n== Generated\n- Certificate:\t%q\n- Private key:\t%q\n", File.Cert, File.Key)
+	fmt.Printf("\n== Generated\n- Certificate:\t%q\n", File.Cert)
+	if uri := loadKMS(); uri != "" {
+		fmt.Printf("- Private key:\t%s\n", uri)
+	} else if y := loadYubiKey(); y != nil {
+		fmt.Printf("- Private key:\tYubiKey %s, slot %s\n", y.Serial, y.Slot)
+	} else {
+		fmt.Printf("- Private key:\t%q\n", File.Key)
+	}
+	audit(operator, ACTION_CA, NAME_CA, "")
 }
@@ -14,7 +14,7 @@ import (
 )
 
 var cmdCat = &flagplus.Subcommand{
-	UsageLine: "cat [-req | -cert | -key] FILE",
+	UsageLine: "cat [-req | -cert | -key] [-readonly] FILE",
 	Short:     "show the content",
 	Long: `
 "cat" shows the content of a certification-related file.
@@ -25,7 +25,7 @@ a name or the path when the "file" is an absolute or relatative path.
 }
 
 func init() {
-	cmdCat.AddFlags("req", "cert", "key")
+	addFlags(cmdCat, "req", "cert", "key", "readonly")
 }
 
 func runCat(cmd *flagplus.Subcommand, args []string) {
@@ -0,0 +1,435 @@
+// Copyright 2014 Jonas mg
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/tredoe/easycert"
+	"github.com/tredoe/easycert/store"
+	"github.com/tredoe/flagplus"
+)
+
+var cmdCeremony = &flagplus.Subcommand{
+	UsageLine: "ceremony [-shares number] [-threshold number] [-out dir] [-key-type rsa|ecdsa] [-rsa-size bits] [-curve name] [-years number] [-backend name] create | ceremony join FILE... | ceremony verify FILE",
+	Short:     "create the root CA in an auditable ceremony",
+	Long: `
+"ceremony" guides the creation of the root CA for the teams which need an
+auditable record of it.
+
+	create  prompts for the administrator of the ceremony, the witnesses and the
+	        custodian of every share; checks the random generator; creates the
+	        CA like "ca -batch" with a random passphrase, which is split in the
+	        shares given in "-shares" (5 by default), so that any of them given
+	        in "-threshold" (3 by default) recover it; and writes the report of
+	        the ceremony signed by the new CA
+	join    prints the passphrase of the CA's private key recovered from the
+	        files of the shares, to be set in EASYCERT_CA_PASS
+	verify  checks the signature of the report of a ceremony with the CA
+
+The shares, the report ("report.txt") and its signature ("report.txt.sig") are
+written into the directory given in "-out", "ceremony" of the certificates
+directory by default. Every share has to be handed to its custodian and removed
+from the disk; the passphrase is never shown. The report has the fingerprints of
+the CA and of every share, and room for the signatures of the attendees, so it
+can be printed. The signature can be checked with OpenSSL too:
+
+	openssl dgst -sha256 -signature report.txt.sig \
+		-verify <(openssl x509 -pubkey -noout -in certs/ca.crt) report.txt
+
+The random generator is checked with the tests of monobit and long runs of FIPS
+140-2 over 20000 bits, and the entropy of the kernel whether it is available.
+`,
+	Run: runCeremony,
+}
+
+const (
+	// CEREMONY_SHARE_PEM is the type of the block in PEM format of a share.
+	CEREMONY_SHARE_PEM = "EASYCERT CEREMONY SHARE"
+
+	FILE_CEREMONY_REPORT = "report.txt"
+
+	// _CEREMONY_PASS_SIZE is the size in bytes of the random passphrase.
+	_CEREMONY_PASS_SIZE = 32
+
+	// _ENTROPY_MIN is the minimum of the entropy of the kernel, in bits.
+	_ENTROPY_MIN = 256
+)
+
+var (
+	Shares    = flag.Int("shares", 5, "number of shares to split the secret")
+	Threshold = flag.Int("threshold", 3, "number of shares needed to recover the secret")
+)
+
+// fileEntropy is the entropy available in the kernel of Linux.
+var fileEntropy = "/proc/sys/kernel/random/entropy_avail"
+
+var errCeremonyAbort = errors.New("ceremony aborted")
+
+// nameFile matches the characters to remove of a name to use it in a file name.
+var nameFile = regexp.MustCompile(`[^A-Za-z0-9._-]+`)
+
+func init() {
+	addFlags(cmdCeremony, "shares", "threshold", "out", "key-type", "rsa-size", "curve", "years", "backend")
+}
+
+func runCeremony(cmd *flagplus.Subcommand, args []string) {
+	switch {
+	case len(args) == 1 && args[0] == "create":
+		CeremonyCreate(os.Stdin)
+	case len(args) > 1 && args[0] == "join":
+		pass, err := ceremonyJoin(args[1:])
+		if err != nil {
+			log.Fatal(err)
+		}
+		fmt.Println(pass)
+	case len(args) == 2 && args[0] == "verify":
+		if err := ceremonyVerify(args[1]); err != nil {
+			log.Fatal(err)
+		}
+		fmt.Printf("%s: OK\n", args[1])
+	default:
+		log.Print("Missing required arguments: create | join FILE... | verify FILE")
+		cmd.Usage()
+	}
+}
+
+// ceremonyReport represents the record of a ceremony.
+type ceremonyReport struct {
+	Date          time.Time
+	Host          string
+	Operator      string
+	Administrator string
+	Witnesses     []string
+	Custodians    []string
+	Entropy       []string
+}
+
+// CeremonyCreate runs the ceremony of creation of the root CA, reading the
+// answers of the prompts from `in`.
+func CeremonyCreate(in io.Reader) {
+	setCertPath(NAME_CA)
+	if _, err := os.Stat(File.Cert); !os.IsNotExist(err) {
+		log.Fatal("The certification authority's certificate exists")
+	}
+	if *Threshold < 2 || *Threshold > *Shares || *Shares > 255 {
+		log.Fatalf("The threshold (%d) must be between 2 and the number of shares (%d), up to 255",
+			*Threshold, *Shares)
+	}
+	dir := *Out
+	if dir == "" {
+		dir = filepath.Join(Dir.Root, "ceremony")
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		log.Fatal(err)
+	}
+
+	r := ceremonyReport{Date: time.Now().UTC(), Operator: currentOperator()}
+	r.Host, _ = os.Hostname()
+	answers := bufio.NewReader(in)
+
+	fmt.Print("\n== Root ceremony\n\n")
+
+	r.Administrator = mustAsk(answers, "Administrator of the ceremony")
+	for _, v := range strings.Split(mustAsk(answers, "Witnesses (comma-separated)"), ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			r.Witnesses = append(r.Witnesses, v)
+		}
+	}
+	for i := 1; i <= *Shares; i++ {
+		r.Custodians = append(r.Custodians, mustAsk(answers, fmt.Sprintf("Custodian of the share %d/%d", i, *Shares)))
+	}
+
+	fmt.Print("\n== Entropy\n\n")
+
+	entropy, err := entropyChecks()
+	for _, v := range entropy {
+		fmt.Printf("- %s\n", v)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+	r.Entropy = entropy
+
+	fmt.Println()
+	if mustAsk(answers, "Type YES to create the root CA") != "YES" {
+		log.Fatal(errCeremonyAbort)
+	}
+
+	secret := make([]byte, _CEREMONY_PASS_SIZE)
+	if _, err = rand.Read(secret); err != nil {
+		log.Fatal(err)
+	}
+	pass := hex.EncodeToString(secret)
+	shares, err := shamirSplit([]byte(pass), *Shares, *Threshold)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	os.Setenv(ENV_CA_PASS, pass)
+	*IsBatch = true
+	runCA(cmdCA, nil)
+
+	ca, err := parseCertFile(File.Cert)
+	if err != nil {
+		log.Fatal(err)
+	}
+	caSum := fingerprint(sha256Sum(ca.Raw))
+
+	fmt.Print("\n== Shares\n\n")
+
+	var shareSums []string
+	for i, share := range shares {
+		block := &pem.Block{
+			Type: CEREMONY_SHARE_PEM,
+			Headers: map[string]string{
+				"Custodian": r.Custodians[i],
+				"Share":     fmt.Sprintf("%d/%d", i+1, *Shares),
+				"Threshold": strconv.Itoa(*Threshold),
+				"CA":        caSum,
+			},
+			Bytes: share,
+		}
+		data := pem.EncodeToMemory(block)
+		name := fmt.Sprintf("share-%d-%s.pem", i+1, strings.Trim(nameFile.ReplaceAllString(r.Custodians[i], "_"), "_"))
+		file := filepath.Join(dir, name)
+
+		if err = writeFileAtomic(file, data, 0400); err != nil {
+			log.Fatal(err)
+		}
+		shareSums = append(shareSums, hex.EncodeToString(sha256Sum(data)))
+		fmt.Printf("- %s:\t%q\n", r.Custodians[i], file)
+	}
+
+	report := r.text(ca, shareSums)
+	file := filepath.Join(dir, FILE_CEREMONY_REPORT)
+	if err = writeFileAtomic(file, report, 0644); err != nil {
+		log.Fatal(err)
+	}
+	key, err := loadKeyFile(File.Key, pass)
+	if err != nil {
+		log.Fatal(err)
+	}
+	digest := sha256.Sum256(report)
+	sig, err := key.Sign(rand.Reader, digest[:], crypto.SHA256)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err = writeFileAtomic(file+".sig", sig, 0644); err != nil {
+		log.Fatal(err)
+	}
+
+	fmt.Printf("\n== Report\n\n%s\n== Generated\n- Report:\t%q\n- Signature:\t%q\n", report, file, file+".sig")
+	audit(r.Operator, ACTION_CA, NAME_CA, "ceremony report "+hex.EncodeToString(digest[:]))
+}
+
+// text returns the report of the ceremony of the CA, with the digests of the
+// shares.
+func (r *ceremonyReport) text(ca *x509.Certificate, shareSums []string) []byte {
+	var b bytes.Buffer
+
+	fmt.Fprint(&b, "EasyCert root CA ceremony\n=========================\n\n")
+	fmt.Fprintf(&b, "Date:\t\t%s\n", r.Date.Format(time.RFC3339))
+	fmt.Fprintf(&b, "Host:\t\t%s\n", r.Host)
+	fmt.Fprintf(&b, "Operator:\t%s\n", r.Operator)
+	fmt.Fprintf(&b, "Administrator:\t%s\n", r.Administrator)
+	fmt.Fprintf(&b, "Witnesses:\t%s\n", strings.Join(r.Witnesses, ", "))
+
+	fmt.Fprint(&b, "\n== Entropy\n\n")
+	for _, v := range r.Entropy {
+		fmt.Fprintf(&b, "- %s\n", v)
+	}
+
+	fmt.Fprint(&b, "\n== Root CA\n\n")
+	fmt.Fprintf(&b, "Subject:\t%s\n", ca.Subject)
+	fmt.Fprintf(&b, "Serial:\t\t%s\n", easycert.SerialHex(ca.SerialNumber))
+	fmt.Fprintf(&b, "Not before:\t%s\n", ca.NotBefore.UTC().Format(time.RFC3339))
+	fmt.Fprintf(&b, "Not after:\t%s\n", ca.NotAfter.UTC().Format(time.RFC3339))
+	switch pub := ca.PublicKey.(type) {
+	case *rsa.PublicKey:
+		fmt.Fprintf(&b, "Key:\t\tRSA %d bits\n", pub.N.BitLen())
+	case *ecdsa.PublicKey:
+		fmt.Fprintf(&b, "Key:\t\tECDSA %s\n", pub.Curve.Params().Name)
+	}
+	fmt.Fprintf(&b, "SHA-256:\t%s\n", fingerprint(sha256Sum(ca.Raw)))
+	fmt.Fprintf(&b, "SHA-1:\t\t%s\n", fingerprint(sha1Sum(ca.Raw)))
+	fmt.Fprintf(&b, "SPKI pin:\t%s\n", store.SPKIPin(ca.RawSubjectPublicKeyInfo))
+
+	fmt.Fprint(&b, "\n== Shares\n\n")
+	fmt.Fprintf(&b, "The passphrase of the private key is split in %d shares; any %d of them\nrecover it. SHA-256 of the files:\n\n",
+		len(shareSums), *Threshold)
+	for i, v := range shareSums {
+		fmt.Fprintf(&b, "%d. %s\t%s\n", i+1, r.Custodians[i], v)
+	}
+
+	fmt.Fprint(&b, "\n== Signatures\n\n")
+	attendees := append([]string{r.Administrator}, r.Witnesses...)
+	attendees = append(attendees, r.Custodians...)
+	for _, v := range attendees {
+		fmt.Fprintf(&b, "%s:\n\n\t____________________________\n\n", v)
+	}
+	return b.Bytes()
+}
+
+// mustAsk prints the question and returns the answer, which can not be empty.
+func mustAsk(r *bufio.Reader, question string) string {
+	for {
+		fmt.Printf("%s: ", question)
+		line, err := r.ReadString('\n')
+		line = strings.TrimSpace(line)
+
+		if line != "" {
+			if err != nil {
+				fmt.Println()
+			}
+			return line
+		}
+		if err != nil {
+			fmt.Println()
+			log.Fatal(errCeremonyAbort)
+		}
+	}
+}
+
+// entropyChecks checks the random generator, returning the results.
+func entropyChecks() ([]string, error) {
+	var results []string
+
+	if data, err := os.ReadFile(fileEntropy); err == nil {
+		bits, err := strconv.Atoi(strings.TrimSpace(string(data)))
+		if err != nil {
+			return results, fmt.Errorf("%s: %s", fileEntropy, err)
+		}
+		results = append(results, fmt.Sprintf("Entropy of the kernel: %d bits", bits))
+		if bits < _ENTROPY_MIN {
+			return results, fmt.Errorf("entropy of the kernel too low: %d bits, want %d at least", bits, _ENTROPY_MIN)
+		}
+	}
+
+	sample := make([]byte, 2500) // 20000 bits
+	if _, err := rand.Read(sample); err != nil {
+		return results, err
+	}
+	ones, longest, run, last := 0, 0, 0, -1
+	for _, v := range sample {
+		for i := 7; i >= 0; i-- {
+			bit := int(v>>uint(i)) & 1
+			ones += bit
+			if bit == last {
+				run++
+			} else {
+				run, last = 1, bit
+			}
+			if run > longest {
+				longest = run
+			}
+		}
+	}
+
+	// FIPS 140-2, section 4.9.1.
+	monobit := ones > 9725 && ones < 10275
+	results = append(results, fmt.Sprintf("Monobit test of 20000 bits: %d ones, %s", ones, passed(monobit)))
+	longRun := longest < 26
+	results = append(results, fmt.Sprintf("Long runs test of 20000 bits: longest run of %d, %s", longest, passed(longRun)))
+
+	if !monobit || !longRun {
+		return results, errors.New("the random generator failed the tests")
+	}
+	return results, nil
+}
+
+func passed(ok bool) string {
+	if ok {
+		return "passed"
+	}
+	return "FAILED"
+}
+
+// ceremonyJoin returns the passphrase recovered from the files of the shares,
+// checking it with the CA's private key whether it is in the directory.
+func ceremonyJoin(files []string) (string, error) {
+	var shares [][]byte
+	var ca, threshold string
+
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return "", err
+		}
+		block, _ := pem.Decode(data)
+		if block == nil || block.Type != CEREMONY_SHARE_PEM {
+			return "", fmt.Errorf("no share in PEM format: %q", file)
+		}
+		if ca == "" {
+			ca, threshold = block.Headers["CA"], block.Headers["Threshold"]
+		} else if block.Headers["CA"] != ca {
+			return "", fmt.Errorf("share of another CA: %q", file)
+		}
+		shares = append(shares, block.Bytes)
+	}
+	if n, err := strconv.Atoi(threshold); err != nil || len(shares) < n {
+		return "", fmt.Errorf("%s shares are needed, got %d", threshold, len(shares))
+	}
+
+	secret, err := shamirCombine(shares)
+	if err != nil {
+		return "", err
+	}
+	pass := string(secret)
+
+	setCertPath(NAME_CA)
+	if _, err = os.Stat(File.Key); err == nil {
+		if _, err = loadKeyFile(File.Key, pass); err != nil {
+			return "", fmt.Errorf("the shares do not recover the passphrase: %s", err)
+		}
+	}
+	return pass, nil
+}
+
+// ceremonyVerify checks the signature of the report with the CA.
+func ceremonyVerify(file string) error {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return err
+	}
+	sig, err := os.ReadFile(file + ".sig")
+	if err != nil {
+		return err
+	}
+	ca, err := parseCertFile(caFile(NAME_CA))
+	if err != nil {
+		return err
+	}
+	algo := x509.SHA256WithRSA
+	if _, ok := ca.PublicKey.(*ecdsa.PublicKey); ok {
+		algo = x509.ECDSAWithSHA256
+	}
+	if err = ca.CheckSignature(algo, data, sig); err != nil {
+		return fmt.Errorf("%s: %s", file, err)
+	}
+	return nil
+}
@@ -7,29 +7,81 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"flag"
 	"fmt"
 	"log"
+	"os"
 	"path/filepath"
+	"strings"
 
 	"github.com/tredoe/flagplus"
 )
 
 var cmdChk = &flagplus.Subcommand{
-	UsageLine: "chk [-req | -cert | -key] FILE",
+	UsageLine: "chk [-req | -cert [-system-roots] | -key [-json] | -ocsp] [-ca name] [-backend name] [-readonly] FILE [URL]",
 	Short:     "checking",
 	Long: `
 "chk" checks whether a certification-related file is right.
 To look for the file, it uses the certificates directory when the "file" is just
 a name or the path when the "file" is an absolute or relatative path.
+
+With the flag "-cert", the certificate is verified against the CA given in
+"-ca". The flag "-system-roots" trusts the root certificates of the operating
+system too, so any certificate can be checked; to trust only them, set "-ca" to
+an empty value. The issuers are looked for into the file and into the
+certificates directory. It warns whether the file, like the chain configured in
+a server, has the root CA after the certificate: the clients have to trust it
+by themselves, so sending it is useless and hides a root not installed.
+
+With the flag "-key", it prints the type of the private key, its size or curve,
+whether it is encrypted and the public exponent of RSA keys, in JSON format
+whether it is used the flag "-json". It fails whether the key is weak: too
+small, with a wrong exponent, inconsistent, or with the fingerprint of the keys
+vulnerable to ROCA or generated by the OpenSSL of Debian with a predictable
+random generator (using the blacklist of the package "openssl-blacklist").
+
+With the flag "-ocsp", it queries the OCSP responder listed in the certificate
+(or the one at URL) about the revocation status of the certificate, printing
+the dates of the response; it fails whether the status is not "good". The
+response has to be signed by the CA given in "-ca", or by a responder
+delegated by it.
+
+With "-backend native", the requests and the certificates are checked in Go
+instead of executing OpenSSL (see "ca").
 `,
 	Run: runChk,
 }
 
+var (
+	IsOCSP        = flag.Bool("ocsp", false, "query the OCSP responder about the certificate")
+	IsSystemRoots = flag.Bool("system-roots", false, "trust the root certificates of the system")
+	IsJSON        = flag.Bool("json", false, "print in JSON format")
+)
+
 func init() {
-	cmdChk.AddFlags("req", "cert", "key")
+	addFlags(cmdChk, "req", "cert", "key", "ocsp", "ca", "system-roots", "json", "backend", "readonly")
 }
 
 func runChk(cmd *flagplus.Subcommand, args []string) {
+	if *IsOCSP {
+		if len(args) != 1 && len(args) != 2 {
+			log.Print("Missing required argument: FILE")
+			cmd.Usage()
+		}
+		url := ""
+		if len(args) == 2 {
+			url = args[1]
+		}
+
+		*IsCert = true
+		CheckOCSP(getAbsPaths(false, args[:1])[0], url)
+		return
+	}
 	if len(args) != 1 {
 		log.Print("Missing required argument: FILE")
 		cmd.Usage()
@@ -51,21 +103,216 @@ func runChk(cmd *flagplus.Subcommand, args []string) {
 
 // CheckRequest checks the certificate request.
 func CheckRequest(file string) {
+	if nativeBackend() {
+		if err := nativeCheckRequest(file); err != nil {
+			log.Fatal(err)
+		}
+		fmt.Println("Certificate request self-signature verify OK")
+		return
+	}
 	args := []string{"req", "-verify", "-noout", "-in", file}
 	fmt.Printf("%s", openssl(args...))
 }
 
 // CheckCert checks the certificate.
 func CheckCert(file string) {
-	args := []string{"verify",
-		"-CAfile", filepath.Join(Dir.Cert, NAME_CA+EXT_CERT),
-		file,
+	lintServedChain(file)
+	if *IsSystemRoots {
+		CheckCertSystem(file)
+		return
+	}
+	if nativeBackend() {
+		ca, err := parseCertFile(caFile(*CACert))
+		if err != nil {
+			log.Fatal(err)
+		}
+		roots := x509.NewCertPool()
+		roots.AddCert(ca)
+		verifyCert(file, roots)
+		return
 	}
+	args := []string{"verify", "-CAfile", caFile(*CACert), file}
 	fmt.Printf("%s", openssl(args...))
 }
 
+// lintServedChain warns whether the root CA is into the chain of the file, after
+// the certificate.
+func lintServedChain(file string) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		log.Fatal(err)
+	}
+	for n := 0; ; {
+		var block *pem.Block
+
+		if block, data = pem.Decode(data); block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		if n++; n == 1 {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			continue
+		}
+		if bytes.Equal(cert.RawIssuer, cert.RawSubject) {
+			fmt.Fprintf(os.Stderr, "* Root CA in the chain of the server: %s\n", cert.Subject)
+		}
+	}
+}
+
+// CheckCertSystem checks the certificate against the root certificates of the
+// system, and against the CA given in "-ca" whether it is not empty.
+func CheckCertSystem(file string) {
+	roots, err := x509.SystemCertPool()
+	if err != nil {
+		log.Fatalf("Could not load the root certificates of the system: %s", err)
+	}
+	if *CACert != "" {
+		ca, err := parseCertFile(caFile(*CACert))
+		if err != nil {
+			log.Fatal(err)
+		}
+		roots.AddCert(ca)
+	}
+	verifyCert(file, roots)
+}
+
+// verifyCert verifies the first certificate of the file against the roots,
+// with the rest of certificates of the file and the ones of the certificates
+// directory like intermediates.
+func verifyCert(file string, roots *x509.CertPool) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		log.Fatal(err)
+	}
+	var certs []*x509.Certificate
+	for {
+		var block *pem.Block
+
+		if block, data = pem.Decode(data); block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			log.Fatalf("%s: %s", file, err)
+		}
+		certs = append(certs, cert)
+	}
+	if len(certs) == 0 {
+		log.Fatalf("No certificate in PEM format: %q", file)
+	}
+
+	intermediates := x509.NewCertPool()
+	for _, v := range certs[1:] {
+		intermediates.AddCert(v)
+	}
+	for _, v := range chainOf(certs[0], chainCerts()) {
+		intermediates.AddCert(v.Cert)
+	}
+
+	_, err = certs[0].Verify(x509.VerifyOptions{
+		Roots:         roots,
+		Intermediates: intermediates,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+	})
+	if err != nil {
+		log.Fatalf("%s: %s", file, err)
+	}
+	fmt.Printf("%s: OK\n", file)
+}
+
+// caFile returns the file of the CA's certificate `name`, which is looked for
+// into the certificates directory unless it is a path.
+func caFile(name string) string {
+	if name == "" {
+		name = NAME_CA
+	}
+	if name[0] != '.' && name[0] != os.PathSeparator {
+		name = filepath.Join(Dir.Cert, name+EXT_CERT)
+	}
+	return name
+}
+
 // CheckKey checks the private key.
 func CheckKey(file string) {
-	args := []string{"rsa", "-check", "-noout", "-in", file}
-	fmt.Printf("%s", openssl(args...))
+	r, err := checkPrivateKey(file)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if *IsJSON {
+		data, err := json.MarshalIndent(r, "", "\t")
+		if err != nil {
+			log.Fatal(err)
+		}
+		fmt.Printf("%s\n", data)
+	} else {
+		fmt.Printf("- File:\t%q\n", r.File)
+		fmt.Printf("- Type:\t%s\n", r.Type)
+		if r.Curve != "" {
+			fmt.Printf("- Curve:\t%s\n", r.Curve)
+		}
+		fmt.Printf("- Size:\t%d bits\n", r.Size)
+		if r.Exponent != 0 {
+			fmt.Printf("- Exponent:\t%d\n", r.Exponent)
+		}
+		fmt.Printf("- Encrypted:\t%t\n", r.Encrypted)
+		if r.Type == "RSA" {
+			fmt.Printf("- ROCA:\t%t\n", r.ROCA)
+			if r.DebianWeak != nil {
+				fmt.Printf("- Debian weak:\t%t\n", *r.DebianWeak)
+			} else {
+				fmt.Printf("- Debian weak:\tunknown (no blacklist in %q)\n", DIR_BLACKLIST)
+			}
+		}
+		if len(r.Problems) == 0 {
+			fmt.Println("Key ok")
+		}
+	}
+
+	if len(r.Problems) != 0 {
+		log.Fatalf("Weak private key: %s", strings.Join(r.Problems, "; "))
+	}
+}
+
+// CheckOCSP checks the revocation status of the certificate in the OCSP
+// responder at `url`, or in the one listed in the certificate whether it is
+// empty.
+func CheckOCSP(file, url string) {
+	if url == "" {
+		url = strings.TrimSpace(string(openssl("x509", "-noout", "-ocsp_uri", "-in", file)))
+		if url == "" {
+			log.Fatalf("The certificate has not an OCSP responder: %q\n\n"+
+				"  Add the URL of the responder like argument", file)
+		}
+	}
+
+	issuer := caFile(*CACert)
+	out := openssl("ocsp", "-issuer", issuer, "-CAfile", issuer,
+		"-cert", file, "-url", url)
+	fmt.Printf("%s", out)
+
+	if status := ocspStatus(out, file); status != "good" {
+		log.Fatalf("Certificate with status %q in OCSP responder: %s", status, url)
+	}
+}
+
+// ocspStatus returns the status of the certificate `file` in the output of
+// "openssl ocsp".
+func ocspStatus(out []byte, file string) string {
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+
+	for scanner.Scan() {
+		if status := strings.TrimPrefix(scanner.Text(), file+": "); status != scanner.Text() {
+			return strings.TrimSpace(status)
+		}
+	}
+	return "unknown"
 }
@@ -0,0 +1,241 @@
+// Copyright 2014 Jonas mg
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/pem"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/tredoe/flagplus"
+)
+
+var cmdCMS = &flagplus.Subcommand{
+	UsageLine: "cms -encrypt -to NAME1,... [-out FILE] FILE | cms -decrypt [-out FILE] NAME FILE | cms -sign [-out FILE] NAME FILE | cms -verify [-ca name] [-out FILE] FILE [SIGNATURE]",
+	Short:     "encrypt and sign files with the certificates",
+	Long: `
+"cms" uses the certificates of the directory to encrypt and sign files, like in
+S/MIME, through the Cryptographic Message Syntax (CMS, the successor of PKCS#7).
+The messages are written in DER format.
+
+With the flag "-encrypt", the file is encrypted with AES-256 for the
+certificates given in "-to", in "FILE.p7m" by default. The expired certificates
+are refused.
+
+With the flag "-decrypt", the encrypted file is decrypted with the private key
+of the certificate NAME, in FILE without the extension ".p7m" by default.
+
+With the flag "-sign", the file is signed with the private key of the
+certificate NAME, in a detached signature "FILE.p7s" by default; it has the
+certificate and its intermediate CAs, so it can be checked by whom has only the
+root CA.
+
+With the flag "-verify", the detached signature, "FILE.p7s" or SIGNATURE, is
+checked for the content in FILE against the CA given in "-ca" ("ca" by default),
+and the certificate of the signer is written in "-out" whether it is set.
+`,
+	Run: runCMS,
+}
+
+// EXT_CMS_ENCRYPT is the extension of the encrypted files, and EXT_CMS_SIGN the
+// one of the detached signatures.
+const (
+	EXT_CMS_ENCRYPT = ".p7m"
+	EXT_CMS_SIGN    = ".p7s"
+)
+
+var (
+	IsEncrypt = flag.Bool("encrypt", false, "encrypt a file for the certificates")
+	IsDecrypt = flag.Bool("decrypt", false, "decrypt a file with the private key")
+	IsVerify  = flag.Bool("verify", false, "verify the signature of a file")
+	To        = flag.String("to", "", "comma-separated names of the certificates of the recipients")
+)
+
+func init() {
+	addFlags(cmdCMS, "encrypt", "decrypt", "sign", "verify", "to", "ca", "out")
+}
+
+func runCMS(cmd *flagplus.Subcommand, args []string) {
+	n := 0
+	for _, v := range []bool{*IsEncrypt, *IsDecrypt, *IsSign, *IsVerify} {
+		if v {
+			n++
+		}
+	}
+	if n != 1 {
+		log.Print("Missing required flag: one of -encrypt, -decrypt, -sign or -verify")
+		cmd.Usage()
+	}
+
+	// The temporary files are removed whether OpenSSL fails.
+	beginIssuance()
+	defer commitIssuance()
+
+	switch {
+	case *IsEncrypt:
+		if len(args) != 1 || *To == "" {
+			log.Print("Missing required arguments: -to NAME1,... FILE")
+			cmd.Usage()
+		}
+		EncryptFile(strings.Split(*To, ","), args[0])
+	case *IsVerify:
+		if len(args) != 1 && len(args) != 2 {
+			log.Print("Missing required arguments: FILE [SIGNATURE]")
+			cmd.Usage()
+		}
+		signature := args[0] + EXT_CMS_SIGN
+		if len(args) == 2 {
+			signature = args[1]
+		}
+		VerifyFile(args[0], signature)
+	default:
+		if len(args) != 2 {
+			log.Print("Missing required arguments: NAME FILE")
+			cmd.Usage()
+		}
+		if *IsDecrypt {
+			DecryptFile(args[0], args[1])
+		} else {
+			SignFile(args[0], args[1])
+		}
+	}
+}
+
+// EncryptFile encrypts the file for the certificates `names`.
+func EncryptFile(names []string, file string) {
+	out := cmsOut(file + EXT_CMS_ENCRYPT)
+	certs := make([]string, len(names))
+
+	for i, v := range names {
+		setCertPath(v)
+		cert, err := parseCertFile(File.Cert)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if time.Now().After(cert.NotAfter) {
+			log.Fatalf("Certificate expired: %q", v)
+		}
+		certs[i] = File.Cert
+	}
+
+	tmp := mustTempFile(out)
+	args := []string{"cms", "-encrypt", "-binary", "-aes-256-cbc",
+		"-in", file, "-outform", "DER", "-out", tmp,
+	}
+	openssl(append(args, certs...)...)
+	mustCommitFile(tmp, out, 0644)
+
+	fmt.Printf("== Encrypted\n- File:\t%q\n- To:\t%s\n", out, strings.Join(names, ", "))
+}
+
+// DecryptFile decrypts the file with the private key of the certificate `name`.
+func DecryptFile(name, file string) {
+	def := strings.TrimSuffix(file, EXT_CMS_ENCRYPT)
+	if def == file && *Out == "" {
+		log.Fatalf("Missing flag -out: the file has not the extension %q", EXT_CMS_ENCRYPT)
+	}
+	out := cmsOut(def)
+	setCertPath(name)
+
+	tmp := mustTempFile(out)
+	openssl("cms", "-decrypt", "-binary", "-inform", "DER", "-in", file,
+		"-recip", File.Cert, "-inkey", File.Key, "-out", tmp)
+	mustCommitFile(tmp, out, 0600)
+
+	fmt.Printf("== Decrypted\n- File:\t%q\n", out)
+}
+
+// SignFile makes a detached signature of the file with the private key of the
+// certificate `name`, including its chain of intermediate CAs.
+func SignFile(name, file string) {
+	out := cmsOut(file + EXT_CMS_SIGN)
+	cert := signDetached(name, file, out)
+
+	fmt.Printf("== Signed\n- Signature:\t%q\n- Signer:\t%s\n", out, cert.Subject)
+}
+
+// signDetached writes in `out` the detached signature of the file, returning
+// the certificate of the signer. The private key of the CA is unlocked by the
+// passphrase of the environment, whether it is set.
+func signDetached(name, file, out string) *x509.Certificate {
+	setCertPath(name)
+	cert, err := parseCertFile(File.Cert)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	args := []string{"cms", "-sign", "-binary", "-in", file, "-signer", File.Cert}
+	if name == NAME_CA {
+		if loadKMS() != "" {
+			log.Fatal("The CA's private key in a KMS can not sign files")
+		}
+		args = append(args, caKeyArgs("-inkey", File.Key)...)
+	} else {
+		args = append(args, "-inkey", File.Key)
+	}
+
+	var chain []byte
+	for _, v := range chainOf(cert, chainCerts()) {
+		if bytes.Equal(v.Cert.RawIssuer, v.Cert.RawSubject) {
+			continue // the root CA is trusted by the verifier
+		}
+		chain = append(chain, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: v.Cert.Raw})...)
+	}
+	if len(chain) != 0 {
+		chainFile := mustTempFile(out)
+		defer os.Remove(chainFile)
+		if err = os.WriteFile(chainFile, chain, 0600); err != nil {
+			fatal(err)
+		}
+		args = append(args, "-certfile", chainFile)
+	}
+
+	tmp := mustTempFile(out)
+	args = append(args, "-outform", "DER", "-out", tmp)
+	openssl(args...)
+	mustCommitFile(tmp, out, 0644)
+	return cert
+}
+
+// VerifyFile verifies the detached signature of the file.
+func VerifyFile(file, signature string) {
+	args := []string{"cms", "-verify", "-binary", "-purpose", "any",
+		"-inform", "DER", "-in", signature, "-content", file,
+		"-CAfile", caFile(*CACert), "-out", os.DevNull,
+	}
+
+	var tmp string
+	if *Out != "" {
+		tmp = mustTempFile(*Out)
+		args = append(args, "-signer", tmp)
+	}
+	openssl(args...)
+
+	if *Out != "" {
+		mustCommitFile(tmp, *Out, 0644)
+		fmt.Printf("- Signer:\t%q\n", *Out)
+	}
+}
+
+// cmsOut returns the output file, the one of the flag "-out" or `def`, which
+// has not to exist.
+func cmsOut(def string) string {
+	out := def
+	if *Out != "" {
+		out = *Out
+	}
+	if _, err := os.Stat(out); !os.IsNotExist(err) {
+		log.Fatalf("File already exists: %q", out)
+	}
+	return out
+}
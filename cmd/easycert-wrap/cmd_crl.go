@@ -0,0 +1,276 @@
+// Copyright 2014 Jonas mg
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/pem"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/tredoe/easycert"
+	"github.com/tredoe/flagplus"
+)
+
+var cmdCRL = &flagplus.Subcommand{
+	UsageLine: "crl [-show] [-info] [-readonly] [FILE | URL] | crl -gen [-passin source] | crl -diff OLD NEW",
+	Short:     "inspect certificate revocation lists",
+	Long: `
+"crl" prints out the information of a certificate revocation list (CRL): the
+issuer, the dates, the extensions and the revoked certificates with the date
+and reason of every one. The list can be of any CA; it is got from the URL
+whether it starts with "http://" or "https://", else it is looked for in the
+directory of the CRLs when it is just a name ("ca" by default), or in the path.
+The list can be in PEM or DER format. It is the same with the flag "-show".
+
+With the flag "-gen", the revocation list of the CA is generated again, like
+"revoke" does, so it is updated before of the date of its next update (30 days
+after of generating it, by default). It is used to keep the list valid whether
+no certificate is revoked in that time, i.e. from a job of cron.
+
+With the flag "-diff", it compares two lists of the same CA, printing the
+serial numbers added ("+") to the new list and removed ("-") from it.
+`,
+	Run: runCRL,
+}
+
+var (
+	IsInfo = flag.Bool("info", false, "print the information of the list")
+	IsDiff = flag.Bool("diff", false, "print the changes between two lists")
+	IsGen  = flag.Bool("gen", false, "generate the revocation list of the CA")
+	IsShow = flag.Bool("show", false, "print the revocation list")
+)
+
+func init() {
+	addFlags(cmdCRL, "show", "info", "gen", "diff", "readonly", "passin")
+}
+
+// CRL_MAX_SIZE is the maximum size of a revocation list got from an URL.
+const CRL_MAX_SIZE = 32 << 20
+
+// crlReasons are the names of the reason codes of revocation (RFC 5280).
+var crlReasons = map[int]string{
+	0:  "unspecified",
+	1:  "keyCompromise",
+	2:  "cACompromise",
+	3:  "affiliationChanged",
+	4:  "superseded",
+	5:  "cessationOfOperation",
+	6:  "certificateHold",
+	8:  "removeFromCRL",
+	9:  "privilegeWithdrawn",
+	10: "aACompromise",
+}
+
+func runCRL(cmd *flagplus.Subcommand, args []string) {
+	if *IsGen {
+		if len(args) != 0 || *IsShow || *IsDiff {
+			log.Print("Flag -gen is used without arguments nor other flags")
+			cmd.Usage()
+		}
+		mustWritable()
+		GenCRL()
+		return
+	}
+	if *IsDiff {
+		if len(args) != 2 {
+			log.Print("Missing required arguments: OLD NEW")
+			cmd.Usage()
+		}
+		DiffCRL(args[0], args[1])
+		return
+	}
+
+	if len(args) > 1 {
+		log.Print("Too many arguments")
+		cmd.Usage()
+	}
+	name := NAME_CA
+	if len(args) == 1 {
+		name = args[0]
+	}
+	InfoCRL(name)
+}
+
+// GenCRL generates the revocation list of the CA, without changes in the
+// database but the number of the list.
+func GenCRL() {
+	operator := mustRole(ACTION_CRL)
+	setCertPath(NAME_CA)
+
+	tx := beginIssuance()
+	if err := tx.saveDatabase(); err != nil {
+		log.Fatal(err)
+	}
+
+	fmt.Print("\n== Generate CRL\n\n")
+	if err := genCRL(); err != nil {
+		fatal(err)
+	}
+	if err := syncDatabase(); err != nil {
+		fatal(err)
+	}
+	commitIssuance()
+
+	list, err := parseCRL(File.CRL)
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Printf("\n== Generated\n- CRL:\t%q\t(number %s, next update %s)\n",
+		File.CRL, list.Number, list.NextUpdate.Format(time.RFC3339))
+	audit(operator, ACTION_CRL, NAME_CA, "number "+list.Number.String())
+}
+
+// InfoCRL prints the information of the revocation list.
+func InfoCRL(name string) {
+	data, err := readCRL(name)
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Printf("%s", opensslInput(data, "crl", "-inform", "DER", "-noout", "-text"))
+}
+
+// DiffCRL prints the revoked certificates added and removed between both
+// revocation lists.
+func DiffCRL(oldName, newName string) {
+	oldList, err := parseCRL(oldName)
+	if err != nil {
+		log.Fatal(err)
+	}
+	newList, err := parseCRL(newName)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if !bytes.Equal(oldList.RawIssuer, newList.RawIssuer) || !bytes.Equal(oldList.AuthorityKeyId, newList.AuthorityKeyId) {
+		log.Fatalf("The lists are of different issuers:\n- %s\n- %s", oldList.Issuer, newList.Issuer)
+	}
+
+	fmt.Printf("== Old: %s (updated %s)\n", oldName, oldList.ThisUpdate.Format(time.RFC3339))
+	fmt.Printf("== New: %s (updated %s)\n\n", newName, newList.ThisUpdate.Format(time.RFC3339))
+
+	added, removed := diffCRL(oldList, newList)
+	for _, v := range added {
+		fmt.Printf("+ %s\t%s\t%s\n", easycert.SerialHex(v.SerialNumber), v.RevocationTime.Format(time.RFC3339), crlReason(v.ReasonCode))
+	}
+	for _, v := range removed {
+		fmt.Printf("- %s\t%s\t%s\n", easycert.SerialHex(v.SerialNumber), v.RevocationTime.Format(time.RFC3339), crlReason(v.ReasonCode))
+	}
+	if len(added) == 0 && len(removed) == 0 {
+		fmt.Println("No changes")
+	}
+}
+
+// diffCRL returns the entries of `newList` which are not in `oldList`, and the
+// ones of `oldList` which are not in `newList`, sorted by serial number.
+func diffCRL(oldList, newList *x509.RevocationList) (added, removed []x509.RevocationListEntry) {
+	inList := func(list *x509.RevocationList) map[string]bool {
+		m := make(map[string]bool, len(list.RevokedCertificateEntries))
+		for _, v := range list.RevokedCertificateEntries {
+			m[v.SerialNumber.String()] = true
+		}
+		return m
+	}
+	inOld, inNew := inList(oldList), inList(newList)
+
+	for _, v := range newList.RevokedCertificateEntries {
+		if !inOld[v.SerialNumber.String()] {
+			added = append(added, v)
+		}
+	}
+	for _, v := range oldList.RevokedCertificateEntries {
+		if !inNew[v.SerialNumber.String()] {
+			removed = append(removed, v)
+		}
+	}
+
+	for _, list := range [][]x509.RevocationListEntry{added, removed} {
+		sort.Slice(list, func(i, j int) bool {
+			return list[i].SerialNumber.Cmp(list[j].SerialNumber) < 0
+		})
+	}
+	return added, removed
+}
+
+// crlReason returns the name of the reason code.
+func crlReason(code int) string {
+	if name, ok := crlReasons[code]; ok {
+		return name
+	}
+	return fmt.Sprintf("reason %d", code)
+}
+
+// parseCRL reads and parses the revocation list.
+func parseCRL(name string) (*x509.RevocationList, error) {
+	data, err := readCRL(name)
+	if err != nil {
+		return nil, err
+	}
+	list, err := x509.ParseRevocationList(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", name, err)
+	}
+	return list, nil
+}
+
+// readCRL returns the revocation list in DER format, got from an URL, from the
+// directory of the CRLs whether `name` is just a name, or from a file.
+func readCRL(name string) ([]byte, error) {
+	var data []byte
+	var err error
+
+	if strings.HasPrefix(name, "http://") || strings.HasPrefix(name, "https://") {
+		data, err = fetchCRL(name)
+	} else {
+		if name[0] != '.' && name[0] != os.PathSeparator {
+			name = filepath.Join(Dir.Revok, name+EXT_REVOK)
+		}
+		data, err = os.ReadFile(name)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if block, _ := pem.Decode(data); block != nil {
+		if block.Type != "X509 CRL" {
+			return nil, fmt.Errorf("%s: not a revocation list: %q", name, block.Type)
+		}
+		return block.Bytes, nil
+	}
+	return data, nil
+}
+
+// fetchCRL gets the revocation list from the URL.
+func fetchCRL(url string) ([]byte, error) {
+	client := &http.Client{Timeout: 30 * time.Second}
+
+	resp, err := client.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s: %s", url, resp.Status)
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, CRL_MAX_SIZE+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > CRL_MAX_SIZE {
+		return nil, fmt.Errorf("%s: revocation list bigger than %d bytes", url, CRL_MAX_SIZE)
+	}
+	return data, nil
+}
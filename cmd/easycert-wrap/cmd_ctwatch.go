@@ -0,0 +1,348 @@
+// Copyright 2014 Jonas mg
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/tredoe/easycert"
+	"github.com/tredoe/flagplus"
+)
+
+var cmdCTWatch = &flagplus.Subcommand{
+	UsageLine: "ctwatch [-domain name1,...] [-dry-run]",
+	Short:     "watch the Certificate Transparency logs",
+	Long: `
+"ctwatch" looks for the certificates of the domains, and of their subdomains,
+logged in the public Certificate Transparency logs since the last run, through
+the search of crt.sh. It alerts of the ones which were not issued by the CA nor
+by the issuers expected, since they could have been issued to an attacker.
+It is intended to be run by cron.
+
+It is configured in the field "ctwatch" of the file "store.json", and the alerts
+are sent by email whether the field "smtp" is set (see "notify"), and posted in
+JSON format to the URL in "webhook" whether it is set:
+
+	{
+		"ctwatch": {
+			"domains": ["example.com"],
+			"issuers": ["Let's Encrypt"],
+			"webhook": "https://hooks.example.com/ctwatch"
+		}
+	}
+
+The field "issuers" has the names, or part of the names, of the issuers which
+are expected, and "url" the search of another service compatible with crt.sh.
+The flag "-domain" overrides the domains, and "-dry-run" prints the alerts
+instead of sending them.
+`,
+	Run: runCTWatch,
+}
+
+var Domain = flag.String("domain", "", "comma-separated list of domains")
+
+func init() {
+	addFlags(cmdCTWatch, "domain", "dry-run")
+}
+
+// FILE_CTWATCH has the last entry seen of every domain in the CT logs.
+const FILE_CTWATCH = "ctwatch.json"
+
+// DEFAULT_CT_URL is the search of certificates in the CT logs.
+const DEFAULT_CT_URL = "https://crt.sh/"
+
+// CT_MAX_SIZE is the maximum size of the response of the search.
+const CT_MAX_SIZE = 64 << 20
+
+// CTWatchConfig represents the configuration to watch the CT logs.
+type CTWatchConfig struct {
+	Domains []string `json:"domains,omitempty"`
+	Issuers []string `json:"issuers,omitempty"` // Expected, besides of the CA.
+	URL     string   `json:"url,omitempty"`     // Search compatible with crt.sh.
+	Webhook string   `json:"webhook,omitempty"` // URL where the alerts are posted.
+}
+
+// ctEntry represents a certificate logged, as it is returned by crt.sh.
+type ctEntry struct {
+	ID         int64  `json:"id"`
+	IssuerName string `json:"issuer_name"`
+	CommonName string `json:"common_name"`
+	NameValue  string `json:"name_value"` // Names, separated by new lines.
+	Serial     string `json:"serial_number"`
+	NotBefore  string `json:"not_before"`
+	NotAfter   string `json:"not_after"`
+}
+
+// ctAlert represents the certificates unexpected of a domain.
+type ctAlert struct {
+	Domain string     `json:"domain"`
+	Certs  []*ctEntry `json:"certificates"`
+}
+
+func runCTWatch(cmd *flagplus.Subcommand, args []string) {
+	if len(args) != 0 {
+		log.Print("Too many arguments")
+		cmd.Usage()
+	}
+
+	cfg := loadStoreConfig()
+	watch := cfg.CTWatch
+	if watch == nil {
+		watch = new(CTWatchConfig)
+	}
+	if *Domain != "" {
+		watch.Domains = strings.Split(*Domain, ",")
+	}
+	if len(watch.Domains) == 0 {
+		log.Fatalf("Missing domains to watch: set the flag -domain or the field ctwatch in %q", File.Store)
+	}
+	if watch.URL == "" {
+		watch.URL = DEFAULT_CT_URL
+	}
+	if !*IsDryRun {
+		mustWritable()
+	}
+
+	serials, err := knownSerials()
+	if err != nil {
+		log.Fatal(err)
+	}
+	seen, err := loadCTSeen()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	var alerts []*ctAlert
+
+	for _, domain := range watch.Domains {
+		domain = strings.ToLower(strings.TrimSpace(domain))
+
+		entries, err := searchCT(watch.URL, domain)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		alert := &ctAlert{Domain: domain}
+		last := seen[domain]
+		for _, v := range entries {
+			if v.ID <= seen[domain] {
+				continue
+			}
+			if v.ID > last {
+				last = v.ID
+			}
+			if !serials[normSerial(v.Serial)] && !expectedIssuer(v.IssuerName, watch.Issuers) {
+				alert.Certs = append(alert.Certs, v)
+			}
+		}
+		seen[domain] = last
+
+		if len(alert.Certs) != 0 {
+			alerts = append(alerts, alert)
+		}
+	}
+
+	body := ctAlertBody(alerts, watch.URL)
+	if *IsDryRun {
+		fmt.Print(body)
+		return
+	}
+
+	if len(alerts) != 0 {
+		sent := false
+		if cfg.SMTP != nil {
+			if err = sendMail(cfg.SMTP, "[easycert] Unexpected certificates in CT logs", body); err != nil {
+				log.Fatal(err)
+			}
+			fmt.Printf("* Alert sent to %s\n", strings.Join(cfg.SMTP.To, ", "))
+			sent = true
+		}
+		if watch.Webhook != "" {
+			if err = postWebhook(watch.Webhook, alerts); err != nil {
+				log.Fatal(err)
+			}
+			fmt.Printf("* Alert posted to %s\n", watch.Webhook)
+			sent = true
+		}
+		if !sent {
+			fmt.Print(body)
+		}
+	}
+
+	if err = saveCTSeen(seen); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// searchCT returns the certificates of the domain and its subdomains found in
+// the CT logs, through the search at `searchURL`.
+func searchCT(searchURL, domain string) ([]*ctEntry, error) {
+	client := &http.Client{Timeout: 2 * time.Minute}
+	byID := make(map[int64]bool)
+	var entries []*ctEntry
+
+	for _, q := range []string{domain, "%." + domain} {
+		u := searchURL + "?" + url.Values{"q": {q}, "output": {"json"}}.Encode()
+
+		resp, err := client.Get(u)
+		if err != nil {
+			return nil, err
+		}
+		data, err := io.ReadAll(io.LimitReader(resp.Body, CT_MAX_SIZE+1))
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("%s: %s", searchURL, resp.Status)
+		}
+		if len(data) > CT_MAX_SIZE {
+			return nil, fmt.Errorf("%s: response bigger than %d bytes", searchURL, CT_MAX_SIZE)
+		}
+
+		var list []*ctEntry
+		if err = json.Unmarshal(data, &list); err != nil {
+			return nil, fmt.Errorf("%s: %s", searchURL, err)
+		}
+		for _, v := range list {
+			if !byID[v.ID] && matchDomain(v, domain) {
+				byID[v.ID] = true
+				entries = append(entries, v)
+			}
+		}
+	}
+	return entries, nil
+}
+
+// matchDomain reports whether a name of the certificate is the domain or one
+// of its subdomains, since the search can return other ones.
+func matchDomain(e *ctEntry, domain string) bool {
+	for _, v := range append(strings.Split(e.NameValue, "\n"), e.CommonName) {
+		v = strings.ToLower(strings.TrimSpace(v))
+		if v == domain || strings.HasSuffix(v, "."+domain) {
+			return true
+		}
+	}
+	return false
+}
+
+// knownSerials returns the serial numbers of the certificates issued by the CA
+// and of the ones stored in the certificates directory.
+func knownSerials() (map[string]bool, error) {
+	serials := make(map[string]bool)
+
+	entries, err := readIndex()
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	for _, v := range entries {
+		serials[normSerial(v.Serial)] = true
+	}
+	for _, v := range loadCerts() {
+		serials[normSerial(easycert.SerialHex(v.Cert.SerialNumber))] = true
+	}
+	return serials, nil
+}
+
+// normSerial returns the serial number in hexadecimal in a form which can be
+// compared.
+func normSerial(s string) string {
+	s = strings.TrimLeft(strings.ToUpper(strings.ReplaceAll(s, ":", "")), "0")
+	if s == "" {
+		return "0"
+	}
+	return s
+}
+
+// expectedIssuer reports whether the issuer name contains any of `issuers`.
+func expectedIssuer(name string, issuers []string) bool {
+	for _, v := range issuers {
+		if v != "" && strings.Contains(name, v) {
+			return true
+		}
+	}
+	return false
+}
+
+// ctAlertBody returns the text of the alerts, or an empty string whether there
+// are not alerts.
+func ctAlertBody(alerts []*ctAlert, searchURL string) string {
+	var buf bytes.Buffer
+
+	for _, a := range alerts {
+		if buf.Len() == 0 {
+			buf.WriteString("Certificates not issued by the CA found in the CT logs:\n")
+		}
+		fmt.Fprintf(&buf, "\n%s\n\n", a.Domain)
+		for _, v := range a.Certs {
+			fmt.Fprintf(&buf, "  %-30s serial %s, valid until %s\n    issuer %s\n    %s?id=%d\n",
+				v.CommonName, v.Serial, v.NotAfter, v.IssuerName, searchURL, v.ID)
+		}
+	}
+
+	if buf.Len() != 0 {
+		fmt.Fprintf(&buf, "\n-- \neasycert, %s\n", Dir.Root)
+	}
+	return buf.String()
+}
+
+// postWebhook posts the alerts in JSON format to the URL.
+func postWebhook(webhook string, alerts []*ctAlert) error {
+	data, err := json.Marshal(alerts)
+	if err != nil {
+		return err
+	}
+	client := &http.Client{Timeout: 30 * time.Second}
+
+	resp, err := client.Post(webhook, MIME_JSON, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("%s: %s", webhook, resp.Status)
+	}
+	return nil
+}
+
+// loadCTSeen returns the identifier of the last entry seen of every domain.
+func loadCTSeen() (map[string]int64, error) {
+	seen := make(map[string]int64)
+
+	data, err := os.ReadFile(filepath.Join(Dir.Root, FILE_CTWATCH))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return seen, nil
+		}
+		return nil, err
+	}
+	if err = json.Unmarshal(data, &seen); err != nil {
+		return nil, fmt.Errorf("%s: %s", FILE_CTWATCH, err)
+	}
+	return seen, nil
+}
+
+// saveCTSeen saves the identifier of the last entry seen of every domain.
+func saveCTSeen(seen map[string]int64) error {
+	data, err := json.MarshalIndent(seen, "", "\t")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(filepath.Join(Dir.Root, FILE_CTWATCH), data, 0644)
+}
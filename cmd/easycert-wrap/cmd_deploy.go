@@ -0,0 +1,226 @@
+// Copyright 2014 Jonas mg
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"encoding/pem"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+
+	"github.com/tredoe/flagplus"
+)
+
+var cmdDeploy = &flagplus.Subcommand{
+	UsageLine: "deploy -mongodb|-rabbitmq [-with-root] [-manifest] [-out dir] NAME | deploy -iis site [-iis-port number] [-dry-run] NAME | deploy -winrm [-dry-run] NAME | deploy -dc [-dry-run] NAME",
+	Short:     "write the TLS files of a server, or bind the certificate in Windows",
+	Long: `
+"deploy" writes the certificate NAME, its private key and the chain of CA
+certificates in a directory, "NAME-SERVICE" unless it is used "-out", with the
+layout required by the server, plus the stanza of its configuration which
+enables TLS with them. The paths of the stanza are the absolute ones of the
+directory.
+
+With "-mongodb", the files of mongod:
+
+	NAME.pem      the certificate and its intermediate CAs, followed by its
+	              private key, for "certificateKeyFile"
+	ca.pem        the chain of CA certificates, for "CAFile"
+	mongod.conf   the section "net.tls" of the configuration
+
+With "-rabbitmq", the files of RabbitMQ:
+
+	ca_certificate.pem      the chain of CA certificates, for "cacertfile"
+	server_certificate.pem  the certificate and its intermediate CAs, for
+	                        "certfile"
+	server_key.pem          the private key, for "keyfile"
+	rabbitmq.conf           the options "ssl_options" of the configuration
+
+The chain sent by the server has not the root CA, since the clients have to
+trust it by themselves; else it is only used to validate the clients, from
+"CAFile" or "cacertfile". With "-with-root", the root CA is added to the chain
+sent, for the clients which need it, warning about it.
+
+The files with the private key are written only readable by the owner. With
+"-manifest", it is added the file "manifest.json" with the digests of the files
+and the provenance of the certificate (see "export").
+
+In Windows, "-iis" and "-winrm" import the certificate NAME, with its private
+key and the chain of CA certificates, into the personal store of the machine
+("Cert:\LocalMachine\My"), and bind it through PowerShell, so it has to be run
+like administrator:
+
+	-iis      the HTTPS binding of the IIS site at the port of "-iis-port",
+	          which is created whether it does not exist
+	-winrm    the HTTPS listener of WinRM, with the host name of the first
+	          DNS name of the certificate, or else its common name
+	-dc       LDAPS and Kerberos PKINIT of a domain controller of Active
+	          Directory, with a certificate of "req -protocol dc": the root
+	          CA is added to the trusted roots of the machine and the CA
+	          which issued it to the store NTAuth of the machine, and the
+	          directory loads it for LDAPS without restarting
+
+To trust the CA for PKINIT in all the domain, its certificate is published in
+NTAuth by an administrator of the enterprise:
+
+	certutil -dspublish -f ca.crt NTAuthCA
+
+The certificate bound before is replaced, so it is run again after of
+renewing the certificate, like:
+
+	easycert-wrap deploy -iis "Default Web Site" web
+
+The flag "-dry-run" prints the script of PowerShell instead of running it.
+`,
+	Run: runDeploy,
+}
+
+var (
+	IsMongoDB  = flag.Bool("mongodb", false, "files of the server MongoDB")
+	IsRabbitMQ = flag.Bool("rabbitmq", false, "files of the server RabbitMQ")
+	IISSite    = flag.String("iis", "", "IIS site where the certificate is bound")
+	IISPort    = flag.Int("iis-port", 443, "port of the HTTPS binding of IIS")
+	IsWinRM    = flag.Bool("winrm", false, "bind the certificate to the HTTPS listener of WinRM")
+	IsDC       = flag.Bool("dc", false, "import the certificate into the domain controller of Active Directory")
+)
+
+// Servers with files of deployment.
+const (
+	SERVICE_MONGODB  = "mongodb"
+	SERVICE_RABBITMQ = "rabbitmq"
+)
+
+func init() {
+	addFlags(cmdDeploy, "mongodb", "rabbitmq", "iis", "iis-port", "winrm", "dc", "with-root", "manifest", "out", "dry-run")
+}
+
+func runDeploy(cmd *flagplus.Subcommand, args []string) {
+	if len(args) != 1 {
+		log.Print("Missing required argument: NAME")
+		cmd.Usage()
+	}
+	var services []string
+	if *IsMongoDB {
+		services = append(services, SERVICE_MONGODB)
+	}
+	if *IsRabbitMQ {
+		services = append(services, SERVICE_RABBITMQ)
+	}
+	if *IISSite != "" {
+		services = append(services, SERVICE_IIS)
+	}
+	if *IsWinRM {
+		services = append(services, SERVICE_WINRM)
+	}
+	if *IsDC {
+		services = append(services, SERVICE_DC)
+	}
+	switch len(services) {
+	case 0:
+		log.Print("Missing required flag")
+		cmd.Usage()
+	case 1:
+	default:
+		log.Fatal("Flags -mongodb, -rabbitmq, -iis, -winrm and -dc are mutually exclusive")
+	}
+	service := services[0]
+	if *IISPort < 1 || *IISPort > 65535 {
+		log.Fatalf("Invalid port of IIS: %d", *IISPort)
+	}
+
+	name := args[0]
+	setCertPath(name)
+	if service == SERVICE_IIS || service == SERVICE_WINRM || service == SERVICE_DC {
+		if *IsManifest {
+			log.Fatal("Flag -manifest is not used by -iis, -winrm and -dc")
+		}
+		if *IsWithRoot {
+			log.Fatal("Flag -with-root is not used by -iis, -winrm and -dc")
+		}
+		Bind(name, service, *IISSite, *IISPort, *IsDryRun)
+		return
+	}
+	if *Out == "" {
+		*Out = name + "-" + service
+	}
+	Deploy(name, service, *Out)
+}
+
+// Deploy writes the certificate and its private key in the directory `out`,
+// with the files and the configuration of the server `service`.
+func Deploy(name, service, out string) {
+	cert, err := parseCertFile(File.Cert)
+	if err != nil {
+		log.Fatal(err)
+	}
+	chain := chainOf(cert, chainCerts())
+	if len(chain) == 0 {
+		log.Fatalf("Chain of CA certificates not found for %q", name)
+	}
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})
+	for _, v := range servedChain(cert) {
+		certPEM = append(certPEM, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: v.Cert.Raw})...)
+	}
+
+	var caPEM []byte
+	for _, v := range chain {
+		caPEM = append(caPEM, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: v.Cert.Raw})...)
+	}
+
+	keyPEM, err := os.ReadFile(File.Key)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer zero(keyPEM)
+
+	dir, err := filepath.Abs(out)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	var files []archiveFile
+	switch service {
+	case SERVICE_MONGODB:
+		certKeyPEM := append(append([]byte{}, certPEM...), keyPEM...)
+		defer zero(certKeyPEM)
+
+		conf := fmt.Sprintf(`# Section "net" of mongod.conf
+net:
+  tls:
+    mode: requireTLS
+    certificateKeyFile: %s
+    CAFile: %s
+`, filepath.Join(dir, name+".pem"), filepath.Join(dir, "ca.pem"))
+
+		files = []archiveFile{
+			{name + ".pem", certKeyPEM},
+			{"ca.pem", caPEM},
+			{"mongod.conf", []byte(conf)},
+		}
+	case SERVICE_RABBITMQ:
+		conf := fmt.Sprintf(`# Options of TLS of rabbitmq.conf
+listeners.ssl.default = 5671
+ssl_options.cacertfile = %s
+ssl_options.certfile = %s
+ssl_options.keyfile = %s
+ssl_options.verify = verify_peer
+ssl_options.fail_if_no_peer_cert = false
+`, filepath.Join(dir, "ca_certificate.pem"), filepath.Join(dir, "server_certificate.pem"),
+			filepath.Join(dir, "server_key.pem"))
+
+		files = []archiveFile{
+			{"ca_certificate.pem", caPEM},
+			{"server_certificate.pem", certPEM},
+			{"server_key.pem", keyPEM},
+			{"rabbitmq.conf", []byte(conf)},
+		}
+	}
+
+	writeLayout(out, withManifest(name, cert, files))
+}
@@ -0,0 +1,604 @@
+// Copyright 2014 Jonas mg
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/tredoe/flagplus"
+)
+
+var cmdExport = &flagplus.Subcommand{
+	UsageLine: "export -public [-manifest] [-sign [-signer name]] [-version number] [-out file] NAME | export -layout keycloak|shibboleth-idp|shibboleth-sp [-manifest] [-sign [-signer name]] [-version number] [-out dir] NAME | export -mobileconfig [-identity] [-manifest] [-sign [-signer name]] [-version number] [-out file] NAME | export -android [-manifest] [-sign [-signer name]] [-version number] [-out dir] NAME | export -browser-policy [-manifest] [-sign [-signer name]] [-version number] [-out dir] NAME | export -p12 [-password string] [-legacy] [-with-root] [-manifest] [-sign [-signer name]] [-version number] [-out file] NAME",
+	Short:     "export a certificate",
+	Long: `
+"export" makes an archive with a certificate to give it to third parties.
+
+With "-public", the archive (tar.gz) has only public material: the certificate,
+the chain of CA certificates, the fingerprints and the metadata in JSON format.
+It is checked that no private key is included in it.
+
+The archive is written to "NAME-public.tar.gz" unless it is used "-out".
+With "-version", it is exported a previous version of the certificate (see
+"ls -history").
+
+With "-layout", the certificate and its private key are written in a directory,
+"NAME-LAYOUT" unless it is used "-out", with the files expected by the SAML
+software to sign and encrypt the messages (see "req -saml"):
+
+	keycloak        "NAME-keycloak.json", the component of a key provider
+	                "rsa" to import in the realm
+	shibboleth-idp  "idp-signing.crt", "idp-signing.key",
+	                "idp-encryption.crt" and "idp-encryption.key" of the
+	                directory "credentials" of the identity provider
+	shibboleth-sp   "sp-signing-cert.pem", "sp-signing-key.pem",
+	                "sp-encrypt-cert.pem" and "sp-encrypt-key.pem" of the
+	                service provider
+
+The private keys are written only readable by the owner.
+
+With "-mobileconfig", it is written a configuration profile of Apple,
+"NAME.mobileconfig" unless it is used "-out", so that the devices of iOS and
+macOS trust the CA at installing it; the certificate NAME can be the CA itself
+("ca") or one issued by it, and the profile has the chain of CA certificates.
+The profile exported again has the same identifiers, so it replaces the
+installed one.
+
+With "-identity", the profile has too the certificate and its private key in
+PKCS#12 format, protected by the password of the variable EASYCERT_P12_PASS,
+which is asked by the device at installing it; then the profile is written only
+readable by the owner.
+
+With "-android", it is written a directory "NAME-android" unless it is used
+"-out", with the files to add to the resources of an Android app so that its
+debug builds trust the CA: "res/xml/network_security_config.xml", whose trust
+anchors in "debug-overrides" are the CA certificates of the chain, in DER format
+into "res/raw". The configuration is enabled in the element "application" of
+the manifest:
+
+	android:networkSecurityConfig="@xml/network_security_config"
+
+With "-browser-policy", it is written a directory "NAME-browser-policy" unless
+it is used "-out", with the policies of enterprise to make the managed browsers
+trust the CA certificates of the chain:
+
+	chrome/easycert.json      the policy "CACertificates" of Chrome, to copy in
+	                          "/etc/opt/chrome/policies/managed" (Linux), or to
+	                          push like the rest of policies
+	firefox/policies.json     the policy "Certificates" of Firefox, to copy in
+	                          the directory "distribution" of the installation
+	firefox/easycert_ca*.crt  the certificates installed by the policy, to copy
+	                          in "/usr/lib/mozilla/certificates" (Linux) or
+	                          "%USERPROFILE%\AppData\Local\Mozilla\Certificates"
+	                          (Windows)
+
+With "-p12", it is written a PKCS#12 bundle, "NAME.p12" unless it is used
+"-out" (i.e. "NAME.pfx"), with the private key, the certificate and its
+intermediate CAs, for Windows, Java and the appliances which only import this
+format; the root CA is only added with "-with-root", since a server should not
+send it. It is written only readable by the owner. The password is the one given
+in "-password", or the one of the variable EASYCERT_P12_PASS, or else it is
+prompted by OpenSSL. With "-legacy", it is encrypted with 3DES and SHA-1
+instead of AES-256, for the systems which do not support the format by default
+of OpenSSL 3, like Windows Server 2016 or Java 8.
+
+With "-manifest", it is added a file "manifest.json" to the archive or the
+directory, or written next to the file like "OUT.manifest.json", so whoever
+receives it can verify its integrity and provenance: the SHA-256 digest and the
+size of every file, the fingerprints and the validity of the certificate, its
+key usages, the fingerprints of the chain of CA certificates, and the ID of the
+store which exported it, i.e. the SHA-256 fingerprint of its root CA.
+
+With "-sign", the bundle is signed with the CA, or with the certificate given in
+"-signer", which has to be a dedicated release key ("req -code-signing"), in a
+detached signature in CMS written next to the file like "OUT.p7s"; in a
+directory, its manifest is signed, like "manifest.json.p7s". The recipients check it with "verify-bundle".
+`,
+	Run: runExport,
+}
+
+var (
+	IsPublic = flag.Bool("public", false, "only public material")
+	Out      = flag.String("out", "", "output file or directory")
+	Layout   = flag.String("layout", "", "layout of the files of the SAML software")
+
+	IsMobileConfig = flag.Bool("mobileconfig", false, "configuration profile of Apple")
+	IsIdentity     = flag.Bool("identity", false, "add the certificate and its private key")
+	IsAndroid      = flag.Bool("android", false, "network security configuration of Android")
+
+	IsBrowserPolicy = flag.Bool("browser-policy", false, "policies of Chrome and Firefox")
+
+	IsPKCS12    = flag.Bool("p12", false, "PKCS#12 bundle with the private key")
+	P12Password = flag.String("password", "", "password of the PKCS#12 bundle (default from EASYCERT_P12_PASS)")
+	IsLegacy    = flag.Bool("legacy", false, "legacy encryption of PKCS#12 (3DES and SHA-1)")
+
+	Signer = flag.String("signer", NAME_CA, "certificate which signs the exported bundle")
+)
+
+// Layouts of the files of the SAML software.
+const (
+	LAYOUT_KEYCLOAK       = "keycloak"
+	LAYOUT_SHIBBOLETH_IDP = "shibboleth-idp"
+	LAYOUT_SHIBBOLETH_SP  = "shibboleth-sp"
+)
+
+func init() {
+	addFlags(cmdExport, "public", "layout", "mobileconfig", "identity", "android", "browser-policy", "p12", "password", "legacy", "with-root", "manifest", "sign", "signer", "version", "out")
+}
+
+func runExport(cmd *flagplus.Subcommand, args []string) {
+	if len(args) != 1 {
+		log.Print("Missing required argument: NAME")
+		cmd.Usage()
+	}
+	name := args[0]
+	if *IsSign {
+		checkBundleSigner()
+	}
+	setCertPath(name)
+	if *Version != 0 {
+		File.Cert = versionCert(name, *Version)
+		File.Key = versionKey(name, *Version)
+		name = versionName(name, *Version)
+	}
+	if *IsWithRoot && !*IsPKCS12 {
+		log.Fatal("Flag -with-root is only used by -p12")
+	}
+	// The files of a directory are signed through its manifest.
+	if *IsSign && (*Layout != "" || *IsAndroid || *IsBrowserPolicy) {
+		*IsManifest = true
+	}
+
+	if *IsPublic {
+		if *Out == "" {
+			*Out = name + "-public.tar.gz"
+		}
+		ExportPublic(name, *Out)
+	} else if *Layout != "" {
+		if *Out == "" {
+			*Out = name + "-" + *Layout
+		}
+		ExportLayout(name, *Layout, *Out)
+	} else if *IsMobileConfig {
+		if *Out == "" {
+			*Out = name + EXT_MOBILECONFIG
+		}
+		ExportMobileConfig(name, *Out, *IsIdentity)
+	} else if *IsAndroid {
+		if *Out == "" {
+			*Out = name + "-android"
+		}
+		ExportAndroid(name, *Out)
+	} else if *IsBrowserPolicy {
+		if *Out == "" {
+			*Out = name + "-browser-policy"
+		}
+		ExportBrowserPolicy(name, *Out)
+	} else if *IsPKCS12 {
+		if *Out == "" {
+			*Out = name + EXT_PKCS12
+		}
+		ExportPKCS12(name, *Out, *P12Password, *IsLegacy)
+	} else {
+		log.Print("Missing required flag")
+		cmd.Usage()
+	}
+
+	if *IsSign {
+		signBundle(*Out)
+	}
+}
+
+// archiveFile represents a file to add to an archive.
+type archiveFile struct {
+	name string
+	data []byte
+}
+
+// ExportPublic writes an archive with the public material of the certificate.
+func ExportPublic(name, out string) {
+	cert, err := parseCertFile(File.Cert)
+	if err != nil {
+		log.Fatal(err)
+	}
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})
+
+	var chainPEM []byte
+	for _, v := range chainOf(cert, chainCerts()) {
+		chainPEM = append(chainPEM, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: v.Cert.Raw})...)
+	}
+
+	info := newCertInfo(name, cert)
+	meta, err := json.MarshalIndent(info, "", "\t")
+	if err != nil {
+		log.Fatal(err)
+	}
+	fingerprints := fmt.Sprintf("SHA256 %s\nSHA1   %s\n", info.FingerprintSHA256, info.FingerprintSHA1)
+
+	files := []archiveFile{
+		{name + EXT_CERT, certPEM},
+		{"fingerprints.txt", []byte(fingerprints)},
+		{"metadata.json", append(meta, '\n')},
+	}
+	if len(chainPEM) != 0 {
+		files = append(files, archiveFile{"chain" + EXT_CERT, chainPEM})
+	}
+	files = withManifest(name, cert, files)
+
+	for _, f := range files {
+		if err = checkNoKey(f.data); err != nil {
+			log.Fatalf("%s: %s", f.name, err)
+		}
+	}
+
+	if _, err = os.Stat(out); !os.IsNotExist(err) {
+		log.Fatalf("File already exists: %q", out)
+	}
+	if err = writeTarGz(out, name+"-public/", files); err != nil {
+		log.Fatal(err)
+	}
+
+	fmt.Printf("\n== Generated\n- Archive:\t%q\n", out)
+}
+
+// ExportLayout writes the certificate and its private key in the directory
+// `out`, with the files of the SAML software `layout`.
+func ExportLayout(name, layout, out string) {
+	cert, err := parseCertFile(File.Cert)
+	if err != nil {
+		log.Fatal(err)
+	}
+	certPEM, err := os.ReadFile(File.Cert)
+	if err != nil {
+		log.Fatal(err)
+	}
+	keyPEM, err := os.ReadFile(File.Key)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer zero(keyPEM)
+
+	var files []archiveFile
+	switch layout {
+	case LAYOUT_KEYCLOAK:
+		component := map[string]interface{}{
+			"name":         name,
+			"providerId":   "rsa",
+			"providerType": "org.keycloak.keys.KeyProvider",
+			"config": map[string][]string{
+				"priority":    {"100"},
+				"enabled":     {"true"},
+				"active":      {"true"},
+				"algorithm":   {"RS256"},
+				"privateKey":  {string(keyPEM)},
+				"certificate": {string(certPEM)},
+			},
+		}
+		data, err := json.MarshalIndent(component, "", "\t")
+		if err != nil {
+			log.Fatal(err)
+		}
+		files = []archiveFile{{name + "-keycloak.json", append(data, '\n')}}
+	case LAYOUT_SHIBBOLETH_IDP:
+		files = []archiveFile{
+			{"idp-signing.crt", certPEM},
+			{"idp-signing.key", keyPEM},
+			{"idp-encryption.crt", certPEM},
+			{"idp-encryption.key", keyPEM},
+		}
+	case LAYOUT_SHIBBOLETH_SP:
+		files = []archiveFile{
+			{"sp-signing-cert.pem", certPEM},
+			{"sp-signing-key.pem", keyPEM},
+			{"sp-encrypt-cert.pem", certPEM},
+			{"sp-encrypt-key.pem", keyPEM},
+		}
+	default:
+		log.Fatalf("Invalid value %q for flag -layout: it has to be %q, %q or %q",
+			layout, LAYOUT_KEYCLOAK, LAYOUT_SHIBBOLETH_IDP, LAYOUT_SHIBBOLETH_SP)
+	}
+
+	writeLayout(out, withManifest(name, cert, files))
+}
+
+// androidConfig is the template of the network security configuration of
+// Android, with the resources of the CA certificates.
+const androidConfig = `<?xml version="1.0" encoding="utf-8"?>
+<!-- Generated by easycert: trust the CA only in the debug builds. -->
+<network-security-config>
+    <debug-overrides>
+        <trust-anchors>
+%s        </trust-anchors>
+    </debug-overrides>
+</network-security-config>
+`
+
+// ExportAndroid writes in the directory `out` the resources of an Android app
+// to trust the CA of the certificate in its debug builds.
+func ExportAndroid(name, out string) {
+	cert, err := parseCertFile(File.Cert)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	var files []archiveFile
+	var anchors strings.Builder
+
+	for i, v := range mustTrustedCAs(name, cert) {
+		// The names of the resources can only have [a-z0-9_].
+		res := "easycert_ca"
+		if i != 0 {
+			res += "_" + strconv.Itoa(i)
+		}
+		files = append(files, archiveFile{"res/raw/" + res + ".der", v.Cert.Raw})
+		fmt.Fprintf(&anchors, "            <certificates src=\"@raw/%s\"/>\n", res)
+	}
+	files = append(files, archiveFile{"res/xml/network_security_config.xml",
+		[]byte(fmt.Sprintf(androidConfig, anchors.String()))})
+
+	writeLayout(out, withManifest(name, cert, files))
+}
+
+// ExportBrowserPolicy writes in the directory `out` the policies of Chrome and
+// Firefox to trust the CA of the certificate.
+func ExportBrowserPolicy(name, out string) {
+	cert, err := parseCertFile(File.Cert)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	var files []archiveFile
+	var chromeCerts, firefoxCerts []string
+
+	for i, v := range mustTrustedCAs(name, cert) {
+		file := "easycert_ca" + EXT_CERT
+		if i != 0 {
+			file = fmt.Sprintf("easycert_ca_%d%s", i, EXT_CERT)
+		}
+		chromeCerts = append(chromeCerts, base64.StdEncoding.EncodeToString(v.Cert.Raw))
+		firefoxCerts = append(firefoxCerts, file)
+		files = append(files, archiveFile{"firefox/" + file,
+			pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: v.Cert.Raw})})
+	}
+
+	chrome, err := json.MarshalIndent(map[string]interface{}{
+		"CACertificates": chromeCerts,
+	}, "", "\t")
+	if err != nil {
+		log.Fatal(err)
+	}
+	firefox, err := json.MarshalIndent(map[string]interface{}{
+		"policies": map[string]interface{}{
+			"Certificates": map[string][]string{"Install": firefoxCerts},
+		},
+	}, "", "\t")
+	if err != nil {
+		log.Fatal(err)
+	}
+	files = append(files,
+		archiveFile{"chrome/easycert.json", append(chrome, '\n')},
+		archiveFile{"firefox/policies.json", append(firefox, '\n')},
+	)
+
+	writeLayout(out, withManifest(name, cert, files))
+}
+
+// mustTrustedCAs returns the CA certificates to trust the certificate: itself
+// whether it is a CA, and its chain up to the root. It exits whether there is
+// none.
+func mustTrustedCAs(name string, cert *x509.Certificate) []*storeCert {
+	var cas []*storeCert
+	if cert.IsCA {
+		cas = append(cas, &storeCert{Name: name, Cert: cert})
+	}
+	cas = append(cas, chainOf(cert, chainCerts())...)
+	if len(cas) == 0 {
+		log.Fatalf("No CA certificate found for %q", name)
+	}
+	return cas
+}
+
+// writeLayout writes the files in the new directory `out`; the ones with a
+// private key are only readable by the owner.
+func writeLayout(out string, files []archiveFile) {
+	if err := os.Mkdir(out, 0700); err != nil {
+		log.Fatal(err)
+	}
+	fmt.Printf("\n== Generated\n")
+	for _, f := range files {
+		perm := os.FileMode(0644)
+		if bytes.Contains(f.data, []byte("PRIVATE KEY")) {
+			perm = 0600
+		}
+		file := filepath.Join(out, filepath.FromSlash(f.name))
+		if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+			log.Fatal(err)
+		}
+		if err := writeFileAtomic(file, f.data, perm); err != nil {
+			log.Fatal(err)
+		}
+		fmt.Printf("- File:\t%q\n", file)
+	}
+}
+
+// checkNoKey checks that there is not any private key in data, neither in PEM
+// format nor like the content of the key files of the certificates directory.
+func checkNoKey(data []byte) error {
+	rest := data
+	for {
+		var block *pem.Block
+
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			break
+		}
+		if strings.Contains(block.Type, "PRIVATE KEY") {
+			return fmt.Errorf("found a private key (%s)", block.Type)
+		}
+	}
+
+	keys, err := loadKeyBlocks()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		for _, v := range keys {
+			zero(v)
+		}
+	}()
+
+	for _, v := range keys {
+		if bytes.Contains(data, v) {
+			return fmt.Errorf("found the content of a private key")
+		}
+	}
+	return nil
+}
+
+// loadKeyBlocks returns the content of the private keys of the certificates
+// directory, whether they can be read.
+func loadKeyBlocks() ([][]byte, error) {
+	var keys [][]byte
+
+	for _, dir := range []string{Dir.Key, filepath.Join(Dir.Key, DIR_HISTORY)} {
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			if os.IsNotExist(err) || os.IsPermission(err) {
+				continue
+			}
+			return nil, err
+		}
+
+		for _, v := range entries {
+			data, err := os.ReadFile(filepath.Join(dir, v.Name()))
+			if err != nil {
+				continue // i.e. without permission to read it, or a directory
+			}
+			for {
+				var block *pem.Block
+
+				block, data = pem.Decode(data)
+				if block == nil {
+					break
+				}
+				keys = append(keys, block.Bytes)
+			}
+		}
+	}
+	return keys, nil
+}
+
+// writeTarGz writes a compressed tar archive with the files into the directory
+// `prefix`.
+func writeTarGz(out, prefix string, files []archiveFile) error {
+	file, err := os.OpenFile(out, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+
+	gz := gzip.NewWriter(file)
+	tw := tar.NewWriter(gz)
+	now := time.Now()
+
+	for _, f := range files {
+		hdr := &tar.Header{
+			Name:    prefix + f.name,
+			Mode:    0644,
+			Size:    int64(len(f.data)),
+			ModTime: now,
+		}
+		if err = tw.WriteHeader(hdr); err != nil {
+			break
+		}
+		if _, err = tw.Write(f.data); err != nil {
+			break
+		}
+	}
+
+	if err == nil {
+		err = tw.Close()
+	}
+	if err == nil {
+		err = gz.Close()
+	}
+	if errClose := file.Close(); err == nil {
+		err = errClose
+	}
+	if err != nil {
+		os.Remove(out)
+	}
+	return err
+}
+
+// ExportPKCS12 writes a PKCS#12 bundle with the private key, the certificate
+// and its chain of CA certificates, protected by `password`, or by the one of
+// ENV_P12_PASS whether it is empty.
+func ExportPKCS12(name, out, password string, legacy bool) {
+	cert, err := parseCertFile(File.Cert)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if cert.IsCA {
+		log.Fatal("The private key of a CA is not exported")
+	}
+	if _, err = os.Stat(File.Key); err != nil {
+		log.Fatal(err)
+	}
+	if _, err = os.Stat(out); !os.IsNotExist(err) {
+		log.Fatalf("File already exists: %q", out)
+	}
+
+	// The password is passed through the environment, so it is not shown in
+	// the list of processes.
+	if password != "" {
+		os.Setenv(ENV_P12_PASS, password)
+	}
+	args := []string{"pkcs12", "-export", "-in", File.Cert, "-inkey", File.Key, "-name", name}
+	if os.Getenv(ENV_P12_PASS) != "" {
+		args = append(args, "-passout", "env:"+ENV_P12_PASS)
+	} else if batchMode() {
+		log.Fatalf("Batch mode: the password has to be given in -password or %s", ENV_P12_PASS)
+	}
+	if legacy {
+		args = append(args, "-keypbe", "PBE-SHA1-3DES", "-certpbe", "PBE-SHA1-3DES", "-macalg", "sha1")
+	}
+
+	var chain []byte
+	for _, v := range servedChain(cert) {
+		chain = append(chain, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: v.Cert.Raw})...)
+	}
+	if len(chain) != 0 {
+		chainFile := mustTempFile(out)
+		defer os.Remove(chainFile)
+		if err = os.WriteFile(chainFile, chain, 0600); err != nil {
+			fatal(err)
+		}
+		args = append(args, "-certfile", chainFile)
+	}
+
+	tmp := mustTempFile(out)
+	args = append(args, "-out", tmp)
+	openssl(args...)
+	mustCommitFile(tmp, out, 0600)
+
+	fmt.Printf("\n== Generated\n- PKCS#12:\t%q\n", out)
+	writeManifest(name, cert, out)
+}
@@ -0,0 +1,270 @@
+// Copyright 2014 Jonas mg
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/tredoe/flagplus"
+)
+
+var cmdGC = &flagplus.Subcommand{
+	UsageLine: "gc [-expired-for duration] [-delete] [-dry-run]",
+	Short:     "remove the expired material of the store",
+	Long: `
+"gc" removes from the certificates directory the material expired for longer
+than the duration given in "-expired-for" (i.e. "90d"), or in the field
+"retention" of "store.json" (90 days by default):
+
+	certificates and private keys, but the ones of the CAs
+	previous versions of the certificates (see "ls -history")
+	certificate requests never signed, or whose certificate is removed
+	issuers of the chains directory no longer used
+	entries of the database of the CA, and their copies in "newcerts"
+
+The entries of the database still valid but expired are marked like expired.
+Since the revoked certificates are removed of the database, they will not be
+listed in the next revocation lists.
+
+The files are moved into a directory named by the date into "archive", unless
+it is used the flag "-delete". The flag "-dry-run" lists them without removing.
+`,
+	Run: runGC,
+}
+
+var (
+	ExpiredFor = flag.String("expired-for", "", "time since the expiration")
+	IsDelete   = flag.Bool("delete", false, "delete instead of archive")
+)
+
+func init() {
+	addFlags(cmdGC, "expired-for", "delete", "dry-run")
+}
+
+// DEFAULT_RETENTION is the time to keep the material expired when it is not
+// configured.
+const DEFAULT_RETENTION = "90d"
+
+func runGC(cmd *flagplus.Subcommand, args []string) {
+	if len(args) != 0 {
+		log.Print("Too many arguments")
+		cmd.Usage()
+	}
+	operator := mustRole(ACTION_GC)
+
+	retention := *ExpiredFor
+	if retention == "" {
+		if retention = loadStoreConfig().Retention; retention == "" {
+			retention = DEFAULT_RETENTION
+		}
+	}
+	d, err := parseDuration(retention)
+	if err != nil {
+		log.Fatalf("-expired-for: %s", err)
+	}
+	limit := time.Now().Add(-d)
+
+	entries, err := readIndex()
+	if err != nil {
+		log.Fatal(err)
+	}
+	kept, removed, err := gcIndex(entries, limit)
+	if err != nil {
+		log.Fatal(err)
+	}
+	files := gcFiles(removed, limit)
+
+	if *IsDryRun {
+		for _, v := range files {
+			fmt.Println(v)
+		}
+		for _, v := range removed {
+			fmt.Printf("%s\t%s\t%s\n", File.Index, v.Serial, v.Subject)
+		}
+		return
+	}
+	if len(files) == 0 && len(removed) == 0 {
+		fmt.Println("Nothing to remove")
+		return
+	}
+
+	tx := beginIssuance()
+	if err = tx.saveDatabase(); err != nil {
+		log.Fatal(err)
+	}
+	if err = writeIndex(kept); err != nil {
+		fatal(err)
+	}
+	if err = syncDatabase(); err != nil {
+		fatal(err)
+	}
+
+	archive := filepath.Join(Dir.Archive, time.Now().UTC().Format("20060102T150405Z"))
+	if !*IsDelete {
+		for _, v := range files {
+			if err = moveToArchive(v, archive); err != nil {
+				fatal(err)
+			}
+		}
+	}
+	commitIssuance()
+
+	fmt.Print("\n== Removed\n")
+	for _, v := range files {
+		if *IsDelete {
+			if err = os.Remove(v); err != nil {
+				log.Print(err)
+				continue
+			}
+		}
+		fmt.Printf("- %s\n", v)
+	}
+	fmt.Printf("- %d entries of the database\n", len(removed))
+	if !*IsDelete {
+		fmt.Printf("\n* Archived into: %q\n", archive)
+	}
+
+	audit(operator, ACTION_GC, "", fmt.Sprintf("%d files, %d entries (expired for %s)",
+		len(files), len(removed), retention))
+}
+
+// gcIndex returns the entries of the database to keep, marking the ones
+// expired, and the entries expired before of `limit`.
+func gcIndex(entries []*indexEntry, limit time.Time) (kept, removed []*indexEntry, err error) {
+	now := time.Now()
+
+	for _, v := range entries {
+		expiry, err := v.expiry()
+		if err != nil {
+			return nil, nil, err
+		}
+		if expiry.Before(limit) {
+			removed = append(removed, v)
+			continue
+		}
+		if v.Status == INDEX_VALID && expiry.Before(now) {
+			v.Status = INDEX_EXPIRED
+		}
+		kept = append(kept, v)
+	}
+	return kept, removed, nil
+}
+
+// gcFiles returns the files of the store which are expired before of `limit`,
+// and the copies of the certificates of the database entries removed.
+func gcFiles(removed []*indexEntry, limit time.Time) []string {
+	var files []string
+	seen := make(map[string]bool)
+
+	add := func(file string) {
+		if _, err := os.Stat(file); err == nil && !seen[file] {
+			seen[file] = true
+			files = append(files, file)
+		}
+	}
+	isExpired := func(file string) bool {
+		cert, err := parseCertFile(file)
+		if err != nil {
+			log.Printf("%s: %s", file, err)
+			return false
+		}
+		return !cert.IsCA && cert.NotAfter.Before(limit)
+	}
+
+	// The certificates kept, to know the issuers which are used and the
+	// requests which are not leftovers.
+	var inUse []*storeCert
+	kept := make(map[string]bool)
+
+	for _, c := range loadCerts() {
+		if c.Name == NAME_CA || !isExpired(c.File) {
+			inUse = append(inUse, c)
+			kept[c.Name] = true
+			continue
+		}
+		add(c.File)
+		add(filepath.Join(Dir.Key, c.Name+EXT_KEY))
+		add(filepath.Join(Dir.Root, c.Name+".cfg"))
+	}
+
+	history, err := filepath.Glob(filepath.Join(Dir.Cert, DIR_HISTORY, "*"+EXT_CERT))
+	if err != nil {
+		log.Fatal(err)
+	}
+	for _, v := range history {
+		name := strings.TrimSuffix(filepath.Base(v), EXT_CERT)
+
+		if !isExpired(v) {
+			if cert, err := parseCertFile(v); err == nil {
+				inUse = append(inUse, &storeCert{Name: name, File: v, Cert: cert})
+			}
+			continue
+		}
+		add(v)
+		add(filepath.Join(Dir.Key, DIR_HISTORY, name+EXT_KEY))
+	}
+
+	requests, err := filepath.Glob(filepath.Join(Dir.Root, "*"+EXT_REQUEST))
+	if err != nil {
+		log.Fatal(err)
+	}
+	for _, v := range requests {
+		name := strings.TrimSuffix(filepath.Base(v), EXT_REQUEST)
+		if kept[name] {
+			continue
+		}
+		if info, err := os.Stat(v); err == nil && info.ModTime().Before(limit) {
+			add(v)
+			add(strings.TrimSuffix(v, EXT_REQUEST) + ".cfg")
+		}
+	}
+
+	issuers := chainCerts()
+	used := make(map[string]bool)
+	for _, c := range inUse {
+		for _, v := range chainOf(c.Cert, issuers) {
+			used[v.File] = true
+		}
+	}
+	for _, v := range loadIssuers() {
+		if !used[v.File] {
+			add(v.File)
+		}
+	}
+
+	for _, v := range removed {
+		add(filepath.Join(Dir.NewCert, v.Serial+".pem"))
+	}
+	return files
+}
+
+// moveToArchive moves the file into the directory `archive`, with the same path
+// than into the certificates directory. The file is moved back whether the
+// issuance in progress is rolled back.
+func moveToArchive(file, archive string) error {
+	rel, err := filepath.Rel(Dir.Root, file)
+	if err != nil {
+		return err
+	}
+	dst := filepath.Join(archive, rel)
+
+	// It has private keys.
+	if err = os.MkdirAll(filepath.Dir(dst), 0700); err != nil {
+		return err
+	}
+	if err = os.Rename(file, dst); err != nil {
+		return err
+	}
+	curIssuance.addRename(file, dst)
+	return nil
+}
@@ -0,0 +1,176 @@
+// Copyright 2014 Jonas mg
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/tredoe/flagplus"
+)
+
+// runGendocs generates the manual pages in troff format and the reference in
+// Markdown from the subcommands metadata, or the description in OpenAPI of the
+// REST API of the portal.
+//
+// Usage: easycert-wrap gendocs [-format man|md|openapi] DIR
+func runGendocs(args []string) {
+	fs := flag.NewFlagSet("gendocs", flag.ExitOnError)
+	format := fs.String("format", "man", "format of the documentation: man, md, openapi")
+	fs.Parse(args)
+
+	if fs.NArg() != 1 {
+		log.Fatalf("Missing required argument: DIR\n\n  %s gendocs [-format man|md|openapi] DIR", PROGRAM)
+	}
+	dir := fs.Arg(0)
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		log.Fatal(err)
+	}
+
+	switch *format {
+	case "man":
+		writeDoc(filepath.Join(dir, PROGRAM+".1"), manMain())
+		for _, cmd := range commands {
+			writeDoc(filepath.Join(dir, PROGRAM+"-"+cmdName(cmd)+".1"), manCommand(cmd))
+		}
+	case "md":
+		writeDoc(filepath.Join(dir, PROGRAM+".md"), markdown())
+	case "openapi":
+		writeDoc(filepath.Join(dir, "openapi.json"), openAPISpec())
+	default:
+		log.Fatalf("Unknown format: %q", *format)
+	}
+}
+
+func writeDoc(file string, data []byte) {
+	if err := os.WriteFile(file, data, 0644); err != nil {
+		log.Fatal(err)
+	}
+	fmt.Printf("* Generated %q\n", file)
+}
+
+// cmdName returns the name of the subcommand.
+func cmdName(cmd *flagplus.Subcommand) string {
+	return strings.Fields(cmd.UsageLine)[0]
+}
+
+// cmdFlagList returns the flags registered by the subcommand.
+func cmdFlagList(cmd *flagplus.Subcommand) []*flag.Flag {
+	var list []*flag.Flag
+
+	for _, name := range cmdFlags[cmd] {
+		if f := flag.Lookup(name); f != nil {
+			list = append(list, f)
+		}
+	}
+	return list
+}
+
+// == Troff
+//
+
+// manEscape escapes the text to be used in troff.
+func manEscape(s string) string {
+	s = strings.ReplaceAll(s, `\`, `\e`)
+	s = strings.ReplaceAll(s, "-", `\-`)
+
+	lines := strings.Split(s, "\n")
+	for i, v := range lines {
+		if strings.HasPrefix(v, ".") || strings.HasPrefix(v, "'") {
+			lines[i] = `\&` + v
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+func manHeader(buf *bytes.Buffer, title, short string) {
+	fmt.Fprintf(buf, ".TH %s 1 %q \"EasyCert\" \"EasyCert Manual\"\n",
+		strings.ToUpper(title), time.Now().Format("January 2006"))
+	fmt.Fprintf(buf, ".SH NAME\n%s \\- %s\n", manEscape(title), manEscape(short))
+}
+
+func manMain() []byte {
+	var buf bytes.Buffer
+
+	manHeader(&buf, PROGRAM, "create and handle certificates")
+	fmt.Fprintf(&buf, ".SH SYNOPSIS\n.B %s\ncommand [arguments]\n", PROGRAM)
+	fmt.Fprintf(&buf, ".SH DESCRIPTION\n%s\n", manEscape(DESCRIPTION))
+	buf.WriteString(".SH COMMANDS\n")
+	for _, cmd := range commands {
+		fmt.Fprintf(&buf, ".TP\n.B %s\n%s\n", cmdName(cmd), manEscape(cmd.Short))
+	}
+	buf.WriteString(".SH SEE ALSO\n")
+	for i, cmd := range commands {
+		if i != 0 {
+			buf.WriteString(",\n")
+		}
+		fmt.Fprintf(&buf, ".BR %s\\-%s (1)", PROGRAM, cmdName(cmd))
+	}
+	buf.WriteString("\n")
+
+	return buf.Bytes()
+}
+
+func manCommand(cmd *flagplus.Subcommand) []byte {
+	var buf bytes.Buffer
+	name := cmdName(cmd)
+
+	manHeader(&buf, PROGRAM+"-"+name, cmd.Short)
+	fmt.Fprintf(&buf, ".SH SYNOPSIS\n.B %s %s\n%s\n", PROGRAM, name,
+		manEscape(strings.TrimSpace(strings.TrimPrefix(cmd.UsageLine, name))))
+	fmt.Fprintf(&buf, ".SH DESCRIPTION\n%s\n", manEscape(strings.TrimSpace(cmd.Long)))
+
+	if list := cmdFlagList(cmd); len(list) != 0 {
+		buf.WriteString(".SH OPTIONS\n")
+		for _, f := range list {
+			fmt.Fprintf(&buf, ".TP\n.B \\-%s\n%s", manEscape(f.Name), manEscape(f.Usage))
+			if f.DefValue != "" && f.DefValue != "false" {
+				fmt.Fprintf(&buf, " (default: %s)", manEscape(f.DefValue))
+			}
+			buf.WriteString("\n")
+		}
+	}
+	fmt.Fprintf(&buf, ".SH SEE ALSO\n.BR %s (1)\n", PROGRAM)
+
+	return buf.Bytes()
+}
+
+// == Markdown
+//
+
+func markdown() []byte {
+	var buf bytes.Buffer
+
+	fmt.Fprintf(&buf, "# %s\n\n%s\n\n", PROGRAM, DESCRIPTION)
+	fmt.Fprintf(&buf, "Usage:\n\n\t%s command [arguments]\n\n", PROGRAM)
+	buf.WriteString("| Command | Description |\n|---|---|\n")
+	for _, cmd := range commands {
+		name := cmdName(cmd)
+		fmt.Fprintf(&buf, "| [%s](#%s) | %s |\n", name, name, cmd.Short)
+	}
+
+	for _, cmd := range commands {
+		fmt.Fprintf(&buf, "\n## %s\n\n", cmdName(cmd))
+		fmt.Fprintf(&buf, "\t%s %s\n\n", PROGRAM, cmd.UsageLine)
+		fmt.Fprintf(&buf, "%s\n", strings.TrimSpace(cmd.Long))
+
+		if list := cmdFlagList(cmd); len(list) != 0 {
+			buf.WriteString("\n| Flag | Default | Description |\n|---|---|---|\n")
+			for _, f := range list {
+				fmt.Fprintf(&buf, "| `-%s` | %s | %s |\n", f.Name, f.DefValue, f.Usage)
+			}
+		}
+	}
+	return buf.Bytes()
+}
@@ -0,0 +1,146 @@
+// Copyright 2014 Jonas mg
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/tredoe/flagplus"
+)
+
+var cmdGraph = &flagplus.Subcommand{
+	UsageLine: "graph [-o dot|svg] [-color] [-readonly]",
+	Short:     "draw the hierarchy of issuance",
+	Long: `
+"graph" draws the hierarchy of issuance of the certificates directory, like in
+"ls -tree": the root CAs, the intermediate CAs and the certificates signed by
+them, for the documentation and the reviews of the architecture.
+
+It is printed in the language DOT of Graphviz, or in SVG with "-o svg", which
+requires the program "dot" of Graphviz. The CAs are drawn like boxes, and the
+rest of certificates like ellipses.
+
+With the flag "-color", the certificates are colored according to their status:
+green whether they are valid, orange whether they are into their renewal window
+(the field "renewal_days" of "store.json"), red whether they are expired, and
+gray whether they are revoked.
+`,
+	Run: runGraph,
+}
+
+// Formats of the graph.
+const (
+	GRAPH_DOT = "dot"
+	GRAPH_SVG = "svg"
+)
+
+// Colors of the status of the certificates in the graph.
+const (
+	_COLOR_VALID   = "palegreen"
+	_COLOR_RENEWAL = "orange"
+	_COLOR_EXPIRED = "tomato"
+	_COLOR_REVOKED = "gray"
+)
+
+var (
+	Format  = flag.String("o", "", "output format")
+	IsColor = flag.Bool("color", false, "color according to the status")
+)
+
+func init() {
+	addFlags(cmdGraph, "o", "color", "readonly")
+}
+
+func runGraph(cmd *flagplus.Subcommand, args []string) {
+	if len(args) != 0 {
+		log.Print("Too many arguments")
+		cmd.Usage()
+	}
+	if *Format == "" {
+		*Format = GRAPH_DOT
+	}
+	if *Format != GRAPH_DOT && *Format != GRAPH_SVG {
+		log.Fatalf("Invalid value %q for flag -o: it has to be %q or %q", *Format, GRAPH_DOT, GRAPH_SVG)
+	}
+
+	dot := graphDOT(loadCerts(), time.Now())
+	if *Format == GRAPH_DOT {
+		os.Stdout.Write(dot)
+		return
+	}
+	os.Stdout.Write(execCmd(bytes.NewReader(dot), lookTool("dot"), "-Tsvg"))
+}
+
+// graphDOT returns the hierarchy of issuance of the certificates in the
+// language DOT, with the status at the time `now` whether the flag "-color" is
+// set.
+func graphDOT(certs []*storeCert, now time.Time) []byte {
+	sort.Slice(certs, func(i, j int) bool { return certs[i].Name < certs[j].Name })
+
+	var entries []*indexEntry
+	renewal := 0
+	if *IsColor {
+		var err error
+		if entries, err = readIndex(); err != nil && !os.IsNotExist(err) {
+			log.Fatal(err)
+		}
+		renewal = loadStoreConfig().RenewalDays
+	}
+
+	var buf bytes.Buffer
+	buf.WriteString("digraph pki {\n\trankdir=TB;\n\tnode [fontname=\"Helvetica\", fontsize=10];\n\n")
+
+	for _, v := range certs {
+		shape := "ellipse"
+		if v.Cert.IsCA {
+			shape = "box"
+		}
+		label := fmt.Sprintf("%s\n%s\nexpires %s", v.Name, v.Cert.Subject.CommonName,
+			v.Cert.NotAfter.Format("2006-01-02"))
+
+		fmt.Fprintf(&buf, "\t%s [label=%s, shape=%s", dotQuote(v.Name), dotQuote(label), shape)
+		if *IsColor {
+			fmt.Fprintf(&buf, ", style=filled, fillcolor=%s", graphColor(v, entries, renewal, now))
+		}
+		buf.WriteString("];\n")
+	}
+	buf.WriteString("\n")
+
+	for _, v := range certs {
+		if parent := issuerOf(v.Cert, certs); parent != nil {
+			fmt.Fprintf(&buf, "\t%s -> %s;\n", dotQuote(parent.Name), dotQuote(v.Name))
+		}
+	}
+	buf.WriteString("}\n")
+	return buf.Bytes()
+}
+
+// graphColor returns the color of the status of the certificate.
+func graphColor(c *storeCert, entries []*indexEntry, renewal int, now time.Time) string {
+	if e := findIndex(entries, c.Cert.SerialNumber); e != nil && e.Status == INDEX_REVOKED {
+		return _COLOR_REVOKED
+	}
+	switch {
+	case !c.Cert.NotAfter.After(now):
+		return _COLOR_EXPIRED
+	case !c.Cert.NotAfter.After(now.AddDate(0, 0, renewal)):
+		return _COLOR_RENEWAL
+	}
+	return _COLOR_VALID
+}
+
+// dotQuote returns the string quoted like an identifier of DOT.
+func dotQuote(s string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(s) + `"`
+}
@@ -0,0 +1,155 @@
+// Copyright 2014 Jonas mg
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"bytes"
+	"encoding/pem"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/tredoe/flagplus"
+)
+
+var cmdImport = &flagplus.Subcommand{
+	UsageLine: "import FILE NAME | import -dedup",
+	Short:     "import certificates",
+	Long: `
+"import" copies the certificates stored into FILE to the certificates directory,
+using NAME as name for the new file.
+The file can be a certificate in PEM format or a container like PKCS#7 (.p7b),
+PKCS#12 (.p12, .pfx) or Java KeyStore (.jks); a password is asked for the
+containers which are protected.
+
+Whether the file has a chain, only the first certificate is copied to "NAME.crt";
+the issuers are stored once into the directory "chains", named by their SHA-256
+fingerprint, and the chains are assembled when they are exported or published.
+The flag "-dedup" does the same with the certificates already imported.
+`,
+	Run: runImport,
+}
+
+func init() {
+	addFlags(cmdImport, "dedup")
+}
+
+func runImport(cmd *flagplus.Subcommand, args []string) {
+	if *IsDedup {
+		mustWritable()
+		DedupChains()
+		return
+	}
+	if len(args) != 2 {
+		log.Print("Missing required arguments: FILE NAME")
+		cmd.Usage()
+	}
+	setCertPath(args[1])
+	mustWritable()
+
+	if _, err := os.Stat(File.Cert); !os.IsNotExist(err) {
+		log.Fatalf("Certificate already exists: %q", File.Cert)
+	}
+
+	certs := extractCerts(args[0])
+	if certs == nil {
+		data, err := os.ReadFile(args[0])
+		if err != nil {
+			log.Fatal(err)
+		}
+		certs = pemCerts(data)
+	}
+	if len(certs) == 0 {
+		log.Fatalf("No certificate found in %q", args[0])
+	}
+
+	fmt.Print("\n== Imported\n")
+	leaf, err := splitChain(splitCerts(certs))
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err = writeFileAtomic(File.Cert, leaf, 0644); err != nil {
+		log.Fatal(err)
+	}
+	fmt.Printf("- Certificate:\t%q\n", File.Cert)
+}
+
+// isContainer reports whether the file is a container of certificates.
+func isContainer(file string) bool {
+	switch strings.ToLower(filepath.Ext(file)) {
+	case EXT_PKCS7, ".p7c", EXT_PKCS12, ".pfx", EXT_JKS, ".keystore":
+		return true
+	}
+	return false
+}
+
+// extractCerts returns in PEM format the certificates stored into a container
+// (PKCS#7, PKCS#12 or JKS), or nil if the file is not a container.
+func extractCerts(file string) []byte {
+	var out []byte
+
+	switch strings.ToLower(filepath.Ext(file)) {
+	case EXT_PKCS7, ".p7c":
+		args := []string{"pkcs7", "-print_certs", "-in", file}
+
+		data, err := os.ReadFile(file)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if !bytes.Contains(data, []byte("-----BEGIN")) {
+			args = append(args, "-inform", "DER")
+		}
+		out = openssl(args...)
+
+	case EXT_PKCS12, ".pfx":
+		out = openssl("pkcs12", "-nokeys", "-in", file)
+
+	case EXT_JKS, ".keystore":
+		out = keytool("-list", "-rfc", "-keystore", file)
+
+	default:
+		return nil
+	}
+
+	return pemCerts(out)
+}
+
+// pemCerts returns the PEM blocks of certificates found in data, discarding
+// any other content.
+func pemCerts(data []byte) []byte {
+	return bytes.Join(splitCerts(data), nil)
+}
+
+// splitCerts returns every certificate, in PEM format, found in data.
+func splitCerts(data []byte) [][]byte {
+	var certs [][]byte
+
+	for {
+		var block *pem.Block
+
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+		if block.Type == "CERTIFICATE" {
+			certs = append(certs, pem.EncodeToMemory(block))
+		}
+	}
+	return certs
+}
+
+// keytool executes a command of the Java's key and certificate management tool.
+func keytool(args ...string) []byte {
+	cmdPath, err := exec.LookPath("keytool")
+	if err != nil {
+		log.Fatal("Java keytool is not installed; it is required for JKS files")
+	}
+	return execCmd(os.Stdin, cmdPath, args...)
+}
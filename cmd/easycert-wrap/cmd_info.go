@@ -7,22 +7,46 @@
 package main
 
 import (
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
 	"flag"
 	"fmt"
 	"log"
+	"os"
+	"path/filepath"
+	"strings"
 
+	"github.com/tredoe/easycert/store"
 	"github.com/tredoe/flagplus"
 )
 
 var cmdInfo = &flagplus.Subcommand{
-	UsageLine: "info [-end-date] [-hash] [-issuer] [-name] FILE",
+	UsageLine: "info [-req] [-end-date] [-hash] [-issuer] [-name] [-spki] [-json] [-backend name] [-readonly] FILE",
 	Short:     "information",
 	Long: `
-"info" prints out information of a certificate.
+"info" prints out information of a certificate, or of a certificate request
+whether it is used the flag "-req"; then it prints the subject, the attributes
+(challenge password, unstructured name) and the requested extensions.
 To look for the file, it uses the certificates directory when the "file" is just
 a name or the path when the "file" is an absolute or relatative path.
+The file can be a container (PKCS#7, PKCS#12 or JKS), then the information is
+printed for every certificate inside it.
+
+The flag "-spki" prints the pin of the public key of the certificate, or of the
+request with "-req", to identify it by its key (see "req -spki").
 
 Whether a flag is not set, then it prints full information.
+
+The flag "-json" prints all the information in JSON format instead, to be used
+from scripts: the subject, the issuer, the serial number, the subject
+alternative names, the validity and the fingerprints of the certificate (an
+array for the containers), or the subject, the alternative names and the pin of
+the key of the request.
+
+With "-backend native", the information is got in Go instead of executing
+OpenSSL (see "ca"), in the same format; the containers are not supported, and
+only the subject and the hostnames of the requests are printed.
 `,
 	Run: runInfo,
 }
@@ -35,7 +59,7 @@ var (
 )
 
 func init() {
-	cmdInfo.AddFlags("end-date", "hash", "issuer", "name")
+	addFlags(cmdInfo, "req", "end-date", "hash", "issuer", "name", "spki", "json", "backend", "readonly")
 }
 
 func runInfo(cmd *flagplus.Subcommand, args []string) {
@@ -44,8 +68,41 @@ func runInfo(cmd *flagplus.Subcommand, args []string) {
 		cmd.Usage()
 	}
 
+	if *IsSPKI {
+		*IsCert = !*IsRequest
+		file := getAbsPaths(false, args)
+		pin, err := filePin(file[0], *IsRequest)
+		if err != nil {
+			log.Fatal(err)
+		}
+		fmt.Println(pin)
+		return
+	}
+	if *IsRequest {
+		file := getAbsPaths(false, args)
+		if *IsJSON {
+			printJSON(infoRequestJSON(file[0]))
+			return
+		}
+		fmt.Print(InfoRequestAttrs(file[0]))
+		return
+	}
+
 	*IsCert = true
 	file := getAbsPaths(false, args)
+
+	if *IsJSON {
+		printJSON(infoJSON(file[0]))
+		return
+	}
+
+	if isContainer(file[0]) {
+		if nativeBackend() {
+			log.Fatal("The native backend does not support the containers")
+		}
+		infoContainer(file[0])
+		return
+	}
 	run := false
 
 	if *IsEndDate {
@@ -69,32 +126,199 @@ func runInfo(cmd *flagplus.Subcommand, args []string) {
 	}
 }
 
+// infoContainer prints the information of every certificate stored into a
+// container.
+func infoContainer(file string) {
+	args := []string{"x509", "-noout"}
+
+	if *IsEndDate {
+		args = append(args, "-enddate")
+	}
+	if *IsHash {
+		args = append(args, "-hash")
+	}
+	if *IsIssuer {
+		args = append(args, "-issuer")
+	}
+	if *IsName {
+		args = append(args, "-subject")
+	}
+	if len(args) == 2 {
+		args = append(args, "-subject", "-issuer", "-enddate")
+	}
+
+	for i, cert := range splitCerts(extractCerts(file)) {
+		if i != 0 {
+			fmt.Println()
+		}
+		fmt.Printf("%s", opensslInput(cert, args...))
+	}
+}
+
 // InfoFull prints all information of a certificate.
 func InfoFull(file string) string {
+	if nativeBackend() {
+		return mustNativeInfo(file, _INFO_SUBJECT, _INFO_ISSUER, _INFO_END_DATE)
+	}
 	args := []string{"x509", "-subject", "-issuer", "-enddate", "-noout", "-in", file}
 	return string(openssl(args...))
 }
 
 // InfoEndDate prints the last date that it is valid.
 func InfoEndDate(file string) string {
+	if nativeBackend() {
+		return mustNativeInfo(file, _INFO_END_DATE)
+	}
 	args := []string{"x509", "-enddate", "-noout", "-in", file}
 	return string(openssl(args...))
 }
 
 // InfoHash prints the hash value.
 func InfoHash(file string) string {
+	if nativeBackend() {
+		return mustNativeInfo(file, _INFO_HASH)
+	}
 	args := []string{"x509", "-hash", "-noout", "-in", file}
 	return string(openssl(args...))
 }
 
 // InfoIssuer prints the issuer.
 func InfoIssuer(file string) string {
+	if nativeBackend() {
+		return mustNativeInfo(file, _INFO_ISSUER)
+	}
 	args := []string{"x509", "-issuer", "-noout", "-in", file}
 	return string(openssl(args...))
 }
 
 // InfoName prints the subject.
 func InfoName(file string) string {
+	if nativeBackend() {
+		return mustNativeInfo(file, _INFO_SUBJECT)
+	}
 	args := []string{"x509", "-subject", "-noout", "-in", file}
 	return string(openssl(args...))
 }
+
+// InfoRequestAttrs prints the subject, attributes and requested extensions of
+// a certificate request.
+func InfoRequestAttrs(file string) string {
+	if nativeBackend() {
+		s, err := nativeInfoRequest(file)
+		if err != nil {
+			log.Fatal(err)
+		}
+		return s
+	}
+	args := []string{"req", "-text", "-noout",
+		"-reqopt", "no_header,no_version,no_pubkey,no_sigdump",
+		"-in", file,
+	}
+	return string(openssl(args...))
+}
+
+// mustNativeInfo returns the fields of the certificate got by the native
+// backend, exiting on error.
+func mustNativeInfo(file string, fields ...int) string {
+	s, err := nativeInfo(file, fields...)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return s
+}
+
+// filePin returns the SPKI pin of the public key of the certificate, or of the
+// certificate request whether `isRequest` is set.
+func filePin(file string, isRequest bool) (string, error) {
+	if !isRequest {
+		cert, err := parseCertFile(file)
+		if err != nil {
+			return "", err
+		}
+		return store.SPKIPin(cert.RawSubjectPublicKeyInfo), nil
+	}
+
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return "", err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return "", fmt.Errorf("no certificate request in PEM format: %q", file)
+	}
+	req, err := x509.ParseCertificateRequest(block.Bytes)
+	if err != nil {
+		return "", err
+	}
+	return store.SPKIPin(req.RawSubjectPublicKeyInfo), nil
+}
+
+// RequestInfo represents the information of a certificate request.
+type RequestInfo struct {
+	Name    string `json:"name"`
+	Subject string `json:"subject"`
+
+	DNSNames    []string `json:"dns_names,omitempty"`
+	IPAddresses []string `json:"ip_addresses,omitempty"`
+	Emails      []string `json:"emails,omitempty"`
+
+	Pin string `json:"pin_sha256"` // Of the public key (SPKI).
+}
+
+// infoJSON returns the information of the certificate, or of every certificate
+// into a container.
+func infoJSON(file string) interface{} {
+	name := strings.TrimSuffix(filepath.Base(file), filepath.Ext(file))
+
+	if isContainer(file) {
+		list := []*CertInfo{}
+		for _, v := range splitCerts(extractCerts(file)) {
+			block, _ := pem.Decode(v)
+			cert, err := x509.ParseCertificate(block.Bytes)
+			if err != nil {
+				log.Fatalf("%s: %s", file, err)
+			}
+			list = append(list, newCertInfo(name, cert))
+		}
+		return list
+	}
+
+	cert, err := parseCertFile(file)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return newCertInfo(name, cert)
+}
+
+// infoRequestJSON returns the information of the certificate request.
+func infoRequestJSON(file string) *RequestInfo {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		log.Fatal(err)
+	}
+	req, err := parseRequestPEM(data)
+	if err != nil {
+		log.Fatalf("%s: %s", file, err)
+	}
+
+	info := &RequestInfo{
+		Name:     strings.TrimSuffix(filepath.Base(file), filepath.Ext(file)),
+		Subject:  req.Subject.String(),
+		DNSNames: req.DNSNames,
+		Emails:   req.EmailAddresses,
+		Pin:      store.SPKIPin(req.RawSubjectPublicKeyInfo),
+	}
+	for _, ip := range req.IPAddresses {
+		info.IPAddresses = append(info.IPAddresses, ip.String())
+	}
+	return info
+}
+
+// printJSON prints the value in JSON format, indented.
+func printJSON(v interface{}) {
+	data, err := json.MarshalIndent(v, "", "\t")
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Printf("%s\n", data)
+}
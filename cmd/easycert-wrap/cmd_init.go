@@ -22,15 +22,72 @@ var cmdInit = &flagplus.Subcommand{
 	Short:     "initialize the directory",
 	Long: `
 "init" makes the directory structure in the HOME directory where
-the certificates are handled.
+the certificates are handled. Another directory can be set in the environment
+variable EASYCERT_ROOT, even in a server like "ssh://user@host/path"; then the
+commands are run in the server through SSH.
+
+Whether the environment variable EASYCERT_REMOTE has the URL of a portal (see
+"serve"), the commands "req", "sign", "ls", "info" and "revoke" are run through
+its API, so the host of the CA is not accessed: the private keys and the
+requests are generated in the local directory, the requests are signed in the
+portal, and the certificates are downloaded. The token of the administrators,
+to sign and revoke, is got from EASYCERT_REMOTE_TOKEN, and the operator is
+authenticated with the certificate named in EASYCERT_REMOTE_CERT, of the local
+directory.
+
+The configuration of OpenSSL created ("openssl.cfg") can reference variables of
+environment, like "${ENV:ORG_NAME}", and files, like "${FILE:/run/secrets/ou}",
+which are resolved at issuance.
+
+The default values of the subject in that configuration are got from the table
+"subject" of the file of defaults of the user ("~/.config/easycert/config.toml"),
+which has also the certificates directory, in "root", and the default values of
+the flags of every command, in the table "flags":
+
+	root = "~/pki"
+
+	[flags]
+	years = 2
+	rsa-size = 4096
+
+	[subject]
+	country = "ES"
+	organization = "Example Ltd"
+
+The flags can be set too in variables of environment, like in containers: the
+name in capital letters, with underscores instead of dashes, and the prefix
+"EASYCERT_FLAG_" (i.e. "EASYCERT_FLAG_RSA_SIZE=4096" for "-rsa-size 4096").
+The flags given in the command line take precedence over the variables of
+environment, and these over the file of defaults.
+
+The database of the root CA is kept in the file "index.db" of bbolt, by default.
+The files of OpenSSL ("index.txt", "serial" and "crlnumber") are written from it
+before of being used, and they are stored into it after every change, so a store
+without "index.db" is migrated at its first change. The database can be set in
+the field "database" of "store.json": the driver "bolt" with the file as data
+source name, "file" to keep only the files of OpenSSL, or an external database
+for high availability or external backups, with the driver "sqlite" or
+"postgres" and the data source name of the driver; the program has to be built
+with the tag of the driver ("sqlite" or "postgres"):
+
+	{
+		"database": {
+			"driver": "postgres",
+			"dsn": "postgres://easycert@db.example.com/easycert"
+		}
+	}
+
+The entries are in the table "easycert_index", and the next serial number and
+number of the revocation list in the table "easycert_state".
 `,
 	Run: runInit,
 }
 
 func runInit(cmd *flagplus.Subcommand, args []string) {
 	var err error
+	mustWritable()
 
-	for _, v := range []string{Dir.Root, Dir.Cert, Dir.Key} {
+	for _, v := range []string{Dir.Root, Dir.Cert, Dir.Key, Dir.Hook} {
 		if err = os.Mkdir(v, 0755); err != nil {
 			log.Fatal(err)
 		}
@@ -62,13 +119,17 @@ func runInit(cmd *flagplus.Subcommand, args []string) {
 	}
 
 	data := struct {
-		RootDir        string
-		HostName       string
-		SubjectAltName string
+		RootDir           string
+		HostName          string
+		SubjectAltName    string
+		ChallengePassword string
+		Subject           SubjectDefaults
 	}{
 		Dir.Root,
 		"",
 		"",
+		"",
+		Subject,
 	}
 	err = tmpl.Execute(configFile, data)
 	configFile.Close()
@@ -85,6 +146,7 @@ func runInit(cmd *flagplus.Subcommand, args []string) {
 	tmpl, _ = template.ParseFiles(configTemplate)
 	data.HostName = "{{.HostName}}"
 	data.SubjectAltName = "{{.SubjectAltName}}"
+	data.ChallengePassword = "{{.ChallengePassword}}"
 
 	err = tmpl.Execute(configFile, data)
 	configFile.Close()
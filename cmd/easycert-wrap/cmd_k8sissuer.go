@@ -0,0 +1,393 @@
+// Copyright 2014 Jonas mg
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/tredoe/flagplus"
+)
+
+var cmdK8sIssuer = &flagplus.Subcommand{
+	UsageLine: "k8s-issuer [-group name] [-interval duration] [-once] [-dry-run]",
+	Short:     "sign the certificate requests of cert-manager in Kubernetes",
+	Long: `
+"k8s-issuer" is an external issuer of cert-manager: it signs with the CA the
+CertificateRequests of the cluster whose issuer is in the API group of "-group"
+(by default "easycert.tredoe.github.io"), once they are approved, and sets the
+certificate and the CA in their status. The kind of the issuer ("Issuer" or
+"ClusterIssuer") is not checked, so any name can be used in "issuerRef":
+
+	issuerRef:
+	  group: easycert.tredoe.github.io
+	  kind: ClusterIssuer
+	  name: team-ca
+
+The requests are signed like the ones approved from the queue, with the name
+"k8s-NAMESPACE.NAME", running the hooks and recording them in the audit log;
+the requests denied in cert-manager are marked like failed.
+
+It runs in the cluster with the token of its service account, which has to be
+allowed to list the resources "certificaterequests" of "cert-manager.io" and to
+update "certificaterequests/status". Out of the cluster, the URL of the API
+server and the token are got from EASYCERT_K8S_API and EASYCERT_K8S_TOKEN.
+
+The requests are looked for every "-interval" (30s by default), or once with
+"-once"; the flag "-dry-run" prints the requests to sign without signing them.
+`,
+	Run: runK8sIssuer,
+}
+
+var (
+	K8sGroup = flag.String("group", DEFAULT_K8S_GROUP, "API group of the issuer in cert-manager")
+	Interval = flag.Duration("interval", 30*time.Second, "time between the checks")
+	IsOnce   = flag.Bool("once", false, "check once and exit")
+)
+
+func init() {
+	addFlags(cmdK8sIssuer, "group", "interval", "once", "dry-run")
+}
+
+// DEFAULT_K8S_GROUP is the API group of the issuer in cert-manager.
+const DEFAULT_K8S_GROUP = "easycert.tredoe.github.io"
+
+// Environment variables to access the API server out of the cluster.
+const (
+	ENV_K8S_API   = "EASYCERT_K8S_API"
+	ENV_K8S_TOKEN = "EASYCERT_K8S_TOKEN"
+)
+
+// _K8S_ACCOUNT is the directory of the service account into the pods.
+const _K8S_ACCOUNT = "/var/run/secrets/kubernetes.io/serviceaccount"
+
+// _K8S_REQUESTS is the path of the CertificateRequests of cert-manager.
+const _K8S_REQUESTS = "/apis/cert-manager.io/v1"
+
+// Reasons of the condition "Ready" of the CertificateRequests.
+const (
+	K8S_ISSUED  = "Issued"
+	K8S_PENDING = "Pending"
+	K8S_FAILED  = "Failed"
+	K8S_DENIED  = "Denied"
+)
+
+// k8sCondition is a condition of the status of a CertificateRequest.
+type k8sCondition struct {
+	Type               string `json:"type"`
+	Status             string `json:"status"`
+	Reason             string `json:"reason,omitempty"`
+	Message            string `json:"message,omitempty"`
+	LastTransitionTime string `json:"lastTransitionTime,omitempty"`
+}
+
+// k8sRequest is a CertificateRequest of cert-manager, with the fields used.
+type k8sRequest struct {
+	Metadata struct {
+		Name      string `json:"name"`
+		Namespace string `json:"namespace"`
+	} `json:"metadata"`
+	Spec struct {
+		Request   []byte `json:"request"` // CSR in PEM format.
+		IssuerRef struct {
+			Name  string `json:"name"`
+			Kind  string `json:"kind"`
+			Group string `json:"group"`
+		} `json:"issuerRef"`
+	} `json:"spec"`
+	Status struct {
+		Conditions []k8sCondition `json:"conditions,omitempty"`
+	} `json:"status"`
+}
+
+// condition returns the condition of the type, or nil.
+func (r *k8sRequest) condition(typ string) *k8sCondition {
+	for i, v := range r.Status.Conditions {
+		if v.Type == typ {
+			return &r.Status.Conditions[i]
+		}
+	}
+	return nil
+}
+
+// certName returns the name of the certificate in the certificates directory.
+// The namespace is separated by a dot, which it cannot have, so the names of
+// the requests of different namespaces do not collide.
+func (r *k8sRequest) certName() string {
+	return "k8s-" + r.Metadata.Namespace + "." + r.Metadata.Name
+}
+
+// k8sClient is the client of the API server of Kubernetes.
+type k8sClient struct {
+	base   string
+	token  string
+	client *http.Client
+}
+
+// newK8sClient returns the client with the service account of the pod, or
+// with the API server and the token of the environment.
+func newK8sClient() (*k8sClient, error) {
+	c := &k8sClient{
+		base:   os.Getenv(ENV_K8S_API),
+		token:  os.Getenv(ENV_K8S_TOKEN),
+		client: &http.Client{Timeout: 30 * time.Second},
+	}
+	if c.base != "" {
+		if c.token == "" {
+			return nil, fmt.Errorf("the token of the API server has to be set in %s", ENV_K8S_TOKEN)
+		}
+		return c, nil
+	}
+
+	host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+	if host == "" || port == "" {
+		return nil, fmt.Errorf("not running in Kubernetes: set the API server in %s", ENV_K8S_API)
+	}
+	token, err := os.ReadFile(_K8S_ACCOUNT + "/token")
+	if err != nil {
+		return nil, err
+	}
+	caPEM, err := os.ReadFile(_K8S_ACCOUNT + "/ca.crt")
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(caPEM) {
+		return nil, fmt.Errorf("no certificate in %s/ca.crt", _K8S_ACCOUNT)
+	}
+
+	c.base = "https://" + net.JoinHostPort(host, port)
+	c.token = string(bytes.TrimSpace(token))
+	c.client.Transport = &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}}
+	return c, nil
+}
+
+// do sends the request with the value `in` in JSON format, and decodes the
+// response into `out` whether it is not nil.
+func (c *k8sClient) do(method, path, contentType string, in, out interface{}) error {
+	var body io.Reader
+	if in != nil {
+		data, err := json.Marshal(in)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(data)
+	}
+
+	req, err := http.NewRequest(method, c.base+path, body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", MIME_JSON)
+	if in != nil {
+		req.Header.Set("Content-Type", contentType)
+	}
+	req.Header.Set("Authorization", "Bearer "+c.token)
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("%s %s: %s: %s", method, path, resp.Status, bytes.TrimSpace(msg))
+	}
+	if out != nil {
+		return json.NewDecoder(resp.Body).Decode(out)
+	}
+	return nil
+}
+
+// list returns the CertificateRequests of all the namespaces.
+func (c *k8sClient) list() ([]*k8sRequest, error) {
+	var list struct {
+		Items []*k8sRequest `json:"items"`
+	}
+	if err := c.do("GET", _K8S_REQUESTS+"/certificaterequests", "", nil, &list); err != nil {
+		return nil, err
+	}
+	return list.Items, nil
+}
+
+// setStatus sets the condition "Ready" of the request, keeping the other
+// conditions, and the certificate and the CA whether they are not nil.
+func (c *k8sClient) setStatus(r *k8sRequest, ready bool, reason, msg string, cert, ca []byte) error {
+	now := time.Now().UTC().Format(time.RFC3339)
+	cond := k8sCondition{
+		Type: "Ready", Status: "False", Reason: reason, Message: msg, LastTransitionTime: now,
+	}
+	if ready {
+		cond.Status = "True"
+	}
+
+	conditions := []k8sCondition{cond}
+	for _, v := range r.Status.Conditions {
+		if v.Type != "Ready" {
+			conditions = append(conditions, v)
+		}
+	}
+	status := map[string]interface{}{"conditions": conditions}
+	if cert != nil {
+		status["certificate"] = cert
+		status["ca"] = ca
+	}
+	if reason == K8S_FAILED || reason == K8S_DENIED {
+		status["failureTime"] = now
+	}
+
+	return c.do("PATCH", fmt.Sprintf("%s/namespaces/%s/certificaterequests/%s/status",
+		_K8S_REQUESTS, r.Metadata.Namespace, r.Metadata.Name),
+		"application/merge-patch+json", map[string]interface{}{"status": status}, nil)
+}
+
+func runK8sIssuer(cmd *flagplus.Subcommand, args []string) {
+	if len(args) != 0 {
+		log.Print("Too many arguments")
+		cmd.Usage()
+	}
+	if *Interval <= 0 {
+		log.Fatal("Flag -interval has to be positive")
+	}
+	operator := currentOperator()
+	if !*IsDryRun {
+		operator = mustRole(ACTION_SIGN)
+	}
+
+	c, err := newK8sClient()
+	if err != nil {
+		log.Fatal(err)
+	}
+	for {
+		if err = syncK8sRequests(c, operator); err != nil {
+			if *IsOnce {
+				log.Fatal(err)
+			}
+			log.Print(err)
+		}
+		if *IsOnce {
+			return
+		}
+		time.Sleep(*Interval)
+	}
+}
+
+// syncK8sRequests signs the CertificateRequests approved for the issuer, and
+// marks like failed the denied ones.
+func syncK8sRequests(c *k8sClient, operator string) error {
+	list, err := c.list()
+	if err != nil {
+		return err
+	}
+
+	for _, r := range list {
+		if r.Spec.IssuerRef.Group != *K8sGroup {
+			continue
+		}
+		if ready := r.condition("Ready"); ready != nil &&
+			(ready.Status == "True" || ready.Reason == K8S_FAILED || ready.Reason == K8S_DENIED) {
+			continue // done
+		}
+		where := r.Metadata.Namespace + "/" + r.Metadata.Name
+
+		if denied := r.condition("Denied"); denied != nil && denied.Status == "True" {
+			fmt.Printf("* Request denied: %s\n", where)
+			if !*IsDryRun {
+				if err = c.setStatus(r, false, K8S_DENIED, "The request was denied", nil, nil); err != nil {
+					return err
+				}
+			}
+			continue
+		}
+		if approved := r.condition("Approved"); approved == nil || approved.Status != "True" {
+			continue // waiting for the approval
+		}
+
+		if *IsDryRun {
+			fmt.Printf("* Request to sign: %s, like %q\n", where, r.certName())
+			continue
+		}
+		cert, err := signK8sRequest(r, operator)
+		if err != nil {
+			reason := K8S_PENDING // retried in the next check
+			if errors.Is(err, errQueueName) || errors.Is(err, errQueueCSR) {
+				reason = K8S_FAILED
+			}
+			log.Printf("%s: %s", where, err)
+			if ready := r.condition("Ready"); ready != nil && ready.Reason == reason && ready.Message == err.Error() {
+				continue // the same failure
+			}
+			if err = c.setStatus(r, false, reason, err.Error(), nil, nil); err != nil {
+				return err
+			}
+			continue
+		}
+
+		caPEM, err := os.ReadFile(filepath.Join(Dir.Cert, NAME_CA+EXT_CERT))
+		if err != nil {
+			return err
+		}
+		if err = c.setStatus(r, true, K8S_ISSUED, "Certificate issued by easycert", cert, caPEM); err != nil {
+			return err
+		}
+		fmt.Printf("* Request signed: %s, like %q\n", where, r.certName())
+	}
+	return nil
+}
+
+// signK8sRequest signs the request like one approved from the queue, and
+// returns the certificate in PEM format. The certificate already signed for the
+// request, with the same key, is returned whether the status could not be set
+// before.
+func signK8sRequest(r *k8sRequest, operator string) ([]byte, error) {
+	name := r.certName()
+	_, csr, err := parseQueueCSR(name, r.Spec.Request)
+	if err != nil {
+		return nil, err
+	}
+
+	file := filepath.Join(Dir.Cert, name+EXT_CERT)
+	if cert, err := parseCertFile(file); err == nil {
+		pub, ok := cert.PublicKey.(interface{ Equal(crypto.PublicKey) bool })
+		if !ok || !pub.Equal(csr.PublicKey) {
+			return nil, fmt.Errorf("certificate already exists with other key: %q", file)
+		}
+	} else {
+		q, err := addQueue(name, r.Spec.Request, nil, "k8s", operator)
+		if err != nil {
+			return nil, err
+		}
+		if err = q.approve(operator); err != nil {
+			// Out of the queue, since the request is submitted again.
+			if err2 := q.setStatus(STATUS_DENIED); err2 != nil {
+				log.Print(err2)
+			}
+			return nil, err
+		}
+	}
+
+	cert, err := parseCertFile(file)
+	if err != nil {
+		return nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw}), nil
+}
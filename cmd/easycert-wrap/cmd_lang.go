@@ -7,8 +7,11 @@
 package main
 
 import (
+	"bytes"
+	"encoding/pem"
 	"flag"
 	"fmt"
+	"go/token"
 	"log"
 	"os"
 	"os/exec"
@@ -23,12 +26,42 @@ import (
 )
 
 var cmdLang = &flagplus.Subcommand{
-	UsageLine: "lang [-ca file] [-server name] [-client] [-go]",
+	UsageLine: "lang [-ca file] [-server name] [-client] [-package name] [-var-prefix prefix] [-out dir] [-go | -c | -esp32]",
 	Short:     "generate files into a language to handle the certificate",
 	Long: `
 "lang" generate files into a language to handle the certificate.
 To look for the file, it uses the certificates directory when the "file" is just
 a name or the path when the "file" is an absolute or relatative path.
+
+The client verifies the certificate of the server against the CA, and against
+its OCSP responder whether the certificate has one, through the function
+VerifyPeer of the package "github.com/tredoe/easycert/store".
+
+Every file has a test which checks that the certificate is valid for the CA,
+and the first file has a directive "go:generate" to create them again through
+"go generate", since the files generated can be overwritten. The files belong to
+the package "main" unless it is used the flag "-package", and they are written
+to the current directory unless it is used "-out".
+
+The names of the variables, "ServerTLSConfig" and "ClientTLSConfig", and of the
+tests start with the prefix given in "-var-prefix", to follow the conventions of
+the project.
+
+With "-c", it generates instead the files "easycert_certs.h" and "easycert_certs.c"
+for the TLS stacks of embedded systems, like mbedTLS or wolfSSL, which have the
+CA certificate, and the certificate and key of the server whether it is used
+"-server", like constant arrays in PEM format ended in a null character, and
+macros with their lengths (i.e. "CA_CERT_LEN"), which include the null character
+like the functions to parse them require (i.e. "mbedtls_x509_crt_parse").
+The prefix of "-var-prefix" is also used in the names of arrays and macros.
+
+With "-esp32", it generates instead the file "easycert_esp32.h" for Arduino and
+ESP32, with the same content like strings in PEM format, to use in the sketches
+(i.e. "client.setCACert(ca_cert)" of WiFiClientSecure) or with mbedTLS, plus the
+files in binary format (DER) "ca_cert.der", "server_cert.der" and
+"server_key.der", to embed them through "EMBED_FILES" of ESP-IDF or to write
+them into a data partition, which are parsed by "mbedtls_x509_crt_parse_der" and
+"mbedtls_pk_parse_key". The private key can not be encrypted.
 `,
 	Run: runLang,
 }
@@ -39,46 +72,147 @@ var (
 
 	IsClient = flag.Bool("client", false, "create generic file for the client")
 	IsGo     = flag.Bool("go", true, "create files for Go language")
+	IsC      = flag.Bool("c", false, "create files for C language, instead of Go")
+	IsESP32  = flag.Bool("esp32", false, "create files for Arduino and ESP32, instead of Go")
+	Package  = flag.String("package", "main", "name of the package of the Go files")
+
+	VarPrefix = flag.String("var-prefix", "", "prefix of the names of the variables")
 )
 
 func init() {
-	cmdLang.AddFlags("ca", "server", "client", "go")
+	addFlags(cmdLang, "ca", "server", "client", "package", "var-prefix", "out", "go", "c", "esp32")
 }
 
+// HEADER_GENERATED is the first line of the files generated by "lang".
+const HEADER_GENERATED = "// MACHINE GENERATED BY easycert (github.com/tredoe/easycert)"
+
 func runLang(cmd *flagplus.Subcommand, args []string) {
 	if *CACert == "" {
 		log.Fatal("Missing required parameter in flag `-ca-cert`")
 	}
+	if !token.IsIdentifier(*Package) {
+		log.Fatalf("Invalid name of package: %q", *Package)
+	}
+	if *VarPrefix != "" && !token.IsIdentifier(*VarPrefix) {
+		log.Fatalf("Invalid prefix of variables: %q", *VarPrefix)
+	}
+	generate := langCommand()
+
 	if (*CACert)[0] != '.' && (*CACert)[0] != os.PathSeparator {
 		*CACert = filepath.Join(Dir.Cert, *CACert+EXT_CERT)
 	}
 
-	serverFile := ""
-	clientFile := ""
-	if *IsGo {
-		serverFile = FILE_SERVER_GO
-		clientFile = FILE_CLIENT_GO
-	} else {
-		log.Print("Missing required flag -- `-go`")
+	var files []string
+	switch {
+	case *IsC:
+		if *ServerCert != "" || *IsClient {
+			files = append(files, FILE_CERT_H, FILE_CERT_C)
+		}
+	case *IsESP32:
+		if *ServerCert != "" || *IsClient {
+			files = append(files, FILE_ESP32_H, *VarPrefix+"ca_cert"+EXT_DER)
+		}
+		if *ServerCert != "" {
+			files = append(files, *VarPrefix+"server_cert"+EXT_DER, *VarPrefix+"server_key"+EXT_DER)
+		}
+	case *IsGo:
+		if *ServerCert != "" {
+			files = append(files, FILE_SERVER_GO, FILE_SERVER_TEST_GO)
+		}
+		if *IsClient {
+			files = append(files, FILE_CLIENT_GO, FILE_CLIENT_TEST_GO)
+		}
+	default:
+		log.Print("Missing required flag -- `-go`, `-c` or `-esp32`")
 		cmd.Usage()
 	}
 
-	if *ServerCert != "" {
-		if _, err := os.Stat(serverFile); !os.IsNotExist(err) {
-			log.Fatalf("File already exists: %q", serverFile)
+	// The files generated before can be overwritten, like from "go generate".
+	// The binary files go with the header of ESP32.
+	for _, v := range files {
+		generated := v
+		if filepath.Ext(v) == EXT_DER {
+			generated = FILE_ESP32_H
+		}
+		v = filepath.Join(langDir(), v)
+		if _, err := os.Stat(v); !os.IsNotExist(err) && !isGenerated(filepath.Join(langDir(), generated)) {
+			log.Fatalf("File already exists: %q", v)
 		}
 	}
+	if err := os.MkdirAll(langDir(), 0755); err != nil {
+		log.Fatal(err)
+	}
+
+	switch {
+	case *IsC:
+		Cert2C()
+	case *IsESP32:
+		Cert2ESP32()
+	default:
+		Cert2Lang(generate)
+	}
+}
+
+// langDir returns the directory where the files are written.
+func langDir() string {
+	if *Out == "" {
+		return "."
+	}
+	return *Out
+}
+
+// langCommand returns the command line of "lang" to generate the files again
+// from the directory where they are written, like "go generate" does.
+func langCommand() string {
+	ca := *CACert
+	if ca[0] == '.' && *Out != "" {
+		absCA, err1 := filepath.Abs(ca)
+		absOut, err2 := filepath.Abs(*Out)
+		if err1 != nil || err2 != nil {
+			log.Fatal("Could not get the absolute paths of -ca and -out")
+		}
+		if rel, err := filepath.Rel(absOut, absCA); err == nil {
+			ca = rel
+		} else {
+			ca = absCA
+		}
+		if ca[0] != '.' && ca[0] != os.PathSeparator {
+			ca = "." + string(os.PathSeparator) + ca
+		}
+	}
+
+	args := []string{PROGRAM, "lang", "-ca", ca}
+	if *ServerCert != "" {
+		args = append(args, "-server", *ServerCert)
+	}
 	if *IsClient {
-		if _, err := os.Stat(clientFile); !os.IsNotExist(err) {
-			log.Fatalf("File already exists: %q", clientFile)
+		args = append(args, "-client")
+	}
+	args = append(args, "-package", *Package)
+	if *VarPrefix != "" {
+		args = append(args, "-var-prefix", *VarPrefix)
+	}
+
+	for i, v := range args {
+		if v == "" || strings.ContainsAny(v, " \t\"") {
+			args[i] = strconv.Quote(v)
 		}
 	}
+	return strings.Join(args, " ")
+}
 
-	Cert2Lang()
+// isGenerated reports whether the file was generated by "lang".
+func isGenerated(file string) bool {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return false
+	}
+	return bytes.HasPrefix(data, []byte(HEADER_GENERATED+"\n"))
 }
 
-// Cert2Lang creates files in Go language to handle the certificate.
-func Cert2Lang() {
+// Cert2Lang creates files in Go language to handle the certificate, with their
+// tests. The first file has the directive to run `generate` from "go generate".
+func Cert2Lang(generate string) {
 	version, err := exec.Command(File.Cmd, "version").Output()
 	if err != nil {
 		log.Fatal(err)
@@ -89,21 +223,36 @@ func Cert2Lang() {
 		log.Fatal(err)
 	}
 
+	testPrefix := *VarPrefix
+	if testPrefix != "" {
+		testPrefix = strings.ToUpper(testPrefix[:1]) + testPrefix[1:]
+	}
+
 	// Common data to pass to templates.
 	data := struct {
+		Header     string
 		System     string
 		Arch       string
 		Version    string
 		Date       string
+		Package    string
+		Prefix     string // Of the variables.
+		TestPrefix string // Of the tests, which has to start with a capital letter.
+		Generate   string
 		ValidUntil string
 		CACert     string
 		Cert       string
 		Key        string
 	}{
+		HEADER_GENERATED,
 		runtime.GOOS,
 		runtime.GOARCH,
 		strings.TrimRight(string(version), "\n"),
 		time.Now().Format(time.RFC822),
+		*Package,
+		*VarPrefix,
+		testPrefix,
+		generate,
 		"",
 		GoBlock(caCertBlock).String(),
 		"",
@@ -126,45 +275,223 @@ func Cert2Lang() {
 		data.ValidUntil = fmt.Sprint(strings.TrimRight(InfoEndDate(certFile), "\n"))
 		data.Cert = GoBlock(certBlock).String()
 		data.Key = GoBlock(keyBlock).String()
+		zero(keyBlock)
+
+		// It has the private key.
+		writeTemplate(FILE_SERVER_GO, TMPL_SERVER_GO, 0600, data)
+
+		writeTemplate(FILE_SERVER_TEST_GO, TMPL_SERVER_TEST_GO, 0666, data)
+		data.Generate = "" // only in the first file
+	}
+
+	if *IsClient {
+		writeTemplate(FILE_CLIENT_GO, TMPL_CLIENT_GO, 0666, data)
+		writeTemplate(FILE_CLIENT_TEST_GO, TMPL_CLIENT_TEST_GO, 0666, data)
+	}
+}
+
+// Cert2C creates files in C language with the certificates, for the TLS stacks
+// of embedded systems.
+func Cert2C() {
+	version, err := exec.Command(File.Cmd, "version").Output()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	caCertBlock, err := os.ReadFile(*CACert)
+	if err != nil {
+		log.Fatal(err)
+	}
 
-		file, err := os.OpenFile(FILE_SERVER_GO, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0666)
+	data := struct {
+		Header     string
+		System     string
+		Arch       string
+		Version    string
+		Date       string
+		Prefix     string // Of the arrays.
+		Macro      string // Prefix of the macros.
+		FileH      string
+		ValidUntil string
+		CACert     string
+		CACertLen  int
+		Cert       string
+		CertLen    int
+		Key        string
+		KeyLen     int
+	}{
+		Header:    HEADER_GENERATED,
+		System:    runtime.GOOS,
+		Arch:      runtime.GOARCH,
+		Version:   strings.TrimRight(string(version), "\n"),
+		Date:      time.Now().Format(time.RFC822),
+		Prefix:    *VarPrefix,
+		Macro:     strings.ToUpper(*VarPrefix),
+		FileH:     FILE_CERT_H,
+		CACert:    CBlock(caCertBlock).String(),
+		CACertLen: len(caCertBlock) + 1,
+	}
+	perm := os.FileMode(0666)
+
+	if *ServerCert != "" {
+		certFile := filepath.Join(Dir.Cert, *ServerCert+EXT_CERT)
+		keyFile := filepath.Join(Dir.Key, *ServerCert+EXT_KEY)
+
+		certBlock, err := os.ReadFile(certFile)
 		if err != nil {
 			log.Fatal(err)
 		}
-
-		tmpl := template.Must(template.New("").Parse(TMPL_SERVER_GO))
-
-		err = tmpl.Execute(file, data)
-		file.Close()
+		keyBlock, err := os.ReadFile(keyFile)
 		if err != nil {
 			log.Fatal(err)
 		}
+
+		data.ValidUntil = fmt.Sprint(strings.TrimRight(InfoEndDate(certFile), "\n"))
+		data.Cert, data.CertLen = CBlock(certBlock).String(), len(certBlock)+1
+		data.Key, data.KeyLen = CBlock(keyBlock).String(), len(keyBlock)+1
+		zero(keyBlock)
+		perm = 0600 // it has the private key
 	}
 
-	if *IsClient {
-		file, err := os.OpenFile(FILE_CLIENT_GO, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0666)
+	writeTemplate(FILE_CERT_H, TMPL_CERT_H, 0666, data)
+	writeTemplate(FILE_CERT_C, TMPL_CERT_C, perm, data)
+}
+
+// Cert2ESP32 creates the header for Arduino and ESP32 with the certificates in
+// PEM format, and the files with the certificates in binary format.
+func Cert2ESP32() {
+	version, err := exec.Command(File.Cmd, "version").Output()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	caCertBlock, err := os.ReadFile(*CACert)
+	if err != nil {
+		log.Fatal(err)
+	}
+	caCerts := splitCerts(caCertBlock)
+	if len(caCerts) == 0 {
+		log.Fatalf("No certificate in PEM format: %q", *CACert)
+	}
+
+	data := struct {
+		Header     string
+		System     string
+		Arch       string
+		Version    string
+		Date       string
+		Prefix     string // Of the strings.
+		Macro      string // Prefix of the macro guard.
+		ValidUntil string
+		CACert     string
+		Cert       string
+		Key        string
+	}{
+		Header:  HEADER_GENERATED,
+		System:  runtime.GOOS,
+		Arch:    runtime.GOARCH,
+		Version: strings.TrimRight(string(version), "\n"),
+		Date:    time.Now().Format(time.RFC822),
+		Prefix:  *VarPrefix,
+		Macro:   strings.ToUpper(*VarPrefix),
+		CACert:  pemLiteral(bytes.Join(caCerts, nil)),
+	}
+	perm := os.FileMode(0666)
+
+	writeDER(*VarPrefix+"ca_cert"+EXT_DER, caCerts, 0666)
+
+	if *ServerCert != "" {
+		certFile := filepath.Join(Dir.Cert, *ServerCert+EXT_CERT)
+		keyFile := filepath.Join(Dir.Key, *ServerCert+EXT_KEY)
+
+		certBlock, err := os.ReadFile(certFile)
 		if err != nil {
 			log.Fatal(err)
 		}
+		certs := splitCerts(certBlock)
+		if len(certs) == 0 {
+			log.Fatalf("No certificate in PEM format: %q", certFile)
+		}
 
-		tmpl := template.Must(template.New("").Parse(TMPL_CLIENT_GO))
-
-		err = tmpl.Execute(file, data)
-		file.Close()
+		keyBlock, err := os.ReadFile(keyFile)
 		if err != nil {
 			log.Fatal(err)
 		}
+		block, _ := pem.Decode(keyBlock)
+		zero(keyBlock)
+		if block == nil {
+			log.Fatalf("No private key in PEM format: %q", keyFile)
+		}
+		if isEncryptedKey(block) {
+			log.Fatalf("The private key is encrypted: %q", keyFile)
+		}
+		keyPEM := pem.EncodeToMemory(block)
+
+		data.ValidUntil = fmt.Sprint(strings.TrimRight(InfoEndDate(certFile), "\n"))
+		data.Cert = pemLiteral(bytes.Join(certs, nil))
+		data.Key = pemLiteral(keyPEM)
+		perm = 0600 // it has the private key
+
+		writeDER(*VarPrefix+"server_cert"+EXT_DER, certs, 0666)
+		writeDER(*VarPrefix+"server_key"+EXT_DER, [][]byte{keyPEM}, 0600)
+		zero(keyPEM)
+		zero(block.Bytes)
+	}
+
+	writeTemplate(FILE_ESP32_H, TMPL_ESP32_H, perm, data)
+}
+
+// pemLiteral returns the data in PEM format like a string literal in C, split
+// in a literal by line.
+func pemLiteral(data []byte) string {
+	lines := strings.SplitAfter(strings.TrimRight(string(data), "\n"), "\n")
+	for i, v := range lines {
+		lines[i] = strconv.Quote(strings.TrimRight(v, "\n") + "\n")
+	}
+	return strings.Join(lines, "\n")
+}
+
+// writeDER writes the blocks in PEM format into the file in binary format.
+func writeDER(name string, blocks [][]byte, perm os.FileMode) {
+	var buf bytes.Buffer
+	for _, v := range blocks {
+		block, _ := pem.Decode(v)
+		buf.Write(block.Bytes)
+	}
+
+	err := os.WriteFile(filepath.Join(langDir(), name), buf.Bytes(), perm)
+	zero(buf.Bytes())
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// writeTemplate writes the file from the template into the output directory.
+func writeTemplate(name, text string, perm os.FileMode, data interface{}) {
+	file, err := os.OpenFile(filepath.Join(langDir(), name), os.O_CREATE|os.O_TRUNC|os.O_WRONLY, perm)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	tmpl := template.Must(template.New("").Parse(text))
+
+	err = tmpl.Execute(file, data)
+	file.Close()
+	if err != nil {
+		log.Fatal(err)
 	}
 }
 
 // == Template
 //
 
-const TMPL_SERVER_GO = `// MACHINE GENERATED BY easycert (github.com/tredoe/easycert)
+const TMPL_SERVER_GO = `{{.Header}}
 // From {{.System}} ({{.Arch}}) with "{{.Version}}", on {{.Date}}
 // Server valid for: {{.ValidUntil}}
-
-package main
+{{if .Generate}}
+//go:generate {{.Generate}}
+{{end}}
+package {{.Package}}
 
 import (
 	"crypto/tls"
@@ -172,7 +499,7 @@ import (
 	"log"
 )
 
-var ServerTLSConfig *tls.Config
+var {{.Prefix}}ServerTLSConfig *tls.Config
 
 func init() {
 	/*CA_CERT_BLOCK := {{.CACert}}*/
@@ -191,7 +518,7 @@ func init() {
 		log.Fatal("server: CertPool: CA certificate not valid")
 	}*/
 
-	ServerTLSConfig = &tls.Config{
+	{{.Prefix}}ServerTLSConfig = &tls.Config{
 		Certificates: []tls.Certificate{cert},
 		//ClientCAs:    certPool,
 		//ClientAuth:   tls.,
@@ -199,43 +526,217 @@ func init() {
 }
 `
 
-const TMPL_CLIENT_GO = `// MACHINE GENERATED BY easycert (github.com/tredoe/easycert)
+const TMPL_CLIENT_GO = `{{.Header}}
 // From {{.System}} ({{.Arch}}) with "{{.Version}}", on {{.Date}}
-
+{{if .Generate}}
+//go:generate {{.Generate}}
+{{end}}
 // MUST set the filenames for both certificate and key
-// var CertFile, KeyFile string
+// var {{.Prefix}}CertFile, {{.Prefix}}KeyFile string
 
-package main
+package {{.Package}}
 
 import (
 	"crypto/tls"
-	"crypto/x509"
 	"log"
+
+	"github.com/tredoe/easycert/store"
 )
 
-var ClientTLSConfig *tls.Config
+var {{.Prefix}}ClientTLSConfig *tls.Config
 
 func init() {
 	CA_CERT_BLOCK := {{.CACert}}
 
-	cert, err := tls.LoadX509KeyPair(CertFile, KeyFile)
+	cert, err := tls.LoadX509KeyPair({{.Prefix}}CertFile, {{.Prefix}}KeyFile)
 	if err != nil {
 		log.Fatal("client: load keys: ", err)
 	}
 
-	certPool := x509.NewCertPool()
-	if ok := certPool.AppendCertsFromPEM(CA_CERT_BLOCK); !ok {
-		log.Fatal("client: CertPool: CA certificate not valid")
+	dir := store.NewMem()
+	if err = dir.WriteFile(store.CertFile(store.NAME_CA), CA_CERT_BLOCK, 0644); err != nil {
+		log.Fatal("client: CA certificate: ", err)
+	}
+	certPool, err := store.CertPool(dir)
+	if err != nil {
+		log.Fatal("client: CertPool: ", err)
 	}
 
-	ClientTLSConfig = &tls.Config{
-		Certificates: []tls.Certificate{cert},
-		RootCAs:      certPool,
+	// The status of the server certificate is checked through OCSP, whether it
+	// has a responder.
+	verifyPeer, err := store.VerifyPeer(dir, store.PeerOptions{OCSP: true})
+	if err != nil {
+		log.Fatal("client: VerifyPeer: ", err)
+	}
+
+	{{.Prefix}}ClientTLSConfig = &tls.Config{
+		Certificates:          []tls.Certificate{cert},
+		RootCAs:               certPool,
+		VerifyPeerCertificate: verifyPeer,
 		//CipherSuites: []uint16{tls.},
 	}
 }
 `
 
+const TMPL_SERVER_TEST_GO = `{{.Header}}
+// From {{.System}} ({{.Arch}}) with "{{.Version}}", on {{.Date}}
+
+package {{.Package}}
+
+import (
+	"crypto/x509"
+	"testing"
+)
+
+// The key pair is loaded at the initialization of the package.
+func Test{{.TestPrefix}}ServerCert(t *testing.T) {
+	CA_CERT_BLOCK := {{.CACert}}
+
+	roots := x509.NewCertPool()
+	if ok := roots.AppendCertsFromPEM(CA_CERT_BLOCK); !ok {
+		t.Fatal("CA certificate not valid")
+	}
+	if len({{.Prefix}}ServerTLSConfig.Certificates) == 0 {
+		t.Fatal("server without certificate")
+	}
+	verify{{.TestPrefix}}ServerCert(t, {{.Prefix}}ServerTLSConfig.Certificates[0].Certificate, roots)
+}
+
+// verify{{.TestPrefix}}ServerCert checks that the chain of the certificate in DER
+// is valid for the CAs in ` + "`roots`" + `.
+func verify{{.TestPrefix}}ServerCert(t *testing.T, chain [][]byte, roots *x509.CertPool) {
+	t.Helper()
+
+	certs := make([]*x509.Certificate, len(chain))
+	for i, v := range chain {
+		var err error
+		if certs[i], err = x509.ParseCertificate(v); err != nil {
+			t.Fatal(err)
+		}
+	}
+	intermediates := x509.NewCertPool()
+	for _, v := range certs[1:] {
+		intermediates.AddCert(v)
+	}
+
+	if _, err := certs[0].Verify(x509.VerifyOptions{
+		Roots:         roots,
+		Intermediates: intermediates,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}); err != nil {
+		t.Error(err)
+	}
+}
+`
+
+const TMPL_CLIENT_TEST_GO = `{{.Header}}
+// From {{.System}} ({{.Arch}}) with "{{.Version}}", on {{.Date}}
+
+package {{.Package}}
+
+import (
+	"crypto/x509"
+	"testing"
+)
+
+// The key pair is loaded at the initialization of the package.
+func Test{{.TestPrefix}}ClientCert(t *testing.T) {
+	if {{.Prefix}}ClientTLSConfig.RootCAs == nil {
+		t.Fatal("client without CA certificate")
+	}
+	for _, cert := range {{.Prefix}}ClientTLSConfig.Certificates {
+		verify{{.TestPrefix}}ClientCert(t, cert.Certificate, {{.Prefix}}ClientTLSConfig.RootCAs)
+	}
+}
+
+// verify{{.TestPrefix}}ClientCert checks that the chain of the certificate in DER
+// is valid for the CAs in ` + "`roots`" + `.
+func verify{{.TestPrefix}}ClientCert(t *testing.T, chain [][]byte, roots *x509.CertPool) {
+	t.Helper()
+
+	certs := make([]*x509.Certificate, len(chain))
+	for i, v := range chain {
+		var err error
+		if certs[i], err = x509.ParseCertificate(v); err != nil {
+			t.Fatal(err)
+		}
+	}
+	intermediates := x509.NewCertPool()
+	for _, v := range certs[1:] {
+		intermediates.AddCert(v)
+	}
+
+	if _, err := certs[0].Verify(x509.VerifyOptions{
+		Roots:         roots,
+		Intermediates: intermediates,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}); err != nil {
+		t.Error(err)
+	}
+}
+`
+
+const TMPL_CERT_H = `{{.Header}}
+// From {{.System}} ({{.Arch}}) with "{{.Version}}", on {{.Date}}
+{{- if .ValidUntil}}
+// Server valid for: {{.ValidUntil}}
+{{- end}}
+//
+// The certificates and the key are in PEM format, ended in a null character,
+// which is included in the lengths.
+
+#ifndef {{.Macro}}EASYCERT_CERTS_H
+#define {{.Macro}}EASYCERT_CERTS_H
+
+#define {{.Macro}}CA_CERT_LEN {{.CACertLen}}
+extern const unsigned char {{.Prefix}}ca_cert[{{.Macro}}CA_CERT_LEN];
+{{if .Cert}}
+#define {{.Macro}}SERVER_CERT_LEN {{.CertLen}}
+extern const unsigned char {{.Prefix}}server_cert[{{.Macro}}SERVER_CERT_LEN];
+
+#define {{.Macro}}SERVER_KEY_LEN {{.KeyLen}}
+extern const unsigned char {{.Prefix}}server_key[{{.Macro}}SERVER_KEY_LEN];
+{{end}}
+#endif
+`
+
+const TMPL_CERT_C = `{{.Header}}
+// From {{.System}} ({{.Arch}}) with "{{.Version}}", on {{.Date}}
+
+#include "{{.FileH}}"
+
+const unsigned char {{.Prefix}}ca_cert[{{.Macro}}CA_CERT_LEN] = {{.CACert}};
+{{if .Cert}}
+const unsigned char {{.Prefix}}server_cert[{{.Macro}}SERVER_CERT_LEN] = {{.Cert}};
+
+const unsigned char {{.Prefix}}server_key[{{.Macro}}SERVER_KEY_LEN] = {{.Key}};
+{{- end}}
+`
+
+const TMPL_ESP32_H = `{{.Header}}
+// From {{.System}} ({{.Arch}}) with "{{.Version}}", on {{.Date}}
+{{- if .ValidUntil}}
+// Server valid for: {{.ValidUntil}}
+{{- end}}
+//
+// The certificates and the key are in PEM format; the length to pass to mbedTLS
+// is the one given by "sizeof", which includes the null character.
+
+#ifndef {{.Macro}}EASYCERT_ESP32_H
+#define {{.Macro}}EASYCERT_ESP32_H
+
+static const char {{.Prefix}}ca_cert[] =
+{{.CACert}};
+{{if .Cert}}
+static const char {{.Prefix}}server_cert[] =
+{{.Cert}};
+
+static const char {{.Prefix}}server_key[] =
+{{.Key}};
+{{end}}
+#endif
+`
+
 // GoBlock represents the definition of a "[]byte" in Go.
 type GoBlock []byte
 
@@ -255,3 +756,24 @@ func (b GoBlock) String() string {
 
 	return fmt.Sprintf("[]byte{\n\t\t%s\n\t}", strings.Join(s, ""))
 }
+
+// CBlock represents the definition of an array of bytes in C, ended in a null
+// character.
+type CBlock []byte
+
+func (b CBlock) String() string {
+	var buf strings.Builder
+	buf.WriteString("{")
+
+	for i, v := range append(b[:len(b):len(b)], 0) {
+		if i%12 == 0 {
+			buf.WriteString("\n\t")
+		} else {
+			buf.WriteString(" ")
+		}
+		fmt.Fprintf(&buf, "0x%02x,", v)
+	}
+
+	buf.WriteString("\n}")
+	return buf.String()
+}
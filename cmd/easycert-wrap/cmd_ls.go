@@ -7,57 +7,131 @@
 package main
 
 import (
+	"flag"
 	"fmt"
 	"log"
 	"path/filepath"
+	"sort"
+	"strings"
 
 	"github.com/tredoe/flagplus"
 )
 
 var cmdLs = &flagplus.Subcommand{
-	UsageLine: "ls [-req] [-cert] [-key]",
+	UsageLine: "ls [-req] [-cert] [-key] [-tree] [-history NAME] [-json] [-readonly]",
 	Short:     "list",
 	Long: `
 "ls" lists files in the certificates directory.
 Whether it is not used some flag, it lists all files related to certificates.
+
+The flag "-tree" shows the certificates like a hierarchy of issuance, from the
+root CA through the intermediate CAs to the certificates signed by them.
+
+The flag "-history" lists the current and the previous versions of the
+certificate NAME, kept when it is reissued, with their serial number and
+expiration.
+
+The flag "-json" prints the files like an array of records in JSON format, with
+the name, the type ("certificate", "request" or "key") and the path of every
+file; the records of the certificates have also their information, like
+"info -json".
 `,
 	Run: runLs,
 }
 
+var IsTree = flag.Bool("tree", false, "show the hierarchy of issuance")
+
 func init() {
-	cmdLs.AddFlags("req", "cert", "key")
+	addFlags(cmdLs, "req", "cert", "key", "tree", "history", "json", "readonly")
 }
 
 func runLs(cmd *flagplus.Subcommand, args []string) {
+	if *IsJSON && (*IsHistory || *IsTree) {
+		log.Print("Flag -json can not be used with -history or -tree")
+		cmd.Usage()
+	}
+	if *IsHistory {
+		if len(args) != 1 {
+			log.Print("Missing required argument: NAME")
+			cmd.Usage()
+		}
+		printHistory(args[0])
+		return
+	}
+	if *IsTree {
+		printTree()
+		return
+	}
 	if !*IsCert && !*IsRequest && !*IsKey {
 		*IsCert = true
 		*IsRequest = true
 		*IsKey = true
 	}
 
-	if *IsCert {
-		match, err := filepath.Glob(filepath.Join(Dir.Cert, "*"+EXT_CERT))
-		if err != nil {
-			log.Fatal(err)
+	var records []*lsRecord
+
+	for _, v := range []struct {
+		isSet   bool
+		typ     string
+		pattern string
+	}{
+		{*IsCert, LS_CERT, filepath.Join(Dir.Cert, "*"+EXT_CERT)},
+		{*IsRequest, LS_REQUEST, filepath.Join(Dir.Root, "*"+EXT_REQUEST)},
+		{*IsKey, LS_KEY, filepath.Join(Dir.Key, "*"+EXT_KEY)},
+	} {
+		if !v.isSet {
+			continue
 		}
-		printCert(match)
-	}
-	if *IsRequest {
-		match, err := filepath.Glob(filepath.Join(Dir.Root, "*"+EXT_REQUEST))
+		match, err := filepath.Glob(v.pattern)
 		if err != nil {
 			log.Fatal(err)
 		}
-		printCert(match)
+		if !*IsJSON {
+			printCert(match)
+			continue
+		}
+
+		for _, file := range match {
+			r := &lsRecord{
+				Name: strings.TrimSuffix(filepath.Base(file), filepath.Ext(file)),
+				Type: v.typ,
+				File: file,
+			}
+			if v.typ == LS_CERT {
+				cert, err := parseCertFile(file)
+				if err != nil {
+					log.Fatal(err)
+				}
+				r.CertInfo = newCertInfo(r.Name, cert)
+			}
+			records = append(records, r)
+		}
 	}
-	if *IsKey {
-		match, err := filepath.Glob(filepath.Join(Dir.Key, "*"+EXT_KEY))
-		if err != nil {
-			log.Fatal(err)
+
+	if *IsJSON {
+		if records == nil {
+			records = []*lsRecord{}
 		}
-		printCert(match)
+		printJSON(records)
 	}
 }
 
+// Types of the files listed by "ls".
+const (
+	LS_CERT    = "certificate"
+	LS_REQUEST = "request"
+	LS_KEY     = "key"
+)
+
+// lsRecord represents a file listed by "ls" in JSON format. The certificates
+// have their information.
+type lsRecord struct {
+	Name string `json:"name"`
+	Type string `json:"type"`
+	File string `json:"file"`
+	*CertInfo
+}
+
 // printCert prints the name of the certificates.
 func printCert(cert []string) {
 	if len(cert) == 0 {
@@ -71,3 +145,47 @@ func printCert(cert []string) {
 	}
 	fmt.Println()
 }
+
+// certNode represents a certificate into the hierarchy of issuance.
+type certNode struct {
+	name     string
+	children []*certNode
+}
+
+// printTree prints the certificates like a tree, linking every certificate with
+// its issuer through the Authority and Subject Key Identifiers.
+func printTree() {
+	certs := loadCerts()
+
+	nodes := make(map[*storeCert]*certNode, len(certs))
+	for _, v := range certs {
+		nodes[v] = &certNode{name: filepath.Base(v.File)}
+	}
+
+	var roots []*certNode
+
+	for _, v := range certs {
+		if parent := issuerOf(v.Cert, certs); parent != nil {
+			nodes[parent].children = append(nodes[parent].children, nodes[v])
+		} else {
+			roots = append(roots, nodes[v])
+		}
+	}
+
+	sort.Slice(roots, func(i, j int) bool { return roots[i].name < roots[j].name })
+	for _, n := range roots {
+		printNode(n, 0)
+	}
+}
+
+// printNode prints a node and its children indented according to the depth.
+func printNode(n *certNode, depth int) {
+	fmt.Printf("%s%s\n", strings.Repeat("    ", depth), n.name)
+
+	sort.Slice(n.children, func(i, j int) bool {
+		return n.children[i].name < n.children[j].name
+	})
+	for _, v := range n.children {
+		printNode(v, depth+1)
+	}
+}
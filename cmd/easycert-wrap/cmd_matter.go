@@ -0,0 +1,208 @@
+// Copyright 2014 Jonas mg
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"crypto/x509"
+	"encoding/asn1"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/tredoe/flagplus"
+)
+
+var cmdMatter = &flagplus.Subcommand{
+	UsageLine: "matter -vid id [-pid id] [-years number] [-out dir] NAME",
+	Short:     "generate the device attestation chain of Matter",
+	Long: `
+"matter" generates the chain of device attestation used in the development of
+Matter devices: the Product Attestation Authority (PAA), the Product Attestation
+Intermediate (PAI) and the Device Attestation Certificate (DAC) named NAME. It
+is a chain apart from the CA of the certificates directory.
+
+The vendor ID, given in "-vid", and the product ID, given in "-pid", are 4
+hexadecimal digits (i.e. the test vendors FFF1 to FFF4), which are added to the
+subjects like the attributes of Matter: the PAA and the PAI have the vendor ID,
+and the DAC has the vendor and the product IDs. The keys are ECDSA on the curve
+P-256, signed with SHA-256, and the extensions are the required ones: the basic
+constraints, the key usage and the key identifiers.
+
+The files are written in the directory "matter-VID" unless it is used "-out":
+"paa.crt", "pai.crt" and "NAME.crt" with their keys, plus the certificates in
+DER format (".der") for the SDK and the devices. The PAA and the PAI of the
+directory are reused whether they exist, so the devices of a vendor share them.
+`,
+	Run: runMatter,
+}
+
+// OIDs of the attributes of the subject of Matter.
+var (
+	oidMatterVID = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 37244, 2, 1}
+	oidMatterPID = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 37244, 2, 2}
+)
+
+// Names of the files of the authorities of Matter.
+const (
+	NAME_PAA = "paa"
+	NAME_PAI = "pai"
+)
+
+// matterConfig is the configuration of OpenSSL for the chain of Matter.
+const matterConfig = `oid_section = matter_oids
+
+[ matter_oids ]
+matterVID = 1.3.6.1.4.1.37244.2.1
+matterPID = 1.3.6.1.4.1.37244.2.2
+
+[ req ]
+distinguished_name = req_distinguished_name
+string_mask = utf8only
+
+[ req_distinguished_name ]
+
+[ paa ]
+basicConstraints = critical, CA:TRUE, pathlen:1
+keyUsage = critical, keyCertSign, cRLSign
+subjectKeyIdentifier = hash
+authorityKeyIdentifier = keyid:always
+
+[ pai ]
+basicConstraints = critical, CA:TRUE, pathlen:0
+keyUsage = critical, keyCertSign, cRLSign
+subjectKeyIdentifier = hash
+authorityKeyIdentifier = keyid:always
+
+[ dac ]
+basicConstraints = critical, CA:FALSE
+keyUsage = critical, digitalSignature
+subjectKeyIdentifier = hash
+authorityKeyIdentifier = keyid:always
+`
+
+// validMatterID matches a vendor or product ID of Matter.
+var validMatterID = regexp.MustCompile(`^[0-9A-F]{4}$`)
+
+var (
+	VendorID  = flag.String("vid", "", "vendor ID of Matter, in hexadecimal")
+	ProductID = flag.String("pid", "8000", "product ID of Matter, in hexadecimal")
+)
+
+func init() {
+	addFlags(cmdMatter, "vid", "pid", "years", "out")
+}
+
+func runMatter(cmd *flagplus.Subcommand, args []string) {
+	if len(args) != 1 || *VendorID == "" {
+		log.Print("Missing required arguments: -vid id NAME")
+		cmd.Usage()
+	}
+	vid, pid := strings.ToUpper(*VendorID), strings.ToUpper(*ProductID)
+	for _, v := range []string{vid, pid} {
+		if !validMatterID.MatchString(v) {
+			log.Fatalf("Invalid ID of Matter: %q; it has to be 4 hexadecimal digits", v)
+		}
+	}
+	out := *Out
+	if out == "" {
+		out = "matter-" + vid
+	}
+	if err := os.MkdirAll(out, 0700); err != nil {
+		log.Fatal(err)
+	}
+	name := args[0]
+	if _, err := os.Stat(filepath.Join(out, name+EXT_CERT)); !os.IsNotExist(err) {
+		log.Fatalf("Certificate already exists: %q", filepath.Join(out, name+EXT_CERT))
+	}
+
+	// Creating the PAA is like creating a CA.
+	action := ACTION_SIGN
+	if _, err := os.Stat(filepath.Join(out, NAME_PAA+EXT_CERT)); os.IsNotExist(err) {
+		action = ACTION_CA
+	}
+	operator := mustRole(action)
+
+	// The temporary files are removed whether OpenSSL fails.
+	beginIssuance()
+	defer commitIssuance()
+
+	config := mustTempFile(filepath.Join(out, "matter.cfg"))
+	defer os.Remove(config)
+	if err := os.WriteFile(config, []byte(matterConfig), 0600); err != nil {
+		fatal(err)
+	}
+
+	fmt.Print("\n== Generated\n")
+	issuer := ""
+	for _, v := range []struct {
+		name, section, subject string
+	}{
+		{NAME_PAA, "paa", "/CN=Matter Development PAA/matterVID=" + vid},
+		{NAME_PAI, "pai", "/CN=Matter Development PAI/matterVID=" + vid},
+		{name, "dac", "/CN=" + name + "/matterVID=" + vid + "/matterPID=" + pid},
+	} {
+		certFile := filepath.Join(out, v.name+EXT_CERT)
+
+		if v.section != "dac" {
+			if cert, err := parseCertFile(certFile); err == nil {
+				if id := matterID(cert, oidMatterVID); id != vid {
+					fatalf("The vendor ID of %q is %q, not %q", certFile, id, vid)
+				}
+				issuer = filepath.Join(out, v.name)
+				continue
+			} else if !os.IsNotExist(err) {
+				fatal(err)
+			}
+		}
+		genMatterCert(config, filepath.Join(out, v.name), issuer, v.section, v.subject)
+		issuer = filepath.Join(out, v.name)
+		fmt.Printf("- %s:\t%q\n", strings.ToUpper(v.section), certFile)
+	}
+	audit(operator, action, "matter/"+name, "VID "+vid+", PID "+pid)
+}
+
+// genMatterCert generates the key and the certificate `file` (without
+// extension) with the extensions of the `section` of the configuration, signed
+// by `issuer` or self-signed whether it is empty.
+func genMatterCert(config, file, issuer, section, subject string) {
+	keyFile := createKeyFile(file + EXT_KEY)
+	certFile := mustTempFile(file + EXT_CERT)
+	derFile := mustTempFile(file + EXT_DER)
+
+	openssl("genpkey", "-algorithm", "EC", "-pkeyopt", "ec_paramgen_curve:P-256", "-out", keyFile)
+
+	args := []string{"req", "-new", "-x509", "-config", config,
+		"-key", keyFile, "-subj", subject, "-extensions", section,
+		"-sha256", "-days", strconv.Itoa(365 * *Years), "-out", certFile,
+	}
+	if issuer != "" {
+		args = append(args, "-CA", issuer+EXT_CERT, "-CAkey", issuer+EXT_KEY)
+	}
+	openssl(args...)
+	openssl("x509", "-in", certFile, "-outform", "DER", "-out", derFile)
+
+	mustCommitFile(keyFile, file+EXT_KEY, 0400)
+	mustCommitFile(certFile, file+EXT_CERT, 0644)
+	mustCommitFile(derFile, file+EXT_DER, 0644)
+}
+
+// matterID returns the value of the attribute `oid` of the subject, i.e. the
+// vendor ID.
+func matterID(cert *x509.Certificate, oid asn1.ObjectIdentifier) string {
+	for _, v := range cert.Subject.Names {
+		if v.Type.Equal(oid) {
+			s, _ := v.Value.(string)
+			return s
+		}
+	}
+	return ""
+}
@@ -0,0 +1,188 @@
+// Copyright 2014 Jonas mg
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/tredoe/flagplus"
+)
+
+var cmdNebula = &flagplus.Subcommand{
+	UsageLine: "nebula -init [-years number] | nebula -ip cidr [-groups name1,...] NAME | nebula -pki NAME",
+	Short:     "issue the certificates of the overlay network Nebula",
+	Long: `
+"nebula" issues the certificates of the overlay network Nebula from the same
+certificates directory, so the identities of the mesh are handled together with
+the TLS ones. The certificates of Nebula are not X.509, so they are issued by
+the program "nebula-cert", which has to be installed, into the directory
+"nebula".
+
+With the flag "-init", it creates the CA of Nebula, whose name is the
+organization followed by " Nebula CA" (see "init"), valid for the years given in
+"-years".
+
+With the flag "-ip", it issues the certificate of the host NAME with its IP
+address and network in CIDR notation (i.e. "192.168.100.5/24") and the groups
+given in "-groups", used by the rules of the firewall. It is valid until the
+expiration of the CA of Nebula.
+
+With the flag "-pki", it prints the section "pki" of the configuration of Nebula
+for the host NAME, with the CA, the certificate and the key inline, so it can be
+pasted in the file "config.yml" of the host.
+`,
+	Run: runNebula,
+}
+
+// NAME_NEBULA_CA is the name of the files of the CA of Nebula.
+const NAME_NEBULA_CA = "ca"
+
+var (
+	IsNebulaInit = flag.Bool("init", false, "create the CA")
+	NebulaIP     = flag.String("ip", "", "IP address and network in CIDR notation")
+	Groups       = flag.String("groups", "", "comma-separated groups of the host")
+	IsPKI        = flag.Bool("pki", false, "print the section pki of the configuration")
+)
+
+func init() {
+	addFlags(cmdNebula, "init", "ip", "groups", "pki", "years")
+}
+
+func runNebula(cmd *flagplus.Subcommand, args []string) {
+	switch {
+	case *IsNebulaInit:
+		if len(args) != 0 {
+			log.Print("Too many arguments")
+			cmd.Usage()
+		}
+		NebulaCA()
+	case *NebulaIP != "":
+		if len(args) != 1 {
+			log.Print("Missing required argument: NAME")
+			cmd.Usage()
+		}
+		NebulaSign(args[0], *NebulaIP, *Groups)
+	case *IsPKI:
+		if len(args) != 1 {
+			log.Print("Missing required argument: NAME")
+			cmd.Usage()
+		}
+		data, err := nebulaPKI(args[0])
+		if err != nil {
+			log.Fatal(err)
+		}
+		os.Stdout.Write(data)
+	default:
+		log.Print("Missing required flag")
+		cmd.Usage()
+	}
+}
+
+// nebulaFile returns the file of the credential `name` of Nebula, with the
+// extension `ext`.
+func nebulaFile(name, ext string) string {
+	return filepath.Join(Dir.Nebula, name+ext)
+}
+
+// NebulaCA creates the CA of Nebula.
+func NebulaCA() {
+	operator := mustRole(ACTION_CA)
+	nebulaCert := lookTool("nebula-cert")
+	name := strings.TrimSpace(Subject.Organization + " Nebula CA")
+
+	certFile, keyFile := nebulaFile(NAME_NEBULA_CA, EXT_CERT), nebulaFile(NAME_NEBULA_CA, EXT_KEY)
+	if _, err := os.Stat(certFile); !os.IsNotExist(err) {
+		log.Fatal("The certificate of the CA of Nebula exists")
+	}
+	if err := os.MkdirAll(Dir.Nebula, 0700); err != nil {
+		log.Fatal(err)
+	}
+
+	beginIssuance()
+	curIssuance.addFile(certFile)
+	curIssuance.addFile(keyFile)
+	execCmd(nil, nebulaCert, "ca", "-name", name,
+		"-duration", strconv.Itoa(365*24**Years)+"h",
+		"-out-crt", certFile, "-out-key", keyFile)
+	if err := os.Chmod(keyFile, 0400); err != nil {
+		fatal(err)
+	}
+	commitIssuance()
+
+	fmt.Printf("\n== Generated\n- Certificate:\t%q\n- Private key:\t%q\n", certFile, keyFile)
+	audit(operator, ACTION_CA, "nebula/"+NAME_NEBULA_CA, name)
+}
+
+// NebulaSign issues the certificate of Nebula of the host `name`, with its key.
+func NebulaSign(name, ip, groups string) {
+	operator := mustRole(ACTION_SIGN)
+	nebulaCert := lookTool("nebula-cert")
+
+	if name == NAME_NEBULA_CA || strings.ContainsAny(name, `/\`) {
+		log.Fatalf("Invalid name of host: %q", name)
+	}
+	if _, _, err := net.ParseCIDR(ip); err != nil {
+		log.Fatalf("Invalid value for flag -ip: %s", err)
+	}
+	certFile, keyFile := nebulaFile(name, EXT_CERT), nebulaFile(name, EXT_KEY)
+	if _, err := os.Stat(certFile); !os.IsNotExist(err) {
+		log.Fatalf("Certificate already exists: %q", certFile)
+	}
+
+	args := []string{"sign", "-name", name, "-ip", ip,
+		"-ca-crt", nebulaFile(NAME_NEBULA_CA, EXT_CERT),
+		"-ca-key", nebulaFile(NAME_NEBULA_CA, EXT_KEY),
+		"-out-crt", certFile, "-out-key", keyFile,
+	}
+	if groups != "" {
+		args = append(args, "-groups", groups)
+	}
+
+	beginIssuance()
+	curIssuance.addFile(certFile)
+	curIssuance.addFile(keyFile)
+	execCmd(nil, nebulaCert, args...)
+	if err := os.Chmod(keyFile, 0400); err != nil {
+		fatal(err)
+	}
+	commitIssuance()
+
+	fmt.Printf("\n== Generated\n- Certificate:\t%q\n- Private key:\t%q\n", certFile, keyFile)
+	audit(operator, ACTION_SIGN, "nebula/"+name, "ip "+ip)
+}
+
+// nebulaPKI returns the section "pki" of the configuration of Nebula of the
+// host `name`, in YAML format.
+func nebulaPKI(name string) ([]byte, error) {
+	var buf bytes.Buffer
+
+	buf.WriteString("pki:\n")
+	for _, v := range []struct{ key, file string }{
+		{"ca", nebulaFile(NAME_NEBULA_CA, EXT_CERT)},
+		{"cert", nebulaFile(name, EXT_CERT)},
+		{"key", nebulaFile(name, EXT_KEY)},
+	} {
+		data, err := os.ReadFile(v.file)
+		if err != nil {
+			return nil, err
+		}
+		fmt.Fprintf(&buf, "  %s: |\n", v.key)
+		for _, line := range strings.Split(strings.TrimRight(string(data), "\n"), "\n") {
+			fmt.Fprintf(&buf, "    %s\n", line)
+		}
+		zero(data)
+	}
+	return buf.Bytes(), nil
+}
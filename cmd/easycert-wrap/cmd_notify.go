@@ -0,0 +1,179 @@
+// Copyright 2014 Jonas mg
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"net/smtp"
+	"strings"
+	"time"
+
+	"github.com/tredoe/flagplus"
+)
+
+var cmdNotify = &flagplus.Subcommand{
+	UsageLine: "notify [-days number] [-dry-run]",
+	Short:     "send notifications by email or issue",
+	Long: `
+"notify" sends an email in plain text listing the certificates which are into
+their renewal window and the requests pending of approval. Nothing is sent when
+there is nothing to notify. It is intended to be run by cron.
+
+The server SMTP is set in the field "smtp" of the file "store.json" in the
+certificates directory:
+
+	{
+		"renewal_days": 30,
+		"smtp": {
+			"addr": "smtp.example.com:587",
+			"username": "user",
+			"password": "secret",
+			"from": "easycert@example.com",
+			"to": ["admin@example.com"]
+		}
+	}
+
+Whether the field "issue" is set, an issue is opened in a repository of GitHub
+or GitLab listing the certificates into their renewal window; it is updated in
+the next runs, and closed when there is nothing to renew. The token of the API
+is got from the environment variable EASYCERT_ISSUE_TOKEN:
+
+	{
+		"issue": {
+			"provider": "github",
+			"repo": "example/ops",
+			"label": "easycert"
+		}
+	}
+
+The field "url" sets the API for GitHub Enterprise or GitLab self-managed, i.e.
+"https://gitlab.example.com/api/v4"; by default, the label is "easycert".
+
+The flag "-days" overrides the renewal window, and "-dry-run" prints the email
+and the issue instead of sending them.
+`,
+	Run: runNotify,
+}
+
+var (
+	Days     = flag.Int("days", 0, "days before of the expiration to renew (default from store.json)")
+	IsDryRun = flag.Bool("dry-run", false, "print instead of run")
+)
+
+func init() {
+	addFlags(cmdNotify, "days", "dry-run", "readonly")
+}
+
+func runNotify(cmd *flagplus.Subcommand, args []string) {
+	cfg := loadStoreConfig()
+	if *Days > 0 {
+		cfg.RenewalDays = *Days
+	}
+	if cfg.SMTP == nil && cfg.Issue == nil && !*IsDryRun {
+		log.Fatalf("Missing configuration of SMTP or issue in %q", File.Store)
+	}
+
+	if cfg.Issue != nil {
+		if err := syncIssue(cfg.Issue, cfg.RenewalDays); err != nil {
+			log.Fatal(err)
+		}
+		if cfg.SMTP == nil && !*IsDryRun {
+			return
+		}
+	}
+
+	body := notifyBody(cfg.RenewalDays)
+	if body == "" {
+		return
+	}
+
+	if *IsDryRun {
+		fmt.Print(body)
+		return
+	}
+	if err := sendMail(cfg.SMTP, "[easycert] Certificates to review", body); err != nil {
+		log.Fatal(err)
+	}
+	fmt.Printf("* Notification sent to %s\n", strings.Join(cfg.SMTP.To, ", "))
+}
+
+// notifyBody returns the text to notify, or an empty string whether there is
+// nothing to notify.
+func notifyBody(days int) string {
+	var buf bytes.Buffer
+
+	limit := time.Now().AddDate(0, 0, days)
+	for _, v := range loadCerts() {
+		if v.Cert.NotAfter.After(limit) {
+			continue
+		}
+		if buf.Len() == 0 {
+			fmt.Fprintf(&buf, "Certificates expiring in the next %d days:\n\n", days)
+		}
+
+		status := "expires"
+		if v.Cert.NotAfter.Before(time.Now()) {
+			status = "EXPIRED"
+		}
+		fmt.Fprintf(&buf, "  %-20s %s %s\n", v.Name, status, v.Cert.NotAfter.Format(time.RFC822))
+	}
+
+	if err := dropQueue(currentOperator()); err != nil {
+		log.Print(err)
+	}
+	list, err := listQueue()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	pending := 0
+	for _, r := range list {
+		if r.Status != STATUS_PENDING {
+			continue
+		}
+		if pending == 0 {
+			if buf.Len() != 0 {
+				buf.WriteString("\n")
+			}
+			buf.WriteString("Certificate requests awaiting approval:\n\n")
+		}
+		fmt.Fprintf(&buf, "  %s  %-20s %s\n", r.ID, r.Name, r.Subject)
+		pending++
+	}
+
+	if buf.Len() != 0 {
+		fmt.Fprintf(&buf, "\n-- \neasycert, %s\n", Dir.Root)
+	}
+	return buf.String()
+}
+
+// sendMail sends an email in plain text.
+func sendMail(cfg *SMTPConfig, subject, body string) error {
+	var msg bytes.Buffer
+
+	fmt.Fprintf(&msg, "From: %s\r\n", cfg.From)
+	fmt.Fprintf(&msg, "To: %s\r\n", strings.Join(cfg.To, ", "))
+	fmt.Fprintf(&msg, "Subject: %s\r\n", subject)
+	fmt.Fprintf(&msg, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	msg.WriteString("MIME-Version: 1.0\r\n")
+	msg.WriteString("Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	msg.WriteString(strings.ReplaceAll(body, "\n", "\r\n"))
+
+	var auth smtp.Auth
+	if cfg.Username != "" {
+		host, _, err := net.SplitHostPort(cfg.Addr)
+		if err != nil {
+			return err
+		}
+		auth = smtp.PlainAuth("", cfg.Username, cfg.Password, host)
+	}
+	return smtp.SendMail(cfg.Addr, auth, cfg.From, cfg.To, msg.Bytes())
+}
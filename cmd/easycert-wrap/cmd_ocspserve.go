@@ -0,0 +1,372 @@
+// Copyright 2014 Jonas mg
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"log"
+	"math/big"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/tredoe/flagplus"
+)
+
+var cmdOCSPServe = &flagplus.Subcommand{
+	UsageLine: "ocsp-serve [-addr host:port] [-passin source]",
+	Short:     "serve an OCSP responder",
+	Long: `
+"ocsp-serve" runs a responder of the Online Certificate Status Protocol (OCSP,
+RFC 6960) for the certificates signed by the CA, so the services can check
+whether a certificate is revoked without distributing the revocation lists.
+
+The requests are accepted by POST and by GET, and the status is got from the
+database of the CA at every request, so the certificates revoked by "revoke"
+are answered at once: "good" for the valid and the expired ones, "revoked"
+with the date and the reason, or "unknown" for the serial numbers not issued
+by the CA. The responses are signed by the CA, whose passphrase is got from
+the environment variable EASYCERT_CA_PASS, or from the source of "-passin"
+(see "ca"), and they are valid for 1 hour.
+
+The URL of the responder is added to the certificates through the extension
+"authorityInfoAccess" in the section "usr_cert" of the configuration:
+
+	authorityInfoAccess = OCSP;URI:http://ocsp.example.com:8080
+
+Else, it can be given to "chk -ocsp FILE URL".
+`,
+	Run: runOCSPServe,
+}
+
+func init() {
+	addFlags(cmdOCSPServe, "addr", "passin")
+}
+
+// OCSP_VALIDITY is the time until the next update of the responses.
+const OCSP_VALIDITY = time.Hour
+
+// _OCSP_MAX_REQUEST is the maximum size of a request.
+const _OCSP_MAX_REQUEST = 64 << 10
+
+// Status of the OCSP responses.
+const (
+	_OCSP_SUCCESSFUL = 0
+	_OCSP_MALFORMED  = 1
+	_OCSP_INTERNAL   = 2
+)
+
+var (
+	oidOCSPBasic = asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 48, 1, 1}
+	oidOCSPNonce = asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 48, 1, 2}
+	oidSHA1      = asn1.ObjectIdentifier{1, 3, 14, 3, 2, 26}
+	oidSHA256    = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 1}
+
+	oidSHA256WithRSA   = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 1, 11}
+	oidECDSAWithSHA256 = asn1.ObjectIdentifier{1, 2, 840, 10045, 4, 3, 2}
+
+	errOCSPMalformed = errors.New("malformed OCSP request")
+)
+
+type ocspCertID struct {
+	HashAlgorithm pkix.AlgorithmIdentifier
+	NameHash      []byte
+	IssuerKeyHash []byte
+	SerialNumber  *big.Int
+}
+
+type ocspRequest struct {
+	TBSRequest struct {
+		Version       int           `asn1:"explicit,tag:0,default:0,optional"`
+		RequestorName asn1.RawValue `asn1:"explicit,tag:1,optional"`
+		RequestList   []struct {
+			Cert       ocspCertID
+			Extensions []pkix.Extension `asn1:"explicit,tag:0,optional"`
+		}
+		Extensions []pkix.Extension `asn1:"explicit,tag:2,optional"`
+	}
+}
+
+type ocspResponseData struct {
+	ResponderID asn1.RawValue
+	ProducedAt  time.Time `asn1:"generalized"`
+	Responses   []ocspSingleResponse
+	Extensions  []pkix.Extension `asn1:"explicit,tag:1,optional"`
+}
+
+type ocspSingleResponse struct {
+	CertID     ocspCertID
+	Status     asn1.RawValue
+	ThisUpdate time.Time `asn1:"generalized"`
+	NextUpdate time.Time `asn1:"generalized,explicit,tag:0,optional"`
+}
+
+type ocspRevokedInfo struct {
+	RevocationTime time.Time       `asn1:"generalized"`
+	Reason         asn1.Enumerated `asn1:"explicit,tag:0"`
+}
+
+type ocspBasicResponse struct {
+	TBSResponseData    asn1.RawValue
+	SignatureAlgorithm pkix.AlgorithmIdentifier
+	Signature          asn1.BitString
+}
+
+type ocspResponseBytes struct {
+	ResponseType asn1.ObjectIdentifier
+	Response     []byte
+}
+
+type ocspResponse struct {
+	Status   asn1.Enumerated
+	Response ocspResponseBytes `asn1:"explicit,tag:0,optional"`
+}
+
+func runOCSPServe(cmd *flagplus.Subcommand, args []string) {
+	if len(args) != 0 {
+		log.Print("Too many arguments")
+		cmd.Usage()
+	}
+	if l := openSysLog(); l != nil {
+		log.SetOutput(sysLogWriter{l})
+		log.SetPrefix("")
+	}
+
+	responder, err := newOCSPResponder()
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Printf("* Serving OCSP on http://%s\n", *Addr)
+	log.Fatal(http.ListenAndServe(*Addr, responder))
+}
+
+// ocspResponder answers the OCSP requests about the certificates of the CA.
+type ocspResponder struct {
+	ca      *x509.Certificate
+	key     crypto.Signer
+	algo    pkix.AlgorithmIdentifier
+	keyHash []byte // SHA-1 of the public key of the CA, to identify it.
+}
+
+// newOCSPResponder returns the responder with the CA's certificate and
+// private key.
+func newOCSPResponder() (*ocspResponder, error) {
+	if loadYubiKey() != nil {
+		return nil, errors.New("the OCSP responder can not sign with the CA's private key in a YubiKey")
+	}
+	ca, err := parseCertFile(filepath.Join(Dir.Cert, NAME_CA+EXT_CERT))
+	if err != nil {
+		return nil, err
+	}
+	key, err := nativeCAKey(ca)
+	if err != nil {
+		return nil, err
+	}
+
+	r := &ocspResponder{ca: ca, key: key}
+	switch key.Public().(type) {
+	case *rsa.PublicKey:
+		r.algo = pkix.AlgorithmIdentifier{
+			Algorithm:  oidSHA256WithRSA,
+			Parameters: asn1.RawValue{Tag: asn1.TagNull},
+		}
+	case *ecdsa.PublicKey:
+		r.algo = pkix.AlgorithmIdentifier{Algorithm: oidECDSAWithSHA256}
+	default:
+		return nil, fmt.Errorf("%s: %T", errKeyType, key.Public())
+	}
+	if r.keyHash, err = issuerKeyHash(ca, sha1.New()); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *ocspResponder) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	var der []byte
+	var err error
+
+	switch req.Method {
+	case "GET":
+		// The request is in base64, and escaped for the URL.
+		var path string
+		if path, err = url.PathUnescape(strings.TrimPrefix(req.URL.Path, "/")); err == nil {
+			der, err = base64.StdEncoding.DecodeString(path)
+		}
+		if err != nil {
+			err = errOCSPMalformed
+		}
+	case "POST":
+		der, err = io.ReadAll(io.LimitReader(req.Body, _OCSP_MAX_REQUEST))
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var resp []byte
+	if err == nil {
+		resp, err = r.respond(der, time.Now())
+	}
+	if err != nil {
+		log.Printf("ocsp: %s", err)
+		status := _OCSP_INTERNAL
+		if err == errOCSPMalformed {
+			status = _OCSP_MALFORMED
+		}
+		resp, _ = asn1.Marshal(struct{ Status asn1.Enumerated }{asn1.Enumerated(status)})
+	}
+
+	w.Header().Set("Content-Type", "application/ocsp-response")
+	w.Write(resp)
+}
+
+// respond returns the response signed to the request in DER format.
+func (r *ocspResponder) respond(der []byte, now time.Time) ([]byte, error) {
+	var req ocspRequest
+	if rest, err := asn1.Unmarshal(der, &req); err != nil || len(rest) != 0 ||
+		len(req.TBSRequest.RequestList) == 0 {
+		return nil, errOCSPMalformed
+	}
+
+	entries, err := readIndex()
+	if err != nil {
+		return nil, err
+	}
+	now = now.UTC().Truncate(time.Second)
+
+	data := ocspResponseData{ProducedAt: now}
+	// By key: [2] EXPLICIT OCTET STRING.
+	keyHash, err := asn1.Marshal(r.keyHash)
+	if err != nil {
+		return nil, err
+	}
+	data.ResponderID = asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 2, IsCompound: true, Bytes: keyHash}
+
+	for _, v := range req.TBSRequest.RequestList {
+		status, err := r.status(v.Cert, entries)
+		if err != nil {
+			return nil, err
+		}
+		data.Responses = append(data.Responses, ocspSingleResponse{
+			CertID:     v.Cert,
+			Status:     status,
+			ThisUpdate: now,
+			NextUpdate: now.Add(OCSP_VALIDITY),
+		})
+	}
+	for _, v := range req.TBSRequest.Extensions {
+		if v.Id.Equal(oidOCSPNonce) {
+			data.Extensions = append(data.Extensions, pkix.Extension{Id: v.Id, Value: v.Value})
+		}
+	}
+
+	tbs, err := asn1.Marshal(data)
+	if err != nil {
+		return nil, err
+	}
+	digest := sha256.Sum256(tbs)
+	sig, err := r.key.Sign(rand.Reader, digest[:], crypto.SHA256)
+	if err != nil {
+		return nil, err
+	}
+
+	basic, err := asn1.Marshal(ocspBasicResponse{
+		TBSResponseData:    asn1.RawValue{FullBytes: tbs},
+		SignatureAlgorithm: r.algo,
+		Signature:          asn1.BitString{Bytes: sig, BitLength: 8 * len(sig)},
+	})
+	if err != nil {
+		return nil, err
+	}
+	return asn1.Marshal(ocspResponse{
+		Status:   _OCSP_SUCCESSFUL,
+		Response: ocspResponseBytes{oidOCSPBasic, basic},
+	})
+}
+
+// status returns the status of the certificate in the database, like the
+// CHOICE of the response: good [0], revoked [1] or unknown [2].
+func (r *ocspResponder) status(id ocspCertID, entries []*indexEntry) (asn1.RawValue, error) {
+	unknown := asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 2}
+
+	var h hash.Hash
+	switch {
+	case id.HashAlgorithm.Algorithm.Equal(oidSHA1):
+		h = sha1.New()
+	case id.HashAlgorithm.Algorithm.Equal(oidSHA256):
+		h = sha256.New()
+	default:
+		return unknown, nil
+	}
+	keyHash, err := issuerKeyHash(r.ca, h)
+	if err != nil {
+		return unknown, err
+	}
+	h.Reset()
+	h.Write(r.ca.RawSubject)
+	if !bytes.Equal(h.Sum(nil), id.NameHash) || !bytes.Equal(keyHash, id.IssuerKeyHash) {
+		return unknown, nil
+	}
+
+	entry := findIndex(entries, id.SerialNumber)
+	if entry == nil {
+		return unknown, nil
+	}
+	if entry.Status != INDEX_REVOKED {
+		return asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0}, nil
+	}
+
+	revoked, err := time.Parse(INDEX_TIME, strings.Split(entry.Revocation, ",")[0])
+	if err != nil {
+		return unknown, err
+	}
+	info, err := asn1.MarshalWithParams(ocspRevokedInfo{revoked, asn1.Enumerated(reasonCode(entry.reason()))}, "tag:1")
+	if err != nil {
+		return unknown, err
+	}
+	return asn1.RawValue{FullBytes: info}, nil
+}
+
+// issuerKeyHash returns the hash of the public key of the certificate,
+// without the algorithm.
+func issuerKeyHash(cert *x509.Certificate, h hash.Hash) ([]byte, error) {
+	var spki struct {
+		Algorithm pkix.AlgorithmIdentifier
+		PublicKey asn1.BitString
+	}
+	if _, err := asn1.Unmarshal(cert.RawSubjectPublicKeyInfo, &spki); err != nil {
+		return nil, err
+	}
+	h.Write(spki.PublicKey.RightAlign())
+	return h.Sum(nil), nil
+}
+
+// reasonCode returns the code of the reason of revocation; "unspecified"
+// whether it is unknown.
+func reasonCode(reason string) int {
+	for code, name := range crlReasons {
+		if strings.EqualFold(name, reason) {
+			return code
+		}
+	}
+	return 0
+}
@@ -0,0 +1,263 @@
+// Copyright 2014 Jonas mg
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/xml"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/tredoe/easycert/store"
+	"github.com/tredoe/flagplus"
+)
+
+var cmdPins = &flagplus.Subcommand{
+	UsageLine: "pins [-o list|okhttp|android|hpkp] [-readonly] NAME...",
+	Short:     "export the pins of the public keys",
+	Long: `
+"pins" prints the pins of the public keys of the certificates (the SHA-256 hash
+in base64 of the SubjectPublicKeyInfo, like in "info -spki") together with the
+pins of their backup keys, so the clients which pin the keys keep working when
+a certificate is replaced by one with the backup key.
+
+The backup key of NAME is placed in "private/backup/NAME.key", and it is
+generated automatically whether it does not exist yet, unless the certificates
+directory is read-only. It is used by the next certificate with "req
+-backup-key -reissue NAME", and then a new backup key is generated by the next
+run of "pins".
+
+The pin set is printed like a list by default, or with "-o":
+
+	okhttp   the Java code of a CertificatePinner of OkHttp
+	android  the network security configuration of Android, whose pin set
+	         expires with the certificate
+	hpkp     the header "Public-Key-Pins" of HTTP, of 60 days
+
+The pins are set for the DNS names of the certificate, or for NAME whether it
+has none.
+`,
+	Run: runPins,
+}
+
+// Formats of the pin sets.
+const (
+	PINS_LIST    = "list"
+	PINS_OKHTTP  = "okhttp"
+	PINS_ANDROID = "android"
+	PINS_HPKP    = "hpkp"
+)
+
+// HPKP_MAX_AGE is the time, in seconds, that the pins are kept by the browsers.
+const HPKP_MAX_AGE = 60 * 24 * 60 * 60
+
+func init() {
+	addFlags(cmdPins, "o", "readonly")
+}
+
+// pinSet represents the pins of a certificate and of its backup key.
+type pinSet struct {
+	Name     string
+	Hosts    []string
+	NotAfter time.Time
+	Pin      string
+	Backup   string
+}
+
+func runPins(cmd *flagplus.Subcommand, args []string) {
+	if len(args) == 0 {
+		log.Print("Missing required argument: NAME")
+		cmd.Usage()
+	}
+	if *Format == "" {
+		*Format = PINS_LIST
+	}
+	switch *Format {
+	case PINS_LIST, PINS_OKHTTP, PINS_ANDROID, PINS_HPKP:
+	default:
+		log.Fatalf("Invalid value %q for flag -o: it has to be %q, %q, %q or %q",
+			*Format, PINS_LIST, PINS_OKHTTP, PINS_ANDROID, PINS_HPKP)
+	}
+
+	sets := make([]*pinSet, len(args))
+	for i, name := range args {
+		set, err := newPinSet(name)
+		if err != nil {
+			log.Fatal(err)
+		}
+		sets[i] = set
+	}
+
+	switch *Format {
+	case PINS_OKHTTP:
+		fmt.Print(pinsOkHttp(sets))
+	case PINS_ANDROID:
+		fmt.Print(pinsAndroid(sets))
+	case PINS_HPKP:
+		fmt.Print(pinsHPKP(sets))
+	default:
+		tw := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+		for _, v := range sets {
+			fmt.Fprintf(tw, "%s\tcurrent\t%s\n", v.Name, v.Pin)
+			if v.Backup != "" {
+				fmt.Fprintf(tw, "%s\tbackup\t%s\n", v.Name, v.Backup)
+			}
+		}
+		tw.Flush()
+	}
+}
+
+// newPinSet returns the pins of the certificate `name` and of its backup key,
+// which is generated whether it does not exist and the certificates directory
+// is writable.
+func newPinSet(name string) (*pinSet, error) {
+	setCertPath(name)
+	cert, err := parseCertFile(File.Cert)
+	if err != nil {
+		return nil, err
+	}
+
+	set := &pinSet{
+		Name:     name,
+		Hosts:    cert.DNSNames,
+		NotAfter: cert.NotAfter,
+		Pin:      store.SPKIPin(cert.RawSubjectPublicKeyInfo),
+	}
+	if len(set.Hosts) == 0 {
+		set.Hosts = []string{name}
+	}
+
+	file := backupKeyFile(name)
+	if _, err = os.Stat(file); os.IsNotExist(err) {
+		operator := currentOperator()
+		if readOnly() || checkEdition(ACTION_REQUEST) != nil ||
+			checkRole(loadStoreConfig(), operator, ACTION_REQUEST) != nil {
+			log.Printf("No backup key for %q", name)
+			return set, nil
+		}
+		if err = genBackupKey(file); err != nil {
+			return nil, err
+		}
+		audit(operator, ACTION_REQUEST, name, "backup key")
+	}
+
+	pub, err := readPublicKey(file)
+	if err != nil {
+		return nil, err
+	}
+	if pub == nil {
+		return nil, fmt.Errorf("backup key encrypted: %q", file)
+	}
+	spki, err := x509.MarshalPKIXPublicKey(pub)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", file, err)
+	}
+	set.Backup = store.SPKIPin(spki)
+	return set, nil
+}
+
+// backupKeyFile returns the file of the backup key of `name`.
+func backupKeyFile(name string) string {
+	return filepath.Join(Dir.Backup, name+EXT_KEY)
+}
+
+// genBackupKey generates a key, of the type of the flags "-key-type",
+// "-rsa-size" and "-curve".
+func genBackupKey(file string) error {
+	fipsCheckKeySpec(&KeySpec)
+	if err := os.MkdirAll(Dir.Backup, 0700); err != nil {
+		return err
+	}
+
+	beginIssuance()
+	tmpFile := mustTempFile(file)
+	opensslProgress(keygenMessage(), append([]string{"genpkey", "-out", tmpFile},
+		KeySpec.genpkeyArgs()...)...)
+	mustCommitFile(tmpFile, file, 0400)
+	commitIssuance()
+
+	fmt.Fprintf(os.Stderr, "* Backup key generated: %q\n", file)
+	return nil
+}
+
+// pinHash returns the hash in base64 of the pin, without the prefix.
+func pinHash(pin string) string {
+	return strings.TrimPrefix(pin, store.PIN_PREFIX)
+}
+
+// pins returns the pins of the set.
+func (s *pinSet) pins() []string {
+	if s.Backup == "" {
+		return []string{s.Pin}
+	}
+	return []string{s.Pin, s.Backup}
+}
+
+// pinsOkHttp returns the Java code to build a CertificatePinner of OkHttp.
+func pinsOkHttp(sets []*pinSet) string {
+	var buf bytes.Buffer
+
+	buf.WriteString("CertificatePinner certificatePinner = new CertificatePinner.Builder()\n")
+	for _, v := range sets {
+		for _, host := range v.Hosts {
+			for _, pin := range v.pins() {
+				fmt.Fprintf(&buf, "\t.add(%q, %q)\n", host, pin)
+			}
+		}
+	}
+	buf.WriteString("\t.build();\n")
+	return buf.String()
+}
+
+// pinsAndroid returns the network security configuration of Android.
+func pinsAndroid(sets []*pinSet) string {
+	var buf bytes.Buffer
+
+	buf.WriteString(xml.Header)
+	buf.WriteString("<network-security-config>\n")
+	for _, v := range sets {
+		buf.WriteString("\t<domain-config>\n")
+		for _, host := range v.Hosts {
+			buf.WriteString("\t\t<domain includeSubdomains=\"false\">")
+			xml.EscapeText(&buf, []byte(host))
+			buf.WriteString("</domain>\n")
+		}
+		fmt.Fprintf(&buf, "\t\t<pin-set expiration=\"%s\">\n", v.NotAfter.UTC().Format("2006-01-02"))
+		for _, pin := range v.pins() {
+			fmt.Fprintf(&buf, "\t\t\t<pin digest=\"SHA-256\">%s</pin>\n", pinHash(pin))
+		}
+		buf.WriteString("\t\t</pin-set>\n\t</domain-config>\n")
+	}
+	buf.WriteString("</network-security-config>\n")
+	return buf.String()
+}
+
+// pinsHPKP returns the header "Public-Key-Pins" of every certificate.
+func pinsHPKP(sets []*pinSet) string {
+	var buf bytes.Buffer
+
+	for i, v := range sets {
+		if len(sets) > 1 {
+			if i != 0 {
+				buf.WriteString("\n")
+			}
+			fmt.Fprintf(&buf, "# %s\n", strings.Join(v.Hosts, ", "))
+		}
+		buf.WriteString("Public-Key-Pins:")
+		for _, pin := range v.pins() {
+			fmt.Fprintf(&buf, " pin-sha256=%q;", pinHash(pin))
+		}
+		fmt.Fprintf(&buf, " max-age=%d\n", HPKP_MAX_AGE)
+	}
+	return buf.String()
+}
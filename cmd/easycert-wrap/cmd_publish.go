@@ -0,0 +1,176 @@
+// Copyright 2014 Jonas mg
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"encoding/json"
+	"encoding/pem"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/tredoe/flagplus"
+)
+
+var cmdPublish = &flagplus.Subcommand{
+	UsageLine: "publish (-s3 bucket/prefix | -gcs bucket/prefix) [-dry-run]",
+	Short:     "upload the public certificates to object storage",
+	Long: `
+"publish" uploads the certificates, their chains and the revocation lists to
+Amazon S3 or Google Cloud Storage, so they can be got by the fleet of servers.
+The private keys are never uploaded.
+
+The layout under the prefix is stable:
+
+	index.json        public information of all certificates
+	certs/NAME.crt    certificate in PEM format
+	certs/NAME.cer    certificate in DER format
+	chains/NAME.pem   certificate followed by the CA certificates
+	crl/FILE          revocation lists
+
+It uses the commands "aws" or "gsutil", which have to be configured with the
+credentials. The flag "-dry-run" lists the files instead of uploading them.
+`,
+	Run: runPublish,
+}
+
+var (
+	S3  = flag.String("s3", "", "bucket and prefix of Amazon S3")
+	GCS = flag.String("gcs", "", "bucket and prefix of Google Cloud Storage")
+)
+
+func init() {
+	addFlags(cmdPublish, "s3", "gcs", "dry-run", "readonly")
+}
+
+// Content types of the files published.
+const (
+	MIME_PEM  = "application/x-pem-file"
+	MIME_CERT = "application/pkix-cert"
+	MIME_CRL  = "application/pkix-crl"
+	MIME_JSON = "application/json"
+)
+
+// publishFile represents a file to upload.
+type publishFile struct {
+	archiveFile
+	contentType string
+}
+
+func runPublish(cmd *flagplus.Subcommand, args []string) {
+	if (*S3 == "") == (*GCS == "") {
+		log.Print("Missing required flag: -s3 or -gcs")
+		cmd.Usage()
+	}
+
+	files := publishFiles()
+	for _, f := range files {
+		if err := checkNoKey(f.data); err != nil {
+			log.Fatalf("%s: %s", f.name, err)
+		}
+	}
+
+	if *IsDryRun {
+		for _, f := range files {
+			fmt.Printf("%-40s %s\n", f.name, f.contentType)
+		}
+		return
+	}
+
+	dir, err := os.MkdirTemp("", PROGRAM+"-publish-")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	fmt.Print("\n== Publish\n\n")
+	for i, f := range files {
+		file := filepath.Join(dir, fmt.Sprintf("%d", i))
+		if err = os.WriteFile(file, f.data, 0644); err != nil {
+			log.Fatal(err)
+		}
+
+		var dst string
+		if *S3 != "" {
+			dst = "s3://" + path.Join(*S3, f.name)
+			execCmd(nil, lookTool("aws"), "s3", "cp", "--only-show-errors",
+				"--content-type", f.contentType, file, dst)
+		} else {
+			dst = "gs://" + path.Join(*GCS, f.name)
+			execCmd(nil, lookTool("gsutil"), "-q", "-h", "Content-Type:"+f.contentType,
+				"cp", file, dst)
+		}
+		fmt.Printf("- Uploaded:\t%q\n", dst)
+	}
+}
+
+// lookTool returns the path of the program, exiting whether it is not
+// installed.
+func lookTool(name string) string {
+	cmdPath, err := exec.LookPath(name)
+	if err != nil {
+		log.Fatalf("%s is not installed", name)
+	}
+	return cmdPath
+}
+
+// publishFiles returns the public files of the certificates directory, with
+// the layout to publish them.
+func publishFiles() []publishFile {
+	var files []publishFile
+	var index []*CertInfo
+
+	certs := loadCerts()
+	issuers := chainCerts()
+	for _, c := range certs {
+		certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c.Cert.Raw})
+		chainPEM := certPEM
+		for _, v := range chainOf(c.Cert, issuers) {
+			chainPEM = append(chainPEM, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: v.Cert.Raw})...)
+		}
+
+		files = append(files,
+			publishFile{archiveFile{"certs/" + c.Name + EXT_CERT, certPEM}, MIME_PEM},
+			publishFile{archiveFile{"certs/" + c.Name + ".cer", c.Cert.Raw}, MIME_CERT},
+			publishFile{archiveFile{"chains/" + c.Name + ".pem", chainPEM}, MIME_PEM},
+		)
+		index = append(index, newCertInfo(c.Name, c.Cert))
+	}
+
+	entries, err := os.ReadDir(Dir.Revok)
+	if err != nil && !os.IsNotExist(err) {
+		log.Fatal(err)
+	}
+	for _, v := range entries {
+		if v.IsDir() || strings.HasPrefix(v.Name(), ".") {
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(Dir.Revok, v.Name()))
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		contentType := MIME_CRL
+		if block, _ := pem.Decode(data); block != nil {
+			contentType = MIME_PEM
+		}
+		files = append(files, publishFile{archiveFile{"crl/" + v.Name(), data}, contentType})
+	}
+
+	data, err := json.MarshalIndent(index, "", "\t")
+	if err != nil {
+		log.Fatal(err)
+	}
+	files = append(files, publishFile{archiveFile{"index.json", append(data, '\n')}, MIME_JSON})
+
+	return files
+}
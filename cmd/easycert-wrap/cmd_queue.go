@@ -0,0 +1,173 @@
+// Copyright 2014 Jonas mg
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/tredoe/flagplus"
+)
+
+var cmdQueue = &flagplus.Subcommand{
+	UsageLine: "queue [-all] [-attestation file] [FILE NAME]",
+	Short:     "list or add requests pending of approval",
+	Long: `
+"queue" lists the certificate requests which are pending of approval, or adds
+the request in FILE to the queue to issue the certificate NAME.
+The requests received from the portal and the files "NAME.csr" placed in the
+directory "queue/drop" land in the queue too.
+
+Use "approve" or "deny" to review them.
+
+The flag "-attestation" attaches the attestation statement of the key (TPM,
+Android or Apple key attestation), which is verified when the request is queued
+and before of approving it. The chains of certificates of Android and Apple, in
+PEM or DER and starting with the certificate of the attested key, are verified
+against the roots of Google and Apple, and that key has to be the one of the
+request; the keys of Android have to be in secure hardware (TEE or StrongBox).
+The rest of statements (i.e. TPM) are verified by the executable
+"verify-attestation" of the hooks directory; the statement is passed in the
+environment variable EASYCERT_ATTESTATION and the request in EASYCERT_REQUEST.
+The hook has to check that the attested key is the one of the request, passed in
+EASYCERT_SPKI (SubjectPublicKeyInfo in DER, in base64) and its SHA-256 in
+EASYCERT_SPKI_SHA256 (in hexadecimal).
+Whether the field "require_attestation" of "store.json" is set, only the
+requests with an attestation verified are signed.
+`,
+	Run: runQueue,
+}
+
+var cmdApprove = &flagplus.Subcommand{
+	UsageLine: "approve [-years number] [-stagger window] [-passin source] [-batch] ID...",
+	Short:     "approve a pending request",
+	Long: `
+"approve" signs certificate requests of the queue using the CA. Like in "sign",
+the expirations of the requests approved together can be spread out with the
+flag "-stagger".
+`,
+	Run: runApprove,
+}
+
+var cmdDeny = &flagplus.Subcommand{
+	UsageLine: "deny ID",
+	Short:     "deny a pending request",
+	Long: `
+"deny" rejects a certificate request of the queue.
+`,
+	Run: runDeny,
+}
+
+var IsAll = flag.Bool("all", false, "all of them")
+
+func init() {
+	addFlags(cmdQueue, "all", "attestation", "readonly")
+	addFlags(cmdApprove, "years", "stagger", "passin", "batch")
+}
+
+func runQueue(cmd *flagplus.Subcommand, args []string) {
+	if len(args) != 0 && len(args) != 2 {
+		log.Print("Wrong number of arguments")
+		cmd.Usage()
+	}
+
+	if len(args) == 2 {
+		mustWritable()
+
+		data, err := os.ReadFile(args[0])
+		if err != nil {
+			log.Fatal(err)
+		}
+		var attestation []byte
+		if *AttestFile != "" {
+			if attestation, err = os.ReadFile(*AttestFile); err != nil {
+				log.Fatal(err)
+			}
+		}
+		r, err := addQueue(args[1], data, attestation, "file", currentOperator())
+		if err != nil {
+			log.Fatal(err)
+		}
+		fmt.Printf("* Request added to queue: %s\n", r.ID)
+		return
+	}
+
+	if err := dropQueue(currentOperator()); err != nil {
+		log.Fatal(err)
+	}
+	list, err := listQueue()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	for _, r := range list {
+		if r.Status != STATUS_PENDING && !*IsAll {
+			continue
+		}
+		fmt.Printf("%s\t%-8s\t%s\t%s\t%s\n", r.ID, r.Status, r.Name, r.Source, r.Subject)
+	}
+}
+
+func runApprove(cmd *flagplus.Subcommand, args []string) {
+	mustWritable()
+	if len(args) == 0 {
+		log.Print("Missing required argument: ID")
+		cmd.Usage()
+	}
+	b := newBatch(len(args))
+
+	for i, id := range args {
+		r := pendingQueue(id)
+
+		if err := r.verifyAttestation(); err != nil {
+			log.Fatal(err)
+		}
+		setCertPath(r.Name)
+		File.Request = r.fileCSR()
+		b.next(i, r.Name)
+		SignReq()
+		b.add(r.Name)
+
+		if err := r.setStatus(STATUS_APPROVED); err != nil {
+			log.Fatal(err)
+		}
+	}
+	b.save()
+}
+
+func runDeny(cmd *flagplus.Subcommand, args []string) {
+	r := queueArg(cmd, args)
+
+	if err := r.deny(currentOperator()); err != nil {
+		log.Fatal(err)
+	}
+	fmt.Printf("* Request denied: %s\n", r.ID)
+}
+
+// queueArg returns the pending request whose identifier is in the arguments.
+func queueArg(cmd *flagplus.Subcommand, args []string) *queueReq {
+	mustWritable()
+	if len(args) != 1 {
+		log.Print("Missing required argument: ID")
+		cmd.Usage()
+	}
+	return pendingQueue(args[0])
+}
+
+// pendingQueue returns the pending request with the identifier.
+func pendingQueue(id string) *queueReq {
+	r, err := getQueue(id)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if r.Status != STATUS_PENDING {
+		log.Fatal(errQueueDone)
+	}
+	return r
+}
@@ -0,0 +1,125 @@
+// Copyright 2014 Jonas mg
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+
+	"github.com/tredoe/flagplus"
+)
+
+var cmdRecover = &flagplus.Subcommand{
+	UsageLine: "recover -escrow-key file [-out file] NAME",
+	Short:     "recover a private key from escrow",
+	Long: `
+"recover" decrypts the private key of NAME stored in escrow, using the private
+key of escrow. The key is written to the private keys directory, unless it is
+used "-out".
+
+The escrow is off by default. It is enabled with the field "escrow" of the file
+"store.json", where "cert" is the certificate whose public key wraps the private
+keys generated by "req", and "names" are the patterns of the names which need
+escrow (i.e. the certificates for S/MIME); all names whether it is empty:
+
+	{
+		"escrow": {
+			"cert": "escrow",
+			"names": ["mail-*"]
+		}
+	}
+`,
+	Run: runRecover,
+}
+
+var EscrowKey = flag.String("escrow-key", "", "private key of escrow")
+
+func init() {
+	addFlags(cmdRecover, "escrow-key", "out")
+}
+
+// EscrowConfig represents the configuration of the escrow of private keys.
+type EscrowConfig struct {
+	Cert  string   `json:"cert"`  // name or file of the escrow certificate
+	Names []string `json:"names"` // patterns of names; all whether it is empty
+}
+
+// match reports whether the private key of `name` has to be in escrow.
+func (cfg *EscrowConfig) match(name string) bool {
+	if len(cfg.Names) == 0 {
+		return true
+	}
+	for _, v := range cfg.Names {
+		if ok, _ := path.Match(v, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// escrowFile returns the file where it is stored the private key in escrow.
+func escrowFile(name string) string {
+	return filepath.Join(Dir.Escrow, name+EXT_KEY+".cms")
+}
+
+// escrowKey wraps the private key of `name` with the public key of escrow,
+// whether it is configured.
+func escrowKey(name string) {
+	cfg := loadStoreConfig().Escrow
+	if cfg == nil || !cfg.match(name) {
+		return
+	}
+
+	cert := cfg.Cert
+	if cert[0] != '.' && cert[0] != os.PathSeparator {
+		cert = filepath.Join(Dir.Cert, cert+EXT_CERT)
+	}
+
+	if err := os.MkdirAll(Dir.Escrow, 0700); err != nil {
+		fatal(err)
+	}
+	file := mustTempFile(escrowFile(name))
+	openssl("cms", "-encrypt", "-binary", "-aes256", "-outform", "PEM",
+		"-in", File.Key, "-out", file, cert)
+	mustCommitFile(file, escrowFile(name), 0600)
+
+	fmt.Printf("- Escrow:\t%q\n", escrowFile(name))
+}
+
+func runRecover(cmd *flagplus.Subcommand, args []string) {
+	if len(args) != 1 {
+		log.Print("Missing required argument: NAME")
+		cmd.Usage()
+	}
+	if *EscrowKey == "" {
+		log.Print("Missing required flag: -escrow-key")
+		cmd.Usage()
+	}
+	operator := mustRole(ACTION_RECOVER)
+	setCertPath(args[0])
+
+	out := *Out
+	if out == "" {
+		out = File.Key
+	}
+	if _, err := os.Stat(out); !os.IsNotExist(err) {
+		log.Fatalf("File already exists: %q", out)
+	}
+
+	keyFile := createKeyFile(out)
+	openssl("cms", "-decrypt", "-inform", "PEM",
+		"-in", escrowFile(args[0]), "-inkey", *EscrowKey, "-out", keyFile)
+
+	mustCommitFile(keyFile, out, 0400)
+	audit(operator, ACTION_RECOVER, args[0], "")
+
+	fmt.Printf("\n== Recovered\n- Private key:\t%q\n", out)
+}
@@ -0,0 +1,171 @@
+// Copyright 2014 Jonas mg
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"text/tabwriter"
+
+	"github.com/tredoe/easycert/client"
+	"github.com/tredoe/flagplus"
+)
+
+var cmdRemote = &flagplus.Subcommand{
+	UsageLine: "remote -url url [-token string] [-ca name] list | submit [-attestation file] NAME FILE | approve ID | deny ID | cert [-out file] ID",
+	Short:     "handle the queue of a remote portal",
+	Long: `
+"remote" uses the REST API of a portal (see "serve") at the URL given in "-url",
+instead of the local certificates directory:
+
+	list     lists the requests of the queue
+	submit   adds the certificate request in FILE to issue the certificate NAME
+	approve  signs the request ID
+	deny     denies the request ID
+	cert     prints the certificate issued for the request ID, or writes it in
+	         "-out"
+
+To approve or deny, it is used the token of the administrators given in
+"-token". The server certificate of the portal is verified with the roots of
+the system and the CA given in "-ca", whether it exists. The URL and the token
+are got too from the environment variables EASYCERT_REMOTE and
+EASYCERT_REMOTE_TOKEN, and the operator is authenticated with the certificate
+named in EASYCERT_REMOTE_CERT (see "init").
+
+The API is described in OpenAPI at "/api/v1/openapi.json" of the portal, and
+the programs in Go can use it through the package
+"github.com/tredoe/easycert/client".
+`,
+	Run: runRemoteAPI,
+}
+
+var PortalURL = flag.String("url", "", "URL of the portal")
+
+func init() {
+	addFlags(cmdRemote, "url", "token", "ca", "attestation", "out")
+}
+
+func runRemoteAPI(cmd *flagplus.Subcommand, args []string) {
+	if *PortalURL == "" {
+		*PortalURL = os.Getenv(ENV_REMOTE)
+	}
+	if *Token == "" {
+		*Token = os.Getenv(ENV_REMOTE_TOKEN)
+	}
+	if len(args) == 0 || *PortalURL == "" {
+		log.Print("Missing required arguments: -url url ACTION")
+		cmd.Usage()
+	}
+	c := client.New(*PortalURL, *Token)
+	c.HTTPClient = remoteHTTPClient()
+
+	nArgs := map[string]int{"list": 1, "submit": 3, "approve": 2, "deny": 2, "cert": 2}
+	n, ok := nArgs[args[0]]
+	if !ok {
+		log.Fatalf("Unknown action: %q", args[0])
+	}
+	if len(args) != n {
+		log.Print("Wrong number of arguments")
+		cmd.Usage()
+	}
+
+	var req *client.Request
+	var err error
+
+	switch args[0] {
+	case "list":
+		var list []*client.Request
+		if list, err = c.List(); err != nil {
+			log.Fatal(err)
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+		fmt.Fprintln(w, "ID\tNAME\tSTATUS\tSOURCE\tSUBMITTED")
+		for _, v := range list {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n",
+				v.ID, v.Name, v.Status, v.Source, v.Submitted.Format("2006-01-02 15:04"))
+		}
+		w.Flush()
+		return
+	case "submit":
+		s := client.Submission{Name: args[1]}
+		var data []byte
+		if data, err = os.ReadFile(args[2]); err != nil {
+			log.Fatal(err)
+		}
+		s.CSR = string(data)
+		if *AttestFile != "" {
+			if data, err = os.ReadFile(*AttestFile); err != nil {
+				log.Fatal(err)
+			}
+			s.Attestation = string(data)
+		}
+		req, err = c.Submit(s)
+	case "approve":
+		req, err = c.Approve(args[1])
+	case "deny":
+		req, err = c.Deny(args[1])
+	case "cert":
+		var data []byte
+		if data, err = c.Cert(args[1]); err != nil {
+			log.Fatal(err)
+		}
+		if *Out == "" {
+			os.Stdout.Write(data)
+			return
+		}
+		if err = writeFileAtomic(*Out, data, 0644); err != nil {
+			log.Fatal(err)
+		}
+		fmt.Printf("== Downloaded\n- Certificate:\t%q\n", *Out)
+		return
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Printf("* Request %s (%s): %s\n", req.ID, req.Name, req.Status)
+}
+
+// remoteHTTPClient returns the client of HTTP which trusts the roots of the
+// system plus the CA, whether it exists, and which is authenticated with the
+// certificate set in EASYCERT_REMOTE_CERT, whether it is set.
+func remoteHTTPClient() *http.Client {
+	config := new(tls.Config)
+
+	data, err := os.ReadFile(caFile(*CACert))
+	if err == nil {
+		if config.RootCAs, err = x509.SystemCertPool(); err != nil {
+			config.RootCAs = x509.NewCertPool()
+		}
+		if !config.RootCAs.AppendCertsFromPEM(data) {
+			log.Fatalf("No certificate in %q", caFile(*CACert))
+		}
+	} else if !os.IsNotExist(err) {
+		log.Fatal(err)
+	}
+
+	if name := os.Getenv(ENV_REMOTE_CERT); name != "" {
+		pair, err := tls.LoadX509KeyPair(filepath.Join(Dir.Cert, name+EXT_CERT),
+			filepath.Join(Dir.Key, name+EXT_KEY))
+		if err != nil {
+			log.Fatalf("Certificate of %s: %s", ENV_REMOTE_CERT, err)
+		}
+		config.Certificates = []tls.Certificate{pair}
+	}
+
+	if config.RootCAs == nil && config.Certificates == nil {
+		return http.DefaultClient
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = config
+	return &http.Client{Transport: transport}
+}
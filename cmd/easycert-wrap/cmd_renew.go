@@ -0,0 +1,204 @@
+// Copyright 2014 Jonas mg
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/tredoe/easycert"
+	"github.com/tredoe/flagplus"
+)
+
+var cmdRenew = &flagplus.Subcommand{
+	UsageLine: "renew [-years number] [-reuse-key] [-passin source] [-backend name] [-batch] NAME",
+	Short:     "reissue a certificate with the same subject and hostnames",
+	Long: `
+"renew" reissues the certificate NAME: the request is generated from the
+current certificate, with the same subject and subject alternative names (the
+hostnames and IP addresses), and a new private key of the same type and size,
+and then it is signed by the CA which issued it, with the validity of "-years".
+
+The current certificate and its private key are kept like a previous version
+(see "sign -reissue"). With the flag "-reuse-key", the current private key is
+used for the new request instead of generating one, so only the certificate is
+kept like a previous version; it is the way to renew the certificates whose keys
+can not be generated in the host of the CA ("no_server_keygen").
+
+Whether the current private key is encrypted ("req -encrypt-key"), the new one
+is encrypted too, with the passphrase prompted or got from the source of
+"-passin", like in "req".
+
+The nameless certificates ("req -spki" and "req -saml") and the ones of the
+protocols ("req -protocol") are renewed with their profile; the device
+identities ("req -hw-type"), the certificates of the challenge TLS-ALPN-01 and
+the CAs are not renewed.
+`,
+	Run: runRenew,
+}
+
+var IsReuseKey = flag.Bool("reuse-key", false, "use the current private key")
+
+func init() {
+	addFlags(cmdRenew, "years", "reuse-key", "passin", "backend", "batch")
+}
+
+func runRenew(cmd *flagplus.Subcommand, args []string) {
+	if len(args) != 1 {
+		log.Print("Missing required argument: NAME")
+		cmd.Usage()
+	}
+	operator := mustRole(ACTION_REQUEST)
+	if !*IsReuseKey && loadStoreConfig().NoServerKeygen {
+		log.Fatal("The private keys can not be generated in this host (\"no_server_keygen\")\n" +
+			"  Use \"-reuse-key\" to renew with the current private key")
+	}
+	mustAttestationNotRequired()
+
+	name := args[0]
+	setCertPath(name)
+	cert, err := parseCertFile(File.Cert)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if cert.IsCA {
+		log.Fatalf("The certificate of a CA is not renewed: %q", name)
+	}
+	if cert.Subject.SerialNumber != "" {
+		log.Fatalf("The device identities are not renewed: %q\n\n  Use \"req -reissue\"", name)
+	}
+	if _, err = os.Stat(File.Request); !os.IsNotExist(err) {
+		log.Fatalf("Certificate request already exists: %q", File.Request)
+	}
+	useCA(renewIssuer(cert))
+
+	// The new key is encrypted like the current one.
+	if data, err := os.ReadFile(File.Key); err == nil {
+		if block, _ := pem.Decode(data); block != nil && isEncryptedKey(block) {
+			*IsEncryptKey = true
+		}
+	}
+	reqPassIn, *PassIn = *PassIn, ""
+	if reqPassIn != "" && !*IsEncryptKey {
+		log.Fatalf("Flag -passin is only used whether the private key is encrypted: %q", name)
+	}
+
+	// The profile of the request, like in "state".
+	Host = hostFlag{}
+	for _, v := range cert.DNSNames {
+		Host.dns = append(Host.dns, "DNS:"+v)
+	}
+	for _, ip := range cert.IPAddresses {
+		Host.ip = append(Host.ip, "IP:"+ip.String())
+	}
+	if *Protocol = certProtocol(cert); *Protocol == PROTOCOL_TLS_ALPN {
+		log.Fatalf("The certificates of the challenge TLS-ALPN-01 are not renewed: %q", name)
+	}
+	if *Protocol == PROTOCOL_DC {
+		if *Realm, *DCGUID, err = certDCIdentity(cert); err != nil {
+			log.Fatalf("%s: %s", name, err)
+		}
+	}
+	if Host.String() == "" {
+		if cert.KeyUsage == x509.KeyUsageDigitalSignature|x509.KeyUsageKeyEncipherment {
+			*IsSAML = true
+		} else if isCodeSigning(cert) {
+			*IsCodeSign = true
+		} else {
+			*IsSPKI = true
+		}
+	}
+	if !*IsReuseKey {
+		k, err := parseStateKey(stateKey(cert))
+		if err != nil {
+			log.Fatal(err)
+		}
+		KeySpec = *k
+		fipsCheckKeySpec(&KeySpec)
+	}
+
+	beginIssuance()
+	if err = archiveVersion(name, !*IsReuseKey); err != nil {
+		fatal(err)
+	}
+	// The versions are pruned once the new certificate is signed.
+	*IsReissue = true
+
+	if err = requestConfig(name); err != nil {
+		fatal(err)
+	}
+	keyFile := ""
+	if !*IsReuseKey {
+		keyFile = createKeyFile(File.Key)
+	}
+	reqFile := mustTempFile(File.Request)
+
+	if nativeBackend() {
+		if err = nativeWriteReq(cert.RawSubject, keyFile, reqFile); err != nil {
+			fatal(err)
+		}
+	} else {
+		subject, err := easycert.NameSubj(cert.RawSubject)
+		if err != nil {
+			fatal(err)
+		}
+		config, done := mustResolveConfig(File.SrvConfig)
+		defer done()
+
+		opensslArgs := []string{"req", "-new", "-batch", "-utf8",
+			"-config", config, "-subj", subject, "-out", reqFile,
+		}
+		if *IsReuseKey {
+			opensslArgs = append(opensslArgs, "-key", File.Key)
+			if *IsEncryptKey {
+				opensslArgs = append(opensslArgs, keyPassArgs("-passin")...)
+			}
+		} else if *IsEncryptKey {
+			genEncryptedKey(keyFile, keyPassArgs("-pass"))
+			opensslArgs = append(opensslArgs, "-key", keyFile)
+			opensslArgs = append(opensslArgs, keyPassArgs("-passin")...)
+		} else {
+			opensslArgs = append(opensslArgs, "-nodes", "-keyout", keyFile)
+			opensslArgs = append(opensslArgs, KeySpec.newkeyArgs()...)
+		}
+		opensslArgs = append(opensslArgs, fipsDigestArgs("req")...)
+		fmt.Printf("%s", opensslProgress(keygenMessage(), opensslArgs...))
+	}
+	if keyFile != "" {
+		mustCommitFile(keyFile, File.Key, 0400)
+	}
+	mustCommitFile(reqFile, File.Request, 0644)
+
+	fmt.Printf("\n== Generated\n- Request:\t%q\n", File.Request)
+	if keyFile != "" {
+		fmt.Printf("- Private key:\t%q\n", File.Key)
+		escrowKey(name)
+	}
+	audit(operator, ACTION_REQUEST, name, "renew")
+
+	SignReq()
+}
+
+// renewIssuer returns the name of the CA of the store which issued the
+// certificate, the root CA or an intermediate one.
+func renewIssuer(cert *x509.Certificate) string {
+	root, err := parseCertFile(caFile(NAME_CA))
+	if err != nil {
+		log.Fatal(err)
+	}
+	cas := append(loadIntermediates(), &storeCert{Name: NAME_CA, Cert: root})
+
+	issuer := issuerOf(cert, cas)
+	if issuer == nil {
+		log.Fatalf("The issuer of %q is not a CA of the store", certName())
+	}
+	return issuer.Name
+}
@@ -7,33 +7,154 @@
 package main
 
 import (
+	"context"
 	"errors"
 	"flag"
 	"fmt"
 	"log"
 	"net"
 	"os"
+	"regexp"
 	"strings"
 	"text/template"
+	"time"
 
 	"github.com/tredoe/flagplus"
 )
 
 var cmdReq = &flagplus.Subcommand{
-	UsageLine: "req [-sign] [-rsa-size bits] [-years number] [-host name1,...] NAME",
+	UsageLine: "req [-sign] [-reissue] [-backup-key | -encrypt-key [-passin source]] [-spki | -saml | -code-signing] [-protocol name [-key-authorization string | -realm name [-dc-guid guid]]] [-idevid] [-hw-type oid -hw-serial serial] [-key-type rsa|ecdsa] [-rsa-size bits] [-curve name] [-years number] [-host name1,...] [-validate-dns] [-challenge source] [-backend name] [-fips] [-batch] NAME | req -ephemeral [-key-type rsa|ecdsa] [-rsa-size bits] [-curve name] [-years number] [-host name1,...] [-validate-dns] NAME",
 	Short:     "create X509 certificate request",
 	Long: `
 "req" creates a X509 certificate signing request (CSR) to be signed by a CA.
+The challenge password is added like attribute of the request, as it is used by
+SCEP to authorize the enrollment. It is got from the source given in
+"-challenge", env:VAR or file:PATH like in "-passin", so it is not seen in the
+list of processes, and it has to have between 11 and 30 characters. It is
+removed from the configuration of the request once the request is generated.
+
+The private key is generated like in "ca": RSA of the size given in "-rsa-size",
+or ECDSA with "-key-type ecdsa" on the curve given in "-curve".
+
+The hostnames without domain given in "-host" are expanded with every suffix
+set in the field "auto_sans" of "store.json"; i.e. with
+[".svc.cluster.local", ".internal"], "web" adds "web.svc.cluster.local" and
+"web.internal". The name "localhost" is not expanded, since it is reserved for
+the loopback.
+
+With the flag "-validate-dns", the domain names have to resolve and the IP
+addresses have to resolve in reverse to a name which resolves to the same
+address (forward-confirmed), so a typo is caught before of deploying the
+certificate. The wildcards are checked through their parent domain.
+
+With the flag "-reissue", the current certificate and its private key are kept
+like a previous version (see "sign") before of generating the new key.
+With "-backup-key", the backup key of NAME made by "pins" is used instead of
+generating a new one, so the clients which pinned it keep working.
+
+The private key is written without encryption, only readable by the owner,
+unless it is used "-encrypt-key": then it is encrypted in AES-256 with a
+passphrase, which is prompted or got from the source of "-passin" ("env:VAR" or
+"file:PATH", like in OpenSSL), required in batch mode and by the native
+backend; the passphrase of the CA of "-sign" is got from EASYCERT_CA_PASS then.
+The commands which use the key through OpenSSL, like "export -p12", prompt for
+its passphrase, and "renew" encrypts the new key with "-passin".
+
+With the flag "-spki", the certificate is nameless: it has no hostnames, and its
+subject has only NAME like common name, without prompts. It is identified by the
+pin of its public key (the SHA-256 hash of the SubjectPublicKeyInfo), which is
+printed, so it is intended for the internal services which authenticate by key
+rather than by name, like through Unix domain sockets. The pin is printed too by
+"info -spki", and the package "store" verifies the peers by their pins.
+
+With the flag "-saml", the certificate is nameless too, but for the signing and
+encryption of the SAML messages and metadata: its key usage is restricted to
+digital signature and key encipherment. It is exported in the layouts of the
+SAML software with "export -layout", and it signs the metadata with
+"sign-metadata".
+
+With the flag "-code-signing", the certificate is nameless too, but for the
+signing of the releases: its key usage is restricted to digital signature, with
+the extended key usage of code signing. It is the dedicated certificate given in
+"export -sign -signer", since the bundles are only signed by the CA or by these
+certificates.
+
+With the flag "-ephemeral", the certificate is issued in memory by a new CA
+which only exists while the command runs, and the certificate, its private key
+and the certificate of the CA are printed in PEM format, without touching the
+certificates directory nor the disk, like for the tests or the one-shot runs.
+
+With the flag "-protocol", the certificate of the server has the extensions
+required by the protocol, instead of adding them to the configuration:
+
+	tls-alpn-01  the extension acmeIdentifier, critical, with the SHA-256
+	             digest of the key authorization given in "-key-authorization",
+	             for the responders of the challenge TLS-ALPN-01 of ACME (RFC
+	             8737); "-host" has to have a single domain name
+	rdp          the extended key usages of server authentication and Remote
+	             Desktop Authentication, which makes Windows choose the
+	             certificate for RDP
+	ldaps        the extended key usage of server authentication, required by
+	             the LDAP servers like Active Directory
+	dc           the profile of the domain controllers of Active Directory,
+	             for LDAPS and the Kerberos PKINIT (logon by smart card): the
+	             extended key usages of server and client authentication, KDC
+	             authentication and smart card logon, the certificate
+	             template "DomainController", and the subject alternative
+	             names of the DNS name of the domain and the principal
+	             "krbtgt/REALM@REALM" of the realm given in "-realm"; with
+	             "-dc-guid", the GUID of the object of the controller in the
+	             directory is added too
+
+The key usage of "rdp", "ldaps" and "dc" is restricted to digital signature and
+key encipherment. The native backend does not support "dc", whose names are
+otherNames; the certificate is imported in the domain controller with
+"deploy -dc". The protocol is kept by "renew", but for "tls-alpn-01", whose
+certificates are of a single challenge.
+
+With the flags "-hw-type" and "-hw-serial", the certificate is a device identity
+of IEEE 802.1AR for network equipment: the hardware module, its type (an OID)
+and its serial number, is added to the subject alternative names like the
+otherName hardwareModuleName (RFC 4108), the serial number is added to the
+subject, whose common name is NAME, and the key usage is restricted to digital
+signature and key encipherment. By default, it is a local identity (LDevID)
+with the validity of "-years"; with "-idevid", it is the initial identity
+(IDevID) installed by the manufacturer, which is signed without expiration
+(until 9999-12-31, as RFC 5280 defines for the identities of the life of the
+device).
+
+Whether the field "no_server_keygen" of "store.json" is set, the private keys
+are never generated in the host of the CA, so "req" fails; the requests have to
+be generated in the devices and added through "queue FILE NAME".
+
+With "-backend native", the key and the request are generated in Go instead of
+executing OpenSSL (see "ca"), without prompts: the subject is the one of batch
+mode. The challenge password and the device identities are not supported.
 `,
 	Run: runReq,
 }
 
+// SAML_KEY_USAGE is the extension of the certificates to sign and encrypt the
+// SAML messages.
+const SAML_KEY_USAGE = "keyUsage = critical, digitalSignature, keyEncipherment"
+
+// CODE_SIGNING_KEY_USAGE is the extension of the certificates to sign the
+// releases, like the exported bundles.
+const CODE_SIGNING_KEY_USAGE = "keyUsage = critical, digitalSignature\nextendedKeyUsage = codeSigning"
+
 var errHost = errors.New("must be an IP or DNS")
 
+// validDNS matches a domain name, with a wildcard in the first label optionally.
+var validDNS = regexp.MustCompile(`^(\*\.)?([A-Za-z0-9_]([A-Za-z0-9_-]*[A-Za-z0-9])?\.)+[A-Za-z0-9]([A-Za-z0-9-]*[A-Za-z0-9])?\.?$`)
+
+// validShortName matches a hostname without domain.
+var validShortName = regexp.MustCompile(`^[A-Za-z0-9]([A-Za-z0-9-]*[A-Za-z0-9])?$`)
+
 // hostFlag represents the hostname with IP addresses and/or domain names.
 type hostFlag struct {
-	ip  []string
-	dns []string
+	ip    []string
+	dns   []string
+	short []string // hostnames to expand with the suffixes of "auto_sans"
 }
 
 func (h *hostFlag) String() string {
@@ -52,8 +173,10 @@ func (h *hostFlag) Set(value string) error {
 
 		if ip := net.ParseIP(v); ip != nil {
 			h.ip = append(h.ip, "IP:"+ip.String())
-		} else if strings.ContainsRune(v, '.') {
+		} else if validDNS.MatchString(v) || strings.EqualFold(v, "localhost") {
 			h.dns = append(h.dns, "DNS:"+v)
+		} else if validShortName.MatchString(v) {
+			h.short = append(h.short, v)
 		} else {
 			return errHost
 		}
@@ -61,64 +184,388 @@ func (h *hostFlag) Set(value string) error {
 	return nil
 }
 
+// expand adds the domain names of the short hostnames, appending every suffix.
+func (h *hostFlag) expand(suffixes []string) error {
+	if len(h.short) != 0 && len(suffixes) == 0 {
+		return fmt.Errorf("Hostname without domain: %q\n\n"+
+			"  Set the suffixes to append in the field \"auto_sans\" of \"store.json\"", h.short[0])
+	}
+
+	for _, name := range h.short {
+		for _, suffix := range suffixes {
+			h.dns = append(h.dns, "DNS:"+name+suffix)
+		}
+	}
+	h.short = nil
+	return nil
+}
+
+// DNS_TIMEOUT is the time to wait for every lookup.
+const DNS_TIMEOUT = 10 * time.Second
+
+// validate checks that the domain names resolve, and that the IP addresses
+// resolve in reverse to a name which resolves to the same address.
+func (h *hostFlag) validate() error {
+	lookup := func(f func(context.Context) error) error {
+		ctx, cancel := context.WithTimeout(context.Background(), DNS_TIMEOUT)
+		defer cancel()
+		return f(ctx)
+	}
+
+	for _, v := range h.dns {
+		name := strings.TrimPrefix(strings.TrimPrefix(v, "DNS:"), "*.")
+
+		err := lookup(func(ctx context.Context) error {
+			_, err := net.DefaultResolver.LookupHost(ctx, name)
+			return err
+		})
+		if err != nil {
+			return fmt.Errorf("Hostname does not resolve: %s", err)
+		}
+	}
+
+	for _, v := range h.ip {
+		ip := net.ParseIP(strings.TrimPrefix(v, "IP:"))
+
+		err := lookup(func(ctx context.Context) error {
+			names, err := net.DefaultResolver.LookupAddr(ctx, ip.String())
+			if err != nil {
+				return err
+			}
+			for _, name := range names {
+				addrs, err := net.DefaultResolver.LookupIPAddr(ctx, name)
+				if err != nil {
+					continue
+				}
+				for _, addr := range addrs {
+					if addr.IP.Equal(ip) {
+						return nil
+					}
+				}
+			}
+			return fmt.Errorf("%s: no name resolves to the address (%s)", ip, strings.Join(names, ", "))
+		})
+		if err != nil {
+			return fmt.Errorf("IP address not forward-confirmed: %s", err)
+		}
+	}
+	return nil
+}
+
 var (
 	Host hostFlag
 
-	IsSign = flag.Bool("sign", false, "sign a certificate request")
+	IsSign      = flag.Bool("sign", false, "sign a certificate request, or a file with cms or export")
+	Challenge   = flag.String("challenge", "", "source of the challenge password to add to the request: env:VAR or file:PATH")
+	ValidateDNS = flag.Bool("validate-dns", false, "check that the hostnames and IPs resolve")
+	IsSPKI      = flag.Bool("spki", false, "nameless certificate, identified by the pin of its key")
+	IsSAML      = flag.Bool("saml", false, "nameless certificate to sign the SAML messages and metadata")
+	IsCodeSign  = flag.Bool("code-signing", false, "nameless certificate to sign the releases, like the exported bundles")
+	IsBackupKey = flag.Bool("backup-key", false, "use the backup key instead of generating a new one")
 )
 
 func init() {
 	flag.Var(&Host, "host", "comma-separated hostnames and IPs to generate a server certificate")
-	cmdReq.AddFlags("sign", "rsa-size", "years", "host")
+	addFlags(cmdReq, "sign", "reissue", "backup-key", "encrypt-key", "passin", "spki", "saml", "code-signing", "protocol", "key-authorization", "realm", "dc-guid", "idevid", "hw-type", "hw-serial", "key-type", "rsa-size", "curve", "years", "host", "validate-dns", "challenge", "backend", "fips", "batch", "ephemeral")
+}
+
+// runEphemeral issues the ephemeral certificate `name`, which is not recorded
+// in the certificates directory, so the roles of the operators do not apply.
+func runEphemeral(name string) {
+	if *IsSign || *IsReissue || *IsBackupKey || *IsEncryptKey || isNameless() ||
+		*Protocol != "" || isDevID() || *Challenge != "" {
+		log.Fatal("Flag -ephemeral is only used with -key-type, -rsa-size, -curve, -years, -host and -validate-dns")
+	}
+	if err := Host.expand(nil); err != nil {
+		log.Fatal(err)
+	}
+	if *ValidateDNS {
+		if err := Host.validate(); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if err := Ephemeral(os.Stdout, name); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// isNameless reports whether the certificate of the request has no hostnames,
+// being identified by its name only.
+func isNameless() bool {
+	return *IsSPKI || *IsSAML || *IsCodeSign
 }
 
 func runReq(cmd *flagplus.Subcommand, args []string) {
 	if len(args) != 1 {
 		log.Fatalf("Missing required argument: NAME\n\n  %s", cmd.UsageLine)
 	}
+	if *IsEphemeral {
+		runEphemeral(args[0])
+		return
+	}
+	operator := mustRole(ACTION_REQUEST)
+	if loadStoreConfig().NoServerKeygen {
+		log.Fatal("The private keys can not be generated in this host (\"no_server_keygen\")\n" +
+			"  Use \"queue FILE NAME\" to add a request generated outside")
+	}
+	if *IsSign {
+		mustAttestationNotRequired()
+	}
+	if (*IsSPKI && *IsSAML) || (*IsCodeSign && (*IsSPKI || *IsSAML)) {
+		log.Fatal("Flags -spki, -saml and -code-signing are exclusive")
+	}
+	// The source of "-passin" is the one of the private key of the request,
+	// so the CA's passphrase of "-sign" is got from the environment.
+	reqPassIn, *PassIn = *PassIn, ""
+	if reqPassIn != "" && !*IsEncryptKey {
+		log.Fatal("Flag -passin is only used by -encrypt-key")
+	}
+	if *IsEncryptKey && *IsBackupKey {
+		log.Fatal("Flags -encrypt-key and -backup-key are exclusive")
+	}
+	if err := checkDevID(); err != nil {
+		log.Fatal(err)
+	}
+	if isNameless() && isDevID() {
+		log.Fatal("A device identity can not be nameless (\"-spki\", \"-saml\" or \"-code-signing\")")
+	}
+	if isNameless() && Host.String() != "" {
+		log.Fatal("A nameless certificate (\"-spki\", \"-saml\" or \"-code-signing\") can not have hostnames")
+	}
+	if nativeBackend() && (*Challenge != "" || isDevID()) {
+		log.Fatal("The native backend does not support the challenge password nor the device identities")
+	}
+	if *Challenge != "" {
+		var err error
+		if reqChallenge, err = readChallenge(*Challenge); err != nil {
+			log.Fatal(err)
+		}
+	}
+	fipsCheckKeySpec(&KeySpec)
+	if err := Host.expand(loadStoreConfig().AutoSANs); err != nil {
+		log.Fatal(err)
+	}
+	if err := checkProtocol(); err != nil {
+		log.Fatal(err)
+	}
+	if *ValidateDNS {
+		if err := Host.validate(); err != nil {
+			log.Fatal(err)
+		}
+	}
 	setCertPath(args[0])
 
 	if _, err := os.Stat(File.Request); !os.IsNotExist(err) {
 		log.Fatalf("Certificate request already exists: %q", File.Request)
 	}
 
+	beginIssuance()
+	if *IsReissue {
+		if err := archiveVersion(args[0], true); err != nil {
+			fatal(err)
+		}
+	}
 	configFile := ""
 
-	if Host.String() != "" {
-		if err := serverConfig(); err != nil {
-			log.Fatal(err)
+	if Host.String() != "" || reqChallenge != "" || batchMode() || isNameless() || isDevID() || nativeBackend() {
+		if err := requestConfig(args[0]); err != nil {
+			fatal(err)
 		}
 		configFile = File.SrvConfig
 	} else {
 		configFile = File.Config
 	}
 
-	opensslArgs := []string{"req", "-new", "-nodes",
-		"-config", configFile, "-keyout", File.Key, "-out", File.Request,
-		"-newkey", "rsa:" + RSASize.String(),
+	var keyFile string
+
+	if *IsBackupKey {
+		if _, err := os.Stat(File.Key); !os.IsNotExist(err) {
+			fatalf("Private key already exists: %q", File.Key)
+		}
+		backup := backupKeyFile(args[0])
+		if _, err := os.Stat(backup); os.IsNotExist(err) {
+			fatalf("No backup key for %q; it is generated by \"pins\"", args[0])
+		}
+		// The backup key is moved back whether the issuance fails.
+		if err := os.Rename(backup, File.Key); err != nil {
+			fatal(err)
+		}
+		curIssuance.addRename(backup, File.Key)
+	} else {
+		keyFile = createKeyFile(File.Key)
 	}
-	fmt.Printf("%s", openssl(opensslArgs...))
+	reqFile := mustTempFile(File.Request)
 
-	if err := os.Chmod(File.Key, 0400); err != nil {
-		log.Print(err)
+	if nativeBackend() {
+		if err := nativeReq(args[0], keyFile, reqFile); err != nil {
+			fatal(err)
+		}
+	} else {
+		config, done := mustResolveConfig(configFile)
+		defer done()
+		var opensslArgs []string
+
+		if *IsBackupKey {
+			opensslArgs = []string{"req", "-new",
+				"-config", config, "-key", File.Key, "-out", reqFile,
+			}
+		} else if *IsEncryptKey {
+			genEncryptedKey(keyFile, keyPassArgs("-pass"))
+
+			opensslArgs = []string{"req", "-new",
+				"-config", config, "-key", keyFile, "-out", reqFile,
+			}
+			opensslArgs = append(opensslArgs, keyPassArgs("-passin")...)
+		} else {
+			opensslArgs = []string{"req", "-new", "-nodes",
+				"-config", config, "-keyout", keyFile, "-out", reqFile,
+			}
+			opensslArgs = append(opensslArgs, KeySpec.newkeyArgs()...)
+		}
+		opensslArgs = append(opensslArgs, fipsDigestArgs("req")...)
+		opensslArgs = append(opensslArgs, batchArgs()...)
+		if isDevID() {
+			opensslArgs = append(opensslArgs, "-subj", batchSubject(args[0], *HWSerial))
+		}
+		if (isNameless() || isDevID()) && !batchMode() {
+			opensslArgs = append(opensslArgs, "-batch")
+		}
+		if *IsBackupKey || *IsEncryptKey {
+			fmt.Printf("%s", openssl(opensslArgs...))
+		} else {
+			fmt.Printf("%s", opensslProgress(keygenMessage(), opensslArgs...))
+		}
+	}
+	if reqChallenge != "" {
+		if err := stripChallenge(File.SrvConfig); err != nil {
+			fatal(err)
+		}
+	}
+	if !*IsBackupKey {
+		mustCommitFile(keyFile, File.Key, 0400)
 	}
+	mustCommitFile(reqFile, File.Request, 0644)
 
 	fmt.Printf("\n== Generated\n- Request:\t%q\n- Private key:\t%q\n", File.Request, File.Key)
+	if *IsSPKI {
+		pin, err := filePin(File.Request, true)
+		if err != nil {
+			fatal(err)
+		}
+		fmt.Printf("- SPKI pin:\t%s\n", pin)
+	}
+	escrowKey(args[0])
+	audit(operator, ACTION_REQUEST, args[0], "")
 
 	if *IsSign {
 		SignReq()
+	} else {
+		commitIssuance()
+		if *IsReissue {
+			pruneVersions(args[0])
+		}
+	}
+}
+
+// requestConfig generates the configuration according for a server and/or
+// a request with challenge password. In batch mode, or for a nameless
+// certificate, the common name is `name` whether it is not a server.
+func requestConfig(name string) error {
+	hostname := ""
+	subjectAltName := ""
+	challenge := ""
+
+	if Host.String() != "" {
+		var err error
+
+		hostname, err = os.Hostname()
+		if err != nil {
+			return fmt.Errorf("Could not get hostname: %s\n\n"+
+				"You may want to fix your '/etc/hosts' and/or DNS setup",
+				err)
+		}
+		subjectAltName = "subjectAltName = " + Host.String()
+	}
+	if *IsSAML {
+		// The extensions are added in the section of the certificate, like the
+		// subject alternative names.
+		subjectAltName = SAML_KEY_USAGE
 	}
+	if *IsCodeSign {
+		subjectAltName = CODE_SIGNING_KEY_USAGE
+	}
+	if isDevID() {
+		subjectAltName = devIDExtensions(subjectAltName)
+	}
+	if *Protocol != "" {
+		subjectAltName = protocolExtensions(subjectAltName)
+	}
+	if reqChallenge != "" {
+		challenge = _CHALLENGE_DEFAULT + " = " + reqChallenge
+	}
+	if hostname == "" && (batchMode() || isNameless()) {
+		hostname = name
+	}
+
+	return writeRequestConfig(requestTemplate{hostname, subjectAltName, challenge})
 }
 
-// serverConfig generates the configuration according for a server.
-func serverConfig() error {
-	hostname, err := os.Hostname()
+// Limits of the length of the challenge password, like "challengePassword_min"
+// and "challengePassword_max" of the configuration.
+const (
+	CHALLENGE_MIN = 11
+	CHALLENGE_MAX = 30
+)
+
+// _CHALLENGE_DEFAULT is the field of the configuration with the challenge
+// password.
+const _CHALLENGE_DEFAULT = "challengePassword_default"
+
+// reqChallenge is the challenge password of the request, got from the source
+// of "-challenge".
+var reqChallenge string
+
+// readChallenge returns the challenge password of the source, checking its
+// length.
+func readChallenge(src string) (string, error) {
+	pass, err := readPassIn(src)
+	if err != nil {
+		return "", err
+	}
+	if n := len(pass); n < CHALLENGE_MIN || n > CHALLENGE_MAX {
+		return "", fmt.Errorf("the challenge password has %d characters; it has to have between %d and %d",
+			n, CHALLENGE_MIN, CHALLENGE_MAX)
+	}
+	return pass, nil
+}
+
+// stripChallenge removes the challenge password from the configuration of the
+// request, once the request has been generated.
+func stripChallenge(file string) error {
+	data, err := os.ReadFile(file)
 	if err != nil {
-		return fmt.Errorf("Could not get hostname: %s\n\n"+
-			"You may want to fix your '/etc/hosts' and/or DNS setup",
-			err)
+		return err
+	}
+	var lines []string
+	for _, v := range strings.Split(string(data), "\n") {
+		if !strings.HasPrefix(v, _CHALLENGE_DEFAULT) {
+			lines = append(lines, v)
+		}
 	}
+	return os.WriteFile(file, []byte(strings.Join(lines, "\n")), 0644)
+}
 
+// requestTemplate are the values of the template of the configuration of a
+// request.
+type requestTemplate struct {
+	HostName          string
+	SubjectAltName    string
+	ChallengePassword string
+}
+
+// writeRequestConfig writes the configuration of the request from the template
+// into the issuance in progress.
+func writeRequestConfig(data requestTemplate) error {
 	tmpl, err := template.ParseFiles(File.Config + ".tmpl")
 	if err != nil {
 		return fmt.Errorf("Parsing error in configuration: %s", err)
@@ -128,14 +575,8 @@ func serverConfig() error {
 	if err != nil {
 		return err
 	}
+	curIssuance.addFile(File.SrvConfig)
 
-	data := struct {
-		HostName       string
-		SubjectAltName string
-	}{
-		hostname,
-		"subjectAltName = " + Host.String(),
-	}
 	err = tmpl.Execute(configFile, data)
 	configFile.Close()
 	if err != nil {
@@ -144,3 +585,34 @@ func serverConfig() error {
 
 	return nil
 }
+
+// requestExtensions returns the extensions of the certificate set in the
+// configuration of the request: the lines which are not in the template, but
+// the defaults of the subject and the attributes.
+func requestExtensions(file string) (string, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return "", err
+	}
+	tmpl, err := template.ParseFiles(File.Config + ".tmpl")
+	if err != nil {
+		return "", fmt.Errorf("Parsing error in configuration: %s", err)
+	}
+	var empty strings.Builder
+	if err = tmpl.Execute(&empty, requestTemplate{}); err != nil {
+		return "", err
+	}
+
+	known := make(map[string]bool)
+	for _, v := range strings.Split(empty.String(), "\n") {
+		known[v] = true
+	}
+	var ext []string
+	for _, v := range strings.Split(string(data), "\n") {
+		if !known[v] && !strings.HasPrefix(v, "commonName_default") &&
+			!strings.HasPrefix(v, _CHALLENGE_DEFAULT) {
+			ext = append(ext, v)
+		}
+	}
+	return strings.Join(ext, "\n"), nil
+}
@@ -0,0 +1,353 @@
+// Copyright 2014 Jonas mg
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"encoding/pem"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/tredoe/flagplus"
+)
+
+var cmdRevoke = &flagplus.Subcommand{
+	UsageLine: "revoke [-reason name] [-passin source] NAME | revoke -all -cn pattern [-reason name] [-dry-run] [-passin source]",
+	Short:     "revoke certificates",
+	Long: `
+"revoke" revokes a certificate signed by the CA, and generates the certificate
+revocation list (CRL) of the CA, in DER format, at "crl/ca.crl".
+
+With the flag "-all", it revokes every valid certificate of the certificates
+directory whose common name matches the pattern given in "-cn" (i.e.
+'*.old-project.internal'), in a single transaction, so the CRL is generated only
+once; the flag "-dry-run" prints the certificates matched without revoking them.
+
+The reason of the revocation is one of: unspecified (by default),
+keyCompromise, CACompromise, affiliationChanged, superseded,
+cessationOfOperation and certificateHold. The latter suspends the certificate
+temporarily, until it is revoked with another reason or restored by "unrevoke".
+`,
+	Run: runRevoke,
+}
+
+var cmdUnrevoke = &flagplus.Subcommand{
+	UsageLine: "unrevoke [-passin source] NAME",
+	Short:     "restore a certificate on hold",
+	Long: `
+"unrevoke" restores a certificate suspended with the reason "certificateHold",
+so it is valid again, and generates the certificate revocation list of the CA.
+The certificates revoked with another reason can not be restored.
+`,
+	Run: runUnrevoke,
+}
+
+var (
+	CommonName = flag.String("cn", "", "pattern of the common name")
+	Reason     = flag.String("reason", REASON_UNSPECIFIED, "reason of the revocation")
+)
+
+func init() {
+	addFlags(cmdRevoke, "reason", "all", "cn", "dry-run", "passin")
+	addFlags(cmdUnrevoke, "passin")
+}
+
+// Reasons of revocation, with the names used by OpenSSL.
+const (
+	REASON_UNSPECIFIED = "unspecified"
+	REASON_KEY         = "keyCompromise"
+	REASON_CA          = "CACompromise"
+	REASON_AFFILIATION = "affiliationChanged"
+	REASON_SUPERSEDED  = "superseded"
+	REASON_CESSATION   = "cessationOfOperation"
+	REASON_HOLD        = "certificateHold"
+)
+
+// HOLD_INSTRUCTION is the instruction of the certificates on hold; none, since
+// the holder is who has to contact with the CA.
+const HOLD_INSTRUCTION = "holdInstructionNone"
+
+var revokeReasons = []string{
+	REASON_UNSPECIFIED, REASON_KEY, REASON_CA, REASON_AFFILIATION,
+	REASON_SUPERSEDED, REASON_CESSATION, REASON_HOLD,
+}
+
+var (
+	errRevoked = errors.New("certificate not valid (revoked or expired)")
+	errNotHold = errors.New("certificate not on hold")
+)
+
+func runRevoke(cmd *flagplus.Subcommand, args []string) {
+	reason := revokeReason(*Reason)
+	if reason == "" {
+		log.Fatalf("Unknown reason: %q\n\n  Use one of: %s", *Reason, strings.Join(revokeReasons, ", "))
+	}
+
+	var names []string
+	if *IsAll {
+		if *CommonName == "" || len(args) != 0 {
+			log.Print("Missing required flag: -cn")
+			cmd.Usage()
+		}
+		if _, err := path.Match(*CommonName, ""); err != nil {
+			log.Fatalf("Wrong pattern: %q", *CommonName)
+		}
+	} else if len(args) != 1 {
+		log.Print("Missing required argument: NAME")
+		cmd.Usage()
+	} else if args[0] == NAME_CA {
+		log.Fatal("The certification authority's certificate can not be revoked")
+	} else {
+		names = args
+	}
+
+	entries, err := readIndex()
+	if err != nil {
+		log.Fatal(err)
+	}
+	toRevoke, err := revokeList(entries, names, *CommonName, reason)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if len(toRevoke) == 0 {
+		log.Fatalf("No valid certificate matches the pattern: %q", *CommonName)
+	}
+
+	if *IsDryRun {
+		for _, v := range toRevoke {
+			fmt.Printf("%s\t%s\n", v.name, v.entry.Serial)
+		}
+		return
+	}
+	operator := mustRole(ACTION_REVOKE)
+
+	tx := beginIssuance()
+	if err = tx.saveDatabase(); err != nil {
+		log.Fatal(err)
+	}
+
+	now := time.Now()
+	for _, v := range toRevoke {
+		v.entry.revoke(now, reason)
+	}
+	updateCRL(entries)
+
+	fmt.Print("\n== Revoked\n")
+	for _, v := range toRevoke {
+		fmt.Printf("- %s\t(serial %s)\n", v.name, v.entry.Serial)
+		audit(operator, ACTION_REVOKE, v.name, reason)
+	}
+	fmt.Printf("- CRL:\t%q\n", File.CRL)
+}
+
+// revokeReason returns the name of the reason of revocation, or the empty
+// string whether it is unknown.
+func revokeReason(s string) string {
+	for _, v := range revokeReasons {
+		if strings.EqualFold(v, s) {
+			return v
+		}
+	}
+	return ""
+}
+
+// revokeName revokes the certificate `name` into the process of the portal, so
+// it returns the errors instead of exiting.
+func revokeName(name, reason, operator string) (*indexEntry, error) {
+	queueMu.Lock()
+	defer queueMu.Unlock()
+
+	if reason = revokeReason(reason); reason == "" {
+		return nil, fmt.Errorf("unknown reason; use one of: %s", strings.Join(revokeReasons, ", "))
+	}
+	if name == NAME_CA {
+		return nil, errors.New("the certification authority's certificate can not be revoked")
+	}
+	if err := checkRole(loadStoreConfig(), operator, ACTION_REVOKE); err != nil {
+		return nil, err
+	}
+
+	entries, err := readIndex()
+	if err != nil {
+		return nil, err
+	}
+	toRevoke, err := revokeList(entries, []string{name}, "", reason)
+	if err != nil {
+		return nil, err
+	}
+	entry := toRevoke[0].entry
+
+	tx := beginIssuance()
+	err = func() error {
+		if err := tx.saveDatabase(); err != nil {
+			return err
+		}
+		entry.revoke(time.Now(), reason)
+		if err := writeIndex(entries); err != nil {
+			return err
+		}
+		if err := genCRLWith(opensslNoFatal); err != nil {
+			return err
+		}
+		return syncDatabase()
+	}()
+	if err != nil {
+		tx.rollback()
+		return nil, err
+	}
+	commitIssuance()
+
+	audit(operator, ACTION_REVOKE, name, reason)
+	return entry, nil
+}
+
+func runUnrevoke(cmd *flagplus.Subcommand, args []string) {
+	if len(args) != 1 {
+		log.Print("Missing required argument: NAME")
+		cmd.Usage()
+	}
+	operator := mustRole(ACTION_UNREVOKE)
+	setCertPath(args[0])
+
+	cert, err := parseCertFile(File.Cert)
+	if err != nil {
+		log.Fatal(err)
+	}
+	entries, err := readIndex()
+	if err != nil {
+		log.Fatal(err)
+	}
+	entry := findIndex(entries, cert.SerialNumber)
+	if entry == nil || entry.Status != INDEX_REVOKED || entry.reason() != REASON_HOLD {
+		log.Fatalf("%s: %s", args[0], errNotHold)
+	}
+
+	tx := beginIssuance()
+	if err = tx.saveDatabase(); err != nil {
+		log.Fatal(err)
+	}
+
+	entry.Status = INDEX_VALID
+	entry.Revocation = ""
+	updateCRL(entries)
+
+	fmt.Printf("\n== Restored\n- %s\t(serial %s)\n- CRL:\t%q\n", args[0], entry.Serial, File.CRL)
+	audit(operator, ACTION_UNREVOKE, args[0], "")
+}
+
+// updateCRL writes the entries to the database and generates the revocation
+// list, ending the issuance in progress.
+func updateCRL(entries []*indexEntry) {
+	if err := writeIndex(entries); err != nil {
+		fatal(err)
+	}
+
+	fmt.Print("\n== Generate CRL\n\n")
+	if err := genCRL(); err != nil {
+		fatal(err)
+	}
+	if err := syncDatabase(); err != nil {
+		fatal(err)
+	}
+	commitIssuance()
+}
+
+// revokeItem is a certificate to revoke.
+type revokeItem struct {
+	name  string
+	entry *indexEntry
+}
+
+// revokeList returns the entries of the valid certificates with the names
+// given, or whose common name matches `pattern`. The certificates on hold are
+// included whether the new reason is not a hold.
+func revokeList(entries []*indexEntry, names []string, pattern, reason string) ([]revokeItem, error) {
+	var list []revokeItem
+
+	for _, v := range loadCerts() {
+		if v.Name == NAME_CA || v.Cert.IsCA {
+			continue
+		}
+		if len(names) != 0 {
+			if v.Name != names[0] {
+				continue
+			}
+		} else if ok, _ := path.Match(pattern, v.Cert.Subject.CommonName); !ok {
+			continue
+		}
+
+		entry := findIndex(entries, v.Cert.SerialNumber)
+		onHold := entry != nil && entry.Status == INDEX_REVOKED && entry.reason() == REASON_HOLD
+		if entry == nil || (entry.Status != INDEX_VALID && !(onHold && reason != REASON_HOLD)) {
+			if len(names) != 0 {
+				return nil, fmt.Errorf("%s: %s", v.Name, errRevoked)
+			}
+			continue
+		}
+		list = append(list, revokeItem{v.Name, entry})
+	}
+
+	if len(names) != 0 && len(list) == 0 {
+		return nil, fmt.Errorf("Certificate not found: %q", names[0])
+	}
+	return list, nil
+}
+
+// genCRL generates the certificate revocation list of the CA, from its
+// database.
+func genCRL() error {
+	return genCRLWith(func(args ...string) ([]byte, error) { return openssl(args...), nil })
+}
+
+// genCRLWith is like genCRL, but OpenSSL is run by `run`.
+func genCRLWith(run func(args ...string) ([]byte, error)) error {
+	if _, err := os.Stat(File.CRLNumber); os.IsNotExist(err) {
+		if err = writeFileAtomic(File.CRLNumber, []byte{'0', '1', '\n'}, 0644); err != nil {
+			return err
+		}
+	}
+	if loadKMS() != "" {
+		return nativeCRL()
+	}
+
+	config, done, err := resolveConfig(File.Config)
+	if err != nil {
+		return err
+	}
+	defer done()
+	tmp, err := tempFile(File.CRL)
+	if err != nil {
+		return err
+	}
+	args := []string{"ca", "-gencrl", "-config", config, "-out", tmp}
+	args = append(args, fipsDigestArgs("ca")...)
+	args = append(args, caKeyArgs("-keyfile", "")...)
+	out, err := run(args...)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%s", out)
+
+	// OpenSSL writes it in PEM format.
+	data, err := os.ReadFile(tmp)
+	if err != nil {
+		return err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != "X509 CRL" {
+		return errors.New("CRL not generated")
+	}
+	if err = os.WriteFile(tmp, block.Bytes, 0600); err != nil {
+		return err
+	}
+	return commitFile(tmp, File.CRL, 0644)
+}
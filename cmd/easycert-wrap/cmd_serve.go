@@ -0,0 +1,383 @@
+// Copyright 2014 Jonas mg
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+
+	"github.com/tredoe/flagplus"
+)
+
+var cmdServe = &flagplus.Subcommand{
+	UsageLine: "serve [-addr host:port] [-server name] [-token string] [-ha]",
+	Short:     "serve a portal to submit certificate requests",
+	Long: `
+"serve" runs a web portal where the developers paste a certificate request
+(CSR) which lands in the queue, pending of approval. The administrators approve
+or deny the pending requests using the token, and the issued certificates can
+be downloaded. The private keys never pass through the portal. The forms are
+protected against cross-site request forgery by a token kept in a cookie.
+
+Whether it is used the flag "-server", the portal is served over TLS with that
+certificate, and the clients can authenticate with a certificate signed by the
+CA; its common name identifies the operator, which is "portal" without it.
+Whether the operators are configured in "store.json" (see "audit"), the client
+certificate is required to approve, deny or revoke, also by the API. Whether
+the token is not set, then it is generated and printed.
+The passphrase of the CA's private key is got from the environment variable
+EASYCERT_CA_PASS.
+
+The queue is handled too through a REST API in JSON format at "/api/v1", which
+is described in OpenAPI at "/api/v1/openapi.json"; the token of the
+administrators is sent like bearer token (see "remote").
+
+Whether the field "syslog" of "store.json" is set (see "audit"), the errors of
+the portal are written to the log of the system instead of the standard error.
+
+Whether the environment variable OTEL_EXPORTER_OTLP_ENDPOINT is set, the portal
+exports to that collector of OpenTelemetry, by OTLP over HTTP with the encoding
+JSON, the spans of the requests and of the steps of the issuance ("queue.add",
+"issuance.check", "issuance.sign", "issuance.store" and "issuance.hook"), and
+the histogram of their durations "easycert.operation.duration". The trace of
+the client is continued from its header "traceparent". It is configured too by
+OTEL_EXPORTER_OTLP_TRACES_ENDPOINT, OTEL_EXPORTER_OTLP_METRICS_ENDPOINT,
+OTEL_EXPORTER_OTLP_HEADERS, OTEL_SERVICE_NAME and OTEL_SDK_DISABLED.
+
+With the flag "-ha", several instances of the portal run like active/standby:
+the active one is elected through a lease in the external database of
+"store.json" (see "init"), renewed every 5 seconds, and the standby ones wait
+to listen until the lease of the active one expires, after 15 seconds. The
+active instance exits whether it loses the lease. The instances have to share
+the certificates directory, i.e. in a network file system, and the token given
+in "-token"; the clocks of their hosts have to be synchronized.
+`,
+	Run: runServe,
+}
+
+var (
+	Addr  = flag.String("addr", "localhost:8080", "address where to listen")
+	Token = flag.String("token", "", "token of the administrators")
+	IsHA  = flag.Bool("ha", false, "active/standby with leader election")
+)
+
+func init() {
+	addFlags(cmdServe, "addr", "server", "token", "ha", "years")
+}
+
+func runServe(cmd *flagplus.Subcommand, args []string) {
+	mustWritable()
+	if l := openSysLog(); l != nil {
+		log.SetOutput(sysLogWriter{l})
+		log.SetPrefix("")
+	}
+	var lease leaser
+	if *IsHA {
+		if *Token == "" {
+			log.Fatal("Flag -ha requires -token, shared by the instances")
+		}
+		var err error
+		if lease, err = openLeaser(); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if *Token == "" {
+		b := make([]byte, 16)
+		if _, err := rand.Read(b); err != nil {
+			log.Fatal(err)
+		}
+		*Token = hex.EncodeToString(b)
+		fmt.Printf("* Token for administrators: %s\n", *Token)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", traced("/", portalIndex))
+	mux.HandleFunc("/submit", traced("/submit", portalSubmit))
+	mux.HandleFunc("/approve", traced("/approve", portalReview))
+	mux.HandleFunc("/deny", traced("/deny", portalReview))
+	mux.HandleFunc("/cert", traced("/cert", portalCert))
+	apiHandle(mux)
+
+	if tel = newTelemetry(); tel != nil {
+		go tel.run()
+	}
+	if lease != nil {
+		waitLeadership(lease, haHolder())
+	}
+
+	srv := &http.Server{Addr: *Addr, Handler: mux}
+
+	if *ServerCert == "" {
+		fmt.Printf("* Serving on http://%s\n", *Addr)
+		log.Fatal(srv.ListenAndServe())
+	}
+
+	caCert, err := os.ReadFile(filepath.Join(Dir.Cert, NAME_CA+EXT_CERT))
+	if err != nil {
+		log.Fatal(err)
+	}
+	certPool := x509.NewCertPool()
+	if ok := certPool.AppendCertsFromPEM(caCert); !ok {
+		log.Fatal("CA certificate not valid")
+	}
+	srv.TLSConfig = &tls.Config{
+		ClientAuth: tls.VerifyClientCertIfGiven,
+		ClientCAs:  certPool,
+	}
+
+	fmt.Printf("* Serving on https://%s\n", *Addr)
+	log.Fatal(srv.ListenAndServeTLS(
+		filepath.Join(Dir.Cert, *ServerCert+EXT_CERT),
+		filepath.Join(Dir.Key, *ServerCert+EXT_KEY),
+	))
+}
+
+// NAME_PORTAL is the operator of the portal for the clients without
+// certificate.
+const NAME_PORTAL = "portal"
+
+var errClientCert = errors.New("a client certificate is required, since the operators are configured in the store")
+
+// portalOperator returns the identity of who does the request: the common name
+// of the client certificate, or NAME_PORTAL whether it is not used.
+func portalOperator(r *http.Request) string {
+	if r.TLS != nil && len(r.TLS.PeerCertificates) != 0 {
+		return r.TLS.PeerCertificates[0].Subject.CommonName
+	}
+	return NAME_PORTAL
+}
+
+// portalReviewer returns the identity of who approves, denies or revokes. The
+// client certificate is required whether the operators are configured in the
+// store, so their roles are checked.
+func portalReviewer(r *http.Request) (string, error) {
+	if len(loadStoreConfig().Operators) != 0 &&
+		(r.TLS == nil || len(r.TLS.PeerCertificates) == 0) {
+		return "", errClientCert
+	}
+	return portalOperator(r), nil
+}
+
+var portalTmpl = template.Must(template.New("").Parse(TMPL_PORTAL))
+
+func portalIndex(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/" {
+		http.NotFound(w, r)
+		return
+	}
+	portalRender(w, r, http.StatusOK, "")
+}
+
+// portalRender writes the page with the status code and the message.
+func portalRender(w http.ResponseWriter, r *http.Request, status int, msg string) {
+	list, err := listQueue()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	data := struct {
+		Message string
+		CSRF    string
+		List    []*queueReq
+	}{msg, csrfToken(w, r), list}
+
+	// The headers are set before of the status code.
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(status)
+	if err = portalTmpl.Execute(w, data); err != nil {
+		log.Print(err)
+	}
+}
+
+// _CSRF_COOKIE is the cookie with the token against cross-site request
+// forgery, which the forms of the portal have to send too.
+const _CSRF_COOKIE = "easycert_csrf"
+
+// csrfToken returns the token of the client against cross-site request
+// forgery, setting it in a cookie whether it has not one.
+func csrfToken(w http.ResponseWriter, r *http.Request) string {
+	if c, err := r.Cookie(_CSRF_COOKIE); err == nil && len(c.Value) == 32 {
+		return c.Value
+	}
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		log.Print(err)
+		return ""
+	}
+	token := hex.EncodeToString(b)
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     _CSRF_COOKIE,
+		Value:    token,
+		Path:     "/",
+		Secure:   r.TLS != nil,
+		HttpOnly: true,
+		SameSite: http.SameSiteStrictMode,
+	})
+	return token
+}
+
+// checkCSRF checks whether the form has the token of the cookie against
+// cross-site request forgery.
+func checkCSRF(r *http.Request) bool {
+	c, err := r.Cookie(_CSRF_COOKIE)
+	return err == nil && c.Value != "" &&
+		subtle.ConstantTimeCompare([]byte(r.FormValue("csrf")), []byte(c.Value)) == 1
+}
+
+func portalSubmit(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !checkCSRF(r) {
+		portalRender(w, r, http.StatusForbidden, "Error: invalid form; reload the page")
+		return
+	}
+
+	var attestation []byte
+	if v := r.FormValue("attestation"); v != "" {
+		attestation = []byte(v)
+	}
+	var req *queueReq
+	err := traceStep(spanOf(r), "queue.add", func() (err error) {
+		req, err = addQueue(r.FormValue("name"), []byte(r.FormValue("csr")), attestation, "web", portalOperator(r))
+		return err
+	})
+	if err != nil {
+		portalRender(w, r, http.StatusBadRequest, "Error: "+err.Error())
+		return
+	}
+	portalRender(w, r, http.StatusOK, fmt.Sprintf("Request %s submitted; it is pending of approval.", req.ID))
+}
+
+// portalReview approves or denies a request.
+func portalReview(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !checkCSRF(r) {
+		portalRender(w, r, http.StatusForbidden, "Error: invalid form; reload the page")
+		return
+	}
+	if subtle.ConstantTimeCompare([]byte(r.FormValue("token")), []byte(*Token)) != 1 {
+		portalRender(w, r, http.StatusForbidden, "Error: invalid token")
+		return
+	}
+
+	operator, err := portalReviewer(r)
+	if err != nil {
+		portalRender(w, r, http.StatusForbidden, "Error: "+err.Error())
+		return
+	}
+
+	req, err := getQueue(r.FormValue("id"))
+	if err == nil {
+		req.span = spanOf(r)
+		if r.URL.Path == "/approve" {
+			err = req.approve(operator)
+		} else {
+			err = req.deny(operator)
+		}
+	}
+	if err != nil {
+		portalRender(w, r, http.StatusBadRequest, "Error: "+err.Error())
+		return
+	}
+	portalRender(w, r, http.StatusOK, fmt.Sprintf("Request %s %s.", req.ID, req.Status))
+}
+
+// portalCert sends the certificate issued for an approved request.
+func portalCert(w http.ResponseWriter, r *http.Request) {
+	req, err := getQueue(r.FormValue("id"))
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	if req.Status != STATUS_APPROVED {
+		http.Error(w, errQueueDone.Error(), http.StatusNotFound)
+		return
+	}
+
+	data, err := os.ReadFile(req.certFile())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/x-pem-file")
+	w.Header().Set("Content-Disposition", "attachment; filename="+req.Name+EXT_CERT)
+	w.Write(data)
+}
+
+// == Template
+//
+
+const TMPL_PORTAL = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>EasyCert</title>
+<style>
+body { font-family: sans-serif; margin: 2em; }
+table { border-collapse: collapse; }
+td, th { border: 1px solid #ccc; padding: 0.3em 0.6em; text-align: left; }
+textarea { width: 40em; height: 12em; font-family: monospace; }
+.msg { background: #eef; padding: 0.5em; }
+</style>
+</head>
+<body>
+<h1>EasyCert</h1>
+{{if .Message}}<p class="msg">{{.Message}}</p>{{end}}
+
+<h2>Submit a certificate request</h2>
+<form method="post" action="/submit">
+<input type="hidden" name="csrf" value="{{.CSRF}}">
+<p>Name: <input name="name" required></p>
+<p><textarea name="csr" placeholder="-----BEGIN CERTIFICATE REQUEST-----" required></textarea></p>
+<p><textarea name="attestation" placeholder="Attestation statement of the key (optional)"></textarea></p>
+<p><input type="submit" value="Submit"></p>
+</form>
+
+<h2>Requests</h2>
+<table>
+<tr><th>ID</th><th>Name</th><th>Subject</th><th>Submitted</th><th>Status</th><th></th></tr>
+{{range .List}}
+<tr>
+<td>{{.ID}}</td><td>{{.Name}}</td><td>{{.Subject}}</td>
+<td>{{.Submitted.Format "2006-01-02 15:04"}}</td><td>{{.Status}}</td>
+<td>
+{{if eq .Status "pending"}}
+<form method="post">
+<input type="hidden" name="csrf" value="{{$.CSRF}}">
+<input type="hidden" name="id" value="{{.ID}}">
+<input type="password" name="token" placeholder="token" required>
+<input type="submit" formaction="/approve" value="Approve">
+<input type="submit" formaction="/deny" value="Deny">
+</form>
+{{else if eq .Status "approved"}}
+<a href="/cert?id={{.ID}}">Download</a>
+{{end}}
+</td>
+</tr>
+{{end}}
+</table>
+</body>
+</html>
+`
@@ -0,0 +1,203 @@
+// Copyright 2014 Jonas mg
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/pem"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/tredoe/easycert"
+	"github.com/tredoe/flagplus"
+)
+
+var cmdSidecar = &flagplus.Subcommand{
+	UsageLine: "sidecar -watch NAME -keystore file [-password string] [-interval duration] [-with-root] [-once]",
+	Short:     "keep a Java keystore in sync with a certificate",
+	Long: `
+"sidecar" keeps the keystore of "-keystore" in sync with the certificate of
+"-watch", for the applications of Java which can not read the files in PEM
+format: the keystore is written with its private key and the intermediate CAs
+(and the root CA with "-with-root") when it is started, and again every time the certificate changes,
+like when it is renewed.
+
+The format of the keystore is got from the extension of the file: PKCS#12
+(.p12, .pfx) or Java KeyStore (.jks, .keystore), which requires the Java
+keytool. The private key is stored with the alias NAME, and the keystore is
+protected by the password of "-password", or else EASYCERT_P12_PASS, which is
+needed by Java to read it; it is replaced atomically, and only readable by the
+owner.
+
+The certificate is checked every "-interval" (30s by default), or once with
+"-once", and the errors are logged without exiting, to keep the keystore being
+used until the certificate is fixed.
+`,
+	Run: runSidecar,
+}
+
+var (
+	WatchName = flag.String("watch", "", "name of the certificate to watch")
+	Keystore  = flag.String("keystore", "", "keystore to keep in sync (.p12, .pfx, .jks or .keystore)")
+)
+
+func init() {
+	addFlags(cmdSidecar, "watch", "keystore", "password", "interval", "with-root", "once")
+}
+
+// Formats of the keystores.
+const (
+	KEYSTORE_PKCS12 = "PKCS12"
+	KEYSTORE_JKS    = "JKS"
+)
+
+func runSidecar(cmd *flagplus.Subcommand, args []string) {
+	if len(args) != 0 {
+		log.Print("Too many arguments")
+		cmd.Usage()
+	}
+	if *WatchName == "" || *Keystore == "" {
+		log.Print("Missing required flags: -watch and -keystore")
+		cmd.Usage()
+	}
+	if *Interval <= 0 {
+		log.Fatal("Flag -interval has to be positive")
+	}
+	format, err := keystoreFormat(*Keystore)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if format == KEYSTORE_JKS {
+		if _, err = exec.LookPath("keytool"); err != nil {
+			log.Fatal("Java keytool is not installed; it is required for JKS files")
+		}
+	}
+	if *P12Password != "" {
+		os.Setenv(ENV_P12_PASS, *P12Password)
+	}
+	if os.Getenv(ENV_P12_PASS) == "" {
+		log.Fatalf("The password of the keystore has to be given in -password or %s", ENV_P12_PASS)
+	}
+
+	setCertPath(*WatchName)
+	var last [sha256.Size]byte
+
+	for {
+		cert, err := parseCertFile(File.Cert)
+		if err == nil {
+			if sum := sha256.Sum256(cert.Raw); sum != last {
+				if err = SyncKeystore(*WatchName, *Keystore, format); err == nil {
+					last = sum
+					fmt.Printf("- Keystore:\t%q (serial %s)\n", *Keystore, easycert.SerialHex(cert.SerialNumber))
+				}
+			}
+		}
+		if err != nil {
+			if *IsOnce {
+				log.Fatal(err)
+			}
+			log.Print(err)
+		}
+		if *IsOnce {
+			return
+		}
+		time.Sleep(*Interval)
+	}
+}
+
+// keystoreFormat returns the format of the keystore from the extension of
+// `file`.
+func keystoreFormat(file string) (string, error) {
+	switch strings.ToLower(filepath.Ext(file)) {
+	case EXT_PKCS12, ".pfx":
+		return KEYSTORE_PKCS12, nil
+	case EXT_JKS, ".keystore":
+		return KEYSTORE_JKS, nil
+	}
+	return "", fmt.Errorf("unknown format of keystore: %q", file)
+}
+
+// SyncKeystore writes the keystore `file` in format `format` with the private
+// key of the certificate `name`, the certificate and its chain of CA
+// certificates, protected by the password of ENV_P12_PASS. The errors are
+// returned since it is called by a long-running command.
+func SyncKeystore(name, file, format string) error {
+	cert, err := parseCertFile(File.Cert)
+	if err != nil {
+		return err
+	}
+	if cert.IsCA {
+		return errors.New("the private key of a CA is not exported")
+	}
+
+	dir, err := os.MkdirTemp("", "easycert-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+
+	p12 := filepath.Join(dir, name+EXT_PKCS12)
+	args := []string{"pkcs12", "-export", "-in", File.Cert, "-inkey", File.Key, "-name", name,
+		"-passout", "env:" + ENV_P12_PASS, "-out", p12}
+
+	var chain []byte
+	for _, v := range servedChain(cert) {
+		chain = append(chain, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: v.Cert.Raw})...)
+	}
+	if len(chain) != 0 {
+		chainFile := filepath.Join(dir, "chain"+EXT_CERT)
+		if err = os.WriteFile(chainFile, chain, 0600); err != nil {
+			return err
+		}
+		args = append(args, "-certfile", chainFile)
+	}
+	if _, err = opensslNoFatal(args...); err != nil {
+		return err
+	}
+
+	out := p12
+	if format == KEYSTORE_JKS {
+		out = filepath.Join(dir, name+EXT_JKS)
+		if err = keytoolNoFatal("-importkeystore", "-noprompt",
+			"-srckeystore", p12, "-srcstoretype", KEYSTORE_PKCS12, "-srcstorepass:env", ENV_P12_PASS,
+			"-destkeystore", out, "-deststoretype", KEYSTORE_JKS, "-deststorepass:env", ENV_P12_PASS,
+		); err != nil {
+			return err
+		}
+	}
+
+	data, err := os.ReadFile(out)
+	if err != nil {
+		return err
+	}
+	defer zero(data)
+	return writeFileAtomic(file, data, 0600)
+}
+
+// keytoolNoFatal executes a command of the Java keytool, returning the error
+// instead of exiting.
+func keytoolNoFatal(args ...string) error {
+	var output bytes.Buffer
+
+	debugCmd("keytool", args)
+	cmd := exec.Command("keytool", args...)
+	cmd.Stdout = &output
+	cmd.Stderr = &output
+
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("keytool %s: %s\n%s", args[0], err, output.Bytes())
+	}
+	return nil
+}
@@ -10,59 +10,175 @@ import (
 	"fmt"
 	"log"
 	"os"
-	"strconv"
 
 	"github.com/tredoe/flagplus"
 )
 
 var cmdSign = &flagplus.Subcommand{
-	UsageLine: "sign [-years number] NAME",
+	UsageLine: "sign [-ca name] [-years number] [-stagger window] [-reissue] [-kms-uri uri] [-passin source] [-backend name] [-fips] [-batch] NAME...",
 	Short:     "sign certificate request",
 	Long: `
 "sign" signs a certificate signing request (CSR) using the CA in the
-certificates directory and generates a certificate.
+certificates directory and generates a certificate. Several requests can be
+signed in a batch; then the progress is shown for every request, and a summary
+with the serial number and the expiration of every certificate at the end, or
+whether some request fails, since the rest are skipped.
+
+With the flag "-ca", the certificates are issued by the intermediate CA given
+(see "ca -intermediate") instead of the root CA, and recorded in its database.
+Then the certificate followed by the chain of intermediate CAs, without the
+root CA, is written to "NAME.fullchain.pem" in the directory of certificates,
+for the servers which have to send the chain.
+
+With the flag "-stagger", the expirations of the certificates of the batch are
+spread out over that window (i.e. "7d" or "36h") after the validity given in
+"-years", so they are not renewed all in the same day; the schedule is recorded
+in the file "schedule.log" of the certificates directory. The requests of
+IDevID ("req -idevid") are signed without expiration, whatever "-years".
+
+With the flag "-reissue", the current certificate is kept like the previous
+version "NAME@1", "NAME@2", ... into the directory "certs/history" instead of
+failing, so it can be restored whether the new one is wrong. The number of
+versions kept is set in the field "history" of "store.json" (3 by default).
+
+The issuance is done like a transaction: whether some step fails, the files
+generated are removed and the database of the CA is restored. With "req -sign",
+the private key and the request are removed too.
+
+Whether the field "receipt" is set in the file "store.json", a receipt in JSON
+format (serial, fingerprints, subject, operator, date) is written into the
+directory "receipts", signed with GPG or minisign:
+
+	{
+		"receipt": {
+			"signer": "gpg",
+			"key": "ca@example.com"
+		}
+	}
+
+For minisign, "key" is the secret key file.
+
+The executable files "pre-sign" and "post-sign" in the hooks directory are run
+before and after of signing, with the metadata of the certificate in variables
+of environment (EASYCERT_NAME, EASYCERT_SUBJECT, EASYCERT_SERIAL, ...).
+Whether "pre-sign" fails, the request is not signed.
+
+With "-backend native", the requests are signed in Go instead of executing
+OpenSSL (see "ca"), without confirmation. The subject alternative names and the
+key usage of the configuration of the request are added, like OpenSSL does, but
+the other extensions and the requests of IDevID are not supported.
+
+The root CA created with "ca -kms-uri" signs in Go too, with the key in the KMS.
+With "-kms-uri", the requests are signed with the key of the URI instead of the
+CA's private key file, whether it is the same key, like after of importing it
+into the KMS.
 `,
 	Run: runSign,
 }
 
 func init() {
-	cmdSign.AddFlags("years")
+	addFlags(cmdSign, "ca", "years", "stagger", "reissue", "kms-uri", "passin", "backend", "fips", "batch")
 }
 
 func runSign(cmd *flagplus.Subcommand, args []string) {
-	if len(args) != 1 {
+	if len(args) == 0 {
 		log.Print("Missing required argument: NAME")
 		cmd.Usage()
 	}
-	setCertPath(args[0])
+	mustAttestationNotRequired()
+	useCA(*CACert)
+	b := newBatch(len(args))
 
-	SignReq()
+	for i, name := range args {
+		setCertPath(name)
+		b.next(i, name)
+		SignReq()
+		b.add(name)
+	}
+	b.save()
 }
 
 // SignReq signs a certificate request generating a new certificate.
 func SignReq() {
+	operator := mustRole(ACTION_SIGN)
+	tx := beginIssuance()
+
 	if _, err := os.Stat(File.Cert); !os.IsNotExist(err) {
-		log.Fatalf("Certificate already exists: %q", File.Cert)
+		if !*IsReissue {
+			fatalf("Certificate already exists: %q\n\n  Use \"-reissue\" to keep it like a previous version", File.Cert)
+		}
+		if err = archiveVersion(certName(), false); err != nil {
+			fatal(err)
+		}
 	}
 
 	configFile := ""
 	isForServer := false
 
 	if _, err := os.Stat(File.SrvConfig); os.IsNotExist(err) {
-		configFile = File.Config
+		// The request was not generated here, i.e. it comes from the queue.
+		if configFile, err = writeSANsConfig(File.Request); err != nil {
+			fatal(err)
+		}
+		isForServer = configFile == File.SrvConfig
 	} else {
 		isForServer = true
 		configFile = File.SrvConfig
 	}
 
+	if err := fipsCheckRequest(File.Request); err != nil {
+		fatal(err)
+	}
+	if err := runHook(HOOK_PRE_SIGN, hookMeta()); err != nil {
+		fatal(err)
+	}
+
 	fmt.Print("\n== Sign\n\n")
 
-	opensslArgs := []string{"ca", "-policy", "policy_anything",
-		"-config", configFile, "-in", File.Request, "-out", File.Cert,
-		"-days", strconv.Itoa(365 * *Years),
-		//"-keyfile", File.Key,
+	if err := tx.saveDatabase(); err != nil {
+		fatal(err)
+	}
+	certFile := mustTempFile(File.Cert)
+
+	if nativeBackend() || loadKMS() != "" {
+		serverConfig := ""
+		if isForServer {
+			serverConfig = configFile
+		}
+		if err := nativeIssue(nil, serverConfig, certFile); err != nil {
+			fatal(err)
+		}
+	} else {
+		config, done := mustCAConfig(configFile)
+		defer done()
+
+		opensslArgs := []string{"ca", "-policy", "policy_anything",
+			"-config", config, "-in", File.Request, "-out", certFile,
+			//"-keyfile", File.Key,
+		}
+		if isIDevID(configFile) {
+			opensslArgs = append(opensslArgs, "-enddate", IDEVID_END_DATE)
+		} else {
+			opensslArgs = append(opensslArgs, validityArgs()...)
+		}
+		opensslArgs = append(opensslArgs, fipsDigestArgs("ca")...)
+		opensslArgs = append(opensslArgs, batchArgs()...)
+		opensslArgs = append(opensslArgs, caKeyArgs("-keyfile", "")...)
+		fmt.Printf("%s", openssl(opensslArgs...))
+	}
+
+	// OpenSSL exits without error whether the signing is not confirmed.
+	if info, err := os.Stat(certFile); err != nil || info.Size() == 0 {
+		fatal("Certificate not signed")
+	}
+	mustCommitFile(certFile, File.Cert, 0644)
+	if err := syncDatabase(); err != nil {
+		fatal(err)
+	}
+	commitIssuance()
+	if *IsReissue {
+		pruneVersions(certName())
 	}
-	fmt.Printf("%s", openssl(opensslArgs...))
 
 	if err := os.Remove(File.Request); err != nil {
 		log.Print(err)
@@ -76,4 +192,26 @@ func SignReq() {
 	}
 
 	fmt.Printf("\n== Generated\n- Certificate:\t%q\n", File.Cert)
+	if cert, err := parseCertFile(File.Cert); err != nil {
+		log.Print(err)
+	} else if file, err := writeFullChain(cert, certName()); err != nil {
+		log.Print(err)
+	} else if file != "" {
+		fmt.Printf("- Full chain:\t%q\n", file)
+	}
+
+	meta := hookMeta()
+	audit(operator, ACTION_SIGN, meta["NAME"], "serial "+meta["SERIAL"])
+
+	receipt, err := writeReceipt(meta["NAME"], operator)
+	if err != nil {
+		log.Print(err)
+	}
+	if receipt != "" {
+		fmt.Printf("- Receipt:\t%q\n", receipt)
+	}
+
+	if err := runHook(HOOK_POST_SIGN, meta); err != nil {
+		log.Fatal(err)
+	}
 }
@@ -0,0 +1,192 @@
+// Copyright 2014 Jonas mg
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+
+	"github.com/tredoe/flagplus"
+)
+
+var cmdSignMetadata = &flagplus.Subcommand{
+	UsageLine: "sign-metadata [-out file] NAME METADATA",
+	Short:     "sign SAML metadata",
+	Long: `
+"sign-metadata" signs the SAML metadata of the file METADATA with the private
+key of the certificate NAME (see "req -saml"), through an enveloped XML
+signature (XML-DSig) with RSA-SHA256 and the exclusive canonicalization, which
+has the certificate in its KeyInfo. It requires the program "xmlsec1" of the XML
+Security Library.
+
+The root element, EntityDescriptor or EntitiesDescriptor, gets an attribute "ID"
+whether it has none, to be referenced by the signature. The metadata already
+signed is refused.
+
+The metadata signed is printed, or written in "-out".
+`,
+	Run: runSignMetadata,
+}
+
+// XML namespaces of the SAML metadata and of the XML signatures.
+const (
+	NS_SAML_METADATA = "urn:oasis:names:tc:SAML:2.0:metadata"
+	NS_XMLDSIG       = "http://www.w3.org/2000/09/xmldsig#"
+)
+
+// metadataSignature is the template of the signature, filled in by "xmlsec1".
+const metadataSignature = `<ds:Signature xmlns:ds="` + NS_XMLDSIG + `">` +
+	`<ds:SignedInfo>` +
+	`<ds:CanonicalizationMethod Algorithm="http://www.w3.org/2001/10/xml-exc-c14n#"/>` +
+	`<ds:SignatureMethod Algorithm="http://www.w3.org/2001/04/xmldsig-more#rsa-sha256"/>` +
+	`<ds:Reference URI="#%s">` +
+	`<ds:Transforms>` +
+	`<ds:Transform Algorithm="http://www.w3.org/2000/09/xmldsig#enveloped-signature"/>` +
+	`<ds:Transform Algorithm="http://www.w3.org/2001/10/xml-exc-c14n#"/>` +
+	`</ds:Transforms>` +
+	`<ds:DigestMethod Algorithm="http://www.w3.org/2001/04/xmlenc#sha256"/>` +
+	`<ds:DigestValue/>` +
+	`</ds:Reference>` +
+	`</ds:SignedInfo>` +
+	`<ds:SignatureValue/>` +
+	`<ds:KeyInfo><ds:X509Data/></ds:KeyInfo>` +
+	`</ds:Signature>`
+
+func init() {
+	addFlags(cmdSignMetadata, "out")
+}
+
+func runSignMetadata(cmd *flagplus.Subcommand, args []string) {
+	if len(args) != 2 {
+		log.Print("Missing required arguments: NAME METADATA")
+		cmd.Usage()
+	}
+	setCertPath(args[0])
+	xmlsec := lookTool("xmlsec1")
+
+	data, err := os.ReadFile(args[1])
+	if err != nil {
+		log.Fatal(err)
+	}
+	tmpl, root, err := metadataTemplate(data)
+	if err != nil {
+		log.Fatalf("%s: %s", args[1], err)
+	}
+	if *Out != "" {
+		if _, err = os.Stat(*Out); !os.IsNotExist(err) {
+			log.Fatalf("File already exists: %q", *Out)
+		}
+	}
+
+	// The temporary files are removed whether "xmlsec1" fails.
+	beginIssuance()
+	defer commitIssuance()
+
+	tmp := mustTempFile(args[1])
+	defer os.Remove(tmp)
+	if err = os.WriteFile(tmp, tmpl, 0600); err != nil {
+		fatal(err)
+	}
+	signed := execCmd(nil, xmlsec, "--sign",
+		"--privkey-pem", File.Key+","+File.Cert,
+		"--id-attr:ID", NS_SAML_METADATA+":"+root, tmp)
+
+	if *Out == "" {
+		os.Stdout.Write(signed)
+		return
+	}
+	if err = writeFileAtomic(*Out, signed, 0644); err != nil {
+		fatal(err)
+	}
+	fmt.Printf("== Signed\n- Metadata:\t%q\n", *Out)
+}
+
+// metadataTemplate returns the metadata with the template of the signature
+// like first child of the root element, which gets an attribute "ID" whether it
+// has none, and the name of the root element.
+func metadataTemplate(data []byte) ([]byte, string, error) {
+	d := xml.NewDecoder(bytes.NewReader(data))
+
+	var root xml.StartElement
+	for {
+		tok, err := d.Token()
+		if err != nil {
+			if err == io.EOF {
+				err = errors.New("no root element")
+			}
+			return nil, "", err
+		}
+		if v, ok := tok.(xml.StartElement); ok {
+			root = v
+			break
+		}
+	}
+	end := int(d.InputOffset()) // just after the start tag
+
+	if root.Name.Space != NS_SAML_METADATA ||
+		(root.Name.Local != "EntityDescriptor" && root.Name.Local != "EntitiesDescriptor") {
+		return nil, "", fmt.Errorf("root element %q is not of SAML metadata", root.Name.Local)
+	}
+	if data[end-2] == '/' {
+		return nil, "", errors.New("empty metadata")
+	}
+
+	// The signature has to be the first child.
+	for {
+		tok, err := d.Token()
+		if err != nil {
+			return nil, "", err
+		}
+		if v, ok := tok.(xml.StartElement); ok {
+			if v.Name.Space == NS_XMLDSIG && v.Name.Local == "Signature" {
+				return nil, "", errors.New("metadata already signed")
+			}
+			break
+		}
+		if _, ok := tok.(xml.EndElement); ok {
+			break
+		}
+	}
+
+	id := ""
+	for _, v := range root.Attr {
+		if v.Name.Space == "" && v.Name.Local == "ID" {
+			id = v.Value
+		}
+	}
+
+	var buf bytes.Buffer
+	if id == "" {
+		b := make([]byte, 16)
+		if _, err := rand.Read(b); err != nil {
+			return nil, "", err
+		}
+		id = "_" + hex.EncodeToString(b)
+
+		buf.Write(data[:end-1])
+		fmt.Fprintf(&buf, " ID=%q>", id)
+	} else {
+		buf.Write(data[:end])
+	}
+	fmt.Fprintf(&buf, metadataSignature, xmlEscape(id))
+	buf.Write(data[end:])
+	return buf.Bytes(), root.Name.Local, nil
+}
+
+// xmlEscape returns the string escaped to be placed into an attribute.
+func xmlEscape(s string) string {
+	var buf bytes.Buffer
+	xml.EscapeText(&buf, []byte(s))
+	return buf.String()
+}
@@ -0,0 +1,551 @@
+// Copyright 2014 Jonas mg
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/tredoe/flagplus"
+)
+
+var cmdState = &flagplus.Subcommand{
+	UsageLine: "state [-out file] export | state diff FILE | state [-dry-run] apply FILE",
+	Short:     "keep the definition of the certificates in a file",
+	Long: `
+"state" handles the definition of the certificates in a file in YAML format, so
+it can be kept in a repository of git and applied like the rest of the
+infrastructure (GitOps).
+
+	export  writes the state of the certificates directory, in the file given
+	        in "-out" or in the standard output by default
+	diff    prints the differences between FILE and the certificates directory,
+	        and exits with status 1 whether there is some one
+	apply   issues the certificates of FILE which are missing, and reissues the
+	        ones whose definition changed, through "req" and "sign" in batch
+	        mode; "-dry-run" prints the commands without running them
+
+The state is canonical: the certificates are sorted by name and the hostnames
+are sorted too, so the export of the same directory is always the same file:
+
+	certificates:
+	  - name: api
+	    profile: server
+	    key: ecdsa-p256
+	    ca: services
+	    hosts:
+	      - api.example.com
+	      - 10.0.0.5
+	  - name: sso
+	    profile: saml
+	    key: rsa-2048
+
+The profile is "server" (by default), or "spki" and "saml" for the nameless
+certificates (see "req"); the key is "rsa-BITS" or "ecdsa-CURVE", and whether
+it is not set, it is not compared; "ca" is the intermediate CA which issues the
+certificate (see "sign -ca"), the root CA whether it is not set. The hostnames
+without domain are expanded like in "req -host".
+
+The certificates of the directory which are not in FILE are only reported, so
+they have to be revoked explicitly. The CAs, the device identities and the
+certificates imported from other CAs are left out of the state.
+`,
+	Run: runState,
+}
+
+func init() {
+	addFlags(cmdState, "out", "dry-run")
+}
+
+// Profiles of the certificates in the state.
+const (
+	PROFILE_SERVER = "server"
+	PROFILE_SPKI   = "spki"
+	PROFILE_SAML   = "saml"
+)
+
+// stateCert represents the definition of a certificate.
+type stateCert struct {
+	Name    string
+	Profile string
+	Key     string
+	CA      string // Intermediate CA, or empty for the root CA.
+	Hosts   []string
+}
+
+// stateChange represents a certificate to issue or to reissue, whose current
+// definition is `cur`, or nil whether it is not in the store.
+type stateChange struct {
+	want, cur *stateCert
+	diff      []string
+}
+
+func runState(cmd *flagplus.Subcommand, args []string) {
+	if len(args) == 0 || (args[0] == "export" && len(args) != 1) ||
+		((args[0] == "diff" || args[0] == "apply") && len(args) != 2) {
+		log.Print("Missing required arguments: export | diff FILE | apply FILE")
+		cmd.Usage()
+	}
+
+	switch args[0] {
+	case "export":
+		data := formatState(currentState())
+		if *Out == "" {
+			os.Stdout.Write(data)
+			return
+		}
+		if err := writeFileAtomic(*Out, data, 0644); err != nil {
+			log.Fatal(err)
+		}
+		fmt.Printf("\n== Generated\n- State:\t%q\n", *Out)
+	case "diff":
+		changes, extra := diffState(mustReadState(args[1]))
+		printStateDiff(changes, extra)
+		if len(changes) != 0 || len(extra) != 0 {
+			os.Exit(1)
+		}
+	case "apply":
+		changes, extra := diffState(mustReadState(args[1]))
+		printStateDiff(changes, extra)
+		ApplyState(changes)
+	default:
+		log.Printf("Unknown action: %q", args[0])
+		cmd.Usage()
+	}
+}
+
+// currentState returns the definition of the certificates of the store, sorted
+// by name.
+func currentState() []*stateCert {
+	cas := loadIntermediates()
+	root, err := parseCertFile(caFile(NAME_CA))
+	if err != nil {
+		log.Fatal(err)
+	}
+	cas = append(cas, &storeCert{Name: "", Cert: root})
+
+	var list []*stateCert
+	for _, v := range loadCerts() {
+		if v.Cert.IsCA || v.Cert.Subject.SerialNumber != "" {
+			continue
+		}
+		issuer := issuerOf(v.Cert, cas)
+		if issuer == nil {
+			continue
+		}
+
+		c := &stateCert{Name: v.Name, Profile: PROFILE_SERVER, Key: stateKey(v.Cert), CA: issuer.Name}
+		c.Hosts = append(c.Hosts, v.Cert.DNSNames...)
+		for _, ip := range v.Cert.IPAddresses {
+			c.Hosts = append(c.Hosts, ip.String())
+		}
+		sort.Strings(c.Hosts)
+
+		if len(c.Hosts) == 0 {
+			c.Profile = PROFILE_SPKI
+			if v.Cert.KeyUsage == x509.KeyUsageDigitalSignature|x509.KeyUsageKeyEncipherment {
+				c.Profile = PROFILE_SAML
+			}
+		}
+		list = append(list, c)
+	}
+	return list
+}
+
+// stateKey returns the type of the public key of the certificate, like
+// "rsa-2048" or "ecdsa-p256".
+func stateKey(cert *x509.Certificate) string {
+	switch pub := cert.PublicKey.(type) {
+	case *rsa.PublicKey:
+		return KEY_TYPE_RSA + "-" + strconv.Itoa(pub.N.BitLen())
+	case *ecdsa.PublicKey:
+		for name, curve := range curves {
+			if curve == pub.Curve {
+				return KEY_TYPE_ECDSA + "-" + name
+			}
+		}
+	}
+	return "unknown"
+}
+
+// parseStateKey returns the specification of the key, like "rsa-2048" or
+// "ecdsa-p256".
+func parseStateKey(s string) (*keySpec, error) {
+	k := &keySpec{RSASize: KeySpec.RSASize, Curve: KeySpec.Curve}
+
+	i := strings.IndexByte(s, '-')
+	if i == -1 {
+		return nil, fmt.Errorf("wrong key %q; it has to be like \"rsa-2048\" or \"ecdsa-p256\"", s)
+	}
+	k.Type = s[:i]
+
+	switch k.Type {
+	case KEY_TYPE_RSA:
+		size, err := strconv.Atoi(s[i+1:])
+		if err != nil {
+			return nil, fmt.Errorf("wrong key %q: %s", s, err)
+		}
+		k.RSASize = size
+	case KEY_TYPE_ECDSA:
+		k.Curve = s[i+1:]
+	}
+	if err := k.check(); err != nil {
+		return nil, fmt.Errorf("wrong key %q: %s", s, err)
+	}
+	return k, nil
+}
+
+// formatState returns the state in canonical YAML.
+func formatState(list []*stateCert) []byte {
+	var buf bytes.Buffer
+
+	buf.WriteString("certificates:\n")
+	for _, c := range list {
+		fmt.Fprintf(&buf, "  - name: %s\n", yamlString(c.Name))
+		fmt.Fprintf(&buf, "    profile: %s\n", c.Profile)
+		if c.Key != "" {
+			fmt.Fprintf(&buf, "    key: %s\n", c.Key)
+		}
+		if c.CA != "" {
+			fmt.Fprintf(&buf, "    ca: %s\n", yamlString(c.CA))
+		}
+		if len(c.Hosts) != 0 {
+			buf.WriteString("    hosts:\n")
+			for _, h := range c.Hosts {
+				fmt.Fprintf(&buf, "      - %s\n", yamlString(h))
+			}
+		}
+	}
+	return buf.Bytes()
+}
+
+// yamlString quotes the string whether it would not be a plain scalar, like
+// the wildcards.
+func yamlString(s string) string {
+	if s == "" || strings.ContainsAny(s, ":#*&!|>'\"%@`{}[],") || strings.TrimSpace(s) != s {
+		return strconv.Quote(s)
+	}
+	return s
+}
+
+// mustReadState returns the state of the file, checked.
+func mustReadState(file string) []*stateCert {
+	f, err := os.Open(file)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer f.Close()
+
+	list, err := parseState(f)
+	if err != nil {
+		log.Fatalf("%s: %s", file, err)
+	}
+	return list
+}
+
+// parseState parses the state in YAML, in the format written by formatState:
+// the list "certificates" of maps of scalars, with the list "hosts".
+func parseState(r io.Reader) ([]*stateCert, error) {
+	var list []*stateCert
+	var cur *stateCert
+	inList, inHosts := false, false
+	seen := make(map[string]bool)
+
+	s := bufio.NewScanner(r)
+	for n := 1; s.Scan(); n++ {
+		line := s.Text()
+		if i := strings.Index(line, " #"); i != -1 {
+			line = line[:i]
+		}
+		text := strings.TrimSpace(line)
+		if text == "" || text[0] == '#' {
+			continue
+		}
+		errLine := func(format string, v ...interface{}) error {
+			return fmt.Errorf("line %d: %s", n, fmt.Sprintf(format, v...))
+		}
+
+		if line[0] != ' ' && line[0] != '-' {
+			if text != "certificates:" {
+				return nil, errLine("unknown key %q", text)
+			}
+			inList = true
+			continue
+		}
+		if !inList {
+			return nil, errLine("out of \"certificates\"")
+		}
+
+		item := strings.HasPrefix(text, "- ")
+		if item {
+			text = strings.TrimSpace(text[2:])
+		}
+		if item && inHosts && !strings.HasPrefix(text, "name:") {
+			h, err := yamlValue(text)
+			if err != nil {
+				return nil, errLine("%s", err)
+			}
+			cur.Hosts = append(cur.Hosts, h)
+			continue
+		}
+
+		key, value := text, ""
+		if i := strings.IndexByte(text, ':'); i != -1 {
+			key, value = strings.TrimSpace(text[:i]), strings.TrimSpace(text[i+1:])
+		} else {
+			return nil, errLine("missing \":\"")
+		}
+		if item {
+			if key != "name" {
+				return nil, errLine("the certificate has to start with \"name\"")
+			}
+			cur = &stateCert{Profile: PROFILE_SERVER}
+			list = append(list, cur)
+		} else if cur == nil {
+			return nil, errLine("field out of a certificate")
+		}
+		inHosts = false
+
+		if key == "hosts" && value == "" {
+			inHosts = true
+			continue
+		}
+		if key == "hosts" && strings.HasPrefix(value, "[") && strings.HasSuffix(value, "]") {
+			for _, v := range strings.Split(value[1:len(value)-1], ",") {
+				if v = strings.TrimSpace(v); v != "" {
+					h, err := yamlValue(v)
+					if err != nil {
+						return nil, errLine("%s", err)
+					}
+					cur.Hosts = append(cur.Hosts, h)
+				}
+			}
+			continue
+		}
+
+		v, err := yamlValue(value)
+		if err != nil {
+			return nil, errLine("%s", err)
+		}
+		switch key {
+		case "name":
+			if !validName.MatchString(v) {
+				return nil, errLine("invalid name %q", v)
+			}
+			if seen[v] {
+				return nil, errLine("certificate repeated: %q", v)
+			}
+			seen[v] = true
+			cur.Name = v
+		case "profile":
+			if v != PROFILE_SERVER && v != PROFILE_SPKI && v != PROFILE_SAML {
+				return nil, errLine("unknown profile %q", v)
+			}
+			cur.Profile = v
+		case "key":
+			if _, err = parseStateKey(v); err != nil {
+				return nil, errLine("%s", err)
+			}
+			cur.Key = v
+		case "ca":
+			if v == NAME_CA {
+				v = ""
+			}
+			cur.CA = v
+		default:
+			return nil, errLine("unknown field %q", key)
+		}
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+
+	for _, c := range list {
+		if c.Profile != PROFILE_SERVER && len(c.Hosts) != 0 {
+			return nil, fmt.Errorf("%s: a nameless certificate (%q) can not have hostnames", c.Name, c.Profile)
+		}
+		if c.Profile == PROFILE_SERVER && len(c.Hosts) == 0 {
+			return nil, fmt.Errorf("%s: a certificate of server needs hostnames", c.Name)
+		}
+	}
+	return list, nil
+}
+
+// yamlValue returns the value of a scalar, unquoted.
+func yamlValue(s string) (string, error) {
+	if strings.HasPrefix(s, `"`) {
+		return strconv.Unquote(s)
+	}
+	if strings.HasPrefix(s, "'") {
+		if len(s) < 2 || !strings.HasSuffix(s, "'") {
+			return "", fmt.Errorf("wrong quoted string: %s", s)
+		}
+		return strings.ReplaceAll(s[1:len(s)-1], "''", "'"), nil
+	}
+	return s, nil
+}
+
+// diffState returns the certificates of the state which have to be issued or
+// reissued, and the names of the ones which are only in the store.
+func diffState(want []*stateCert) (changes []*stateChange, extra []string) {
+	cur := make(map[string]*stateCert)
+	for _, c := range currentState() {
+		cur[c.Name] = c
+	}
+	suffixes := loadStoreConfig().AutoSANs
+
+	sort.Slice(want, func(i, j int) bool { return want[i].Name < want[j].Name })
+	for _, w := range want {
+		c := cur[w.Name]
+		delete(cur, w.Name)
+		if c == nil {
+			changes = append(changes, &stateChange{want: w})
+			continue
+		}
+
+		var diff []string
+		if w.Profile != c.Profile {
+			diff = append(diff, fmt.Sprintf("profile %s -> %s", c.Profile, w.Profile))
+		}
+		if w.Key != "" && w.Key != c.Key {
+			diff = append(diff, fmt.Sprintf("key %s -> %s", c.Key, w.Key))
+		}
+		if w.CA != c.CA {
+			diff = append(diff, fmt.Sprintf("ca %s -> %s", caLabel(c.CA), caLabel(w.CA)))
+		}
+		hosts, err := expandHosts(w.Hosts, suffixes)
+		if err != nil {
+			log.Fatalf("%s: %s", w.Name, err)
+		}
+		if strings.Join(hosts, ",") != strings.Join(c.Hosts, ",") {
+			diff = append(diff, fmt.Sprintf("hosts %s -> %s",
+				strings.Join(c.Hosts, ", "), strings.Join(hosts, ", ")))
+		}
+		if len(diff) != 0 {
+			changes = append(changes, &stateChange{want: w, cur: c, diff: diff})
+		}
+	}
+
+	for name := range cur {
+		extra = append(extra, name)
+	}
+	sort.Strings(extra)
+	return changes, extra
+}
+
+// expandHosts returns the hostnames sorted, with the ones without domain
+// expanded with the suffixes of "auto_sans", like "req -host".
+func expandHosts(hosts, suffixes []string) ([]string, error) {
+	var h hostFlag
+	for _, v := range hosts {
+		if err := h.Set(v); err != nil {
+			return nil, fmt.Errorf("%q %s", v, err)
+		}
+	}
+	if err := h.expand(suffixes); err != nil {
+		return nil, err
+	}
+
+	var list []string
+	for _, v := range append(h.dns, h.ip...) {
+		list = append(list, v[strings.IndexByte(v, ':')+1:])
+	}
+	sort.Strings(list)
+	return list, nil
+}
+
+func caLabel(name string) string {
+	if name == "" {
+		return NAME_CA
+	}
+	return name
+}
+
+func printStateDiff(changes []*stateChange, extra []string) {
+	for _, v := range changes {
+		if v.cur == nil {
+			fmt.Printf("+ %s\n", v.want.Name)
+			continue
+		}
+		fmt.Printf("~ %s\n", v.want.Name)
+		for _, d := range v.diff {
+			fmt.Printf("    %s\n", d)
+		}
+	}
+	for _, name := range extra {
+		fmt.Printf("- %s\n", name)
+	}
+}
+
+// ApplyState issues the certificates to issue or to reissue, running "req" and
+// "sign" of this program in batch mode.
+func ApplyState(changes []*stateChange) {
+	if !*IsDryRun && len(changes) != 0 {
+		mustWritable()
+	}
+	exe, err := os.Executable()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	for _, v := range changes {
+		w := v.want
+		reqArgs := []string{"req", "-batch"}
+		signArgs := []string{"sign", "-batch"}
+		if v.cur != nil {
+			reqArgs = append(reqArgs, "-reissue")
+			signArgs = append(signArgs, "-reissue")
+		}
+
+		switch w.Profile {
+		case PROFILE_SPKI:
+			reqArgs = append(reqArgs, "-spki")
+		case PROFILE_SAML:
+			reqArgs = append(reqArgs, "-saml")
+		default:
+			reqArgs = append(reqArgs, "-host", strings.Join(w.Hosts, ","))
+		}
+		if w.Key != "" {
+			k, _ := parseStateKey(w.Key)
+			reqArgs = append(reqArgs, "-key-type", k.Type)
+			if k.Type == KEY_TYPE_ECDSA {
+				reqArgs = append(reqArgs, "-curve", k.Curve)
+			} else {
+				reqArgs = append(reqArgs, "-rsa-size", strconv.Itoa(k.RSASize))
+			}
+		}
+		if w.CA != "" {
+			signArgs = append(signArgs, "-ca", w.CA)
+		}
+		reqArgs = append(reqArgs, w.Name)
+		signArgs = append(signArgs, w.Name)
+
+		for _, args := range [][]string{reqArgs, signArgs} {
+			fmt.Printf("\n== %s %s\n", PROGRAM, strings.Join(args, " "))
+			if *IsDryRun {
+				continue
+			}
+			c := exec.Command(exe, args...)
+			c.Stdout = os.Stdout
+			c.Stderr = os.Stderr
+			if err = c.Run(); err != nil {
+				log.Fatalf("%s: %s", w.Name, err)
+			}
+		}
+	}
+}
@@ -0,0 +1,227 @@
+// Copyright 2014 Jonas mg
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/tredoe/flagplus"
+)
+
+var cmdStats = &flagplus.Subcommand{
+	UsageLine: "stats [-json] [-readonly]",
+	Short:     "show statistics of the certificates issued",
+	Long: `
+"stats" shows a quick overview of the certificates issued by the CA, from its
+database: the number of certificates by status (valid, expired and revoked),
+the issuance by month, the distribution of the algorithms of the keys, and a
+histogram of the expirations of the valid certificates.
+
+The issuance and the keys are got from the copies of the certificates kept by
+OpenSSL in the directory "newcerts"; the ones whose copy is missing are counted
+like unknown. The statistics are printed in JSON format whether it is used the
+flag "-json".
+`,
+	Run: runStats,
+}
+
+func init() {
+	addFlags(cmdStats, "json", "readonly")
+}
+
+// STATS_BAR_WIDTH is the number of characters of the longest bar of the
+// histograms.
+const STATS_BAR_WIDTH = 40
+
+// STATS_UNKNOWN is the key of the certificates whose copy is missing.
+const STATS_UNKNOWN = "unknown"
+
+// expirationBuckets are the upper limits, in days, of the histogram of the
+// expirations; the last bucket has the rest.
+var expirationBuckets = []int{7, 30, 90, 365}
+
+// statsCount represents the number of certificates of an item of a histogram.
+type statsCount struct {
+	Name  string `json:"name"`
+	Count int    `json:"count"`
+}
+
+// storeStats represents the statistics of the certificates issued.
+type storeStats struct {
+	Total       int          `json:"total"`
+	Status      []statsCount `json:"status"`
+	Issuance    []statsCount `json:"issuance_by_month"`
+	Keys        []statsCount `json:"key_algorithms"`
+	Expirations []statsCount `json:"expirations"`
+}
+
+func runStats(cmd *flagplus.Subcommand, args []string) {
+	if len(args) != 0 {
+		log.Print("Too many arguments")
+		cmd.Usage()
+	}
+
+	entries, err := readIndex()
+	if err != nil {
+		if os.IsNotExist(err) {
+			log.Fatalf("Database of the CA not found: %q", File.Index)
+		}
+		log.Fatal(err)
+	}
+	stats, err := newStoreStats(entries, time.Now())
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if *IsJSON {
+		data, err := json.MarshalIndent(stats, "", "\t")
+		if err != nil {
+			log.Fatal(err)
+		}
+		fmt.Printf("%s\n", data)
+		return
+	}
+
+	fmt.Printf("== Certificates: %d\n\n", stats.Total)
+	printHistogram(stats.Status)
+	fmt.Print("\n== Issuance by month\n\n")
+	printHistogram(stats.Issuance)
+	fmt.Print("\n== Key algorithms\n\n")
+	printHistogram(stats.Keys)
+	fmt.Print("\n== Expirations of the valid certificates\n\n")
+	printHistogram(stats.Expirations)
+}
+
+// newStoreStats returns the statistics of the entries of the database at the
+// time `now`.
+func newStoreStats(entries []*indexEntry, now time.Time) (*storeStats, error) {
+	var valid, expired, revoked int
+	issuance := make(map[string]int)
+	keys := make(map[string]int)
+	expirations := make([]int, len(expirationBuckets)+1)
+
+	for _, e := range entries {
+		expiry, err := e.expiry()
+		if err != nil {
+			return nil, err
+		}
+
+		switch {
+		case e.Status == INDEX_REVOKED:
+			revoked++
+		case e.Status == INDEX_EXPIRED || !expiry.After(now):
+			expired++
+		default:
+			valid++
+			days := int(expiry.Sub(now).Hours() / 24)
+			i := sort.SearchInts(expirationBuckets, days)
+			expirations[i]++
+		}
+
+		month, key := STATS_UNKNOWN, STATS_UNKNOWN
+		file := filepath.Join(Dir.NewCert, e.Serial+".pem")
+		if cert, err := parseCertFile(file); err == nil {
+			month = cert.NotBefore.UTC().Format("2006-01")
+			if r, err := checkPublicKey(cert.PublicKey); err == nil {
+				key = keyAlgorithm(r)
+			}
+		} else if !os.IsNotExist(err) {
+			log.Printf("%s: %s", file, err)
+		}
+		issuance[month]++
+		keys[key]++
+	}
+
+	stats := &storeStats{
+		Total: len(entries),
+		Status: []statsCount{
+			{"valid", valid},
+			{"expired", expired},
+			{"revoked", revoked},
+		},
+		Issuance: sortedCounts(issuance, func(a, b string) bool {
+			return a < b // the format of the months sorts them by time
+		}),
+		Keys: sortedCounts(keys, func(a, b string) bool {
+			return keys[a] > keys[b] || (keys[a] == keys[b] && a < b)
+		}),
+	}
+
+	for i, v := range expirations {
+		name := "more than 1 year"
+		if i < len(expirationBuckets) {
+			name = "within " + strconv.Itoa(expirationBuckets[i]) + " days"
+		}
+		stats.Expirations = append(stats.Expirations, statsCount{name, v})
+	}
+	return stats, nil
+}
+
+// keyAlgorithm returns the algorithm and the size or the curve of the key.
+func keyAlgorithm(r *keyReport) string {
+	switch {
+	case r.Type == "Ed25519":
+		return r.Type
+	case r.Curve != "":
+		return r.Type + " " + r.Curve
+	}
+	return r.Type + " " + strconv.Itoa(r.Size)
+}
+
+// sortedCounts returns the counts sorted with `less`, but with the unknown ones
+// at the end.
+func sortedCounts(counts map[string]int, less func(a, b string) bool) []statsCount {
+	names := make([]string, 0, len(counts))
+	for k := range counts {
+		if k != STATS_UNKNOWN {
+			names = append(names, k)
+		}
+	}
+	sort.Slice(names, func(i, j int) bool { return less(names[i], names[j]) })
+	if _, ok := counts[STATS_UNKNOWN]; ok {
+		names = append(names, STATS_UNKNOWN)
+	}
+
+	list := make([]statsCount, len(names))
+	for i, v := range names {
+		list[i] = statsCount{v, counts[v]}
+	}
+	return list
+}
+
+// printHistogram prints the counts with bars scaled to the largest one.
+func printHistogram(counts []statsCount) {
+	if len(counts) == 0 {
+		fmt.Println("  none")
+		return
+	}
+	width, max := 0, 0
+	for _, v := range counts {
+		if len(v.Name) > width {
+			width = len(v.Name)
+		}
+		if v.Count > max {
+			max = v.Count
+		}
+	}
+
+	for _, v := range counts {
+		n := 0
+		if max != 0 {
+			n = (v.Count*STATS_BAR_WIDTH + max - 1) / max
+		}
+		fmt.Printf("  %-*s %5d %s\n", width, v.Name, v.Count, strings.Repeat("#", n))
+	}
+}
@@ -0,0 +1,188 @@
+// Copyright 2014 Jonas mg
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"encoding/hex"
+	"encoding/pem"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"unicode/utf16"
+
+	"github.com/tredoe/flagplus"
+)
+
+var cmdTrust = &flagplus.Subcommand{
+	UsageLine: "trust -wsl [-dry-run] | trust -vm name1,... [-dry-run]",
+	Short:     "install the CA in WSL or virtual machines",
+	Long: `
+"trust" installs the CA certificate in the store of trusted certificates of the
+system of the guests where the services are developed, so the same CA is
+trusted in the host and in them.
+
+With "-wsl", it is installed in every distribution of the Windows Subsystem for
+Linux found by "wsl.exe -l", but the ones of Docker Desktop, as root.
+
+With "-vm", it is installed in the virtual machines given, through SSH with
+"sudo" (the user has to be allowed to use it), or through "multipass exec"
+whether the name starts with "multipass:" (i.e. "multipass:dev").
+
+The certificate is added like "easycert-HASH.crt", where HASH is the start of
+its SHA-256 fingerprint, in the directory of the system for the local CAs
+(Debian, Ubuntu, Alpine, Fedora, RHEL, Arch Linux or openSUSE), and the store is
+updated. The flag "-dry-run" prints the commands without running them.
+`,
+	Run: runTrust,
+}
+
+var (
+	IsWSL = flag.Bool("wsl", false, "install in the distributions of WSL")
+	VM    = flag.String("vm", "", "virtual machines where to install")
+)
+
+func init() {
+	addFlags(cmdTrust, "wsl", "vm", "dry-run")
+}
+
+// Programs to run the commands in the guests.
+const (
+	CMD_WSL       = "wsl.exe"
+	CMD_SSH       = "ssh"
+	CMD_MULTIPASS = "multipass"
+)
+
+// _VM_MULTIPASS is the prefix of the virtual machines of Multipass.
+const _VM_MULTIPASS = "multipass:"
+
+// wslSkipped are the distributions of WSL where the CA is not installed.
+var wslSkipped = map[string]bool{"docker-desktop": true, "docker-desktop-data": true}
+
+// trustScript is the script to install the certificate, with the name of the
+// file and the certificate in PEM format.
+const trustScript = `set -e
+name=%s
+if [ -d /usr/local/share/ca-certificates ]; then
+	dir=/usr/local/share/ca-certificates; update="update-ca-certificates"
+elif [ -d /etc/pki/ca-trust/source/anchors ]; then
+	dir=/etc/pki/ca-trust/source/anchors; update="update-ca-trust extract"
+elif [ -d /etc/ca-certificates/trust-source/anchors ]; then
+	dir=/etc/ca-certificates/trust-source/anchors; update="trust extract-compat"
+elif [ -d /usr/share/pki/trust/anchors ]; then
+	dir=/usr/share/pki/trust/anchors; update="update-ca-certificates"
+else
+	echo "unknown store of certificates" >&2; exit 1
+fi
+cat > "$dir/$name" <<'EOF'
+%sEOF
+$update
+echo "installed $dir/$name"
+`
+
+func runTrust(cmd *flagplus.Subcommand, args []string) {
+	if len(args) != 0 {
+		log.Print("Too many arguments")
+		cmd.Usage()
+	}
+	if *IsWSL == (*VM != "") {
+		log.Print("Flags -wsl and -vm are mutually exclusive, and one is required")
+		cmd.Usage()
+	}
+
+	ca, err := parseCertFile(filepath.Join(Dir.Cert, NAME_CA+EXT_CERT))
+	if err != nil {
+		log.Fatal(err)
+	}
+	script := fmt.Sprintf(trustScript,
+		"easycert-"+hex.EncodeToString(sha256Sum(ca.Raw))[:16]+EXT_CERT,
+		pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.Raw}))
+
+	var cmds [][]string
+	if *IsWSL {
+		distros, err := wslDistros()
+		if err != nil {
+			log.Fatal(err)
+		}
+		if len(distros) == 0 {
+			log.Fatal("No distribution of WSL found")
+		}
+		for _, v := range distros {
+			cmds = append(cmds, []string{CMD_WSL, "-d", v, "-u", "root", "-e", "sh", "-c", script})
+		}
+	} else {
+		for _, v := range strings.Split(*VM, ",") {
+			if v = strings.TrimSpace(v); v == "" {
+				continue
+			}
+			if strings.HasPrefix(v, _VM_MULTIPASS) {
+				cmds = append(cmds, []string{CMD_MULTIPASS, "exec", strings.TrimPrefix(v, _VM_MULTIPASS),
+					"--", "sudo", "sh", "-c", script})
+				continue
+			}
+			sshArgs := []string{CMD_SSH}
+			if isTerminal(os.Stdin) {
+				sshArgs = append(sshArgs, "-t") // for the password of sudo
+			}
+			cmds = append(cmds, append(sshArgs, v, "--", "sudo sh -c "+shellQuote(script)))
+		}
+	}
+
+	if len(cmds) == 0 {
+		log.Fatal("No virtual machine given")
+	}
+
+	failed := 0
+	for _, v := range cmds {
+		// The script is not printed, since it is the same for all.
+		fmt.Printf("\n== %s\n", strings.Join(v[:len(v)-1], " "))
+		if *IsDryRun {
+			continue
+		}
+		c := exec.Command(v[0], v[1:]...)
+		c.Stdin = os.Stdin
+		c.Stdout = os.Stdout
+		c.Stderr = os.Stderr
+		if err := c.Run(); err != nil {
+			log.Print(err)
+			failed++
+		}
+	}
+	if failed != 0 {
+		log.Fatalf("The CA could not be installed in %d of %d guests", failed, len(cmds))
+	}
+}
+
+// wslDistros returns the names of the distributions of WSL, but the skipped
+// ones.
+func wslDistros() ([]string, error) {
+	out, err := exec.Command(CMD_WSL, "-l", "-q").Output()
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", CMD_WSL, err)
+	}
+
+	// The output is in UTF-16 (little endian) whether it is run from Windows.
+	if (len(out) >= 2 && len(out)%2 == 0 && out[1] == 0) || strings.HasPrefix(string(out), "\xff\xfe") {
+		u := make([]uint16, 0, len(out)/2)
+		for i := 0; i+1 < len(out); i += 2 {
+			u = append(u, uint16(out[i])|uint16(out[i+1])<<8)
+		}
+		out = []byte(string(utf16.Decode(u)))
+	}
+
+	var list []string
+	for _, v := range strings.Split(string(out), "\n") {
+		v = strings.Trim(v, "\ufeff\r\x00 \t")
+		if v != "" && !wslSkipped[v] {
+			list = append(list, v)
+		}
+	}
+	return list, nil
+}
@@ -0,0 +1,209 @@
+// Copyright 2014 Jonas mg
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/tredoe/flagplus"
+)
+
+var cmdVerifyBundle = &flagplus.Subcommand{
+	UsageLine: "verify-bundle [-ca name] FILE | verify-bundle [-ca name] DIR",
+	Short:     "verify the signature of an exported bundle",
+	Long: `
+"verify-bundle" checks that a bundle written by "export -sign" comes from the
+expected store, before installing it: its detached signature in CMS, "FILE.p7s"
+or "DIR/manifest.json.p7s", is checked against the CA given in "-ca" ("ca" by
+default), which can be the file of the root CA of the store, to verify without
+a certificates directory.
+
+In a directory, the signature is of its manifest, and every file has to be
+listed in the manifest with the same digest and size; the store of the manifest
+has to be the one of the CA whether it is a root CA.
+
+The signer is pinned after the verification of the chain: it has to be the CA
+itself, or a certificate of code signing issued by it ("req -code-signing"), so
+a bundle signed by any other certificate of the store, like the one of a
+server, is refused.
+`,
+	Run: runVerifyBundle,
+}
+
+func init() {
+	addFlags(cmdVerifyBundle, "ca")
+}
+
+func runVerifyBundle(cmd *flagplus.Subcommand, args []string) {
+	if len(args) != 1 {
+		log.Print("Missing required argument: FILE or DIR")
+		cmd.Usage()
+	}
+	VerifyBundle(args[0])
+}
+
+// checkBundleSigner checks the certificate of "-signer" before exporting: it has
+// to be the CA, or a certificate of code signing, without expiring.
+func checkBundleSigner() {
+	setCertPath(*Signer)
+	cert, err := parseCertFile(File.Cert)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if time.Now().After(cert.NotAfter) {
+		log.Fatalf("Certificate expired: %q", *Signer)
+	}
+	if *Signer != NAME_CA && !isCodeSigning(cert) {
+		log.Fatalf("The bundles are only signed by the CA or by a certificate of code signing (\"req -code-signing\"): %q", *Signer)
+	}
+}
+
+// signBundle writes the detached signature of the bundle written in `out` by
+// "export", with the certificate of "-signer": the one of the file or, in a
+// directory, the one of its manifest.
+func signBundle(out string) {
+	info, err := os.Stat(out)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if info.IsDir() {
+		out = filepath.Join(out, FILE_MANIFEST)
+	}
+
+	cert := signDetached(*Signer, out, out+EXT_CMS_SIGN)
+	fmt.Printf("- Signature:\t%q\n- Signer:\t%s\n", out+EXT_CMS_SIGN, cert.Subject)
+}
+
+// VerifyBundle verifies the signature of the bundle in the file or directory,
+// and the digests of the files of a directory.
+func VerifyBundle(bundle string) {
+	info, err := os.Stat(bundle)
+	if err != nil {
+		log.Fatal(err)
+	}
+	content := bundle
+	if info.IsDir() {
+		content = filepath.Join(bundle, FILE_MANIFEST)
+	}
+	ca, err := parseCertFile(caFile(*CACert))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	tmp, err := os.CreateTemp("", "easycert-signer-")
+	if err != nil {
+		log.Fatal(err)
+	}
+	tmp.Close()
+	defer os.Remove(tmp.Name())
+
+	if _, err = opensslNoFatal("cms", "-verify", "-binary", "-purpose", "any",
+		"-inform", "DER", "-in", content+EXT_CMS_SIGN, "-content", content,
+		"-CAfile", caFile(*CACert), "-signer", tmp.Name(), "-out", os.DevNull,
+	); err != nil {
+		log.Fatalf("Signature not valid: %q\n\n%s", content+EXT_CMS_SIGN, err)
+	}
+	signer, err := parseCertFile(tmp.Name())
+	if err != nil {
+		log.Fatal(err)
+	}
+	if !bytes.Equal(signer.Raw, ca.Raw) && !isCodeSigning(signer) {
+		log.Fatalf("Signer not allowed: %s\n\n"+
+			"  The bundles are only signed by the CA or by a certificate of code signing",
+			signer.Subject)
+	}
+
+	fmt.Printf("== Verified\n- Bundle:\t%q\n- Signer:\t%s\n", bundle, signer.Subject)
+	if bytes.Equal(ca.RawIssuer, ca.RawSubject) {
+		fmt.Printf("- Store:\t%s\n", fingerprint(sha256Sum(ca.Raw)))
+	}
+
+	if info.IsDir() {
+		n, err := checkBundleFiles(bundle, ca)
+		if err != nil {
+			log.Fatal(err)
+		}
+		fmt.Printf("- Files:\t%d\n", n)
+	}
+}
+
+// isCodeSigning reports whether the certificate is a dedicated one to sign the
+// releases, with the extended key usage of code signing.
+func isCodeSigning(cert *x509.Certificate) bool {
+	for _, usage := range cert.ExtKeyUsage {
+		if usage == x509.ExtKeyUsageCodeSigning {
+			return true
+		}
+	}
+	return false
+}
+
+// checkBundleFiles checks the files of the directory against its manifest,
+// returning their number.
+func checkBundleFiles(dir string, ca *x509.Certificate) (int, error) {
+	data, err := os.ReadFile(filepath.Join(dir, FILE_MANIFEST))
+	if err != nil {
+		return 0, err
+	}
+	m := new(Manifest)
+	if err = json.Unmarshal(data, m); err != nil {
+		return 0, fmt.Errorf("%s: %s", FILE_MANIFEST, err)
+	}
+	if bytes.Equal(ca.RawIssuer, ca.RawSubject) && m.Store != fingerprint(sha256Sum(ca.Raw)) {
+		return 0, fmt.Errorf("the manifest is of other store: %s", m.Store)
+	}
+
+	listed := make(map[string]bool)
+	for _, f := range m.Files {
+		if !filepath.IsLocal(filepath.FromSlash(f.Name)) {
+			return 0, fmt.Errorf("file out of the bundle in the manifest: %q", f.Name)
+		}
+		data, err := os.ReadFile(filepath.Join(dir, filepath.FromSlash(f.Name)))
+		if err != nil {
+			return 0, err
+		}
+		if len(data) != f.Size || hex.EncodeToString(sha256Sum(data)) != f.SHA256 {
+			return 0, fmt.Errorf("file modified: %q", f.Name)
+		}
+		listed[f.Name] = true
+	}
+
+	// The files added to the bundle after it was signed.
+	var extra []string
+	err = filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		name, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		name = filepath.ToSlash(name)
+		if name != FILE_MANIFEST && name != FILE_MANIFEST+EXT_CMS_SIGN && !listed[name] {
+			extra = append(extra, name)
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	if len(extra) != 0 {
+		sort.Strings(extra)
+		return 0, fmt.Errorf("files not in the manifest: %q", extra)
+	}
+	return len(m.Files), nil
+}
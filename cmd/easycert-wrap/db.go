@@ -0,0 +1,334 @@
+// Copyright 2014 Jonas mg
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// The database of the root CA is kept by a driver: bbolt in the file
+// "index.db" by default, or an external database set in the field "database"
+// of "store.json", for the deployments which need high availability or
+// external backups. The files of OpenSSL ("index.txt", "serial" and
+// "crlnumber") are written from it before of being used by OpenSSL, and they
+// are stored into it after every change.
+
+// Drivers of the database of the CA.
+const (
+	DB_BOLT     = "bolt" // The default.
+	DB_FILE     = "file" // Only the files of OpenSSL.
+	DB_SQLITE   = "sqlite"
+	DB_POSTGRES = "postgres"
+)
+
+// FILE_DB is the database of the driver bolt, in the directory of the root CA.
+const FILE_DB = "index.db"
+
+// DatabaseConfig represents the database of the CA.
+type DatabaseConfig struct {
+	Driver string `json:"driver"`
+	DSN    string `json:"dsn,omitempty"` // Data source name of the driver.
+}
+
+// dbState is the content of the database of the CA.
+type dbState struct {
+	Entries   []*indexEntry
+	Serial    string // Next serial number, in hexadecimal.
+	CRLNumber string // Next number of the revocation list; empty whether there is none.
+}
+
+// database stores the database of the CA.
+type database interface {
+	// load returns the content of the database, or nil whether it is empty.
+	load() (*dbState, error)
+	// save replaces the content of the database.
+	save(st *dbState) error
+	close() error
+}
+
+// leaser is a database which can elect the leader of several instances.
+type leaser interface {
+	// lease acquires or renews the lease `name` for `holder` until `expires`,
+	// reporting whether it is held by `holder`. A lease is acquired only when
+	// it is free or has expired.
+	lease(name, holder string, expires time.Time) (bool, error)
+}
+
+// dbDrivers are the drivers built in, which open a database by its DSN.
+// They are registered by the files built with their tag, but bolt.
+var dbDrivers = map[string]func(dsn string) (database, error){}
+
+// dbDriverTags are the build tags of the drivers of external databases.
+var dbDriverTags = map[string]string{
+	DB_SQLITE:   "sqlite",
+	DB_POSTGRES: "postgres",
+}
+
+func (c *DatabaseConfig) check() error {
+	if c.Driver == DB_FILE || c.Driver == DB_BOLT {
+		return nil
+	}
+	tag, ok := dbDriverTags[c.Driver]
+	if !ok {
+		return fmt.Errorf("database has an unknown driver: %q", c.Driver)
+	}
+	if _, ok = dbDrivers[c.Driver]; !ok {
+		return fmt.Errorf("database driver %q is not built in; build with the tag %q", c.Driver, tag)
+	}
+	if c.DSN == "" {
+		return errors.New("database needs the field dsn")
+	}
+	return nil
+}
+
+// openDatabase opens the database of the root CA, or returns nil whether it is
+// kept only in the files of OpenSSL. With `create` false, nil is returned
+// whether the file of bolt does not exist yet.
+func openDatabase(create bool) (database, string, error) {
+	cfg := loadStoreConfig().Database
+	if cfg == nil {
+		cfg = &DatabaseConfig{Driver: DB_BOLT}
+	}
+	if cfg.Driver == DB_FILE {
+		return nil, "", nil
+	}
+
+	dsn := cfg.DSN
+	if cfg.Driver == DB_BOLT && dsn == "" {
+		dsn = filepath.Join(Dir.Root, FILE_DB)
+	}
+	if cfg.Driver == DB_BOLT && !create {
+		if _, err := os.Stat(dsn); os.IsNotExist(err) {
+			return nil, "", nil
+		}
+	}
+	db, err := dbDrivers[cfg.Driver](dsn)
+	if err != nil {
+		return nil, "", fmt.Errorf("database %s: %s", cfg.Driver, err)
+	}
+	return db, cfg.Driver, nil
+}
+
+// loadDatabase returns the content of the database of the root CA, or nil
+// whether it is kept only in the files of OpenSSL or it is empty; the store
+// is migrated to it at the first change. The files of OpenSSL are rewritten
+// whether they differ, but in read-only mode.
+func loadDatabase() (*dbState, error) {
+	if issuerCA != NAME_CA {
+		return nil, nil
+	}
+	db, driver, err := openDatabase(false)
+	if db == nil || err != nil {
+		return nil, err
+	}
+	defer db.close()
+
+	st, err := db.load()
+	if err != nil {
+		return nil, fmt.Errorf("database %s: %s", driver, err)
+	}
+	if st == nil || readOnly() {
+		return st, nil
+	}
+
+	for file, data := range map[string][]byte{
+		File.Index:     formatIndex(st.Entries),
+		File.Serial:    []byte(st.Serial + "\n"),
+		File.CRLNumber: []byte(st.CRLNumber + "\n"),
+	} {
+		if file == File.CRLNumber && st.CRLNumber == "" {
+			continue
+		}
+		if cur, err := os.ReadFile(file); err == nil && bytes.Equal(cur, data) {
+			continue
+		}
+		if err = writeFileAtomic(file, data, 0644); err != nil {
+			return nil, err
+		}
+	}
+	return st, nil
+}
+
+// storeDatabase stores the files of OpenSSL of the root CA into its database.
+func storeDatabase() error {
+	db, driver, err := openDatabase(true)
+	if db == nil || err != nil {
+		return err
+	}
+	defer db.close()
+
+	st := new(dbState)
+	if st.Entries, err = readIndexFile(); err != nil {
+		return err
+	}
+	for file, v := range map[string]*string{File.Serial: &st.Serial, File.CRLNumber: &st.CRLNumber} {
+		data, err := os.ReadFile(file)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		*v = strings.TrimSpace(string(data))
+	}
+
+	if err = db.save(st); err != nil {
+		return fmt.Errorf("database %s: %s", driver, err)
+	}
+	return nil
+}
+
+// == SQL
+//
+
+// Tables of the database of the CA in SQL, valid in SQLite and PostgreSQL.
+const (
+	_SQL_TABLE_INDEX = `CREATE TABLE IF NOT EXISTS easycert_index (
+	seq BIGINT NOT NULL,
+	serial TEXT PRIMARY KEY,
+	status TEXT NOT NULL,
+	expiry TEXT NOT NULL,
+	revocation TEXT NOT NULL,
+	subject TEXT NOT NULL
+)`
+	_SQL_TABLE_STATE = `CREATE TABLE IF NOT EXISTS easycert_state (
+	name TEXT PRIMARY KEY,
+	value TEXT NOT NULL
+)`
+	_SQL_TABLE_LEASE = `CREATE TABLE IF NOT EXISTS easycert_lease (
+	name TEXT PRIMARY KEY,
+	holder TEXT NOT NULL,
+	expires BIGINT NOT NULL
+)`
+)
+
+// sqlDB is a database of the CA through database/sql.
+type sqlDB struct {
+	db *sql.DB
+
+	// param returns the placeholder of the parameter `i`, from 1, in the
+	// dialect of SQL of the driver.
+	param func(i int) string
+}
+
+// openSQL opens the database `dsn` with the driver of database/sql `driver`,
+// creating the tables whether they do not exist.
+func openSQL(driver, dsn string, param func(i int) string) (*sqlDB, error) {
+	db, err := sql.Open(driver, dsn)
+	if err != nil {
+		return nil, err
+	}
+	for _, v := range []string{_SQL_TABLE_INDEX, _SQL_TABLE_STATE, _SQL_TABLE_LEASE} {
+		if _, err = db.Exec(v); err != nil {
+			db.Close()
+			return nil, err
+		}
+	}
+	return &sqlDB{db, param}, nil
+}
+
+func (d *sqlDB) load() (*dbState, error) {
+	st := new(dbState)
+	rows, err := d.db.Query("SELECT name, value FROM easycert_state")
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var name, value string
+		if err = rows.Scan(&name, &value); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		switch name {
+		case "serial":
+			st.Serial = value
+		case "crlnumber":
+			st.CRLNumber = value
+		}
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	if st.Serial == "" {
+		return nil, nil
+	}
+
+	rows, err = d.db.Query("SELECT status, expiry, revocation, serial, subject FROM easycert_index ORDER BY seq")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		e := &indexEntry{File: "unknown"}
+		if err = rows.Scan(&e.Status, &e.Expiry, &e.Revocation, &e.Serial, &e.Subject); err != nil {
+			return nil, err
+		}
+		st.Entries = append(st.Entries, e)
+	}
+	return st, rows.Err()
+}
+
+func (d *sqlDB) save(st *dbState) error {
+	tx, err := d.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err = tx.Exec("DELETE FROM easycert_index"); err != nil {
+		return err
+	}
+	insert := fmt.Sprintf(
+		"INSERT INTO easycert_index (seq, serial, status, expiry, revocation, subject) VALUES (%s, %s, %s, %s, %s, %s)",
+		d.param(1), d.param(2), d.param(3), d.param(4), d.param(5), d.param(6))
+	for i, v := range st.Entries {
+		if _, err = tx.Exec(insert, i, v.Serial, v.Status, v.Expiry, v.Revocation, v.Subject); err != nil {
+			return err
+		}
+	}
+
+	if _, err = tx.Exec("DELETE FROM easycert_state"); err != nil {
+		return err
+	}
+	insert = fmt.Sprintf("INSERT INTO easycert_state (name, value) VALUES (%s, %s)", d.param(1), d.param(2))
+	if _, err = tx.Exec(insert, "serial", st.Serial); err != nil {
+		return err
+	}
+	if _, err = tx.Exec(insert, "crlnumber", st.CRLNumber); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (d *sqlDB) close() error { return d.db.Close() }
+
+func (d *sqlDB) lease(name, holder string, expires time.Time) (bool, error) {
+	now := time.Now().UnixMilli()
+
+	_, err := d.db.Exec(fmt.Sprintf("INSERT INTO easycert_lease (name, holder, expires) "+
+		"SELECT %s, %s, 0 WHERE NOT EXISTS (SELECT 1 FROM easycert_lease WHERE name = %s)",
+		d.param(1), d.param(2), d.param(3)), name, holder, name)
+	if err != nil {
+		return false, err
+	}
+
+	// The holder renews it, or another one takes it once it has expired.
+	res, err := d.db.Exec(fmt.Sprintf("UPDATE easycert_lease SET holder = %s, expires = %s "+
+		"WHERE name = %s AND (holder = %s OR expires < %s)",
+		d.param(1), d.param(2), d.param(3), d.param(4), d.param(5)),
+		holder, expires.UnixMilli(), name, holder, now)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n == 1, err
+}
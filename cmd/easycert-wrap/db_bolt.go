@@ -0,0 +1,108 @@
+// Copyright 2014 Jonas mg
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"strings"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// Buckets of the database of the CA in bolt: the entries by position, and the
+// numbers by name.
+var (
+	_BOLT_INDEX = []byte("index")
+	_BOLT_STATE = []byte("state")
+)
+
+// BOLT_TIMEOUT is the time to wait for the lock of the file, held by another
+// process.
+const BOLT_TIMEOUT = 10 * time.Second
+
+func init() {
+	dbDrivers[DB_BOLT] = openBolt
+}
+
+// boltDB is a database of the CA in a file of bolt.
+type boltDB struct {
+	db *bolt.DB
+}
+
+// openBolt opens the file of bolt, creating it whether it does not exist. It is
+// opened only to read in read-only mode.
+func openBolt(file string) (database, error) {
+	db, err := bolt.Open(file, 0600, &bolt.Options{Timeout: BOLT_TIMEOUT, ReadOnly: readOnly()})
+	if err != nil {
+		return nil, err
+	}
+	return &boltDB{db}, nil
+}
+
+func (d *boltDB) load() (*dbState, error) {
+	var st *dbState
+
+	err := d.db.View(func(tx *bolt.Tx) error {
+		state, index := tx.Bucket(_BOLT_STATE), tx.Bucket(_BOLT_INDEX)
+		if state == nil || index == nil {
+			return nil
+		}
+		st = &dbState{
+			Serial:    string(state.Get([]byte("serial"))),
+			CRLNumber: string(state.Get([]byte("crlnumber"))),
+		}
+
+		return index.ForEach(func(k, v []byte) error {
+			field := strings.SplitN(string(v), "\t", 6)
+			if len(field) != 6 {
+				return fmt.Errorf("entry %d: wrong number of fields", binary.BigEndian.Uint64(k))
+			}
+			st.Entries = append(st.Entries, &indexEntry{
+				field[0], field[1], field[2], field[3], field[4], field[5],
+			})
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return st, nil
+}
+
+func (d *boltDB) save(st *dbState) error {
+	return d.db.Update(func(tx *bolt.Tx) error {
+		for _, v := range [][]byte{_BOLT_INDEX, _BOLT_STATE} {
+			if err := tx.DeleteBucket(v); err != nil && err != bolt.ErrBucketNotFound {
+				return err
+			}
+		}
+		index, err := tx.CreateBucket(_BOLT_INDEX)
+		if err != nil {
+			return err
+		}
+		state, err := tx.CreateBucket(_BOLT_STATE)
+		if err != nil {
+			return err
+		}
+
+		for i, v := range st.Entries {
+			key := binary.BigEndian.AppendUint64(nil, uint64(i))
+			if err = index.Put(key, []byte(v.line())); err != nil {
+				return err
+			}
+		}
+
+		if err = state.Put([]byte("serial"), []byte(st.Serial)); err != nil {
+			return err
+		}
+		return state.Put([]byte("crlnumber"), []byte(st.CRLNumber))
+	})
+}
+
+func (d *boltDB) close() error { return d.db.Close() }
@@ -0,0 +1,21 @@
+// Copyright 2014 Jonas mg
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+//go:build postgres
+
+package main
+
+import (
+	"strconv"
+
+	_ "github.com/lib/pq"
+)
+
+func init() {
+	dbDrivers[DB_POSTGRES] = func(dsn string) (database, error) {
+		return openSQL("postgres", dsn, func(i int) string { return "$" + strconv.Itoa(i) })
+	}
+}
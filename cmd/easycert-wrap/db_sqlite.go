@@ -0,0 +1,17 @@
+// Copyright 2014 Jonas mg
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+//go:build sqlite
+
+package main
+
+import _ "modernc.org/sqlite"
+
+func init() {
+	dbDrivers[DB_SQLITE] = func(dsn string) (database, error) {
+		return openSQL("sqlite", dsn, func(int) string { return "?" })
+	}
+}
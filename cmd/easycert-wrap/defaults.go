@@ -0,0 +1,344 @@
+// Copyright 2014 Jonas mg
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Defaults of the user, shared by all the certificates directories:
+//
+//	# Certificates directory, whether EASYCERT_ROOT is not set.
+//	root = "~/pki"
+//
+//	# Default values of the flags, which are overridden by the command line.
+//	[flags]
+//	years = 2
+//	rsa-size = 4096
+//	json = true
+//
+//	# Default values of the subject, for the configuration created by "init".
+//	[subject]
+//	country = "ES"
+//	organization = "Example Ltd"
+//
+// It is a file in TOML format, but only with strings, integers and booleans.
+//
+// The flags can be set too in variables of environment, which override the file
+// of defaults: the name of the flag in capital letters, with underscores instead
+// of dashes, and the prefix "EASYCERT_FLAG_" (i.e. "EASYCERT_FLAG_RSA_SIZE").
+
+// FILE_DEFAULTS is the file of defaults, into the configuration directory of
+// the user.
+const FILE_DEFAULTS = "easycert/config.toml"
+
+// Defaults of the subject when they are not set.
+const (
+	DEFAULT_COUNTRY      = "UK"
+	DEFAULT_ORGANIZATION = "Internet Widgits Pty Ltd"
+)
+
+// SubjectDefaults represents the default values of the subject.
+type SubjectDefaults struct {
+	Country      string
+	State        string
+	Locality     string
+	Organization string
+	Unit         string
+}
+
+// Defaults represents the file of defaults of the user.
+type Defaults struct {
+	Root    string            // Certificates directory.
+	Flags   map[string]string // Values by name of flag.
+	Subject SubjectDefaults
+}
+
+// Subject has the default values of the subject, from the file of defaults.
+var Subject = SubjectDefaults{
+	Country:      DEFAULT_COUNTRY,
+	Organization: DEFAULT_ORGANIZATION,
+}
+
+var errTOMLValue = errors.New("value not supported; it has to be a string, an integer or a boolean")
+
+// defaultsFile returns the path of the file of defaults, or an empty string
+// whether the configuration directory of the user is unknown.
+func defaultsFile() string {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, filepath.FromSlash(FILE_DEFAULTS))
+}
+
+// loadDefaults reads the file of defaults of the user, whether it exists, and
+// sets the certificates directory and the default values of the flags and of
+// the subject. It has to be called before of parsing the command line, so the
+// flags given there override the defaults.
+func loadDefaults() {
+	file := defaultsFile()
+	if file == "" {
+		return
+	}
+	data, err := os.ReadFile(file)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return
+		}
+		log.Fatal(err)
+	}
+
+	d, err := parseDefaults(data)
+	if err != nil {
+		log.Fatalf("%s: %s", file, err)
+	}
+
+	if d.Root != "" && os.Getenv(ENV_ROOT) == "" {
+		setRoot(File.Cmd, expandHome(d.Root))
+	}
+	for name, value := range d.Flags {
+		if flag.Lookup(name) == nil {
+			log.Fatalf("%s: unknown flag %q", file, name)
+		}
+		if err = flag.Set(name, value); err != nil {
+			log.Fatalf("%s: flag %q: %s", file, name, err)
+		}
+	}
+	Subject = d.Subject
+}
+
+// expandHome replaces the prefix "~/" of the path by the home directory.
+func expandHome(path string) string {
+	if !strings.HasPrefix(path, "~/") {
+		return path
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		log.Fatal(err)
+	}
+	return filepath.Join(home, path[2:])
+}
+
+// ENV_FLAG_PREFIX is the prefix of the variables of environment of the flags.
+// It is not "EASYCERT_" alone, since the hooks get the metadata of the
+// certificate in variables like EASYCERT_NAME or EASYCERT_KEY, which would be
+// taken like flags by the commands run from the hooks.
+const ENV_FLAG_PREFIX = "EASYCERT_FLAG_"
+
+// envFlag returns the name of the variable of environment of the flag.
+func envFlag(name string) string {
+	return ENV_FLAG_PREFIX + strings.ToUpper(strings.ReplaceAll(name, "-", "_"))
+}
+
+// loadEnvFlags sets the flags whose variables of environment are set. It has
+// to be called after of loadDefaults and before of parsing the command line,
+// so the precedence is: command line, environment, and file of defaults.
+func loadEnvFlags() {
+	flag.VisitAll(func(f *flag.Flag) {
+		if strings.Contains(f.Name, ".") { // of the tests
+			return
+		}
+		key := envFlag(f.Name)
+		if value, ok := os.LookupEnv(key); ok {
+			if err := f.Value.Set(value); err != nil {
+				log.Fatalf("Environment variable %s: %s", key, err)
+			}
+		}
+	})
+}
+
+// parseDefaults parses the file of defaults.
+func parseDefaults(data []byte) (*Defaults, error) {
+	tables, err := parseTOML(data)
+	if err != nil {
+		return nil, err
+	}
+
+	d := &Defaults{
+		Flags: tables["flags"],
+		Subject: SubjectDefaults{
+			Country:      DEFAULT_COUNTRY,
+			Organization: DEFAULT_ORGANIZATION,
+		},
+	}
+
+	for key, value := range tables[""] {
+		switch key {
+		case "root":
+			d.Root = value
+		default:
+			return nil, fmt.Errorf("unknown key %q", key)
+		}
+	}
+
+	for key, value := range tables["subject"] {
+		// The values are written into the configuration of OpenSSL, and into
+		// the template for the servers.
+		if strings.ContainsAny(value, "\r\n") || strings.Contains(value, "{{") {
+			return nil, fmt.Errorf("subject: value of %q with several lines or with \"{{\"", key)
+		}
+
+		switch key {
+		case "country":
+			if len(value) != 2 {
+				return nil, fmt.Errorf("subject: country has to be a code of 2 letters: %q", value)
+			}
+			d.Subject.Country = value
+		case "state":
+			d.Subject.State = value
+		case "locality":
+			d.Subject.Locality = value
+		case "organization":
+			d.Subject.Organization = value
+		case "unit":
+			d.Subject.Unit = value
+		default:
+			return nil, fmt.Errorf("subject: unknown key %q", key)
+		}
+	}
+
+	for name := range tables {
+		if name != "" && name != "flags" && name != "subject" {
+			return nil, fmt.Errorf("unknown table %q", name)
+		}
+	}
+	return d, nil
+}
+
+// parseTOML parses the subset of TOML with tables, and keys with strings,
+// integers or booleans, returning the values like strings by key and by table.
+// The keys out of any table are in the table with empty name.
+func parseTOML(data []byte) (map[string]map[string]string, error) {
+	tables := map[string]map[string]string{"": {}}
+	table := ""
+
+	s := bufio.NewScanner(bytes.NewReader(data))
+	for n := 1; s.Scan(); n++ {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+
+		if line[0] == '[' {
+			end := strings.IndexByte(line, ']')
+			if end == -1 || !isTOMLComment(line[end+1:]) {
+				return nil, fmt.Errorf("line %d: wrong table", n)
+			}
+			table = strings.TrimSpace(line[1:end])
+			if !isTOMLKey(table) {
+				return nil, fmt.Errorf("line %d: wrong name of table: %q", n, table)
+			}
+			if _, ok := tables[table]; ok {
+				return nil, fmt.Errorf("line %d: table %q defined twice", n, table)
+			}
+			tables[table] = make(map[string]string)
+			continue
+		}
+
+		i := strings.IndexByte(line, '=')
+		if i == -1 {
+			return nil, fmt.Errorf("line %d: missing '='", n)
+		}
+		key := strings.TrimSpace(line[:i])
+		if !isTOMLKey(key) {
+			return nil, fmt.Errorf("line %d: wrong key: %q", n, key)
+		}
+		if _, ok := tables[table][key]; ok {
+			return nil, fmt.Errorf("line %d: key %q defined twice", n, key)
+		}
+
+		value, err := parseTOMLValue(strings.TrimSpace(line[i+1:]))
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %s", n, err)
+		}
+		tables[table][key] = value
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+	return tables, nil
+}
+
+// parseTOMLValue returns the value, without the comment at the end.
+func parseTOMLValue(s string) (string, error) {
+	if s == "" {
+		return "", errors.New("missing value")
+	}
+
+	switch s[0] {
+	case '"': // basic string
+		for i := 1; i < len(s); i++ {
+			switch s[i] {
+			case '\\':
+				i++
+			case '"':
+				if !isTOMLComment(s[i+1:]) {
+					return "", errTOMLValue
+				}
+				return strconv.Unquote(s[:i+1])
+			}
+		}
+		return "", errors.New("string not closed")
+
+	case '\'': // literal string
+		end := strings.IndexByte(s[1:], '\'')
+		if end == -1 {
+			return "", errors.New("string not closed")
+		}
+		if !isTOMLComment(s[end+2:]) {
+			return "", errTOMLValue
+		}
+		return s[1 : end+1], nil
+	}
+
+	if i := strings.IndexByte(s, '#'); i != -1 {
+		s = strings.TrimSpace(s[:i])
+	}
+	if s == "true" || s == "false" {
+		return s, nil
+	}
+	if _, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return s, nil
+	}
+	// The underscores can separate the digits.
+	if digits := strings.ReplaceAll(s, "_", ""); !strings.Contains(s, "__") &&
+		s[0] != '_' && s[len(s)-1] != '_' {
+		if _, err := strconv.ParseInt(digits, 10, 64); err == nil {
+			return digits, nil
+		}
+	}
+	return "", errTOMLValue
+}
+
+// isTOMLKey reports whether s is a bare key.
+func isTOMLKey(s string) bool {
+	if s == "" {
+		return false
+	}
+	for _, r := range s {
+		if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '_' || r == '-') {
+			return false
+		}
+	}
+	return true
+}
+
+// isTOMLComment reports whether s is empty or a comment.
+func isTOMLComment(s string) bool {
+	s = strings.TrimSpace(s)
+	return s == "" || s[0] == '#'
+}
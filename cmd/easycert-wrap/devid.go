@@ -0,0 +1,109 @@
+// Copyright 2014 Jonas mg
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+// Device identities of IEEE 802.1AR: the initial one (IDevID), installed by
+// the manufacturer for the life of the device, and the local ones (LDevID).
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+)
+
+const (
+	// OID_HW_MODULE_NAME is the type of the otherName of the subject
+	// alternative names which identifies the hardware module (RFC 4108).
+	OID_HW_MODULE_NAME = "1.3.6.1.5.5.7.8.4"
+
+	// DEVID_KEY_USAGE is the extension of the device identities.
+	DEVID_KEY_USAGE = "keyUsage = critical, digitalSignature, keyEncipherment"
+
+	// IDEVID_END_DATE is the expiration of an IDevID: no well-defined
+	// expiration date (RFC 5280, section 4.1.2.5).
+	IDEVID_END_DATE = "99991231235959Z"
+
+	// _IDEVID_MARK marks the configuration of a request of IDevID, to be
+	// signed without expiration.
+	_IDEVID_MARK = "# 802.1AR IDevID, without expiration"
+)
+
+var (
+	// validOID matches an object identifier in dotted notation.
+	validOID = regexp.MustCompile(`^[0-2](\.(0|[1-9][0-9]*))+$`)
+
+	// validHWSerial matches the serial number of a hardware module, which is
+	// placed in the configuration of OpenSSL and in the subject.
+	validHWSerial = regexp.MustCompile(`^[A-Za-z0-9._:-]{1,64}$`)
+)
+
+var (
+	IsIDevID = flag.Bool("idevid", false, "initial device identity of 802.1AR, without expiration")
+	HWType   = flag.String("hw-type", "", "OID of the type of the hardware module")
+	HWSerial = flag.String("hw-serial", "", "serial number of the hardware module")
+)
+
+// checkDevID checks the flags of the device identity.
+func checkDevID() error {
+	if (*HWType == "") != (*HWSerial == "") {
+		return errors.New("Flags -hw-type and -hw-serial have to be used together")
+	}
+	if *HWType == "" {
+		if *IsIDevID {
+			return errors.New("An IDevID (\"-idevid\") requires -hw-type and -hw-serial")
+		}
+		return nil
+	}
+	if !validOID.MatchString(*HWType) {
+		return fmt.Errorf("Invalid OID for flag -hw-type: %q", *HWType)
+	}
+	if !validHWSerial.MatchString(*HWSerial) {
+		return fmt.Errorf("Invalid serial number for flag -hw-serial: %q; it has to have "+
+			"letters, digits, '.', '_', ':' or '-'", *HWSerial)
+	}
+	return nil
+}
+
+// isDevID reports whether the request is of a device identity.
+func isDevID() bool { return *HWType != "" }
+
+// devIDExtensions returns the extensions of the certificate of a device
+// identity, adding the hardware module to the subject alternative names `san`.
+// The policy of signing keeps the serial number of the subject.
+func devIDExtensions(san string) string {
+	name := "otherName:" + OID_HW_MODULE_NAME + ";SEQUENCE:hw_module_name"
+	if san == "" {
+		san = "subjectAltName = " + name
+	} else {
+		san += ", " + name
+	}
+
+	lines := []string{san, DEVID_KEY_USAGE}
+	if *IsIDevID {
+		lines = append(lines, _IDEVID_MARK)
+	}
+	lines = append(lines,
+		"",
+		"[ hw_module_name ]",
+		"hwType = OID:"+*HWType,
+		"hwSerialNum = OCTETSTRING:"+*HWSerial,
+		"",
+		"[ policy_anything ]",
+		"serialNumber = optional",
+	)
+	return strings.Join(lines, "\n")
+}
+
+// isIDevID reports whether the configuration is of a request of IDevID.
+func isIDevID(config string) bool {
+	data, err := os.ReadFile(config)
+	return err == nil && bytes.Contains(data, []byte(_IDEVID_MARK))
+}
@@ -12,13 +12,49 @@ The commands are:
 
     init        initialize the directory
     ca          create certification authority
+    ceremony    create the root CA in an auditable ceremony
     req         create X509 certificate request
     sign        sign certificate request
+    renew       reissue a certificate with the same subject and hostnames
+    acme        get a certificate from Let's Encrypt or another ACME server
     lang        generate files into a language to handle the certificate
+    import      import certificates
+    export      export a certificate
+    verify-bundle verify the signature of an exported bundle
+    deploy      write the TLS files of a server, or bind the certificate in Windows
+    sidecar     keep a Java keystore in sync with a certificate
+    trust       install the CA in WSL or virtual machines
+    airgap      exchange requests and certificates with an offline CA
+    revoke      revoke certificates
+    unrevoke    restore a certificate on hold
+    publish     upload the public certificates to object storage
     ls          list
+    graph       draw the hierarchy of issuance
+    state       keep the definition of the certificates in a file
     info        information
+    pins        export the pins of the public keys
+    cms         encrypt and sign files with the certificates
+    sign-metadata sign SAML metadata
+    matter      generate the device attestation chain of Matter
+    nebula      issue the certificates of the overlay network Nebula
     cat         show the content
     chk         checking
+    crl         inspect certificate revocation lists
+    serve       serve a portal to submit certificate requests
+    ocsp-serve  serve an OCSP responder
+    k8s-issuer  sign the certificate requests of cert-manager in Kubernetes
+    acme-serve  serve an ACME endpoint which issues certificates of the CA
+    queue       list or add requests pending of approval
+    approve     approve a pending request
+    deny        deny a pending request
+    remote      handle the queue of a remote portal
+    notify      send notifications by email or issue
+    audit       show the audit log
+    audit-keys  look for weak or shared keys
+    stats       show statistics of the certificates issued
+    ctwatch     watch the Certificate Transparency logs
+    gc          remove the expired material of the store
+    recover     recover a private key from escrow
 
 Use "easycert-wrap help [command]" for more information about a command.
 
@@ -30,77 +66,1020 @@ Usage:
         easycert-wrap init
 
 "init" makes the directory structure in the HOME directory where
-the certificates are handled.
+the certificates are handled. Another directory can be set in the environment
+variable EASYCERT_ROOT, even in a server like "ssh://user@host/path"; then the
+commands are run in the server through SSH.
+
+Whether the environment variable EASYCERT_REMOTE has the URL of a portal (see
+"serve"), the commands "req", "sign", "ls", "info" and "revoke" are run through
+its API, so the host of the CA is not accessed: the private keys and the
+requests are generated in the local directory, the requests are signed in the
+portal, and the certificates are downloaded. The token of the administrators,
+to sign and revoke, is got from EASYCERT_REMOTE_TOKEN, and the operator is
+authenticated with the certificate named in EASYCERT_REMOTE_CERT, of the local
+directory.
+
+The configuration of OpenSSL created ("openssl.cfg") can reference variables of
+environment, like "${ENV:ORG_NAME}", and files, like "${FILE:/run/secrets/ou}",
+which are resolved at issuance.
+
+The default values of the subject in that configuration are got from the table
+"subject" of the file of defaults of the user ("~/.config/easycert/config.toml"),
+which has also the certificates directory, in "root", and the default values of
+the flags of every command, in the table "flags":
+
+	root = "~/pki"
+
+	[flags]
+	years = 2
+	rsa-size = 4096
+
+	[subject]
+	country = "ES"
+	organization = "Example Ltd"
+
+The flags can be set too in variables of environment, like in containers: the
+name in capital letters, with underscores instead of dashes, and the prefix
+"EASYCERT_FLAG_" (i.e. "EASYCERT_FLAG_RSA_SIZE=4096" for "-rsa-size 4096").
+The flags given in the command line take precedence over the variables of
+environment, and these over the file of defaults.
+
+The database of the root CA is kept in the file "index.db" of bbolt, by default.
+The files of OpenSSL ("index.txt", "serial" and "crlnumber") are written from it
+before of being used, and they are stored into it after every change, so a store
+without "index.db" is migrated at its first change. The database can be set in
+the field "database" of "store.json": the driver "bolt" with the file as data
+source name, "file" to keep only the files of OpenSSL, or an external database
+for high availability or external backups, with the driver "sqlite" or
+"postgres" and the data source name of the driver; the program has to be built
+with the tag of the driver ("sqlite" or "postgres"):
+
+	{
+		"database": {
+			"driver": "postgres",
+			"dsn": "postgres://easycert@db.example.com/easycert"
+		}
+	}
+
+The entries are in the table "easycert_index", and the next serial number and
+number of the revocation list in the table "easycert_state".
 
 
 Create certification authority
 
 Usage:
 
-        easycert-wrap ca [-rsa-size bits] [-years number]
+        easycert-wrap ca [-intermediate name [-parent name] | -yubikey [-slot name] | -kms-uri uri] [-passin source] [-key-type rsa|ecdsa] [-rsa-size bits] [-curve name] [-years number] [-backend name] [-fips] [-batch]
 
 "ca" creates a certification authority (CA) and makes the directories and files
 to handle the certificates signed by this CA.
 
+The private key is RSA of the size given in "-rsa-size" (2048 bits by default),
+or ECDSA with "-key-type ecdsa" on the curve given in "-curve" ("p256" by
+default; "p384" or "p521"). A CA with a key of a type can sign requests with
+keys of the other one.
+
+The CA's private key is encrypted in AES-256 with a passphrase, which is got
+from the environment variable EASYCERT_CA_PASS whether it is set, instead of
+being prompted; it is also used by "sign", "approve" and the rest of commands
+which sign with the CA. With "-passin", it is got from another source, like in
+OpenSSL: "env:VAR", an environment variable, or "file:PATH", the first line of
+a file; it can not be given in the command line.
+
+With "-batch", the commands never prompt: the subject has the default values of
+the configuration, or of the file of defaults of the user for the CA, whose
+common name is the organization followed by " CA" (see "init"), and they fail
+whether the passphrase is needed but it is not in EASYCERT_CA_PASS nor in
+"-passin", instead of
+waiting for an answer. It is also used whether the standard input is closed or
+it is the null device, like in the daemons; any other standard input, like a
+pipe, is used to answer the prompts. In batch mode, a spinner is shown while the
+key is generated whether the standard error output is a terminal.
+
+With "-intermediate NAME", an intermediate CA is created instead, signed by
+the CA given in "-parent" (the root CA by default, or another intermediate CA).
+It is placed in the directory "intermediates/NAME" with the same layout than the
+certificates directory: its certificate, its private key (encrypted with the
+passphrase of EASYCERT_CA_PASS too) and its database, where the certificates
+signed by it are recorded. Its certificate is stored in the chains directory
+too, to build the chains of the certificates issued by it (see "sign -ca"). In
+batch mode, its common name is the organization followed by NAME and " CA". The
+native backend does not support the intermediate CAs.
+
+In FIPS mode ("-fips", the environment variable EASYCERT_FIPS, the field
+"fips" of "store.json", or built with the tag "boringcrypto"), the key sizes,
+curves and signature algorithms are restricted to those approved by FIPS, and
+the operations outside them are refused.
+
+With "-yubikey", the private key of the root CA is generated into the slot PIV
+of "-slot" ("9c", for digital signatures, by default) of the YubiKey connected,
+through "ykman", and it is never written in the private directory: it is
+replaced by "ca.yubikey", with the serial number of the YubiKey and the slot.
+The key requires the PIN at every use, so "sign", "approve", "revoke" and the
+rest of commands which sign with the CA prompt for it, or get it from the
+environment variable EASYCERT_YUBIKEY_PIN. OpenSSL signs through the provider
+"pkcs11" (pkcs11-provider) with the PKCS#11 module of the variable
+PKCS11_PROVIDER_MODULE, or else "libykcs11.so" of yubico-piv-tool. The
+YubiKey supports RSA keys up to 4096 bits and the curves p256 and p384; the
+native backend and "ocsp-serve" can not sign with it.
+
+With "-kms-uri URI", the private key of the root CA is the one of a cloud KMS,
+already created with a purpose of signing: "awskms:///KEY" (its ID, ARN or
+alias), or "awskms://REGION/KEY", for AWS KMS; "gcpkms://projects/.../
+cryptoKeyVersions/N", for GCP Cloud KMS; or "azurekms://VAULT.vault.azure.net/
+keys/NAME/VERSION", for Azure Key Vault. The URI is stored in "ca.kms", in
+place of the key, and the certificates and CRLs of the root CA are signed in Go,
+like by the native backend, where the KMS signs the digests: with the
+credentials of the command "aws" for AWS, and with the access tokens of "gcloud"
+or "az" for the others, so the key never leaves the KMS. "sign -kms-uri" signs
+with a KMS a CA whose key is in a file, to migrate it, whether it is the same
+key. The extensions of the requests are the ones of the native backend, and a
+root CA in a KMS does not sign intermediate CAs nor files.
+
+With "-backend native", the CA is created in Go instead of executing OpenSSL,
+so it is not needed: the subject is the one of batch mode, and the private key
+is encrypted in PKCS#8 with the passphrase of EASYCERT_CA_PASS or "-passin",
+which is required. The files and the database are the same than with OpenSSL, so both
+backends can be mixed. The backend by default can be set in the section
+"[flags]" of the file of defaults of the user (see "init"), or in the
+environment variable EASYCERT_FLAG_BACKEND.
+
+
+Create the root CA in an auditable ceremony
+
+Usage:
+
+        easycert-wrap ceremony [-shares number] [-threshold number] [-out dir] [-key-type rsa|ecdsa] [-rsa-size bits] [-curve name] [-years number] [-backend name] create | ceremony join FILE... | ceremony verify FILE
+
+"ceremony" guides the creation of the root CA for the teams which need an
+auditable record of it.
+
+	create  prompts for the administrator of the ceremony, the witnesses and the
+	        custodian of every share; checks the random generator; creates the
+	        CA like "ca -batch" with a random passphrase, which is split in the
+	        shares given in "-shares" (5 by default), so that any of them given
+	        in "-threshold" (3 by default) recover it; and writes the report of
+	        the ceremony signed by the new CA
+	join    prints the passphrase of the CA's private key recovered from the
+	        files of the shares, to be set in EASYCERT_CA_PASS
+	verify  checks the signature of the report of a ceremony with the CA
+
+The shares, the report ("report.txt") and its signature ("report.txt.sig") are
+written into the directory given in "-out", "ceremony" of the certificates
+directory by default. Every share has to be handed to its custodian and removed
+from the disk; the passphrase is never shown. The report has the fingerprints of
+the CA and of every share, and room for the signatures of the attendees, so it
+can be printed. The signature can be checked with OpenSSL too:
+
+	openssl dgst -sha256 -signature report.txt.sig \
+		-verify <(openssl x509 -pubkey -noout -in certs/ca.crt) report.txt
+
+The random generator is checked with the tests of monobit and long runs of FIPS
+140-2 over 20000 bits, and the entropy of the kernel whether it is available.
+
 
 Create X509 certificate request
 
 Usage:
 
-        easycert-wrap req [-sign] [-rsa-size bits] [-years number] [-host name1,...] NAME
+        easycert-wrap req [-sign] [-reissue] [-backup-key | -encrypt-key [-passin source]] [-spki | -saml | -code-signing] [-protocol name [-key-authorization string | -realm name [-dc-guid guid]]] [-idevid] [-hw-type oid -hw-serial serial] [-key-type rsa|ecdsa] [-rsa-size bits] [-curve name] [-years number] [-host name1,...] [-validate-dns] [-challenge source] [-backend name] [-fips] [-batch] NAME | req -ephemeral [-key-type rsa|ecdsa] [-rsa-size bits] [-curve name] [-years number] [-host name1,...] [-validate-dns] NAME
 
 "req" creates a X509 certificate signing request (CSR) to be signed by a CA.
+The challenge password is added like attribute of the request, as it is used by
+SCEP to authorize the enrollment. It is got from the source given in
+"-challenge", env:VAR or file:PATH like in "-passin", so it is not seen in the
+list of processes, and it has to have between 11 and 30 characters. It is
+removed from the configuration of the request once the request is generated.
+
+The private key is generated like in "ca": RSA of the size given in "-rsa-size",
+or ECDSA with "-key-type ecdsa" on the curve given in "-curve".
+
+The hostnames without domain given in "-host" are expanded with every suffix
+set in the field "auto_sans" of "store.json"; i.e. with
+[".svc.cluster.local", ".internal"], "web" adds "web.svc.cluster.local" and
+"web.internal". The name "localhost" is not expanded, since it is reserved for
+the loopback.
+
+With the flag "-validate-dns", the domain names have to resolve and the IP
+addresses have to resolve in reverse to a name which resolves to the same
+address (forward-confirmed), so a typo is caught before of deploying the
+certificate. The wildcards are checked through their parent domain.
+
+With the flag "-reissue", the current certificate and its private key are kept
+like a previous version (see "sign") before of generating the new key.
+With "-backup-key", the backup key of NAME made by "pins" is used instead of
+generating a new one, so the clients which pinned it keep working.
+
+The private key is written without encryption, only readable by the owner,
+unless it is used "-encrypt-key": then it is encrypted in AES-256 with a
+passphrase, which is prompted or got from the source of "-passin" ("env:VAR" or
+"file:PATH", like in OpenSSL), required in batch mode and by the native
+backend; the passphrase of the CA of "-sign" is got from EASYCERT_CA_PASS then.
+The commands which use the key through OpenSSL, like "export -p12", prompt for
+its passphrase, and "renew" encrypts the new key with "-passin".
+
+With the flag "-spki", the certificate is nameless: it has no hostnames, and its
+subject has only NAME like common name, without prompts. It is identified by the
+pin of its public key (the SHA-256 hash of the SubjectPublicKeyInfo), which is
+printed, so it is intended for the internal services which authenticate by key
+rather than by name, like through Unix domain sockets. The pin is printed too by
+"info -spki", and the package "store" verifies the peers by their pins.
+
+With the flag "-saml", the certificate is nameless too, but for the signing and
+encryption of the SAML messages and metadata: its key usage is restricted to
+digital signature and key encipherment. It is exported in the layouts of the
+SAML software with "export -layout", and it signs the metadata with
+"sign-metadata".
+
+With the flag "-code-signing", the certificate is nameless too, but for the
+signing of the releases: its key usage is restricted to digital signature, with
+the extended key usage of code signing. It is the dedicated certificate given in
+"export -sign -signer", since the bundles are only signed by the CA or by these
+certificates.
+
+With the flag "-ephemeral", the certificate is issued in memory by a new CA
+which only exists while the command runs, and the certificate, its private key
+and the certificate of the CA are printed in PEM format, without touching the
+certificates directory nor the disk, like for the tests or the one-shot runs.
+
+With the flag "-protocol", the certificate of the server has the extensions
+required by the protocol, instead of adding them to the configuration:
+
+	tls-alpn-01  the extension acmeIdentifier, critical, with the SHA-256
+	             digest of the key authorization given in "-key-authorization",
+	             for the responders of the challenge TLS-ALPN-01 of ACME (RFC
+	             8737); "-host" has to have a single domain name
+	rdp          the extended key usages of server authentication and Remote
+	             Desktop Authentication, which makes Windows choose the
+	             certificate for RDP
+	ldaps        the extended key usage of server authentication, required by
+	             the LDAP servers like Active Directory
+	dc           the profile of the domain controllers of Active Directory,
+	             for LDAPS and the Kerberos PKINIT (logon by smart card): the
+	             extended key usages of server and client authentication, KDC
+	             authentication and smart card logon, the certificate
+	             template "DomainController", and the subject alternative
+	             names of the DNS name of the domain and the principal
+	             "krbtgt/REALM@REALM" of the realm given in "-realm"; with
+	             "-dc-guid", the GUID of the object of the controller in the
+	             directory is added too
+
+The key usage of "rdp", "ldaps" and "dc" is restricted to digital signature and
+key encipherment. The native backend does not support "dc", whose names are
+otherNames; the certificate is imported in the domain controller with
+"deploy -dc". The protocol is kept by "renew", but for "tls-alpn-01", whose
+certificates are of a single challenge.
+
+With the flags "-hw-type" and "-hw-serial", the certificate is a device identity
+of IEEE 802.1AR for network equipment: the hardware module, its type (an OID)
+and its serial number, is added to the subject alternative names like the
+otherName hardwareModuleName (RFC 4108), the serial number is added to the
+subject, whose common name is NAME, and the key usage is restricted to digital
+signature and key encipherment. By default, it is a local identity (LDevID)
+with the validity of "-years"; with "-idevid", it is the initial identity
+(IDevID) installed by the manufacturer, which is signed without expiration
+(until 9999-12-31, as RFC 5280 defines for the identities of the life of the
+device).
+
+Whether the field "no_server_keygen" of "store.json" is set, the private keys
+are never generated in the host of the CA, so "req" fails; the requests have to
+be generated in the devices and added through "queue FILE NAME".
+
+With "-backend native", the key and the request are generated in Go instead of
+executing OpenSSL (see "ca"), without prompts: the subject is the one of batch
+mode. The challenge password and the device identities are not supported.
 
 
 Sign certificate request
 
 Usage:
 
-        easycert-wrap sign [-years number] NAME
+        easycert-wrap sign [-ca name] [-years number] [-stagger window] [-reissue] [-kms-uri uri] [-passin source] [-backend name] [-fips] [-batch] NAME...
 
 "sign" signs a certificate signing request (CSR) using the CA in the
-certificates directory and generates a certificate.
+certificates directory and generates a certificate. Several requests can be
+signed in a batch; then the progress is shown for every request, and a summary
+with the serial number and the expiration of every certificate at the end, or
+whether some request fails, since the rest are skipped.
+
+With the flag "-ca", the certificates are issued by the intermediate CA given
+(see "ca -intermediate") instead of the root CA, and recorded in its database.
+Then the certificate followed by the chain of intermediate CAs, without the
+root CA, is written to "NAME.fullchain.pem" in the directory of certificates,
+for the servers which have to send the chain.
+
+With the flag "-stagger", the expirations of the certificates of the batch are
+spread out over that window (i.e. "7d" or "36h") after the validity given in
+"-years", so they are not renewed all in the same day; the schedule is recorded
+in the file "schedule.log" of the certificates directory. The requests of
+IDevID ("req -idevid") are signed without expiration, whatever "-years".
+
+With the flag "-reissue", the current certificate is kept like the previous
+version "NAME@1", "NAME@2", ... into the directory "certs/history" instead of
+failing, so it can be restored whether the new one is wrong. The number of
+versions kept is set in the field "history" of "store.json" (3 by default).
+
+The issuance is done like a transaction: whether some step fails, the files
+generated are removed and the database of the CA is restored. With "req -sign",
+the private key and the request are removed too.
+
+Whether the field "receipt" is set in the file "store.json", a receipt in JSON
+format (serial, fingerprints, subject, operator, date) is written into the
+directory "receipts", signed with GPG or minisign:
+
+	{
+		"receipt": {
+			"signer": "gpg",
+			"key": "ca@example.com"
+		}
+	}
+
+For minisign, "key" is the secret key file.
+
+The executable files "pre-sign" and "post-sign" in the hooks directory are run
+before and after of signing, with the metadata of the certificate in variables
+of environment (EASYCERT_NAME, EASYCERT_SUBJECT, EASYCERT_SERIAL, ...).
+Whether "pre-sign" fails, the request is not signed.
+
+With "-backend native", the requests are signed in Go instead of executing
+OpenSSL (see "ca"), without confirmation. The subject alternative names and the
+key usage of the configuration of the request are added, like OpenSSL does, but
+the other extensions and the requests of IDevID are not supported.
+
+The root CA created with "ca -kms-uri" signs in Go too, with the key in the KMS.
+With "-kms-uri", the requests are signed with the key of the URI instead of the
+CA's private key file, whether it is the same key, like after of importing it
+into the KMS.
+
+
+Reissue a certificate with the same subject and hostnames
+
+Usage:
+
+        easycert-wrap renew [-years number] [-reuse-key] [-passin source] [-backend name] [-batch] NAME
+
+"renew" reissues the certificate NAME: the request is generated from the
+current certificate, with the same subject and subject alternative names (the
+hostnames and IP addresses), and a new private key of the same type and size,
+and then it is signed by the CA which issued it, with the validity of "-years".
+
+The current certificate and its private key are kept like a previous version
+(see "sign -reissue"). With the flag "-reuse-key", the current private key is
+used for the new request instead of generating one, so only the certificate is
+kept like a previous version; it is the way to renew the certificates whose keys
+can not be generated in the host of the CA ("no_server_keygen").
+
+Whether the current private key is encrypted ("req -encrypt-key"), the new one
+is encrypted too, with the passphrase prompted or got from the source of
+"-passin", like in "req".
+
+The nameless certificates ("req -spki" and "req -saml") and the ones of the
+protocols ("req -protocol") are renewed with their profile; the device
+identities ("req -hw-type"), the certificates of the challenge TLS-ALPN-01 and
+the CAs are not renewed.
+
+
+Get a certificate from Let's Encrypt or another ACME server
+
+Usage:
+
+        easycert-wrap acme -domain names [-http | -dns] [-directory url] [-email address] [-listen addr | -webroot dir] [-reissue] [NAME]
+
+"acme" gets a certificate for the comma-separated list of domains of "-domain"
+from an ACME server (RFC 8555), by default the one of Let's Encrypt; the flag
+"-directory" sets the URL of the directory of another server, like the staging
+one of Let's Encrypt:
+
+	https://acme-staging-v02.api.letsencrypt.org/directory
+
+The private key is generated in the host like in "req" ("-key-type", "-rsa-size"
+and "-curve"), and the certificate is stored like NAME, the first domain by
+default, into the certificates directory, next to the ones issued by the CA; its
+issuers are stored into the directory "chains", like in "import".
+
+The account is registered the first time, agreeing the terms of service of the
+server, with the contact address of "-email"; its key is kept into the directory
+"private/acme", by host of the server.
+
+The control of the domains is proved with the challenge HTTP-01 by default
+("-http"): a server answers the challenges in the address of "-listen" (":80"),
+or they are written into the directory ".well-known/acme-challenge" of the web
+root of "-webroot". With "-dns", the challenge DNS-01 is used, required by the
+wildcard domains: the TXT record "_acme-challenge.DOMAIN" is published by the
+hook "acme-dns", whether it exists, else it is shown to add it by hand. The hook
+gets the variables EASYCERT_ACTION ("present" or "cleanup"), EASYCERT_DOMAIN,
+EASYCERT_RECORD and EASYCERT_VALUE.
+
+The flag "-reissue" gets a new certificate for NAME, keeping the current one
+like a previous version.
 
 
 Generate files into a language to handle the certificate
 
 Usage:
 
-        easycert-wrap lang [-ca file] [-server name] [-client] [-go]
+        easycert-wrap lang [-ca file] [-server name] [-client] [-package name] [-var-prefix prefix] [-out dir] [-go | -c | -esp32]
 
 "lang" generate files into a language to handle the certificate.
 To look for the file, it uses the certificates directory when the "file" is just
 a name or the path when the "file" is an absolute or relatative path.
 
+The client verifies the certificate of the server against the CA, and against
+its OCSP responder whether the certificate has one, through the function
+VerifyPeer of the package "github.com/tredoe/easycert/store".
+
+Every file has a test which checks that the certificate is valid for the CA,
+and the first file has a directive "go:generate" to create them again through
+"go generate", since the files generated can be overwritten. The files belong to
+the package "main" unless it is used the flag "-package", and they are written
+to the current directory unless it is used "-out".
+
+The names of the variables, "ServerTLSConfig" and "ClientTLSConfig", and of the
+tests start with the prefix given in "-var-prefix", to follow the conventions of
+the project.
+
+With "-c", it generates instead the files "easycert_certs.h" and "easycert_certs.c"
+for the TLS stacks of embedded systems, like mbedTLS or wolfSSL, which have the
+CA certificate, and the certificate and key of the server whether it is used
+"-server", like constant arrays in PEM format ended in a null character, and
+macros with their lengths (i.e. "CA_CERT_LEN"), which include the null character
+like the functions to parse them require (i.e. "mbedtls_x509_crt_parse").
+The prefix of "-var-prefix" is also used in the names of arrays and macros.
+
+With "-esp32", it generates instead the file "easycert_esp32.h" for Arduino and
+ESP32, with the same content like strings in PEM format, to use in the sketches
+(i.e. "client.setCACert(ca_cert)" of WiFiClientSecure) or with mbedTLS, plus the
+files in binary format (DER) "ca_cert.der", "server_cert.der" and
+"server_key.der", to embed them through "EMBED_FILES" of ESP-IDF or to write
+them into a data partition, which are parsed by "mbedtls_x509_crt_parse_der" and
+"mbedtls_pk_parse_key". The private key can not be encrypted.
+
+
+Import certificates
+
+Usage:
+
+        easycert-wrap import FILE NAME | import -dedup
+
+"import" copies the certificates stored into FILE to the certificates directory,
+using NAME as name for the new file.
+The file can be a certificate in PEM format or a container like PKCS#7 (.p7b),
+PKCS#12 (.p12, .pfx) or Java KeyStore (.jks); a password is asked for the
+containers which are protected.
+
+Whether the file has a chain, only the first certificate is copied to "NAME.crt";
+the issuers are stored once into the directory "chains", named by their SHA-256
+fingerprint, and the chains are assembled when they are exported or published.
+The flag "-dedup" does the same with the certificates already imported.
+
+
+Export a certificate
+
+Usage:
+
+        easycert-wrap export -public [-manifest] [-sign [-signer name]] [-version number] [-out file] NAME | export -layout keycloak|shibboleth-idp|shibboleth-sp [-manifest] [-sign [-signer name]] [-version number] [-out dir] NAME | export -mobileconfig [-identity] [-manifest] [-sign [-signer name]] [-version number] [-out file] NAME | export -android [-manifest] [-sign [-signer name]] [-version number] [-out dir] NAME | export -browser-policy [-manifest] [-sign [-signer name]] [-version number] [-out dir] NAME | export -p12 [-password string] [-legacy] [-with-root] [-manifest] [-sign [-signer name]] [-version number] [-out file] NAME
+
+"export" makes an archive with a certificate to give it to third parties.
+
+With "-public", the archive (tar.gz) has only public material: the certificate,
+the chain of CA certificates, the fingerprints and the metadata in JSON format.
+It is checked that no private key is included in it.
+
+The archive is written to "NAME-public.tar.gz" unless it is used "-out".
+With "-version", it is exported a previous version of the certificate (see
+"ls -history").
+
+With "-layout", the certificate and its private key are written in a directory,
+"NAME-LAYOUT" unless it is used "-out", with the files expected by the SAML
+software to sign and encrypt the messages (see "req -saml"):
+
+	keycloak        "NAME-keycloak.json", the component of a key provider
+	                "rsa" to import in the realm
+	shibboleth-idp  "idp-signing.crt", "idp-signing.key",
+	                "idp-encryption.crt" and "idp-encryption.key" of the
+	                directory "credentials" of the identity provider
+	shibboleth-sp   "sp-signing-cert.pem", "sp-signing-key.pem",
+	                "sp-encrypt-cert.pem" and "sp-encrypt-key.pem" of the
+	                service provider
+
+The private keys are written only readable by the owner.
+
+With "-mobileconfig", it is written a configuration profile of Apple,
+"NAME.mobileconfig" unless it is used "-out", so that the devices of iOS and
+macOS trust the CA at installing it; the certificate NAME can be the CA itself
+("ca") or one issued by it, and the profile has the chain of CA certificates.
+The profile exported again has the same identifiers, so it replaces the
+installed one.
+
+With "-identity", the profile has too the certificate and its private key in
+PKCS#12 format, protected by the password of the variable EASYCERT_P12_PASS,
+which is asked by the device at installing it; then the profile is written only
+readable by the owner.
+
+With "-android", it is written a directory "NAME-android" unless it is used
+"-out", with the files to add to the resources of an Android app so that its
+debug builds trust the CA: "res/xml/network_security_config.xml", whose trust
+anchors in "debug-overrides" are the CA certificates of the chain, in DER format
+into "res/raw". The configuration is enabled in the element "application" of
+the manifest:
+
+	android:networkSecurityConfig="@xml/network_security_config"
+
+With "-browser-policy", it is written a directory "NAME-browser-policy" unless
+it is used "-out", with the policies of enterprise to make the managed browsers
+trust the CA certificates of the chain:
+
+	chrome/easycert.json      the policy "CACertificates" of Chrome, to copy in
+	                          "/etc/opt/chrome/policies/managed" (Linux), or to
+	                          push like the rest of policies
+	firefox/policies.json     the policy "Certificates" of Firefox, to copy in
+	                          the directory "distribution" of the installation
+	firefox/easycert_ca*.crt  the certificates installed by the policy, to copy
+	                          in "/usr/lib/mozilla/certificates" (Linux) or
+	                          "%USERPROFILE%\AppData\Local\Mozilla\Certificates"
+	                          (Windows)
+
+With "-p12", it is written a PKCS#12 bundle, "NAME.p12" unless it is used
+"-out" (i.e. "NAME.pfx"), with the private key, the certificate and its
+intermediate CAs, for Windows, Java and the appliances which only import this
+format; the root CA is only added with "-with-root", since a server should not
+send it. It is written only readable by the owner. The password is the one given
+in "-password", or the one of the variable EASYCERT_P12_PASS, or else it is
+prompted by OpenSSL. With "-legacy", it is encrypted with 3DES and SHA-1
+instead of AES-256, for the systems which do not support the format by default
+of OpenSSL 3, like Windows Server 2016 or Java 8.
+
+With "-manifest", it is added a file "manifest.json" to the archive or the
+directory, or written next to the file like "OUT.manifest.json", so whoever
+receives it can verify its integrity and provenance: the SHA-256 digest and the
+size of every file, the fingerprints and the validity of the certificate, its
+key usages, the fingerprints of the chain of CA certificates, and the ID of the
+store which exported it, i.e. the SHA-256 fingerprint of its root CA.
+
+With "-sign", the bundle is signed with the CA, or with the certificate given in
+"-signer", which has to be a dedicated release key ("req -code-signing"), in a
+detached signature in CMS written next to the file like "OUT.p7s"; in a
+directory, its manifest is signed, like "manifest.json.p7s". The recipients check it with "verify-bundle".
+
+
+Verify the signature of an exported bundle
+
+Usage:
+
+        easycert-wrap verify-bundle [-ca name] FILE | verify-bundle [-ca name] DIR
+
+"verify-bundle" checks that a bundle written by "export -sign" comes from the
+expected store, before installing it: its detached signature in CMS, "FILE.p7s"
+or "DIR/manifest.json.p7s", is checked against the CA given in "-ca" ("ca" by
+default), which can be the file of the root CA of the store, to verify without
+a certificates directory.
+
+In a directory, the signature is of its manifest, and every file has to be
+listed in the manifest with the same digest and size; the store of the manifest
+has to be the one of the CA whether it is a root CA.
+
+The signer is pinned after the verification of the chain: it has to be the CA
+itself, or a certificate of code signing issued by it ("req -code-signing"), so
+a bundle signed by any other certificate of the store, like the one of a
+server, is refused.
+
+
+Write the TLS files of a server, or bind the certificate in Windows
+
+Usage:
+
+        easycert-wrap deploy -mongodb|-rabbitmq [-with-root] [-manifest] [-out dir] NAME | deploy -iis site [-iis-port number] [-dry-run] NAME | deploy -winrm [-dry-run] NAME | deploy -dc [-dry-run] NAME
+
+"deploy" writes the certificate NAME, its private key and the chain of CA
+certificates in a directory, "NAME-SERVICE" unless it is used "-out", with the
+layout required by the server, plus the stanza of its configuration which
+enables TLS with them. The paths of the stanza are the absolute ones of the
+directory.
+
+With "-mongodb", the files of mongod:
+
+	NAME.pem      the certificate and its intermediate CAs, followed by its
+	              private key, for "certificateKeyFile"
+	ca.pem        the chain of CA certificates, for "CAFile"
+	mongod.conf   the section "net.tls" of the configuration
+
+With "-rabbitmq", the files of RabbitMQ:
+
+	ca_certificate.pem      the chain of CA certificates, for "cacertfile"
+	server_certificate.pem  the certificate and its intermediate CAs, for
+	                        "certfile"
+	server_key.pem          the private key, for "keyfile"
+	rabbitmq.conf           the options "ssl_options" of the configuration
+
+The chain sent by the server has not the root CA, since the clients have to
+trust it by themselves; else it is only used to validate the clients, from
+"CAFile" or "cacertfile". With "-with-root", the root CA is added to the chain
+sent, for the clients which need it, warning about it.
+
+The files with the private key are written only readable by the owner. With
+"-manifest", it is added the file "manifest.json" with the digests of the files
+and the provenance of the certificate (see "export").
+
+In Windows, "-iis" and "-winrm" import the certificate NAME, with its private
+key and the chain of CA certificates, into the personal store of the machine
+("Cert:\LocalMachine\My"), and bind it through PowerShell, so it has to be run
+like administrator:
+
+	-iis      the HTTPS binding of the IIS site at the port of "-iis-port",
+	          which is created whether it does not exist
+	-winrm    the HTTPS listener of WinRM, with the host name of the first
+	          DNS name of the certificate, or else its common name
+	-dc       LDAPS and Kerberos PKINIT of a domain controller of Active
+	          Directory, with a certificate of "req -protocol dc": the root
+	          CA is added to the trusted roots of the machine and the CA
+	          which issued it to the store NTAuth of the machine, and the
+	          directory loads it for LDAPS without restarting
+
+To trust the CA for PKINIT in all the domain, its certificate is published in
+NTAuth by an administrator of the enterprise:
+
+	certutil -dspublish -f ca.crt NTAuthCA
+
+The certificate bound before is replaced, so it is run again after of
+renewing the certificate, like:
+
+	easycert-wrap deploy -iis "Default Web Site" web
+
+The flag "-dry-run" prints the script of PowerShell instead of running it.
+
+
+Keep a Java keystore in sync with a certificate
+
+Usage:
+
+        easycert-wrap sidecar -watch NAME -keystore file [-password string] [-interval duration] [-with-root] [-once]
+
+"sidecar" keeps the keystore of "-keystore" in sync with the certificate of
+"-watch", for the applications of Java which can not read the files in PEM
+format: the keystore is written with its private key and the intermediate CAs
+(and the root CA with "-with-root") when it is started, and again every time the certificate changes,
+like when it is renewed.
+
+The format of the keystore is got from the extension of the file: PKCS#12
+(.p12, .pfx) or Java KeyStore (.jks, .keystore), which requires the Java
+keytool. The private key is stored with the alias NAME, and the keystore is
+protected by the password of "-password", or else EASYCERT_P12_PASS, which is
+needed by Java to read it; it is replaced atomically, and only readable by the
+owner.
+
+The certificate is checked every "-interval" (30s by default), or once with
+"-once", and the errors are logged without exiting, to keep the keystore being
+used until the certificate is fixed.
+
+
+Install the CA in WSL or virtual machines
+
+Usage:
+
+        easycert-wrap trust -wsl [-dry-run] | trust -vm name1,... [-dry-run]
+
+"trust" installs the CA certificate in the store of trusted certificates of the
+system of the guests where the services are developed, so the same CA is
+trusted in the host and in them.
+
+With "-wsl", it is installed in every distribution of the Windows Subsystem for
+Linux found by "wsl.exe -l", but the ones of Docker Desktop, as root.
+
+With "-vm", it is installed in the virtual machines given, through SSH with
+"sudo" (the user has to be allowed to use it), or through "multipass exec"
+whether the name starts with "multipass:" (i.e. "multipass:dev").
+
+The certificate is added like "easycert-HASH.crt", where HASH is the start of
+its SHA-256 fingerprint, in the directory of the system for the local CAs
+(Debian, Ubuntu, Alpine, Fedora, RHEL, Arch Linux or openSUSE), and the store is
+updated. The flag "-dry-run" prints the commands without running them.
+
+
+Exchange requests and certificates with an offline CA
+
+Usage:
+
+        easycert-wrap airgap [-cert] [-out file] [-qr dir] export NAME... | airgap import FILE...
+
+"airgap" carries the certificate requests to a CA in a machine without network,
+like the root CA of a ceremony, and the certificates signed back, through a
+single file or QR codes, so neither network nor USB devices are needed.
+
+	export  writes the requests NAME, or the certificates NAME with "-cert", in
+	        a bundle: in the file given in "-out", in the standard output by
+	        default, and like QR codes in PNG format in the directory given in
+	        "-qr", through the program "qrencode"
+	import  reads the bundles from the files; the images (PNG or JPEG) are
+	        decoded through the program "zbarimg", and the text files can have
+	        the content of the QR codes, one per line
+
+The requests imported are signed by "sign" in the offline machine, and then its
+certificates are exported with "-cert". The certificates imported must match
+the public key of the requests of the directory, which are removed, and they
+are verified with the CA whether it is in the directory.
+
+The bundle is compressed, and it is identified by its SHA-256 digest, printed
+by both commands, so it can be compared by the operators of both machines.
+
+
+Revoke certificates
+
+Usage:
+
+        easycert-wrap revoke [-reason name] [-passin source] NAME | revoke -all -cn pattern [-reason name] [-dry-run] [-passin source]
+
+"revoke" revokes a certificate signed by the CA, and generates the certificate
+revocation list (CRL) of the CA, in DER format, at "crl/ca.crl".
+
+With the flag "-all", it revokes every valid certificate of the certificates
+directory whose common name matches the pattern given in "-cn" (i.e.
+'*.old-project.internal'), in a single transaction, so the CRL is generated only
+once; the flag "-dry-run" prints the certificates matched without revoking them.
+
+The reason of the revocation is one of: unspecified (by default),
+keyCompromise, CACompromise, affiliationChanged, superseded,
+cessationOfOperation and certificateHold. The latter suspends the certificate
+temporarily, until it is revoked with another reason or restored by "unrevoke".
+
+
+Restore a certificate on hold
+
+Usage:
+
+        easycert-wrap unrevoke [-passin source] NAME
+
+"unrevoke" restores a certificate suspended with the reason "certificateHold",
+so it is valid again, and generates the certificate revocation list of the CA.
+The certificates revoked with another reason can not be restored.
+
+
+Upload the public certificates to object storage
+
+Usage:
+
+        easycert-wrap publish (-s3 bucket/prefix | -gcs bucket/prefix) [-dry-run]
+
+"publish" uploads the certificates, their chains and the revocation lists to
+Amazon S3 or Google Cloud Storage, so they can be got by the fleet of servers.
+The private keys are never uploaded.
+
+The layout under the prefix is stable:
+
+	index.json        public information of all certificates
+	certs/NAME.crt    certificate in PEM format
+	certs/NAME.cer    certificate in DER format
+	chains/NAME.pem   certificate followed by the CA certificates
+	crl/FILE          revocation lists
+
+It uses the commands "aws" or "gsutil", which have to be configured with the
+credentials. The flag "-dry-run" lists the files instead of uploading them.
+
 
 List
 
 Usage:
 
-        easycert-wrap ls [-req] [-cert] [-key]
+        easycert-wrap ls [-req] [-cert] [-key] [-tree] [-history NAME] [-json] [-readonly]
 
 "ls" lists files in the certificates directory.
 Whether it is not used some flag, it lists all files related to certificates.
 
+The flag "-tree" shows the certificates like a hierarchy of issuance, from the
+root CA through the intermediate CAs to the certificates signed by them.
+
+The flag "-history" lists the current and the previous versions of the
+certificate NAME, kept when it is reissued, with their serial number and
+expiration.
+
+The flag "-json" prints the files like an array of records in JSON format, with
+the name, the type ("certificate", "request" or "key") and the path of every
+file; the records of the certificates have also their information, like
+"info -json".
+
+
+Draw the hierarchy of issuance
+
+Usage:
+
+        easycert-wrap graph [-o dot|svg] [-color] [-readonly]
+
+"graph" draws the hierarchy of issuance of the certificates directory, like in
+"ls -tree": the root CAs, the intermediate CAs and the certificates signed by
+them, for the documentation and the reviews of the architecture.
+
+It is printed in the language DOT of Graphviz, or in SVG with "-o svg", which
+requires the program "dot" of Graphviz. The CAs are drawn like boxes, and the
+rest of certificates like ellipses.
+
+With the flag "-color", the certificates are colored according to their status:
+green whether they are valid, orange whether they are into their renewal window
+(the field "renewal_days" of "store.json"), red whether they are expired, and
+gray whether they are revoked.
+
+
+Keep the definition of the certificates in a file
+
+Usage:
+
+        easycert-wrap state [-out file] export | state diff FILE | state [-dry-run] apply FILE
+
+"state" handles the definition of the certificates in a file in YAML format, so
+it can be kept in a repository of git and applied like the rest of the
+infrastructure (GitOps).
+
+	export  writes the state of the certificates directory, in the file given
+	        in "-out" or in the standard output by default
+	diff    prints the differences between FILE and the certificates directory,
+	        and exits with status 1 whether there is some one
+	apply   issues the certificates of FILE which are missing, and reissues the
+	        ones whose definition changed, through "req" and "sign" in batch
+	        mode; "-dry-run" prints the commands without running them
+
+The state is canonical: the certificates are sorted by name and the hostnames
+are sorted too, so the export of the same directory is always the same file:
+
+	certificates:
+	  - name: api
+	    profile: server
+	    key: ecdsa-p256
+	    ca: services
+	    hosts:
+	      - api.example.com
+	      - 10.0.0.5
+	  - name: sso
+	    profile: saml
+	    key: rsa-2048
+
+The profile is "server" (by default), or "spki" and "saml" for the nameless
+certificates (see "req"); the key is "rsa-BITS" or "ecdsa-CURVE", and whether
+it is not set, it is not compared; "ca" is the intermediate CA which issues the
+certificate (see "sign -ca"), the root CA whether it is not set. The hostnames
+without domain are expanded like in "req -host".
+
+The certificates of the directory which are not in FILE are only reported, so
+they have to be revoked explicitly. The CAs, the device identities and the
+certificates imported from other CAs are left out of the state.
+
 
 Information
 
 Usage:
 
-        easycert-wrap info [-end-date] [-hash] [-issuer] [-name] FILE
+        easycert-wrap info [-req] [-end-date] [-hash] [-issuer] [-name] [-spki] [-json] [-backend name] [-readonly] FILE
 
-"info" prints out information of a certificate.
+"info" prints out information of a certificate, or of a certificate request
+whether it is used the flag "-req"; then it prints the subject, the attributes
+(challenge password, unstructured name) and the requested extensions.
 To look for the file, it uses the certificates directory when the "file" is just
 a name or the path when the "file" is an absolute or relatative path.
+The file can be a container (PKCS#7, PKCS#12 or JKS), then the information is
+printed for every certificate inside it.
+
+The flag "-spki" prints the pin of the public key of the certificate, or of the
+request with "-req", to identify it by its key (see "req -spki").
 
 Whether a flag is not set, then it prints full information.
 
+The flag "-json" prints all the information in JSON format instead, to be used
+from scripts: the subject, the issuer, the serial number, the subject
+alternative names, the validity and the fingerprints of the certificate (an
+array for the containers), or the subject, the alternative names and the pin of
+the key of the request.
+
+With "-backend native", the information is got in Go instead of executing
+OpenSSL (see "ca"), in the same format; the containers are not supported, and
+only the subject and the hostnames of the requests are printed.
+
+
+Export the pins of the public keys
+
+Usage:
+
+        easycert-wrap pins [-o list|okhttp|android|hpkp] [-readonly] NAME...
+
+"pins" prints the pins of the public keys of the certificates (the SHA-256 hash
+in base64 of the SubjectPublicKeyInfo, like in "info -spki") together with the
+pins of their backup keys, so the clients which pin the keys keep working when
+a certificate is replaced by one with the backup key.
+
+The backup key of NAME is placed in "private/backup/NAME.key", and it is
+generated automatically whether it does not exist yet, unless the certificates
+directory is read-only. It is used by the next certificate with "req
+-backup-key -reissue NAME", and then a new backup key is generated by the next
+run of "pins".
+
+The pin set is printed like a list by default, or with "-o":
+
+	okhttp   the Java code of a CertificatePinner of OkHttp
+	android  the network security configuration of Android, whose pin set
+	         expires with the certificate
+	hpkp     the header "Public-Key-Pins" of HTTP, of 60 days
+
+The pins are set for the DNS names of the certificate, or for NAME whether it
+has none.
+
+
+Encrypt and sign files with the certificates
+
+Usage:
+
+        easycert-wrap cms -encrypt -to NAME1,... [-out FILE] FILE | cms -decrypt [-out FILE] NAME FILE | cms -sign [-out FILE] NAME FILE | cms -verify [-ca name] [-out FILE] FILE [SIGNATURE]
+
+"cms" uses the certificates of the directory to encrypt and sign files, like in
+S/MIME, through the Cryptographic Message Syntax (CMS, the successor of PKCS#7).
+The messages are written in DER format.
+
+With the flag "-encrypt", the file is encrypted with AES-256 for the
+certificates given in "-to", in "FILE.p7m" by default. The expired certificates
+are refused.
+
+With the flag "-decrypt", the encrypted file is decrypted with the private key
+of the certificate NAME, in FILE without the extension ".p7m" by default.
+
+With the flag "-sign", the file is signed with the private key of the
+certificate NAME, in a detached signature "FILE.p7s" by default; it has the
+certificate and its intermediate CAs, so it can be checked by whom has only the
+root CA.
+
+With the flag "-verify", the detached signature, "FILE.p7s" or SIGNATURE, is
+checked for the content in FILE against the CA given in "-ca" ("ca" by default),
+and the certificate of the signer is written in "-out" whether it is set.
+
+
+Sign SAML metadata
+
+Usage:
+
+        easycert-wrap sign-metadata [-out file] NAME METADATA
+
+"sign-metadata" signs the SAML metadata of the file METADATA with the private
+key of the certificate NAME (see "req -saml"), through an enveloped XML
+signature (XML-DSig) with RSA-SHA256 and the exclusive canonicalization, which
+has the certificate in its KeyInfo. It requires the program "xmlsec1" of the XML
+Security Library.
+
+The root element, EntityDescriptor or EntitiesDescriptor, gets an attribute "ID"
+whether it has none, to be referenced by the signature. The metadata already
+signed is refused.
+
+The metadata signed is printed, or written in "-out".
+
+
+Generate the device attestation chain of Matter
+
+Usage:
+
+        easycert-wrap matter -vid id [-pid id] [-years number] [-out dir] NAME
+
+"matter" generates the chain of device attestation used in the development of
+Matter devices: the Product Attestation Authority (PAA), the Product Attestation
+Intermediate (PAI) and the Device Attestation Certificate (DAC) named NAME. It
+is a chain apart from the CA of the certificates directory.
+
+The vendor ID, given in "-vid", and the product ID, given in "-pid", are 4
+hexadecimal digits (i.e. the test vendors FFF1 to FFF4), which are added to the
+subjects like the attributes of Matter: the PAA and the PAI have the vendor ID,
+and the DAC has the vendor and the product IDs. The keys are ECDSA on the curve
+P-256, signed with SHA-256, and the extensions are the required ones: the basic
+constraints, the key usage and the key identifiers.
+
+The files are written in the directory "matter-VID" unless it is used "-out":
+"paa.crt", "pai.crt" and "NAME.crt" with their keys, plus the certificates in
+DER format (".der") for the SDK and the devices. The PAA and the PAI of the
+directory are reused whether they exist, so the devices of a vendor share them.
+
+
+Issue the certificates of the overlay network Nebula
+
+Usage:
+
+        easycert-wrap nebula -init [-years number] | nebula -ip cidr [-groups name1,...] NAME | nebula -pki NAME
+
+"nebula" issues the certificates of the overlay network Nebula from the same
+certificates directory, so the identities of the mesh are handled together with
+the TLS ones. The certificates of Nebula are not X.509, so they are issued by
+the program "nebula-cert", which has to be installed, into the directory
+"nebula".
+
+With the flag "-init", it creates the CA of Nebula, whose name is the
+organization followed by " Nebula CA" (see "init"), valid for the years given in
+"-years".
+
+With the flag "-ip", it issues the certificate of the host NAME with its IP
+address and network in CIDR notation (i.e. "192.168.100.5/24") and the groups
+given in "-groups", used by the rules of the firewall. It is valid until the
+expiration of the CA of Nebula.
+
+With the flag "-pki", it prints the section "pki" of the configuration of Nebula
+for the host NAME, with the CA, the certificate and the key inline, so it can be
+pasted in the file "config.yml" of the host.
+
 
 Show the content
 
 Usage:
 
-        easycert-wrap cat [-req | -cert | -key] FILE
+        easycert-wrap cat [-req | -cert | -key] [-readonly] FILE
 
 "cat" shows the content of a certification-related file.
 To look for the file, it uses the certificates directory when the "file" is just
@@ -111,12 +1090,468 @@ Checking
 
 Usage:
 
-        easycert-wrap chk [-req | -cert | -key] FILE
+        easycert-wrap chk [-req | -cert [-system-roots] | -key [-json] | -ocsp] [-ca name] [-backend name] [-readonly] FILE [URL]
 
 "chk" checks whether a certification-related file is right.
 To look for the file, it uses the certificates directory when the "file" is just
 a name or the path when the "file" is an absolute or relatative path.
 
+With the flag "-cert", the certificate is verified against the CA given in
+"-ca". The flag "-system-roots" trusts the root certificates of the operating
+system too, so any certificate can be checked; to trust only them, set "-ca" to
+an empty value. The issuers are looked for into the file and into the
+certificates directory. It warns whether the file, like the chain configured in
+a server, has the root CA after the certificate: the clients have to trust it
+by themselves, so sending it is useless and hides a root not installed.
+
+With the flag "-key", it prints the type of the private key, its size or curve,
+whether it is encrypted and the public exponent of RSA keys, in JSON format
+whether it is used the flag "-json". It fails whether the key is weak: too
+small, with a wrong exponent, inconsistent, or with the fingerprint of the keys
+vulnerable to ROCA or generated by the OpenSSL of Debian with a predictable
+random generator (using the blacklist of the package "openssl-blacklist").
+
+With the flag "-ocsp", it queries the OCSP responder listed in the certificate
+(or the one at URL) about the revocation status of the certificate, printing
+the dates of the response; it fails whether the status is not "good". The
+response has to be signed by the CA given in "-ca", or by a responder
+delegated by it.
+
+With "-backend native", the requests and the certificates are checked in Go
+instead of executing OpenSSL (see "ca").
+
+
+Inspect certificate revocation lists
+
+Usage:
+
+        easycert-wrap crl [-show] [-info] [-readonly] [FILE | URL] | crl -gen [-passin source] | crl -diff OLD NEW
+
+"crl" prints out the information of a certificate revocation list (CRL): the
+issuer, the dates, the extensions and the revoked certificates with the date
+and reason of every one. The list can be of any CA; it is got from the URL
+whether it starts with "http://" or "https://", else it is looked for in the
+directory of the CRLs when it is just a name ("ca" by default), or in the path.
+The list can be in PEM or DER format. It is the same with the flag "-show".
+
+With the flag "-gen", the revocation list of the CA is generated again, like
+"revoke" does, so it is updated before of the date of its next update (30 days
+after of generating it, by default). It is used to keep the list valid whether
+no certificate is revoked in that time, i.e. from a job of cron.
+
+With the flag "-diff", it compares two lists of the same CA, printing the
+serial numbers added ("+") to the new list and removed ("-") from it.
+
+
+Serve a portal to submit certificate requests
+
+Usage:
+
+        easycert-wrap serve [-addr host:port] [-server name] [-token string] [-ha]
+
+"serve" runs a web portal where the developers paste a certificate request
+(CSR) which lands in the queue, pending of approval. The administrators approve
+or deny the pending requests using the token, and the issued certificates can
+be downloaded. The private keys never pass through the portal. The forms are
+protected against cross-site request forgery by a token kept in a cookie.
+
+Whether it is used the flag "-server", the portal is served over TLS with that
+certificate, and the clients can authenticate with a certificate signed by the
+CA; its common name identifies the operator, which is "portal" without it.
+Whether the operators are configured in "store.json" (see "audit"), the client
+certificate is required to approve, deny or revoke, also by the API. Whether
+the token is not set, then it is generated and printed.
+The passphrase of the CA's private key is got from the environment variable
+EASYCERT_CA_PASS.
+
+The queue is handled too through a REST API in JSON format at "/api/v1", which
+is described in OpenAPI at "/api/v1/openapi.json"; the token of the
+administrators is sent like bearer token (see "remote").
+
+Whether the field "syslog" of "store.json" is set (see "audit"), the errors of
+the portal are written to the log of the system instead of the standard error.
+
+Whether the environment variable OTEL_EXPORTER_OTLP_ENDPOINT is set, the portal
+exports to that collector of OpenTelemetry, by OTLP over HTTP with the encoding
+JSON, the spans of the requests and of the steps of the issuance ("queue.add",
+"issuance.check", "issuance.sign", "issuance.store" and "issuance.hook"), and
+the histogram of their durations "easycert.operation.duration". The trace of
+the client is continued from its header "traceparent". It is configured too by
+OTEL_EXPORTER_OTLP_TRACES_ENDPOINT, OTEL_EXPORTER_OTLP_METRICS_ENDPOINT,
+OTEL_EXPORTER_OTLP_HEADERS, OTEL_SERVICE_NAME and OTEL_SDK_DISABLED.
+
+With the flag "-ha", several instances of the portal run like active/standby:
+the active one is elected through a lease in the external database of
+"store.json" (see "init"), renewed every 5 seconds, and the standby ones wait
+to listen until the lease of the active one expires, after 15 seconds. The
+active instance exits whether it loses the lease. The instances have to share
+the certificates directory, i.e. in a network file system, and the token given
+in "-token"; the clocks of their hosts have to be synchronized.
+
+
+Serve an OCSP responder
+
+Usage:
+
+        easycert-wrap ocsp-serve [-addr host:port] [-passin source]
+
+"ocsp-serve" runs a responder of the Online Certificate Status Protocol (OCSP,
+RFC 6960) for the certificates signed by the CA, so the services can check
+whether a certificate is revoked without distributing the revocation lists.
+
+The requests are accepted by POST and by GET, and the status is got from the
+database of the CA at every request, so the certificates revoked by "revoke"
+are answered at once: "good" for the valid and the expired ones, "revoked"
+with the date and the reason, or "unknown" for the serial numbers not issued
+by the CA. The responses are signed by the CA, whose passphrase is got from
+the environment variable EASYCERT_CA_PASS, or from the source of "-passin"
+(see "ca"), and they are valid for 1 hour.
+
+The URL of the responder is added to the certificates through the extension
+"authorityInfoAccess" in the section "usr_cert" of the configuration:
+
+	authorityInfoAccess = OCSP;URI:http://ocsp.example.com:8080
+
+Else, it can be given to "chk -ocsp FILE URL".
+
+
+Sign the certificate requests of cert-manager in Kubernetes
+
+Usage:
+
+        easycert-wrap k8s-issuer [-group name] [-interval duration] [-once] [-dry-run]
+
+"k8s-issuer" is an external issuer of cert-manager: it signs with the CA the
+CertificateRequests of the cluster whose issuer is in the API group of "-group"
+(by default "easycert.tredoe.github.io"), once they are approved, and sets the
+certificate and the CA in their status. The kind of the issuer ("Issuer" or
+"ClusterIssuer") is not checked, so any name can be used in "issuerRef":
+
+	issuerRef:
+	  group: easycert.tredoe.github.io
+	  kind: ClusterIssuer
+	  name: team-ca
+
+The requests are signed like the ones approved from the queue, with the name
+"k8s-NAMESPACE.NAME", running the hooks and recording them in the audit log;
+the requests denied in cert-manager are marked like failed.
+
+It runs in the cluster with the token of its service account, which has to be
+allowed to list the resources "certificaterequests" of "cert-manager.io" and to
+update "certificaterequests/status". Out of the cluster, the URL of the API
+server and the token are got from EASYCERT_K8S_API and EASYCERT_K8S_TOKEN.
+
+The requests are looked for every "-interval" (30s by default), or once with
+"-once"; the flag "-dry-run" prints the requests to sign without signing them.
+
+
+Serve an ACME endpoint which issues certificates of the CA
+
+Usage:
+
+        easycert-wrap acme-serve [-addr host:port] [-server name] [-domain names] [-passin source]
+
+"acme-serve" runs a server of the ACME protocol (RFC 8555), so the standard
+clients like certbot, Caddy or cert-manager get certificates signed by the CA.
+Its directory is at "/directory":
+
+	certbot certonly --server https://ca.example.com:8443/directory ...
+
+The control of the domains is proved with the challenge HTTP-01, getting the key
+authorization from the port 80 of the domain, or with DNS-01, looking up the TXT
+record "_acme-challenge.DOMAIN", required by the wildcard domains. The flag
+"-domain" restricts the domains to the ones of its comma-separated list and to
+their subdomains.
+
+The certificates are signed like in "sign", with the domains like subject
+alternative names and the first one like common name, whatever the subject of
+the request is. They are stored like "acme-DOMAIN" ("acme-wildcard.DOMAIN" for
+"*.DOMAIN"), keeping the current certificate like a previous version; the hooks
+are run and they are recorded in the audit log, like done by the operator which
+runs the server. The returned chain has the intermediate CAs, but not the root.
+
+The accounts are kept into the directory "acme-accounts", but the orders in
+progress are lost whether the server is restarted.
+
+Whether it is used the flag "-server", the endpoint is served over TLS with that
+certificate; else, the clients have to allow plain HTTP. The passphrase of the
+CA's private key is got from the environment variable EASYCERT_CA_PASS, or from
+the source of "-passin" (see "ca"), unless the key is in a KMS.
+
+
+List or add requests pending of approval
+
+Usage:
+
+        easycert-wrap queue [-all] [-attestation file] [FILE NAME]
+
+"queue" lists the certificate requests which are pending of approval, or adds
+the request in FILE to the queue to issue the certificate NAME.
+The requests received from the portal and the files "NAME.csr" placed in the
+directory "queue/drop" land in the queue too.
+
+Use "approve" or "deny" to review them.
+
+The flag "-attestation" attaches the attestation statement of the key (TPM,
+Android or Apple key attestation), which is verified when the request is queued
+and before of approving it. The chains of certificates of Android and Apple, in
+PEM or DER and starting with the certificate of the attested key, are verified
+against the roots of Google and Apple, and that key has to be the one of the
+request; the keys of Android have to be in secure hardware (TEE or StrongBox).
+The rest of statements (i.e. TPM) are verified by the executable
+"verify-attestation" of the hooks directory; the statement is passed in the
+environment variable EASYCERT_ATTESTATION and the request in EASYCERT_REQUEST.
+The hook has to check that the attested key is the one of the request, passed in
+EASYCERT_SPKI (SubjectPublicKeyInfo in DER, in base64) and its SHA-256 in
+EASYCERT_SPKI_SHA256 (in hexadecimal).
+Whether the field "require_attestation" of "store.json" is set, only the
+requests with an attestation verified are signed.
+
+
+Approve a pending request
+
+Usage:
+
+        easycert-wrap approve [-years number] [-stagger window] [-passin source] [-batch] ID...
+
+"approve" signs certificate requests of the queue using the CA. Like in "sign",
+the expirations of the requests approved together can be spread out with the
+flag "-stagger".
+
+
+Deny a pending request
+
+Usage:
+
+        easycert-wrap deny ID
+
+"deny" rejects a certificate request of the queue.
+
+
+Handle the queue of a remote portal
+
+Usage:
+
+        easycert-wrap remote -url url [-token string] [-ca name] list | submit [-attestation file] NAME FILE | approve ID | deny ID | cert [-out file] ID
+
+"remote" uses the REST API of a portal (see "serve") at the URL given in "-url",
+instead of the local certificates directory:
+
+	list     lists the requests of the queue
+	submit   adds the certificate request in FILE to issue the certificate NAME
+	approve  signs the request ID
+	deny     denies the request ID
+	cert     prints the certificate issued for the request ID, or writes it in
+	         "-out"
+
+To approve or deny, it is used the token of the administrators given in
+"-token". The server certificate of the portal is verified with the roots of
+the system and the CA given in "-ca", whether it exists. The URL and the token
+are got too from the environment variables EASYCERT_REMOTE and
+EASYCERT_REMOTE_TOKEN, and the operator is authenticated with the certificate
+named in EASYCERT_REMOTE_CERT (see "init").
+
+The API is described in OpenAPI at "/api/v1/openapi.json" of the portal, and
+the programs in Go can use it through the package
+"github.com/tredoe/easycert/client".
+
+
+Send notifications by email
+
+Usage:
+
+        easycert-wrap notify [-days number] [-dry-run]
+
+"notify" sends an email in plain text listing the certificates which are into
+their renewal window and the requests pending of approval. Nothing is sent when
+there is nothing to notify. It is intended to be run by cron.
+
+The server SMTP is set in the field "smtp" of the file "store.json" in the
+certificates directory:
+
+	{
+		"renewal_days": 30,
+		"smtp": {
+			"addr": "smtp.example.com:587",
+			"username": "user",
+			"password": "secret",
+			"from": "easycert@example.com",
+			"to": ["admin@example.com"]
+		}
+	}
+
+Whether the field "issue" is set, an issue is opened in a repository of GitHub
+or GitLab listing the certificates into their renewal window; it is updated in
+the next runs, and closed when there is nothing to renew. The token of the API
+is got from the environment variable EASYCERT_ISSUE_TOKEN:
+
+	{
+		"issue": {
+			"provider": "github",
+			"repo": "example/ops",
+			"label": "easycert"
+		}
+	}
+
+The field "url" sets the API for GitHub Enterprise or GitLab self-managed, i.e.
+"https://gitlab.example.com/api/v4"; by default, the label is "easycert".
+
+The flag "-days" overrides the renewal window, and "-dry-run" prints the email
+and the issue instead of sending them.
+
+
+Show the audit log
+
+Usage:
+
+        easycert-wrap audit [-all]
+
+"audit" shows who did every action on the certificates directory, the last
+fifty events or all of them using "-all".
+
+The operator is the user of the system, or the name set in the environment
+variable EASYCERT_OPERATOR; in the portal it is the common name of the client
+certificate, or "portal" without it. The roles are enforced whether the field
+"operators" is set in the file "store.json":
+
+	{
+		"operators": {
+			"alice": "admin",
+			"bob": "issuer",
+			"carol": "auditor"
+		}
+	}
+
+An "admin" can do everything, an "issuer" creates, signs and reviews requests,
+and an "auditor" can only read. Since anyone can set EASYCERT_OPERATOR, it is
+refused then; and the portal requires a client certificate to approve, deny or
+revoke.
+
+Whether the field "syslog" of "store.json" is set to "journald" or "syslog",
+the events are sent too to the journal of systemd or to the local syslog, so
+the pipelines of logs capture them without reading the audit log. The events
+have the fields EASYCERT_ACTION, EASYCERT_OPERATOR, EASYCERT_NAME and
+EASYCERT_DETAIL in the journal, and the pairs "action=", "operator=", "name="
+and "detail=" after of the message in syslog:
+
+	{
+		"syslog": "journald"
+	}
+
+
+Look for weak or shared keys
+
+Usage:
+
+        easycert-wrap audit-keys [-json] [-readonly]
+
+"audit-keys" scans the private keys of the certificates directory and the public
+keys of its certificates, the current and the previous versions, looking for:
+
+	keys shared by several names, since a key used by different services is
+	exposed whether any of them is compromised
+	weak keys, like in "chk -key": too small, with a wrong exponent, or with the
+	fingerprint of the keys vulnerable to ROCA or generated by the OpenSSL of
+	Debian with a predictable random generator
+
+The encrypted private keys are not read, but the public keys of their
+certificates are checked. It fails whether something is found, printing the
+findings in JSON format whether it is used the flag "-json".
+
+
+Show statistics of the certificates issued
+
+Usage:
+
+        easycert-wrap stats [-json] [-readonly]
+
+"stats" shows a quick overview of the certificates issued by the CA, from its
+database: the number of certificates by status (valid, expired and revoked),
+the issuance by month, the distribution of the algorithms of the keys, and a
+histogram of the expirations of the valid certificates.
+
+The issuance and the keys are got from the copies of the certificates kept by
+OpenSSL in the directory "newcerts"; the ones whose copy is missing are counted
+like unknown. The statistics are printed in JSON format whether it is used the
+flag "-json".
+
+
+Watch the Certificate Transparency logs
+
+Usage:
+
+        easycert-wrap ctwatch [-domain name1,...] [-dry-run]
+
+"ctwatch" looks for the certificates of the domains, and of their subdomains,
+logged in the public Certificate Transparency logs since the last run, through
+the search of crt.sh. It alerts of the ones which were not issued by the CA nor
+by the issuers expected, since they could have been issued to an attacker.
+It is intended to be run by cron.
+
+It is configured in the field "ctwatch" of the file "store.json", and the alerts
+are sent by email whether the field "smtp" is set (see "notify"), and posted in
+JSON format to the URL in "webhook" whether it is set:
+
+	{
+		"ctwatch": {
+			"domains": ["example.com"],
+			"issuers": ["Let's Encrypt"],
+			"webhook": "https://hooks.example.com/ctwatch"
+		}
+	}
+
+The field "issuers" has the names, or part of the names, of the issuers which
+are expected, and "url" the search of another service compatible with crt.sh.
+The flag "-domain" overrides the domains, and "-dry-run" prints the alerts
+instead of sending them.
+
+
+Remove the expired material of the store
+
+Usage:
+
+        easycert-wrap gc [-expired-for duration] [-delete] [-dry-run]
+
+"gc" removes from the certificates directory the material expired for longer
+than the duration given in "-expired-for" (i.e. "90d"), or in the field
+"retention" of "store.json" (90 days by default):
+
+	certificates and private keys, but the ones of the CAs
+	previous versions of the certificates (see "ls -history")
+	certificate requests never signed, or whose certificate is removed
+	issuers of the chains directory no longer used
+	entries of the database of the CA, and their copies in "newcerts"
+
+The entries of the database still valid but expired are marked like expired.
+Since the revoked certificates are removed of the database, they will not be
+listed in the next revocation lists.
+
+The files are moved into a directory named by the date into "archive", unless
+it is used the flag "-delete". The flag "-dry-run" lists them without removing.
+
+
+Recover a private key from escrow
+
+Usage:
+
+        easycert-wrap recover -escrow-key file [-out file] NAME
+
+"recover" decrypts the private key of NAME stored in escrow, using the private
+key of escrow. The key is written to the private keys directory, unless it is
+used "-out".
+
+The escrow is off by default. It is enabled with the field "escrow" of the file
+"store.json", where "cert" is the certificate whose public key wraps the private
+keys generated by "req", and "names" are the patterns of the names which need
+escrow (i.e. the certificates for S/MIME); all names whether it is empty:
+
+	{
+		"escrow": {
+			"cert": "escrow",
+			"names": ["mail-*"]
+		}
+	}
+
 
 */
 package main
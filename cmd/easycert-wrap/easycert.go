@@ -9,6 +9,7 @@ package main
 import (
 	"bytes"
 	"fmt"
+	"io"
 	"log"
 	"os"
 	"os/exec"
@@ -22,12 +23,22 @@ const (
 	// Where the configuration template is installed through "go get".
 	_DIR_CONFIG = "github.com/tredoe/easycert/data"
 
-	DIR_ROOT = ".cert" // Directory to store the certificates.
-	NAME_CA  = "ca"    // Name for files related to the CA.
+	DIR_ROOT = ".cert"         // Directory to store the certificates.
+	ENV_ROOT = "EASYCERT_ROOT" // Environment variable to use another directory.
+	NAME_CA  = "ca"            // Name for files related to the CA.
 
 	FILE_CONFIG    = "openssl.cfg"
+	FILE_STORE     = "store.json"
 	FILE_SERVER_GO = "z-srv_cert.go"
 	FILE_CLIENT_GO = "z-clt_cert.go"
+
+	FILE_SERVER_TEST_GO = "z-srv_cert_test.go"
+	FILE_CLIENT_TEST_GO = "z-clt_cert_test.go"
+
+	FILE_CERT_H = "easycert_certs.h"
+	FILE_CERT_C = "easycert_certs.c"
+
+	FILE_ESP32_H = "easycert_esp32.h"
 )
 
 // File extensions.
@@ -43,6 +54,14 @@ const (
 	// For files that contain both the Key and the server certificate since some
 	// servers need this. Permissions should be restrictive on these files.
 	EXT_CERT_AND_KEY = ".pem"
+
+	// Certificate or key in binary format (DER), for embedded systems.
+	EXT_DER = ".der"
+
+	// Containers used by vendors to deliver certificates.
+	EXT_PKCS7  = ".p7b" // PKCS#7 bundle (can hold a certificate chain)
+	EXT_PKCS12 = ".p12" // PKCS#12 archive (protected by password)
+	EXT_JKS    = ".jks" // Java KeyStore
 )
 
 // DirPath represents the directory structure.
@@ -51,6 +70,28 @@ type DirPath struct {
 	Cert  string // Where the server certificates are placed.
 	Key   string // Where the private keys are placed.
 	Revok string // Where the certificate revokation list is placed.
+	Hook  string // Where the scripts run before and after of signing are placed.
+	Queue string // Where the requests waiting for approval are placed.
+
+	// Where the receipts of the certificates issued are placed.
+	Receipt string
+
+	// Where the private keys in escrow are placed.
+	Escrow string
+
+	// Where the backup keys are placed, whose pins are published with the ones
+	// of the certificates.
+	Backup string
+
+	// Where the certificates of the overlay network Nebula are placed, with
+	// their keys.
+	Nebula string
+
+	// Where the issuers of the certificates imported are placed, once.
+	Chain string
+
+	// Where the material removed by "gc" is placed.
+	Archive string
 
 	// Where OpenSSL puts the created certificates in PEM (unencrypted) format
 	// and in the form 'cert_serial_number.pem' (e.g. '07.pem')
@@ -62,8 +103,12 @@ type FilePath struct {
 	Cmd       string // OpenSSL' path
 	Config    string // OpenSSL's configuration file.
 	SrvConfig string // OpenSSL's configuration file for a server.
+	Store     string // Configuration of the certificates directory.
+	Audit     string // Log of the actions done by the operators.
 	Index     string // Serves as a database for OpenSSL.
 	Serial    string // Contains the next certificate’s serial number.
+	CRLNumber string // Contains the next CRL's number.
+	CRL       string // Certificate revokation list of the CA.
 
 	Cert    string // Certificate.
 	Key     string // Private key.
@@ -80,47 +125,138 @@ func init() {
 	log.SetFlags(0)
 	log.SetPrefix("FAIL! ")
 
+	// Without OpenSSL, the commands of the native backend still work.
 	cmdPath, err := exec.LookPath("openssl")
 	if err != nil {
-		log.Fatal("OpenSSL is not installed")
+		cmdPath = "openssl"
 	}
 
-	user, err := user.Current()
-	if err != nil {
-		log.Fatal(err)
+	root := os.Getenv(ENV_ROOT)
+	if root == "" {
+		user, err := user.Current()
+		if err != nil {
+			log.Fatal(err)
+		}
+		root = filepath.Join(user.HomeDir, DIR_ROOT)
 	}
+	setRoot(cmdPath, root)
+}
 
-	root := filepath.Join(user.HomeDir, DIR_ROOT)
-
+// setRoot sets the directory structure into `root`, using the OpenSSL's
+// executable at `cmdPath`.
+func setRoot(cmdPath, root string) {
 	Dir = &DirPath{
 		Root:    root,
 		Cert:    filepath.Join(root, "certs"),
 		NewCert: filepath.Join(root, "newcerts"),
 		Key:     filepath.Join(root, "private"),
 		Revok:   filepath.Join(root, "crl"),
+		Hook:    filepath.Join(root, "hooks"),
+		Queue:   filepath.Join(root, "queue"),
+		Receipt: filepath.Join(root, "receipts"),
+		Escrow:  filepath.Join(root, "escrow"),
+		Backup:  filepath.Join(root, "private", "backup"),
+		Nebula:  filepath.Join(root, "nebula"),
+		Chain:   filepath.Join(root, "chains"),
+		Archive: filepath.Join(root, "archive"),
 	}
 
 	File = &FilePath{
 		Cmd:    cmdPath,
 		Config: filepath.Join(Dir.Root, FILE_CONFIG),
+		Store:  filepath.Join(Dir.Root, FILE_STORE),
+		Audit:  filepath.Join(Dir.Root, "audit.log"),
 		Index:  filepath.Join(Dir.Root, "index.txt"),
 		Serial: filepath.Join(Dir.Root, "serial"),
+
+		CRLNumber: filepath.Join(Dir.Root, "crlnumber"),
+		CRL:       filepath.Join(Dir.Revok, NAME_CA+EXT_REVOK),
 	}
 }
 
+const (
+	PROGRAM     = "easycert-wrap"
+	DESCRIPTION = "EasyCert-wrap is a wrap over OpenSSL to create and handle certificates."
+)
+
+// commands are the subcommands, in the order they are shown.
+var commands = []*flagplus.Subcommand{
+	cmdInit,
+	cmdCA,
+	cmdCeremony,
+	cmdReq,
+	cmdSign,
+	cmdRenew,
+	cmdACME,
+	cmdLang,
+	cmdImport,
+	cmdExport,
+	cmdVerifyBundle,
+	cmdDeploy,
+	cmdSidecar,
+	cmdTrust,
+	cmdAirgap,
+	cmdRevoke,
+	cmdUnrevoke,
+	cmdPublish,
+	cmdLs,
+	cmdGraph,
+	cmdState,
+	cmdInfo,
+	cmdPins,
+	cmdCMS,
+	cmdSignMetadata,
+	cmdMatter,
+	cmdNebula,
+	cmdCat,
+	cmdChk,
+	cmdCRL,
+	cmdServe,
+	cmdOCSPServe,
+	cmdK8sIssuer,
+	cmdACMEServe,
+	cmdQueue,
+	cmdApprove,
+	cmdDeny,
+	cmdRemote,
+	cmdNotify,
+	cmdAudit,
+	cmdAuditKeys,
+	cmdStats,
+	cmdCTWatch,
+	cmdGC,
+	cmdRecover,
+}
+
 func main() {
-	app := flagplus.NewCommand(
-		"EasyCert-wrap is a wrap over OpenSSL to create and handle certificates.",
-		cmdInit,
-		cmdCA,
-		cmdReq,
-		cmdSign,
-		cmdLang,
-		cmdLs,
-		cmdInfo,
-		cmdCat,
-		cmdChk,
-	)
+	// Hidden command, to be used by packagers.
+	if len(os.Args) > 1 && os.Args[1] == "gendocs" {
+		runGendocs(os.Args[2:])
+		return
+	}
+	loadDefaults()
+	loadEnvFlags()
+	// Certificates directory in a server.
+	if u := remoteURL(Dir.Root); u != nil {
+		if os.Getenv(ENV_REMOTE) != "" {
+			log.Fatalf("%s can not be used with a remote directory in %s", ENV_REMOTE, ENV_ROOT)
+		}
+		runRemote(u, os.Args[1:])
+		return
+	}
+	// Portal which handles the certificates directory.
+	if os.Getenv(ENV_REMOTE) != "" {
+		useRemoteAPI()
+	}
+	// External subcommand.
+	if len(os.Args) > 1 {
+		if path := lookPlugin(os.Args[1]); path != "" {
+			runPlugin(path, os.Args[1], os.Args[2:])
+			return
+		}
+	}
+
+	app := flagplus.NewCommand(DESCRIPTION, editionCommands()...)
 	app.Parse()
 }
 
@@ -137,6 +273,8 @@ func getAbsPaths(isCmdInfo bool, args []string) []string {
 			} else if *IsKey {
 				newArgs[i] = filepath.Join(Dir.Key, v+EXT_KEY)
 			}
+		} else {
+			newArgs[i] = v
 		}
 	}
 	return newArgs
@@ -155,20 +293,49 @@ func setCertPath(name string) {
 
 // openssl executes an OpenSSL command.
 func openssl(args ...string) []byte {
+	return execCmd(os.Stdin, File.Cmd, args...)
+}
+
+// opensslInput executes an OpenSSL command reading the standard input from
+// `input`.
+func opensslInput(input []byte, args ...string) []byte {
+	return execCmd(bytes.NewReader(input), File.Cmd, args...)
+}
+
+// execCmd executes the command `name`, returning its standard output.
+func execCmd(stdin io.Reader, name string, args ...string) []byte {
 	var stdout bytes.Buffer
 
-	cmd := exec.Command(File.Cmd, args...)
-	cmd.Stdin = os.Stdin
+	debugCmd(name, args)
+	cmd := exec.Command(name, args...)
+	cmd.Stdin = stdin
 	cmd.Stdout = &stdout
 	cmd.Stderr = os.Stderr
 
 	err := cmd.Start()
 	if err != nil {
-		log.Fatal(err)
+		fatal(err)
 	}
 	if err = cmd.Wait(); err != nil {
 		fmt.Fprintln(os.Stderr)
-		log.Fatal(err)
+		fatal(err)
 	}
 	return stdout.Bytes()
 }
+
+// opensslNoFatal executes an OpenSSL command without input, returning the
+// error instead of exiting. The error includes the standard error output.
+// It is used by the long-running commands.
+func opensslNoFatal(args ...string) ([]byte, error) {
+	var stdout, stderr bytes.Buffer
+
+	debugCmd(File.Cmd, args)
+	cmd := exec.Command(File.Cmd, args...)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("openssl %s: %s\n%s", args[0], err, stderr.Bytes())
+	}
+	return stdout.Bytes(), nil
+}
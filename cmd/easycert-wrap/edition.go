@@ -0,0 +1,70 @@
+// Copyright 2014 Jonas mg
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"fmt"
+
+	"github.com/tredoe/flagplus"
+)
+
+// Editions of the program, to separate the duties at the level of the binary.
+// The editions restricted are built with the tags "signer" and "requester".
+const (
+	EDITION_FULL      = ""
+	EDITION_SIGNER    = "signer"    // Signs the requests, but never generates nor exports keys.
+	EDITION_REQUESTER = "requester" // Generates the requests, without access to the CA.
+)
+
+// edition is set by the file built with the tag of the edition.
+var edition = EDITION_FULL
+
+// editionActions are the actions allowed in each restricted edition.
+var editionActions = map[string][]string{
+	EDITION_SIGNER:    {ACTION_SIGN, ACTION_QUEUE, ACTION_DENY, ACTION_REVOKE, ACTION_UNREVOKE, ACTION_CRL, ACTION_GC},
+	EDITION_REQUESTER: {ACTION_REQUEST, ACTION_QUEUE},
+}
+
+// editionExcluded are the subcommands left out of each restricted edition.
+var editionExcluded = map[string][]*flagplus.Subcommand{
+	EDITION_SIGNER:    {cmdCA, cmdReq, cmdRenew, cmdACME, cmdLang, cmdImport, cmdExport, cmdDeploy, cmdSidecar, cmdRecover, cmdNebula, cmdMatter},
+	EDITION_REQUESTER: {cmdCA, cmdSign, cmdRenew, cmdRevoke, cmdUnrevoke, cmdServe, cmdOCSPServe, cmdK8sIssuer, cmdACMEServe, cmdApprove, cmdDeny, cmdRecover, cmdGC, cmdStats, cmdNebula, cmdMatter},
+}
+
+// checkEdition checks whether the action is allowed in the edition of the
+// program.
+func checkEdition(action string) error {
+	if edition == EDITION_FULL {
+		return nil
+	}
+	for _, v := range editionActions[edition] {
+		if v == action {
+			return nil
+		}
+	}
+	return fmt.Errorf("the %s edition is not allowed to %s", edition, action)
+}
+
+// editionCommands returns the subcommands available in the edition of the
+// program.
+func editionCommands() []*flagplus.Subcommand {
+	if edition == EDITION_FULL {
+		return commands
+	}
+
+	list := make([]*flagplus.Subcommand, 0, len(commands))
+Loop:
+	for _, cmd := range commands {
+		for _, v := range editionExcluded[edition] {
+			if v == cmd {
+				continue Loop
+			}
+		}
+		list = append(list, cmd)
+	}
+	return list
+}
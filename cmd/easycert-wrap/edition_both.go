@@ -0,0 +1,12 @@
+// Copyright 2014 Jonas mg
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+//go:build signer && requester
+
+package main
+
+// The editions are exclusive, so the build fails whether both tags are used.
+var _ = the_tags_signer_and_requester_are_exclusive
@@ -0,0 +1,82 @@
+// Copyright 2014 Jonas mg
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+// Ephemeral certificates, issued in a certificates directory in memory by a CA
+// which only exists while the command runs, so nothing is written to disk.
+
+package main
+
+import (
+	"crypto/rand"
+	"encoding/pem"
+	"flag"
+	"io"
+	"strings"
+
+	"github.com/tredoe/easycert"
+	"github.com/tredoe/easycert/store"
+)
+
+var IsEphemeral = flag.Bool("ephemeral", false, "issue in memory by a throwaway CA, printing the certificate, its key and the CA")
+
+// EPHEMERAL_CA is the common name of the CA of the ephemeral certificates.
+const EPHEMERAL_CA = "Ephemeral CA"
+
+// Ephemeral issues the certificate `name` for the hosts of "-host", with the
+// key of "-key-type", in a certificates directory in memory with a new CA, and
+// writes to `w` the certificate, its private key and the certificate of the CA
+// in PEM format. The CA's private key is lost once the command ends.
+func Ephemeral(w io.Writer, name string) error {
+	s, err := easycert.Init(store.NewMem())
+	if err != nil {
+		return err
+	}
+	keyOpts := &easycert.KeyOptions{
+		Type:    KeySpec.Type,
+		RSASize: KeySpec.RSASize,
+		Curve:   curves[KeySpec.Curve],
+	}
+	days := 365 * *Years
+
+	ca, err := s.CreateCA(easycert.Name{CommonName: EPHEMERAL_CA}, &easycert.CAOptions{
+		Key: keyOpts, Days: days, Passphrase: rand.Text(),
+	})
+	if err != nil {
+		return err
+	}
+
+	var hosts []string
+	for _, v := range append(Host.dns, Host.ip...) {
+		hosts = append(hosts, strings.TrimPrefix(strings.TrimPrefix(v, "DNS:"), "IP:"))
+	}
+	req, err := s.NewRequest(name, &easycert.RequestOptions{Hosts: hosts, Key: keyOpts})
+	if err != nil {
+		return err
+	}
+	cert, err := ca.Sign(req, &easycert.SignOptions{Days: days})
+	if err != nil {
+		return err
+	}
+	key, err := s.Key(name, "")
+	if err != nil {
+		return err
+	}
+	keyPEM, err := easycert.MarshalKey(key, "")
+	if err != nil {
+		return err
+	}
+
+	for _, v := range [][]byte{
+		pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw}),
+		keyPEM,
+		pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.Cert.Raw}),
+	} {
+		if _, err = w.Write(v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,118 @@
+// Copyright 2014 Jonas mg
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+)
+
+// ENV_FIPS is the environment variable to use the FIPS mode.
+const ENV_FIPS = "EASYCERT_FIPS"
+
+// FIPS_DIGEST is the message digest used to sign in FIPS mode.
+const FIPS_DIGEST = "sha256"
+
+// fipsBuild is set when the program is built with a FIPS validated module.
+var fipsBuild = false
+
+var IsFIPS = flag.Bool("fips", false, "restrict the algorithms to those approved by FIPS")
+
+// Algorithms approved by FIPS 186-4.
+var (
+	fipsRSASizes = map[int]bool{2048: true, 3072: true, 4096: true}
+	fipsCurves   = map[string]bool{"P-256": true, "P-384": true, "P-521": true}
+
+	fipsSigAlgs = map[x509.SignatureAlgorithm]bool{
+		x509.SHA256WithRSA:    true,
+		x509.SHA384WithRSA:    true,
+		x509.SHA512WithRSA:    true,
+		x509.SHA256WithRSAPSS: true,
+		x509.SHA384WithRSAPSS: true,
+		x509.SHA512WithRSAPSS: true,
+		x509.ECDSAWithSHA256:  true,
+		x509.ECDSAWithSHA384:  true,
+		x509.ECDSAWithSHA512:  true,
+	}
+)
+
+// fipsMode reports whether the algorithms are restricted to those approved by
+// FIPS.
+func fipsMode() bool {
+	return fipsBuild || *IsFIPS || os.Getenv(ENV_FIPS) != "" || loadStoreConfig().FIPS
+}
+
+// fipsCheckKeySpec exits whether the key to generate is not approved, in FIPS
+// mode.
+func fipsCheckKeySpec(k *keySpec) {
+	if !fipsMode() {
+		return
+	}
+	if k.Type == KEY_TYPE_RSA && !fipsRSASizes[k.RSASize] {
+		log.Fatalf("FIPS mode: RSA key size must be 2048, 3072 or 4096; got %d", k.RSASize)
+	}
+	if k.Type == KEY_TYPE_ECDSA && !fipsCurves[curves[k.Curve].Params().Name] {
+		log.Fatalf("FIPS mode: curve not approved: %s", curves[k.Curve].Params().Name)
+	}
+}
+
+// fipsCheckRequest checks that both the public key and the signature of the
+// certificate request are approved, in FIPS mode.
+func fipsCheckRequest(file string) error {
+	if !fipsMode() {
+		return nil
+	}
+
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return fmt.Errorf("no certificate request in PEM format: %q", file)
+	}
+	req, err := x509.ParseCertificateRequest(block.Bytes)
+	if err != nil {
+		return err
+	}
+
+	if !fipsSigAlgs[req.SignatureAlgorithm] {
+		return fmt.Errorf("FIPS mode: signature algorithm not approved: %s", req.SignatureAlgorithm)
+	}
+
+	switch pub := req.PublicKey.(type) {
+	case *rsa.PublicKey:
+		if !fipsRSASizes[pub.N.BitLen()] {
+			return fmt.Errorf("FIPS mode: RSA key size not approved: %d", pub.N.BitLen())
+		}
+	case *ecdsa.PublicKey:
+		if !fipsCurves[pub.Curve.Params().Name] {
+			return fmt.Errorf("FIPS mode: curve not approved: %s", pub.Curve.Params().Name)
+		}
+	default:
+		return fmt.Errorf("FIPS mode: public key algorithm not approved: %s", req.PublicKeyAlgorithm)
+	}
+	return nil
+}
+
+// fipsDigestArgs returns the arguments to set the message digest of OpenSSL
+// for the command `cmd`, in FIPS mode.
+func fipsDigestArgs(cmd string) []string {
+	if !fipsMode() {
+		return nil
+	}
+	if cmd == "ca" {
+		return []string{"-md", FIPS_DIGEST}
+	}
+	return []string{"-" + FIPS_DIGEST}
+}
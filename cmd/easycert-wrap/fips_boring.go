@@ -0,0 +1,16 @@
+// Copyright 2014 Jonas mg
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+//go:build boringcrypto
+
+package main
+
+// Restrict the TLS configurations to FIPS-approved settings.
+import _ "crypto/tls/fipsonly"
+
+func init() {
+	fipsBuild = true
+}
@@ -0,0 +1,90 @@
+// Copyright 2014 Jonas mg
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"time"
+)
+
+// High availability of the portal: several instances, active/standby, elect
+// the active one through a lease in the external database.
+
+// HA_LEASE is the name of the lease of the active instance of the portal.
+const HA_LEASE = "serve"
+
+// HA_LEASE_TTL is the time which the lease is held without being renewed; it is
+// renewed every third of it.
+const HA_LEASE_TTL = 15 * time.Second
+
+// haHolder returns the identity of the instance: the host and the process.
+func haHolder() string {
+	host, err := os.Hostname()
+	if err != nil {
+		host = "localhost"
+	}
+	return host + ":" + strconv.Itoa(os.Getpid())
+}
+
+// openLeaser opens the external database of "store.json" to elect the leader.
+func openLeaser() (leaser, error) {
+	cfg := loadStoreConfig().Database
+	if cfg == nil || cfg.Driver == DB_FILE {
+		return nil, fmt.Errorf("high availability needs an external database in the field \"database\" of %q", File.Store)
+	}
+
+	db, err := dbDrivers[cfg.Driver](cfg.DSN)
+	if err != nil {
+		return nil, fmt.Errorf("database %s: %s", cfg.Driver, err)
+	}
+	l, ok := db.(leaser)
+	if !ok {
+		db.close()
+		return nil, fmt.Errorf("database %s can not elect a leader", cfg.Driver)
+	}
+	return l, nil
+}
+
+// waitLeadership blocks while the instance is standby, until it acquires the
+// lease. Then, the lease is renewed in the background, and the program exits
+// whether it is lost, so the new active instance is the only one which issues.
+func waitLeadership(l leaser, holder string) {
+	fmt.Printf("* Standby as %s\n", holder)
+	for {
+		ok, err := l.lease(HA_LEASE, holder, time.Now().Add(HA_LEASE_TTL))
+		if err != nil {
+			log.Print(err)
+		} else if ok {
+			break
+		}
+		time.Sleep(HA_LEASE_TTL / 3)
+	}
+	fmt.Printf("* Active as %s\n", holder)
+
+	go func() {
+		renewed := time.Now()
+
+		for range time.Tick(HA_LEASE_TTL / 3) {
+			ok, err := l.lease(HA_LEASE, holder, time.Now().Add(HA_LEASE_TTL))
+			switch {
+			case err == nil && ok:
+				renewed = time.Now()
+			case err == nil:
+				log.Fatalf("Leadership lost: the lease %q is held by another instance", HA_LEASE)
+			default:
+				log.Print(err)
+				// Before of the expiration, when another one could take it.
+				if time.Since(renewed) >= HA_LEASE_TTL*2/3 {
+					log.Fatalf("Leadership lost: the lease %q could not be renewed", HA_LEASE)
+				}
+			}
+		}
+	}()
+}
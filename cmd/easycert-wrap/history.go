@@ -0,0 +1,202 @@
+// Copyright 2014 Jonas mg
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/tredoe/easycert"
+)
+
+// DIR_HISTORY is the directory, into the directories of certificates and
+// private keys, where the previous versions are kept like "NAME@1", "NAME@2", ...
+const DIR_HISTORY = "history"
+
+// DEFAULT_HISTORY is the number of previous versions of every certificate kept
+// when it is not configured.
+const DEFAULT_HISTORY = 3
+
+var (
+	IsReissue = flag.Bool("reissue", false, "keep the current certificate like a previous version")
+	IsHistory = flag.Bool("history", false, "list the versions of a certificate")
+	Version   = flag.Int("version", 0, "number of a previous version")
+)
+
+// versionName returns the name of the version `n` of the certificate.
+func versionName(name string, n int) string { return name + "@" + strconv.Itoa(n) }
+
+// certName returns the name of the certificate set by "setCertPath".
+func certName() string { return strings.TrimSuffix(filepath.Base(File.Cert), EXT_CERT) }
+
+// versionCert returns the path of the version `n` of the certificate.
+func versionCert(name string, n int) string {
+	return filepath.Join(Dir.Cert, DIR_HISTORY, versionName(name, n)+EXT_CERT)
+}
+
+// versionKey returns the path of the private key of the version `n`.
+func versionKey(name string, n int) string {
+	return filepath.Join(Dir.Key, DIR_HISTORY, versionName(name, n)+EXT_KEY)
+}
+
+// versions returns the numbers of the previous versions of the certificate,
+// from the oldest.
+func versions(name string) ([]int, error) {
+	match, err := filepath.Glob(filepath.Join(Dir.Cert, DIR_HISTORY, name+"@*"+EXT_CERT))
+	if err != nil {
+		return nil, err
+	}
+
+	list := make([]int, 0, len(match))
+	for _, v := range match {
+		v = strings.TrimSuffix(filepath.Base(v), EXT_CERT)
+		n, err := strconv.Atoi(v[len(name)+1:])
+		if err != nil || n <= 0 {
+			continue
+		}
+		list = append(list, n)
+	}
+	sort.Ints(list)
+	return list, nil
+}
+
+// archiveVersion keeps the current certificate of `name` like its last previous
+// version; with `withKey`, its private key too, since a new one is generated.
+// The files are moved back whether the issuance in progress is rolled back.
+func archiveVersion(name string, withKey bool) error {
+	cert := filepath.Join(Dir.Cert, name+EXT_CERT)
+	if _, err := os.Stat(cert); os.IsNotExist(err) {
+		return nil
+	}
+
+	// The new certificate has the same subject than the versions kept.
+	if err := curIssuance.saveDatabase(); err != nil {
+		return err
+	}
+	if err := allowSameSubject(); err != nil {
+		return err
+	}
+
+	list, err := versions(name)
+	if err != nil {
+		return err
+	}
+	n := 1
+	if len(list) != 0 {
+		n = list[len(list)-1] + 1
+	}
+
+	moves := [][2]string{{cert, versionCert(name, n)}}
+	if key := filepath.Join(Dir.Key, name+EXT_KEY); withKey {
+		if _, err = os.Stat(key); err == nil {
+			moves = append(moves, [2]string{key, versionKey(name, n)})
+		}
+	}
+
+	for _, v := range moves {
+		dir := filepath.Dir(v[1])
+		if _, err = os.Stat(dir); os.IsNotExist(err) {
+			perm := os.FileMode(0755)
+			if strings.HasPrefix(dir, Dir.Key) {
+				perm = 0700
+			}
+			if err = os.Mkdir(dir, perm); err != nil {
+				return err
+			}
+		}
+
+		if err = os.Rename(v[0], v[1]); err != nil {
+			return err
+		}
+		curIssuance.addRename(v[0], v[1])
+		if err = syncDir(dir); err != nil {
+			return err
+		}
+	}
+
+	fmt.Printf("* Previous version kept: %s\n", versionName(name, n))
+	return nil
+}
+
+// allowSameSubject sets the database of the CA to allow several valid
+// certificates with the same subject, like the reissued one and the previous
+// versions.
+func allowSameSubject() error {
+	file := File.Index + ".attr"
+
+	data, err := os.ReadFile(file)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if strings.Contains(string(data), "unique_subject = no") {
+		return nil
+	}
+	return writeFileAtomic(file, []byte("unique_subject = no\n"), 0644)
+}
+
+// pruneVersions removes the oldest versions of the certificate beyond the
+// number configured in the field "history" of the store.
+func pruneVersions(name string) {
+	keep := loadStoreConfig().History
+	if keep == 0 {
+		keep = DEFAULT_HISTORY
+	}
+
+	list, err := versions(name)
+	if err != nil {
+		log.Print(err)
+		return
+	}
+	for len(list) > keep {
+		for _, file := range []string{versionCert(name, list[0]), versionKey(name, list[0])} {
+			if err = os.Remove(file); err != nil && !os.IsNotExist(err) {
+				log.Print(err)
+			}
+		}
+		list = list[1:]
+	}
+}
+
+// printHistory prints the current and previous versions of the certificate,
+// with their serial number and expiration.
+func printHistory(name string) {
+	list, err := versions(name)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	files := []string{filepath.Join(Dir.Cert, name+EXT_CERT)}
+	names := []string{name}
+	for i := len(list) - 1; i >= 0; i-- {
+		files = append(files, versionCert(name, list[i]))
+		names = append(names, versionName(name, list[i]))
+	}
+
+	found := false
+	for i, file := range files {
+		cert, err := parseCertFile(file)
+		if err != nil {
+			if !os.IsNotExist(err) {
+				log.Printf("%s: %s", file, err)
+			}
+			continue
+		}
+		found = true
+		fmt.Printf("%s\t%s\t%s\n", names[i], easycert.SerialHex(cert.SerialNumber),
+			cert.NotAfter.UTC().Format(time.RFC3339))
+	}
+	if !found {
+		log.Fatalf("Certificate not found: %q", name)
+	}
+}
@@ -0,0 +1,99 @@
+// Copyright 2014 Jonas mg
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// Hooks run around the signing of a certificate request. They are executable
+// files placed in the hooks directory, like in Git.
+const (
+	// Run before of signing; an exit status non-zero aborts the signing.
+	HOOK_PRE_SIGN = "pre-sign"
+
+	// Run after of issuing the certificate, i.e. to deploy it.
+	HOOK_POST_SIGN = "post-sign"
+
+	// Run to publish and remove the TXT records of the challenges DNS-01 of
+	// "acme".
+	HOOK_ACME_DNS = "acme-dns"
+)
+
+// runHook runs the hook `name` whether it exists in the hooks directory,
+// passing it the metadata of the certificate in environment variables
+// prefixed by "EASYCERT_".
+func runHook(name string, meta map[string]string) error {
+	file := filepath.Join(Dir.Hook, name)
+
+	info, err := os.Stat(file)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if info.Mode()&0111 == 0 {
+		return fmt.Errorf("hook %q is not executable", file)
+	}
+
+	env := os.Environ()
+	for k, v := range meta {
+		env = append(env, "EASYCERT_"+k+"="+v)
+	}
+
+	cmd := exec.Command(file)
+	cmd.Env = env
+	cmd.Dir = Dir.Root
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+
+	if err = cmd.Run(); err != nil {
+		return fmt.Errorf("hook %q failed: %s", name, err)
+	}
+	return nil
+}
+
+// hookMeta returns the metadata of the certificate being signed, to pass it
+// to the hooks.
+func hookMeta() map[string]string {
+	meta := map[string]string{
+		"NAME":    certName(),
+		"ROOT":    Dir.Root,
+		"CERT":    File.Cert,
+		"KEY":     File.Key,
+		"REQUEST": File.Request,
+	}
+
+	if nativeBackend() {
+		nativeHookMeta(meta)
+		return meta
+	}
+	// The metadata which can not be got is left out, since it is called from
+	// the servers too.
+	if _, err := os.Stat(File.Request); err == nil {
+		if out, err := opensslNoFatal("req", "-subject", "-noout", "-in", File.Request); err == nil {
+			meta["SUBJECT"] = strings.TrimSpace(strings.TrimPrefix(string(out), "subject="))
+		}
+	}
+	if _, err := os.Stat(File.Cert); err == nil {
+		out, _ := opensslNoFatal("x509", "-serial", "-enddate", "-noout", "-in", File.Cert)
+
+		for _, line := range strings.Split(string(out), "\n") {
+			if v := strings.TrimPrefix(line, "serial="); v != line {
+				meta["SERIAL"] = v
+			} else if v := strings.TrimPrefix(line, "notAfter="); v != line {
+				meta["END_DATE"] = v
+			}
+		}
+	}
+	return meta
+}
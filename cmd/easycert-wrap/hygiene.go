@@ -0,0 +1,64 @@
+// Copyright 2014 Jonas mg
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+// Handling of the key material.
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+// ENV_DEBUG is the environment variable to print the commands executed, with
+// the secrets redacted.
+const ENV_DEBUG = "EASYCERT_DEBUG"
+
+// zero overwrites the bytes, to not keep key material in memory after of its
+// use. The strings can not be overwritten, so the copies of the key material
+// converted to string (i.e. to be written by a template) are not wiped.
+func zero(b []byte) {
+	for i := range b {
+		b[i] = 0
+	}
+}
+
+// createKeyFile creates an empty temporary file only accessible by the owner,
+// where a private key is going to be written, so the key is never readable by
+// other users, even for a moment. It fails whether the file already exists.
+//
+// The temporary file is renamed to `file` using commitFile.
+func createKeyFile(file string) string {
+	if _, err := os.Stat(file); !os.IsNotExist(err) {
+		fatalf("Private key already exists: %q", file)
+	}
+	return mustTempFile(file)
+}
+
+// debugCmd prints the command to execute whether the debug mode is set.
+func debugCmd(name string, args []string) {
+	if os.Getenv(ENV_DEBUG) == "" {
+		return
+	}
+	fmt.Fprintf(os.Stderr, "DEBUG: %s %s\n", name, strings.Join(redactArgs(args), " "))
+}
+
+// redactArgs returns the arguments hiding the passwords given in the command
+// line (i.e. "-passin pass:secret").
+func redactArgs(args []string) []string {
+	out := make([]string, len(args))
+
+	for i, v := range args {
+		if strings.HasPrefix(v, "pass:") {
+			v = "pass:[REDACTED]"
+		} else if strings.Contains(v, "PRIVATE KEY") {
+			v = "[REDACTED]"
+		}
+		out[i] = v
+	}
+	return out
+}
@@ -0,0 +1,140 @@
+// Copyright 2014 Jonas mg
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"fmt"
+	"math/big"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/tredoe/easycert"
+)
+
+// Status of the certificates in the database of OpenSSL.
+const (
+	INDEX_VALID   = "V"
+	INDEX_REVOKED = "R"
+	INDEX_EXPIRED = "E"
+)
+
+// INDEX_TIME is the format of the dates in the database of OpenSSL.
+const INDEX_TIME = "060102150405Z"
+
+// indexEntry is a line of the database of OpenSSL, where the fields are
+// separated by tabs.
+type indexEntry struct {
+	Status     string
+	Expiry     string
+	Revocation string // Date and reason, separated by commas.
+	Serial     string // In hexadecimal.
+	File       string // Always "unknown".
+	Subject    string
+}
+
+// readIndex returns the entries of the database of OpenSSL.
+func readIndex() ([]*indexEntry, error) {
+	// In an issuance, the files have the changes not stored yet.
+	if curIssuance == nil || curIssuance.db == nil {
+		st, err := loadDatabase()
+		if err != nil {
+			return nil, err
+		}
+		if st != nil {
+			return st.Entries, nil
+		}
+	}
+	return readIndexFile()
+}
+
+// readIndexFile returns the entries of the file of the database of OpenSSL.
+func readIndexFile() ([]*indexEntry, error) {
+	data, err := os.ReadFile(File.Index)
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []*indexEntry
+	for i, line := range strings.Split(string(data), "\n") {
+		if line == "" {
+			continue
+		}
+		field := strings.SplitN(line, "\t", 6)
+		if len(field) != 6 {
+			return nil, fmt.Errorf("%s:%d: wrong number of fields", File.Index, i+1)
+		}
+		entries = append(entries, &indexEntry{
+			field[0], field[1], field[2], field[3], field[4], field[5],
+		})
+	}
+	return entries, nil
+}
+
+// writeIndex writes the entries to the database of OpenSSL.
+func writeIndex(entries []*indexEntry) error {
+	return writeFileAtomic(File.Index, formatIndex(entries), 0644)
+}
+
+// formatIndex returns the entries in the format of the database of OpenSSL.
+func formatIndex(entries []*indexEntry) []byte {
+	var b strings.Builder
+
+	for _, v := range entries {
+		b.WriteString(v.line())
+		b.WriteByte('\n')
+	}
+	return []byte(b.String())
+}
+
+// line returns the entry like a line of the database of OpenSSL.
+func (e *indexEntry) line() string {
+	return strings.Join([]string{e.Status, e.Expiry, e.Revocation, e.Serial, e.File, e.Subject}, "\t")
+}
+
+// findIndex returns the entry with the serial number, or nil.
+func findIndex(entries []*indexEntry, serial *big.Int) *indexEntry {
+	hex := easycert.SerialHex(serial)
+
+	for _, v := range entries {
+		if strings.EqualFold(v.Serial, hex) {
+			return v
+		}
+	}
+	return nil
+}
+
+// revoke marks the entry like revoked at the time, with the reason.
+func (e *indexEntry) revoke(t time.Time, reason string) {
+	if reason == REASON_HOLD {
+		reason += "," + HOLD_INSTRUCTION
+	}
+	e.Status = INDEX_REVOKED
+	e.Revocation = t.UTC().Format(INDEX_TIME) + "," + reason
+}
+
+// expiry returns the time of expiration of the certificate.
+func (e *indexEntry) expiry() (time.Time, error) {
+	layout := INDEX_TIME
+	if len(e.Expiry) == len(INDEX_TIME)+2 {
+		layout = "20" + INDEX_TIME // GeneralizedTime, since 2050
+	}
+	t, err := time.Parse(layout, e.Expiry)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("%s: serial %s: wrong expiration: %q", File.Index, e.Serial, e.Expiry)
+	}
+	return t, nil
+}
+
+// reason returns the reason of the revocation, if any.
+func (e *indexEntry) reason() string {
+	field := strings.Split(e.Revocation, ",")
+	if len(field) < 2 {
+		return ""
+	}
+	return field[1]
+}
@@ -0,0 +1,276 @@
+// Copyright 2014 Jonas mg
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+// Intermediate CAs, subordinated to the root CA or to another intermediate CA.
+// Every one has the layout of the certificates directory (certificate, private
+// key and database) into its own directory, so OpenSSL handles it like the root
+// CA.
+
+package main
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/pem"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// DIR_INTERMEDIATE is the directory, into the certificates directory, where
+// the intermediate CAs are placed.
+const DIR_INTERMEDIATE = "intermediates"
+
+// EXT_FULLCHAIN is the extension of the file with the certificate followed by
+// its intermediate CAs, for the servers.
+const EXT_FULLCHAIN = ".fullchain.pem"
+
+var (
+	Intermediate = flag.String("intermediate", "", "name of the intermediate CA to create")
+	Parent       = flag.String("parent", NAME_CA, "name of the CA which signs the intermediate CA")
+)
+
+// issuerCA is the name of the CA which issues the certificates, set by useCA.
+var issuerCA = NAME_CA
+
+// intermediateDir returns the directory of the intermediate CA `name`.
+func intermediateDir(name string) string {
+	return filepath.Join(Dir.Root, DIR_INTERMEDIATE, name)
+}
+
+// caRoot returns the directory with the database of the CA `name`.
+func caRoot(name string) string {
+	if name == NAME_CA {
+		return Dir.Root
+	}
+	return intermediateDir(name)
+}
+
+// useCA sets the database of the CA `name`, the root CA or an intermediate
+// one, to issue the certificates. It exits whether the CA does not exist.
+func useCA(name string) {
+	if name != NAME_CA && !validName.MatchString(name) {
+		fatalf("Invalid name of CA: %q", name)
+	}
+	root := caRoot(name)
+	if _, err := os.Stat(filepath.Join(root, "certs", NAME_CA+EXT_CERT)); err != nil {
+		if os.IsNotExist(err) {
+			fatalf("Certification authority not found: %q", name)
+		}
+		fatal(err)
+	}
+	if name != NAME_CA && nativeBackend() {
+		fatal("The native backend does not support the intermediate CAs")
+	}
+
+	issuerCA = name
+	Dir.NewCert = filepath.Join(root, "newcerts")
+	File.Index = filepath.Join(root, "index.txt")
+	File.Serial = filepath.Join(root, "serial")
+	File.CRLNumber = filepath.Join(root, "crlnumber")
+	File.CRL = filepath.Join(root, "crl", NAME_CA+EXT_REVOK)
+}
+
+// mustCAConfig is like mustResolveConfig, but the paths of the CA in the
+// configuration are changed to the ones of the CA set by useCA.
+func mustCAConfig(file string) (string, func()) {
+	config, done := mustResolveConfig(file)
+	if issuerCA == NAME_CA {
+		return config, done
+	}
+	defer done()
+
+	data, err := os.ReadFile(config)
+	if err != nil {
+		fatal(err)
+	}
+	data = bytes.ReplaceAll(data, []byte(Dir.Root+"/"), []byte(intermediateDir(issuerCA)+"/"))
+
+	tmp := mustTempFile(file)
+	if err = os.WriteFile(tmp, data, 0600); err != nil {
+		fatal(err)
+	}
+	return tmp, func() { os.Remove(tmp) }
+}
+
+// CreateIntermediate creates the intermediate CA `name`, signed by the CA
+// `parent`.
+func CreateIntermediate(name, parent string) {
+	operator := mustRole(ACTION_CA)
+	fipsCheckKeySpec(&KeySpec)
+
+	if !validName.MatchString(name) || name == NAME_CA {
+		fatalf("Invalid name of intermediate CA: %q", name)
+	}
+	root := intermediateDir(name)
+	if _, err := os.Stat(root); !os.IsNotExist(err) {
+		fatalf("The intermediate CA exists: %q", root)
+	}
+	useCA(parent)
+	if loadKMS() != "" {
+		fatal("The root CA with the private key in a KMS can not sign intermediate CAs")
+	}
+
+	tx := beginIssuance()
+	if err := tx.saveDatabase(); err != nil {
+		fatal(err)
+	}
+
+	// New directories and files, with the layout of the certificates
+	// directory.
+
+	if err := os.MkdirAll(filepath.Dir(root), 0755); err != nil {
+		fatal(err)
+	}
+	for _, v := range []string{root, "certs", "private", "newcerts", "crl"} {
+		if v != root {
+			v = filepath.Join(root, v)
+		}
+		if err := os.Mkdir(v, 0755); err != nil {
+			fatal(err)
+		}
+		tx.addFile(v)
+	}
+	if err := os.Chmod(filepath.Join(root, "private"), 0700); err != nil {
+		fatal(err)
+	}
+	for _, v := range []struct {
+		file string
+		data []byte
+	}{
+		{"index.txt", nil},
+		{"serial", []byte{'0', '1', '\n'}},
+		{"crlnumber", []byte{'0', '1', '\n'}},
+	} {
+		file := filepath.Join(root, v.file)
+		if err := writeFileAtomic(file, v.data, 0644); err != nil {
+			fatal(err)
+		}
+		tx.addFile(file)
+	}
+
+	keyFile := createKeyFile(filepath.Join(root, "private", NAME_CA+EXT_KEY))
+	certFile := filepath.Join(root, "certs", NAME_CA+EXT_CERT)
+	tmpCert := mustTempFile(certFile)
+	reqFile := filepath.Join(root, NAME_CA+EXT_REQUEST)
+	tx.addFile(reqFile)
+
+	fmt.Print("\n== Build Intermediate Certification Authority\n\n")
+
+	reqConfig, reqDone := mustResolveConfig(File.Config)
+	defer reqDone()
+
+	genEncryptedKey(keyFile, caPassArgs("-pass"))
+
+	opensslArgs := []string{"req", "-new",
+		"-config", reqConfig, "-out", reqFile, "-key", keyFile,
+	}
+	opensslArgs = append(opensslArgs, fipsDigestArgs("req")...)
+	if batchMode() {
+		opensslArgs = append(opensslArgs, "-batch",
+			"-subj", batchSubject(strings.TrimSpace(Subject.Organization+" "+name+" CA"), ""))
+	}
+	opensslArgs = append(opensslArgs, caPassArgs("-passin")...)
+	fmt.Printf("%s", openssl(opensslArgs...))
+
+	fmt.Printf("\n== Sign by %q\n\n", parent)
+
+	config, done := mustCAConfig(File.Config)
+	defer done()
+
+	opensslArgs = []string{"ca", "-batch", "-policy", "policy_anything",
+		"-config", config, "-in", reqFile, "-out", tmpCert,
+		"-days", strconv.Itoa(365 * *Years),
+		"-extensions", "v3_ca",
+	}
+	opensslArgs = append(opensslArgs, fipsDigestArgs("ca")...)
+	opensslArgs = append(opensslArgs, caKeyArgs("-keyfile", "")...)
+	fmt.Printf("%s", openssl(opensslArgs...))
+
+	if info, err := os.Stat(tmpCert); err != nil || info.Size() == 0 {
+		fatal("Certificate not signed")
+	}
+	mustCommitFile(keyFile, filepath.Join(root, "private", NAME_CA+EXT_KEY), 0400)
+	mustCommitFile(tmpCert, certFile, 0644)
+	if err := syncDatabase(); err != nil {
+		fatal(err)
+	}
+
+	// Like issuer in the chains directory, to build the chains of the
+	// certificates issued by it.
+	cert, err := parseCertFile(certFile)
+	if err != nil {
+		fatal(err)
+	}
+	issuer, err := storeIssuer(cert, loadCerts())
+	if err != nil {
+		fatal(err)
+	}
+	commitIssuance()
+
+	if err = os.Remove(reqFile); err != nil && !os.IsNotExist(err) {
+		log.Print(err)
+	}
+
+	fmt.Printf("\n== Generated\n- Certificate:\t%q\n- Private key:\t%q\n",
+		certFile, filepath.Join(root, "private", NAME_CA+EXT_KEY))
+	if issuer != "" {
+		fmt.Printf("- Issuer:\t%q\n", issuer)
+	}
+	audit(operator, ACTION_CA, name, "parent "+parent)
+}
+
+// writeFullChain writes the certificate followed by the chain of its
+// intermediate CAs, without the root CA. It returns the path of the file, or
+// an empty string whether the certificate was issued by the root CA.
+func writeFullChain(cert *x509.Certificate, name string) (string, error) {
+	data := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})
+	n := 0
+	for _, v := range chainOf(cert, chainCerts()) {
+		if bytes.Equal(v.Cert.RawIssuer, v.Cert.RawSubject) {
+			break
+		}
+		data = append(data, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: v.Cert.Raw})...)
+		n++
+	}
+	if n == 0 {
+		return "", nil
+	}
+
+	file := filepath.Join(Dir.Cert, name+EXT_FULLCHAIN)
+	if err := writeFileAtomic(file, data, 0644); err != nil {
+		return "", err
+	}
+	return file, nil
+}
+
+// loadIntermediates returns the certificates of the intermediate CAs, named by
+// their names.
+func loadIntermediates() []*storeCert {
+	match, err := filepath.Glob(filepath.Join(Dir.Root, DIR_INTERMEDIATE, "*", "certs", NAME_CA+EXT_CERT))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	certs := make([]*storeCert, 0, len(match))
+	for _, v := range match {
+		cert, err := parseCertFile(v)
+		if err != nil {
+			log.Printf("%s: %s", v, err)
+			continue
+		}
+		certs = append(certs, &storeCert{
+			Name: filepath.Base(filepath.Dir(filepath.Dir(v))),
+			File: v,
+			Cert: cert,
+		})
+	}
+	return certs
+}
@@ -0,0 +1,279 @@
+// Copyright 2014 Jonas mg
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+// Issue in GitHub or GitLab listing the certificates to renew, for the teams
+// which track the operations work like issues.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// ENV_ISSUE_TOKEN is the environment variable with the token of the API of
+// GitHub or GitLab, to manage the issue.
+const ENV_ISSUE_TOKEN = "EASYCERT_ISSUE_TOKEN"
+
+// Providers of issues.
+const (
+	ISSUE_GITHUB = "github"
+	ISSUE_GITLAB = "gitlab"
+)
+
+const (
+	DEFAULT_GITHUB_API  = "https://api.github.com"
+	DEFAULT_GITLAB_API  = "https://gitlab.com/api/v4"
+	DEFAULT_ISSUE_LABEL = "easycert"
+
+	// Title of the issue; the open issue with this title and the label is
+	// updated instead of opening another one.
+	ISSUE_TITLE = "[easycert] Certificates to renew"
+)
+
+// IssueConfig represents the configuration of the issue of the certificates to
+// renew.
+type IssueConfig struct {
+	Provider string `json:"provider"`        // "github" or "gitlab"
+	Repo     string `json:"repo"`            // i.e. "owner/name" or "group/project"
+	URL      string `json:"url,omitempty"`   // API, for GitHub Enterprise or GitLab self-managed.
+	Label    string `json:"label,omitempty"` // Label to find the issue.
+}
+
+func (cfg *IssueConfig) check() error {
+	if cfg.Provider != ISSUE_GITHUB && cfg.Provider != ISSUE_GITLAB {
+		return fmt.Errorf("issue has to have the provider %q or %q", ISSUE_GITHUB, ISSUE_GITLAB)
+	}
+	if !strings.Contains(cfg.Repo, "/") {
+		return errors.New("issue needs the field repo, like \"owner/name\"")
+	}
+	return nil
+}
+
+func (cfg *IssueConfig) label() string {
+	if cfg.Label == "" {
+		return DEFAULT_ISSUE_LABEL
+	}
+	return cfg.Label
+}
+
+// issue represents an issue, with the fields of GitHub and GitLab.
+type issue struct {
+	Number      int    `json:"number"` // GitHub
+	IID         int    `json:"iid"`    // GitLab
+	Title       string `json:"title"`
+	Body        string `json:"body"`        // GitHub
+	Description string `json:"description"` // GitLab
+}
+
+// issueClient is the client of the API of issues of the repository.
+type issueClient struct {
+	cfg    *IssueConfig
+	base   string // URL of the issues of the repository.
+	token  string
+	client *http.Client
+}
+
+func newIssueClient(cfg *IssueConfig) (*issueClient, error) {
+	c := &issueClient{
+		cfg:    cfg,
+		token:  os.Getenv(ENV_ISSUE_TOKEN),
+		client: &http.Client{Timeout: 30 * time.Second},
+	}
+	if c.token == "" {
+		return nil, fmt.Errorf("the token of %s has to be set in %s", cfg.Provider, ENV_ISSUE_TOKEN)
+	}
+
+	api := strings.TrimSuffix(cfg.URL, "/")
+	if cfg.Provider == ISSUE_GITHUB {
+		if api == "" {
+			api = DEFAULT_GITHUB_API
+		}
+		c.base = api + "/repos/" + cfg.Repo + "/issues"
+	} else {
+		if api == "" {
+			api = DEFAULT_GITLAB_API
+		}
+		c.base = api + "/projects/" + url.PathEscape(cfg.Repo) + "/issues"
+	}
+	return c, nil
+}
+
+// do sends the request with the value `in` in JSON format, and decodes the
+// response into `out` whether it is not nil.
+func (c *issueClient) do(method, path string, in, out interface{}) error {
+	var body io.Reader
+	if in != nil {
+		data, err := json.Marshal(in)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(data)
+	}
+
+	req, err := http.NewRequest(method, c.base+path, body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", MIME_JSON)
+	if in != nil {
+		req.Header.Set("Content-Type", MIME_JSON)
+	}
+	if c.cfg.Provider == ISSUE_GITHUB {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	} else {
+		req.Header.Set("PRIVATE-TOKEN", c.token)
+	}
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("%s %s: %s", method, req.URL.Redacted(), resp.Status)
+	}
+	if out != nil {
+		return json.NewDecoder(resp.Body).Decode(out)
+	}
+	return nil
+}
+
+// find returns the open issue with the title and the label, or nil.
+func (c *issueClient) find() (*issue, error) {
+	state := "open"
+	if c.cfg.Provider == ISSUE_GITLAB {
+		state = "opened"
+	}
+	query := url.Values{
+		"state":    {state},
+		"labels":   {c.cfg.label()},
+		"per_page": {"100"},
+	}
+
+	var list []*issue
+	if err := c.do("GET", "?"+query.Encode(), nil, &list); err != nil {
+		return nil, err
+	}
+	for _, v := range list {
+		if v.Title == ISSUE_TITLE {
+			return v, nil
+		}
+	}
+	return nil, nil
+}
+
+func (c *issueClient) create(body string) error {
+	if c.cfg.Provider == ISSUE_GITHUB {
+		return c.do("POST", "", map[string]interface{}{
+			"title": ISSUE_TITLE, "body": body, "labels": []string{c.cfg.label()},
+		}, nil)
+	}
+	return c.do("POST", "", map[string]interface{}{
+		"title": ISSUE_TITLE, "description": body, "labels": c.cfg.label(),
+	}, nil)
+}
+
+func (c *issueClient) update(v *issue, body string) error {
+	if c.cfg.Provider == ISSUE_GITHUB {
+		return c.do("PATCH", fmt.Sprintf("/%d", v.Number), map[string]string{"body": body}, nil)
+	}
+	return c.do("PUT", fmt.Sprintf("/%d", v.IID), map[string]string{"description": body}, nil)
+}
+
+func (c *issueClient) close(v *issue) error {
+	if c.cfg.Provider == ISSUE_GITHUB {
+		return c.do("PATCH", fmt.Sprintf("/%d", v.Number), map[string]string{"state": "closed"}, nil)
+	}
+	return c.do("PUT", fmt.Sprintf("/%d", v.IID), map[string]string{"state_event": "close"}, nil)
+}
+
+// issueBody returns the description in Markdown of the certificates into
+// their renewal window, or an empty string whether there is none.
+func issueBody(days int) string {
+	var buf bytes.Buffer
+
+	now := time.Now()
+	limit := now.AddDate(0, 0, days)
+	for _, v := range loadCerts() {
+		if v.Cert.NotAfter.After(limit) {
+			continue
+		}
+		if buf.Len() == 0 {
+			fmt.Fprintf(&buf, "Certificates expiring in the next %d days, in `%s`:\n\n", days, Dir.Root)
+			buf.WriteString("| Name | Common name | Expiration | Status |\n")
+			buf.WriteString("|------|-------------|------------|--------|\n")
+		}
+
+		// Without the days left, so the issue is only updated on changes.
+		status := "expires"
+		if v.Cert.NotAfter.Before(now) {
+			status = "**EXPIRED**"
+		}
+		fmt.Fprintf(&buf, "| `%s` | %s | %s | %s |\n", v.Name, v.Cert.Subject.CommonName,
+			v.Cert.NotAfter.UTC().Format("2006-01-02"), status)
+	}
+
+	if buf.Len() != 0 {
+		buf.WriteString("\nThis issue is updated by `easycert notify`, and closed when there is nothing to renew.\n")
+	}
+	return buf.String()
+}
+
+// syncIssue opens or updates the issue with the certificates to renew, and
+// closes it when there is none.
+func syncIssue(cfg *IssueConfig, days int) error {
+	body := issueBody(days)
+	where := cfg.Provider + ":" + cfg.Repo
+
+	if *IsDryRun {
+		if body == "" {
+			fmt.Printf("* Issue in %s to close, whether it is open\n", where)
+		} else {
+			fmt.Printf("* Issue in %s to open or update:\n\n%s\n", where, body)
+		}
+		return nil
+	}
+
+	c, err := newIssueClient(cfg)
+	if err != nil {
+		return err
+	}
+	v, err := c.find()
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case v == nil && body == "":
+		return nil
+	case v == nil:
+		if err = c.create(body); err != nil {
+			return err
+		}
+		fmt.Printf("* Issue opened in %s\n", where)
+	case body == "":
+		if err = c.close(v); err != nil {
+			return err
+		}
+		fmt.Printf("* Issue closed in %s\n", where)
+	case body != v.Body+v.Description:
+		if err = c.update(v, body); err != nil {
+			return err
+		}
+		fmt.Printf("* Issue updated in %s\n", where)
+	}
+	return nil
+}
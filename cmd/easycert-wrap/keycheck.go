@@ -0,0 +1,231 @@
+// Copyright 2014 Jonas mg
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+// Checking of the strength of the keys.
+
+package main
+
+import (
+	"bufio"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// DIR_BLACKLIST is where the package "openssl-blacklist" of Debian places the
+// fingerprints of the RSA keys generated by the OpenSSL with a predictable
+// random generator (CVE-2008-0166), in files like "blacklist.RSA-2048".
+const DIR_BLACKLIST = "/usr/share/openssl-blacklist"
+
+// Minimum sizes in bits of the keys considered strong.
+const (
+	MIN_RSA_SIZE = 2048
+	MIN_EC_SIZE  = 256
+)
+
+var errKeyType = errors.New("unsupported type of key")
+
+// keyReport represents the properties of a key, and the weaknesses found.
+type keyReport struct {
+	File      string `json:"file"`
+	Type      string `json:"type"`
+	Size      int    `json:"size"`
+	Curve     string `json:"curve,omitempty"`
+	Exponent  int    `json:"exponent,omitempty"`
+	Encrypted bool   `json:"encrypted"`
+
+	ROCA bool `json:"roca"`
+	// Nil whether there is not a blacklist for the size of the key.
+	DebianWeak *bool `json:"debian_weak,omitempty"`
+
+	Problems []string `json:"problems,omitempty"`
+}
+
+// checkPrivateKey returns the report of the private key in PEM format. An
+// encrypted key is decrypted by OpenSSL, which gets the passphrase from the
+// environment variable ENV_CA_PASS whether it is set, else from the terminal.
+func checkPrivateKey(file string) (*keyReport, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil || !strings.HasSuffix(block.Type, "PRIVATE KEY") {
+		return nil, fmt.Errorf("no private key in PEM format: %q", file)
+	}
+
+	encrypted := isEncryptedKey(block)
+	if encrypted {
+		args := append([]string{"pkey", "-in", file}, caPassArgs("-passin")...)
+		data = openssl(args...)
+		defer zero(data)
+
+		if block, _ = pem.Decode(data); block == nil {
+			return nil, fmt.Errorf("no private key decrypted: %q", file)
+		}
+	}
+	defer zero(block.Bytes)
+
+	key, err := parsePrivateKey(block)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", file, err)
+	}
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("%s: %s", file, errKeyType)
+	}
+
+	r, err := checkPublicKey(signer.Public())
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", file, err)
+	}
+	r.File = file
+	r.Encrypted = encrypted
+
+	if k, ok := key.(*rsa.PrivateKey); ok {
+		if err = k.Validate(); err != nil {
+			r.Problems = append(r.Problems, "inconsistent RSA key: "+err.Error())
+		}
+	}
+	return r, nil
+}
+
+// isEncryptedKey reports whether the private key of the block is encrypted, in
+// PKCS#8 or in the legacy format of OpenSSL.
+func isEncryptedKey(block *pem.Block) bool {
+	return block.Type == "ENCRYPTED PRIVATE KEY" ||
+		strings.Contains(block.Headers["Proc-Type"], "ENCRYPTED")
+}
+
+// parsePrivateKey parses the private key of the block, in PKCS#1, SEC 1 or
+// PKCS#8 format.
+func parsePrivateKey(block *pem.Block) (crypto.PrivateKey, error) {
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		return x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "EC PRIVATE KEY":
+		return x509.ParseECPrivateKey(block.Bytes)
+	case "PRIVATE KEY":
+		return x509.ParsePKCS8PrivateKey(block.Bytes)
+	}
+	return nil, errKeyType
+}
+
+// checkPublicKey returns the report of the public key.
+func checkPublicKey(pub crypto.PublicKey) (*keyReport, error) {
+	r := new(keyReport)
+
+	switch k := pub.(type) {
+	case *rsa.PublicKey:
+		r.Type = "RSA"
+		r.Size = k.N.BitLen()
+		r.Exponent = k.E
+
+		if r.Size < MIN_RSA_SIZE {
+			r.Problems = append(r.Problems, fmt.Sprintf("RSA key smaller than %d bits", MIN_RSA_SIZE))
+		}
+		if k.E%2 == 0 || k.E < 3 {
+			r.Problems = append(r.Problems, fmt.Sprintf("invalid public exponent: %d", k.E))
+		} else if k.E < 65537 {
+			r.Problems = append(r.Problems, fmt.Sprintf("public exponent too small: %d", k.E))
+		}
+
+		if r.ROCA = isROCA(k.N); r.ROCA {
+			r.Problems = append(r.Problems, "key vulnerable to ROCA (CVE-2017-15361)")
+		}
+		if weak, ok := isDebianWeak(k.N); ok {
+			r.DebianWeak = &weak
+			if weak {
+				r.Problems = append(r.Problems, "key generated by the weak OpenSSL of Debian (CVE-2008-0166)")
+			}
+		}
+
+	case *ecdsa.PublicKey:
+		r.Type = "ECDSA"
+		r.Size = k.Curve.Params().BitSize
+		r.Curve = k.Curve.Params().Name
+
+		if r.Size < MIN_EC_SIZE {
+			r.Problems = append(r.Problems, fmt.Sprintf("elliptic curve smaller than %d bits", MIN_EC_SIZE))
+		}
+
+	case ed25519.PublicKey:
+		r.Type = "Ed25519"
+		r.Size = 256
+		r.Curve = "Ed25519"
+
+	default:
+		return nil, errKeyType
+	}
+	return r, nil
+}
+
+// rocaPrimes are the small primes used to look for the structure of the moduli
+// generated by the Infineon library vulnerable to ROCA.
+var rocaPrimes = []int64{
+	3, 5, 7, 11, 13, 17, 19, 23, 29, 31, 37, 41, 43, 47, 53, 59, 61, 67, 71, 73,
+	79, 83, 89, 97, 101, 103, 107, 109, 113, 127, 131, 137, 139, 149, 151, 157,
+	163, 167,
+}
+
+// isROCA reports whether the modulus has the fingerprint of the keys
+// vulnerable to ROCA: it is a power of 65537 modulo every prime of rocaPrimes.
+func isROCA(n *big.Int) bool {
+	var m big.Int
+
+	for _, p := range rocaPrimes {
+		r := m.Mod(n, big.NewInt(p)).Int64()
+
+		found := false
+		for g, x := 65537%p, int64(1); ; {
+			if x == r {
+				found = true
+				break
+			}
+			if x = x * g % p; x == 1 {
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// isDebianWeak reports whether the modulus is in the blacklist of Debian. It
+// returns ok false whether there is not a blacklist for its size.
+func isDebianWeak(n *big.Int) (weak, ok bool) {
+	f, err := os.Open(filepath.Join(DIR_BLACKLIST, fmt.Sprintf("blacklist.RSA-%d", n.BitLen())))
+	if err != nil {
+		return false, false
+	}
+	defer f.Close()
+
+	// The fingerprint is the last 80 bits of the SHA-1 of the output of
+	// "openssl rsa -noout -modulus".
+	sum := sha1.Sum([]byte(fmt.Sprintf("Modulus=%X\n", n)))
+	fingerprint := hex.EncodeToString(sum[:])[20:]
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if strings.TrimSpace(scanner.Text()) == fingerprint {
+			return true, true
+		}
+	}
+	return false, scanner.Err() == nil
+}
@@ -0,0 +1,98 @@
+// Copyright 2014 Jonas mg
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+// Passphrases of the private keys, got from the source given in "-passin" like
+// the argument of OpenSSL, or else prompted. The keys are encrypted in PKCS#8
+// with AES-256, since "openssl req" encrypts them in Triple DES.
+
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+)
+
+var (
+	PassIn       = flag.String("passin", "", "source of the passphrase of the private key: env:VAR or file:PATH")
+	IsEncryptKey = flag.Bool("encrypt-key", false, "encrypt the private key in AES-256 with a passphrase")
+)
+
+// reqPassIn is the source of the passphrase of the private key of the request
+// in "req" and "renew", where "-passin" is not the one of the CA.
+var reqPassIn string
+
+// checkPassIn checks the source of a passphrase. The passphrase itself
+// ("pass:") is not accepted, since it would be seen in the list of processes.
+func checkPassIn(src string) error {
+	kind, value, _ := strings.Cut(src, ":")
+	if (kind != "env" && kind != "file") || value == "" {
+		return fmt.Errorf("Invalid source of passphrase: %q; it has to be env:VAR or file:PATH", src)
+	}
+	return nil
+}
+
+// readPassIn returns the passphrase of the source: the value of the
+// environment variable, or the first line of the file, like OpenSSL.
+func readPassIn(src string) (string, error) {
+	if err := checkPassIn(src); err != nil {
+		return "", err
+	}
+	kind, value, _ := strings.Cut(src, ":")
+
+	var pass string
+	if kind == "env" {
+		pass = os.Getenv(value)
+	} else {
+		data, err := os.ReadFile(value)
+		if err != nil {
+			return "", err
+		}
+		pass, _, _ = strings.Cut(string(data), "\n")
+		pass = strings.TrimSuffix(pass, "\r")
+	}
+	if pass == "" {
+		return "", fmt.Errorf("empty passphrase in %s", src)
+	}
+	return pass, nil
+}
+
+// keyPassArgs returns the OpenSSL's option `opt` to get the passphrase of the
+// private key of the request from its source. In batch mode, it exits whether
+// it is not set, instead of prompting.
+func keyPassArgs(opt string) []string {
+	if reqPassIn == "" {
+		if batchMode() {
+			fatal("Batch mode: the source of the passphrase of the private key has to be set in -passin")
+		}
+		return nil
+	}
+	if err := checkPassIn(reqPassIn); err != nil {
+		fatal(err)
+	}
+	return []string{opt, reqPassIn}
+}
+
+// reqKeyPass returns the passphrase to encrypt the private key of the request
+// in Go; it is empty whether the key is not encrypted.
+func reqKeyPass() (string, error) {
+	if !*IsEncryptKey {
+		return "", nil
+	}
+	if reqPassIn == "" {
+		return "", errors.New("the native backend needs the source of the passphrase of the private key in -passin")
+	}
+	return readPassIn(reqPassIn)
+}
+
+// genEncryptedKey generates the private key into `keyFile`, encrypted in
+// AES-256 with the passphrase given by the options `pass`, or else prompted.
+func genEncryptedKey(keyFile string, pass []string) {
+	args := append([]string{"genpkey", "-aes-256-cbc", "-out", keyFile}, KeySpec.genpkeyArgs()...)
+	fmt.Printf("%s", opensslProgress(keygenMessage(), append(args, pass...)...))
+}
@@ -0,0 +1,384 @@
+// Copyright 2014 Jonas mg
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+// Private key of the root CA in a cloud KMS: AWS KMS, GCP Cloud KMS or Azure Key
+// Vault. The certificates are signed in Go, like by the native backend, and the
+// digests are signed by the KMS with the credentials of its command line tool.
+
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Schemes of the URIs of the keys in a KMS.
+const (
+	KMS_AWS   = "awskms"
+	KMS_GCP   = "gcpkms"
+	KMS_AZURE = "azurekms"
+)
+
+// Command line tools of the KMS, which have the credentials.
+const (
+	CMD_AWS    = "aws"
+	CMD_GCLOUD = "gcloud"
+	CMD_AZ     = "az"
+)
+
+// EXT_KMS is the extension of the file with the URI of the CA's private key,
+// stored in the private directory in place of the key.
+const EXT_KMS = ".kms"
+
+// AZURE_KMS_API is the version of the API of Azure Key Vault.
+const AZURE_KMS_API = "7.4"
+
+var KMSURI = flag.String("kms-uri", "", "URI of the CA's private key in a cloud KMS")
+
+// Endpoints of the APIs of the KMS.
+var (
+	gcpKMSEndpoint = "https://cloudkms.googleapis.com/v1/"
+	azureKMSScheme = "https"
+)
+
+var (
+	// validGCPKey matches the name of a version of a key of Cloud KMS.
+	validGCPKey = regexp.MustCompile(`^projects/[^/]+/locations/[^/]+/keyRings/[^/]+/cryptoKeys/[^/]+/cryptoKeyVersions/[0-9]+$`)
+
+	// validAzureKey matches the vault and the path of a version of a key of
+	// Key Vault.
+	validAzureKey = regexp.MustCompile(`^[A-Za-z0-9-]+\.vault\.azure\.net/keys/[A-Za-z0-9-]+/[A-Za-z0-9]+$`)
+)
+
+// kmsSigner signs with a private key in a KMS.
+type kmsSigner struct {
+	scheme string
+	region string // AWS
+	key    string // key ID of AWS, name of GCP or vault and path of Azure
+	pub    crypto.PublicKey
+}
+
+// kmsFile returns the file with the URI of the CA's private key.
+func kmsFile() string {
+	return filepath.Join(Dir.Key, NAME_CA+EXT_KMS)
+}
+
+// loadKMS returns the URI of the private key of the CA in use: the one given in
+// "-kms-uri", or the one of the root CA created with it. It is empty whether
+// the key is not in a KMS.
+func loadKMS() string {
+	if issuerCA != NAME_CA {
+		return ""
+	}
+	if *KMSURI != "" {
+		return *KMSURI
+	}
+	data, err := os.ReadFile(kmsFile())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return ""
+		}
+		fatal(err)
+	}
+	return strings.TrimSpace(string(data))
+}
+
+// parseKMSURI parses the URI of a key:
+//
+//	awskms:///KEY-ID, awskms://REGION/KEY-ID
+//	gcpkms://projects/P/locations/L/keyRings/R/cryptoKeys/K/cryptoKeyVersions/V
+//	azurekms://VAULT.vault.azure.net/keys/NAME/VERSION
+func parseKMSURI(uri string) (*kmsSigner, error) {
+	scheme, rest, ok := strings.Cut(uri, "://")
+	if !ok {
+		return nil, fmt.Errorf("invalid URI of KMS: %q", uri)
+	}
+	s := &kmsSigner{scheme: scheme}
+
+	switch scheme {
+	case KMS_AWS:
+		s.region, s.key, _ = strings.Cut(rest, "/")
+		if s.key == "" {
+			return nil, fmt.Errorf("URI of AWS KMS without key ID: %q", uri)
+		}
+	case KMS_GCP:
+		if !validGCPKey.MatchString(rest) {
+			return nil, fmt.Errorf("URI of Cloud KMS without the name of the version of the key: %q", uri)
+		}
+		s.key = rest
+	case KMS_AZURE:
+		if !validAzureKey.MatchString(rest) {
+			return nil, fmt.Errorf("URI of Key Vault without the vault, name and version of the key: %q", uri)
+		}
+		s.key = rest
+	default:
+		return nil, fmt.Errorf("unknown KMS %q: it has to be %s, %s or %s", scheme, KMS_AWS, KMS_GCP, KMS_AZURE)
+	}
+	return s, nil
+}
+
+// newKMSSigner returns the signer of the key in the KMS, with its public key.
+func newKMSSigner(uri string) (*kmsSigner, error) {
+	s, err := parseKMSURI(uri)
+	if err != nil {
+		return nil, err
+	}
+
+	switch s.scheme {
+	case KMS_AWS:
+		out, err := kmsCmd(CMD_AWS, s.awsArgs("get-public-key", "--query", "PublicKey")...)
+		if err != nil {
+			return nil, err
+		}
+		der, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(out)))
+		if err != nil {
+			return nil, fmt.Errorf("%s: public key: %s", uri, err)
+		}
+		if s.pub, err = x509.ParsePKIXPublicKey(der); err != nil {
+			return nil, fmt.Errorf("%s: public key: %s", uri, err)
+		}
+	case KMS_GCP:
+		var resp struct{ Pem string }
+		if err = s.call(http.MethodGet, gcpKMSEndpoint+s.key+"/publicKey", nil, &resp); err != nil {
+			return nil, err
+		}
+		block, _ := pem.Decode([]byte(resp.Pem))
+		if block == nil {
+			return nil, fmt.Errorf("%s: public key not in PEM format", uri)
+		}
+		if s.pub, err = x509.ParsePKIXPublicKey(block.Bytes); err != nil {
+			return nil, fmt.Errorf("%s: public key: %s", uri, err)
+		}
+	case KMS_AZURE:
+		var resp struct{ Key json.RawMessage }
+		if err = s.call(http.MethodGet, s.azureURL(""), nil, &resp); err != nil {
+			return nil, err
+		}
+		if s.pub, err = parseKMSJWK(resp.Key); err != nil {
+			return nil, fmt.Errorf("%s: public key: %s", uri, err)
+		}
+	}
+
+	switch s.pub.(type) {
+	case *ecdsa.PublicKey, *rsa.PublicKey:
+	default:
+		return nil, fmt.Errorf("%s: the key has to be ECDSA or RSA", uri)
+	}
+	return s, nil
+}
+
+// Public returns the public key.
+func (s *kmsSigner) Public() crypto.PublicKey { return s.pub }
+
+// Sign signs the digest in the KMS; the RSA keys sign in PKCS #1 v1.5.
+func (s *kmsSigner) Sign(_ io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	if _, ok := opts.(*rsa.PSSOptions); ok {
+		return nil, errors.New("KMS: the signatures RSA-PSS are not supported")
+	}
+	bits := map[crypto.Hash]string{crypto.SHA256: "256", crypto.SHA384: "384", crypto.SHA512: "512"}[opts.HashFunc()]
+	if bits == "" {
+		return nil, fmt.Errorf("KMS: unsupported hash %s", opts.HashFunc())
+	}
+	_, isEC := s.pub.(*ecdsa.PublicKey)
+
+	switch s.scheme {
+	case KMS_AWS:
+		algorithm := "RSASSA_PKCS1_V1_5_SHA_" + bits
+		if isEC {
+			algorithm = "ECDSA_SHA_" + bits
+		}
+		tmp, err := os.CreateTemp("", "easycert-digest-")
+		if err != nil {
+			return nil, err
+		}
+		defer os.Remove(tmp.Name())
+		_, err = tmp.Write(digest)
+		if err1 := tmp.Close(); err == nil {
+			err = err1
+		}
+		if err != nil {
+			return nil, err
+		}
+		out, err := kmsCmd(CMD_AWS, s.awsArgs("sign", "--message", "fileb://"+tmp.Name(),
+			"--message-type", "DIGEST", "--signing-algorithm", algorithm, "--query", "Signature")...)
+		if err != nil {
+			return nil, err
+		}
+		return base64.StdEncoding.DecodeString(strings.TrimSpace(string(out)))
+	case KMS_GCP:
+		req := map[string]map[string][]byte{"digest": {"sha" + bits: digest}}
+		var resp struct{ Signature []byte }
+		if err := s.call(http.MethodPost, gcpKMSEndpoint+s.key+":asymmetricSign", req, &resp); err != nil {
+			return nil, err
+		}
+		return resp.Signature, nil
+	case KMS_AZURE:
+		algorithm := "RS" + bits
+		if isEC {
+			algorithm = "ES" + bits
+		}
+		req := map[string]string{"alg": algorithm, "value": base64.RawURLEncoding.EncodeToString(digest)}
+		var resp struct{ Value string }
+		if err := s.call(http.MethodPost, s.azureURL("/sign"), req, &resp); err != nil {
+			return nil, err
+		}
+		sig, err := base64.RawURLEncoding.DecodeString(resp.Value)
+		if err != nil || !isEC {
+			return sig, err
+		}
+		// Key Vault returns the integers R and S concatenated (RFC 7518).
+		half := len(sig) / 2
+		return asn1.Marshal(struct{ R, S *big.Int }{
+			new(big.Int).SetBytes(sig[:half]), new(big.Int).SetBytes(sig[half:]),
+		})
+	}
+	return nil, fmt.Errorf("unknown KMS %q", s.scheme)
+}
+
+// awsArgs returns the arguments of the command of "aws kms".
+func (s *kmsSigner) awsArgs(cmd string, args ...string) []string {
+	args = append([]string{"kms", cmd, "--key-id", s.key, "--output", "text"}, args...)
+	if s.region != "" {
+		args = append(args, "--region", s.region)
+	}
+	return args
+}
+
+// azureURL returns the URL of the operation of the key of Key Vault.
+func (s *kmsSigner) azureURL(op string) string {
+	return azureKMSScheme + "://" + s.key + op + "?api-version=" + AZURE_KMS_API
+}
+
+// call calls the API of the KMS with the token of its command line tool,
+// sending `in` and decoding the response into `out` in JSON format.
+func (s *kmsSigner) call(method, url string, in, out interface{}) error {
+	var token []byte
+	var err error
+	if s.scheme == KMS_GCP {
+		token, err = kmsCmd(CMD_GCLOUD, "auth", "print-access-token")
+	} else {
+		token, err = kmsCmd(CMD_AZ, "account", "get-access-token", "--resource", "https://vault.azure.net",
+			"--query", "accessToken", "--output", "tsv")
+	}
+	if err != nil {
+		return err
+	}
+
+	var body io.Reader
+	if in != nil {
+		data, err := json.Marshal(in)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(data)
+	}
+	req, err := http.NewRequest(method, url, body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+strings.TrimSpace(string(token)))
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := (&http.Client{Timeout: 30 * time.Second}).Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("KMS: %s: %s\n%s", url, resp.Status, data)
+	}
+	return json.Unmarshal(data, out)
+}
+
+// kmsCmd executes the command line tool of the KMS, returning its output.
+func kmsCmd(name string, args ...string) ([]byte, error) {
+	var stdout, stderr bytes.Buffer
+
+	debugCmd(name, args)
+	cmd := exec.Command(name, args...)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("%s %s: %s\n%s", name, strings.Join(args[:2], " "), err, stderr.Bytes())
+	}
+	return stdout.Bytes(), nil
+}
+
+// parseKMSJWK parses the public key in JWK format of Key Vault, whose types of
+// the keys in a HSM have the suffix "-HSM".
+func parseKMSJWK(data []byte) (crypto.PublicKey, error) {
+	var k struct {
+		Kty, Crv, X, Y, N, E string
+	}
+	if err := json.Unmarshal(data, &k); err != nil {
+		return nil, err
+	}
+	dec := func(s string) []byte {
+		b, _ := base64.RawURLEncoding.DecodeString(strings.TrimRight(s, "="))
+		return b
+	}
+
+	switch strings.TrimSuffix(k.Kty, "-HSM") {
+	case "EC":
+		curve := map[string]elliptic.Curve{
+			"P-256": elliptic.P256(), "P-384": elliptic.P384(), "P-521": elliptic.P521(),
+		}[k.Crv]
+		if curve == nil {
+			return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+		key := &ecdsa.PublicKey{Curve: curve, X: new(big.Int).SetBytes(dec(k.X)), Y: new(big.Int).SetBytes(dec(k.Y))}
+		if !curve.IsOnCurve(key.X, key.Y) {
+			return nil, errors.New("the point is not on the curve")
+		}
+		return key, nil
+	case "RSA":
+		n, e := dec(k.N), dec(k.E)
+		if len(n) == 0 || len(e) == 0 || len(e) > 4 {
+			return nil, errors.New("wrong key RSA")
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}, nil
+	}
+	return nil, fmt.Errorf("unsupported key type %q", k.Kty)
+}
+
+// checkKMS checks the flags to create the CA with the private key in a KMS.
+func checkKMS() error {
+	if *KMSURI == "" {
+		return nil
+	}
+	if *Intermediate != "" {
+		return errors.New("Flag -kms-uri is only used by the root CA")
+	}
+	if *IsYubiKey {
+		return errors.New("Flags -kms-uri and -yubikey are exclusive")
+	}
+	_, err := parseKMSURI(*KMSURI)
+	return err
+}
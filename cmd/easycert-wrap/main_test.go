@@ -0,0 +1,5293 @@
+// Copyright 2014 Jonas mg
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"encoding/xml"
+	"errors"
+	"flag"
+	"fmt"
+	"go/parser"
+	"go/token"
+	"io"
+	"io/fs"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"os/exec"
+	"os/user"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/tredoe/easycert"
+	"github.com/tredoe/easycert/client"
+)
+
+var update = flag.Bool("update", false, "update the golden files")
+
+// envTestMain is the environment variable to run the test binary like the
+// program, so the commands are tested in their own process.
+const envTestMain = "EASYCERT_TEST_MAIN"
+
+const testCAPass = "testpassword"
+
+func TestMain(m *testing.M) {
+	if os.Getenv(envTestMain) != "" {
+		main()
+		os.Exit(0)
+	}
+	os.Exit(m.Run())
+}
+
+// == Store
+//
+
+// testStore represents a certificates directory created for a test.
+type testStore struct {
+	t    testing.TB
+	root string
+	env  []string
+}
+
+// newTestStore initializes a certificates directory in a temporary directory.
+// The CA is created whether `withCA` is true.
+func newTestStore(t testing.TB, withCA bool) *testStore {
+	t.Helper()
+	tmp := t.TempDir()
+
+	// The configuration template is looked for in GOPATH.
+	data, err := filepath.Abs(filepath.Join("..", "..", "data"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	pkgDir := filepath.Join(tmp, "gopath", "src", filepath.FromSlash(_DIR_CONFIG))
+	if err = os.MkdirAll(filepath.Dir(pkgDir), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err = os.Symlink(data, pkgDir); err != nil {
+		t.Fatal(err)
+	}
+
+	s := &testStore{
+		t:    t,
+		root: filepath.Join(tmp, "cert"),
+	}
+	s.env = append(os.Environ(),
+		envTestMain+"=1",
+		ENV_ROOT+"="+s.root,
+		ENV_CA_PASS+"="+testCAPass,
+		ENV_OPERATOR+"=tester",
+		"XDG_CONFIG_HOME="+filepath.Join(tmp, "config"), // without defaults of the user
+		"GOPATH="+filepath.Join(tmp, "gopath"),
+		"GO111MODULE=off",
+	)
+
+	s.mustRun("", "init")
+	if withCA {
+		s.mustRun(dnInput("Test CA"), "ca")
+	}
+	return s
+}
+
+// dnInput returns the answers to the prompts of OpenSSL for a request, with
+// the default values but the common name.
+func dnInput(commonName string) string {
+	// Country, state, locality, organization, unit, common name, email,
+	// challenge password, company.
+	return "\n\n\n\n\n" + commonName + "\n\n\n\n"
+}
+
+// signInput are the answers to confirm the signing.
+const signInput = "y\ny\n"
+
+// run executes the program with the arguments, returning the output.
+func (s *testStore) run(stdin string, args ...string) (string, error) {
+	return s.runEnv(nil, stdin, args...)
+}
+
+// runEnv is like run, but adding variables of environment.
+func (s *testStore) runEnv(env []string, stdin string, args ...string) (string, error) {
+	cmd := exec.Command(os.Args[0], args...)
+	cmd.Env = append(append([]string{}, s.env...), env...)
+	cmd.Stdin = strings.NewReader(stdin)
+
+	out, err := cmd.CombinedOutput()
+	return string(out), err
+}
+
+// mustRun is like run, but the test fails on error.
+func (s *testStore) mustRun(stdin string, args ...string) string {
+	s.t.Helper()
+
+	out, err := s.run(stdin, args...)
+	if err != nil {
+		s.t.Fatalf("%s: %s\n%s", strings.Join(args, " "), err, out)
+	}
+	return out
+}
+
+// file returns the path of a file in the store.
+func (s *testStore) file(elem ...string) string {
+	return filepath.Join(append([]string{s.root}, elem...)...)
+}
+
+// cert returns the certificate with the name.
+func (s *testStore) cert(name string) *x509.Certificate {
+	s.t.Helper()
+
+	cert, err := parseCertFile(s.file("certs", name+EXT_CERT))
+	if err != nil {
+		s.t.Fatal(err)
+	}
+	return cert
+}
+
+// issue creates and signs a certificate.
+func (s *testStore) issue(name string, args ...string) *x509.Certificate {
+	s.t.Helper()
+
+	s.mustRun(dnInput(name), append(append([]string{"req"}, args...), name)...)
+	s.mustRun(signInput, "sign", name)
+	return s.cert(name)
+}
+
+func checkMode(t *testing.T, file string, perm os.FileMode) {
+	t.Helper()
+
+	info, err := os.Stat(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != perm {
+		t.Errorf("%s: got mode %v, want %v", file, info.Mode().Perm(), perm)
+	}
+}
+
+func checkNotExist(t *testing.T, files ...string) {
+	t.Helper()
+
+	for _, v := range files {
+		if _, err := os.Stat(v); !os.IsNotExist(err) {
+			t.Errorf("%s: got file, want none", v)
+		}
+	}
+}
+
+// == Tests
+//
+
+func TestInit(t *testing.T) {
+	s := newTestStore(t, false)
+
+	for _, v := range []string{"certs", "private", "hooks", FILE_CONFIG, FILE_CONFIG + ".tmpl"} {
+		if _, err := os.Stat(s.file(v)); err != nil {
+			t.Error(err)
+		}
+	}
+	checkMode(t, s.file("private"), 0710)
+	checkMode(t, s.file(FILE_CONFIG), 0600)
+
+	if _, err := s.run("", "init"); err == nil {
+		t.Error("init twice: got no error")
+	}
+}
+
+func TestCA(t *testing.T) {
+	s := newTestStore(t, true)
+	ca := s.cert(NAME_CA)
+
+	if !ca.IsCA || !ca.BasicConstraintsValid {
+		t.Error("CA certificate without basic constraints of CA")
+	}
+	if err := ca.CheckSignatureFrom(ca); err != nil {
+		t.Errorf("CA certificate is not self-signed: %s", err)
+	}
+	if ca.Subject.CommonName != "Test CA" {
+		t.Errorf("got common name %q", ca.Subject.CommonName)
+	}
+
+	checkMode(t, s.file("private", NAME_CA+EXT_KEY), 0400)
+	checkNotExist(t, s.file(NAME_CA+EXT_REQUEST))
+
+	if _, err := s.run(dnInput("Test CA"), "ca"); err == nil {
+		t.Error("ca twice: got no error")
+	}
+}
+
+func TestYubiKey(t *testing.T) {
+	s := newTestStore(t, false)
+
+	for _, args := range [][]string{
+		{"-slot", "9b"},
+		{"-key-type", "ecdsa", "-curve", "p521"},
+		{"-rsa-size", "8192"},
+		{"-intermediate", "sub"},
+		{"-backend", BACKEND_NATIVE},
+	} {
+		if _, err := s.run("", append([]string{"ca", "-yubikey"}, args...)...); err == nil {
+			t.Errorf("ca -yubikey %q: got no error", args)
+		}
+	}
+
+	// A fake ykman which records its arguments; OpenSSL fails without the
+	// provider of PKCS#11, so the issuance is rolled back.
+	bin := t.TempDir()
+	logFile := filepath.Join(bin, "log")
+	script := fmt.Sprintf("#!/bin/sh\nif [ \"$1\" = list ]; then echo 12345678; exit; fi\necho \"$*\" >> %s\n", logFile)
+	if err := os.WriteFile(filepath.Join(bin, CMD_YKMAN), []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	env := []string{"PATH=" + bin + string(os.PathListSeparator) + os.Getenv("PATH"),
+		ENV_PKCS11_MODULE + "=" + filepath.Join(bin, "none.so")}
+
+	if _, err := s.runEnv(env, dnInput("Test CA"), "ca", "-yubikey", "-key-type", "ecdsa"); err == nil {
+		t.Error("ca -yubikey without PKCS#11: got no error")
+	}
+	data, err := os.ReadFile(logFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(data), "--device 12345678 piv keys generate --algorithm ECCP256 --pin-policy ALWAYS 9c ") {
+		t.Errorf("got ykman\n%s", data)
+	}
+	checkNotExist(t, s.file("private", NAME_CA+EXT_YUBIKEY), s.file("private", NAME_CA+EXT_KEY),
+		s.file("certs", NAME_CA+EXT_CERT))
+
+	// The CA's key in the YubiKey is used by OpenSSL through its URI.
+	s.mustRun(dnInput("Test CA"), "ca")
+	if err = os.Rename(s.file("private", NAME_CA+EXT_KEY), s.file("private", "old"+EXT_KEY)); err != nil {
+		t.Fatal(err)
+	}
+	y := `{"serial": "12345678", "slot": "9a", "module": "/none.so"}`
+	if err = os.WriteFile(s.file("private", NAME_CA+EXT_YUBIKEY), []byte(y), 0644); err != nil {
+		t.Fatal(err)
+	}
+	s.mustRun(dnInput("web"), "req", "-host", "www.example.com", "web")
+	out, err := s.runEnv([]string{ENV_DEBUG + "=1", ENV_YUBIKEY_PIN + "=123456"}, signInput, "sign", "web")
+	if err == nil {
+		t.Error("sign without PKCS#11: got no error")
+	}
+	if !strings.Contains(out, "-provider pkcs11 -provider default -keyfile pkcs11:token=YubiKey%20PIV%20%2312345678;id=%01;type=private -passin env:"+ENV_YUBIKEY_PIN) {
+		t.Errorf("sign: got\n%s", out)
+	}
+	if out, err = s.run("", "sign", "-backend", BACKEND_NATIVE, "web"); err == nil || !strings.Contains(out, "YubiKey") {
+		t.Errorf("sign -backend native: got error %v\n%s", err, out)
+	}
+}
+
+func TestKMS(t *testing.T) {
+	s := newTestStore(t, false)
+
+	for _, args := range [][]string{
+		{"-kms-uri", "vault://ca"},
+		{"-kms-uri", "gcpkms://projects/p/keyRings/r"},
+		{"-kms-uri", "awskms:///alias/ca", "-intermediate", "sub"},
+		{"-kms-uri", "awskms:///alias/ca", "-yubikey"},
+	} {
+		if _, err := s.run("", append([]string{"ca"}, args...)...); err == nil {
+			t.Errorf("ca %q: got no error", args)
+		}
+	}
+
+	// A fake aws which signs with a key of OpenSSL.
+	bin := t.TempDir()
+	keyFile := filepath.Join(bin, "kms.key")
+	if out, err := exec.Command("openssl", "genpkey", "-algorithm", "EC",
+		"-pkeyopt", "ec_paramgen_curve:P-256", "-out", keyFile).CombinedOutput(); err != nil {
+		t.Fatalf("%s\n%s", err, out)
+	}
+	script := fmt.Sprintf(`#!/bin/sh
+for a; do case "$a" in fileb://*) msg=${a#fileb://};; esac; done
+case "$2" in
+get-public-key) openssl pkey -in %[1]s -pubout -outform DER | base64 ;;
+sign) openssl pkeyutl -sign -inkey %[1]s -in "$msg" | base64 ;;
+esac
+`, keyFile)
+	if err := os.WriteFile(filepath.Join(bin, CMD_AWS), []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	env := []string{"PATH=" + bin + string(os.PathListSeparator) + os.Getenv("PATH")}
+
+	out, err := s.runEnv(env, "", "ca", "-kms-uri", "awskms:///alias/ca")
+	if err != nil {
+		t.Fatalf("ca -kms-uri: %s\n%s", err, out)
+	}
+	checkNotExist(t, s.file("private", NAME_CA+EXT_KEY))
+	if data, err := os.ReadFile(s.file("private", NAME_CA+EXT_KMS)); err != nil || string(data) != "awskms:///alias/ca\n" {
+		t.Fatalf("%s: got %q, %v", NAME_CA+EXT_KMS, data, err)
+	}
+	ca := s.cert(NAME_CA)
+	if !ca.IsCA || ca.CheckSignatureFrom(ca) != nil {
+		t.Fatal("CA: wrong self-signed certificate")
+	}
+
+	s.mustRun(dnInput("web"), "req", "-host", "www.example.com", "web")
+	if out, err = s.runEnv(env, "", "sign", "web"); err != nil {
+		t.Fatalf("sign: %s\n%s", err, out)
+	}
+	if err = s.cert("web").CheckSignatureFrom(ca); err != nil {
+		t.Fatal(err)
+	}
+	if out, err = s.runEnv(env, "", "revoke", "web"); err != nil {
+		t.Fatalf("revoke: %s\n%s", err, out)
+	}
+	data, err := os.ReadFile(s.file("crl", NAME_CA+EXT_REVOK))
+	if err != nil {
+		t.Fatal(err)
+	}
+	crl, err := x509.ParseRevocationList(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = crl.CheckSignatureFrom(ca); err != nil || len(crl.RevokedCertificateEntries) != 1 {
+		t.Errorf("CRL: got %d entries, %v", len(crl.RevokedCertificateEntries), err)
+	}
+	if _, err = s.runEnv(env, "", "ca", "-intermediate", "sub"); err == nil {
+		t.Error("ca -intermediate with the root CA in a KMS: got no error")
+	}
+
+	// The key of the KMS has to be the one of the CA.
+	s = newTestStore(t, true)
+	s.mustRun(dnInput("web"), "req", "-host", "www.example.com", "web")
+	out, err = s.runEnv(env, "", "sign", "-kms-uri", "awskms:///alias/ca", "web")
+	if err == nil || !strings.Contains(out, "not the one of the CA") {
+		t.Errorf("sign -kms-uri with other key: got error %v\n%s", err, out)
+	}
+}
+
+func TestEncryptKey(t *testing.T) {
+	s := newTestStore(t, true)
+	passFile := filepath.Join(t.TempDir(), "pass")
+	if err := os.WriteFile(passFile, []byte("key secret\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	// The keys are encrypted in AES-256, not in Triple DES.
+	aes256CBC := []byte{0x06, 0x09, 0x60, 0x86, 0x48, 0x01, 0x65, 0x03, 0x04, 0x01, 0x2a}
+	checkKey := func(name, pass string) {
+		t.Helper()
+		file := s.file("private", name+EXT_KEY)
+		data, err := os.ReadFile(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if block, _ := pem.Decode(data); block == nil || !isEncryptedKey(block) || !bytes.Contains(block.Bytes, aes256CBC) {
+			t.Errorf("%s: key not encrypted in AES-256", name)
+		}
+		if _, err = loadKeyFile(file, pass); err != nil {
+			t.Errorf("%s: %s", name, err)
+		}
+	}
+	checkKey(NAME_CA, testCAPass)
+
+	for _, args := range [][]string{
+		{"-passin", "file:" + passFile},
+		{"-encrypt-key", "-passin", "pass:key secret"},
+		{"-encrypt-key", "-batch"},
+		{"-encrypt-key", "-backup-key"},
+	} {
+		if _, err := s.run(dnInput("bad"), append(append([]string{"req"}, args...), "bad")...); err == nil {
+			t.Errorf("req %q: got no error", args)
+		}
+	}
+
+	s.mustRun(dnInput("web"), "req", "-encrypt-key", "-passin", "file:"+passFile, "-host", "www.example.com", "web")
+	checkKey("web", "key secret")
+	s.mustRun(signInput, "sign", "web")
+	s.mustRun(signInput, "renew", "-passin", "file:"+passFile, "web")
+	checkKey("web", "key secret")
+
+	// The CA's passphrase from another source.
+	s.mustRun(dnInput("api"), "req", "-host", "api.example.com", "api")
+	env := []string{ENV_CA_PASS + "=", "CA_SECRET=" + testCAPass}
+	if out, err := s.runEnv(env, signInput, "sign", "-passin", "env:CA_SECRET", "api"); err != nil {
+		t.Fatalf("sign -passin: %s\n%s", err, out)
+	}
+	if _, err := s.run(signInput, "renew", "-passin", "file:"+passFile, "api"); err == nil {
+		t.Error("renew -passin with the key not encrypted: got no error")
+	}
+
+	s.mustRun("", "req", "-backend", BACKEND_NATIVE, "-encrypt-key", "-passin", "file:"+passFile, "-host", "n.example.com", "native")
+	checkKey("native", "key secret")
+	if _, err := s.run("", "req", "-backend", BACKEND_NATIVE, "-encrypt-key", "-host", "m.example.com", "native2"); err == nil {
+		t.Error("req -backend native -encrypt-key without -passin: got no error")
+	}
+}
+
+func TestCeremony(t *testing.T) {
+	s := newTestStore(t, false)
+	answers := "Ada\nBob, Carol\nDan\nEve\nFay\nYES\n"
+
+	out := s.mustRun(answers, "ceremony", "-shares", "3", "-threshold", "2", "create")
+	ca := s.cert(NAME_CA)
+	report := s.file("ceremony", FILE_CEREMONY_REPORT)
+
+	data, err := os.ReadFile(report)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, v := range []string{"Bob, Carol", fingerprint(sha256Sum(ca.Raw)), "Monobit test", "3. Fay\t"} {
+		if !bytes.Contains(data, []byte(v)) {
+			t.Errorf("report without %q:\n%s", v, data)
+		}
+	}
+	if !strings.Contains(out, string(data)) {
+		t.Error("report not printed")
+	}
+	s.mustRun("", "ceremony", "verify", report)
+
+	shares, err := filepath.Glob(s.file("ceremony", "share-*.pem"))
+	if err != nil || len(shares) != 3 {
+		t.Fatalf("got shares %v", shares)
+	}
+	checkMode(t, shares[0], 0400)
+	pass := strings.TrimSpace(s.mustRun("", "ceremony", "join", shares[2], shares[0]))
+	if strings.Contains(out, pass) {
+		t.Error("passphrase printed in the ceremony")
+	}
+
+	s.mustRun(dnInput("web"), "req", "web")
+	if out, err := s.runEnv([]string{ENV_CA_PASS + "=" + pass}, signInput, "sign", "web"); err != nil {
+		t.Fatalf("sign with the passphrase of the shares: %s\n%s", err, out)
+	}
+
+	if out, err := s.run("", "ceremony", "join", shares[1]); err == nil {
+		t.Errorf("join of a single share: got no error\n%s", out)
+	}
+	if err = os.WriteFile(report, append(data, "x"...), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if out, err := s.run("", "ceremony", "verify", report); err == nil {
+		t.Errorf("verify of a report modified: got no error\n%s", out)
+	}
+
+	// Not confirmed.
+	s = newTestStore(t, false)
+	if out, err := s.run("Ada\nBob\nDan\nEve\nFay\nFay\nno\n", "ceremony", "create"); err == nil {
+		t.Errorf("ceremony not confirmed: got no error\n%s", out)
+	}
+	checkNotExist(t, s.file("certs", NAME_CA+EXT_CERT))
+}
+
+func TestShamir(t *testing.T) {
+	secret := []byte("secret passphrase")
+	shares, err := shamirSplit(secret, 5, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, v := range [][][]byte{shares[:3], shares[2:], {shares[4], shares[0], shares[2]}, shares} {
+		got, err := shamirCombine(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, secret) {
+			t.Errorf("combine of %d shares: got %q", len(v), got)
+		}
+	}
+	if got, _ := shamirCombine(shares[:2]); bytes.Equal(got, secret) {
+		t.Error("secret recovered with less shares than the threshold")
+	}
+	if _, err = shamirCombine([][]byte{shares[0], shares[0]}); err == nil {
+		t.Error("combine of repeated shares: got no error")
+	}
+}
+
+func TestReqSign(t *testing.T) {
+	s := newTestStore(t, true)
+	cert := s.issue("web", "-host", "www.example.com,127.0.0.1")
+
+	roots := x509.NewCertPool()
+	roots.AddCert(s.cert(NAME_CA))
+	if _, err := cert.Verify(x509.VerifyOptions{
+		Roots:     roots,
+		DNSName:   "www.example.com",
+		KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+	}); err != nil {
+		t.Error(err)
+	}
+	if len(cert.IPAddresses) != 1 || !cert.IPAddresses[0].Equal(net.ParseIP("127.0.0.1")) {
+		t.Errorf("got IP addresses %v", cert.IPAddresses)
+	}
+
+	checkMode(t, s.file("private", "web"+EXT_KEY), 0400)
+	checkNotExist(t, s.file("web"+EXT_REQUEST), s.file("web.cfg"))
+
+	// No temporary files.
+	for _, dir := range []string{s.root, s.file("certs"), s.file("private")} {
+		match, _ := filepath.Glob(filepath.Join(dir, ".*.tmp-*"))
+		if len(match) != 0 {
+			t.Errorf("temporary files left: %v", match)
+		}
+	}
+
+	out := s.mustRun("", "audit")
+	for _, v := range []string{ACTION_CA, ACTION_REQUEST, ACTION_SIGN} {
+		if !strings.Contains(out, " "+v+" ") {
+			t.Errorf("audit without action %q:\n%s", v, out)
+		}
+	}
+
+	if _, err := s.run(dnInput("web"), "req", "web"); err == nil {
+		t.Error("req of existing certificate: got no error")
+	}
+}
+
+func TestBatch(t *testing.T) {
+	s := newTestStore(t, true)
+
+	// Without standard input, like in a daemon.
+	noInput := func(env []string, args ...string) (string, error) {
+		cmd := exec.Command(os.Args[0], args...)
+		cmd.Env = append(append([]string{}, s.env...), env...)
+		out, err := cmd.CombinedOutput()
+		return string(out), err
+	}
+
+	// The prompts are not answered.
+	s.mustRun("", "req", "-batch", "web")
+	s.mustRun("", "sign", "-batch", "web")
+	if cn := s.cert("web").Subject.CommonName; cn != "web" {
+		t.Errorf("got common name %q", cn)
+	}
+
+	if out, err := noInput(nil, "req", "api"); err != nil {
+		t.Fatalf("%s\n%s", err, out)
+	}
+	if out, err := noInput([]string{ENV_CA_PASS + "="}, "sign", "api"); err == nil ||
+		!strings.Contains(out, ENV_CA_PASS) {
+		t.Errorf("without passphrase: got error %v\n%s", err, out)
+	}
+	checkNotExist(t, s.file("certs", "api"+EXT_CERT))
+
+	if out, err := noInput(nil, "sign", "api"); err != nil {
+		t.Fatalf("%s\n%s", err, out)
+	}
+
+	// Summary of the batch.
+	for _, v := range []string{"a", "b", "c"} {
+		s.mustRun("", "req", "-batch", v)
+	}
+	out := s.mustRun("", "sign", "-batch", "a", "b")
+	for _, v := range []string{"== [2/2] b", "== Summary: 2 of 2 signed", "NAME  ", "signed"} {
+		if !strings.Contains(out, v) {
+			t.Errorf("sign of batch: output without %q:\n%s", v, out)
+		}
+	}
+	out, err := s.run("", "sign", "-batch", "c", "missing", "a")
+	if err == nil || !strings.Contains(out, "== Summary: 1 of 3 signed, 1 skipped") ||
+		!strings.Contains(out, "missing") || !strings.Contains(out, _ITEM_FAILED) {
+		t.Errorf("sign of batch failed: got error %v\n%s", err, out)
+	}
+
+	ca := newTestStore(t, false)
+	ca.mustRun("", "ca", "-batch")
+	if cn := ca.cert(NAME_CA).Subject.CommonName; cn != DEFAULT_ORGANIZATION+" CA" {
+		t.Errorf("CA: got common name %q", cn)
+	}
+}
+
+func TestStagger(t *testing.T) {
+	s := newTestStore(t, true)
+
+	for _, backend := range []string{BACKEND_OPENSSL, BACKEND_NATIVE} {
+		names := []string{backend + "-a", backend + "-b", backend + "-c"}
+		for _, v := range names {
+			s.mustRun("", "req", "-batch", v)
+		}
+		start := time.Now()
+		s.mustRun("", append([]string{"sign", "-batch", "-backend", backend,
+			"-years", "1", "-stagger", "2d"}, names...)...)
+
+		// The expirations are spread out over the window, one day apart.
+		base := start.AddDate(1, 0, 0)
+		for i, v := range names {
+			want := base.Add(time.Duration(i) * 24 * time.Hour)
+			if got := s.cert(v).NotAfter; got.Sub(want).Abs() > time.Minute {
+				t.Errorf("%s: got expiration %s, want %s", v, got, want)
+			}
+		}
+	}
+
+	// The schedule of every batch is appended to the log.
+	data, err := os.ReadFile(s.file(FILE_SCHEDULE))
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("got %d batches in the schedule:\n%s", len(lines), data)
+	}
+	var b batch
+	if err = json.Unmarshal([]byte(lines[1]), &b); err != nil {
+		t.Fatal(err)
+	}
+	if b.Stagger != "2d" || len(b.Certs) != 3 {
+		t.Fatalf("got schedule %s", lines[1])
+	}
+	for _, v := range b.Certs {
+		if !v.NotAfter.Equal(s.cert(v.Name).NotAfter) {
+			t.Errorf("%s: got expiration %s in the schedule, want %s", v.Name,
+				v.NotAfter, s.cert(v.Name).NotAfter)
+		}
+	}
+
+	// Without stagger, nothing is scheduled.
+	s.mustRun("", "req", "-batch", "d")
+	s.mustRun("", "sign", "-batch", "d")
+	if data2, _ := os.ReadFile(s.file(FILE_SCHEDULE)); !bytes.Equal(data, data2) {
+		t.Error("sign without stagger: the schedule was changed")
+	}
+
+	s.mustRun("", "req", "-batch", "e")
+	if out, err := s.run("", "sign", "-batch", "-stagger", "7x", "e"); err == nil ||
+		!strings.Contains(out, errDuration.Error()) {
+		t.Errorf("invalid window: got error %v\n%s", err, out)
+	}
+}
+
+func TestSPKI(t *testing.T) {
+	s := newTestStore(t, true)
+
+	out := s.mustRun("", "req", "-spki", "svc")
+	i := strings.Index(out, "- SPKI pin:\t")
+	if i == -1 {
+		t.Fatalf("req -spki: output without pin:\n%s", out)
+	}
+	pin := strings.TrimSpace(strings.SplitN(out[i+len("- SPKI pin:\t"):], "\n", 2)[0])
+	if got := strings.TrimSpace(s.mustRun("", "info", "-req", "-spki", "svc")); got != pin {
+		t.Errorf("info -req -spki: got %q, want %q", got, pin)
+	}
+
+	s.mustRun(signInput, "sign", "svc")
+	cert := s.cert("svc")
+	if len(cert.DNSNames) != 0 || len(cert.IPAddresses) != 0 || cert.Subject.CommonName != "svc" {
+		t.Errorf("nameless certificate: got subject %q, names %v %v",
+			cert.Subject, cert.DNSNames, cert.IPAddresses)
+	}
+	if got := strings.TrimSpace(s.mustRun("", "info", "-spki", "svc")); got != pin {
+		t.Errorf("info -spki: got %q, want %q", got, pin)
+	}
+
+	if _, err := s.run("", "req", "-spki", "-host", "www.example.com", "web"); err == nil {
+		t.Error("req -spki with hostnames: got no error")
+	}
+}
+
+func TestEphemeral(t *testing.T) {
+	s := newTestStore(t, false)
+	root := filepath.Join(t.TempDir(), "missing")
+
+	out, err := s.runEnv([]string{ENV_ROOT + "=" + root}, "", "req", "-ephemeral",
+		"-key-type", "ecdsa", "-host", "www.example.com,127.0.0.1", "web")
+	if err != nil {
+		t.Fatalf("req -ephemeral: %s\n%s", err, out)
+	}
+	var certs []*x509.Certificate
+	var key crypto.Signer
+	for rest := []byte(out); ; {
+		var block *pem.Block
+		if block, rest = pem.Decode(rest); block == nil {
+			break
+		}
+		if block.Type == "PRIVATE KEY" {
+			if key, err = easycert.ParseKey(pem.EncodeToMemory(block), ""); err != nil {
+				t.Fatal(err)
+			}
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			t.Fatal(err)
+		}
+		certs = append(certs, cert)
+	}
+	if len(certs) != 2 || key == nil {
+		t.Fatalf("req -ephemeral: got %d certificates, key %v:\n%s", len(certs), key != nil, out)
+	}
+	cert, ca := certs[0], certs[1]
+	if err = cert.CheckSignatureFrom(ca); err != nil || ca.Subject.CommonName != EPHEMERAL_CA {
+		t.Errorf("got CA %q: %v", ca.Subject.CommonName, err)
+	}
+	if pub, ok := key.Public().(*ecdsa.PublicKey); !ok || !pub.Equal(cert.PublicKey) {
+		t.Error("got other private key")
+	}
+	if cert.Subject.CommonName != "web" || len(cert.DNSNames) != 1 || len(cert.IPAddresses) != 1 {
+		t.Errorf("got subject %q, names %v %v", cert.Subject, cert.DNSNames, cert.IPAddresses)
+	}
+	checkNotExist(t, root)
+
+	if _, err = s.run("", "req", "-ephemeral", "-sign", "web"); err == nil {
+		t.Error("req -ephemeral -sign: got no error")
+	}
+}
+
+func TestPins(t *testing.T) {
+	s := newTestStore(t, true)
+	cert := s.issue("web", "-host", "www.example.com")
+	pin := strings.TrimSpace(s.mustRun("", "info", "-spki", "web"))
+
+	out := s.mustRun("", "pins", "web")
+	checkMode(t, s.file("private", "backup", "web"+EXT_KEY), 0400)
+	var backup string
+	for _, line := range strings.Split(out, "\n") {
+		if f := strings.Fields(line); len(f) == 3 && f[0] == "web" && f[1] == "backup" {
+			backup = f[2]
+		}
+	}
+	if !strings.Contains(out, pin) || backup == "" || backup == pin {
+		t.Fatalf("pins: got\n%s", out)
+	}
+	if out2 := s.mustRun("", "pins", "web"); !strings.Contains(out2, backup) {
+		t.Errorf("pins: backup key generated again:\n%s", out2)
+	}
+
+	hash := strings.TrimPrefix(backup, "sha256/")
+	for format, want := range map[string]string{
+		"okhttp":  `.add("www.example.com", "` + backup + `")`,
+		"android": `<pin-set expiration="` + cert.NotAfter.UTC().Format("2006-01-02") + `">`,
+		"hpkp":    `pin-sha256="` + hash + `";`,
+	} {
+		if out = s.mustRun("", "pins", "-o", format, "web"); !strings.Contains(out, want) {
+			t.Errorf("pins -o %s: output without %q:\n%s", format, want, out)
+		}
+	}
+
+	s.mustRun(dnInput("web"), "req", "-backup-key", "-reissue", "web")
+	s.mustRun(signInput, "sign", "web")
+	if got := strings.TrimSpace(s.mustRun("", "info", "-spki", "web")); got != backup {
+		t.Errorf("req -backup-key: got pin %q, want %q", got, backup)
+	}
+	checkNotExist(t, s.file("private", "backup", "web"+EXT_KEY))
+
+	if _, err := s.run(dnInput("web"), "req", "-backup-key", "-reissue", "web"); err == nil {
+		t.Error("req -backup-key without backup key: got no error")
+	}
+}
+
+func TestCMS(t *testing.T) {
+	s := newTestStore(t, true)
+	s.issue("web", "-host", "www.example.com")
+	s.issue("api", "-host", "api.example.com")
+
+	dir := t.TempDir()
+	file := filepath.Join(dir, "secret.txt")
+	content := []byte("the content of the file\n")
+	if err := os.WriteFile(file, content, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	s.mustRun("", "cms", "-encrypt", "-to", "web,api", file)
+	if err := os.Remove(file); err != nil {
+		t.Fatal(err)
+	}
+	s.mustRun("", "cms", "-decrypt", "api", file+EXT_CMS_ENCRYPT)
+	checkMode(t, file, 0600)
+	if data, err := os.ReadFile(file); err != nil || !bytes.Equal(data, content) {
+		t.Fatalf("cms -decrypt: got %q, %v", data, err)
+	}
+	if _, err := s.run("", "cms", "-encrypt", "-to", "web", file); err == nil {
+		t.Error("cms -encrypt over an existing file: got no error")
+	}
+	if _, err := s.run("", "cms", "-encrypt", "-to", "nobody", "-out", file+".nobody", file); err == nil {
+		t.Error("cms -encrypt to a missing certificate: got no error")
+	}
+
+	s.mustRun("", "cms", "-sign", "web", file)
+	signer := filepath.Join(dir, "signer.crt")
+	s.mustRun("", "cms", "-verify", "-out", signer, file)
+	if cert, err := parseCertFile(signer); err != nil || cert.Subject.CommonName != "web" {
+		t.Errorf("cms -verify: got signer %v, %v", cert, err)
+	}
+
+	if err := os.WriteFile(file, []byte("other content\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.run("", "cms", "-verify", file); err == nil {
+		t.Error("cms -verify of a modified file: got no error")
+	}
+	if _, err := s.run("", "cms", "-sign", "-decrypt", "web", file); err == nil {
+		t.Error("cms with two operations: got no error")
+	}
+}
+
+func TestSAML(t *testing.T) {
+	s := newTestStore(t, true)
+
+	if _, err := s.run("", "req", "-saml", "-host", "idp.example.com", "idp"); err == nil {
+		t.Error("req -saml with hostnames: got no error")
+	}
+	s.mustRun("", "req", "-saml", "idp")
+	s.mustRun(signInput, "sign", "idp")
+	cert := s.cert("idp")
+	if cert.Subject.CommonName != "idp" || len(cert.DNSNames) != 0 ||
+		cert.KeyUsage != x509.KeyUsageDigitalSignature|x509.KeyUsageKeyEncipherment {
+		t.Errorf("SAML certificate: got subject %q, names %v, key usage %d",
+			cert.Subject, cert.DNSNames, cert.KeyUsage)
+	}
+
+	dir := t.TempDir()
+	out := filepath.Join(dir, "shibboleth")
+	s.mustRun("", "export", "-layout", "shibboleth-idp", "-out", out, "idp")
+	checkMode(t, filepath.Join(out, "idp-signing.crt"), 0644)
+	checkMode(t, filepath.Join(out, "idp-encryption.key"), 0600)
+
+	out = filepath.Join(dir, "keycloak")
+	s.mustRun("", "export", "-layout", "keycloak", "-out", out, "idp")
+	data, err := os.ReadFile(filepath.Join(out, "idp-keycloak.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var component struct {
+		ProviderID string              `json:"providerId"`
+		Config     map[string][]string `json:"config"`
+	}
+	if err = json.Unmarshal(data, &component); err != nil {
+		t.Fatal(err)
+	}
+	if component.ProviderID != "rsa" || len(component.Config["privateKey"]) != 1 ||
+		!strings.Contains(component.Config["certificate"][0], "BEGIN CERTIFICATE") {
+		t.Errorf("keycloak: got %s", data)
+	}
+	if _, err = s.run("", "export", "-layout", "adfs", "-out", filepath.Join(dir, "adfs"), "idp"); err == nil {
+		t.Error("export with unknown layout: got no error")
+	}
+
+	metadata := []byte(`<?xml version="1.0"?>
+<md:EntityDescriptor xmlns:md="urn:oasis:names:tc:SAML:2.0:metadata" entityID="https://idp.example.com">
+  <md:IDPSSODescriptor protocolSupportEnumeration="urn:oasis:names:tc:SAML:2.0:protocol"/>
+</md:EntityDescriptor>
+`)
+	tmpl, root, err := metadataTemplate(metadata)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if root != "EntityDescriptor" || !bytes.Contains(tmpl, []byte(`entityID="https://idp.example.com" ID="_`)) ||
+		!bytes.Contains(tmpl, []byte(`"><ds:Signature xmlns:ds=`)) {
+		t.Errorf("template of the signature: got\n%s", tmpl)
+	}
+	if _, _, err = metadataTemplate(tmpl); err == nil {
+		t.Error("metadata already signed: got no error")
+	}
+	if _, _, err = metadataTemplate([]byte(`<EntityDescriptor/>`)); err == nil {
+		t.Error("metadata without namespace: got no error")
+	}
+
+	if _, err = exec.LookPath("xmlsec1"); err != nil {
+		t.Log("xmlsec1 is not installed")
+		return
+	}
+	file := filepath.Join(dir, "metadata.xml")
+	if err = os.WriteFile(file, metadata, 0644); err != nil {
+		t.Fatal(err)
+	}
+	signed := s.mustRun("", "sign-metadata", "idp", file)
+	if !strings.Contains(signed, "<ds:SignatureValue>") || !strings.Contains(signed, "<ds:X509Certificate>") {
+		t.Errorf("sign-metadata: got\n%s", signed)
+	}
+}
+
+func TestPKCS12(t *testing.T) {
+	s := newTestStore(t, true)
+	s.issue("web", "-host", "web.example.com")
+	dir := t.TempDir()
+
+	// contents returns the output of OpenSSL reading the bundle.
+	contents := func(file, password string, args ...string) string {
+		t.Helper()
+		args = append([]string{"pkcs12", "-in", file, "-passin", "pass:" + password, "-nodes", "-info"}, args...)
+		out, err := exec.Command("openssl", args...).CombinedOutput()
+		if err != nil {
+			t.Fatalf("%s\n%s", err, out)
+		}
+		return string(out)
+	}
+
+	out := filepath.Join(dir, "web.pfx")
+	s.mustRun("", "export", "-p12", "-password", "secret", "-out", out, "web")
+	checkMode(t, out, 0600)
+	got := contents(out, "secret")
+	if n := strings.Count(got, "BEGIN CERTIFICATE"); n != 1 {
+		t.Errorf("got %d certificates, want 1:\n%s", n, got)
+	}
+	if !strings.Contains(got, "PRIVATE KEY") || !strings.Contains(got, "friendlyName: web") {
+		t.Errorf("got no private key nor name:\n%s", got)
+	}
+	if _, err := s.run("", "export", "-p12", "-password", "secret", "-out", out, "web"); err == nil {
+		t.Error("export over a file: got no error")
+	}
+
+	out = filepath.Join(dir, "root.p12")
+	s.mustRun("", "export", "-p12", "-with-root", "-password", "secret", "-out", out, "web")
+	if got = contents(out, "secret"); strings.Count(got, "BEGIN CERTIFICATE") != 2 {
+		t.Errorf("with-root: got\n%s", got)
+	}
+	if _, err := s.run("", "export", "-public", "-with-root", "web"); err == nil {
+		t.Error("export -public -with-root: got no error")
+	}
+
+	out = filepath.Join(dir, "legacy.p12")
+	if _, err := s.runEnv([]string{ENV_P12_PASS + "=other"}, "", "export", "-p12", "-legacy", "-out", out, "web"); err != nil {
+		t.Fatal(err)
+	}
+	if got = contents(out, "other"); !strings.Contains(got, "3DES") && !strings.Contains(got, "TripleDES") {
+		t.Errorf("legacy: got\n%s", got)
+	}
+
+	if _, err := s.runEnv([]string{ENV_P12_PASS + "=other"}, "", "export", "-p12", NAME_CA); err == nil {
+		t.Error("export of the CA: got no error")
+	}
+}
+
+func TestSidecar(t *testing.T) {
+	s := newTestStore(t, true)
+	s.issue("web", "-host", "web.example.com")
+	keystore := filepath.Join(t.TempDir(), "keystore.p12")
+
+	// serial returns the serial number of the certificate in the keystore.
+	serial := func() string {
+		t.Helper()
+		out, err := exec.Command("openssl", "pkcs12", "-in", keystore, "-passin", "pass:secret",
+			"-nokeys", "-clcerts").CombinedOutput()
+		if err != nil {
+			t.Fatalf("%s\n%s", err, out)
+		}
+		block, _ := pem.Decode(out[bytes.Index(out, []byte("-----BEGIN")):])
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return easycert.SerialHex(cert.SerialNumber)
+	}
+
+	for _, args := range [][]string{
+		{"sidecar", "-watch", "web"},
+		{"sidecar", "-watch", "web", "-keystore", "keystore.pem", "-password", "secret"},
+		{"sidecar", "-watch", "web", "-keystore", keystore},
+	} {
+		if _, err := s.run("", args...); err == nil {
+			t.Errorf("%q: got no error", args)
+		}
+	}
+
+	s.mustRun("", "sidecar", "-watch", "web", "-keystore", keystore, "-password", "secret", "-once")
+	checkMode(t, keystore, 0600)
+	if got, want := serial(), easycert.SerialHex(s.cert("web").SerialNumber); got != want {
+		t.Errorf("got serial %s, want %s", got, want)
+	}
+
+	cmd := exec.Command(os.Args[0], "sidecar", "-watch", "web", "-keystore", keystore, "-interval", "100ms")
+	cmd.Env = append(append([]string{}, s.env...), ENV_P12_PASS+"=secret")
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer cmd.Process.Kill()
+
+	s.mustRun(dnInput("web"), "req", "-reissue", "web")
+	s.mustRun(signInput, "sign", "web")
+	want := easycert.SerialHex(s.cert("web").SerialNumber)
+	for i := 0; serial() != want; i++ {
+		if i == 50 {
+			t.Fatalf("renewed certificate not synced: got serial %s, want %s", serial(), want)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+func TestMobileConfig(t *testing.T) {
+	s := newTestStore(t, true)
+	ca := s.cert(NAME_CA)
+	s.issue("web", "-host", "web.example.com")
+
+	// plistNode is an element of the property list.
+	type plistNode struct {
+		XMLName xml.Name
+		Text    string      `xml:",chardata"`
+		Nodes   []plistNode `xml:",any"`
+	}
+	// payloads returns the values of the keys of every payload.
+	payloads := func(file string) []map[string]string {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var plist plistNode
+		if err = xml.Unmarshal(data, &plist); err != nil {
+			t.Fatalf("%s: %s", err, data)
+		}
+		profile := plist.Nodes[0].Nodes
+		if profile[0].Text != "PayloadContent" {
+			t.Fatalf("got first key %q", profile[0].Text)
+		}
+
+		var list []map[string]string
+		for _, dict := range profile[1].Nodes {
+			m := make(map[string]string)
+			for i := 0; i+1 < len(dict.Nodes); i += 2 {
+				m[dict.Nodes[i].Text] = strings.Join(strings.Fields(dict.Nodes[i+1].Text), "")
+			}
+			list = append(list, m)
+		}
+		return list
+	}
+
+	dir := t.TempDir()
+	out := filepath.Join(dir, "web.mobileconfig")
+	s.mustRun("", "export", "-mobileconfig", "-out", out, "web")
+	checkMode(t, out, 0644)
+	list := payloads(out)
+	if len(list) != 1 || list[0]["PayloadType"] != PAYLOAD_ROOT ||
+		list[0]["PayloadContent"] != base64.StdEncoding.EncodeToString(ca.Raw) {
+		t.Fatalf("got payloads %v", list)
+	}
+
+	// The same profile at exporting it again.
+	out2 := filepath.Join(dir, "web2.mobileconfig")
+	s.mustRun("", "export", "-mobileconfig", "-out", out2, "web")
+	data, err := os.ReadFile(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data2, err := os.ReadFile(out2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, data2) {
+		t.Errorf("exported again: got\n%s\nwant\n%s", data2, data)
+	}
+	if _, err = s.run("", "export", "-mobileconfig", "-out", out, "web"); err == nil {
+		t.Error("export to existing file: got no error")
+	}
+
+	out = filepath.Join(dir, "ca.mobileconfig")
+	s.mustRun("", "export", "-mobileconfig", "-out", out, "ca")
+	if list := payloads(out); len(list) != 1 || list[0]["PayloadType"] != PAYLOAD_ROOT {
+		t.Errorf("CA: got payloads %v", list)
+	}
+	if _, err = s.run("", "export", "-mobileconfig", "-identity", "-out", filepath.Join(dir, "id.mobileconfig"), "ca"); err == nil {
+		t.Error("export -identity of the CA: got no error")
+	}
+
+	out = filepath.Join(dir, "identity.mobileconfig")
+	if _, err = s.run("", "export", "-mobileconfig", "-identity", "-out", out, "web"); err == nil {
+		t.Errorf("export -identity without %s: got no error", ENV_P12_PASS)
+	}
+	env := []string{ENV_P12_PASS + "=p12-pass"}
+	if o, err := s.runEnv(env, "", "export", "-mobileconfig", "-identity", "-out", out, "web"); err != nil {
+		t.Fatalf("%s\n%s", err, o)
+	}
+	checkMode(t, out, 0600)
+	list = payloads(out)
+	if len(list) != 2 || list[1]["PayloadType"] != PAYLOAD_PKCS12 {
+		t.Fatalf("got payloads %v", list)
+	}
+	p12, err := base64.StdEncoding.DecodeString(list[1]["PayloadContent"])
+	if err != nil {
+		t.Fatal(err)
+	}
+	cmd := exec.Command("openssl", "pkcs12", "-nokeys", "-passin", "pass:p12-pass")
+	cmd.Stdin = bytes.NewReader(p12)
+	if o, err := cmd.CombinedOutput(); err != nil || !strings.Contains(string(o), "BEGIN CERTIFICATE") {
+		t.Errorf("PKCS#12: %v\n%s", err, o)
+	}
+}
+
+func TestAndroid(t *testing.T) {
+	s := newTestStore(t, true)
+	ca := s.cert(NAME_CA)
+	s.issue("web")
+
+	out := filepath.Join(t.TempDir(), "app")
+	s.mustRun("", "export", "-android", "-out", out, "web")
+
+	der, err := os.ReadFile(filepath.Join(out, "res", "raw", "easycert_ca.der"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(der, ca.Raw) {
+		t.Error("res/raw/easycert_ca.der: got other certificate than the CA")
+	}
+
+	data, err := os.ReadFile(filepath.Join(out, "res", "xml", "network_security_config.xml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var config struct {
+		Anchors []struct {
+			Src string `xml:"src,attr"`
+		} `xml:"debug-overrides>trust-anchors>certificates"`
+	}
+	if err = xml.Unmarshal(data, &config); err != nil {
+		t.Fatal(err)
+	}
+	if len(config.Anchors) != 1 || config.Anchors[0].Src != "@raw/easycert_ca" {
+		t.Errorf("got configuration:\n%s", data)
+	}
+
+	if _, err = s.run("", "export", "-android", "-out", out, "web"); err == nil {
+		t.Error("export to existing directory: got no error")
+	}
+}
+
+func TestBrowserPolicy(t *testing.T) {
+	s := newTestStore(t, true)
+	ca := s.cert(NAME_CA)
+	s.issue("web")
+
+	out := filepath.Join(t.TempDir(), "policy")
+	s.mustRun("", "export", "-browser-policy", "-out", out, "web")
+
+	var chrome struct {
+		CACertificates []string
+	}
+	data, err := os.ReadFile(filepath.Join(out, "chrome", "easycert.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = json.Unmarshal(data, &chrome); err != nil {
+		t.Fatal(err)
+	}
+	if len(chrome.CACertificates) != 1 || chrome.CACertificates[0] != base64.StdEncoding.EncodeToString(ca.Raw) {
+		t.Errorf("chrome: got %s", data)
+	}
+
+	var firefox struct {
+		Policies struct {
+			Certificates struct {
+				Install []string
+			}
+		} `json:"policies"`
+	}
+	data, err = os.ReadFile(filepath.Join(out, "firefox", "policies.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = json.Unmarshal(data, &firefox); err != nil {
+		t.Fatal(err)
+	}
+	install := firefox.Policies.Certificates.Install
+	if len(install) != 1 {
+		t.Fatalf("firefox: got %s", data)
+	}
+	cert, err := parseCertFile(filepath.Join(out, "firefox", install[0]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !cert.Equal(ca) {
+		t.Errorf("firefox: %s is not the CA", install[0])
+	}
+}
+
+func TestTrust(t *testing.T) {
+	s := newTestStore(t, true)
+	ca := s.cert(NAME_CA)
+
+	// Fake programs which record their arguments.
+	bin := t.TempDir()
+	logFile := filepath.Join(bin, "log")
+	distros := filepath.Join(bin, "distros")
+	var list []byte
+	for _, r := range "\ufeffUbuntu\r\ndocker-desktop\r\nFedora\r\n" {
+		list = append(list, byte(r), byte(r>>8))
+	}
+	if err := os.WriteFile(distros, list, 0644); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{CMD_WSL, CMD_SSH, CMD_MULTIPASS} {
+		script := fmt.Sprintf("#!/bin/sh\nif [ \"$1\" = -l ]; then cat %s; exit; fi\necho \"$(basename $0) $*\" >> %s\n",
+			distros, logFile)
+		if err := os.WriteFile(filepath.Join(bin, name), []byte(script), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	env := []string{"PATH=" + bin + string(os.PathListSeparator) + os.Getenv("PATH")}
+
+	readLog := func() string {
+		t.Helper()
+		data, err := os.ReadFile(logFile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		os.Remove(logFile)
+		return string(data)
+	}
+	caPEM := string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.Raw}))
+
+	if out, err := s.runEnv(env, "", "trust", "-wsl"); err != nil {
+		t.Fatalf("%s\n%s", err, out)
+	}
+	got := readLog()
+	for _, want := range []string{
+		CMD_WSL + " -d Ubuntu -u root -e sh -c set -e",
+		CMD_WSL + " -d Fedora -u root -e sh -c set -e",
+		caPEM,
+		"update-ca-trust extract",
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("wsl: got no %q in:\n%s", want, got)
+		}
+	}
+	if strings.Contains(got, "docker-desktop") {
+		t.Errorf("wsl: got distribution of Docker Desktop:\n%s", got)
+	}
+
+	if out, err := s.runEnv(env, "", "trust", "-vm", "dev@vm1,multipass:dev"); err != nil {
+		t.Fatalf("%s\n%s", err, out)
+	}
+	got = readLog()
+	for _, want := range []string{
+		CMD_SSH + " dev@vm1 -- sudo sh -c 'set -e",
+		CMD_MULTIPASS + " exec dev -- sudo sh -c set -e",
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("vm: got no %q in:\n%s", want, got)
+		}
+	}
+
+	out, err := s.runEnv(env, "", "trust", "-vm", "vm2", "-dry-run")
+	if err != nil || !strings.Contains(out, "== "+CMD_SSH+" vm2 --") {
+		t.Errorf("dry run: got %v\n%s", err, out)
+	}
+	if _, err = os.Stat(logFile); !os.IsNotExist(err) {
+		t.Error("dry run: got commands run")
+	}
+	if _, err = s.run("", "trust", "-wsl", "-vm", "vm2"); err == nil {
+		t.Error("trust -wsl -vm: got no error")
+	}
+}
+
+func TestDeploy(t *testing.T) {
+	s := newTestStore(t, true)
+	s.issue("db", "-host", "db.example.com")
+	dir := t.TempDir()
+
+	if _, err := s.run("", "deploy", "db"); err == nil {
+		t.Error("deploy without service: got no error")
+	}
+
+	out := filepath.Join(dir, "mongodb")
+	s.mustRun("", "deploy", "-mongodb", "-out", out, "db")
+	checkMode(t, filepath.Join(out, "db.pem"), 0600)
+	checkMode(t, filepath.Join(out, "ca.pem"), 0644)
+	data, err := os.ReadFile(filepath.Join(out, "db.pem"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(data, []byte("BEGIN CERTIFICATE")) || !bytes.Contains(data, []byte("PRIVATE KEY")) {
+		t.Errorf("mongodb: certificateKeyFile without certificate or key:\n%s", data)
+	}
+	if data, err = os.ReadFile(filepath.Join(out, "mongod.conf")); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(data, []byte("certificateKeyFile: "+filepath.Join(out, "db.pem")+"\n")) {
+		t.Errorf("mongodb: got configuration\n%s", data)
+	}
+
+	out = filepath.Join(dir, "rabbitmq")
+	s.mustRun("", "deploy", "-rabbitmq", "-out", out, "db")
+	checkMode(t, filepath.Join(out, "server_key.pem"), 0600)
+	checkMode(t, filepath.Join(out, "server_certificate.pem"), 0644)
+	if data, err = os.ReadFile(filepath.Join(out, "rabbitmq.conf")); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(data, []byte("ssl_options.keyfile = "+filepath.Join(out, "server_key.pem")+"\n")) {
+		t.Errorf("rabbitmq: got configuration\n%s", data)
+	}
+
+	if _, err = s.run("", "deploy", "-rabbitmq", "-out", out, "db"); err == nil {
+		t.Error("deploy into an existing directory: got no error")
+	}
+
+	// The root CA is only sent by the server with -with-root, and chk warns.
+	if data, err = os.ReadFile(filepath.Join(out, "server_certificate.pem")); err != nil {
+		t.Fatal(err)
+	}
+	if n := bytes.Count(data, []byte("BEGIN CERTIFICATE")); n != 1 {
+		t.Errorf("rabbitmq: got %d certificates in certfile, want 1", n)
+	}
+	if output := s.mustRun("", "chk", "-cert", filepath.Join(out, "server_certificate.pem")); strings.Contains(output, "Root CA") {
+		t.Errorf("chk without root: got warning\n%s", output)
+	}
+	out = filepath.Join(dir, "rabbitmq-root")
+	if output := s.mustRun("", "deploy", "-rabbitmq", "-with-root", "-out", out, "db"); !strings.Contains(output, "* Root CA sent") {
+		t.Errorf("deploy -with-root: got no warning\n%s", output)
+	}
+	if data, err = os.ReadFile(filepath.Join(out, "server_certificate.pem")); err != nil {
+		t.Fatal(err)
+	}
+	if n := bytes.Count(data, []byte("BEGIN CERTIFICATE")); n != 2 {
+		t.Errorf("rabbitmq -with-root: got %d certificates in certfile, want 2", n)
+	}
+	if output := s.mustRun("", "chk", "-cert", filepath.Join(out, "server_certificate.pem")); !strings.Contains(output, "* Root CA in the chain") {
+		t.Errorf("chk with root: got no warning\n%s", output)
+	}
+	if _, err = s.run("", "deploy", "-winrm", "-with-root", "-dry-run", "db"); err == nil {
+		t.Error("deploy -winrm -with-root: got no error")
+	}
+
+	if _, err = s.run("", "deploy", "-iis", "Default Web Site", "-winrm", "db"); err == nil {
+		t.Error("deploy -iis -winrm: got no error")
+	}
+	if _, err = s.run("", "deploy", "-iis", "Default Web Site", "-iis-port", "0", "db"); err == nil {
+		t.Error("deploy -iis with wrong port: got no error")
+	}
+	thumbprint := fmt.Sprintf("%X", sha1.Sum(s.cert("db").Raw))
+	script := s.mustRun("", "deploy", "-iis", "Bob's Site", "-iis-port", "8443", "-dry-run", "db")
+	for _, v := range []string{
+		"Import-PfxCertificate -FilePath $env:EASYCERT_PFX_FILE -CertStoreLocation Cert:\\LocalMachine\\My",
+		"New-WebBinding -Name 'Bob''s Site' -Protocol https -Port 8443",
+		".AddSslCertificate('" + thumbprint + "', 'My')",
+	} {
+		if !strings.Contains(script, v) {
+			t.Errorf("iis: script without %q:\n%s", v, script)
+		}
+	}
+	script = s.mustRun("", "deploy", "-winrm", "-dry-run", "db")
+	if !strings.Contains(script, "-HostName 'db.example.com' -CertificateThumbPrint '"+thumbprint+"'") {
+		t.Errorf("winrm: got script\n%s", script)
+	}
+	if runtime.GOOS != "windows" {
+		if _, err = s.run("", "deploy", "-winrm", "db"); err == nil {
+			t.Error("winrm out of Windows: got no error")
+		}
+	}
+}
+
+func TestMatter(t *testing.T) {
+	s := newTestStore(t, false)
+	dir := filepath.Join(t.TempDir(), "matter")
+
+	if _, err := s.run("", "matter", "-vid", "FFFG", "-out", dir, "dev1"); err == nil {
+		t.Error("matter with wrong vendor ID: got no error")
+	}
+	s.mustRun("", "matter", "-vid", "fff1", "-pid", "8001", "-out", dir, "dev1")
+	s.mustRun("", "matter", "-vid", "FFF1", "-pid", "8002", "-out", dir, "dev2")
+	checkMode(t, filepath.Join(dir, "dev1"+EXT_KEY), 0400)
+
+	certs := make(map[string]*x509.Certificate)
+	for _, name := range []string{NAME_PAA, NAME_PAI, "dev1", "dev2"} {
+		data, err := os.ReadFile(filepath.Join(dir, name+EXT_DER))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if certs[name], err = x509.ParseCertificate(data); err != nil {
+			t.Fatal(err)
+		}
+		if vid := matterID(certs[name], oidMatterVID); vid != "FFF1" {
+			t.Errorf("%s: got vendor ID %q", name, vid)
+		}
+		if _, ok := certs[name].PublicKey.(*ecdsa.PublicKey); !ok ||
+			certs[name].SignatureAlgorithm != x509.ECDSAWithSHA256 {
+			t.Errorf("%s: got key %T, signature %s", name, certs[name].PublicKey, certs[name].SignatureAlgorithm)
+		}
+	}
+	if pid := matterID(certs["dev2"], oidMatterPID); pid != "8002" {
+		t.Errorf("DAC: got product ID %q", pid)
+	}
+	if pai := certs[NAME_PAI]; !pai.IsCA || pai.MaxPathLen != 0 || !pai.MaxPathLenZero {
+		t.Errorf("PAI: got CA %v, path length %d", pai.IsCA, pai.MaxPathLen)
+	}
+	dac := certs["dev1"]
+	if dac.IsCA || dac.KeyUsage != x509.KeyUsageDigitalSignature {
+		t.Errorf("DAC: got CA %v, key usage %d", dac.IsCA, dac.KeyUsage)
+	}
+
+	// The second device shares the PAA and the PAI.
+	roots, intermediates := x509.NewCertPool(), x509.NewCertPool()
+	roots.AddCert(certs[NAME_PAA])
+	intermediates.AddCert(certs[NAME_PAI])
+	for _, name := range []string{"dev1", "dev2"} {
+		if _, err := certs[name].Verify(x509.VerifyOptions{
+			Roots:         roots,
+			Intermediates: intermediates,
+			KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+		}); err != nil {
+			t.Errorf("%s: %s", name, err)
+		}
+	}
+
+	if _, err := s.run("", "matter", "-vid", "FFF2", "-out", dir, "dev3"); err == nil {
+		t.Error("matter with the PAA of another vendor: got no error")
+	}
+	checkNotExist(t, filepath.Join(dir, "dev3"+EXT_KEY), filepath.Join(dir, "dev3"+EXT_CERT))
+
+	// Creating the PAA needs the role to create a CA.
+	env := s.setOperators(map[string]string{systemUser(t): ROLE_ISSUER})
+	other := filepath.Join(t.TempDir(), "matter")
+	if _, err := s.runEnv(env, "", "matter", "-vid", "FFF1", "-out", other, "dev1"); err == nil {
+		t.Error("matter with a new PAA by issuer: got no error")
+	}
+	if out, err := s.runEnv(env, "", "matter", "-vid", "FFF1", "-out", dir, "dev4"); err != nil {
+		t.Errorf("matter by issuer: %s\n%s", err, out)
+	}
+}
+
+func TestChallenge(t *testing.T) {
+	s := newTestStore(t, true)
+
+	if _, err := s.runEnv([]string{"CHALLENGE=short"}, dnInput("web"), "req", "-challenge", "env:CHALLENGE", "web"); err == nil {
+		t.Error("req with short challenge password: got no error")
+	}
+	if _, err := s.run(dnInput("web"), "req", "-challenge", "secret-of-web", "web"); err == nil {
+		t.Error("req with challenge password in the command line: got no error")
+	}
+	checkNotExist(t, s.file("web"+EXT_REQUEST))
+
+	file := filepath.Join(t.TempDir(), "challenge")
+	if err := os.WriteFile(file, []byte("secret-of-web\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	s.mustRun(dnInput("web"), "req", "-challenge", "file:"+file, "web")
+
+	out, err := exec.Command("openssl", "req", "-in", s.file("web"+EXT_REQUEST), "-noout", "-text").CombinedOutput()
+	if err != nil {
+		t.Fatalf("%s\n%s", err, out)
+	}
+	if !bytes.Contains(out, []byte("challengePassword")) || !bytes.Contains(out, []byte("secret-of-web")) {
+		t.Errorf("request without challenge password:\n%s", out)
+	}
+	data, err := os.ReadFile(s.file("web.cfg"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(data, []byte("secret-of-web")) {
+		t.Errorf("challenge password kept in the configuration:\n%s", data)
+	}
+}
+
+func TestDevID(t *testing.T) {
+	s := newTestStore(t, true)
+
+	if _, err := s.run("", "req", "-idevid", "dev"); err == nil {
+		t.Error("req -idevid without hardware module: got no error")
+	}
+	if _, err := s.run("", "req", "-hw-type", "1.3.6.1.4.1.6175.10.1", "-hw-serial", "SN#1", "dev"); err == nil {
+		t.Error("req with wrong serial number: got no error")
+	}
+
+	s.mustRun("", "req", "-idevid", "-hw-type", "1.3.6.1.4.1.6175.10.1", "-hw-serial", "SN-0042", "dev")
+	s.mustRun(signInput, "sign", "dev")
+	cert := s.cert("dev")
+	if cert.NotAfter.Year() != 9999 {
+		t.Errorf("IDevID: got expiration %s", cert.NotAfter)
+	}
+	if cert.Subject.CommonName != "dev" || cert.Subject.SerialNumber != "SN-0042" ||
+		cert.KeyUsage != x509.KeyUsageDigitalSignature|x509.KeyUsageKeyEncipherment {
+		t.Errorf("IDevID: got subject %q, key usage %d", cert.Subject, cert.KeyUsage)
+	}
+
+	var hwType asn1.ObjectIdentifier
+	var hwSerial []byte
+	for _, ext := range cert.Extensions {
+		if !ext.Id.Equal(asn1.ObjectIdentifier{2, 5, 29, 17}) {
+			continue
+		}
+		var names []asn1.RawValue
+		if _, err := asn1.Unmarshal(ext.Value, &names); err != nil {
+			t.Fatal(err)
+		}
+		for _, v := range names {
+			var other struct {
+				ID    asn1.ObjectIdentifier
+				Value asn1.RawValue `asn1:"explicit,tag:0"`
+			}
+			if v.Tag != 0 {
+				continue
+			}
+			if _, err := asn1.UnmarshalWithParams(v.FullBytes, &other, "tag:0"); err != nil {
+				t.Fatal(err)
+			}
+			if other.ID.String() != OID_HW_MODULE_NAME {
+				continue
+			}
+			var hw struct {
+				Type   asn1.ObjectIdentifier
+				Serial []byte
+			}
+			if _, err := asn1.Unmarshal(other.Value.Bytes, &hw); err != nil {
+				t.Fatal(err)
+			}
+			hwType, hwSerial = hw.Type, hw.Serial
+		}
+	}
+	if hwType.String() != "1.3.6.1.4.1.6175.10.1" || string(hwSerial) != "SN-0042" {
+		t.Errorf("hardwareModuleName: got %s, %q", hwType, hwSerial)
+	}
+
+	s.mustRun("", "req", "-hw-type", "1.3.6.1.4.1.6175.10.1", "-hw-serial", "SN-0043", "ldev")
+	s.mustRun(signInput, "sign", "ldev")
+	if cert = s.cert("ldev"); cert.NotAfter.After(time.Now().AddDate(1, 0, 1)) {
+		t.Errorf("LDevID: got expiration %s", cert.NotAfter)
+	}
+}
+
+func TestProtocol(t *testing.T) {
+	s := newTestStore(t, true)
+
+	for _, args := range [][]string{
+		{"-protocol", "smtp", "-host", "mail.example.com"},
+		{"-protocol", PROTOCOL_RDP},
+		{"-protocol", PROTOCOL_LDAPS, "-saml"},
+		{"-protocol", PROTOCOL_TLS_ALPN, "-host", "www.example.com"},
+		{"-protocol", PROTOCOL_TLS_ALPN, "-key-authorization", "token.thumb", "-host", "a.example.com,b.example.com"},
+		{"-key-authorization", "token.thumb", "-host", "www.example.com"},
+	} {
+		if _, err := s.run("", append(append([]string{"req"}, args...), "bad")...); err == nil {
+			t.Errorf("req %q: got no error", args)
+		}
+	}
+
+	cert := s.issue("rdp", "-protocol", PROTOCOL_RDP, "-host", "desktop.example.com")
+	if len(cert.ExtKeyUsage) != 1 || cert.ExtKeyUsage[0] != x509.ExtKeyUsageServerAuth ||
+		len(cert.UnknownExtKeyUsage) != 1 || cert.UnknownExtKeyUsage[0].String() != OID_RDP_AUTH {
+		t.Errorf("rdp: got extended key usages %v, %v", cert.ExtKeyUsage, cert.UnknownExtKeyUsage)
+	}
+	if cert.KeyUsage != x509.KeyUsageDigitalSignature|x509.KeyUsageKeyEncipherment {
+		t.Errorf("rdp: got key usage %d", cert.KeyUsage)
+	}
+	s.mustRun(signInput, "renew", "rdp")
+	if got := certProtocol(s.cert("rdp")); got != PROTOCOL_RDP {
+		t.Errorf("renew rdp: got protocol %q", got)
+	}
+
+	// The extensions are signed by the native backend too.
+	s.mustRun("", "req", "-backend", BACKEND_NATIVE, "-protocol", PROTOCOL_LDAPS, "-host", "dc1.example.com", "ldap")
+	s.mustRun("", "sign", "-backend", BACKEND_NATIVE, "ldap")
+	if got := certProtocol(s.cert("ldap")); got != PROTOCOL_LDAPS {
+		t.Errorf("ldaps: got protocol %q", got)
+	}
+
+	cert = s.issue("alpn", "-protocol", PROTOCOL_TLS_ALPN, "-key-authorization", "token.thumb", "-host", "www.example.com")
+	digest := sha256.Sum256([]byte("token.thumb"))
+	var found bool
+	for _, ext := range cert.Extensions {
+		if ext.Id.String() != OID_ACME_IDENTIFIER {
+			continue
+		}
+		var value []byte
+		if _, err := asn1.Unmarshal(ext.Value, &value); err != nil {
+			t.Fatal(err)
+		}
+		if !ext.Critical || !bytes.Equal(value, digest[:]) {
+			t.Errorf("acmeIdentifier: got critical %v, value %x", ext.Critical, value)
+		}
+		found = true
+	}
+	if !found {
+		t.Error("tls-alpn-01: got no acmeIdentifier")
+	}
+	if _, err := s.run(signInput, "renew", "alpn"); err == nil {
+		t.Error("renew tls-alpn-01: got no error")
+	}
+
+	// Domain controller of Active Directory.
+	guid := "6f9619ff-8b86-d011-b42d-00c04fc964ff"
+	for _, args := range [][]string{
+		{"-protocol", PROTOCOL_DC, "-host", "dc1.lab.example.com"},
+		{"-protocol", PROTOCOL_DC, "-realm", "LAB", "-host", "dc1.lab.example.com"},
+		{"-protocol", PROTOCOL_DC, "-realm", "LAB.EXAMPLE.COM", "-dc-guid", "6f9619ff", "-host", "dc1.lab.example.com"},
+		{"-protocol", PROTOCOL_LDAPS, "-realm", "LAB.EXAMPLE.COM", "-host", "dc1.lab.example.com"},
+		{"-protocol", PROTOCOL_DC, "-realm", "LAB.EXAMPLE.COM", "-host", "dc1.lab.example.com", "-backend", BACKEND_NATIVE},
+	} {
+		if _, err := s.run("", append(append([]string{"req"}, args...), "bad")...); err == nil {
+			t.Errorf("req %q: got no error", args)
+		}
+	}
+	cert = s.issue("dc1", "-protocol", PROTOCOL_DC, "-realm", "lab.example.com", "-dc-guid", "{"+strings.ToUpper(guid)+"}", "-host", "dc1.lab.example.com")
+	checkDC := func(cert *x509.Certificate) {
+		t.Helper()
+		if got := certProtocol(cert); got != PROTOCOL_DC {
+			t.Errorf("dc: got protocol %q", got)
+		}
+		if len(cert.DNSNames) != 2 || cert.DNSNames[1] != "lab.example.com" {
+			t.Errorf("dc: got DNS names %q", cert.DNSNames)
+		}
+		if realm, id, err := certDCIdentity(cert); err != nil || realm != "LAB.EXAMPLE.COM" || id != guid {
+			t.Errorf("dc: got realm %q, GUID %q, error %v", realm, id, err)
+		}
+		var template bool
+		for _, ext := range cert.Extensions {
+			template = template || ext.Id.String() == OID_CERT_TEMPLATE_NAME
+		}
+		if !template || len(cert.ExtKeyUsage) != 2 || len(cert.UnknownExtKeyUsage) != 2 {
+			t.Errorf("dc: got template %v, extended key usages %v, %v", template, cert.ExtKeyUsage, cert.UnknownExtKeyUsage)
+		}
+	}
+	checkDC(cert)
+	// The GUID is stored like in Active Directory.
+	if !bytes.Contains(cert.Raw, []byte{0xff, 0x19, 0x96, 0x6f, 0x86, 0x8b, 0x11, 0xd0}) {
+		t.Error("dc: GUID not in the byte order of Active Directory")
+	}
+	s.mustRun(signInput, "renew", "dc1")
+	checkDC(s.cert("dc1"))
+
+	script := s.mustRun("", "deploy", "-dc", "-dry-run", "dc1")
+	for _, v := range []string{"Import-PfxCertificate", "Cert:\\LocalMachine\\Root", "-addstore NTAuth", "renewServerCertificate"} {
+		if !strings.Contains(script, v) {
+			t.Errorf("deploy -dc: script without %q:\n%s", v, script)
+		}
+	}
+	if _, err := s.run("", "deploy", "-dc", "-dry-run", "rdp"); err == nil {
+		t.Error("deploy -dc of rdp: got no error")
+	}
+}
+
+func TestNebula(t *testing.T) {
+	s := newTestStore(t, false)
+
+	// Fake "nebula-cert", which records its arguments.
+	bin := t.TempDir()
+	log := filepath.Join(bin, "args.log")
+	script := `#!/bin/sh
+echo "$*" >> ` + log + `
+cmd=$1; shift
+while [ $# -gt 1 ]; do
+	case $1 in
+	-out-crt) crt=$2 ;;
+	-out-key) key=$2 ;;
+	esac
+	shift 2
+done
+printf -- '-----BEGIN NEBULA CERTIFICATE-----\n%s\n-----END NEBULA CERTIFICATE-----\n' "$cmd" > "$crt"
+printf -- '-----BEGIN NEBULA X25519 PRIVATE KEY-----\nkey\n-----END NEBULA X25519 PRIVATE KEY-----\n' > "$key"
+`
+	if err := os.WriteFile(filepath.Join(bin, "nebula-cert"), []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	env := []string{"PATH=" + bin + string(os.PathListSeparator) + os.Getenv("PATH")}
+	nebula := func(args ...string) (string, error) {
+		return s.runEnv(env, "", append([]string{"nebula"}, args...)...)
+	}
+
+	if out, err := nebula("-init", "-years", "2"); err != nil {
+		t.Fatalf("%s\n%s", err, out)
+	}
+	checkMode(t, s.file("nebula", "ca"+EXT_KEY), 0400)
+	if _, err := nebula("-init"); err == nil {
+		t.Error("nebula -init with the CA: got no error")
+	}
+
+	if _, err := nebula("-ip", "192.168.100.5", "lighthouse"); err == nil {
+		t.Error("nebula -ip without network: got no error")
+	}
+	if out, err := nebula("-ip", "192.168.100.5/24", "-groups", "servers,ssh", "lighthouse"); err != nil {
+		t.Fatalf("%s\n%s", err, out)
+	}
+	checkMode(t, s.file("nebula", "lighthouse"+EXT_KEY), 0400)
+
+	data, err := os.ReadFile(log)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{" Nebula CA -duration 17520h ", "sign -name lighthouse -ip 192.168.100.5/24 ", "-groups servers,ssh"} {
+		if !strings.Contains(string(data), want) {
+			t.Errorf("arguments of nebula-cert without %q:\n%s", want, data)
+		}
+	}
+
+	out, err := nebula("-pki", "lighthouse")
+	if err != nil {
+		t.Fatalf("%s\n%s", err, out)
+	}
+	for _, want := range []string{"pki:\n  ca: |\n    -----BEGIN NEBULA CERTIFICATE-----\n    ca\n",
+		"  cert: |\n    -----BEGIN NEBULA CERTIFICATE-----\n    sign\n", "  key: |\n    -----BEGIN NEBULA X25519 PRIVATE KEY-----\n"} {
+		if !strings.Contains(out, want) {
+			t.Errorf("nebula -pki: output without %q:\n%s", want, out)
+		}
+	}
+}
+
+func TestAirgap(t *testing.T) {
+	online := newTestStore(t, false)
+	offline := newTestStore(t, true)
+
+	data, err := os.ReadFile(offline.file("certs", NAME_CA+EXT_CERT))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = os.WriteFile(online.file("certs", NAME_CA+EXT_CERT), data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// Fake "qrencode" and "zbarimg", whose images are the text of the codes.
+	bin := t.TempDir()
+	tools := map[string]string{
+		"qrencode": "#!/bin/sh\nwhile [ $# -gt 0 ]; do [ \"$1\" = -o ] && out=$2; shift; done\ncat > \"$out\"\n",
+		"zbarimg":  "#!/bin/sh\nfor f; do :; done\ncat \"$f\"; echo\n",
+	}
+	for name, script := range tools {
+		if err = os.WriteFile(filepath.Join(bin, name), []byte(script), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	env := []string{"PATH=" + bin + string(os.PathListSeparator) + os.Getenv("PATH")}
+	run := func(s *testStore, args ...string) string {
+		t.Helper()
+		out, err := s.runEnv(env, "", append([]string{"airgap"}, args...)...)
+		if err != nil {
+			t.Fatalf("%s: %s\n%s", strings.Join(args, " "), err, out)
+		}
+		return out
+	}
+
+	online.mustRun(dnInput("web"), "req", "web")
+	online.mustRun(dnInput("db"), "req", "-host", "db.example.com", "db")
+
+	dir := t.TempDir()
+	run(online, "-out", filepath.Join(dir, "web.pem"), "export", "web")
+	run(online, "-qr", filepath.Join(dir, "qr"), "export", "db")
+	images, err := filepath.Glob(filepath.Join(dir, "qr", "*.png"))
+	if err != nil || len(images) == 0 {
+		t.Fatalf("no QR codes: %v", err)
+	}
+	run(offline, append([]string{"import", filepath.Join(dir, "web.pem")}, images...)...)
+
+	offline.mustRun(signInput, "sign", "web")
+	offline.mustRun(signInput, "sign", "db")
+	if v := offline.cert("db").DNSNames; len(v) != 1 || v[0] != "db.example.com" {
+		t.Errorf("configuration of the request not exported: got hostnames %v", v)
+	}
+
+	out := run(offline, "-cert", "-qr", filepath.Join(dir, "certs"), "export", "web", "db")
+	digest := out[strings.LastIndex(out, "\t")+1:]
+
+	// The codes are read in any order, from a text file.
+	if images, err = filepath.Glob(filepath.Join(dir, "certs", "*.png")); err != nil || len(images) < 2 {
+		t.Fatalf("want several QR codes, got %v", images)
+	}
+	var lines []string
+	for i := len(images) - 1; i >= 0; i-- {
+		data, err := os.ReadFile(images[i])
+		if err != nil {
+			t.Fatal(err)
+		}
+		lines = append(lines, string(data))
+	}
+	codes := filepath.Join(dir, "codes.txt")
+	if err = os.WriteFile(codes, []byte(strings.Join(lines, "\n")), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err = os.WriteFile(codes+".1", []byte(lines[0]), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if out, err := online.runEnv(env, "", "airgap", "import", codes+".1"); err == nil {
+		t.Errorf("import with a missing code: got no error\n%s", out)
+	}
+
+	if out = run(online, "import", codes); !strings.HasSuffix(out, digest) {
+		t.Errorf("import: digest differs from %s\n%s", digest, out)
+	}
+	for _, name := range []string{"web", "db"} {
+		if !online.cert(name).Equal(offline.cert(name)) {
+			t.Errorf("certificate %q not imported", name)
+		}
+		checkNotExist(t, online.file(name+EXT_REQUEST))
+	}
+
+	// The certificate of another request.
+	offline.issue("app")
+	run(offline, "-cert", "-out", filepath.Join(dir, "app.pem"), "export", "app")
+	online.mustRun(dnInput("app"), "req", "app")
+	if out, err := online.runEnv(env, "", "airgap", "import", filepath.Join(dir, "app.pem")); err == nil {
+		t.Errorf("import of certificate of another key: got no error\n%s", out)
+	}
+}
+
+func TestNativeBackend(t *testing.T) {
+	s := newTestStore(t, false)
+
+	// Without OpenSSL in the path.
+	env := []string{"PATH=" + t.TempDir(), envFlag("backend") + "=" + BACKEND_NATIVE}
+	native := func(args ...string) string {
+		t.Helper()
+		out, err := s.runEnv(env, "", args...)
+		if err != nil {
+			t.Fatalf("%s: %s\n%s", strings.Join(args, " "), err, out)
+		}
+		return out
+	}
+
+	native("ca")
+	ca := s.cert(NAME_CA)
+	if !ca.IsCA || ca.CheckSignatureFrom(ca) != nil {
+		t.Error("CA certificate is not a self-signed CA")
+	}
+	checkMode(t, s.file("private", NAME_CA+EXT_KEY), 0400)
+
+	native("req", "-host", "www.example.com,127.0.0.1", "web")
+	native("chk", "-req", "web")
+	native("sign", "web")
+	cert := s.cert("web")
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca)
+	if _, err := cert.Verify(x509.VerifyOptions{
+		Roots:     roots,
+		DNSName:   "www.example.com",
+		KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+	}); err != nil {
+		t.Error(err)
+	}
+	if len(cert.IPAddresses) != 1 || !cert.IPAddresses[0].Equal(net.ParseIP("127.0.0.1")) {
+		t.Errorf("got IP addresses %v", cert.IPAddresses)
+	}
+	checkMode(t, s.file("private", "web"+EXT_KEY), 0400)
+	checkNotExist(t, s.file("web"+EXT_REQUEST), s.file("web.cfg"))
+
+	// OpenSSL signs with the key of the native CA, into the same database.
+	s.mustRun(dnInput("db"), "req", "db")
+	s.mustRun(signInput, "sign", "db")
+	if out := native("chk", "-cert", "db"); !strings.HasSuffix(out, ": OK\n") {
+		t.Errorf("chk: got %q", out)
+	}
+
+	for _, name := range []string{NAME_CA, "web", "db"} {
+		for _, flag := range []string{"-name", "-issuer", "-end-date", "-hash"} {
+			want := s.mustRun("", "info", flag, name)
+			if got := native("info", flag, name); got != want {
+				t.Errorf("info %s %s: got %q, want %q", flag, name, got, want)
+			}
+		}
+	}
+
+	for _, args := range [][]string{
+		{"req", "-challenge", "env:CHALLENGE", "app"},
+		{"info", "-backend", "none", "web"},
+	} {
+		if out, err := s.runEnv(env, "", args...); err == nil {
+			t.Errorf("%s: got no error\n%s", strings.Join(args, " "), out)
+		}
+	}
+
+	// The native backend signs with the key of a CA created by OpenSSL.
+	s = newTestStore(t, true)
+	s.mustRun(dnInput("api"), "req", "api")
+	native("sign", "api")
+	if err := s.cert("api").CheckSignatureFrom(s.cert(NAME_CA)); err != nil {
+		t.Error(err)
+	}
+	data, err := os.ReadFile(s.file("index.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries := strings.Split(strings.TrimSpace(string(data)), "\n")
+	if len(entries) != 2 || !strings.Contains(entries[1], "\t02\tunknown\t/") ||
+		!strings.HasSuffix(entries[1], "/CN=api") {
+		t.Errorf("got index %q", entries)
+	}
+}
+
+func TestIntermediate(t *testing.T) {
+	s := newTestStore(t, true)
+
+	s.mustRun(dnInput("Test Sub CA"), "ca", "-intermediate", "sub")
+	s.mustRun(dnInput("Test Sub2 CA"), "ca", "-intermediate", "sub2", "-parent", "sub", "-key-type", "ecdsa")
+	if _, err := s.run(dnInput("Test Sub CA"), "ca", "-intermediate", "sub"); err == nil {
+		t.Error("intermediate CA created twice: got no error")
+	}
+	if _, err := s.run(dnInput("Test Sub3 CA"), "ca", "-intermediate", "sub3", "-parent", "none"); err == nil {
+		t.Error("intermediate CA with unknown parent: got no error")
+	}
+	checkNotExist(t, s.file(DIR_INTERMEDIATE, "sub3"))
+	checkMode(t, s.file(DIR_INTERMEDIATE, "sub", "private", NAME_CA+EXT_KEY), 0400)
+
+	s.mustRun(dnInput("web"), "req", "web")
+	if _, err := s.run(signInput, "sign", "-ca", "none", "web"); err == nil {
+		t.Error("sign with unknown CA: got no error")
+	}
+	s.mustRun(signInput, "sign", "-ca", "sub2", "web")
+	web := s.cert("web")
+	if web.Issuer.CommonName != "Test Sub2 CA" {
+		t.Errorf("got issuer %q", web.Issuer.CommonName)
+	}
+
+	// The certificates are recorded in the database of their issuer.
+	for file, want := range map[string][]string{
+		s.file("index.txt"):                           {"CN=Test CA", "CN=Test Sub CA"},
+		s.file(DIR_INTERMEDIATE, "sub", "index.txt"):  {"Test Sub2 CA"},
+		s.file(DIR_INTERMEDIATE, "sub2", "index.txt"): {"CN=web"},
+	} {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, v := range want {
+			if !strings.Contains(string(data), v) {
+				t.Errorf("%s: got no %q in:\n%s", file, v, data)
+			}
+		}
+		if lines := strings.Count(string(data), "\n"); lines != len(want) {
+			t.Errorf("%s: got %d entries, want %d", file, lines, len(want))
+		}
+	}
+
+	data, err := os.ReadFile(s.file("certs", "web"+EXT_FULLCHAIN))
+	if err != nil {
+		t.Fatal(err)
+	}
+	chain := splitCerts(data)
+	if len(chain) != 3 {
+		t.Fatalf("full chain: got %d certificates, want 3", len(chain))
+	}
+	roots := x509.NewCertPool()
+	roots.AddCert(s.cert(NAME_CA))
+	intermediates := x509.NewCertPool()
+	for _, v := range chain[1:] {
+		block, _ := pem.Decode(v)
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			t.Fatal(err)
+		}
+		intermediates.AddCert(cert)
+	}
+	if _, err = web.Verify(x509.VerifyOptions{Roots: roots, Intermediates: intermediates}); err != nil {
+		t.Errorf("full chain: %s", err)
+	}
+
+	// Issued by the root CA, without full chain.
+	s.issue("mail")
+	checkNotExist(t, s.file("certs", "mail"+EXT_FULLCHAIN))
+}
+
+func TestRenew(t *testing.T) {
+	s := newTestStore(t, true)
+	s.mustRun(dnInput("Test Sub CA"), "ca", "-intermediate", "sub")
+	old := s.issue("web", "-host", "www.example.com,10.0.0.1")
+	s.issue("sso", "-saml")
+	s.mustRun(dnInput("api"), "req", "-key-type", "ecdsa", "-curve", "p384", "-host", "api.example.com", "api")
+	s.mustRun(signInput, "sign", "-ca", "sub", "api")
+
+	if _, err := s.run(signInput, "renew", NAME_CA); err == nil {
+		t.Error("renew of the CA: got no error")
+	}
+	if _, err := s.run(signInput, "renew", "none"); err == nil {
+		t.Error("renew of unknown certificate: got no error")
+	}
+
+	// samePublicKey reports whether both certificates have the same key.
+	samePublicKey := func(a, b *x509.Certificate) bool {
+		return bytes.Equal(a.RawSubjectPublicKeyInfo, b.RawSubjectPublicKeyInfo)
+	}
+
+	s.mustRun(signInput, "renew", "-years", "2", "web")
+	web := s.cert("web")
+	if !bytes.Equal(web.RawSubject, old.RawSubject) || web.SerialNumber.Cmp(old.SerialNumber) == 0 {
+		t.Errorf("got subject %q and serial %s", web.Subject, web.SerialNumber)
+	}
+	if strings.Join(web.DNSNames, ",") != "www.example.com" || len(web.IPAddresses) != 1 ||
+		web.IPAddresses[0].String() != "10.0.0.1" {
+		t.Errorf("got names %q, %q", web.DNSNames, web.IPAddresses)
+	}
+	if samePublicKey(web, old) {
+		t.Error("renew: got the same private key")
+	}
+	if got := web.NotAfter.Year() - web.NotBefore.Year(); got != 2 {
+		t.Errorf("renew -years 2: got validity of %d years", got)
+	}
+	checkMode(t, s.file("private", DIR_HISTORY, "web@1"+EXT_KEY), 0400)
+	checkNotExist(t, s.file("web"+EXT_REQUEST))
+
+	s.mustRun(signInput, "renew", "-reuse-key", "web")
+	if !samePublicKey(s.cert("web"), web) {
+		t.Error("renew -reuse-key: got another private key")
+	}
+	if _, err := os.Stat(s.file("certs", DIR_HISTORY, "web@2"+EXT_CERT)); err != nil {
+		t.Error(err)
+	}
+	checkNotExist(t, s.file("private", DIR_HISTORY, "web@2"+EXT_KEY))
+
+	s.mustRun("", "renew", "-backend", "native", "web")
+	if native := s.cert("web"); !bytes.Equal(native.RawSubject, old.RawSubject) ||
+		strings.Join(native.DNSNames, ",") != "www.example.com" {
+		t.Errorf("renew -backend native: got subject %q and names %q", native.Subject, native.DNSNames)
+	}
+
+	s.mustRun(signInput, "renew", "sso")
+	if sso := s.cert("sso"); sso.KeyUsage != x509.KeyUsageDigitalSignature|x509.KeyUsageKeyEncipherment {
+		t.Errorf("renew of SAML: got key usage %v", sso.KeyUsage)
+	}
+
+	s.mustRun(signInput, "renew", "api")
+	api := s.cert("api")
+	if api.Issuer.CommonName != "Test Sub CA" {
+		t.Errorf("renew of intermediate: got issuer %q", api.Issuer.CommonName)
+	}
+	if pub, ok := api.PublicKey.(*ecdsa.PublicKey); !ok || pub.Curve != elliptic.P384() {
+		t.Errorf("renew of ECDSA: got key %T", api.PublicKey)
+	}
+}
+
+// fakeACME is an ACME server which issues the certificates with its own CA,
+// validating the challenges with the function `validate`.
+type fakeACME struct {
+	srv      *httptest.Server
+	caKey    *ecdsa.PrivateKey
+	ca       *x509.Certificate
+	validate func(typ, domain, token, keyAuth string) bool
+	token    string // of the challenges HTTP-01, instead of a valid one
+
+	mu       sync.Mutex
+	nonce    int
+	nonces   map[string]bool             // issued and not used yet
+	accounts map[string]*ecdsa.PublicKey // by URL
+	authz    []*acmeAuthz
+	order    *acmeOrder
+	cert     []byte
+	contact  []string
+}
+
+func newFakeACME(t *testing.T) *fakeACME {
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Fake ACME CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, caKey.Public(), caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca, _ := x509.ParseCertificate(der)
+
+	f := &fakeACME{
+		caKey: caKey, ca: ca, nonces: make(map[string]bool),
+		accounts: make(map[string]*ecdsa.PublicKey),
+	}
+	f.srv = httptest.NewServer(f)
+	t.Cleanup(f.srv.Close)
+	return f
+}
+
+func (f *fakeACME) url(path string) string { return f.srv.URL + path }
+
+func (f *fakeACME) problem(w http.ResponseWriter, status int, detail string) {
+	w.Header().Set("Content-Type", "application/problem+json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(&acmeProblem{Type: "urn:ietf:params:acme:error:malformed", Detail: detail})
+}
+
+// verify returns the payload of the request in JWS, and the URL of its account.
+func (f *fakeACME) verify(r *http.Request) (payload []byte, kid string, err error) {
+	var jws struct{ Protected, Payload, Signature string }
+	if err = json.NewDecoder(r.Body).Decode(&jws); err != nil {
+		return nil, "", err
+	}
+	data, _ := base64.RawURLEncoding.DecodeString(jws.Protected)
+	var hdr struct {
+		Alg, Nonce, URL, Kid string
+		JWK                  *struct{ X, Y string }
+	}
+	if err = json.Unmarshal(data, &hdr); err != nil {
+		return nil, "", err
+	}
+	if hdr.Alg != "ES256" || hdr.URL != f.url(r.URL.Path) || !f.nonces[hdr.Nonce] {
+		return nil, "", fmt.Errorf("wrong header %s", data)
+	}
+	delete(f.nonces, hdr.Nonce)
+
+	var pub *ecdsa.PublicKey
+	if hdr.JWK != nil {
+		x, _ := base64.RawURLEncoding.DecodeString(hdr.JWK.X)
+		y, _ := base64.RawURLEncoding.DecodeString(hdr.JWK.Y)
+		pub = &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		kid = f.url("/account/" + hdr.JWK.X)
+	} else if pub = f.accounts[hdr.Kid]; pub == nil {
+		return nil, "", fmt.Errorf("unknown account %q", hdr.Kid)
+	} else {
+		kid = hdr.Kid
+	}
+	sig, _ := base64.RawURLEncoding.DecodeString(jws.Signature)
+	sum := sha256.Sum256([]byte(jws.Protected + "." + jws.Payload))
+	if len(sig) != 64 || !ecdsa.Verify(pub, sum[:], new(big.Int).SetBytes(sig[:32]), new(big.Int).SetBytes(sig[32:])) {
+		return nil, "", errors.New("wrong signature")
+	}
+	f.accounts[kid] = pub
+
+	payload, err = base64.RawURLEncoding.DecodeString(jws.Payload)
+	return payload, kid, err
+}
+
+func (f *fakeACME) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if r.URL.Path == "/directory" {
+		json.NewEncoder(w).Encode(&acmeDirectory{
+			NewNonce: f.url("/nonce"), NewAccount: f.url("/account"), NewOrder: f.url("/order"),
+		})
+		return
+	}
+	f.nonce++
+	f.nonces[strconv.Itoa(f.nonce)] = true
+	w.Header().Set("Replay-Nonce", strconv.Itoa(f.nonce))
+	if r.URL.Path == "/nonce" {
+		return
+	}
+	payload, kid, err := f.verify(r)
+	if err != nil {
+		f.problem(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	field := strings.Split(r.URL.Path, "/")
+	switch field[1] {
+	case "account":
+		var account struct {
+			Agreed  bool     `json:"termsOfServiceAgreed"`
+			Contact []string `json:"contact"`
+		}
+		json.Unmarshal(payload, &account)
+		if !account.Agreed {
+			f.problem(w, http.StatusForbidden, "terms of service not agreed")
+			return
+		}
+		f.contact = account.Contact
+		w.Header().Set("Location", kid)
+		w.WriteHeader(http.StatusCreated)
+		fmt.Fprint(w, `{"status":"valid"}`)
+	case "order":
+		if len(field) == 3 {
+			json.NewEncoder(w).Encode(f.order)
+			return
+		}
+		var order acmeOrder
+		json.Unmarshal(payload, &order)
+		f.authz = nil
+		order.Authorizations = nil
+		for i, v := range order.Identifiers {
+			token := "token-http-" + strconv.Itoa(i)
+			if f.token != "" {
+				token = f.token
+			}
+			f.authz = append(f.authz, &acmeAuthz{Status: ACME_PENDING, Identifier: v, Challenges: []acmeChallenge{
+				{Type: ACME_HTTP01, URL: f.url("/chal/" + strconv.Itoa(i)), Token: token, Status: ACME_PENDING},
+				{Type: ACME_DNS01, URL: f.url("/chal/" + strconv.Itoa(i)), Token: "token-dns-" + strconv.Itoa(i), Status: ACME_PENDING},
+			}})
+			order.Authorizations = append(order.Authorizations, f.url("/authz/"+strconv.Itoa(i)))
+		}
+		order.Status = ACME_PENDING
+		order.Finalize = f.url("/finalize")
+		f.order = &order
+		w.Header().Set("Location", f.url("/order/1"))
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(f.order)
+	case "authz":
+		i, _ := strconv.Atoi(field[2])
+		json.NewEncoder(w).Encode(f.authz[i])
+	case "chal":
+		i, _ := strconv.Atoi(field[2])
+		authz := f.authz[i]
+		// The challenge is got from the token, since both types share the URL.
+		for _, chal := range authz.Challenges {
+			sum := sha256.Sum256([]byte(fmt.Sprintf(`{"crv":"P-256","kty":"EC","x":"%s","y":"%s"}`,
+				b64(f.accounts[kid].X.FillBytes(make([]byte, 32))), b64(f.accounts[kid].Y.FillBytes(make([]byte, 32))))))
+			keyAuth := chal.Token + "." + b64(sum[:])
+
+			f.mu.Unlock()
+			ok := f.validate(chal.Type, authz.Identifier.Value, chal.Token, keyAuth)
+			f.mu.Lock()
+			if ok {
+				authz.Status = ACME_VALID
+				break
+			}
+		}
+		if authz.Status != ACME_VALID {
+			authz.Status = ACME_INVALID
+		}
+		fmt.Fprint(w, `{}`)
+	case "finalize":
+		var req struct{ CSR string }
+		json.Unmarshal(payload, &req)
+		der, _ := base64.RawURLEncoding.DecodeString(req.CSR)
+		csr, err := x509.ParseCertificateRequest(der)
+		if err != nil {
+			f.problem(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		tmpl := &x509.Certificate{
+			SerialNumber: big.NewInt(time.Now().UnixNano()),
+			Subject:      csr.Subject,
+			DNSNames:     csr.DNSNames,
+			NotBefore:    time.Now().Add(-time.Hour),
+			NotAfter:     time.Now().Add(90 * 24 * time.Hour),
+			ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		}
+		cert, err := x509.CreateCertificate(rand.Reader, tmpl, f.ca, csr.PublicKey, f.caKey)
+		if err != nil {
+			f.problem(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		f.cert = append(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert}),
+			pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: f.ca.Raw})...)
+		f.order.Status = ACME_VALID
+		f.order.Certificate = f.url("/cert")
+		json.NewEncoder(w).Encode(f.order)
+	case "cert":
+		w.Header().Set("Content-Type", "application/pem-certificate-chain")
+		w.Write(f.cert)
+	default:
+		f.problem(w, http.StatusNotFound, "not found")
+	}
+}
+
+func TestACME(t *testing.T) {
+	s := newTestStore(t, false)
+	f := newFakeACME(t)
+	directory := f.url("/directory")
+
+	webroot := t.TempDir()
+	records := filepath.Join(t.TempDir(), "records")
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	listen := ln.Addr().String()
+	ln.Close()
+
+	f.validate = func(typ, domain, token, keyAuth string) bool {
+		switch typ {
+		case ACME_HTTP01:
+			if data, err := os.ReadFile(filepath.Join(webroot, ".well-known", "acme-challenge", token)); err == nil {
+				return string(data) == keyAuth
+			}
+			resp, err := http.Get("http://" + listen + _ACME_CHALLENGE_PATH + token)
+			if err != nil {
+				return false
+			}
+			defer resp.Body.Close()
+			data, _ := io.ReadAll(resp.Body)
+			return string(data) == keyAuth
+		case ACME_DNS01:
+			data, _ := os.ReadFile(records)
+			sum := sha256.Sum256([]byte(keyAuth))
+			record := "_acme-challenge." + strings.TrimPrefix(domain, "*.") + ". " + b64(sum[:])
+			return strings.Contains(string(data), "present "+record)
+		}
+		return false
+	}
+
+	if _, err = s.run("", "acme", "-directory", directory, "-domain", "*.example.com"); err == nil {
+		t.Error("acme of wildcard with HTTP-01: got no error")
+	}
+
+	s.mustRun("", "acme", "-directory", directory, "-email", "admin@example.com", "-listen", listen,
+		"-domain", "example.com,www.example.com")
+	cert := s.cert("example.com")
+	if strings.Join(cert.DNSNames, ",") != "example.com,www.example.com" || cert.Issuer.CommonName != "Fake ACME CA" {
+		t.Errorf("got names %q from %q", cert.DNSNames, cert.Issuer.CommonName)
+	}
+	if strings.Join(f.contact, ",") != "mailto:admin@example.com" {
+		t.Errorf("got contact %q", f.contact)
+	}
+	checkMode(t, s.file("private", "example.com"+EXT_KEY), 0400)
+	checkMode(t, s.file("private", "acme", strings.ReplaceAll(f.srv.Listener.Addr().String(), ":", "_")+EXT_KEY), 0400)
+	if match, _ := filepath.Glob(s.file("chains", "*"+EXT_CERT)); len(match) != 1 {
+		t.Errorf("got chains %q", match)
+	}
+
+	if _, err = s.run("", "acme", "-directory", directory, "-listen", listen, "-domain", "example.com"); err == nil {
+		t.Error("acme of existing certificate: got no error")
+	}
+	s.mustRun("", "acme", "-directory", directory, "-webroot", webroot, "-reissue", "-domain", "example.com")
+	if s.cert("example.com").Equal(cert) {
+		t.Error("acme -reissue: got the same certificate")
+	}
+	if _, err = os.Stat(s.file("certs", DIR_HISTORY, "example.com@1"+EXT_CERT)); err != nil {
+		t.Error(err)
+	}
+	checkNotExist(t, filepath.Join(webroot, ".well-known", "acme-challenge", "token-http-0"))
+
+	// The token is not used like path out of the web root.
+	victim := filepath.Join(webroot, "index.html")
+	if err = os.WriteFile(victim, []byte("home"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	f.token = "../../index.html"
+	if out, err := s.run("", "acme", "-directory", directory, "-webroot", webroot, "-reissue",
+		"-domain", "example.com"); err == nil || !strings.Contains(out, "wrong token") {
+		t.Errorf("acme with token out of the web root: got error %v\n%s", err, out)
+	}
+	if data, err := os.ReadFile(victim); err != nil || string(data) != "home" {
+		t.Errorf("file out of the challenges changed: %q, %v", data, err)
+	}
+	f.token = ""
+
+	// DNS-01 without hook, in batch mode.
+	if _, err = s.run("", "acme", "-directory", directory, "-dns", "-batch", "-domain", "*.example.com", "wild"); err == nil {
+		t.Error("acme -dns without hook: got no error")
+	}
+	hook := "#!/bin/sh\necho \"$EASYCERT_ACTION $EASYCERT_RECORD $EASYCERT_VALUE\" >> " + records + "\n"
+	if err = os.WriteFile(s.file("hooks", HOOK_ACME_DNS), []byte(hook), 0755); err != nil {
+		t.Fatal(err)
+	}
+	s.mustRun("", "acme", "-directory", directory, "-dns", "-key-type", "ecdsa", "-domain", "*.example.com", "wild")
+	wild := s.cert("wild")
+	if strings.Join(wild.DNSNames, ",") != "*.example.com" {
+		t.Errorf("acme -dns: got names %q", wild.DNSNames)
+	}
+	if _, ok := wild.PublicKey.(*ecdsa.PublicKey); !ok {
+		t.Errorf("acme -key-type ecdsa: got key %T", wild.PublicKey)
+	}
+	if data, _ := os.ReadFile(records); !strings.Contains(string(data), "cleanup _acme-challenge.example.com.") {
+		t.Errorf("hook not run to clean up:\n%s", data)
+	}
+}
+
+func TestACMEServe(t *testing.T) {
+	s := newTestStore(t, true)
+	useStore(t, s)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	listen := ln.Addr().String()
+	ln.Close()
+
+	records := filepath.Join(t.TempDir(), "records")
+	port, lookupTXT := acmeHTTPPort, acmeLookupTXT
+	defer func() { acmeHTTPPort, acmeLookupTXT = port, lookupTXT }()
+	_, acmeHTTPPort, _ = net.SplitHostPort(listen)
+	acmeLookupTXT = func(name string) ([]string, error) {
+		data, _ := os.ReadFile(records)
+		var values []string
+		for _, line := range strings.Split(string(data), "\n") {
+			if v := strings.TrimPrefix(line, "present "+name+". "); v != line {
+				values = append(values, v)
+			}
+		}
+		return values, nil
+	}
+
+	srv := httptest.NewServer(newACMEServer("tester", nil))
+	defer srv.Close()
+	directory := srv.URL + "/directory"
+
+	s.mustRun("", "acme", "-directory", directory, "-listen", listen, "-domain", "localhost")
+	cert := s.cert("acme-localhost")
+	if strings.Join(cert.DNSNames, ",") != "localhost" || cert.Subject.CommonName != "localhost" ||
+		cert.Issuer.CommonName != "Test CA" {
+		t.Errorf("got names %q, subject %q from %q", cert.DNSNames, cert.Subject, cert.Issuer.CommonName)
+	}
+	if !s.cert("localhost").Equal(cert) {
+		t.Error("the certificate of the client is not the one issued")
+	}
+	if match, _ := filepath.Glob(s.file(DIR_ACME_ACCOUNTS, "*.json")); len(match) != 1 {
+		t.Errorf("got accounts %q", match)
+	}
+	checkNotExist(t, s.file("acme-localhost"+EXT_REQUEST))
+
+	// Reissued with the same account, keeping the previous version.
+	s.mustRun("", "acme", "-directory", directory, "-listen", listen, "-reissue", "-domain", "localhost")
+	if s.cert("acme-localhost").Equal(cert) {
+		t.Error("acme-serve: got the same certificate")
+	}
+	if _, err = os.Stat(s.file("certs", DIR_HISTORY, "acme-localhost@1"+EXT_CERT)); err != nil {
+		t.Error(err)
+	}
+	if out := s.mustRun("", "audit"); !strings.Contains(out, "acme account") {
+		t.Errorf("audit without the signing by ACME:\n%s", out)
+	}
+
+	hook := "#!/bin/sh\necho \"$EASYCERT_ACTION $EASYCERT_RECORD $EASYCERT_VALUE\" >> " + records + "\n"
+	if err = os.WriteFile(s.file("hooks", HOOK_ACME_DNS), []byte(hook), 0755); err != nil {
+		t.Fatal(err)
+	}
+	s.mustRun("", "acme", "-directory", directory, "-dns", "-domain", "*.apps.localhost", "wild")
+	if names := s.cert("acme-wildcard.apps.localhost").DNSNames; strings.Join(names, ",") != "*.apps.localhost" {
+		t.Errorf("acme-serve with DNS-01: got names %q", names)
+	}
+
+	// Domains out of the allowed ones.
+	other := httptest.NewServer(newACMEServer("tester", []string{"example.com"}))
+	defer other.Close()
+	out, err := s.run("", "acme", "-directory", other.URL+"/directory", "-listen", listen, "-domain", "localhost", "other")
+	if err == nil || !strings.Contains(out, "rejectedIdentifier") {
+		t.Errorf("acme-serve with domain not allowed: got %v\n%s", err, out)
+	}
+}
+
+func TestACMEServeLimits(t *testing.T) {
+	s := newACMEServer("tester", nil)
+
+	// The nonces are bounded, dropping the oldest ones.
+	first := s.newNonce()
+	for i := 0; i < _ACME_MAX_NONCES+10; i++ {
+		s.newNonce()
+	}
+	if len(s.nonces) > _ACME_MAX_NONCES || len(s.queue) > _ACME_MAX_NONCES {
+		t.Errorf("got %d nonces, %d queued", len(s.nonces), len(s.queue))
+	}
+	if _, ok := s.nonces[first]; ok {
+		t.Error("the oldest nonce was not dropped")
+	}
+
+	// The ones expired are dropped.
+	for _, v := range s.queue {
+		s.nonces[v] = time.Now().Add(-_ACME_NONCE_LIFETIME)
+	}
+	nonce := s.newNonce()
+	if len(s.nonces) != 1 || len(s.queue) != 1 || s.queue[0] != nonce {
+		t.Errorf("got %d nonces after expiration, %d queued", len(s.nonces), len(s.queue))
+	}
+
+	// The orders expired are dropped with their authorizations.
+	now := time.Now()
+	for i, v := range []time.Time{now.Add(-time.Minute), now.Add(time.Minute)} {
+		id := strconv.Itoa(i)
+		a := &acmeServerAuthz{id: id}
+		s.authzs[id] = a
+		s.orders[id] = &acmeServerOrder{id: id, Expires: v.UTC().Format(time.RFC3339), authzs: []*acmeServerAuthz{a}}
+	}
+	s.prune(now)
+	if len(s.orders) != 1 || s.orders["1"] == nil || len(s.authzs) != 1 || s.authzs["1"] == nil {
+		t.Errorf("got orders %v, authorizations %v", s.orders, s.authzs)
+	}
+}
+
+func TestState(t *testing.T) {
+	s := newTestStore(t, true)
+	s.mustRun(dnInput("Test Sub CA"), "ca", "-intermediate", "sub")
+	s.issue("web", "-host", "web.example.com,10.0.0.1")
+	s.issue("sso", "-saml")
+	s.issue("old", "-host", "old.example.com")
+
+	out := s.mustRun("", "state", "export")
+	want := `certificates:
+  - name: old
+    profile: server
+    key: rsa-2048
+    hosts:
+      - old.example.com
+  - name: sso
+    profile: saml
+    key: rsa-2048
+  - name: web
+    profile: server
+    key: rsa-2048
+    hosts:
+      - 10.0.0.1
+      - web.example.com
+`
+	if out != want {
+		t.Errorf("state export: got\n%s", out)
+	}
+	file := s.file("state.yaml")
+	s.mustRun("", "state", "-out", file, "export")
+	if out = s.mustRun("", "state", "diff", file); out != "" {
+		t.Errorf("state diff of the export: got\n%s", out)
+	}
+
+	desired := `# Certificates of the services
+certificates:
+- name: web
+  hosts: [web.example.com, www.example.com, 10.0.0.1]
+- name: sso
+  profile: saml
+- name: api
+  key: ecdsa-p256
+  ca: sub
+  hosts:
+    - "api.example.com"
+`
+	if err := os.WriteFile(file, []byte(desired), 0644); err != nil {
+		t.Fatal(err)
+	}
+	out, err := s.run("", "state", "diff", file)
+	if err == nil {
+		t.Error("state diff with changes: got no error")
+	}
+	for _, v := range []string{"+ api\n", "~ web\n", "hosts 10.0.0.1, web.example.com -> 10.0.0.1, web.example.com, www.example.com", "- old\n"} {
+		if !strings.Contains(out, v) {
+			t.Errorf("state diff: got no %q in:\n%s", v, out)
+		}
+	}
+	if strings.Contains(out, "sso") {
+		t.Errorf("state diff: got sso changed:\n%s", out)
+	}
+
+	out = s.mustRun("", "state", "-dry-run", "apply", file)
+	if !strings.Contains(out, "== "+PROGRAM+" sign -batch -ca sub api") {
+		t.Errorf("state apply -dry-run: got\n%s", out)
+	}
+	checkNotExist(t, s.file("certs", "api"+EXT_CERT))
+
+	s.mustRun("", "state", "apply", file)
+	out, _ = s.run("", "state", "diff", file)
+	if out != "- old\n" {
+		t.Errorf("state diff after apply: got\n%s", out)
+	}
+	if api := s.cert("api"); api.Issuer.CommonName != "Test Sub CA" || api.PublicKeyAlgorithm != x509.ECDSA {
+		t.Errorf("api: got issuer %q and key %s", api.Issuer.CommonName, api.PublicKeyAlgorithm)
+	}
+	if web := s.cert("web"); len(web.DNSNames) != 2 {
+		t.Errorf("web: got hostnames %q", web.DNSNames)
+	}
+
+	for _, v := range []string{
+		"certificates:\n- name: a\n  color: blue\n  hosts: [a.example.com]\n",
+		"certificates:\n- name: a\n  profile: spki\n  hosts: [a.example.com]\n",
+		"certificates:\n- name: a\n  key: dsa-1024\n  hosts: [a.example.com]\n",
+		"certificates:\n- name: a\n  hosts: [a.example.com]\n- name: a\n  hosts: [a.example.com]\n",
+	} {
+		if _, err := parseState(strings.NewReader(v)); err == nil {
+			t.Errorf("parse state: got no error for:\n%s", v)
+		}
+	}
+}
+
+func TestECDSA(t *testing.T) {
+	s := newTestStore(t, false)
+
+	if _, err := s.run(dnInput("Test CA"), "ca", "-key-type", "dsa"); err == nil {
+		t.Error("ca -key-type dsa: got no error")
+	}
+	if _, err := s.run(dnInput("Test CA"), "ca", "-key-type", "ecdsa", "-curve", "p192"); err == nil {
+		t.Error("ca -curve p192: got no error")
+	}
+	s.mustRun(dnInput("Test CA"), "ca", "-key-type", "ecdsa", "-curve", "p384")
+	ca := s.cert(NAME_CA)
+	if pub, ok := ca.PublicKey.(*ecdsa.PublicKey); !ok || pub.Curve != elliptic.P384() {
+		t.Fatalf("CA: got key %T", ca.PublicKey)
+	}
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca)
+	for name, args := range map[string][]string{
+		"ec":  {"-key-type", "ecdsa"},
+		"rsa": nil,
+	} {
+		cert := s.issue(name, args...)
+		if _, err := cert.Verify(x509.VerifyOptions{
+			Roots:     roots,
+			KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+		}); err != nil {
+			t.Errorf("%s: %s", name, err)
+		}
+	}
+	if pub, ok := s.cert("ec").PublicKey.(*ecdsa.PublicKey); !ok || pub.Curve != elliptic.P256() {
+		t.Errorf("ec: got key %T, want ECDSA on P-256", s.cert("ec").PublicKey)
+	}
+	if _, ok := s.cert("rsa").PublicKey.(*rsa.PublicKey); !ok {
+		t.Errorf("rsa: got key %T", s.cert("rsa").PublicKey)
+	}
+
+	// The native backend, with the key of the CA made by OpenSSL.
+	env := []string{envFlag("backend") + "=" + BACKEND_NATIVE, envFlag("key-type") + "=ecdsa"}
+	if out, err := s.runEnv(env, "", "req", "-curve", "p521", "native"); err != nil {
+		t.Fatalf("%s\n%s", err, out)
+	}
+	if out, err := s.runEnv(env, "", "sign", "native"); err != nil {
+		t.Fatalf("%s\n%s", err, out)
+	}
+	cert := s.cert("native")
+	if pub, ok := cert.PublicKey.(*ecdsa.PublicKey); !ok || pub.Curve != elliptic.P521() {
+		t.Errorf("native: got key %T, want ECDSA on P-521", cert.PublicKey)
+	}
+	if err := cert.CheckSignatureFrom(ca); err != nil {
+		t.Errorf("native: %s", err)
+	}
+}
+
+func TestAutoSANs(t *testing.T) {
+	s := newTestStore(t, true)
+
+	if _, err := s.run(dnInput("web"), "req", "-host", "web", "web"); err == nil {
+		t.Error("req of short hostname without auto_sans: got no error")
+	}
+
+	config := `{"auto_sans": [".svc.cluster.local", ".internal"]}`
+	if err := os.WriteFile(s.file(FILE_STORE), []byte(config), 0644); err != nil {
+		t.Fatal(err)
+	}
+	cert := s.issue("web", "-host", "web,api.example.com")
+
+	want := []string{"api.example.com", "web.svc.cluster.local", "web.internal"}
+	if strings.Join(cert.DNSNames, ",") != strings.Join(want, ",") {
+		t.Errorf("got DNS names %v, want %v", cert.DNSNames, want)
+	}
+}
+
+func TestValidateDNS(t *testing.T) {
+	s := newTestStore(t, true)
+
+	cert := s.issue("web", "-host", "localhost,127.0.0.1", "-validate-dns")
+	if len(cert.DNSNames) != 1 || len(cert.IPAddresses) != 1 {
+		t.Errorf("got hosts %v %v", cert.DNSNames, cert.IPAddresses)
+	}
+
+	for _, v := range []struct{ host, err string }{
+		{"localhost,typo.invalid", "Hostname does not resolve"},
+		{"localhost,192.0.2.1", "IP address not forward-confirmed"},
+	} {
+		out, err := s.run(dnInput("api"), "req", "-host", v.host, "-validate-dns", "api")
+		if err == nil || !strings.Contains(out, v.err) {
+			t.Errorf("req -host %s: got error %v\n%s", v.host, err, out)
+		}
+		checkNotExist(t, s.file("api"+EXT_REQUEST), s.file("private", "api"+EXT_KEY))
+	}
+
+	// Without the flag, the names are not looked up.
+	s.mustRun(dnInput("api"), "req", "-host", "typo.invalid", "api")
+}
+
+func TestSignRollback(t *testing.T) {
+	s := newTestStore(t, true)
+	s.mustRun(dnInput("web"), "req", "web")
+
+	index, err := os.ReadFile(s.file("index.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	out, err := s.runEnv([]string{ENV_CA_PASS + "=wrong"}, signInput, "sign", "web")
+	if err == nil {
+		t.Fatalf("sign with wrong passphrase: got no error\n%s", out)
+	}
+	if !strings.Contains(out, "== Rollback") {
+		t.Errorf("no rollback:\n%s", out)
+	}
+	checkNotExist(t, s.file("certs", "web"+EXT_CERT))
+
+	got, err := os.ReadFile(s.file("index.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, index) {
+		t.Errorf("database modified:\n%s", got)
+	}
+	db, err := openBolt(s.file(FILE_DB))
+	if err != nil {
+		t.Fatal(err)
+	}
+	st, err := db.load()
+	db.close()
+	if err != nil || st == nil || !bytes.Equal(formatIndex(st.Entries), index) {
+		t.Errorf("database of bolt modified: %+v, %v", st, err)
+	}
+
+	// The request can be signed later.
+	s.mustRun(signInput, "sign", "web")
+	s.cert("web")
+}
+
+func TestInspect(t *testing.T) {
+	s := newTestStore(t, true)
+	s.issue("web")
+	s.mustRun(dnInput("pending"), "req", "pending")
+
+	for _, tt := range []struct {
+		args []string
+		want string
+	}{
+		{[]string{"ls", "-cert"}, "web"},
+		{[]string{"ls", "-req"}, "pending"},
+		{[]string{"ls", "-key"}, "web"},
+		{[]string{"ls", "-tree"}, "    web"},
+		{[]string{"info", "-cert", "-name", "web"}, "CN = web"},
+		{[]string{"info", "-cert", "-issuer", "web"}, "CN = Test CA"},
+		{[]string{"info", "-cert", "-end-date", "web"}, "notAfter="},
+		{[]string{"cat", "-cert", "web"}, "Certificate:"},
+		{[]string{"chk", "-cert", "web"}, ""},
+		{[]string{"chk", "-cert", "-system-roots", "web"}, "OK"},
+		{[]string{"chk", "-key", "web"}, "Key ok"},
+		{[]string{"chk", "-key", "-json", "web"}, `"type": "RSA"`},
+		{[]string{"chk", "-key", "ca"}, "Encrypted:\ttrue"},
+		{[]string{"chk", "-req", "pending"}, ""},
+		{[]string{"info", "-readonly", "-cert", "-name", "web"}, "CN = web"},
+	} {
+		out, err := s.run("", tt.args...)
+		if err != nil {
+			t.Errorf("%s: %s\n%s", strings.Join(tt.args, " "), err, out)
+			continue
+		}
+		if !strings.Contains(out, tt.want) {
+			t.Errorf("%s: output without %q:\n%s", strings.Join(tt.args, " "), tt.want, out)
+		}
+	}
+
+	if _, err := s.run("", "chk", "-cert", "-system-roots", "-ca", "", "web"); err == nil {
+		t.Error("chk -system-roots without the CA: got no error")
+	}
+}
+
+func TestInspectJSON(t *testing.T) {
+	s := newTestStore(t, true)
+	web := s.issue("web", "-host", "www.example.com,127.0.0.1")
+	s.mustRun(dnInput("pending"), "req", "pending")
+
+	var info CertInfo
+	if err := json.Unmarshal([]byte(s.mustRun("", "info", "-json", "web")), &info); err != nil {
+		t.Fatal(err)
+	}
+	if info.Name != "web" || info.Serial != easycert.SerialHex(web.SerialNumber) || info.IsCA ||
+		!strings.Contains(info.Issuer, "Test CA") || !info.NotAfter.Equal(web.NotAfter) {
+		t.Errorf("info -json: got %+v", info)
+	}
+	if strings.Join(info.DNSNames, ",") != "www.example.com" || strings.Join(info.IPAddresses, ",") != "127.0.0.1" {
+		t.Errorf("info -json: got names %q, %q", info.DNSNames, info.IPAddresses)
+	}
+	if info.FingerprintSHA256 != fingerprint(sha256Sum(web.Raw)) {
+		t.Errorf("info -json: got fingerprint %q", info.FingerprintSHA256)
+	}
+
+	var req RequestInfo
+	if err := json.Unmarshal([]byte(s.mustRun("", "info", "-req", "-json", "pending")), &req); err != nil {
+		t.Fatal(err)
+	}
+	if req.Name != "pending" || !strings.Contains(req.Subject, "CN=pending") || !strings.HasPrefix(req.Pin, "sha256/") {
+		t.Errorf("info -req -json: got %+v", req)
+	}
+
+	var records []lsRecord
+	if err := json.Unmarshal([]byte(s.mustRun("", "ls", "-json")), &records); err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, v := range records {
+		got = append(got, v.Type+":"+v.Name)
+		if v.Type == LS_CERT && (v.CertInfo == nil || v.CertInfo.Serial == "") {
+			t.Errorf("ls -json: certificate without information: %+v", v)
+		}
+		if v.Type != LS_CERT && v.CertInfo != nil {
+			t.Errorf("ls -json: %s with information of certificate", v.Type)
+		}
+	}
+	want := "certificate:ca,certificate:web,request:pending,key:ca,key:pending,key:web"
+	if strings.Join(got, ",") != want {
+		t.Errorf("ls -json: got %s, want %s", strings.Join(got, ","), want)
+	}
+	if out := s.mustRun("", "ls", "-json", "-req", "-cert"); strings.Contains(out, `"key"`) {
+		t.Errorf("ls -json -req -cert: got keys\n%s", out)
+	}
+	if _, err := s.run("", "ls", "-json", "-tree"); err == nil {
+		t.Error("ls -json -tree: got no error")
+	}
+}
+
+func TestCheckPublicKey(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := checkPublicKey(&key.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Type != "RSA" || r.Size != 2048 || r.Exponent != 65537 || len(r.Problems) != 0 {
+		t.Errorf("wrong report: %+v", r)
+	}
+
+	for _, pub := range []*rsa.PublicKey{
+		{N: key.N, E: 3}, // small exponent
+		{N: new(big.Int).Rsh(key.N, 1200), E: 65537},                             // small size
+		{N: new(big.Int).Exp(big.NewInt(65537), big.NewInt(200), nil), E: 65537}, // ROCA
+	} {
+		if r, err = checkPublicKey(pub); err != nil {
+			t.Fatal(err)
+		}
+		if len(r.Problems) == 0 {
+			t.Errorf("weak key without problems: %+v", r)
+		}
+	}
+
+	ec, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r, err = checkPublicKey(&ec.PublicKey); err != nil {
+		t.Fatal(err)
+	}
+	if r.Type != "ECDSA" || r.Curve != "P-256" || len(r.Problems) != 0 {
+		t.Errorf("wrong report: %+v", r)
+	}
+}
+
+func TestAuditKeys(t *testing.T) {
+	s := newTestStore(t, true)
+	s.issue("web")
+
+	if out := s.mustRun("", "audit-keys"); !strings.Contains(out, "No weak or shared keys") {
+		t.Errorf("audit-keys: wrong output:\n%s", out)
+	}
+
+	// The key of "web" is used by another service.
+	for _, v := range [][2]string{
+		{s.file("certs", "web"+EXT_CERT), s.file("certs", "api"+EXT_CERT)},
+		{s.file("private", "web"+EXT_KEY), s.file("private", "api"+EXT_KEY)},
+	} {
+		data, err := os.ReadFile(v[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = os.WriteFile(v[1], data, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	out, err := s.run("", "audit-keys", "-json")
+	if err == nil {
+		t.Error("audit-keys with a shared key: got no error")
+	}
+	if !strings.Contains(out, "key shared by 2 names") || strings.Contains(out, `"name": "ca"`) {
+		t.Errorf("audit-keys: wrong output:\n%s", out)
+	}
+}
+
+func TestStats(t *testing.T) {
+	s := newTestStore(t, true)
+	s.issue("web1.old")
+	s.issue("web2")
+	s.mustRun("", "revoke", "-all", "-cn", "*.old")
+
+	var stats storeStats
+	if err := json.Unmarshal([]byte(s.mustRun("", "stats", "-json")), &stats); err != nil {
+		t.Fatal(err)
+	}
+	count := func(list []statsCount, name string) int {
+		for _, v := range list {
+			if v.Name == name {
+				return v.Count
+			}
+		}
+		return -1
+	}
+
+	// The CA is in its database.
+	if stats.Total != 3 || count(stats.Status, "valid") != 2 || count(stats.Status, "revoked") != 1 {
+		t.Errorf("wrong status: %+v", stats)
+	}
+	if count(stats.Keys, "RSA 2048") != 3 {
+		t.Errorf("wrong keys: %+v", stats.Keys)
+	}
+	if count(stats.Issuance, time.Now().UTC().Format("2006-01")) != 3 {
+		t.Errorf("wrong issuance: %+v", stats.Issuance)
+	}
+	total := 0
+	for _, v := range stats.Expirations {
+		total += v.Count
+	}
+	if total != 2 {
+		t.Errorf("wrong expirations: %+v", stats.Expirations)
+	}
+
+	if out := s.mustRun("", "stats"); !strings.Contains(out, "== Key algorithms") {
+		t.Errorf("stats: wrong output:\n%s", out)
+	}
+}
+
+func TestGraph(t *testing.T) {
+	s := newTestStore(t, true)
+	s.issue("web1.old")
+	s.issue("web2")
+	s.mustRun("", "revoke", "-all", "-cn", "*.old")
+
+	out := s.mustRun("", "graph")
+	for _, v := range []string{
+		"digraph pki {",
+		`"` + NAME_CA + `" [label=`,
+		"shape=box",
+		`"` + NAME_CA + `" -> "web2";`,
+	} {
+		if !strings.Contains(out, v) {
+			t.Errorf("graph: output without %q:\n%s", v, out)
+		}
+	}
+	if strings.Contains(out, "fillcolor") {
+		t.Errorf("graph without color: got colors:\n%s", out)
+	}
+
+	out = s.mustRun("", "graph", "-color")
+	if !strings.Contains(out, "fillcolor="+_COLOR_REVOKED) || !strings.Contains(out, "fillcolor="+_COLOR_VALID) {
+		t.Errorf("graph with color: wrong output:\n%s", out)
+	}
+
+	if _, err := s.run("", "graph", "-o", "png"); err == nil {
+		t.Error("graph with wrong format: got no error")
+	}
+}
+
+func TestNotifyIssue(t *testing.T) {
+	s := newTestStore(t, true)
+	s.issue("web")
+
+	var (
+		mu      sync.Mutex
+		opened  *issue
+		calls   []string
+		headers []string
+	)
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		calls = append(calls, r.Method+" "+r.URL.EscapedPath())
+		headers = append(headers, r.Header.Get("Authorization")+r.Header.Get("PRIVATE-TOKEN"))
+
+		var in map[string]interface{}
+		json.NewDecoder(r.Body).Decode(&in)
+		switch r.Method {
+		case "GET":
+			list := []*issue{{Number: 7, Title: "other"}}
+			if opened != nil {
+				list = append(list, opened)
+			}
+			json.NewEncoder(w).Encode(list)
+		case "POST":
+			body, _ := in["body"].(string)
+			desc, _ := in["description"].(string)
+			opened = &issue{Number: 8, IID: 8, Title: in["title"].(string), Body: body, Description: desc}
+		case "PATCH", "PUT":
+			if in["state"] == "closed" || in["state_event"] == "close" {
+				opened = nil
+			} else if v, ok := in["body"].(string); ok {
+				opened.Body = v
+			}
+		}
+	}))
+	defer api.Close()
+
+	config := fmt.Sprintf(`{"issue": {"provider": "github", "repo": "example/ops", "url": %q}}`, api.URL)
+	if err := os.WriteFile(s.file(FILE_STORE), []byte(config), 0644); err != nil {
+		t.Fatal(err)
+	}
+	env := []string{ENV_ISSUE_TOKEN + "=secret"}
+
+	if _, err := s.run("", "notify", "-days", "100000"); err == nil {
+		t.Error("notify without token: got no error")
+	}
+	out, err := s.runEnv(env, "", "notify", "-days", "100000", "-dry-run")
+	if err != nil || !strings.Contains(out, "| `web` |") {
+		t.Errorf("notify -dry-run: got %v\n%s", err, out)
+	}
+
+	for _, days := range []string{"100000", "100000", "1"} {
+		if out, err := s.runEnv(env, "", "notify", "-days", days); err != nil {
+			t.Fatalf("%s\n%s", err, out)
+		}
+	}
+	want := []string{
+		"GET /repos/example/ops/issues", "POST /repos/example/ops/issues", // opened
+		"GET /repos/example/ops/issues",                                      // not changed
+		"GET /repos/example/ops/issues", "PATCH /repos/example/ops/issues/8", // closed
+	}
+	if strings.Join(calls, "\n") != strings.Join(want, "\n") {
+		t.Errorf("github: got calls\n%s", strings.Join(calls, "\n"))
+	}
+	if headers[0] != "Bearer secret" {
+		t.Errorf("github: got authorization %q", headers[0])
+	}
+	if opened != nil {
+		t.Error("github: issue not closed")
+	}
+
+	config = fmt.Sprintf(`{"issue": {"provider": "gitlab", "repo": "group/ops", "url": %q}}`, api.URL)
+	if err = os.WriteFile(s.file(FILE_STORE), []byte(config), 0644); err != nil {
+		t.Fatal(err)
+	}
+	calls, headers = nil, nil
+	if out, err := s.runEnv(env, "", "notify", "-days", "100000"); err != nil {
+		t.Fatalf("%s\n%s", err, out)
+	}
+	if len(calls) != 2 || calls[1] != "POST /projects/group%2Fops/issues" || headers[1] != "secret" {
+		t.Errorf("gitlab: got calls %q, headers %q", calls, headers)
+	}
+	if opened == nil || !strings.Contains(opened.Description, "| `web` |") {
+		t.Errorf("gitlab: wrong issue opened: %+v", opened)
+	}
+}
+
+func TestK8sIssuer(t *testing.T) {
+	s := newTestStore(t, true)
+
+	newCSR := func(cn string) []byte {
+		csr := filepath.Join(t.TempDir(), "web"+EXT_REQUEST)
+		if out, err := exec.Command("openssl", "req", "-new", "-nodes", "-newkey", "rsa:2048",
+			"-subj", "/CN="+cn, "-addext", "subjectAltName=DNS:"+cn+",DNS:web.example.com",
+			"-keyout", os.DevNull, "-out", csr).CombinedOutput(); err != nil {
+			t.Fatalf("%s\n%s", err, out)
+		}
+		data, err := os.ReadFile(csr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return data
+	}
+	csrPEM := newCSR("web.apps.svc")
+
+	newRequest := func(name, group string, request []byte, conditions ...string) map[string]interface{} {
+		namespace := "apps"
+		if ns, n, ok := strings.Cut(name, "/"); ok {
+			namespace, name = ns, n
+		}
+		var conds []map[string]string
+		for _, v := range conditions {
+			conds = append(conds, map[string]string{"type": v, "status": "True"})
+		}
+		return map[string]interface{}{
+			"metadata": map[string]string{"name": name, "namespace": namespace},
+			"spec": map[string]interface{}{
+				"request":   request,
+				"issuerRef": map[string]string{"name": "team-ca", "kind": "ClusterIssuer", "group": group},
+			},
+			"status": map[string]interface{}{"conditions": conds},
+		}
+	}
+	requests := []map[string]interface{}{
+		newRequest("web", DEFAULT_K8S_GROUP, csrPEM, "Approved"),
+		newRequest("other", "cert-manager.io", csrPEM, "Approved"),
+		newRequest("wait", DEFAULT_K8S_GROUP, csrPEM),
+		newRequest("no", DEFAULT_K8S_GROUP, csrPEM, "Denied"),
+		newRequest("bad", DEFAULT_K8S_GROUP, []byte("garbage"), "Approved"),
+		// Their names would collide whether the namespace were separated by '-'.
+		newRequest("a-b/c", DEFAULT_K8S_GROUP, newCSR("c.a-b.svc"), "Approved"),
+		newRequest("a/b-c", DEFAULT_K8S_GROUP, newCSR("b-c.a.svc"), "Approved"),
+	}
+
+	var (
+		mu      sync.Mutex
+		patches = make(map[string]*k8sRequest)
+		auth    string
+	)
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		auth = r.Header.Get("Authorization")
+
+		if r.Method == "GET" && r.URL.Path == _K8S_REQUESTS+"/certificaterequests" {
+			json.NewEncoder(w).Encode(map[string]interface{}{"items": requests})
+			return
+		}
+		field := strings.Split(r.URL.Path, "/")
+		if r.Method != "PATCH" || len(field) != 9 || field[8] != "status" ||
+			r.Header.Get("Content-Type") != "application/merge-patch+json" {
+			http.Error(w, "unexpected", http.StatusBadRequest)
+			return
+		}
+
+		var patch map[string]interface{}
+		data, _ := io.ReadAll(r.Body)
+		json.Unmarshal(data, &patch)
+		for _, v := range requests {
+			if v["metadata"].(map[string]string)["name"] == field[7] {
+				v["status"] = patch["status"]
+			}
+		}
+		req := new(k8sRequest)
+		json.Unmarshal(data, req)
+		patches[field[7]] = req
+	}))
+	defer api.Close()
+
+	env := []string{ENV_K8S_API + "=" + api.URL, ENV_K8S_TOKEN + "=secret"}
+
+	if _, err := s.run("", "k8s-issuer", "-once"); err == nil {
+		t.Error("out of the cluster without API server: got no error")
+	}
+	out, err := s.runEnv(env, "", "k8s-issuer", "-once", "-dry-run")
+	if err != nil || !strings.Contains(out, `apps/web, like "k8s-apps.web"`) || len(patches) != 0 {
+		t.Errorf("k8s-issuer -dry-run: got %v, %d patches\n%s", err, len(patches), out)
+	}
+
+	if out, err = s.runEnv(env, "", "k8s-issuer", "-once"); err != nil {
+		t.Fatalf("%s\n%s", err, out)
+	}
+	if auth != "Bearer secret" {
+		t.Errorf("got authorization %q", auth)
+	}
+	if len(patches) != 5 {
+		t.Errorf("got patches of %d requests, want 5", len(patches))
+	}
+	for name, reason := range map[string]string{
+		"web": K8S_ISSUED, "no": K8S_DENIED, "bad": K8S_FAILED, "c": K8S_ISSUED, "b-c": K8S_ISSUED,
+	} {
+		if p := patches[name]; p == nil || p.condition("Ready") == nil || p.condition("Ready").Reason != reason {
+			t.Errorf("%s: want reason %q, got %+v", name, reason, p)
+		}
+	}
+
+	// The status of the request signed has the certificate and the CA, and
+	// keeps the approval.
+	var status struct {
+		Certificate []byte
+		CA          []byte
+	}
+	data, _ := json.Marshal(requests[0]["status"])
+	json.Unmarshal(data, &status)
+	parse := func(data []byte) *x509.Certificate {
+		block, _ := pem.Decode(data)
+		if block == nil {
+			return nil
+		}
+		cert, _ := x509.ParseCertificate(block.Bytes)
+		return cert
+	}
+	if cert := parse(status.Certificate); cert == nil || cert.Subject.CommonName != "web.apps.svc" {
+		t.Error("wrong certificate in the status")
+	} else if got := strings.Join(cert.DNSNames, ","); got != "web.apps.svc,web.example.com" {
+		t.Errorf("got DNS names %q in the certificate of the status", got)
+	}
+	if ca := parse(status.CA); ca == nil || !ca.IsCA {
+		t.Error("wrong CA in the status")
+	}
+	if p := patches["web"]; p == nil || p.condition("Approved") == nil {
+		t.Error("the condition Approved was not kept")
+	}
+	for _, v := range []string{"k8s-apps.web", "k8s-a-b.c", "k8s-a.b-c"} {
+		if _, err = os.Stat(s.file("certs", v+EXT_CERT)); err != nil {
+			t.Error(err)
+		}
+	}
+
+	// The requests done are skipped.
+	patches = make(map[string]*k8sRequest)
+	if out, err = s.runEnv(env, "", "k8s-issuer", "-once"); err != nil {
+		t.Fatalf("%s\n%s", err, out)
+	}
+	if len(patches) != 0 {
+		t.Errorf("requests done were updated again: %v", patches)
+	}
+}
+
+func TestCTWatch(t *testing.T) {
+	s := newTestStore(t, true)
+	web := s.issue("web")
+
+	entries := fmt.Sprintf(`[
+		{"id": 1, "issuer_name": "CN=Test CA", "common_name": "web.example.com",
+			"name_value": "web.example.com", "serial_number": "%x"},
+		{"id": 2, "issuer_name": "CN=Evil CA", "common_name": "mail.example.com",
+			"name_value": "mail.example.com", "serial_number": "0a0b"},
+		{"id": 3, "issuer_name": "O=Let's Encrypt, CN=R3", "common_name": "www.example.com",
+			"name_value": "www.example.com", "serial_number": "0c0d"},
+		{"id": 4, "issuer_name": "CN=Evil CA", "common_name": "example.com.evil.org",
+			"name_value": "example.com.evil.org", "serial_number": "0e0f"}
+	]`, web.SerialNumber)
+	ct := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, entries)
+	}))
+	defer ct.Close()
+
+	var posts []string
+	var mu sync.Mutex
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, _ := io.ReadAll(r.Body)
+		mu.Lock()
+		posts = append(posts, string(data))
+		mu.Unlock()
+	}))
+	defer hook.Close()
+
+	config := fmt.Sprintf(`{"ctwatch": {"domains": ["example.com"], "issuers": ["Let's Encrypt"],
+		"url": %q, "webhook": %q}}`, ct.URL+"/", hook.URL)
+	if err := os.WriteFile(s.file(FILE_STORE), []byte(config), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	out := s.mustRun("", "ctwatch", "-dry-run")
+	if !strings.Contains(out, "mail.example.com") {
+		t.Errorf("ctwatch: certificate unexpected not found:\n%s", out)
+	}
+	for _, v := range []string{"web.example.com", "www.example.com", "evil.org"} {
+		if strings.Contains(out, v) {
+			t.Errorf("ctwatch: alert of %q:\n%s", v, out)
+		}
+	}
+
+	s.mustRun("", "ctwatch")
+	s.mustRun("", "ctwatch") // nothing new
+	mu.Lock()
+	defer mu.Unlock()
+	if len(posts) != 1 || !strings.Contains(posts[0], "mail.example.com") {
+		t.Errorf("ctwatch: wrong posts to the webhook: %q", posts)
+	}
+}
+
+func TestReadOnly(t *testing.T) {
+	s := newTestStore(t, true)
+
+	if _, err := s.run(dnInput("web"), "req", "-readonly", "web"); err == nil {
+		t.Error("req in read-only mode: got no error")
+	}
+	if _, err := s.runEnv([]string{ENV_READONLY + "=1"}, dnInput("web"), "req", "web"); err == nil {
+		t.Error("req in read-only mode: got no error")
+	}
+	checkNotExist(t, s.file("private", "web"+EXT_KEY))
+}
+
+func TestRoles(t *testing.T) {
+	s := newTestStore(t, true)
+	name := systemUser(t)
+
+	env := s.setOperators(map[string]string{name: ROLE_AUDITOR, "bob": ROLE_ISSUER})
+	if _, err := s.runEnv(env, dnInput("web"), "req", "web"); err == nil {
+		t.Error("req by auditor: got no error")
+	}
+	if out, err := s.runEnv([]string{ENV_OPERATOR + "=bob"}, dnInput("web"), "req", "web"); err == nil ||
+		!strings.Contains(out, ENV_OPERATOR) {
+		t.Errorf("req with the operator of the environment: got %v\n%s", err, out)
+	}
+
+	env = s.setOperators(map[string]string{"bob": ROLE_ISSUER})
+	if _, err := s.runEnv(env, dnInput("web"), "req", "web"); err == nil {
+		t.Error("req by unknown operator: got no error")
+	}
+
+	env = s.setOperators(map[string]string{name: ROLE_ISSUER})
+	if out, err := s.runEnv(env, dnInput("web"), "req", "web"); err != nil {
+		t.Errorf("req by issuer: %s\n%s", err, out)
+	}
+}
+
+// setOperators configures the operators of the store, returning the
+// environment to run the program like the user of the system.
+func (s *testStore) setOperators(operators map[string]string) []string {
+	s.t.Helper()
+
+	data, err := json.Marshal(map[string]any{"operators": operators})
+	if err != nil {
+		s.t.Fatal(err)
+	}
+	if err = os.WriteFile(s.file(FILE_STORE), data, 0644); err != nil {
+		s.t.Fatal(err)
+	}
+	return []string{ENV_OPERATOR + "="}
+}
+
+// systemUser returns the name of the user of the system.
+func systemUser(t *testing.T) string {
+	t.Helper()
+
+	u, err := user.Current()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return u.Username
+}
+
+func TestCache(t *testing.T) {
+	s := newTestStore(t, true)
+	useStore(t, s)
+	s.setOperators(map[string]string{"alice": ROLE_ADMIN})
+
+	cfg := loadStoreConfig()
+	cfg.Operators["mallory"] = ROLE_ADMIN
+	if _, ok := loadStoreConfig().Operators["mallory"]; ok {
+		t.Error("operator added to the configuration of the cache")
+	}
+
+	// Other content, with the same size and time of modification.
+	info, err := os.Stat(File.Store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.setOperators(map[string]string{"bobby": ROLE_ADMIN})
+	if err = os.Chtimes(File.Store, info.ModTime(), info.ModTime()); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := loadStoreConfig().Operators["bobby"]; !ok {
+		t.Error("configuration modified: got the one of the cache")
+	}
+
+	// The CA's private key is decrypted again with other passphrase.
+	ca := s.cert(NAME_CA)
+	if _, err = nativeCAKey(ca); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv(ENV_CA_PASS, "wrong")
+	if _, err = nativeCAKey(ca); err == nil {
+		t.Error("CA's private key with a wrong passphrase: got no error")
+	}
+}
+
+func TestHooks(t *testing.T) {
+	s := newTestStore(t, true)
+
+	// The hook runs the program, getting the metadata of the certificate.
+	out := filepath.Join(t.TempDir(), "out")
+	hook := "#!/bin/sh\nexec \"" + os.Args[0] + "\" info -end-date \"$EASYCERT_NAME\" > \"" + out + "\" 2>&1\n"
+	if err := os.WriteFile(s.file("hooks", HOOK_POST_SIGN), []byte(hook), 0755); err != nil {
+		t.Fatal(err)
+	}
+	s.issue("web")
+
+	data, err := os.ReadFile(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasPrefix(data, []byte("notAfter=")) {
+		t.Errorf("program run from the hook: got %q", data)
+	}
+}
+
+func TestSysLog(t *testing.T) {
+	if _, err := parseStoreConfig([]byte(`{"syslog": "file"}`)); err == nil {
+		t.Error("unknown syslog: got no error")
+	}
+
+	dir := t.TempDir()
+	listen := func(name string) *net.UnixConn {
+		conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: filepath.Join(dir, name), Net: "unixgram"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { conn.Close() })
+		return conn
+	}
+	read := func(conn *net.UnixConn) string {
+		buf := make([]byte, 4096)
+		n, err := conn.Read(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(buf[:n])
+	}
+	event := auditEvent{Operator: "alice", Action: ACTION_SIGN, Name: "web", Detail: "line 1\nline 2"}
+
+	server := listen("journal")
+	j, err := dialJournal(filepath.Join(dir, "journal"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = j.send(_PRIORITY_NOTICE, "sign web by alice", event.fields()); err != nil {
+		t.Fatal(err)
+	}
+	msg := read(server)
+	for _, want := range []string{"MESSAGE=sign web by alice\n", "PRIORITY=5\n", "SYSLOG_IDENTIFIER=easycert\n",
+		"EASYCERT_ACTION=sign\nEASYCERT_OPERATOR=alice\nEASYCERT_NAME=web\n",
+		"EASYCERT_DETAIL\n\x0d\x00\x00\x00\x00\x00\x00\x00line 1\nline 2\n"} {
+		if !strings.Contains(msg, want) {
+			t.Errorf("journal: message without %q:\n%q", want, msg)
+		}
+	}
+
+	server = listen("syslog")
+	l, err := dialSyslog("unixgram", filepath.Join(dir, "syslog"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = l.send(_PRIORITY_NOTICE, "sign web by alice", event.fields()); err != nil {
+		t.Fatal(err)
+	}
+	want := `sign web by alice action=sign operator=alice name=web detail="line 1\nline 2"`
+	if msg = read(server); !strings.Contains(msg, want) {
+		t.Errorf("syslog: message without %q:\n%q", want, msg)
+	}
+}
+
+func TestTelemetry(t *testing.T) {
+	if remoteSpan("00-00000000000000000000000000000000-00f067aa0ba902b7-01") != nil {
+		t.Error("traceparent with zero trace ID: got a span")
+	}
+	if remoteSpan("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7") != nil {
+		t.Error("traceparent without flags: got a span")
+	}
+
+	bodies := make(map[string][]byte)
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, _ := io.ReadAll(r.Body)
+		bodies[r.URL.Path] = data
+	}))
+	defer collector.Close()
+
+	t.Setenv(ENV_OTEL_ENDPOINT, collector.URL)
+	t.Setenv(ENV_OTEL_SERVICE_NAME, "portal")
+	defer func() { tel = nil }()
+	if tel = newTelemetry(); tel == nil {
+		t.Fatal("telemetry not enabled")
+	}
+
+	h := traced("/submit", func(w http.ResponseWriter, r *http.Request) {
+		err := traceStep(spanOf(r), "queue.add", func() error { return errQueueID })
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	})
+	req := httptest.NewRequest("POST", "/submit", nil)
+	req.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	h(httptest.NewRecorder(), req)
+
+	if err := tel.flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	var traces struct {
+		ResourceSpans []struct {
+			Resource   otlpResource `json:"resource"`
+			ScopeSpans []struct {
+				Spans []otlpSpan `json:"spans"`
+			} `json:"scopeSpans"`
+		} `json:"resourceSpans"`
+	}
+	if err := json.Unmarshal(bodies["/v1/traces"], &traces); err != nil {
+		t.Fatalf("%s\n%s", err, bodies["/v1/traces"])
+	}
+	if len(traces.ResourceSpans) != 1 || len(traces.ResourceSpans[0].ScopeSpans) != 1 {
+		t.Fatalf("traces: got %s", bodies["/v1/traces"])
+	}
+	if v := traces.ResourceSpans[0].Resource.Attributes; len(v) != 1 || v[0].Value["stringValue"] != "portal" {
+		t.Errorf("resource: got %v", v)
+	}
+	spans := traces.ResourceSpans[0].ScopeSpans[0].Spans
+	if len(spans) != 2 {
+		t.Fatalf("got %d spans, want 2", len(spans))
+	}
+	step, server := spans[0], spans[1]
+	if server.Name != "POST /submit" || server.Kind != _SPAN_KIND_SERVER ||
+		server.TraceID != "4bf92f3577b34da6a3ce929d0e0e4736" || server.ParentSpanID != "00f067aa0ba902b7" ||
+		server.Status == nil {
+		t.Errorf("span of the server: got %+v", server)
+	}
+	if step.Name != "queue.add" || step.TraceID != server.TraceID || step.ParentSpanID != server.SpanID ||
+		step.Status == nil || step.Status.Message != errQueueID.Error() {
+		t.Errorf("span of the step: got %+v", step)
+	}
+
+	if !bytes.Contains(bodies["/v1/metrics"], []byte(`"name":"`+METRIC_DURATION+`"`)) ||
+		!bytes.Contains(bodies["/v1/metrics"], []byte(`"stringValue":"queue.add"`)) {
+		t.Errorf("metrics: got %s", bodies["/v1/metrics"])
+	}
+
+	// The spans are exported once.
+	delete(bodies, "/v1/traces")
+	if err := tel.flush(); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := bodies["/v1/traces"]; ok {
+		t.Error("spans exported twice")
+	}
+}
+
+// fakeSQL is a driver of database/sql which records the statements executed.
+type fakeSQL struct{ execs []string }
+
+func (d *fakeSQL) Open(string) (driver.Conn, error) { return fakeConn{d}, nil }
+
+type fakeConn struct{ d *fakeSQL }
+
+func (c fakeConn) Prepare(query string) (driver.Stmt, error) { return fakeStmt{c.d, query}, nil }
+func (c fakeConn) Close() error                              { return nil }
+func (c fakeConn) Begin() (driver.Tx, error) {
+	c.d.execs = append(c.d.execs, "BEGIN")
+	return fakeTx{c.d}, nil
+}
+
+type fakeTx struct{ d *fakeSQL }
+
+func (t fakeTx) Commit() error   { t.d.execs = append(t.d.execs, "COMMIT"); return nil }
+func (t fakeTx) Rollback() error { t.d.execs = append(t.d.execs, "ROLLBACK"); return nil }
+
+type fakeStmt struct {
+	d     *fakeSQL
+	query string
+}
+
+func (s fakeStmt) Close() error  { return nil }
+func (s fakeStmt) NumInput() int { return -1 }
+func (s fakeStmt) Exec(args []driver.Value) (driver.Result, error) {
+	s.d.execs = append(s.d.execs, fmt.Sprint(strings.Fields(s.query)[0:3], args))
+	return driver.RowsAffected(1), nil
+}
+func (s fakeStmt) Query([]driver.Value) (driver.Rows, error) {
+	return nil, errors.New("query not supported")
+}
+
+var fakeSQLDriver = new(fakeSQL)
+
+func init() { sql.Register("easycert-fake", fakeSQLDriver) }
+
+func TestDatabase(t *testing.T) {
+	for _, v := range []string{
+		`{"database": {"driver": "mysql", "dsn": "x"}}`,
+		`{"database": {"driver": "postgres", "dsn": "x"}}`, // not built in
+	} {
+		if _, err := parseStoreConfig([]byte(v)); err == nil {
+			t.Errorf("%s: got no error", v)
+		}
+	}
+	if _, err := parseStoreConfig([]byte(`{"database": {"driver": "file"}}`)); err != nil {
+		t.Errorf("driver file: %s", err)
+	}
+
+	fakeSQLDriver.execs = nil
+	db, err := openSQL("easycert-fake", "", func(i int) string { return "$" + strconv.Itoa(i) })
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries := []*indexEntry{
+		{INDEX_VALID, "300101000000Z", "", "01", "unknown", "/CN=web"},
+		{INDEX_REVOKED, "300101000000Z", "250101000000Z,keyCompromise", "02", "unknown", "/CN=old"},
+	}
+	if err = db.save(&dbState{entries, "03", "01"}); err != nil {
+		t.Fatal(err)
+	}
+	defer db.close()
+
+	want := []string{
+		"[CREATE TABLE IF] []",
+		"[CREATE TABLE IF] []",
+		"[CREATE TABLE IF] []",
+		"BEGIN",
+		"[DELETE FROM easycert_index] []",
+		"[INSERT INTO easycert_index] [0 01 V 300101000000Z  /CN=web]",
+		"[INSERT INTO easycert_index] [1 02 R 300101000000Z 250101000000Z,keyCompromise /CN=old]",
+		"[DELETE FROM easycert_state] []",
+		"[INSERT INTO easycert_state] [serial 03]",
+		"[INSERT INTO easycert_state] [crlnumber 01]",
+		"COMMIT",
+	}
+	if got := fakeSQLDriver.execs; strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("statements:\ngot  %q\nwant %q", got, want)
+	}
+
+	// Election of the leader.
+	fakeSQLDriver.execs = nil
+	expires := time.Now().Add(HA_LEASE_TTL)
+	ok, err := db.lease(HA_LEASE, "host:1", expires)
+	if err != nil || !ok {
+		t.Fatalf("lease: got %v, %v", ok, err)
+	}
+	want = []string{
+		"[INSERT INTO easycert_lease] [serve host:1 serve]",
+		fmt.Sprintf("[UPDATE easycert_lease SET] [host:1 %d serve host:1 ", expires.UnixMilli()),
+	}
+	if got := fakeSQLDriver.execs; len(got) != 2 || got[0] != want[0] || !strings.HasPrefix(got[1], want[1]) {
+		t.Errorf("statements of lease:\ngot  %q\nwant %q", got, want)
+	}
+
+	// The database of bolt, by default.
+	s := newTestStore(t, true)
+	web := s.issue("web")
+	bolt, err := openBolt(s.file(FILE_DB))
+	if err != nil {
+		t.Fatal(err)
+	}
+	st, err := bolt.load()
+	bolt.close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	index, err := os.ReadFile(s.file("index.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st == nil || string(formatIndex(st.Entries)) != string(index) {
+		t.Fatalf("database of bolt: got %+v, want\n%s", st, index)
+	}
+
+	// The files of OpenSSL are written from the database, like in another
+	// instance.
+	for _, v := range []string{"index.txt", "serial"} {
+		if err = os.WriteFile(s.file(v), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if out := s.mustRun("", "ls"); !strings.Contains(out, "web") {
+		t.Errorf("ls from the database:\n%s", out)
+	}
+	api := s.issue("api")
+	if want := new(big.Int).Add(web.SerialNumber, big.NewInt(1)); api.SerialNumber.Cmp(want) != 0 {
+		t.Errorf("got serial %s, want %s", api.SerialNumber, want)
+	}
+	if index, _ = os.ReadFile(s.file("index.txt")); !strings.Contains(string(index), "/CN=web") ||
+		!strings.Contains(string(index), "/CN=api") {
+		t.Errorf("database of OpenSSL not restored:\n%s", index)
+	}
+
+	// Only the files of OpenSSL.
+	files := newTestStore(t, false)
+	if err = os.WriteFile(files.file(FILE_STORE), []byte(`{"database": {"driver": "file"}}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	files.mustRun("", "ca", "-batch")
+	checkNotExist(t, files.file(FILE_DB))
+
+	if _, err = s.run("", "serve", "-ha", "-addr", "localhost:0"); err == nil {
+		t.Error("serve -ha without token: got no error")
+	}
+	out, err := s.run("", "serve", "-ha", "-token", "secret", "-addr", "localhost:0")
+	if err == nil || !strings.Contains(out, "external database") {
+		t.Errorf("serve -ha without database: got %v\n%s", err, out)
+	}
+}
+
+func TestEdition(t *testing.T) {
+	defer func(v string) { edition = v }(edition)
+	cfg := new(StoreConfig)
+
+	edition = EDITION_SIGNER
+	if err := checkRole(cfg, "tester", ACTION_REQUEST); err == nil {
+		t.Error("request in signer edition: got no error")
+	}
+	if err := checkRole(cfg, "tester", ACTION_SIGN); err != nil {
+		t.Errorf("sign in signer edition: %s", err)
+	}
+	for _, cmd := range editionCommands() {
+		if cmd == cmdReq || cmd == cmdExport || cmd == cmdMatter {
+			t.Errorf("command %q in signer edition", cmdName(cmd))
+		}
+	}
+
+	edition = EDITION_REQUESTER
+	if err := checkRole(cfg, "tester", ACTION_SIGN); err == nil {
+		t.Error("sign in requester edition: got no error")
+	}
+	if err := checkRole(cfg, "tester", ACTION_REQUEST); err != nil {
+		t.Errorf("request in requester edition: %s", err)
+	}
+}
+
+func TestNoServerKeygen(t *testing.T) {
+	s := newTestStore(t, true)
+
+	if err := os.WriteFile(s.file(FILE_STORE), []byte(`{"no_server_keygen": true}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.run(dnInput("web"), "req", "web"); err == nil {
+		t.Error("req with no_server_keygen: got no error")
+	}
+	checkNotExist(t, s.file("private", "web"+EXT_KEY))
+}
+
+func TestRevoke(t *testing.T) {
+	s := newTestStore(t, true)
+
+	web1 := s.issue("web1.old")
+	web2 := s.issue("web2.old")
+	s.issue("web3")
+
+	s.mustRun("", "revoke", "-all", "-cn", "*.old", "-reason", "cessationOfOperation")
+
+	data, err := os.ReadFile(s.file("crl", NAME_CA+EXT_REVOK))
+	if err != nil {
+		t.Fatal(err)
+	}
+	crl, err := x509.ParseRevocationList(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(crl.RevokedCertificateEntries) != 2 {
+		t.Fatalf("got %d certificates revoked, want 2", len(crl.RevokedCertificateEntries))
+	}
+	for _, v := range crl.RevokedCertificateEntries {
+		if v.SerialNumber.Cmp(web1.SerialNumber) != 0 && v.SerialNumber.Cmp(web2.SerialNumber) != 0 {
+			t.Errorf("certificate revoked with serial %s", v.SerialNumber)
+		}
+		if v.ReasonCode != 5 {
+			t.Errorf("got reason %d, want cessationOfOperation", v.ReasonCode)
+		}
+	}
+
+	if _, err = s.run("", "revoke", "web1.old"); err == nil {
+		t.Error("revoke of certificate revoked: got no error")
+	}
+	if _, err = s.run("", "revoke", NAME_CA); err == nil {
+		t.Error("revoke of CA: got no error")
+	}
+
+	// Suspension
+	s.mustRun("", "revoke", "-reason", "certificateHold", "web3")
+	if _, err = s.run("", "unrevoke", "web1.old"); err == nil {
+		t.Error("unrevoke of certificate not on hold: got no error")
+	}
+	s.mustRun("", "unrevoke", "web3")
+
+	if data, err = os.ReadFile(s.file("crl", NAME_CA+EXT_REVOK)); err != nil {
+		t.Fatal(err)
+	}
+	if crl, err = x509.ParseRevocationList(data); err != nil {
+		t.Fatal(err)
+	}
+	if len(crl.RevokedCertificateEntries) != 2 {
+		t.Errorf("got %d certificates revoked after unrevoke, want 2", len(crl.RevokedCertificateEntries))
+	}
+}
+
+func TestCRLGen(t *testing.T) {
+	s := newTestStore(t, true)
+	s.issue("web")
+	s.mustRun("", "revoke", "web")
+
+	number := func() *big.Int {
+		t.Helper()
+		data, err := os.ReadFile(s.file("crl", NAME_CA+EXT_REVOK))
+		if err != nil {
+			t.Fatal(err)
+		}
+		crl, err := x509.ParseRevocationList(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(crl.RevokedCertificateEntries) != 1 {
+			t.Errorf("got %d certificates revoked, want 1", len(crl.RevokedCertificateEntries))
+		}
+		return crl.Number
+	}
+
+	before := number()
+	out := s.mustRun("", "crl", "-gen")
+	if after := number(); after.Cmp(before) <= 0 {
+		t.Errorf("got number %s after generating the list, want greater than %s", after, before)
+	}
+	if !strings.Contains(out, "next update") {
+		t.Errorf("got output:\n%s", out)
+	}
+	if _, err := s.run("", "crl", "-gen", "web"); err == nil {
+		t.Error("crl -gen with argument: got no error")
+	}
+	if _, err := s.runEnv([]string{ENV_READONLY + "=1"}, "", "crl", "-gen"); err == nil {
+		t.Error("crl -gen in read-only mode: got no error")
+	}
+	if out = s.mustRun("", "crl", "-show"); !strings.Contains(out, "Revoked Certificates") {
+		t.Errorf("crl -show: got\n%s", out)
+	}
+}
+
+func TestCRLDiff(t *testing.T) {
+	s := newTestStore(t, true)
+	a, b := s.issue("a"), s.issue("b")
+	dir := t.TempDir()
+
+	save := func(name string) string {
+		t.Helper()
+		data, err := os.ReadFile(s.file("crl", NAME_CA+EXT_REVOK))
+		if err != nil {
+			t.Fatal(err)
+		}
+		file := filepath.Join(dir, name+EXT_REVOK)
+		if err = os.WriteFile(file, data, 0644); err != nil {
+			t.Fatal(err)
+		}
+		return file
+	}
+	s.mustRun("", "revoke", "a")
+	oldList := save("old")
+	s.mustRun("", "revoke", "-reason", "keyCompromise", "b")
+	newList := save("new")
+
+	out := s.mustRun("", "crl", "-diff", oldList, newList)
+	if !strings.Contains(out, "+ "+easycert.SerialHex(b.SerialNumber)+"\t") || !strings.Contains(out, "\tkeyCompromise\n") ||
+		strings.Contains(out, " "+easycert.SerialHex(a.SerialNumber)+"\t") || strings.Contains(out, "\n- ") {
+		t.Errorf("crl -diff: got\n%s", out)
+	}
+	if out = s.mustRun("", "crl", "-diff", newList, newList); !strings.Contains(out, "No changes") {
+		t.Errorf("crl -diff of the same list: got\n%s", out)
+	}
+	if out = s.mustRun("", "crl", "-diff", newList, oldList); !strings.Contains(out, "- "+easycert.SerialHex(b.SerialNumber)+"\t") {
+		t.Errorf("crl -diff reversed: got\n%s", out)
+	}
+
+	// Other CA, with the same name.
+	other := newTestStore(t, true)
+	other.issue("c")
+	other.mustRun("", "revoke", "c")
+	out, err := s.run("", "crl", "-diff", oldList, other.file("crl", NAME_CA+EXT_REVOK))
+	if err == nil || !strings.Contains(out, "different issuers") {
+		t.Errorf("crl -diff of other CA: got %v\n%s", err, out)
+	}
+
+	// The information of a list got from an URL.
+	srv := httptest.NewServer(http.FileServer(http.Dir(dir)))
+	defer srv.Close()
+	out = s.mustRun("", "crl", "-info", srv.URL+"/new"+EXT_REVOK)
+	if !strings.Contains(out, "Revoked Certificates") || strings.Count(out, "Serial Number: ") != 2 {
+		t.Errorf("crl -info of URL: got\n%s", out)
+	}
+}
+
+func TestChkOCSP(t *testing.T) {
+	s := newTestStore(t, true)
+	s.issue("web")
+	s.issue("old")
+	s.mustRun("", "revoke", "old")
+	useStore(t, s)
+
+	responder, err := newOCSPResponder()
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(responder)
+	defer srv.Close()
+
+	web := s.file("certs", "web"+EXT_CERT)
+	if out := s.mustRun("", "chk", "-ocsp", web, srv.URL); !strings.Contains(out, web+": good") ||
+		!strings.Contains(out, "This Update:") {
+		t.Errorf("chk -ocsp: got\n%s", out)
+	}
+	out, err := s.run("", "chk", "-ocsp", s.file("certs", "old"+EXT_CERT), srv.URL)
+	if err == nil || !strings.Contains(out, `status "revoked"`) {
+		t.Errorf("chk -ocsp of a revoked certificate: got %v\n%s", err, out)
+	}
+	if out, err = s.run("", "chk", "-ocsp", web); err == nil || !strings.Contains(out, "has not an OCSP responder") {
+		t.Errorf("chk -ocsp without responder: got %v\n%s", err, out)
+	}
+}
+
+func TestPublish(t *testing.T) {
+	s := newTestStore(t, true)
+	s.issue("web", "-host", "www.example.com")
+	s.issue("old")
+	s.mustRun("", "revoke", "old")
+
+	if _, err := s.run("", "publish", "-s3", "bucket", "-gcs", "bucket"); err == nil {
+		t.Error("publish to S3 and GCS: got no error")
+	}
+	out := s.mustRun("", "publish", "-gcs", "bucket/pki", "-dry-run")
+	for _, v := range []string{
+		"certs/web.crt", "certs/web.cer", "chains/web.pem", "certs/ca.crt", "crl/ca.crl", "index.json",
+	} {
+		if !strings.Contains(out, v+" ") && !strings.Contains(out, v+"\t") {
+			t.Errorf("publish -dry-run: output without %q:\n%s", v, out)
+		}
+	}
+	if strings.Contains(out, EXT_KEY) {
+		t.Errorf("publish -dry-run: got private keys:\n%s", out)
+	}
+
+	// A fake aws which copies the files into a directory, like the bucket.
+	bin := t.TempDir()
+	bucket := filepath.Join(bin, "s3")
+	script := fmt.Sprintf(`#!/bin/sh
+dst=%s/${7#s3://}
+mkdir -p "$(dirname "$dst")" && cp "$6" "$dst" && echo "$5" > "$dst.type"
+`, bucket)
+	if err := os.WriteFile(filepath.Join(bin, CMD_AWS), []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	env := []string{"PATH=" + bin + string(os.PathListSeparator) + os.Getenv("PATH")}
+	if out, err := s.runEnv(env, "", "publish", "-s3", "bucket/pki"); err != nil {
+		t.Fatalf("publish -s3: %s\n%s", err, out)
+	}
+
+	read := func(name string) string {
+		t.Helper()
+		data, err := os.ReadFile(filepath.Join(bucket, "bucket", "pki", filepath.FromSlash(name)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(data)
+	}
+	if block, _ := pem.Decode([]byte(read("certs/web.crt"))); block == nil || !bytes.Equal(block.Bytes, s.cert("web").Raw) {
+		t.Error("certs/web.crt: got other certificate")
+	}
+	if got := read("certs/web.cer.type"); got != MIME_CERT+"\n" {
+		t.Errorf("certs/web.cer: got content type %q", got)
+	}
+	if got := strings.Count(read("chains/web.pem"), "BEGIN CERTIFICATE"); got != 2 {
+		t.Errorf("chains/web.pem: got %d certificates, want 2", got)
+	}
+	if got := read("crl/ca.crl.type"); got != MIME_CRL+"\n" && got != MIME_PEM+"\n" {
+		t.Errorf("crl/ca.crl: got content type %q", got)
+	}
+	var index []*CertInfo
+	if err := json.Unmarshal([]byte(read("index.json")), &index); err != nil {
+		t.Fatal(err)
+	}
+	if len(index) != 3 {
+		t.Errorf("index.json: got %d certificates, want 3", len(index))
+	}
+	filepath.WalkDir(bucket, func(path string, d fs.DirEntry, err error) error {
+		if data, _ := os.ReadFile(path); bytes.Contains(data, []byte("PRIVATE KEY")) {
+			t.Errorf("private key published: %s", path)
+		}
+		return nil
+	})
+}
+
+func TestOCSPServe(t *testing.T) {
+	s := newTestStore(t, true)
+	s.issue("web")
+	s.issue("old")
+	s.mustRun("", "revoke", "-reason", "keyCompromise", "old")
+	useStore(t, s)
+
+	responder, err := newOCSPResponder()
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(responder)
+	defer srv.Close()
+
+	ca := s.file("certs", NAME_CA+EXT_CERT)
+	query := func(args ...string) string {
+		t.Helper()
+		out, err := exec.Command("openssl", append([]string{"ocsp", "-issuer", ca, "-CAfile", ca,
+			"-url", srv.URL}, args...)...).CombinedOutput()
+		if err != nil {
+			t.Fatalf("%s\n%s", err, out)
+		}
+		return string(out)
+	}
+
+	out := query("-cert", s.file("certs", "web"+EXT_CERT), "-cert", s.file("certs", "old"+EXT_CERT), "-serial", "0x99")
+	for _, want := range []string{
+		"Response verify OK",
+		"web" + EXT_CERT + ": good",
+		"old" + EXT_CERT + ": revoked",
+		"Reason: keyCompromise",
+		"0x99: unknown",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("got no %q in:\n%s", want, out)
+		}
+	}
+	if strings.Contains(out, "WARNING") {
+		t.Errorf("got warning (nonce) in:\n%s", out)
+	}
+
+	// By GET, without nonce.
+	reqFile := filepath.Join(t.TempDir(), "req.der")
+	if out, err := exec.Command("openssl", "ocsp", "-issuer", ca, "-cert", s.file("certs", "web"+EXT_CERT),
+		"-no_nonce", "-reqout", reqFile).CombinedOutput(); err != nil {
+		t.Fatalf("%s\n%s", err, out)
+	}
+	der, err := os.ReadFile(reqFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.Get(srv.URL + "/" + url.PathEscape(base64.StdEncoding.EncodeToString(der)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	respFile := filepath.Join(t.TempDir(), "resp.der")
+	if err = os.WriteFile(respFile, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if out, err := exec.Command("openssl", "ocsp", "-respin", respFile, "-issuer", ca, "-CAfile", ca,
+		"-cert", s.file("certs", "web"+EXT_CERT)).CombinedOutput(); err != nil || !strings.Contains(string(out), ": good") {
+		t.Errorf("GET: %v\n%s", err, out)
+	}
+
+	// Malformed request.
+	resp, err = http.Post(srv.URL, "application/ocsp-request", strings.NewReader("garbage"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ = io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if !bytes.Equal(data, []byte{0x30, 0x03, 0x0a, 0x01, _OCSP_MALFORMED}) {
+		t.Errorf("malformed request: got response % x", data)
+	}
+
+	// The private key has to be the one of the CA's certificate.
+	web, err := os.ReadFile(s.file("certs", "web"+EXT_CERT))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = os.WriteFile(ca, web, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = newOCSPResponder(); err == nil || !strings.Contains(err.Error(), "not the one of the CA") {
+		t.Errorf("other certificate: got %v", err)
+	}
+}
+
+func TestHistory(t *testing.T) {
+	s := newTestStore(t, true)
+
+	first := s.issue("web")
+	if _, err := s.run(signInput, "sign", "web"); err == nil {
+		t.Error("sign of existing certificate: got no error")
+	}
+	for i := 0; i < DEFAULT_HISTORY+1; i++ {
+		s.issue("web", "-reissue")
+	}
+
+	match, _ := filepath.Glob(s.file("certs", DIR_HISTORY, "web@*"+EXT_CERT))
+	if len(match) != DEFAULT_HISTORY {
+		t.Errorf("got %d versions, want %d: %v", len(match), DEFAULT_HISTORY, match)
+	}
+	checkNotExist(t, s.file("certs", DIR_HISTORY, "web@1"+EXT_CERT))
+	checkMode(t, s.file("private", DIR_HISTORY, "web@2"+EXT_KEY), 0400)
+
+	out := s.mustRun("", "ls", "-history", "web")
+	if n := strings.Count(out, "\n"); n != DEFAULT_HISTORY+1 {
+		t.Errorf("got %d versions listed, want %d:\n%s", n, DEFAULT_HISTORY+1, out)
+	}
+	if strings.Contains(out, "\t"+easycert.SerialHex(first.SerialNumber)+"\t") {
+		t.Errorf("version removed listed:\n%s", out)
+	}
+
+	out = filepath.Join(t.TempDir(), "web.tar.gz")
+	s.mustRun("", "export", "-public", "-version", "2", "-out", out, "web")
+	if _, ok := readTarGz(t, out)["web@2-public/web@2"+EXT_CERT]; !ok {
+		t.Error("export -version: certificate not found")
+	}
+}
+
+func TestProfile(t *testing.T) {
+	s := newTestStore(t, true)
+
+	secret := filepath.Join(t.TempDir(), "ou")
+	if err := os.WriteFile(secret, []byte("Platform\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(s.file(FILE_CONFIG))
+	if err != nil {
+		t.Fatal(err)
+	}
+	data = bytes.Replace(data, []byte("Internet Widgits Pty Ltd"), []byte("${ENV:ORG_NAME}"), 1)
+	data = bytes.Replace(data, []byte("#organizationalUnitName_default\t="),
+		[]byte("organizationalUnitName_default = ${FILE:"+secret+"}"), 1)
+	if err = os.WriteFile(s.file(FILE_CONFIG), data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = s.run(dnInput("web"), "req", "web"); err == nil {
+		t.Error("req without variable of environment: got no error")
+	}
+
+	env := []string{"ORG_NAME=Acme"}
+	if out, err := s.runEnv(env, dnInput("web"), "req", "web"); err != nil {
+		t.Fatalf("%s\n%s", err, out)
+	}
+	if out, err := s.runEnv(env, signInput, "sign", "web"); err != nil {
+		t.Fatalf("%s\n%s", err, out)
+	}
+	subject := s.cert("web").Subject
+	if len(subject.Organization) != 1 || subject.Organization[0] != "Acme" ||
+		len(subject.OrganizationalUnit) != 1 || subject.OrganizationalUnit[0] != "Platform" {
+		t.Errorf("variables not resolved in subject: %s", subject)
+	}
+
+	tmp, _ := filepath.Glob(s.file("." + FILE_CONFIG + ".tmp-*"))
+	if len(tmp) != 0 {
+		t.Errorf("configuration resolved not removed: %v", tmp)
+	}
+}
+
+func TestDefaults(t *testing.T) {
+	s := newTestStore(t, true)
+
+	config := t.TempDir()
+	root := filepath.Join(t.TempDir(), "other")
+	data := fmt.Sprintf(`# Defaults
+root = %q
+
+[flags]
+years = 3 # comment
+
+[subject]
+country = "ES"
+organization = 'Example Ltd'
+`, root)
+	if err := os.MkdirAll(filepath.Join(config, "easycert"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(config, filepath.FromSlash(FILE_DEFAULTS)), []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+	env := []string{"XDG_CONFIG_HOME=" + config}
+
+	// The flags given in the command line override the environment, which
+	// overrides the defaults.
+	for name, years := range map[string]int{"web": 3, "api": 1, "mail": 2} {
+		if out, err := s.runEnv(env, dnInput(name), "req", name); err != nil {
+			t.Fatalf("%s\n%s", err, out)
+		}
+		signEnv := env
+		args := []string{"sign", name}
+		switch years {
+		case 1:
+			signEnv = append(env, envFlag("years")+"=2")
+			args = []string{"sign", "-years", "1", name}
+		case 2:
+			signEnv = append(env, envFlag("years")+"=2")
+		}
+		if out, err := s.runEnv(signEnv, signInput, args...); err != nil {
+			t.Fatalf("%s\n%s", err, out)
+		}
+
+		want := time.Now().AddDate(0, 0, 365*years)
+		if got := s.cert(name).NotAfter; got.Before(want.Add(-time.Hour)) || got.After(want.Add(time.Hour)) {
+			t.Errorf("%s: got expiration %s, want %s", name, got, want)
+		}
+	}
+
+	// The certificates directory is the one of the defaults without EASYCERT_ROOT.
+	if out, err := s.runEnv(append(env, ENV_ROOT+"="), "", "init"); err != nil {
+		t.Fatalf("%s\n%s", err, out)
+	}
+	cfg, err := os.ReadFile(filepath.Join(root, FILE_CONFIG))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, v := range []string{"countryName_default\t\t= ES\n", "0.organizationName_default\t= Example Ltd\n"} {
+		if !bytes.Contains(cfg, []byte(v)) {
+			t.Errorf("configuration without %q", v)
+		}
+	}
+
+	for _, v := range []string{
+		"years = \"3",
+		"[flags]\n[flags]",
+		"[other]",
+		"key = [1, 2]",
+		"[subject]\ncountry = \"Spain\"",
+		"[subject]\norganization = \"a\\nb\"",
+	} {
+		if _, err = parseDefaults([]byte(v)); err == nil {
+			t.Errorf("%q: got no error", v)
+		}
+	}
+	if _, err = s.runEnv(append(env, "XDG_CONFIG_HOME="+t.TempDir()), "", "ls"); err != nil {
+		t.Errorf("without defaults: %s", err)
+	}
+	if _, err = s.runEnv([]string{envFlag("years") + "=many"}, "", "ls"); err == nil {
+		t.Error("wrong value in environment: got no error")
+	}
+}
+
+func TestLang(t *testing.T) {
+	s := newTestStore(t, true)
+	s.issue("web")
+
+	dir := t.TempDir()
+	lang := func(args ...string) ([]byte, error) {
+		cmd := exec.Command(os.Args[0], append([]string{"lang"}, args...)...)
+		cmd.Env = s.env
+		cmd.Dir = dir
+		return cmd.CombinedOutput()
+	}
+	if out, err := lang("-server", "web", "-client", "-package", "certs"); err != nil {
+		t.Fatalf("%s\n%s", err, out)
+	}
+
+	checkMode(t, filepath.Join(dir, FILE_SERVER_GO), 0600)
+
+	for _, v := range []string{FILE_SERVER_GO, FILE_CLIENT_GO, FILE_SERVER_TEST_GO, FILE_CLIENT_TEST_GO} {
+		f, err := parser.ParseFile(token.NewFileSet(), filepath.Join(dir, v), nil, parser.ParseComments)
+		if err != nil {
+			t.Errorf("%s: %s", v, err)
+			continue
+		}
+		if f.Name.Name != "certs" {
+			t.Errorf("%s: got package %q", v, f.Name.Name)
+		}
+	}
+
+	data, err := os.ReadFile(filepath.Join(dir, FILE_SERVER_GO))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(data, []byte("\n//go:generate "+PROGRAM+" lang -ca ca -server web -client -package certs\n")) {
+		t.Error("server file without the directive go:generate")
+	}
+	if data, _ = os.ReadFile(filepath.Join(dir, FILE_CLIENT_GO)); bytes.Contains(data, []byte("go:generate")) {
+		t.Error("directive go:generate in the client file")
+	}
+
+	// The files generated can be overwritten, but not other ones.
+	if out, err := lang("-server", "web", "-client", "-package", "certs"); err != nil {
+		t.Errorf("generate again: %s\n%s", err, out)
+	}
+	if err = os.WriteFile(filepath.Join(dir, FILE_CLIENT_TEST_GO), []byte("package certs\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = lang("-client"); err == nil {
+		t.Error("file not generated overwritten: got no error")
+	}
+	if _, err = lang("-client", "-package", "no-name"); err == nil {
+		t.Error("invalid package: got no error")
+	}
+
+	// Variables with prefix, in another directory.
+	if out, err := lang("-client", "-var-prefix", "web", "-out", "sub"); err != nil {
+		t.Fatalf("%s\n%s", err, out)
+	}
+	if data, err = os.ReadFile(filepath.Join(dir, "sub", FILE_CLIENT_GO)); err != nil {
+		t.Fatal(err)
+	}
+	for _, v := range []string{"var webClientTLSConfig ", "//go:generate " + PROGRAM + " lang -ca ca -client -package main -var-prefix web\n"} {
+		if !bytes.Contains(data, []byte(v)) {
+			t.Errorf("client file without %q", v)
+		}
+	}
+	if data, err = os.ReadFile(filepath.Join(dir, "sub", FILE_CLIENT_TEST_GO)); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(data, []byte("func TestWebClientCert(")) {
+		t.Error("test without prefix")
+	}
+
+	// Files for C.
+	if out, err := lang("-c", "-server", "web", "-out", "c"); err != nil {
+		t.Fatalf("%s\n%s", err, out)
+	}
+	checkMode(t, filepath.Join(dir, "c", FILE_CERT_C), 0600)
+
+	caData, err := os.ReadFile(s.file("certs", NAME_CA+EXT_CERT))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data, err = os.ReadFile(filepath.Join(dir, "c", FILE_CERT_H)); err != nil {
+		t.Fatal(err)
+	}
+	for _, v := range []string{
+		fmt.Sprintf("#define CA_CERT_LEN %d\n", len(caData)+1),
+		"extern const unsigned char server_key[SERVER_KEY_LEN];\n",
+	} {
+		if !bytes.Contains(data, []byte(v)) {
+			t.Errorf("header without %q", v)
+		}
+	}
+	if _, err = os.Stat(filepath.Join(dir, "c", FILE_SERVER_GO)); !os.IsNotExist(err) {
+		t.Error("Go file created with -c")
+	}
+
+	// Files for ESP32.
+	for i := 0; i < 2; i++ { // the files generated are overwritten
+		if out, err := lang("-esp32", "-server", "web", "-out", "esp32"); err != nil {
+			t.Fatalf("%s\n%s", err, out)
+		}
+	}
+	checkMode(t, filepath.Join(dir, "esp32", FILE_ESP32_H), 0600)
+	checkMode(t, filepath.Join(dir, "esp32", "server_key"+EXT_DER), 0600)
+
+	if data, err = os.ReadFile(filepath.Join(dir, "esp32", "server_cert"+EXT_DER)); err != nil {
+		t.Fatal(err)
+	}
+	if cert, err := x509.ParseCertificate(data); err != nil {
+		t.Error(err)
+	} else if !cert.Equal(s.cert("web")) {
+		t.Error("wrong certificate in DER")
+	}
+	if data, err = os.ReadFile(filepath.Join(dir, "esp32", FILE_ESP32_H)); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(data, []byte("static const char ca_cert[] =\n\"-----BEGIN CERTIFICATE-----\\n\"\n")) {
+		t.Error("header without the CA certificate")
+	}
+}
+
+func TestImportExport(t *testing.T) {
+	s := newTestStore(t, true)
+	s.issue("web")
+
+	s.mustRun("", "import", s.file("certs", "web"+EXT_CERT), "copy")
+	if !bytes.Equal(s.cert("copy").Raw, s.cert("web").Raw) {
+		t.Error("imported certificate is different")
+	}
+
+	out := filepath.Join(t.TempDir(), "web.tar.gz")
+	s.mustRun("", "export", "-public", "-out", out, "web")
+
+	files := readTarGz(t, out)
+	for _, v := range []string{"web" + EXT_CERT, "chain" + EXT_CERT, "fingerprints.txt", "metadata.json"} {
+		if _, ok := files["web-public/"+v]; !ok {
+			t.Errorf("archive without %q", v)
+		}
+	}
+	for name, data := range files {
+		if bytes.Contains(data, []byte("PRIVATE KEY")) {
+			t.Errorf("%s: has a private key", name)
+		}
+	}
+}
+
+func TestManifest(t *testing.T) {
+	s := newTestStore(t, true)
+	web := s.issue("web", "-host", "www.example.com")
+	ca := s.cert(NAME_CA)
+	dir := t.TempDir()
+
+	// checkManifest checks the manifest against the files, by name.
+	checkManifest := func(data []byte, files map[string][]byte) {
+		t.Helper()
+
+		var m Manifest
+		if err := json.Unmarshal(data, &m); err != nil {
+			t.Fatal(err)
+		}
+		if m.Store != fingerprint(sha256Sum(ca.Raw)) || m.Certificate.FingerprintSHA256 != fingerprint(sha256Sum(web.Raw)) {
+			t.Errorf("got store %q and certificate %q", m.Store, m.Certificate.FingerprintSHA256)
+		}
+		if len(m.Chain) != 1 || m.Chain[0].FingerprintSHA256 != m.Store {
+			t.Errorf("got chain %+v", m.Chain)
+		}
+		if len(m.Files) != len(files) {
+			t.Errorf("got %d files in the manifest, want %d", len(m.Files), len(files))
+		}
+		for _, f := range m.Files {
+			if sum := sha256.Sum256(files[f.Name]); hex.EncodeToString(sum[:]) != f.SHA256 || len(files[f.Name]) != f.Size {
+				t.Errorf("%s: wrong digest or size in the manifest", f.Name)
+			}
+		}
+	}
+
+	out := filepath.Join(dir, "web.tar.gz")
+	s.mustRun("", "export", "-public", "-manifest", "-out", out, "web")
+	files := make(map[string][]byte)
+	for name, data := range readTarGz(t, out) {
+		files[strings.TrimPrefix(name, "web-public/")] = data
+	}
+	manifest := files[FILE_MANIFEST]
+	delete(files, FILE_MANIFEST)
+	checkManifest(manifest, files)
+
+	out = filepath.Join(dir, "mongodb")
+	s.mustRun("", "deploy", "-mongodb", "-manifest", "-out", out, "web")
+	files = make(map[string][]byte)
+	for _, v := range []string{"web.pem", "ca.pem", "mongod.conf"} {
+		data, err := os.ReadFile(filepath.Join(out, v))
+		if err != nil {
+			t.Fatal(err)
+		}
+		files[v] = data
+	}
+	manifest, err := os.ReadFile(filepath.Join(out, FILE_MANIFEST))
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkManifest(manifest, files)
+
+	out = filepath.Join(dir, "web"+EXT_PKCS12)
+	s.mustRun("", "export", "-p12", "-password", "secret", "-manifest", "-out", out, "web")
+	data, err := os.ReadFile(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if manifest, err = os.ReadFile(out + EXT_MANIFEST); err != nil {
+		t.Fatal(err)
+	}
+	checkManifest(manifest, map[string][]byte{"web" + EXT_PKCS12: data})
+
+	var m Manifest
+	json.Unmarshal(manifest, &m)
+	if strings.Join(m.Certificate.DNSNames, ",") != "www.example.com" {
+		t.Errorf("got names %q", m.Certificate.DNSNames)
+	}
+
+	s.issue("sso", "-saml")
+	out = filepath.Join(dir, "sso")
+	s.mustRun("", "export", "-layout", LAYOUT_SHIBBOLETH_SP, "-manifest", "-out", out, "sso")
+	if manifest, err = os.ReadFile(filepath.Join(out, FILE_MANIFEST)); err != nil {
+		t.Fatal(err)
+	}
+	json.Unmarshal(manifest, &m)
+	if strings.Join(m.KeyUsage, ",") != "digitalSignature,keyEncipherment" {
+		t.Errorf("got key usage %q", m.KeyUsage)
+	}
+
+	if _, err = s.run("", "deploy", "-iis", "Default Web Site", "-manifest", "-dry-run", "web"); err == nil {
+		t.Error("deploy -iis -manifest: got no error")
+	}
+}
+
+func TestVerifyBundle(t *testing.T) {
+	s := newTestStore(t, true)
+	s.issue("web", "-host", "www.example.com")
+	s.mustRun("", "req", "-code-signing", "release")
+	s.mustRun(signInput, "sign", "release")
+	dir := t.TempDir()
+
+	out := filepath.Join(dir, "web.tar.gz")
+	s.mustRun("", "export", "-public", "-sign", "-out", out, "web")
+	store := fingerprint(sha256Sum(s.cert(NAME_CA).Raw))
+	if got := s.mustRun("", "verify-bundle", out); !strings.Contains(got, "Store:\t"+store) ||
+		!strings.Contains(got, "CN=Test CA") {
+		t.Errorf("verify-bundle: wrong output:\n%s", got)
+	}
+
+	// By the recipient, with the root CA of the store.
+	ca := filepath.Join(dir, "ca.crt")
+	data, err := os.ReadFile(s.file("certs", NAME_CA+EXT_CERT))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = os.WriteFile(ca, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	other := newTestStore(t, true)
+	other.mustRun("", "verify-bundle", "-ca", ca, out)
+	if _, err = other.run("", "verify-bundle", out); err == nil {
+		t.Error("verify-bundle with the CA of other store: got no error")
+	}
+
+	f, err := os.OpenFile(out, os.O_APPEND|os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write([]byte{0})
+	f.Close()
+	if _, err = s.run("", "verify-bundle", out); err == nil {
+		t.Error("verify-bundle of a modified archive: got no error")
+	}
+
+	// A directory, signed with a release key through its manifest.
+	out = filepath.Join(dir, "android")
+	s.mustRun("", "export", "-android", "-sign", "-signer", "release", "-out", out, "web")
+	if got := s.mustRun("", "verify-bundle", out); !strings.Contains(got, "CN=release") ||
+		!strings.Contains(got, "Files:\t2") {
+		t.Errorf("verify-bundle of a directory: wrong output:\n%s", got)
+	}
+
+	extra := filepath.Join(out, "res", "raw", "other.der")
+	if err = os.WriteFile(extra, []byte("other"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = s.run("", "verify-bundle", out); err == nil {
+		t.Error("verify-bundle with a file added: got no error")
+	}
+	if err = os.Remove(extra); err != nil {
+		t.Fatal(err)
+	}
+	config := filepath.Join(out, "res", "xml", "network_security_config.xml")
+	if err = os.WriteFile(config, []byte("<network-security-config/>\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = s.run("", "verify-bundle", out); err == nil {
+		t.Error("verify-bundle with a file modified: got no error")
+	}
+
+	// The certificates of the servers do not sign the bundles.
+	out = filepath.Join(dir, "web.pem")
+	if _, err = s.run("", "export", "-public", "-sign", "-signer", "web", "-out", out, "web"); err == nil {
+		t.Error("export -sign with the certificate of a server: got no error")
+	}
+	s.mustRun("", "export", "-public", "-out", out, "web")
+	if msg, err := exec.Command("openssl", "cms", "-sign", "-binary", "-outform", "DER",
+		"-in", out, "-out", out+EXT_CMS_SIGN,
+		"-signer", s.file("certs", "web"+EXT_CERT), "-inkey", s.file("private", "web"+EXT_KEY),
+	).CombinedOutput(); err != nil {
+		t.Fatalf("openssl cms: %s\n%s", err, msg)
+	}
+	if got, err := s.run("", "verify-bundle", out); err == nil || !strings.Contains(got, "Signer not allowed") {
+		t.Errorf("verify-bundle signed by a server: got %v\n%s", err, got)
+	}
+}
+
+func TestImportChain(t *testing.T) {
+	s := newTestStore(t, true)
+
+	// Certificates of another CA, with its chain.
+	other := newTestStore(t, true)
+	other.issue("web")
+	other.issue("api")
+	for _, name := range []string{"web", "api"} {
+		data, err := os.ReadFile(other.file("certs", name+EXT_CERT))
+		if err != nil {
+			t.Fatal(err)
+		}
+		caData, err := os.ReadFile(other.file("certs", NAME_CA+EXT_CERT))
+		if err != nil {
+			t.Fatal(err)
+		}
+		bundle := filepath.Join(t.TempDir(), name+".pem")
+		if err = os.WriteFile(bundle, append(data, caData...), 0644); err != nil {
+			t.Fatal(err)
+		}
+		s.mustRun("", "import", bundle, "other-"+name)
+	}
+
+	match, _ := filepath.Glob(s.file("chains", "*"+EXT_CERT))
+	if len(match) != 1 {
+		t.Fatalf("got %d issuers stored, want 1", len(match))
+	}
+	data, err := os.ReadFile(s.file("certs", "other-web"+EXT_CERT))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := len(splitCerts(data)); n != 1 {
+		t.Errorf("got %d certificates in the file, want 1", n)
+	}
+
+	out := filepath.Join(t.TempDir(), "web.tar.gz")
+	s.mustRun("", "export", "-public", "-out", out, "other-web")
+	chain := readTarGz(t, out)["other-web-public/chain"+EXT_CERT]
+	if block, _ := pem.Decode(chain); block == nil || !bytes.Equal(block.Bytes, other.cert(NAME_CA).Raw) {
+		t.Error("export: chain not assembled")
+	}
+}
+
+func TestGC(t *testing.T) {
+	s := newTestStore(t, true)
+	s.issue("web")
+
+	// Certificate expired a year ago.
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expired := time.Now().AddDate(-1, 0, 0)
+	der, err := x509.CreateCertificate(rand.Reader, &x509.Certificate{
+		SerialNumber: big.NewInt(99),
+		Subject:      pkix.Name{CommonName: "old"},
+		NotBefore:    expired.AddDate(-1, 0, 0),
+		NotAfter:     expired,
+	}, &x509.Certificate{Subject: pkix.Name{CommonName: "old"}}, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file := filepath.Join(t.TempDir(), "old.crt")
+	if err = os.WriteFile(file, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644); err != nil {
+		t.Fatal(err)
+	}
+	s.mustRun("", "import", file, "old")
+
+	// Request never signed.
+	csr := s.file("left" + EXT_REQUEST)
+	if err = os.WriteFile(csr, []byte("request"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err = os.Chtimes(csr, expired, expired); err != nil {
+		t.Fatal(err)
+	}
+	// New request of a certificate still valid.
+	if err = os.WriteFile(s.file("web"+EXT_REQUEST), []byte("request"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err = os.Chtimes(s.file("web"+EXT_REQUEST), expired, expired); err != nil {
+		t.Fatal(err)
+	}
+
+	// Entry of the database.
+	db, err := openBolt(s.file(FILE_DB))
+	if err != nil {
+		t.Fatal(err)
+	}
+	st, err := db.load()
+	if err == nil {
+		st.Entries = append(st.Entries, &indexEntry{
+			INDEX_VALID, expired.UTC().Format(INDEX_TIME), "", "63", "unknown", "/CN=old",
+		})
+		err = db.save(st)
+	}
+	db.close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	out := s.mustRun("", "gc", "-dry-run")
+	for _, v := range []string{"old" + EXT_CERT, "left" + EXT_REQUEST, "\t63\t"} {
+		if !strings.Contains(out, v) {
+			t.Errorf("gc -dry-run without %q:\n%s", v, out)
+		}
+	}
+	if strings.Contains(out, "web") {
+		t.Errorf("gc -dry-run with certificate valid:\n%s", out)
+	}
+
+	s.mustRun("", "gc")
+	checkNotExist(t, s.file("certs", "old"+EXT_CERT), csr)
+	s.cert("web")
+	if _, err = os.Stat(s.file("web" + EXT_REQUEST)); err != nil {
+		t.Error(err)
+	}
+
+	match, _ := filepath.Glob(s.file("archive", "*", "certs", "old"+EXT_CERT))
+	if len(match) != 1 {
+		t.Error("certificate not archived")
+	}
+	data, err := os.ReadFile(s.file("index.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(data, []byte("/CN=old")) || !bytes.Contains(data, []byte("/CN=web")) {
+		t.Errorf("wrong database:\n%s", data)
+	}
+}
+
+// readTarGz returns the files of a compressed tar archive.
+func readTarGz(t *testing.T, file string) map[string][]byte {
+	t.Helper()
+
+	f, err := os.Open(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr := tar.NewReader(gz)
+	files := make(map[string][]byte)
+
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := io.ReadAll(tr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		files[hdr.Name] = data
+	}
+	return files
+}
+
+func TestQueue(t *testing.T) {
+	s := newTestStore(t, true)
+
+	newCSR := func(name string, args ...string) string {
+		file := filepath.Join(t.TempDir(), name+EXT_REQUEST)
+		out, err := exec.Command("openssl", append([]string{"req", "-new", "-nodes", "-newkey", "rsa:2048",
+			"-subj", "/CN=" + name, "-keyout", os.DevNull, "-out", file}, args...)...).CombinedOutput()
+		if err != nil {
+			t.Fatalf("%s\n%s", err, out)
+		}
+		return file
+	}
+	queueID := func(out string) string {
+		i := strings.LastIndex(out, ": ")
+		if i == -1 {
+			t.Fatalf("no identifier in output:\n%s", out)
+		}
+		return strings.TrimSpace(out[i+2:])
+	}
+
+	const sans = "subjectAltName=DNS:web.example.com,DNS:api.example.com,IP:127.0.0.1"
+	idOK := queueID(s.mustRun("", "queue", newCSR("dev1", "-addext", sans), "dev1"))
+	idNo := queueID(s.mustRun("", "queue", newCSR("dev2"), "dev2"))
+
+	if out := s.mustRun("", "queue"); !strings.Contains(out, idOK) || !strings.Contains(out, idNo) {
+		t.Errorf("pending requests not listed:\n%s", out)
+	}
+
+	s.mustRun(signInput, "approve", idOK)
+	if s.cert("dev1").Subject.CommonName != "dev1" {
+		t.Error("wrong certificate approved")
+	}
+	checkNotExist(t, s.file("dev1.cfg"))
+
+	// The subject alternative names of the request are kept, with every backend.
+	id := queueID(s.mustRun("", "queue", newCSR("dev3", "-addext", sans), "dev3"))
+	if out, err := s.runEnv([]string{envFlag("backend") + "=" + BACKEND_NATIVE}, signInput, "approve", id); err != nil {
+		t.Fatalf("approve with native backend: %s\n%s", err, out)
+	}
+	for _, name := range []string{"dev1", "dev3"} {
+		cert := s.cert(name)
+		if got := strings.Join(cert.DNSNames, ","); got != "web.example.com,api.example.com" ||
+			len(cert.IPAddresses) != 1 || !cert.IPAddresses[0].Equal(net.ParseIP("127.0.0.1")) {
+			t.Errorf("%s: got hosts %v %v", name, cert.DNSNames, cert.IPAddresses)
+		}
+	}
+	id = queueID(s.mustRun("", "queue", newCSR("dev4", "-addext", "subjectAltName=DNS:web example.com"), "dev4"))
+	if out, err := s.run(signInput, "approve", id); err == nil || !strings.Contains(out, errHost.Error()) {
+		t.Errorf("approve with wrong hostname: got error %v\n%s", err, out)
+	}
+
+	s.mustRun("", "deny", idNo)
+	checkNotExist(t, s.file("certs", "dev2"+EXT_CERT))
+
+	if _, err := s.run(signInput, "approve", idNo); err == nil {
+		t.Error("approve of request denied: got no error")
+	}
+	if out := s.mustRun("", "queue", "-all"); !strings.Contains(out, STATUS_APPROVED) ||
+		!strings.Contains(out, STATUS_DENIED) {
+		t.Errorf("requests done not listed:\n%s", out)
+	}
+}
+
+func TestAttestation(t *testing.T) {
+	s := newTestStore(t, true)
+
+	if err := os.WriteFile(s.file(FILE_STORE), []byte(`{"require_attestation": true}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	// The verifier accepts the statements with the word "genuine", whether it
+	// gets the key of the request.
+	hook := "#!/bin/sh\ntest -n \"$EASYCERT_SPKI\" && grep -q genuine \"$EASYCERT_ATTESTATION\"\n"
+	if err := os.WriteFile(s.file("hooks", HOOK_ATTEST), []byte(hook), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	newReq := func(name string) string {
+		csr := filepath.Join(dir, name+EXT_REQUEST)
+		if _, err := os.Stat(csr); err == nil {
+			return csr
+		}
+		if out, err := exec.Command("openssl", "req", "-new", "-nodes", "-newkey", "rsa:2048",
+			"-subj", "/CN="+name, "-keyout", filepath.Join(dir, name+EXT_KEY), "-out", csr).CombinedOutput(); err != nil {
+			t.Fatalf("%s\n%s", err, out)
+		}
+		return csr
+	}
+	// keyCert returns the certificate of the key of the request, like the
+	// first one of the chain of an attestation of Android.
+	keyCert := func(name string) string {
+		out, err := exec.Command("openssl", "req", "-x509", "-key", filepath.Join(dir, name+EXT_KEY),
+			"-subj", "/CN=Android Keystore Key").Output()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(out)
+	}
+	queue := func(name, statement string) (string, error) {
+		csr := newReq(name)
+		args := []string{"queue", csr, name}
+		if statement != "" {
+			att := filepath.Join(dir, name+".att")
+			if err := os.WriteFile(att, []byte(statement), 0600); err != nil {
+				t.Fatal(err)
+			}
+			args = append([]string{"queue", "-attestation", att}, args[1:]...)
+		}
+		out, err := s.run("", args...)
+		return strings.TrimSpace(out[strings.LastIndex(out, ": ")+2:]), err
+	}
+	mustQueue := func(name, statement string) string {
+		t.Helper()
+		id, err := queue(name, statement)
+		if err != nil {
+			t.Fatalf("queue %s: %s: %s", name, err, id)
+		}
+		return id
+	}
+
+	if _, err := s.run(signInput, "approve", mustQueue("dev1", "")); err == nil {
+		t.Error("approve without attestation: got no error")
+	}
+	if _, err := s.run(signInput, "approve", mustQueue("dev2", "forged")); err == nil {
+		t.Error("approve with attestation rejected: got no error")
+	}
+	s.mustRun(signInput, "approve", mustQueue("dev3", "genuine"))
+	s.cert("dev3")
+
+	// The certificate of the attested key has to be of the key of the request.
+	newReq("other")
+	if _, err := queue("dev4", keyCert("other")+"genuine\n"); err == nil {
+		t.Error("queue with attestation of other key: got no error")
+	}
+	if out := s.mustRun("", "queue", "-all"); strings.Contains(out, "dev4") {
+		t.Errorf("queue with attestation of other key: request added\n%s", out)
+	}
+	// A chain not issued by the roots of Google nor Apple is rejected, without
+	// the hook.
+	newReq("dev5")
+	if _, err := queue("dev5", keyCert("dev5")+"genuine\n"); err == nil {
+		t.Error("queue with attestation chain of other root: got no error")
+	}
+
+	if _, err := s.run(dnInput("web"), "req", "-sign", "web"); err == nil {
+		t.Error("req -sign with attestation required: got no error")
+	}
+}
+
+func TestAttestationChain(t *testing.T) {
+	newKey := func() *ecdsa.PrivateKey {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return key
+	}
+	newCert := func(tmpl, parent *x509.Certificate, pub, signer crypto.PrivateKey) *x509.Certificate {
+		tmpl.SerialNumber = big.NewInt(time.Now().UnixNano())
+		tmpl.NotBefore = time.Now().Add(-time.Hour)
+		tmpl.NotAfter = time.Now().Add(time.Hour)
+		if parent == nil {
+			parent = tmpl
+		}
+		der, err := x509.CreateCertificate(rand.Reader, tmpl, parent, pub, signer)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cert, _ := x509.ParseCertificate(der)
+		return cert
+	}
+	newCA := func(cn string, parent *x509.Certificate, signer *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+		key := newKey()
+		if signer == nil {
+			signer = key
+		}
+		return newCert(&x509.Certificate{
+			Subject:               pkix.Name{CommonName: cn},
+			BasicConstraintsValid: true,
+			IsCA:                  true,
+			KeyUsage:              x509.KeyUsageCertSign,
+		}, parent, key.Public(), signer), key
+	}
+
+	// Vendors with the roots of the test.
+	android, androidKey := newCA("Android Root", nil, nil)
+	inter, interKey := newCA("Android Intermediate", android, androidKey)
+	apple, appleKey := newCA("Apple Root", nil, nil)
+	other, otherKey := newCA("Other Root", nil, nil)
+
+	vendors := attestVendors
+	t.Cleanup(func() { attestVendors = vendors })
+	attestVendors = []attestVendor{
+		{"Android", x509.NewCertPool(), checkKeyDescription},
+		{"Apple", x509.NewCertPool(), nil},
+	}
+	attestVendors[0].roots.AddCert(android)
+	attestVendors[1].roots.AddCert(apple)
+
+	key := newKey()
+	der, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject: pkix.Name{CommonName: "dev"},
+	}, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req, _ := x509.ParseCertificateRequest(der)
+
+	description := func(level int) []pkix.Extension {
+		value, err := asn1.Marshal(struct {
+			AttestationVersion       int
+			AttestationSecurityLevel asn1.Enumerated
+			KeymasterVersion         int
+			KeymasterSecurityLevel   asn1.Enumerated
+			AttestationChallenge     []byte
+		}{3, asn1.Enumerated(level), 4, asn1.Enumerated(level), []byte("challenge")})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return []pkix.Extension{{Id: oidKeyDescription, Value: value}}
+	}
+	leaf := func(ext []pkix.Extension, pub crypto.PublicKey, parent *x509.Certificate, signer *ecdsa.PrivateKey) *x509.Certificate {
+		return newCert(&x509.Certificate{
+			Subject:         pkix.Name{CommonName: "Android Keystore Key"},
+			ExtraExtensions: ext,
+		}, parent, pub, signer)
+	}
+	toPEM := func(chain ...*x509.Certificate) []byte {
+		var b []byte
+		for _, v := range chain {
+			b = append(b, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: v.Raw})...)
+		}
+		return b
+	}
+	tee := leaf(description(1), key.Public(), inter, interKey)
+
+	for _, tt := range []struct {
+		name      string
+		statement []byte
+		verified  bool
+		err       string
+	}{
+		{"android", toPEM(tee, inter), true, ""},
+		{"android DER", append(append([]byte{}, tee.Raw...), inter.Raw...), true, ""},
+		{"android software", toPEM(leaf(description(_SECURITY_SOFTWARE), key.Public(), inter, interKey), inter), false, "secure hardware"},
+		{"android no description", toPEM(leaf(nil, key.Public(), inter, interKey), inter), false, "no key description"},
+		{"android no intermediate", toPEM(tee), false, errAttestChain.Error()},
+		{"apple", toPEM(leaf(nil, key.Public(), apple, appleKey)), true, ""},
+		{"other root", toPEM(leaf(description(1), key.Public(), other, otherKey)), false, errAttestChain.Error()},
+		{"other key", toPEM(leaf(description(1), newKey().Public(), inter, interKey), inter), false, errAttestKey.Error()},
+		// Left to the hook.
+		{"tpm", []byte("TPM statement"), false, ""},
+	} {
+		verified, err := checkAttestation(tt.statement, req)
+		if verified != tt.verified {
+			t.Errorf("%s: verified = %v, want %v (%v)", tt.name, verified, tt.verified, err)
+		}
+		if tt.err == "" && err != nil {
+			t.Errorf("%s: %s", tt.name, err)
+		} else if tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)) {
+			t.Errorf("%s: got error %v, want %q", tt.name, err, tt.err)
+		}
+	}
+}
+
+func TestEscrow(t *testing.T) {
+	s := newTestStore(t, true)
+	s.issue("escrow")
+
+	config := `{"escrow": {"cert": "escrow", "names": ["mail-*"]}}`
+	if err := os.WriteFile(s.file(FILE_STORE), []byte(config), 0644); err != nil {
+		t.Fatal(err)
+	}
+	s.mustRun(dnInput("mail-1"), "req", "mail-1")
+	s.mustRun(dnInput("web"), "req", "web")
+
+	checkNotExist(t, s.file("escrow", "web"+EXT_KEY+".cms"))
+
+	out := filepath.Join(t.TempDir(), "mail-1.key")
+	s.mustRun("", "recover", "-escrow-key", s.file("private", "escrow"+EXT_KEY), "-out", out, "mail-1")
+
+	want, err := os.ReadFile(s.file("private", "mail-1"+EXT_KEY))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := os.ReadFile(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Error("recovered key is different")
+	}
+	if block, _ := pem.Decode(got); block == nil {
+		t.Error("recovered key is not in PEM format")
+	}
+	checkMode(t, out, 0400)
+}
+
+// == Golden files
+//
+
+func TestAPI(t *testing.T) {
+	s := newTestStore(t, true)
+	useStore(t, s)
+
+	token := *Token
+	*Token = "secret"
+	defer func() { *Token = token }()
+
+	mux := http.NewServeMux()
+	apiHandle(mux)
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	c := client.New(srv.URL, "")
+	ok, err := c.Submit(client.Submission{Name: "dev1", CSR: string(newCSR(t, "dev1"))})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ok.Status != client.STATUS_PENDING || ok.Source != "api" {
+		t.Errorf("submit: got %+v", ok)
+	}
+	no, err := c.Submit(client.Submission{Name: "dev2", CSR: string(newCSR(t, "dev2"))})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = c.Submit(client.Submission{Name: "dev3", CSR: "garbage"}); err == nil {
+		t.Error("submit of invalid request: got no error")
+	}
+	if _, err = c.Get("missing"); err == nil || err.(*client.Error).StatusCode != http.StatusNotFound {
+		t.Errorf("get of missing request: got %v, want status 404", err)
+	}
+	if _, err = c.Approve(ok.ID); err == nil || err.(*client.Error).StatusCode != http.StatusUnauthorized {
+		t.Errorf("approve without token: got %v, want status 401", err)
+	}
+	if _, err = c.Cert(ok.ID); err == nil {
+		t.Error("cert of pending request: got no error")
+	}
+
+	c.Token = "secret"
+	if ok, err = c.Approve(ok.ID); err != nil {
+		t.Fatal(err)
+	}
+	if no, err = c.Deny(no.ID); err != nil {
+		t.Fatal(err)
+	}
+	if ok.Status != client.STATUS_APPROVED || no.Status != client.STATUS_DENIED {
+		t.Errorf("review: got %q and %q", ok.Status, no.Status)
+	}
+	if _, err = c.Approve(no.ID); err == nil || err.(*client.Error).StatusCode != http.StatusConflict {
+		t.Errorf("approve of request denied: got %v, want status 409", err)
+	}
+
+	list, err := c.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 2 {
+		t.Errorf("list: got %d requests, want 2", len(list))
+	}
+
+	data, err := c.Cert(ok.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, err := os.ReadFile(s.file("certs", "dev1"+EXT_CERT))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, want) {
+		t.Error("cert: got a different certificate")
+	}
+}
+
+func TestPortal(t *testing.T) {
+	s := newTestStore(t, true)
+	useStore(t, s)
+
+	token := *Token
+	*Token = "secret"
+	defer func() { *Token = token }()
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", portalIndex)
+	mux.HandleFunc("/submit", portalSubmit)
+	mux.HandleFunc("/approve", portalReview)
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	jar, err := cookiejar.New(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &http.Client{Jar: jar}
+	post := func(path string, form url.Values) (int, string) {
+		t.Helper()
+		resp, err := c.PostForm(srv.URL+path, form)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		if ct := resp.Header.Get("Content-Type"); !strings.HasPrefix(ct, "text/html") {
+			t.Errorf("%s: got content type %q", path, ct)
+		}
+		data, err := io.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp.StatusCode, string(data)
+	}
+
+	resp, err := c.Get(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	page, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, csrf, _ := strings.Cut(string(page), `name="csrf" value="`)
+	csrf, _, _ = strings.Cut(csrf, `"`)
+	if len(csrf) != 32 {
+		t.Fatalf("no token against CSRF in:\n%s", page)
+	}
+
+	form := url.Values{"name": {"dev1"}, "csr": {string(newCSR(t, "dev1"))}}
+	if status, _ := post("/submit", form); status != http.StatusForbidden {
+		t.Errorf("submit without token against CSRF: got status %d", status)
+	}
+	form.Set("csrf", csrf)
+	status, out := post("/submit", form)
+	if status != http.StatusOK || !strings.Contains(out, "submitted") {
+		t.Fatalf("submit: got status %d\n%s", status, out)
+	}
+	list, err := listQueue()
+	if err != nil || len(list) != 1 {
+		t.Fatalf("queue: got %d requests, %v", len(list), err)
+	}
+
+	form = url.Values{"id": {list[0].ID}, "token": {"wrong"}, "csrf": {csrf}}
+	if status, _ = post("/approve", form); status != http.StatusForbidden {
+		t.Errorf("approve with wrong token: got status %d", status)
+	}
+	form.Set("token", "secret")
+	form.Set("csrf", strings.Repeat("0", 32))
+	if status, _ = post("/approve", form); status != http.StatusForbidden {
+		t.Errorf("approve with wrong token against CSRF: got status %d", status)
+	}
+	form.Set("csrf", csrf)
+	if status, out = post("/approve", form); status != http.StatusOK || !strings.Contains(out, "approved") {
+		t.Errorf("approve: got status %d\n%s", status, out)
+	}
+
+	// The operators of the store need the client certificate.
+	s.setOperators(map[string]string{NAME_PORTAL: ROLE_ADMIN})
+	form = url.Values{"name": {"dev2"}, "csr": {string(newCSR(t, "dev2"))}, "csrf": {csrf}}
+	if status, out = post("/submit", form); status != http.StatusOK {
+		t.Fatalf("submit: got status %d\n%s", status, out)
+	}
+	if list, err = listQueue(); err != nil {
+		t.Fatal(err)
+	}
+	for _, v := range list {
+		if v.Name != "dev2" {
+			continue
+		}
+		form = url.Values{"id": {v.ID}, "token": {"secret"}, "csrf": {csrf}}
+		if status, out = post("/approve", form); status != http.StatusForbidden || !strings.Contains(out, "client certificate") {
+			t.Errorf("approve without client certificate: got status %d\n%s", status, out)
+		}
+	}
+}
+
+func TestRemoteSSH(t *testing.T) {
+	s := newTestStore(t, true)
+	s.issue("web", "-host", "www.example.com")
+
+	// A fake ssh which records its arguments, and runs the command line given
+	// after "--" in this host.
+	bin := t.TempDir()
+	logFile := filepath.Join(bin, "log")
+	script := fmt.Sprintf("#!/bin/sh\necho \"$*\" >> %s\nwhile [ \"$1\" != -- ]; do shift; done\nexec sh -c \"$2\"\n", logFile)
+	if err := os.WriteFile(filepath.Join(bin, "ssh"), []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	env := []string{"PATH=" + bin + string(os.PathListSeparator) + os.Getenv("PATH"),
+		ENV_ROOT + "=ssh://admin@ca.example.com:2222" + s.root,
+		ENV_REMOTE_CMD + "=" + os.Args[0],
+	}
+
+	out, err := s.runEnv(env, "", "ls")
+	if err != nil || !strings.Contains(out, "web") || !strings.Contains(out, "not sent to the server") {
+		t.Errorf("ls in remote: got %v\n%s", err, out)
+	}
+	data, err := os.ReadFile(logFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := fmt.Sprintf("-p 2222 admin@ca.example.com -- %s='%s' %s=1 '%s' 'ls'\n",
+		ENV_ROOT, s.root, ENV_READONLY, os.Args[0])
+	if string(data) != want {
+		t.Errorf("got ssh\n%s\nwant\n%s", data, want)
+	}
+	if strings.Contains(string(data), testCAPass) {
+		t.Error("passphrase of the CA sent to the server")
+	}
+
+	// The directory is modified only whether it is allowed.
+	if out, err = s.runEnv(env, "", "revoke", "web"); err == nil || !strings.Contains(out, "read-only mode") {
+		t.Errorf("revoke in remote without writing allowed: got %v\n%s", err, out)
+	}
+	if out, err = s.runEnv(append(env, ENV_REMOTE_WRITE+"=1"), "", "revoke", "web"); err != nil {
+		t.Errorf("revoke in remote: %s\n%s", err, out)
+	}
+	if data, _ = os.ReadFile(s.file("index.txt")); !strings.HasPrefix(string(data), INDEX_VALID) ||
+		!strings.Contains(string(data), "\n"+INDEX_REVOKED+"\t") {
+		t.Errorf("revoke in remote: got database\n%s", data)
+	}
+}
+
+func TestRemoteAPI(t *testing.T) {
+	ca := newTestStore(t, true)
+	useStore(t, ca)
+
+	token := *Token
+	*Token = "secret"
+	defer func() { *Token = token }()
+
+	mux := http.NewServeMux()
+	apiHandle(mux)
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	// The developer has a directory without CA.
+	s := newTestStore(t, false)
+	env := []string{ENV_REMOTE + "=" + srv.URL, ENV_REMOTE_TOKEN + "=secret"}
+	run := func(stdin string, args ...string) string {
+		t.Helper()
+		out, err := s.runEnv(env, stdin, args...)
+		if err != nil {
+			t.Fatalf("%s: %s\n%s", strings.Join(args, " "), err, out)
+		}
+		return out
+	}
+
+	if out := run(dnInput("web"), "req", "web"); !strings.Contains(out, "Submitted request") {
+		t.Errorf("req: request not submitted:\n%s", out)
+	}
+	if out := run("", "ls", "-req"); !strings.Contains(out, "web"+EXT_REQUEST) {
+		t.Errorf("ls -req: pending request not listed:\n%s", out)
+	}
+	run("", "sign", "web")
+	run(dnInput("api"), "req", "-sign", "api")
+
+	// The keys are only in the local directory.
+	for _, name := range []string{"web", "api"} {
+		if !s.cert(name).Equal(ca.cert(name)) {
+			t.Errorf("certificate %q not downloaded", name)
+		}
+		checkNotExist(t, s.file(name+EXT_REQUEST))
+		checkNotExist(t, ca.file("private", name+EXT_KEY))
+	}
+
+	if out := run("", "ls", "-cert"); !strings.Contains(out, "web"+EXT_CERT) ||
+		!strings.Contains(out, "api"+EXT_CERT) {
+		t.Errorf("ls -cert: certificates not listed:\n%s", out)
+	}
+	if out := run("", "info", "-name", "web"); !strings.Contains(out, "CN = web") &&
+		!strings.Contains(out, "CN=web") {
+		t.Errorf("info: got\n%s", out)
+	}
+
+	if out, err := s.runEnv(env[:1], "", "revoke", "web"); err == nil {
+		t.Errorf("revoke without token: got no error\n%s", out)
+	}
+	run("", "revoke", "-reason", "superseded", "web")
+
+	entries, err := readIndex()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e := findIndex(entries, ca.cert("web").SerialNumber); e == nil || e.reason() != REASON_SUPERSEDED {
+		t.Errorf("certificate not revoked in the CA: %+v", e)
+	}
+	if _, err = os.Stat(File.CRL); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestOpenAPIGolden(t *testing.T) {
+	golden := filepath.Join("testdata", "openapi.json")
+	got := openAPISpec()
+
+	if *update {
+		if err := os.WriteFile(golden, got, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want, err := os.ReadFile(golden)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("OpenAPI differs from %q; run \"go test -update\" whether the change is expected", golden)
+	}
+}
+
+func TestReferenceGolden(t *testing.T) {
+	golden := filepath.Join("testdata", PROGRAM+".md")
+	got := markdown()
+
+	if *update {
+		if err := os.MkdirAll("testdata", 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(golden, got, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want, err := os.ReadFile(golden)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("reference differs from %q; run \"go test -update\" whether the change is expected", golden)
+	}
+}
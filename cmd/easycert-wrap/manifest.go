@@ -0,0 +1,168 @@
+// Copyright 2014 Jonas mg
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+// Manifest of the files exported or deployed, so whoever receives them can
+// verify their integrity and provenance.
+
+package main
+
+import (
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// FILE_MANIFEST is the name of the manifest into the archives and directories;
+// the one of a single file is written next to it, with EXT_MANIFEST appended.
+const (
+	FILE_MANIFEST = "manifest.json"
+	EXT_MANIFEST  = ".manifest.json"
+)
+
+var IsManifest = flag.Bool("manifest", false, "add a manifest with the digests and the provenance of the files")
+
+// Manifest represents the manifest of the files of a certificate.
+type Manifest struct {
+	// SHA-256 fingerprint of the root CA of the store which exported the
+	// files.
+	Store     string    `json:"store,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+
+	Certificate *CertInfo `json:"certificate"`
+	KeyUsage    []string  `json:"key_usage,omitempty"`
+	ExtKeyUsage []string  `json:"ext_key_usage,omitempty"`
+
+	// The CA certificates, from the issuer up to the root.
+	Chain []*ManifestCert `json:"chain"`
+	Files []*ManifestFile `json:"files"`
+}
+
+// ManifestCert represents a CA certificate of the chain.
+type ManifestCert struct {
+	Subject           string `json:"subject"`
+	FingerprintSHA256 string `json:"fingerprint_sha256"`
+}
+
+// ManifestFile represents a file, with its path relative to the manifest.
+type ManifestFile struct {
+	Name   string `json:"name"`
+	Size   int    `json:"size"`
+	SHA256 string `json:"sha256"` // like sha256sum
+}
+
+// Names of the key usages, like OpenSSL.
+var (
+	keyUsageNames = []struct {
+		usage x509.KeyUsage
+		name  string
+	}{
+		{x509.KeyUsageDigitalSignature, "digitalSignature"},
+		{x509.KeyUsageContentCommitment, "nonRepudiation"},
+		{x509.KeyUsageKeyEncipherment, "keyEncipherment"},
+		{x509.KeyUsageDataEncipherment, "dataEncipherment"},
+		{x509.KeyUsageKeyAgreement, "keyAgreement"},
+		{x509.KeyUsageCertSign, "keyCertSign"},
+		{x509.KeyUsageCRLSign, "cRLSign"},
+		{x509.KeyUsageEncipherOnly, "encipherOnly"},
+		{x509.KeyUsageDecipherOnly, "decipherOnly"},
+	}
+
+	extKeyUsageNames = map[x509.ExtKeyUsage]string{
+		x509.ExtKeyUsageAny:             "anyExtendedKeyUsage",
+		x509.ExtKeyUsageServerAuth:      "serverAuth",
+		x509.ExtKeyUsageClientAuth:      "clientAuth",
+		x509.ExtKeyUsageCodeSigning:     "codeSigning",
+		x509.ExtKeyUsageEmailProtection: "emailProtection",
+		x509.ExtKeyUsageTimeStamping:    "timeStamping",
+		x509.ExtKeyUsageOCSPSigning:     "OCSPSigning",
+	}
+)
+
+// newManifest returns the manifest of the files of the certificate `name`, in
+// JSON format.
+func newManifest(name string, cert *x509.Certificate, files []archiveFile) ([]byte, error) {
+	m := &Manifest{
+		CreatedAt:   time.Now().UTC().Truncate(time.Second),
+		Certificate: newCertInfo(name, cert),
+		Chain:       []*ManifestCert{},
+	}
+	if root, err := parseCertFile(caFile(NAME_CA)); err == nil {
+		m.Store = fingerprint(sha256Sum(root.Raw))
+	}
+
+	for _, v := range keyUsageNames {
+		if cert.KeyUsage&v.usage != 0 {
+			m.KeyUsage = append(m.KeyUsage, v.name)
+		}
+	}
+	for _, v := range cert.ExtKeyUsage {
+		if s, ok := extKeyUsageNames[v]; ok {
+			m.ExtKeyUsage = append(m.ExtKeyUsage, s)
+		}
+	}
+	for _, v := range cert.UnknownExtKeyUsage {
+		m.ExtKeyUsage = append(m.ExtKeyUsage, v.String())
+	}
+
+	for _, v := range chainOf(cert, chainCerts()) {
+		m.Chain = append(m.Chain, &ManifestCert{
+			Subject:           v.Cert.Subject.String(),
+			FingerprintSHA256: fingerprint(sha256Sum(v.Cert.Raw)),
+		})
+	}
+	for _, f := range files {
+		m.Files = append(m.Files, &ManifestFile{
+			Name:   f.name,
+			Size:   len(f.data),
+			SHA256: hex.EncodeToString(sha256Sum(f.data)),
+		})
+	}
+
+	data, err := json.MarshalIndent(m, "", "\t")
+	if err != nil {
+		return nil, err
+	}
+	return append(data, '\n'), nil
+}
+
+// withManifest returns the files with their manifest added, whether it is set
+// in the flags.
+func withManifest(name string, cert *x509.Certificate, files []archiveFile) []archiveFile {
+	if !*IsManifest {
+		return files
+	}
+	data, err := newManifest(name, cert, files)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return append(files, archiveFile{FILE_MANIFEST, data})
+}
+
+// writeManifest writes the manifest of the file `out` next to it, whether it
+// is set in the flags.
+func writeManifest(name string, cert *x509.Certificate, out string) {
+	if !*IsManifest {
+		return
+	}
+	data, err := os.ReadFile(out)
+	if err != nil {
+		log.Fatal(err)
+	}
+	manifest, err := newManifest(name, cert, []archiveFile{{filepath.Base(out), data}})
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err = writeFileAtomic(out+EXT_MANIFEST, manifest, 0644); err != nil {
+		log.Fatal(err)
+	}
+	fmt.Printf("- Manifest:\t%q\n", out+EXT_MANIFEST)
+}
@@ -0,0 +1,219 @@
+// Copyright 2014 Jonas mg
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+// Configuration profiles of Apple (".mobileconfig"), to install the CA in the
+// devices of iOS and macOS.
+
+package main
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/xml"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/tredoe/easycert"
+)
+
+// ENV_P12_PASS is the environment variable with the password of the bundles in
+// PKCS#12: the identity embedded in the configuration profile, and "-p12".
+const ENV_P12_PASS = "EASYCERT_P12_PASS"
+
+const (
+	EXT_MOBILECONFIG = ".mobileconfig"
+
+	// Prefix of the identifiers of the profiles and their payloads.
+	_PAYLOAD_ID_PREFIX = "com.github.tredoe.easycert."
+)
+
+// Types of the payloads of certificates.
+const (
+	PAYLOAD_ROOT   = "com.apple.security.root"   // Trusted root CA.
+	PAYLOAD_PKCS1  = "com.apple.security.pkcs1"  // Intermediate CA.
+	PAYLOAD_PKCS12 = "com.apple.security.pkcs12" // Identity.
+)
+
+// plistEntry represents a key and its value into a dictionary of a property
+// list. The value is a string, int, bool, []byte or []plistDict.
+type plistEntry struct {
+	key   string
+	value interface{}
+}
+
+// plistDict represents a dictionary of a property list, with the keys in the
+// order to write.
+type plistDict []plistEntry
+
+// writePlist writes the dictionary like an XML property list.
+func writePlist(dict plistDict) []byte {
+	var b bytes.Buffer
+
+	b.WriteString(xml.Header)
+	b.WriteString(`<!DOCTYPE plist PUBLIC "-//Apple//DTD PLIST 1.0//EN" "http://www.apple.com/DTDs/PropertyList-1.0.dtd">` + "\n")
+	b.WriteString(`<plist version="1.0">` + "\n")
+	writePlistDict(&b, dict, 0)
+	b.WriteString("</plist>\n")
+	return b.Bytes()
+}
+
+func writePlistDict(b *bytes.Buffer, dict plistDict, depth int) {
+	indent := strings.Repeat("\t", depth)
+
+	b.WriteString(indent + "<dict>\n")
+	for _, v := range dict {
+		b.WriteString(indent + "\t<key>")
+		xml.EscapeText(b, []byte(v.key))
+		b.WriteString("</key>\n")
+		writePlistValue(b, v.value, depth+1)
+	}
+	b.WriteString(indent + "</dict>\n")
+}
+
+func writePlistValue(b *bytes.Buffer, value interface{}, depth int) {
+	indent := strings.Repeat("\t", depth)
+
+	switch v := value.(type) {
+	case string:
+		b.WriteString(indent + "<string>")
+		xml.EscapeText(b, []byte(v))
+		b.WriteString("</string>\n")
+	case int:
+		fmt.Fprintf(b, "%s<integer>%d</integer>\n", indent, v)
+	case bool:
+		if v {
+			b.WriteString(indent + "<true/>\n")
+		} else {
+			b.WriteString(indent + "<false/>\n")
+		}
+	case []byte:
+		b.WriteString(indent + "<data>\n")
+		enc := base64.StdEncoding.EncodeToString(v)
+		for len(enc) > 64 {
+			b.WriteString(indent + enc[:64] + "\n")
+			enc = enc[64:]
+		}
+		b.WriteString(indent + enc + "\n")
+		b.WriteString(indent + "</data>\n")
+	case []plistDict:
+		b.WriteString(indent + "<array>\n")
+		for _, d := range v {
+			writePlistDict(b, d, depth+1)
+		}
+		b.WriteString(indent + "</array>\n")
+	default:
+		panic(fmt.Sprintf("plist: unsupported type %T", value))
+	}
+}
+
+// payloadUUID returns an UUID derived from the identifier and the content of
+// the payload (like the version 5), so that the profile exported again for
+// the same certificates replaces the installed one.
+func payloadUUID(id string, content []byte) string {
+	h := sha1.New()
+	h.Write([]byte(id))
+	h.Write(content)
+	u := h.Sum(nil)[:16]
+
+	u[6] = u[6]&0x0f | 0x50
+	u[8] = u[8]&0x3f | 0x80
+	return fmt.Sprintf("%X-%X-%X-%X-%X", u[0:4], u[4:6], u[6:8], u[8:10], u[10:])
+}
+
+// certPayload returns the payload of type `payloadType` with the DER data.
+func certPayload(payloadType, id, uuid, fileName, displayName string, data []byte) plistDict {
+	return plistDict{
+		{"PayloadCertificateFileName", fileName},
+		{"PayloadContent", data},
+		{"PayloadDescription", "Adds a certificate"},
+		{"PayloadDisplayName", displayName},
+		{"PayloadIdentifier", id},
+		{"PayloadType", payloadType},
+		{"PayloadUUID", uuid},
+		{"PayloadVersion", 1},
+	}
+}
+
+// ExportMobileConfig writes a configuration profile with the CA certificates
+// of the certificate, and its identity whether `withIdentity` is set.
+func ExportMobileConfig(name, out string, withIdentity bool) {
+	cert, err := parseCertFile(File.Cert)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if withIdentity && cert.IsCA {
+		log.Fatal("The private key of a CA is not exported to the devices")
+	}
+	profileID := _PAYLOAD_ID_PREFIX + name
+	cas := mustTrustedCAs(name, cert)
+
+	var payloads []plistDict
+	var content bytes.Buffer
+
+	for i, v := range cas {
+		payloadType := PAYLOAD_PKCS1
+		if i == len(cas)-1 && bytes.Equal(v.Cert.RawIssuer, v.Cert.RawSubject) {
+			payloadType = PAYLOAD_ROOT
+		}
+		id := fmt.Sprintf("%s.ca.%s", profileID, easycert.SerialHex(v.Cert.SerialNumber))
+		payloads = append(payloads, certPayload(payloadType, id, payloadUUID(id, v.Cert.Raw),
+			fmt.Sprintf("ca-%d%s", i, EXT_CERT), v.Cert.Subject.CommonName, v.Cert.Raw))
+		content.Write(v.Cert.Raw)
+	}
+
+	if withIdentity {
+		if os.Getenv(ENV_P12_PASS) == "" {
+			log.Fatalf("The password of the identity has to be set in %s", ENV_P12_PASS)
+		}
+		// 3DES and SHA-1 since the devices do not support the algorithms by
+		// default of OpenSSL 3.
+		p12 := openssl("pkcs12", "-export", "-in", File.Cert, "-inkey", File.Key,
+			"-name", name, "-passout", "env:"+ENV_P12_PASS,
+			"-keypbe", "PBE-SHA1-3DES", "-certpbe", "PBE-SHA1-3DES", "-macalg", "sha1",
+		)
+		defer zero(p12)
+
+		// The PKCS#12 data changes every time, so the UUID is got from the
+		// certificate.
+		id := profileID + ".identity"
+		payloads = append(payloads, certPayload(PAYLOAD_PKCS12, id, payloadUUID(id, cert.Raw),
+			name+EXT_PKCS12, cert.Subject.CommonName, p12))
+		content.Write(cert.Raw)
+	}
+
+	organization := "EasyCert"
+	if len(cas[len(cas)-1].Cert.Subject.Organization) != 0 {
+		organization = cas[len(cas)-1].Cert.Subject.Organization[0]
+	}
+	profile := plistDict{
+		{"PayloadContent", payloads},
+		{"PayloadDescription", fmt.Sprintf("Trust of the certificates issued by %q", cas[len(cas)-1].Cert.Subject.CommonName)},
+		{"PayloadDisplayName", "EasyCert: " + name},
+		{"PayloadIdentifier", profileID},
+		{"PayloadOrganization", organization},
+		{"PayloadRemovalDisallowed", false},
+		{"PayloadType", "Configuration"},
+		{"PayloadUUID", payloadUUID(profileID, content.Bytes())},
+		{"PayloadVersion", 1},
+	}
+
+	if _, err = os.Stat(out); !os.IsNotExist(err) {
+		log.Fatalf("File already exists: %q", out)
+	}
+	perm := os.FileMode(0644)
+	if withIdentity {
+		perm = 0600
+	}
+	if err = writeFileAtomic(out, writePlist(profile), perm); err != nil {
+		log.Fatal(err)
+	}
+
+	fmt.Printf("\n== Generated\n- Profile:\t%q\n", out)
+	writeManifest(name, cert, out)
+}
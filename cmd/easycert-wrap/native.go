@@ -0,0 +1,655 @@
+// Copyright 2014 Jonas mg
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+// Native backend, which handles the certificates in Go instead of executing
+// OpenSSL, keeping the same files and database.
+
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"flag"
+	"fmt"
+	"io/fs"
+	"log"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tredoe/easycert"
+	"github.com/tredoe/easycert/store"
+)
+
+// Backends of the certificates.
+const (
+	BACKEND_OPENSSL = "openssl"
+	BACKEND_NATIVE  = "native"
+)
+
+var Backend = flag.String("backend", BACKEND_OPENSSL, "backend of the certificates: openssl or native")
+
+// nativeBackend reports whether the certificates are handled in Go, without
+// OpenSSL.
+func nativeBackend() bool {
+	switch *Backend {
+	case BACKEND_OPENSSL:
+		return false
+	case BACKEND_NATIVE:
+		return true
+	}
+	log.Fatalf("Invalid value %q for flag -backend: must be %q or %q", *Backend, BACKEND_OPENSSL, BACKEND_NATIVE)
+	return false
+}
+
+// NATIVE_TIME is the format of the dates printed like OpenSSL.
+const NATIVE_TIME = "Jan _2 15:04:05 2006 GMT"
+
+// == Names
+//
+
+// nativeName returns the name with the default values and the common name.
+func nativeName(commonName string) easycert.Name {
+	return easycert.Name{
+		Country:            Subject.Country,
+		Province:           Subject.State,
+		Locality:           Subject.Locality,
+		Organization:       Subject.Organization,
+		OrganizationalUnit: Subject.Unit,
+		CommonName:         commonName,
+	}
+}
+
+// nativeSubject returns the subject with the default values and the common
+// name, in the types of string used by OpenSSL.
+func nativeSubject(commonName string) ([]byte, error) {
+	name := nativeName(commonName)
+	return name.Marshal()
+}
+
+// == Keys
+//
+
+// nativeGenerateKey generates the key set in "-key-type", showing a spinner in
+// batch mode.
+func nativeGenerateKey() (crypto.Signer, error) {
+	var s *spinner
+	if batchMode() {
+		s = startSpinner(keygenMessage())
+	}
+
+	key, err := KeySpec.generate()
+	if err != nil {
+		s.end("")
+		return nil, err
+	}
+	s.end("done")
+	return key, nil
+}
+
+// writeKeyFile writes the private key in PKCS#8 into the file, encrypted
+// whether the passphrase is not empty.
+func writeKeyFile(file string, key crypto.Signer, pass string) error {
+	data, err := easycert.MarshalKey(key, pass)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(file, data, 0600)
+}
+
+// loadKeyFile returns the private key of the file, decrypted with the
+// passphrase whether it is encrypted in PKCS#8.
+func loadKeyFile(file, pass string) (crypto.Signer, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	key, err := easycert.ParseKey(data, pass)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", file, err)
+	}
+	return key, nil
+}
+
+// caKeyCache is the CA's private key of the native backend, kept by the
+// long-running commands to sign without decrypting the key for every
+// certificate, while the CA and the source of its key are the same.
+var caKeyCache struct {
+	sync.Mutex
+	cert   []byte            // Certificate of the CA, in DER format.
+	source [sha256.Size]byte // Digest of the KMS, or the file and passphrase.
+	key    crypto.Signer
+}
+
+// nativeCAKey returns the private key of the CA `ca`: the one in a KMS, or else
+// the one of the file, decrypted with the passphrase of the environment.
+func nativeCAKey(ca *x509.Certificate) (crypto.Signer, error) {
+	uri := loadKMS()
+	keyFile := filepath.Join(Dir.Key, NAME_CA+EXT_KEY)
+	pass := ""
+
+	if uri == "" {
+		if loadYubiKey() != nil {
+			return nil, errYubiKeyNative
+		}
+		var err error
+		if pass, err = caPass(); err != nil {
+			return nil, err
+		}
+	}
+	source := sha256.Sum256([]byte(uri + "\x00" + keyFile + "\x00" + pass))
+
+	caKeyCache.Lock()
+	defer caKeyCache.Unlock()
+	if caKeyCache.key != nil && caKeyCache.source == source && bytes.Equal(caKeyCache.cert, ca.Raw) {
+		return caKeyCache.key, nil
+	}
+
+	var key crypto.Signer
+	var err error
+	if uri != "" {
+		key, err = newKMSSigner(uri)
+	} else {
+		key, err = loadKeyFile(keyFile, pass)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if pub, ok := ca.PublicKey.(interface{ Equal(crypto.PublicKey) bool }); !ok || !pub.Equal(key.Public()) {
+		return nil, errors.New("the private key is not the one of the CA")
+	}
+
+	caKeyCache.cert, caKeyCache.source, caKeyCache.key = ca.Raw, source, key
+	return key, nil
+}
+
+// caPass returns the passphrase of the CA's private key, which the native
+// backend only gets from the source of "-passin" or the environment.
+func caPass() (string, error) {
+	if *PassIn != "" {
+		return readPassIn(*PassIn)
+	}
+	pass := os.Getenv(ENV_CA_PASS)
+	if pass == "" {
+		return "", fmt.Errorf("the native backend needs the passphrase of the CA's private key in %s", ENV_CA_PASS)
+	}
+	return pass, nil
+}
+
+// nativeCRL generates the revocation list of the CA from its database, signed
+// in Go, with the validity of "default_crl_days" of the configuration.
+func nativeCRL() error {
+	ca, err := parseCertFile(filepath.Join(Dir.Cert, NAME_CA+EXT_CERT))
+	if err != nil {
+		return err
+	}
+	key, err := nativeCAKey(ca)
+	if err != nil {
+		return err
+	}
+	entries, err := readIndex()
+	if err != nil {
+		return err
+	}
+	data, err := os.ReadFile(File.CRLNumber)
+	if err != nil {
+		return err
+	}
+	number, ok := new(big.Int).SetString(strings.TrimSpace(string(data)), 16)
+	if !ok {
+		return fmt.Errorf("%s: wrong CRL number", File.CRLNumber)
+	}
+
+	tmpl := &x509.RevocationList{Number: number, ThisUpdate: time.Now()}
+	tmpl.NextUpdate = tmpl.ThisUpdate.AddDate(0, 0, 30)
+	for _, v := range entries {
+		if v.Status != INDEX_REVOKED {
+			continue
+		}
+		serial, ok := new(big.Int).SetString(v.Serial, 16)
+		if !ok {
+			return fmt.Errorf("%s: wrong serial number: %q", File.Index, v.Serial)
+		}
+		revoked, err := time.Parse(INDEX_TIME, strings.Split(v.Revocation, ",")[0])
+		if err != nil {
+			return fmt.Errorf("%s: serial %s: wrong revocation: %q", File.Index, v.Serial, v.Revocation)
+		}
+		tmpl.RevokedCertificateEntries = append(tmpl.RevokedCertificateEntries, x509.RevocationListEntry{
+			SerialNumber: serial, RevocationTime: revoked, ReasonCode: reasonCode(v.reason()),
+		})
+	}
+
+	der, err := x509.CreateRevocationList(rand.Reader, tmpl, ca, key)
+	if err != nil {
+		return err
+	}
+	tmp, err := tempFile(File.CRL)
+	if err != nil {
+		return err
+	}
+	if err = os.WriteFile(tmp, der, 0600); err != nil {
+		return err
+	}
+	if err = commitFile(tmp, File.CRL, 0644); err != nil {
+		return err
+	}
+	next := new(big.Int).Add(number, big.NewInt(1))
+	return writeFileAtomic(File.CRLNumber, []byte(fmt.Sprintf("%02X\n", next)), 0644)
+}
+
+// == Database
+//
+
+// nativeStore is the certificates directory for the package easycert, where
+// the certificate `name` is written into `certFile`, the temporary file of the
+// issuance, and the new files are added to the issuance to be removed whether
+// it is rolled back.
+type nativeStore struct {
+	store.Dir
+	name, certFile string
+}
+
+func (s nativeStore) WriteFile(name string, data []byte, perm fs.FileMode) error {
+	if name == store.CertFile(s.name) {
+		return os.WriteFile(s.certFile, data, perm)
+	}
+	file := filepath.Join(string(s.Dir), filepath.FromSlash(name))
+	if _, err := os.Stat(file); os.IsNotExist(err) {
+		curIssuance.addFile(file)
+	}
+	return writeFileAtomic(file, data, perm)
+}
+
+// openNativeStore returns the certificates directory, where the certificate
+// `name` is written into `certFile`.
+func openNativeStore(name, certFile string) (*easycert.Store, error) {
+	return easycert.Open(nativeStore{store.Dir(Dir.Root), name, certFile})
+}
+
+// == Commands
+//
+
+// nativeCA generates the CA's private key, encrypted with the passphrase of
+// the environment, and its self-signed certificate.
+func nativeCA(keyFile, certFile string) error {
+	pass, err := caPass()
+	if err != nil {
+		return err
+	}
+	key, err := nativeGenerateKey()
+	if err != nil {
+		return err
+	}
+	if err = nativeCACert(key, certFile); err != nil {
+		return err
+	}
+	return writeKeyFile(keyFile, key, pass)
+}
+
+// nativeCACert writes the self-signed certificate of the CA with the key.
+func nativeCACert(key crypto.Signer, certFile string) error {
+	s, err := openNativeStore(NAME_CA, certFile)
+	if err != nil {
+		return err
+	}
+	_, err = s.CreateCASigner(nativeName(strings.TrimSpace(Subject.Organization+" CA")), key, 365**Years)
+	return err
+}
+
+// nativeReq generates the certificate request of `name` into `reqFile`, with
+// a new private key into `keyFile`, or with the one at File.Key whether it is
+// empty. The subject has the default values, and the common name of the
+// configuration of the request.
+func nativeReq(name, keyFile, reqFile string) error {
+	commonName := requestCommonName(File.SrvConfig)
+	if commonName == "" {
+		commonName = name
+	}
+	subject, err := nativeSubject(commonName)
+	if err != nil {
+		return err
+	}
+	return nativeWriteReq(subject, keyFile, reqFile)
+}
+
+// nativeWriteReq writes the request with the subject in DER format; its key
+// is the one of File.Key whether keyFile is empty, else a new one written to
+// keyFile.
+func nativeWriteReq(subject []byte, keyFile, reqFile string) error {
+	var key crypto.Signer
+	var err error
+
+	pass, err := reqKeyPass()
+	if err != nil {
+		return err
+	}
+	if keyFile == "" {
+		if key, err = loadKeyFile(File.Key, pass); err != nil {
+			return err
+		}
+	} else {
+		if key, err = nativeGenerateKey(); err != nil {
+			return err
+		}
+		if err = writeKeyFile(keyFile, key, pass); err != nil {
+			return err
+		}
+	}
+
+	der, err := x509.CreateCertificateRequest(rand.Reader,
+		&x509.CertificateRequest{RawSubject: subject}, key)
+	if err != nil {
+		return err
+	}
+	data := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: der})
+	return os.WriteFile(reqFile, data, 0644)
+}
+
+// requestCommonName returns the default of the common name set in the
+// configuration of a request.
+func requestCommonName(config string) string {
+	data, err := os.ReadFile(config)
+	if err != nil {
+		return ""
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		if key, value, ok := strings.Cut(line, "="); ok && strings.TrimSpace(key) == "commonName_default" {
+			return strings.TrimSpace(value)
+		}
+	}
+	return ""
+}
+
+// nativeIssue signs the request at File.Request with the CA into `certFile`,
+// adding the extensions of the configuration of the request `config`, whether
+// it is not empty. The subject of the certificate is `subject` in DER format,
+// or the one of the request whether it is nil.
+func nativeIssue(subject []byte, config, certFile string) error {
+	data, err := os.ReadFile(File.Request)
+	if err != nil {
+		return err
+	}
+	req, err := parseRequestPEM(data)
+	if err != nil {
+		return fmt.Errorf("%s: %s", File.Request, err)
+	}
+	tmpl := new(x509.Certificate)
+	if config != "" {
+		if isIDevID(config) {
+			return errors.New("the native backend does not sign IDevID requests")
+		}
+		if err = nativeExtensions(tmpl, config); err != nil {
+			return err
+		}
+	}
+
+	name := strings.TrimSuffix(filepath.Base(File.Cert), EXT_CERT)
+	s, err := openNativeStore(name, certFile)
+	if err != nil {
+		return err
+	}
+	caCert, err := s.Cert(NAME_CA)
+	if err != nil {
+		return err
+	}
+	key, err := nativeCAKey(caCert)
+	if err != nil {
+		return err
+	}
+	ca, err := s.LoadCASigner(key)
+	if err != nil {
+		return err
+	}
+	_, err = ca.Sign(&easycert.Request{Name: name, CSR: req}, &easycert.SignOptions{
+		NotAfter: validityEnd(), Subject: subject, Template: tmpl,
+	})
+	return err
+}
+
+// nativeExtensions adds to the template the extensions set in the
+// configuration of the request: the subject alternative names and the key
+// usage.
+func nativeExtensions(tmpl *x509.Certificate, config string) error {
+	ext, err := requestExtensions(config)
+	if err != nil {
+		return err
+	}
+	usages := map[string]x509.KeyUsage{
+		"digitalSignature": x509.KeyUsageDigitalSignature,
+		"nonRepudiation":   x509.KeyUsageContentCommitment,
+		"keyEncipherment":  x509.KeyUsageKeyEncipherment,
+		"dataEncipherment": x509.KeyUsageDataEncipherment,
+		"keyAgreement":     x509.KeyUsageKeyAgreement,
+	}
+	extKeyUsages := map[string]x509.ExtKeyUsage{
+		"serverAuth":  x509.ExtKeyUsageServerAuth,
+		"clientAuth":  x509.ExtKeyUsageClientAuth,
+		"codeSigning": x509.ExtKeyUsageCodeSigning,
+	}
+
+	for _, line := range strings.Split(ext, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		key, value, _ := strings.Cut(line, "=")
+
+		switch strings.TrimSpace(key) {
+		case "subjectAltName":
+			for _, v := range strings.Split(value, ",") {
+				v = strings.TrimSpace(v)
+
+				if s := strings.TrimPrefix(v, "IP:"); s != v {
+					ip := net.ParseIP(s)
+					if ip == nil {
+						return fmt.Errorf("%s: wrong IP address: %q", config, s)
+					}
+					tmpl.IPAddresses = append(tmpl.IPAddresses, ip)
+				} else if s := strings.TrimPrefix(v, "DNS:"); s != v {
+					tmpl.DNSNames = append(tmpl.DNSNames, s)
+				} else {
+					return fmt.Errorf("%s: subject alternative name not supported by the native backend: %q", config, v)
+				}
+			}
+		case "extendedKeyUsage":
+			for _, v := range strings.Split(value, ",") {
+				v = strings.TrimSpace(v)
+				if usage, ok := extKeyUsages[v]; ok {
+					tmpl.ExtKeyUsage = append(tmpl.ExtKeyUsage, usage)
+				} else if oid, err := parseOID(v); err == nil {
+					tmpl.UnknownExtKeyUsage = append(tmpl.UnknownExtKeyUsage, oid)
+				} else {
+					return fmt.Errorf("%s: extended key usage not supported by the native backend: %q", config, v)
+				}
+			}
+		case OID_ACME_IDENTIFIER:
+			ext, err := nativeDERExtension(OID_ACME_IDENTIFIER, value)
+			if err != nil {
+				return fmt.Errorf("%s: %s", config, err)
+			}
+			tmpl.ExtraExtensions = append(tmpl.ExtraExtensions, ext)
+		case "keyUsage":
+			for _, v := range strings.Split(value, ",") {
+				v = strings.TrimSpace(v)
+				if v == "critical" {
+					continue
+				}
+				usage, ok := usages[v]
+				if !ok {
+					return fmt.Errorf("%s: key usage not supported by the native backend: %q", config, v)
+				}
+				tmpl.KeyUsage |= usage
+			}
+		default:
+			return fmt.Errorf("%s: extension not supported by the native backend: %q", config, line)
+		}
+	}
+	return nil
+}
+
+// nativeDERExtension returns the extension `oid` with the value of the
+// configuration of OpenSSL in the form "[critical, ]DER:hex".
+func nativeDERExtension(oid, value string) (pkix.Extension, error) {
+	ext := pkix.Extension{}
+	id, err := parseOID(oid)
+	if err != nil {
+		return ext, err
+	}
+	ext.Id = id
+
+	value = strings.TrimSpace(value)
+	if s := strings.TrimPrefix(value, "critical,"); s != value {
+		ext.Critical = true
+		value = strings.TrimSpace(s)
+	}
+	s := strings.TrimPrefix(value, "DER:")
+	if s == value {
+		return ext, fmt.Errorf("extension %s not in DER format: %q", oid, value)
+	}
+	if ext.Value, err = hex.DecodeString(strings.ReplaceAll(s, ":", "")); err != nil {
+		return ext, fmt.Errorf("extension %s: %s", oid, err)
+	}
+	return ext, nil
+}
+
+// parseOID parses an object identifier in dotted notation.
+func parseOID(s string) (asn1.ObjectIdentifier, error) {
+	if !validOID.MatchString(s) {
+		return nil, fmt.Errorf("invalid OID: %q", s)
+	}
+	var oid asn1.ObjectIdentifier
+	for _, v := range strings.Split(s, ".") {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid OID: %q", s)
+		}
+		oid = append(oid, n)
+	}
+	return oid, nil
+}
+
+// nativeHookMeta adds to the metadata of the hooks the subject of the
+// request, and the serial number and the expiration of the certificate.
+func nativeHookMeta(meta map[string]string) {
+	if data, err := os.ReadFile(File.Request); err == nil {
+		if req, err := parseRequestPEM(data); err == nil {
+			meta["SUBJECT"], _ = easycert.NameString(req.RawSubject)
+		}
+	}
+	if out, err := nativeInfo(File.Cert, _INFO_SERIAL, _INFO_END_DATE); err == nil {
+		for _, line := range strings.Split(out, "\n") {
+			if v := strings.TrimPrefix(line, "serial="); v != line {
+				meta["SERIAL"] = v
+			} else if v := strings.TrimPrefix(line, "notAfter="); v != line {
+				meta["END_DATE"] = v
+			}
+		}
+	}
+}
+
+// nativeCheckRequest checks the signature of the certificate request.
+func nativeCheckRequest(file string) error {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return err
+	}
+	if _, err = parseRequestPEM(data); err != nil {
+		return fmt.Errorf("%s: %s", file, err)
+	}
+	return nil
+}
+
+// Fields of a certificate printed by nativeInfo.
+const (
+	_INFO_SUBJECT = iota
+	_INFO_ISSUER
+	_INFO_END_DATE
+	_INFO_HASH
+	_INFO_SERIAL
+)
+
+// nativeInfo returns the fields of the certificate in the format of
+// "openssl x509".
+func nativeInfo(file string, fields ...int) (string, error) {
+	cert, err := parseCertFile(file)
+	if err != nil {
+		return "", err
+	}
+	var b strings.Builder
+
+	for _, field := range fields {
+		switch field {
+		case _INFO_SUBJECT, _INFO_ISSUER:
+			name, prefix := cert.RawSubject, "subject="
+			if field == _INFO_ISSUER {
+				name, prefix = cert.RawIssuer, "issuer="
+			}
+			s, err := easycert.NameString(name)
+			if err != nil {
+				return "", err
+			}
+			b.WriteString(prefix + s + "\n")
+		case _INFO_END_DATE:
+			b.WriteString("notAfter=" + cert.NotAfter.UTC().Format(NATIVE_TIME) + "\n")
+		case _INFO_HASH:
+			hash, err := easycert.NameHash(cert.RawSubject)
+			if err != nil {
+				return "", err
+			}
+			fmt.Fprintf(&b, "%08x\n", hash)
+		case _INFO_SERIAL:
+			b.WriteString("serial=" + easycert.SerialHex(cert.SerialNumber) + "\n")
+		}
+	}
+	return b.String(), nil
+}
+
+// nativeInfoRequest returns the subject and the requested hostnames of the
+// certificate request.
+func nativeInfoRequest(file string) (string, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return "", err
+	}
+	req, err := parseRequestPEM(data)
+	if err != nil {
+		return "", fmt.Errorf("%s: %s", file, err)
+	}
+	subject, err := easycert.NameString(req.RawSubject)
+	if err != nil {
+		return "", err
+	}
+
+	var b strings.Builder
+	b.WriteString("        Subject: " + subject + "\n")
+
+	var names []string
+	for _, v := range req.DNSNames {
+		names = append(names, "DNS:"+v)
+	}
+	for _, v := range req.IPAddresses {
+		names = append(names, "IP Address:"+v.String())
+	}
+	if len(names) != 0 {
+		b.WriteString("        Requested Extensions:\n")
+		b.WriteString("            X509v3 Subject Alternative Name:\n")
+		b.WriteString("                " + strings.Join(names, ", ") + "\n")
+	}
+	return b.String(), nil
+}
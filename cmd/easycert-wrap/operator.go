@@ -0,0 +1,154 @@
+// Copyright 2014 Jonas mg
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"os/user"
+	"time"
+)
+
+// Roles of the operators.
+const (
+	ROLE_ADMIN   = "admin"   // Handles the CA and can do everything.
+	ROLE_ISSUER  = "issuer"  // Creates, signs and reviews requests.
+	ROLE_AUDITOR = "auditor" // Only reads.
+)
+
+// Actions recorded in the audit log, and the roles allowed to do them.
+const (
+	ACTION_CA       = "ca"
+	ACTION_REQUEST  = "request"
+	ACTION_SIGN     = "sign"
+	ACTION_QUEUE    = "queue"
+	ACTION_DENY     = "deny"
+	ACTION_RECOVER  = "recover"
+	ACTION_REVOKE   = "revoke"
+	ACTION_UNREVOKE = "unrevoke"
+	ACTION_CRL      = "crl"
+	ACTION_GC       = "gc"
+)
+
+var actionRoles = map[string][]string{
+	ACTION_CA:       {ROLE_ADMIN},
+	ACTION_REQUEST:  {ROLE_ADMIN, ROLE_ISSUER},
+	ACTION_SIGN:     {ROLE_ADMIN, ROLE_ISSUER},
+	ACTION_QUEUE:    {ROLE_ADMIN, ROLE_ISSUER},
+	ACTION_DENY:     {ROLE_ADMIN, ROLE_ISSUER},
+	ACTION_RECOVER:  {ROLE_ADMIN},
+	ACTION_REVOKE:   {ROLE_ADMIN, ROLE_ISSUER},
+	ACTION_UNREVOKE: {ROLE_ADMIN, ROLE_ISSUER},
+	ACTION_CRL:      {ROLE_ADMIN, ROLE_ISSUER},
+	ACTION_GC:       {ROLE_ADMIN},
+}
+
+// ENV_OPERATOR is the environment variable to set the name of the operator,
+// instead of the user of the system. It is refused whether the operators are
+// configured in the store, since anyone can set it.
+const ENV_OPERATOR = "EASYCERT_OPERATOR"
+
+// currentOperator returns the identity of who runs the program.
+func currentOperator() string {
+	u, err := user.Current()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if name := os.Getenv(ENV_OPERATOR); name != "" && name != u.Username {
+		if len(loadStoreConfig().Operators) != 0 {
+			log.Fatalf("The operators are configured in the store, so the operator is the user of the system; unset %s",
+				ENV_OPERATOR)
+		}
+		return name
+	}
+	return u.Username
+}
+
+// checkRole checks whether the operator has some role allowed to do the
+// action. The roles are only enforced when the operators are configured in the
+// store, but the edition of the program is checked always.
+func checkRole(cfg *StoreConfig, operator, action string) error {
+	if err := checkEdition(action); err != nil {
+		return err
+	}
+	if len(cfg.Operators) == 0 {
+		return nil
+	}
+
+	role, ok := cfg.Operators[operator]
+	if !ok {
+		return fmt.Errorf("operator %q is not registered in the store", operator)
+	}
+	for _, v := range actionRoles[action] {
+		if v == role {
+			return nil
+		}
+	}
+	return fmt.Errorf("operator %q with role %q is not allowed to %s", operator, role, action)
+}
+
+// mustRole exits whether the current operator is not allowed to do the action,
+// or whether the certificates directory is in read-only mode.
+func mustRole(action string) string {
+	mustWritable()
+	operator := currentOperator()
+
+	if err := checkRole(loadStoreConfig(), operator, action); err != nil {
+		log.Fatal(err)
+	}
+	return operator
+}
+
+// auditEvent represents an action recorded in the audit log.
+type auditEvent struct {
+	Time     time.Time `json:"time"`
+	Operator string    `json:"operator"`
+	Action   string    `json:"action"`
+	Name     string    `json:"name"`
+	Detail   string    `json:"detail,omitempty"`
+}
+
+// audit appends an event to the audit log, and sends it to the log of the
+// system whether it is configured.
+func audit(operator, action, name, detail string) {
+	event := auditEvent{
+		Time:     time.Now().UTC(),
+		Operator: operator,
+		Action:   action,
+		Name:     name,
+		Detail:   detail,
+	}
+	if l := openSysLog(); l != nil {
+		msg := fmt.Sprintf("%s %s by %s", action, name, operator)
+		if err := l.send(_PRIORITY_NOTICE, msg, event.fields()); err != nil {
+			log.Print(err)
+		}
+	}
+
+	data, err := json.Marshal(event)
+	if err != nil {
+		log.Print(err)
+		return
+	}
+
+	file, err := os.OpenFile(File.Audit, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		log.Print(err)
+		return
+	}
+	_, err = file.Write(append(data, '\n'))
+	if err == nil {
+		err = file.Sync()
+	}
+	file.Close()
+	if err != nil {
+		log.Print(err)
+	}
+}
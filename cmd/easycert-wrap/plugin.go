@@ -0,0 +1,108 @@
+// Copyright 2014 Jonas mg
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"log"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// PLUGIN_PREFIX is the prefix of the external binaries which can be run like
+// subcommands; i.e. "easycert-foo" is run through "easycert foo".
+const PLUGIN_PREFIX = "easycert-"
+
+// PLUGIN_VERSION is the version of the context passed to the plugins. It is
+// incremented only when a field is removed or changes its meaning.
+const PLUGIN_VERSION = 1
+
+// PluginContext is the context passed in JSON format through the standard
+// input to an external subcommand.
+type PluginContext struct {
+	Version int      `json:"version"`
+	Command string   `json:"command"`
+	Args    []string `json:"args"`
+
+	OpenSSL string `json:"openssl"`
+	Config  string `json:"config"`
+
+	RootDir    string `json:"root_dir"`
+	CertDir    string `json:"cert_dir"`
+	KeyDir     string `json:"key_dir"`
+	RevokDir   string `json:"revok_dir"`
+	NewCertDir string `json:"new_cert_dir"`
+}
+
+// isCommand reports whether name is a subcommand built into the program.
+func isCommand(name string) bool {
+	if name == "help" || name == "gendocs" {
+		return true
+	}
+	for _, cmd := range commands {
+		if cmdName(cmd) == name {
+			return true
+		}
+	}
+	return false
+}
+
+// lookPlugin returns the path of the external binary which implements the
+// subcommand `name`, or an empty string if it is not found in PATH.
+func lookPlugin(name string) string {
+	if name == "" || strings.HasPrefix(name, "-") || isCommand(name) {
+		return ""
+	}
+	path, err := exec.LookPath(PLUGIN_PREFIX + name)
+	if err != nil {
+		return ""
+	}
+	return path
+}
+
+// runPlugin runs the external binary at `path`, passing it the context in the
+// standard input and the location of the store in environment variables.
+// The program exits with the same code than the plugin.
+func runPlugin(path, name string, args []string) {
+	ctx := PluginContext{
+		Version: PLUGIN_VERSION,
+		Command: name,
+		Args:    args,
+
+		OpenSSL: File.Cmd,
+		Config:  File.Config,
+
+		RootDir:    Dir.Root,
+		CertDir:    Dir.Cert,
+		KeyDir:     Dir.Key,
+		RevokDir:   Dir.Revok,
+		NewCertDir: Dir.NewCert,
+	}
+	data, err := json.Marshal(ctx)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	cmd := exec.Command(path, args...)
+	cmd.Stdin = bytes.NewReader(data)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.Env = append(os.Environ(),
+		ENV_ROOT+"="+Dir.Root,
+		"EASYCERT_CONFIG="+File.Config,
+		"EASYCERT_OPENSSL="+File.Cmd,
+	)
+
+	if err = cmd.Run(); err != nil {
+		if exitErr, ok := err.(*exec.ExitError); ok {
+			os.Exit(exitErr.ExitCode())
+		}
+		log.Fatal(err)
+	}
+}
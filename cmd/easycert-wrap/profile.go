@@ -0,0 +1,97 @@
+// Copyright 2014 Jonas mg
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// profileVar matches the variables of the configuration of OpenSSL which are
+// resolved at issuance: "${ENV:NAME}" and "${FILE:path}".
+var profileVar = regexp.MustCompile(`\$\{(ENV|FILE):([^}]+)\}`)
+
+// expandProfile replaces the variables of the configuration by the value of the
+// environment variable or the content of the file, so a configuration can be
+// shared between environments and the secrets are not stored in it.
+func expandProfile(data []byte) ([]byte, error) {
+	var err error
+
+	data = profileVar.ReplaceAllFunc(data, func(match []byte) []byte {
+		if err != nil {
+			return nil
+		}
+		sub := profileVar.FindSubmatch(match)
+		kind, key := string(sub[1]), string(sub[2])
+
+		var value string
+		if kind == "ENV" {
+			var ok bool
+			if value, ok = os.LookupEnv(key); !ok {
+				err = fmt.Errorf("configuration: environment variable %q not set", key)
+				return nil
+			}
+		} else {
+			var b []byte
+			if b, err = os.ReadFile(key); err != nil {
+				err = fmt.Errorf("configuration: %s", err)
+				return nil
+			}
+			value = strings.TrimRight(string(b), "\r\n")
+		}
+
+		// A value could add lines to the configuration.
+		if strings.ContainsAny(value, "\r\n") {
+			err = fmt.Errorf("configuration: value of %s with several lines", match)
+			return nil
+		}
+		return []byte(value)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// resolveConfig returns the configuration file to pass to OpenSSL. Whether it
+// has variables, they are resolved into a temporary file, only readable by the
+// owner, which is removed by `done` or by the rollback of the issuance.
+func resolveConfig(file string) (config string, done func(), err error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return "", nil, err
+	}
+	if !bytes.Contains(data, []byte("${ENV:")) && !bytes.Contains(data, []byte("${FILE:")) {
+		return file, func() {}, nil
+	}
+
+	if data, err = expandProfile(data); err != nil {
+		return "", nil, err
+	}
+	tmp, err := tempFile(file)
+	if err != nil {
+		return "", nil, err
+	}
+	if err = os.WriteFile(tmp, data, 0600); err != nil {
+		os.Remove(tmp)
+		return "", nil, err
+	}
+	return tmp, func() { os.Remove(tmp) }, nil
+}
+
+// mustResolveConfig is like resolveConfig but exits on error, rolling back the
+// issuance in progress.
+func mustResolveConfig(file string) (string, func()) {
+	config, done, err := resolveConfig(file)
+	if err != nil {
+		fatal(err)
+	}
+	return config, done
+}
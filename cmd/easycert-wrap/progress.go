@@ -0,0 +1,196 @@
+// Copyright 2014 Jonas mg
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// Progress of the long operations, shown only in a terminal.
+
+// SPINNER_FRAMES are the frames of the spinner.
+const SPINNER_FRAMES = `|/-\`
+
+// SPINNER_INTERVAL is the time between frames of the spinner.
+const SPINNER_INTERVAL = 100 * time.Millisecond
+
+// PROGRESS_BAR_WIDTH is the number of characters of the progress bar.
+const PROGRESS_BAR_WIDTH = 20
+
+// spinner shows that an operation is running, in the standard error output.
+type spinner struct {
+	msg   string
+	start time.Time
+	stop  chan struct{}
+	done  chan struct{}
+}
+
+// startSpinner starts the spinner with the message. It returns nil whether the
+// standard error output is not a terminal.
+func startSpinner(msg string) *spinner {
+	if !isTerminal(os.Stderr) {
+		return nil
+	}
+	s := &spinner{
+		msg:   msg,
+		start: time.Now(),
+		stop:  make(chan struct{}),
+		done:  make(chan struct{}),
+	}
+
+	go func() {
+		defer close(s.done)
+		tick := time.NewTicker(SPINNER_INTERVAL)
+		defer tick.Stop()
+
+		for i := 0; ; i++ {
+			fmt.Fprintf(os.Stderr, "\r%c %s (%s)", SPINNER_FRAMES[i%len(SPINNER_FRAMES)],
+				s.msg, time.Since(s.start).Round(time.Second))
+			select {
+			case <-s.stop:
+				return
+			case <-tick.C:
+			}
+		}
+	}()
+	return s
+}
+
+// end stops the spinner, replacing it by the status whether it is not empty.
+func (s *spinner) end(status string) {
+	if s == nil {
+		return
+	}
+	close(s.stop)
+	<-s.done
+
+	fmt.Fprint(os.Stderr, "\r\033[K")
+	if status != "" {
+		fmt.Fprintf(os.Stderr, "* %s: %s (%s)\n", s.msg, status,
+			time.Since(s.start).Round(time.Second))
+	}
+}
+
+// opensslProgress executes an OpenSSL command like openssl, showing a spinner
+// with the message while it runs. The spinner is only shown in batch mode,
+// since else OpenSSL could prompt; then the standard error output of OpenSSL is
+// only shown whether it fails, so it does not garble the spinner.
+func opensslProgress(msg string, args ...string) []byte {
+	if !batchMode() || !isTerminal(os.Stderr) {
+		return openssl(args...)
+	}
+	var stdout, stderr bytes.Buffer
+
+	debugCmd(File.Cmd, args)
+	cmd := exec.Command(File.Cmd, args...)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	s := startSpinner(msg)
+	err := cmd.Run()
+	if err != nil {
+		s.end("")
+		os.Stderr.Write(stderr.Bytes())
+		fmt.Fprintln(os.Stderr)
+		fatal(err)
+	}
+	s.end("done")
+	return stdout.Bytes()
+}
+
+// keygenMessage returns the message of the spinner for the generation of the
+// key.
+func keygenMessage() string {
+	return "Generating " + KeySpec.String()
+}
+
+// progressBar returns the bar of the progress of `done` items of `total`.
+func progressBar(done, total int) string {
+	n := PROGRESS_BAR_WIDTH * done / total
+	return "[" + strings.Repeat("#", n) + strings.Repeat("-", PROGRESS_BAR_WIDTH-n) + "]"
+}
+
+// == Summary of a batch
+//
+
+// Status of a certificate of a batch.
+const (
+	_ITEM_SIGNED = "signed"
+	_ITEM_FAILED = "failed"
+)
+
+// batchItem represents the result of a certificate of a batch.
+type batchItem struct {
+	name     string
+	serial   string
+	notAfter time.Time
+	status   string
+}
+
+// curBatch is the batch in progress, whose summary is shown whether it fails.
+var curBatch *batch
+
+// header shows the certificate `i` of the batch being signed, with a progress
+// bar whether the standard output is a terminal.
+func (b *batch) header(i int, name string) {
+	b.current = name
+	if b.size < 2 {
+		return
+	}
+	bar := ""
+	if isTerminal(os.Stdout) {
+		bar = " " + progressBar(i, b.size)
+	}
+	fmt.Printf("\n== [%d/%d] %s%s\n", i+1, b.size, name, bar)
+}
+
+// summary writes the table with the status of every certificate of the batch.
+// The certificate in progress is marked like failed whether `failed` is set,
+// and the rest are skipped.
+func (b *batch) summary(w io.Writer, failed bool) {
+	items := b.items
+	if failed {
+		items = append(items, batchItem{name: b.current, status: _ITEM_FAILED})
+	}
+
+	fmt.Fprintf(w, "\n== Summary: %d of %d signed", len(b.items), b.size)
+	if skipped := b.size - len(items); skipped != 0 {
+		fmt.Fprintf(w, ", %d skipped", skipped)
+	}
+	fmt.Fprint(w, "\n\n")
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "NAME\tSERIAL\tEXPIRES\tSTATUS")
+	for _, v := range items {
+		expires := "-"
+		if !v.notAfter.IsZero() {
+			expires = v.notAfter.Format("2006-01-02")
+		}
+		serial := v.serial
+		if serial == "" {
+			serial = "-"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", v.name, serial, expires, v.status)
+	}
+	tw.Flush()
+}
+
+// abort shows the summary of the batch in progress, whether any, since it
+// failed. It is called by fatal.
+func (b *batch) abort() {
+	if b == nil || b.size < 2 {
+		return
+	}
+	curBatch = nil
+	b.summary(os.Stderr, true)
+}
@@ -0,0 +1,282 @@
+// Copyright 2014 Jonas mg
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+// Parameters of the certificates for the protocols which require specific
+// extensions, so they are not set by hand in the configuration of OpenSSL.
+
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// Protocols with parameters of the certificate.
+const (
+	PROTOCOL_TLS_ALPN = "tls-alpn-01"
+	PROTOCOL_RDP      = "rdp"
+	PROTOCOL_LDAPS    = "ldaps"
+	PROTOCOL_DC       = "dc"
+)
+
+const (
+	// OID_ACME_IDENTIFIER is the extension with the digest of the key
+	// authorization of the challenge TLS-ALPN-01 (RFC 8737).
+	OID_ACME_IDENTIFIER = "1.3.6.1.5.5.7.1.31"
+
+	// OID_RDP_AUTH is the extended key usage of Remote Desktop Authentication,
+	// which makes Windows choose the certificate for RDP.
+	OID_RDP_AUTH = "1.3.6.1.4.1.311.54.1.2"
+
+	// PROTOCOL_KEY_USAGE is the key usage of the TLS servers of the protocols.
+	PROTOCOL_KEY_USAGE = "keyUsage = critical, digitalSignature, keyEncipherment"
+
+	// OID_KDC_AUTH is the extended key usage of the KDC in Kerberos PKINIT
+	// (RFC 4556), and OID_SMARTCARD_LOGON the one of Microsoft for the logon
+	// by smart card, which the domain controllers of Active Directory have.
+	OID_KDC_AUTH        = "1.3.6.1.5.2.3.5"
+	OID_SMARTCARD_LOGON = "1.3.6.1.4.1.311.20.2.2"
+
+	// OID_PKINIT_SAN is the type of the otherName of the subject alternative
+	// names with the Kerberos principal of the KDC, KRB5PrincipalName.
+	OID_PKINIT_SAN = "1.3.6.1.5.2.2"
+
+	// OID_DS_GUID is the type of the otherName with the GUID of the object of
+	// the domain controller in Active Directory.
+	OID_DS_GUID = "1.3.6.1.4.1.311.25.1"
+
+	// OID_CERT_TEMPLATE_NAME is the extension of Microsoft with the name of
+	// the certificate template, in BMPString.
+	OID_CERT_TEMPLATE_NAME = "1.3.6.1.4.1.311.20.2"
+
+	// DC_TEMPLATE is the certificate template of the domain controllers.
+	DC_TEMPLATE = "DomainController"
+)
+
+var (
+	// validRealm matches the Kerberos realm of an Active Directory domain,
+	// which is placed in the configuration of OpenSSL.
+	validRealm = regexp.MustCompile(`^[A-Za-z0-9-]+(\.[A-Za-z0-9-]+)+$`)
+
+	// validGUID matches a GUID, with braces optionally.
+	validGUID = regexp.MustCompile(`^\{?[0-9A-Fa-f]{8}(-[0-9A-Fa-f]{4}){3}-[0-9A-Fa-f]{12}\}?$`)
+)
+
+var (
+	Protocol         = flag.String("protocol", "", "protocol of the certificate: tls-alpn-01, rdp, ldaps or dc")
+	KeyAuthorization = flag.String("key-authorization", "", "key authorization of the challenge TLS-ALPN-01")
+	Realm            = flag.String("realm", "", "Kerberos realm of the domain of Active Directory")
+	DCGUID           = flag.String("dc-guid", "", "GUID of the object of the domain controller in Active Directory")
+)
+
+// checkProtocol checks the flags of the protocol, with the hostnames already
+// expanded.
+func checkProtocol() error {
+	if *KeyAuthorization != "" && *Protocol != PROTOCOL_TLS_ALPN {
+		return errors.New("Flag -key-authorization is only used by \"-protocol tls-alpn-01\"")
+	}
+	if (*Realm != "" || *DCGUID != "") && *Protocol != PROTOCOL_DC {
+		return errors.New("Flags -realm and -dc-guid are only used by \"-protocol dc\"")
+	}
+	switch *Protocol {
+	case "":
+		return nil
+	case PROTOCOL_TLS_ALPN:
+		if *KeyAuthorization == "" {
+			return errors.New("The protocol tls-alpn-01 requires -key-authorization")
+		}
+		// The challenge validates a single domain name (RFC 8737, section 3).
+		if len(Host.dns) != 1 || len(Host.ip) != 0 {
+			return errors.New("The protocol tls-alpn-01 requires a single domain name in -host")
+		}
+	case PROTOCOL_DC:
+		if !validRealm.MatchString(*Realm) {
+			return fmt.Errorf("The protocol dc requires the realm of the domain in -realm, like \"LAB.EXAMPLE.COM\"; got %q", *Realm)
+		}
+		if *DCGUID != "" && !validGUID.MatchString(*DCGUID) {
+			return fmt.Errorf("Invalid GUID: %q", *DCGUID)
+		}
+		// The otherNames of the Kerberos principal and the GUID.
+		if nativeBackend() {
+			return errors.New("The native backend does not support the protocol dc")
+		}
+		*Realm = strings.ToUpper(*Realm)
+	case PROTOCOL_RDP, PROTOCOL_LDAPS:
+	default:
+		return fmt.Errorf("Unknown protocol: %q", *Protocol)
+	}
+
+	if Host.String() == "" {
+		return fmt.Errorf("The protocol %s requires the hostnames of the server in -host", *Protocol)
+	}
+	if isNameless() || isDevID() {
+		return fmt.Errorf("The protocol %s is only used by the certificates of servers", *Protocol)
+	}
+	return nil
+}
+
+// protocolExtensions returns the extensions of the certificate of the protocol
+// set in the flags, after of the subject alternative names `san`.
+func protocolExtensions(san string) string {
+	lines := []string{san}
+
+	switch *Protocol {
+	case PROTOCOL_TLS_ALPN:
+		digest := sha256.Sum256([]byte(*KeyAuthorization))
+		value, _ := asn1.Marshal(digest[:])
+		lines = append(lines, OID_ACME_IDENTIFIER+" = critical, DER:"+
+			strings.ReplaceAll(fmt.Sprintf("% X", value), " ", ":"))
+	case PROTOCOL_RDP:
+		lines = append(lines, PROTOCOL_KEY_USAGE, "extendedKeyUsage = serverAuth, "+OID_RDP_AUTH)
+	case PROTOCOL_LDAPS:
+		lines = append(lines, PROTOCOL_KEY_USAGE, "extendedKeyUsage = serverAuth")
+	case PROTOCOL_DC:
+		lines = dcExtensions(san)
+	}
+	return strings.Join(lines, "\n")
+}
+
+// dcExtensions returns the extensions of the certificate of a domain controller
+// of Active Directory, for LDAPS and Kerberos PKINIT: the DNS name of the
+// domain, the principal "krbtgt/REALM@REALM" and the GUID of the controller
+// are added to the subject alternative names `san`, which are written in a
+// section since the value of the GUID has commas.
+func dcExtensions(san string) []string {
+	names := strings.Split(strings.TrimPrefix(san, "subjectAltName = "), ", ")
+	if domain := "DNS:" + strings.ToLower(*Realm); !slices.Contains(names, domain) {
+		names = append(names, domain) // It is in the certificate renewed.
+	}
+	names = append(names, "otherName:"+OID_PKINIT_SAN+";SEQUENCE:kdc_principal")
+	if *DCGUID != "" {
+		names = append(names, "otherName:"+OID_DS_GUID+";FORMAT:HEX,OCTETSTRING:"+hex.EncodeToString(dcGUIDBytes(*DCGUID)))
+	}
+
+	lines := []string{"subjectAltName = @dc_alt_names",
+		PROTOCOL_KEY_USAGE,
+		"extendedKeyUsage = serverAuth, clientAuth, " + OID_KDC_AUTH + ", " + OID_SMARTCARD_LOGON,
+		OID_CERT_TEMPLATE_NAME + " = ASN1:BMPSTRING:" + DC_TEMPLATE,
+		"",
+		"[ dc_alt_names ]",
+	}
+	for i, v := range names {
+		kind, value, _ := strings.Cut(v, ":")
+		lines = append(lines, fmt.Sprintf("%s.%d = %s", kind, i+1, value))
+	}
+	return append(lines,
+		"",
+		"[ kdc_principal ]",
+		"realm = EXP:0, GENERALSTRING:"+*Realm,
+		"principal_name = EXP:1, SEQUENCE:kdc_principal_name",
+		"",
+		"[ kdc_principal_name ]",
+		"name_type = EXP:0, INTEGER:2",
+		"name_string = EXP:1, SEQUENCE:kdc_principal_components",
+		"",
+		"[ kdc_principal_components ]",
+		"component1 = GENERALSTRING:krbtgt",
+		"component2 = GENERALSTRING:"+*Realm,
+	)
+}
+
+// dcGUIDBytes returns the bytes of the GUID like they are stored in Active
+// Directory, where the first three fields are in little-endian.
+func dcGUIDBytes(guid string) []byte {
+	b, _ := hex.DecodeString(strings.NewReplacer("{", "", "}", "", "-", "").Replace(guid))
+	for _, f := range [][2]int{{0, 4}, {4, 6}, {6, 8}} {
+		for i, j := f[0], f[1]-1; i < j; i, j = i+1, j-1 {
+			b[i], b[j] = b[j], b[i]
+		}
+	}
+	return b
+}
+
+// certDCIdentity returns the realm and the GUID of the certificate of a domain
+// controller, from the otherNames of its subject alternative names.
+func certDCIdentity(cert *x509.Certificate) (realm, guid string, err error) {
+	for _, ext := range cert.Extensions {
+		if !ext.Id.Equal(asn1.ObjectIdentifier{2, 5, 29, 17}) {
+			continue
+		}
+		var names []asn1.RawValue
+		if _, err = asn1.Unmarshal(ext.Value, &names); err != nil {
+			return "", "", err
+		}
+
+		for _, v := range names {
+			if v.Class != asn1.ClassContextSpecific || v.Tag != 0 {
+				continue
+			}
+			var other struct {
+				ID    asn1.ObjectIdentifier
+				Value asn1.RawValue // [0] EXPLICIT
+			}
+			if _, err = asn1.UnmarshalWithParams(v.FullBytes, &other, "tag:0"); err != nil {
+				return "", "", err
+			}
+
+			switch other.ID.String() {
+			case OID_PKINIT_SAN:
+				var principal struct {
+					Realm asn1.RawValue // [0] EXPLICIT GeneralString
+					Name  asn1.RawValue
+				}
+				var value asn1.RawValue
+				if _, err = asn1.Unmarshal(other.Value.Bytes, &principal); err == nil {
+					_, err = asn1.Unmarshal(principal.Realm.Bytes, &value)
+				}
+				if err != nil {
+					return "", "", err
+				}
+				realm = string(value.Bytes)
+			case OID_DS_GUID:
+				var b []byte
+				if _, err = asn1.Unmarshal(other.Value.Bytes, &b); err != nil || len(b) != 16 {
+					return "", "", errors.New("wrong GUID of the domain controller")
+				}
+				// The conversion of the fields is symmetric.
+				s := hex.EncodeToString(dcGUIDBytes(hex.EncodeToString(b)))
+				guid = s[:8] + "-" + s[8:12] + "-" + s[12:16] + "-" + s[16:20] + "-" + s[20:]
+			}
+		}
+	}
+	if realm == "" {
+		return "", "", errors.New("the certificate has not the Kerberos principal of the KDC")
+	}
+	return realm, guid, nil
+}
+
+// certProtocol returns the protocol of the certificate, from its extensions;
+// it is empty for the rest of servers.
+func certProtocol(cert *x509.Certificate) string {
+	for _, v := range cert.UnknownExtKeyUsage {
+		if v.String() == OID_KDC_AUTH {
+			return PROTOCOL_DC
+		}
+	}
+	for _, v := range cert.Extensions {
+		if v.Id.String() == OID_ACME_IDENTIFIER {
+			return PROTOCOL_TLS_ALPN
+		}
+	}
+	for _, v := range cert.UnknownExtKeyUsage {
+		if v.String() == OID_RDP_AUTH {
+			return PROTOCOL_RDP
+		}
+	}
+	if len(cert.ExtKeyUsage) == 1 && cert.ExtKeyUsage[0] == x509.ExtKeyUsageServerAuth &&
+		cert.KeyUsage == x509.KeyUsageDigitalSignature|x509.KeyUsageKeyEncipherment {
+		return PROTOCOL_LDAPS
+	}
+	return ""
+}
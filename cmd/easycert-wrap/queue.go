@@ -0,0 +1,418 @@
+// Copyright 2014 Jonas mg
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Status of a request in the queue.
+const (
+	STATUS_PENDING  = "pending"
+	STATUS_APPROVED = "approved"
+	STATUS_DENIED   = "denied"
+)
+
+var (
+	errQueueName = errors.New("name must have only letters, digits, '.', '_' or '-'")
+	errQueueCSR  = errors.New("no valid certificate request in PEM format")
+	errQueueID   = errors.New("request not found in queue")
+	errQueueDone = errors.New("request is not pending")
+)
+
+// ENV_CA_PASS is the environment variable with the passphrase of the CA's
+// private key, used to sign without prompting.
+const ENV_CA_PASS = "EASYCERT_CA_PASS"
+
+// caPassArgs returns the OpenSSL's option `opt` ("-passin" or "-pass") to get
+// the passphrase of the CA's private key from the source of "-passin", or else
+// from the environment, if it is set. In batch mode, it exits whether it is
+// not set, instead of prompting.
+func caPassArgs(opt string) []string {
+	if *PassIn != "" {
+		if err := checkPassIn(*PassIn); err != nil {
+			fatal(err)
+		}
+		return []string{opt, *PassIn}
+	}
+	if os.Getenv(ENV_CA_PASS) == "" {
+		if batchMode() {
+			fatalf("Batch mode: the passphrase of the CA's private key has to be set in %s", ENV_CA_PASS)
+		}
+		return nil
+	}
+	return []string{opt, "env:" + ENV_CA_PASS}
+}
+
+var validName = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]*$`)
+
+// queueMu serializes the changes in the queue and the signing, since the
+// paths to the files of a certificate are global.
+var queueMu sync.Mutex
+
+// queueReq represents a certificate request waiting for approval.
+type queueReq struct {
+	ID        string    `json:"id"`
+	Name      string    `json:"name"`
+	Subject   string    `json:"subject"`
+	Source    string    `json:"source"`
+	Status    string    `json:"status"`
+	Submitted time.Time `json:"submitted"`
+	Updated   time.Time `json:"updated"`
+
+	// An attestation statement of the key was submitted with the request.
+	Attestation bool `json:"attestation,omitempty"`
+
+	// Span of the request in the portal, parent of the steps of the issuance.
+	span *span
+}
+
+func (r *queueReq) fileCSR() string  { return filepath.Join(Dir.Queue, r.ID+EXT_REQUEST) }
+func (r *queueReq) fileMeta() string { return filepath.Join(Dir.Queue, r.ID+".json") }
+
+func (r *queueReq) save() error {
+	data, err := json.MarshalIndent(r, "", "\t")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(r.fileMeta(), append(data, '\n'), 0600)
+}
+
+// parseQueueCSR checks the name and the request, in PEM format, submitted to
+// the queue.
+func parseQueueCSR(name string, csr []byte) (*pem.Block, *x509.CertificateRequest, error) {
+	if !validName.MatchString(name) || name == NAME_CA {
+		return nil, nil, errQueueName
+	}
+
+	block, _ := pem.Decode(csr)
+	if block == nil || block.Type != "CERTIFICATE REQUEST" {
+		return nil, nil, errQueueCSR
+	}
+	req, err := x509.ParseCertificateRequest(block.Bytes)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err = req.CheckSignature(); err != nil {
+		return nil, nil, err
+	}
+	return block, req, nil
+}
+
+// addQueue adds a certificate request to the queue with status pending, with
+// the attestation statement of its key whether it is not nil. `source` is the
+// way in which the request was received.
+func addQueue(name string, csr, attestation []byte, source, operator string) (*queueReq, error) {
+	block, req, err := parseQueueCSR(name, csr)
+	if err != nil {
+		return nil, err
+	}
+	if attestation != nil {
+		if _, err = checkAttestation(attestation, req); err != nil {
+			return nil, err
+		}
+	}
+
+	id := make([]byte, 4)
+	if _, err = rand.Read(id); err != nil {
+		return nil, err
+	}
+
+	r := &queueReq{
+		ID:          time.Now().Format("20060102150405") + "-" + hex.EncodeToString(id),
+		Name:        name,
+		Subject:     req.Subject.String(),
+		Source:      source,
+		Status:      STATUS_PENDING,
+		Submitted:   time.Now().UTC(),
+		Attestation: attestation != nil,
+	}
+
+	queueMu.Lock()
+	defer queueMu.Unlock()
+
+	if err = os.MkdirAll(Dir.Queue, 0700); err != nil {
+		return nil, err
+	}
+	// The metadata is written the last one, since the requests are listed by
+	// it; the other files are removed whether it fails.
+	err = writeFileAtomic(r.fileCSR(), pem.EncodeToMemory(block), 0600)
+	if err == nil && attestation != nil {
+		err = writeFileAtomic(r.fileAttestation(), attestation, 0600)
+	}
+	if err == nil {
+		err = r.save()
+	}
+	if err != nil {
+		os.Remove(r.fileCSR())
+		os.Remove(r.fileAttestation())
+		return nil, err
+	}
+
+	audit(operator, ACTION_QUEUE, name, "request "+r.ID)
+	return r, nil
+}
+
+// getQueue returns the request with the given identifier.
+func getQueue(id string) (*queueReq, error) {
+	if !validName.MatchString(id) {
+		return nil, errQueueID
+	}
+
+	data, err := os.ReadFile(filepath.Join(Dir.Queue, id+".json"))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, errQueueID
+		}
+		return nil, err
+	}
+
+	r := new(queueReq)
+	if err = json.Unmarshal(data, r); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// listQueue returns the requests in the queue, sorted by date of submission.
+func listQueue() ([]*queueReq, error) {
+	match, err := filepath.Glob(filepath.Join(Dir.Queue, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+
+	list := make([]*queueReq, 0, len(match))
+	for _, v := range match {
+		id := filepath.Base(v)
+		r, err := getQueue(id[:len(id)-len(".json")])
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, r)
+	}
+
+	sort.Slice(list, func(i, j int) bool { return list[i].ID < list[j].ID })
+	return list, nil
+}
+
+// approve signs the request using the CA, and marks it like approved.
+func (r *queueReq) approve(operator string) error {
+	queueMu.Lock()
+	defer queueMu.Unlock()
+
+	if r.Status != STATUS_PENDING {
+		return errQueueDone
+	}
+	if err := checkRole(loadStoreConfig(), operator, ACTION_SIGN); err != nil {
+		return err
+	}
+
+	setCertPath(r.Name)
+	File.Request = r.fileCSR()
+
+	tx := beginIssuance()
+	if err := r.issue(); err != nil {
+		tx.rollback()
+		return err
+	}
+	commitIssuance()
+	if err := os.Remove(File.SrvConfig); err != nil && !os.IsNotExist(err) {
+		log.Print(err)
+	}
+
+	meta := hookMeta()
+	audit(operator, ACTION_SIGN, r.Name, "serial "+meta["SERIAL"]+", request "+r.ID)
+
+	if _, err := writeReceipt(r.Name, operator); err != nil {
+		return err
+	}
+
+	return traceStep(r.span, "issuance.hook", func() error {
+		return runHook(HOOK_POST_SIGN, meta)
+	})
+}
+
+// issue signs the request into the issuance in progress, which is rolled back
+// by the caller on error.
+func (r *queueReq) issue() error {
+	if _, err := os.Stat(File.Cert); !os.IsNotExist(err) {
+		return fmt.Errorf("certificate already exists: %q", File.Cert)
+	}
+	err := traceStep(r.span, "issuance.check", func() error {
+		if err := fipsCheckRequest(File.Request); err != nil {
+			return err
+		}
+		if err := r.verifyAttestation(); err != nil {
+			return err
+		}
+		return runHook(HOOK_PRE_SIGN, hookMeta())
+	})
+	if err != nil {
+		return err
+	}
+
+	configFile, err := writeSANsConfig(File.Request)
+	if err != nil {
+		return err
+	}
+	if err = curIssuance.saveDatabase(); err != nil {
+		return err
+	}
+	certFile, err := tempFile(File.Cert)
+	if err != nil {
+		return err
+	}
+
+	if nativeBackend() || loadKMS() != "" {
+		err = traceStep(r.span, "issuance.sign", func() error {
+			if configFile == File.Config {
+				return nativeIssue(nil, "", certFile)
+			}
+			return nativeIssue(nil, configFile, certFile)
+		})
+	} else {
+		config, done, err1 := resolveConfig(configFile)
+		if err1 != nil {
+			return err1
+		}
+		defer done()
+
+		args := []string{"ca", "-batch", "-policy", "policy_anything",
+			"-config", config, "-in", File.Request, "-out", certFile,
+		}
+		args = append(args, validityArgs()...)
+		args = append(args, fipsDigestArgs("ca")...)
+		args = append(args, caKeyArgs("-keyfile", "")...)
+		err = traceStep(r.span, "issuance.sign", func() error {
+			_, err := opensslNoFatal(args...)
+			return err
+		})
+	}
+	if err != nil {
+		return err
+	}
+
+	return traceStep(r.span, "issuance.store", func() error {
+		if err := commitFile(certFile, File.Cert, 0644); err != nil {
+			return err
+		}
+		if err := syncDatabase(); err != nil {
+			return err
+		}
+		return r.setStatus(STATUS_APPROVED)
+	})
+}
+
+// writeSANsConfig writes the configuration of the request with the subject
+// alternative names of the request in `file`, into the issuance in progress,
+// since they are not copied from the request to the certificate. It returns
+// the configuration to sign with: that one, or File.Config whether the request
+// has no DNS names nor IP addresses.
+func writeSANsConfig(file string) (string, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return "", err
+	}
+	req, err := parseRequestPEM(data)
+	if err != nil {
+		return "", fmt.Errorf("%s: %s", file, err)
+	}
+
+	var sans []string
+	for _, v := range req.IPAddresses {
+		sans = append(sans, "IP:"+v.String())
+	}
+	for _, v := range req.DNSNames {
+		if !validDNS.MatchString(v) && !strings.EqualFold(v, "localhost") {
+			return "", fmt.Errorf("%s: %s: %q", file, errHost, v)
+		}
+		sans = append(sans, "DNS:"+v)
+	}
+	if len(sans) == 0 {
+		return File.Config, nil
+	}
+
+	err = writeRequestConfig(requestTemplate{
+		HostName:       certName(),
+		SubjectAltName: "subjectAltName = " + strings.Join(sans, ", "),
+	})
+	return File.SrvConfig, err
+}
+
+// deny marks the request like denied.
+func (r *queueReq) deny(operator string) error {
+	queueMu.Lock()
+	defer queueMu.Unlock()
+
+	if r.Status != STATUS_PENDING {
+		return errQueueDone
+	}
+	if err := checkRole(loadStoreConfig(), operator, ACTION_DENY); err != nil {
+		return err
+	}
+	if err := r.setStatus(STATUS_DENIED); err != nil {
+		return err
+	}
+
+	audit(operator, ACTION_DENY, r.Name, "request "+r.ID)
+	return nil
+}
+
+// setStatus changes the status of the request, saving it.
+func (r *queueReq) setStatus(status string) error {
+	r.Status = status
+	r.Updated = time.Now().UTC()
+	return r.save()
+}
+
+// dropQueue adds to the queue the certificate requests placed in the drop
+// directory, using the file name like name of the certificate. The files added
+// are removed from the directory. Nothing is done in read-only mode.
+func dropQueue(operator string) error {
+	if readOnly() {
+		return nil
+	}
+	match, err := filepath.Glob(filepath.Join(Dir.Queue, "drop", "*"+EXT_REQUEST))
+	if err != nil {
+		return err
+	}
+
+	for _, v := range match {
+		data, err := os.ReadFile(v)
+		if err != nil {
+			return err
+		}
+		name := filepath.Base(v)
+
+		if _, err = addQueue(name[:len(name)-len(EXT_REQUEST)], data, nil, "drop", operator); err != nil {
+			return fmt.Errorf("%s: %s", v, err)
+		}
+		if err = os.Remove(v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// certFile returns the certificate issued for an approved request.
+func (r *queueReq) certFile() string {
+	return filepath.Join(Dir.Cert, r.Name+EXT_CERT)
+}
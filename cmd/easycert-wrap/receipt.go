@@ -0,0 +1,137 @@
+// Copyright 2014 Jonas mg
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/tredoe/easycert"
+)
+
+// Programs to sign the receipts.
+const (
+	SIGNER_GPG      = "gpg"
+	SIGNER_MINISIGN = "minisign"
+)
+
+// ReceiptConfig represents the configuration of the issuance receipts.
+type ReceiptConfig struct {
+	Signer string `json:"signer,omitempty"` // gpg, minisign or empty to not sign
+	Key    string `json:"key,omitempty"`    // GPG key id or minisign secret key file
+}
+
+// Receipt represents the proof of the issuance of a certificate.
+type Receipt struct {
+	Name      string    `json:"name"`
+	Serial    string    `json:"serial"`
+	Subject   string    `json:"subject"`
+	Issuer    string    `json:"issuer"`
+	NotBefore time.Time `json:"not_before"`
+	NotAfter  time.Time `json:"not_after"`
+
+	FingerprintSHA256 string `json:"fingerprint_sha256"`
+	FingerprintSHA1   string `json:"fingerprint_sha1"`
+
+	Operator string    `json:"operator"`
+	IssuedAt time.Time `json:"issued_at"`
+}
+
+// fingerprint returns the digest in hexadecimal, separated by colons.
+func fingerprint(sum []byte) string {
+	s := make([]string, len(sum))
+	for i, v := range sum {
+		s[i] = fmt.Sprintf("%02X", v)
+	}
+	return strings.Join(s, ":")
+}
+
+// writeReceipt writes the receipt of the certificate `name` in the receipts
+// directory, signing it whether it is configured, and returns the path of the
+// receipt. Nothing is done whether the receipts are not configured.
+func writeReceipt(name, operator string) (string, error) {
+	cfg := loadStoreConfig().Receipt
+	if cfg == nil {
+		return "", nil
+	}
+
+	cert, err := parseCertFile(filepath.Join(Dir.Cert, name+EXT_CERT))
+	if err != nil {
+		return "", err
+	}
+
+	data, err := json.MarshalIndent(Receipt{
+		Name:      name,
+		Serial:    easycert.SerialHex(cert.SerialNumber),
+		Subject:   cert.Subject.String(),
+		Issuer:    cert.Issuer.String(),
+		NotBefore: cert.NotBefore.UTC(),
+		NotAfter:  cert.NotAfter.UTC(),
+
+		FingerprintSHA256: fingerprint(sha256Sum(cert.Raw)),
+		FingerprintSHA1:   fingerprint(sha1Sum(cert.Raw)),
+
+		Operator: operator,
+		IssuedAt: time.Now().UTC(),
+	}, "", "\t")
+	if err != nil {
+		return "", err
+	}
+
+	if err = os.MkdirAll(Dir.Receipt, 0755); err != nil {
+		return "", err
+	}
+	file := filepath.Join(Dir.Receipt, name+"-"+easycert.SerialHex(cert.SerialNumber)+".json")
+	if err = writeFileAtomic(file, append(data, '\n'), 0644); err != nil {
+		return "", err
+	}
+
+	var cmd *exec.Cmd
+
+	switch cfg.Signer {
+	case "":
+		return file, nil
+	case SIGNER_GPG:
+		args := []string{"--batch", "--yes", "--armor", "--detach-sign", "-o", file + ".asc"}
+		if cfg.Key != "" {
+			args = append(args, "--local-user", cfg.Key)
+		}
+		cmd = exec.Command(SIGNER_GPG, append(args, file)...)
+	case SIGNER_MINISIGN:
+		cmd = exec.Command(SIGNER_MINISIGN, "-S", "-s", cfg.Key, "-m", file)
+	default:
+		return file, fmt.Errorf("unknown signer of receipts: %q", cfg.Signer)
+	}
+
+	var stderr bytes.Buffer
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = &stderr
+
+	if err = cmd.Run(); err != nil {
+		return file, fmt.Errorf("signing receipt with %s: %s\n%s", cfg.Signer, err, stderr.Bytes())
+	}
+	return file, nil
+}
+
+func sha256Sum(b []byte) []byte {
+	sum := sha256.Sum256(b)
+	return sum[:]
+}
+
+func sha1Sum(b []byte) []byte {
+	sum := sha1.Sum(b)
+	return sum[:]
+}
@@ -0,0 +1,110 @@
+// Copyright 2014 Jonas mg
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+// Remote certificates directory, through SSH.
+
+package main
+
+import (
+	"log"
+	"net/url"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+const (
+	// ENV_REMOTE_WRITE is the environment variable to allow the commands which
+	// modify a remote certificates directory, i.e. to sign.
+	ENV_REMOTE_WRITE = "EASYCERT_REMOTE_WRITE"
+
+	// ENV_REMOTE_CMD is the environment variable with the path of the program
+	// in the server, when it is not in its PATH.
+	ENV_REMOTE_CMD = "EASYCERT_REMOTE_CMD"
+)
+
+// remoteURL returns the URL whether the certificates directory is remote, like
+// "ssh://user@host:port/path".
+func remoteURL(root string) *url.URL {
+	if !strings.HasPrefix(root, "ssh://") {
+		return nil
+	}
+
+	u, err := url.Parse(root)
+	if err != nil || u.Hostname() == "" {
+		log.Fatalf("Wrong URL of remote directory: %q", root)
+	}
+	return u
+}
+
+// runRemote runs the program with the arguments in the server, through the
+// command "ssh", where the certificates directory is. The directory is used in
+// read-only mode unless it is allowed in the environment.
+func runRemote(u *url.URL, args []string) {
+	var sshArgs []string
+
+	if isTerminal(os.Stdin) {
+		sshArgs = append(sshArgs, "-t") // for the prompts of OpenSSL
+	}
+	if u.Port() != "" {
+		sshArgs = append(sshArgs, "-p", u.Port())
+	}
+
+	host := u.Hostname()
+	if u.User != nil {
+		host = u.User.Username() + "@" + host
+	}
+
+	program := os.Getenv(ENV_REMOTE_CMD)
+	if program == "" {
+		program = PROGRAM
+	}
+
+	// The environment is set in the command line since SSH servers only
+	// accept some variables.
+	var line []string
+	if u.Path != "" && u.Path != "/" {
+		line = append(line, ENV_ROOT+"="+shellQuote(u.Path))
+	}
+	if os.Getenv(ENV_REMOTE_WRITE) == "" {
+		line = append(line, ENV_READONLY+"=1")
+	}
+	if os.Getenv(ENV_CA_PASS) != "" {
+		log.Print("The passphrase of the CA is not sent to the server")
+	}
+	line = append(line, shellQuote(program))
+	for _, v := range args {
+		line = append(line, shellQuote(v))
+	}
+
+	cmd := exec.Command("ssh", append(sshArgs, host, "--", strings.Join(line, " "))...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+
+	if err := cmd.Run(); err != nil {
+		if exitErr, ok := err.(*exec.ExitError); ok {
+			os.Exit(exitErr.ExitCode())
+		}
+		log.Fatal(err)
+	}
+}
+
+// isTerminal reports whether the file is a terminal.
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	if err != nil || info.Mode()&os.ModeCharDevice == 0 {
+		return false
+	}
+	// The null device is also a character device.
+	null, err := os.Stat(os.DevNull)
+	return err != nil || !os.SameFile(info, null)
+}
+
+// shellQuote quotes the string to be used like a word in a POSIX shell.
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
@@ -0,0 +1,230 @@
+// Copyright 2014 Jonas mg
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+// Remote certificates directory, through the REST API of the portal.
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/tredoe/easycert/client"
+	"github.com/tredoe/flagplus"
+)
+
+const (
+	// ENV_REMOTE is the environment variable with the URL of the portal
+	// through which the commands "req", "sign", "ls", "info" and "revoke" are
+	// run, i.e. "https://ca.internal:9443".
+	ENV_REMOTE = "EASYCERT_REMOTE"
+
+	// ENV_REMOTE_TOKEN is the environment variable with the token of the
+	// administrators of the portal, to sign and revoke.
+	ENV_REMOTE_TOKEN = "EASYCERT_REMOTE_TOKEN"
+
+	// ENV_REMOTE_CERT is the environment variable with the name of the
+	// certificate, in the local certificates directory, which authenticates
+	// the operator in the portal.
+	ENV_REMOTE_CERT = "EASYCERT_REMOTE_CERT"
+)
+
+// useRemoteAPI routes the commands which have an equivalent in the API of the
+// portal. The private keys are generated in the local certificates directory,
+// and the certificates issued are downloaded into it.
+func useRemoteAPI() {
+	cmdReq.Run = runRemoteReq
+	cmdSign.Run = runRemoteSign
+	cmdLs.Run = runRemoteLs
+	cmdInfo.Run = runRemoteInfo
+	cmdRevoke.Run = runRemoteRevoke
+}
+
+// remoteClient returns the client of the portal set in the environment.
+func remoteClient() *client.Client {
+	c := client.New(os.Getenv(ENV_REMOTE), os.Getenv(ENV_REMOTE_TOKEN))
+	c.HTTPClient = remoteHTTPClient()
+	return c
+}
+
+// runRemoteReq generates the private key and the request locally, and submits
+// the request to the queue of the portal; with "-sign", it is approved too.
+func runRemoteReq(cmd *flagplus.Subcommand, args []string) {
+	isSign := *IsSign
+	*IsSign = false
+	runReq(cmd, args)
+
+	if isSign {
+		remoteSign(remoteClient(), args[0])
+		return
+	}
+	req := remoteSubmit(remoteClient(), args[0])
+	fmt.Printf("\n* Submitted request %s (%s): %s\n", req.ID, req.Name, req.Status)
+}
+
+func runRemoteSign(cmd *flagplus.Subcommand, args []string) {
+	if len(args) == 0 {
+		log.Print("Missing required argument: NAME")
+		cmd.Usage()
+	}
+	c := remoteClient()
+
+	for _, name := range args {
+		remoteSign(c, name)
+	}
+}
+
+// remoteSubmit submits the local request of the certificate `name`.
+func remoteSubmit(c *client.Client, name string) *client.Request {
+	setCertPath(name)
+	data, err := os.ReadFile(File.Request)
+	if err != nil {
+		log.Fatal(err)
+	}
+	req, err := c.Submit(client.Submission{Name: name, CSR: string(data)})
+	if err != nil {
+		log.Fatal(err)
+	}
+	return req
+}
+
+// remoteSign approves the pending request of the certificate `name` in the
+// portal, submitting the local request whether it is not in the queue, and
+// downloads the certificate.
+func remoteSign(c *client.Client, name string) {
+	list, err := c.List()
+	if err != nil {
+		log.Fatal(err)
+	}
+	var req *client.Request
+	for _, v := range list {
+		if v.Name == name && v.Status == client.STATUS_PENDING {
+			req = v
+		}
+	}
+	if req == nil {
+		req = remoteSubmit(c, name)
+	}
+	setCertPath(name)
+
+	if _, err = os.Stat(File.Cert); !os.IsNotExist(err) {
+		log.Fatalf("Certificate already exists: %q", File.Cert)
+	}
+	if req, err = c.Approve(req.ID); err != nil {
+		log.Fatal(err)
+	}
+	data, err := c.Cert(req.ID)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err = writeFileAtomic(File.Cert, data, 0644); err != nil {
+		log.Fatal(err)
+	}
+
+	for _, v := range []string{File.Request, File.SrvConfig} {
+		if err = os.Remove(v); err != nil && !os.IsNotExist(err) {
+			log.Print(err)
+		}
+	}
+	fmt.Printf("\n== Generated\n- Certificate:\t%q\t(request %s)\n", File.Cert, req.ID)
+}
+
+// runRemoteLs lists the certificates and the pending requests of the portal,
+// and the private keys of the local directory.
+func runRemoteLs(cmd *flagplus.Subcommand, args []string) {
+	if *IsTree || *IsHistory {
+		log.Fatal("Flags -tree and -history are not supported through the portal")
+	}
+	if !*IsCert && !*IsRequest && !*IsKey {
+		*IsCert = true
+		*IsRequest = true
+		*IsKey = true
+	}
+	c := remoteClient()
+
+	if *IsCert {
+		certs, err := c.Certificates()
+		if err != nil {
+			log.Fatal(err)
+		}
+		var names []string
+		for _, v := range certs {
+			names = append(names, v.Name+EXT_CERT)
+		}
+		printCert(names)
+	}
+	if *IsRequest {
+		list, err := c.List()
+		if err != nil {
+			log.Fatal(err)
+		}
+		var names []string
+		for _, v := range list {
+			if v.Status == client.STATUS_PENDING {
+				names = append(names, v.Name+EXT_REQUEST)
+			}
+		}
+		printCert(names)
+	}
+	if *IsKey {
+		match, err := filepath.Glob(filepath.Join(Dir.Key, "*"+EXT_KEY))
+		if err != nil {
+			log.Fatal(err)
+		}
+		printCert(match)
+	}
+}
+
+// runRemoteInfo prints the information of a certificate of the portal. The
+// paths and the requests ("-req") are got from the local directory.
+func runRemoteInfo(cmd *flagplus.Subcommand, args []string) {
+	if len(args) != 1 || *IsRequest || args[0][0] == '.' || args[0][0] == os.PathSeparator {
+		runInfo(cmd, args)
+		return
+	}
+
+	data, err := remoteClient().Certificate(args[0])
+	if err != nil {
+		log.Fatal(err)
+	}
+	f, err := os.CreateTemp("", PROGRAM+"-*"+EXT_CERT)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	_, err = f.Write(data)
+	if err1 := f.Close(); err == nil {
+		err = err1
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	runInfo(cmd, []string{f.Name()})
+}
+
+func runRemoteRevoke(cmd *flagplus.Subcommand, args []string) {
+	if *IsAll {
+		log.Fatal("Flag -all is not supported through the portal")
+	}
+	if len(args) != 1 {
+		log.Print("Missing required argument: NAME")
+		cmd.Usage()
+	}
+	reason := revokeReason(*Reason)
+	if reason == "" {
+		log.Fatalf("Unknown reason: %q\n\n  Use one of: %s", *Reason, strings.Join(revokeReasons, ", "))
+	}
+
+	cert, err := remoteClient().Revoke(args[0], reason)
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Printf("\n== Revoked\n- %s\t(serial %s)\n", cert.Name, cert.Serial)
+}
@@ -0,0 +1,114 @@
+// Copyright 2014 Jonas mg
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+// Shamir's secret sharing over GF(256), to split a secret in shares so that
+// any `threshold` of them recover it, but fewer reveal nothing.
+
+package main
+
+import (
+	"crypto/rand"
+	"errors"
+)
+
+var errShares = errors.New("shares of different secrets or repeated")
+
+// gfExp and gfLog are the tables of exponentials and logarithms of GF(256)
+// with the polynomial of AES (x^8 + x^4 + x^3 + x + 1), and generator 3.
+var gfExp, gfLog [256]byte
+
+func init() {
+	x := byte(1)
+	for i := 0; i < 255; i++ {
+		gfExp[i] = x
+		gfLog[x] = byte(i)
+		// x * 3 = x * 2 + x
+		x2 := x << 1
+		if x&0x80 != 0 {
+			x2 ^= 0x1b
+		}
+		x = x2 ^ x
+	}
+	gfExp[255] = gfExp[0]
+}
+
+func gfMul(a, b byte) byte {
+	if a == 0 || b == 0 {
+		return 0
+	}
+	return gfExp[(int(gfLog[a])+int(gfLog[b]))%255]
+}
+
+func gfDiv(a, b byte) byte {
+	if a == 0 {
+		return 0
+	}
+	return gfExp[(int(gfLog[a])-int(gfLog[b])+255)%255]
+}
+
+// shamirSplit splits the secret in `n` shares, where any `threshold` of them
+// recover it. Every share is its x coordinate followed by the y coordinates
+// for every byte of the secret.
+func shamirSplit(secret []byte, n, threshold int) ([][]byte, error) {
+	if threshold < 2 || threshold > n || n > 255 {
+		return nil, errors.New("the threshold must be between 2 and the number of shares, up to 255")
+	}
+	shares := make([][]byte, n)
+	for i := range shares {
+		shares[i] = make([]byte, len(secret)+1)
+		shares[i][0] = byte(i + 1)
+	}
+
+	coef := make([]byte, threshold)
+	for j, s := range secret {
+		// Polynomial of degree threshold-1 whose constant term is the byte.
+		if _, err := rand.Read(coef[1:]); err != nil {
+			return nil, err
+		}
+		coef[0] = s
+
+		for _, share := range shares {
+			x, y := share[0], byte(0)
+			for k := threshold - 1; k >= 0; k-- {
+				y = gfMul(y, x) ^ coef[k]
+			}
+			share[j+1] = y
+		}
+	}
+	return shares, nil
+}
+
+// shamirCombine recovers the secret from the shares, by Lagrange
+// interpolation at x = 0. The result is only right with enough shares.
+func shamirCombine(shares [][]byte) ([]byte, error) {
+	if len(shares) < 2 {
+		return nil, errors.New("at least 2 shares are needed")
+	}
+	size := len(shares[0])
+	seen := make(map[byte]bool)
+
+	for _, v := range shares {
+		if len(v) != size || size < 2 || v[0] == 0 || seen[v[0]] {
+			return nil, errShares
+		}
+		seen[v[0]] = true
+	}
+
+	secret := make([]byte, size-1)
+	for i, a := range shares {
+		// Lagrange basis at 0: prod x_j / (x_j - x_i), with subtraction as XOR.
+		basis := byte(1)
+		for j, b := range shares {
+			if i != j {
+				basis = gfMul(basis, gfDiv(b[0], b[0]^a[0]))
+			}
+		}
+		for k := range secret {
+			secret[k] ^= gfMul(a[k+1], basis)
+		}
+	}
+	return secret, nil
+}
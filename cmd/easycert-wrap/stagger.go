@@ -0,0 +1,159 @@
+// Copyright 2014 Jonas mg
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/tredoe/easycert"
+)
+
+// FILE_SCHEDULE is the log of the expirations of the batches staggered.
+const FILE_SCHEDULE = "schedule.log"
+
+var Stagger = flag.String("stagger", "", "window to spread the expirations of a batch (i.e. 7d)")
+
+var errDuration = errors.New("must be a duration like 7d or 12h")
+
+// staggerOffset is the time added to the validity of the certificate being
+// signed.
+var staggerOffset time.Duration
+
+// parseDuration parses a duration which can be given in days, like "7d".
+func parseDuration(s string) (time.Duration, error) {
+	if strings.HasSuffix(s, "d") {
+		days, err := strconv.Atoi(strings.TrimSuffix(s, "d"))
+		if err != nil || days < 0 {
+			return 0, errDuration
+		}
+		return time.Duration(days) * 24 * time.Hour, nil
+	}
+
+	d, err := time.ParseDuration(s)
+	if err != nil || d < 0 {
+		return 0, errDuration
+	}
+	return d, nil
+}
+
+// validityArgs returns the arguments of "openssl ca" to set the validity of the
+// certificate, according to the years and the offset of the stagger.
+func validityArgs() []string {
+	if staggerOffset == 0 {
+		return []string{"-days", strconv.Itoa(365 * *Years)}
+	}
+	return []string{"-enddate", validityEnd().Format("20060102150405Z")}
+}
+
+// validityEnd returns the expiration of the certificate, according to the
+// years and the offset of the stagger.
+func validityEnd() time.Time {
+	return time.Now().UTC().AddDate(0, 0, 365**Years).Add(staggerOffset)
+}
+
+// batch spreads the expirations of the certificates signed together over the
+// window of the stagger.
+type batch struct {
+	Time    time.Time       `json:"time"`
+	Stagger string          `json:"stagger"`
+	Certs   []scheduledCert `json:"certs"`
+
+	window  time.Duration
+	size    int
+	items   []batchItem
+	current string // Name of the certificate in progress.
+}
+
+// scheduledCert is a certificate of a batch.
+type scheduledCert struct {
+	Name     string    `json:"name"`
+	NotAfter time.Time `json:"not_after"`
+}
+
+// newBatch returns the batch to sign `size` certificates, with the window set
+// in the flag "-stagger".
+func newBatch(size int) *batch {
+	b := &batch{Time: time.Now().UTC(), Stagger: *Stagger, size: size}
+	curBatch = b
+
+	if *Stagger != "" {
+		window, err := parseDuration(*Stagger)
+		if err != nil {
+			log.Fatalf("Invalid value %q for flag -stagger: %s", *Stagger, err)
+		}
+		b.window = window
+	}
+	return b
+}
+
+// next sets the offset of the validity for the certificate `i` of the batch,
+// named `name`.
+func (b *batch) next(i int, name string) {
+	b.header(i, name)
+	staggerOffset = 0
+	if b.size > 1 {
+		staggerOffset = b.window * time.Duration(i) / time.Duration(b.size-1)
+	}
+}
+
+// add records the certificate signed.
+func (b *batch) add(name string) {
+	cert, err := parseCertFile(File.Cert)
+	if err != nil {
+		log.Print(err)
+		b.items = append(b.items, batchItem{name: name, status: _ITEM_SIGNED})
+		return
+	}
+	b.Certs = append(b.Certs, scheduledCert{name, cert.NotAfter.UTC()})
+	b.items = append(b.items, batchItem{
+		name:     name,
+		serial:   easycert.SerialHex(cert.SerialNumber),
+		notAfter: cert.NotAfter,
+		status:   _ITEM_SIGNED,
+	})
+}
+
+// save appends the schedule of the batch to the log, whether the expirations
+// were staggered, and shows the summary whether there were several
+// certificates.
+func (b *batch) save() {
+	curBatch = nil
+	if b.size > 1 {
+		b.summary(os.Stdout, false)
+	}
+	if b.window == 0 || len(b.Certs) == 0 {
+		return
+	}
+
+	data, err := json.Marshal(b)
+	if err != nil {
+		log.Print(err)
+		return
+	}
+	file, err := os.OpenFile(filepath.Join(Dir.Root, FILE_SCHEDULE),
+		os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		log.Print(err)
+		return
+	}
+	_, err = file.Write(append(data, '\n'))
+	if err == nil {
+		err = file.Sync()
+	}
+	file.Close()
+	if err != nil {
+		log.Print(err)
+	}
+}
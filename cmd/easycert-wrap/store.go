@@ -0,0 +1,408 @@
+// Copyright 2014 Jonas mg
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tredoe/easycert"
+)
+
+// StoreConfig represents the configuration of the certificates directory,
+// which is stored in JSON format.
+type StoreConfig struct {
+	// Days before of the expiration when a certificate has to be renewed.
+	RenewalDays int `json:"renewal_days,omitempty"`
+
+	SMTP *SMTPConfig `json:"smtp,omitempty"`
+
+	// Issue in GitHub or GitLab with the certificates to renew.
+	Issue *IssueConfig `json:"issue,omitempty"`
+
+	// Role of every operator, by name. The roles are not enforced when it is
+	// empty.
+	Operators map[string]string `json:"operators,omitempty"`
+
+	// The certificates directory can not be modified, i.e. because it is a
+	// copy mounted in read-only mode for the auditors.
+	ReadOnly bool `json:"readonly,omitempty"`
+
+	// Write a receipt for every certificate issued.
+	Receipt *ReceiptConfig `json:"receipt,omitempty"`
+
+	// Keep in escrow the private keys generated.
+	Escrow *EscrowConfig `json:"escrow,omitempty"`
+
+	// Restrict the algorithms to those approved by FIPS.
+	FIPS bool `json:"fips,omitempty"`
+
+	// Only the requests generated outside are signed; the private keys of the
+	// certificates are never generated in the host of the CA.
+	NoServerKeygen bool `json:"no_server_keygen,omitempty"`
+
+	// Suffixes appended to the short hostnames requested, like ".internal".
+	AutoSANs []string `json:"auto_sans,omitempty"`
+
+	// Only the requests of the queue with an attestation of the key verified
+	// (against the roots of Google and Apple, or by the hook
+	// "verify-attestation") are signed.
+	RequireAttestation bool `json:"require_attestation,omitempty"`
+
+	// Number of previous versions of every certificate kept on reissue.
+	History int `json:"history,omitempty"`
+
+	// Time to keep the material expired, before of being removed by "gc".
+	Retention string `json:"retention,omitempty"`
+
+	// Watch of the Certificate Transparency logs by "ctwatch".
+	CTWatch *CTWatchConfig `json:"ctwatch,omitempty"`
+
+	// Log of the system where the events of the audit log are sent too.
+	Syslog string `json:"syslog,omitempty"`
+
+	// External database where the database of the CA is copied.
+	Database *DatabaseConfig `json:"database,omitempty"`
+}
+
+// SMTPConfig represents the configuration to send notifications by email.
+type SMTPConfig struct {
+	Addr     string   `json:"addr"` // host:port
+	Username string   `json:"username,omitempty"`
+	Password string   `json:"password,omitempty"`
+	From     string   `json:"from"`
+	To       []string `json:"to"`
+}
+
+// DEFAULT_RENEWAL_DAYS is the renewal window used when it is not configured.
+const DEFAULT_RENEWAL_DAYS = 30
+
+// loadStoreConfig returns the configuration of the certificates directory.
+// It is not an error if the file does not exist.
+func loadStoreConfig() *StoreConfig {
+	v, err := loadCached(File.Store, func(data []byte) (interface{}, error) {
+		return parseStoreConfig(data)
+	})
+	if err != nil {
+		if os.IsNotExist(err) {
+			return new(StoreConfig)
+		}
+		log.Fatalf("%q: %s", File.Store, err)
+	}
+
+	return v.(*StoreConfig).clone()
+}
+
+// clone returns a deep copy of the configuration, so the caller can modify it
+// without changing the one of the cache.
+func (cfg *StoreConfig) clone() *StoreConfig {
+	c := *cfg
+	c.Operators = maps.Clone(cfg.Operators)
+	c.AutoSANs = slices.Clone(cfg.AutoSANs)
+
+	if cfg.SMTP != nil {
+		v := *cfg.SMTP
+		v.To = slices.Clone(v.To)
+		c.SMTP = &v
+	}
+	if cfg.Issue != nil {
+		v := *cfg.Issue
+		c.Issue = &v
+	}
+	if cfg.Receipt != nil {
+		v := *cfg.Receipt
+		c.Receipt = &v
+	}
+	if cfg.Escrow != nil {
+		v := *cfg.Escrow
+		v.Names = slices.Clone(v.Names)
+		c.Escrow = &v
+	}
+	if cfg.CTWatch != nil {
+		v := *cfg.CTWatch
+		v.Domains = slices.Clone(v.Domains)
+		v.Issuers = slices.Clone(v.Issuers)
+		c.CTWatch = &v
+	}
+	if cfg.Database != nil {
+		v := *cfg.Database
+		c.Database = &v
+	}
+	return &c
+}
+
+// parseStoreConfig parses and checks the configuration in JSON format.
+func parseStoreConfig(data []byte) (*StoreConfig, error) {
+	cfg := new(StoreConfig)
+
+	if err := json.Unmarshal(data, cfg); err != nil {
+		return nil, fmt.Errorf("parsing error: %s", err)
+	}
+	if err := cfg.check(); err != nil {
+		return nil, fmt.Errorf("configuration error: %s", err)
+	}
+
+	if cfg.RenewalDays == 0 {
+		cfg.RenewalDays = DEFAULT_RENEWAL_DAYS
+	}
+	return cfg, nil
+}
+
+// check checks that the configuration is correct.
+func (cfg *StoreConfig) check() error {
+	if cfg.RenewalDays < 0 {
+		return errors.New("renewal_days must be positive")
+	}
+	for name, role := range cfg.Operators {
+		if role != ROLE_ADMIN && role != ROLE_ISSUER && role != ROLE_AUDITOR {
+			return fmt.Errorf("operator %q has an unknown role: %q", name, role)
+		}
+	}
+	if cfg.Receipt != nil && cfg.Receipt.Signer == SIGNER_MINISIGN && cfg.Receipt.Key == "" {
+		return errors.New("receipt needs the field key to sign with minisign")
+	}
+	if cfg.Escrow != nil && cfg.Escrow.Cert == "" {
+		return errors.New("escrow needs the field cert")
+	}
+	if cfg.SMTP != nil {
+		if cfg.SMTP.Addr == "" || cfg.SMTP.From == "" || len(cfg.SMTP.To) == 0 {
+			return errors.New("smtp needs the fields addr, from and to")
+		}
+	}
+	if cfg.Issue != nil {
+		if err := cfg.Issue.check(); err != nil {
+			return err
+		}
+	}
+	if cfg.History < 0 {
+		return errors.New("history must be positive")
+	}
+	if cfg.Retention != "" {
+		if _, err := parseDuration(cfg.Retention); err != nil {
+			return fmt.Errorf("retention %s", err)
+		}
+	}
+	for _, v := range cfg.AutoSANs {
+		if !strings.HasPrefix(v, ".") || !validDNS.MatchString("host"+v) {
+			return fmt.Errorf("auto_sans has a wrong suffix: %q", v)
+		}
+	}
+	if cfg.Syslog != "" && cfg.Syslog != SYSLOG_JOURNALD && cfg.Syslog != SYSLOG_SYSLOG {
+		return fmt.Errorf("syslog has to be %q or %q", SYSLOG_JOURNALD, SYSLOG_SYSLOG)
+	}
+	if cfg.Database != nil {
+		if err := cfg.Database.check(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ENV_READONLY is the environment variable to use the certificates directory
+// in read-only mode.
+const ENV_READONLY = "EASYCERT_READONLY"
+
+var IsReadOnly = flag.Bool("readonly", false, "use the certificates directory in read-only mode")
+
+// readOnly reports whether the certificates directory can not be modified.
+func readOnly() bool {
+	return *IsReadOnly || os.Getenv(ENV_READONLY) != "" || loadStoreConfig().ReadOnly
+}
+
+// mustWritable exits whether the certificates directory is in read-only mode.
+func mustWritable() {
+	if readOnly() {
+		log.Fatal("The certificates directory is in read-only mode")
+	}
+}
+
+// storeCert represents a certificate of the certificates directory.
+type storeCert struct {
+	Name string // Name without extension.
+	File string
+	Cert *x509.Certificate
+}
+
+// parseCertFile returns the first certificate in PEM format found in file.
+// The certificate returned is shared, so it must not be modified.
+func parseCertFile(file string) (*x509.Certificate, error) {
+	v, err := loadCached(file, func(data []byte) (interface{}, error) {
+		for {
+			var block *pem.Block
+
+			block, data = pem.Decode(data)
+			if block == nil {
+				return nil, fmt.Errorf("no certificate in PEM format: %q", file)
+			}
+			if block.Type == "CERTIFICATE" {
+				return x509.ParseCertificate(block.Bytes)
+			}
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	return v.(*x509.Certificate), nil
+}
+
+// cachedFile represents the value parsed from a file, which is valid while the
+// content of the file is the same.
+type cachedFile struct {
+	sum   [sha256.Size]byte
+	value interface{}
+}
+
+var (
+	fileCacheMu sync.Mutex
+	fileCache   = make(map[string]cachedFile)
+)
+
+// loadCached returns the value parsed from the file, parsing it only whether
+// its content changed since the last time. It is used by the long-running
+// commands, which read the same files for every request. The content is
+// compared by its digest, since the time of modification and the size are
+// kept by a file replaced in the same second, or on purpose.
+func loadCached(file string, parse func([]byte) (interface{}, error)) (interface{}, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256(data)
+
+	fileCacheMu.Lock()
+	c, ok := fileCache[file]
+	fileCacheMu.Unlock()
+	if ok && c.sum == sum {
+		return c.value, nil
+	}
+
+	value, err := parse(data)
+	if err != nil {
+		return nil, err
+	}
+
+	fileCacheMu.Lock()
+	fileCache[file] = cachedFile{sum, value}
+	fileCacheMu.Unlock()
+	return value, nil
+}
+
+// loadCerts returns the certificates of the certificates directory, sorted by
+// name. The files which can not be parsed are reported and skipped.
+func loadCerts() []*storeCert {
+	match, err := filepath.Glob(filepath.Join(Dir.Cert, "*"+EXT_CERT))
+	if err != nil {
+		log.Fatal(err)
+	}
+	sort.Strings(match)
+
+	certs := make([]*storeCert, 0, len(match))
+	for _, v := range match {
+		cert, err := parseCertFile(v)
+		if err != nil {
+			log.Printf("%s: %s", v, err)
+			continue
+		}
+
+		name := filepath.Base(v)
+		certs = append(certs, &storeCert{
+			Name: name[:len(name)-len(EXT_CERT)],
+			File: v,
+			Cert: cert,
+		})
+	}
+	return certs
+}
+
+// issuerOf returns the certificate which issued `cert`, linking them through
+// the Authority and Subject Key Identifiers. It returns nil whether it is
+// self-signed or its issuer is not in `certs`.
+func issuerOf(cert *x509.Certificate, certs []*storeCert) *storeCert {
+	aki := cert.AuthorityKeyId
+	if len(aki) == 0 || bytes.Equal(aki, cert.SubjectKeyId) {
+		return nil
+	}
+
+	for _, v := range certs {
+		if v.Cert != cert && bytes.Equal(aki, v.Cert.SubjectKeyId) {
+			return v
+		}
+	}
+	return nil
+}
+
+// chainOf returns the issuers of `cert` found in `certs`, from the nearest one
+// up to the root.
+func chainOf(cert *x509.Certificate, certs []*storeCert) []*storeCert {
+	var chain []*storeCert
+
+	for v := issuerOf(cert, certs); v != nil; v = issuerOf(v.Cert, certs) {
+		for _, c := range chain {
+			if c == v { // loop
+				return chain
+			}
+		}
+		chain = append(chain, v)
+	}
+	return chain
+}
+
+// CertInfo represents the public information of a certificate.
+type CertInfo struct {
+	Name      string    `json:"name"`
+	Subject   string    `json:"subject"`
+	Issuer    string    `json:"issuer"`
+	Serial    string    `json:"serial"`
+	NotBefore time.Time `json:"not_before"`
+	NotAfter  time.Time `json:"not_after"`
+	IsCA      bool      `json:"is_ca"`
+
+	DNSNames    []string `json:"dns_names,omitempty"`
+	IPAddresses []string `json:"ip_addresses,omitempty"`
+	Emails      []string `json:"emails,omitempty"`
+
+	FingerprintSHA256 string `json:"fingerprint_sha256"`
+	FingerprintSHA1   string `json:"fingerprint_sha1"`
+}
+
+// newCertInfo returns the public information of a certificate.
+func newCertInfo(name string, cert *x509.Certificate) *CertInfo {
+	info := &CertInfo{
+		Name:      name,
+		Subject:   cert.Subject.String(),
+		Issuer:    cert.Issuer.String(),
+		Serial:    easycert.SerialHex(cert.SerialNumber),
+		NotBefore: cert.NotBefore.UTC(),
+		NotAfter:  cert.NotAfter.UTC(),
+		IsCA:      cert.IsCA,
+
+		DNSNames: cert.DNSNames,
+		Emails:   cert.EmailAddresses,
+
+		FingerprintSHA256: fingerprint(sha256Sum(cert.Raw)),
+		FingerprintSHA1:   fingerprint(sha1Sum(cert.Raw)),
+	}
+	for _, ip := range cert.IPAddresses {
+		info.IPAddresses = append(info.IPAddresses, ip.String())
+	}
+	return info
+}
@@ -0,0 +1,159 @@
+// Copyright 2014 Jonas mg
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Logs of the system where the events of the audit log, and the logs of the
+// portal, are sent; set in the field "syslog" of "store.json".
+const (
+	SYSLOG_JOURNALD = "journald"
+	SYSLOG_SYSLOG   = "syslog"
+)
+
+// SYSLOG_TAG identifies the program in the logs of the system.
+const SYSLOG_TAG = "easycert"
+
+// Priorities of syslog (RFC 5424) used in the logs.
+const (
+	_PRIORITY_ERR    = 3
+	_PRIORITY_NOTICE = 5
+)
+
+var (
+	// journalSocket is the socket of the native protocol of the journal of
+	// systemd.
+	journalSocket = "/run/systemd/journal/socket"
+
+	// Network and address of the syslog server; the local one whether they are
+	// empty.
+	syslogNetwork, syslogAddr string
+)
+
+// logField is a structured field of a log message. The keys are the fields of
+// the journal, in upper case.
+type logField struct {
+	key, value string
+}
+
+// sysLogger sends messages to a log of the system.
+type sysLogger interface {
+	send(priority int, msg string, fields []logField) error
+}
+
+var (
+	sysLog     sysLogger
+	sysLogOnce sync.Once
+)
+
+// openSysLog returns the log of the system set in the configuration of the
+// certificates directory, or nil whether it is not set or can not be opened.
+func openSysLog() sysLogger {
+	sysLogOnce.Do(func() {
+		var err error
+
+		switch loadStoreConfig().Syslog {
+		case SYSLOG_JOURNALD:
+			sysLog, err = dialJournal(journalSocket)
+		case SYSLOG_SYSLOG:
+			sysLog, err = dialSyslog(syslogNetwork, syslogAddr)
+		}
+		if err != nil {
+			log.Print(err)
+			sysLog = nil
+		}
+	})
+	return sysLog
+}
+
+// sysLogWriter writes the output of the package log to the log of the system,
+// with the priority of the errors.
+type sysLogWriter struct{ sysLogger }
+
+func (w sysLogWriter) Write(p []byte) (int, error) {
+	if err := w.send(_PRIORITY_ERR, strings.TrimSuffix(string(p), "\n"), nil); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// fields returns the structured fields of the event.
+func (e auditEvent) fields() []logField {
+	fields := []logField{
+		{"EASYCERT_ACTION", e.Action},
+		{"EASYCERT_OPERATOR", e.Operator},
+		{"EASYCERT_NAME", e.Name},
+	}
+	if e.Detail != "" {
+		fields = append(fields, logField{"EASYCERT_DETAIL", e.Detail})
+	}
+	return fields
+}
+
+// formatFields returns the fields like pairs "key=value" for syslog, with the
+// keys in lower case and without the prefix of the program.
+func formatFields(fields []logField) string {
+	var buf bytes.Buffer
+
+	for _, f := range fields {
+		value := f.value
+		if value == "" || strings.ContainsAny(value, " \t\n\"=") {
+			value = strconv.Quote(value)
+		}
+		fmt.Fprintf(&buf, " %s=%s",
+			strings.ToLower(strings.TrimPrefix(f.key, "EASYCERT_")), value)
+	}
+	return buf.String()
+}
+
+// journal sends the messages to the journal of systemd.
+type journal struct {
+	conn *net.UnixConn
+}
+
+// dialJournal connects to the socket of the journal at `path`.
+func dialJournal(path string) (*journal, error) {
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		return nil, err
+	}
+	return &journal{conn}, nil
+}
+
+// send sends the message with the fields in a datagram; the values with new
+// lines are serialized in binary, with their size.
+func (j *journal) send(priority int, msg string, fields []logField) error {
+	var buf bytes.Buffer
+
+	fields = append([]logField{
+		{"MESSAGE", msg},
+		{"PRIORITY", strconv.Itoa(priority)},
+		{"SYSLOG_IDENTIFIER", SYSLOG_TAG},
+	}, fields...)
+
+	for _, f := range fields {
+		if !strings.Contains(f.value, "\n") {
+			fmt.Fprintf(&buf, "%s=%s\n", f.key, f.value)
+			continue
+		}
+		buf.WriteString(f.key + "\n")
+		binary.Write(&buf, binary.LittleEndian, uint64(len(f.value)))
+		buf.WriteString(f.value + "\n")
+	}
+
+	_, err := j.conn.Write(buf.Bytes())
+	return err
+}
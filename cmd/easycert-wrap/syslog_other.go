@@ -0,0 +1,16 @@
+// Copyright 2014 Jonas mg
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+//go:build windows || plan9
+
+package main
+
+import "errors"
+
+// dialSyslog fails since syslog is not available in the system.
+func dialSyslog(network, addr string) (sysLogger, error) {
+	return nil, errors.New("syslog is not supported in this system")
+}
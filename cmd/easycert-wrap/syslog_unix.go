@@ -0,0 +1,34 @@
+// Copyright 2014 Jonas mg
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+//go:build !windows && !plan9
+
+package main
+
+import "log/syslog"
+
+// syslogger sends the messages to syslog, with the fields like pairs
+// "key=value" after of the message.
+type syslogger struct {
+	w *syslog.Writer
+}
+
+// dialSyslog connects to the syslog server at `addr`, with the facility of the
+// daemons.
+func dialSyslog(network, addr string) (*syslogger, error) {
+	w, err := syslog.Dial(network, addr, syslog.LOG_NOTICE|syslog.LOG_DAEMON, SYSLOG_TAG)
+	if err != nil {
+		return nil, err
+	}
+	return &syslogger{w}, nil
+}
+
+func (s *syslogger) send(priority int, msg string, fields []logField) error {
+	if priority == _PRIORITY_ERR {
+		return s.w.Err(msg + formatFields(fields))
+	}
+	return s.w.Notice(msg + formatFields(fields))
+}
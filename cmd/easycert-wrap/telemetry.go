@@ -0,0 +1,428 @@
+// Copyright 2014 Jonas mg
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Telemetry of the portal for OpenTelemetry: the spans of the requests and of
+// the steps of the issuance, and the histogram of their durations. They are
+// exported by OTLP over HTTP with the encoding JSON, configured by the
+// environment variables of OpenTelemetry.
+
+const (
+	ENV_OTEL_ENDPOINT         = "OTEL_EXPORTER_OTLP_ENDPOINT"
+	ENV_OTEL_TRACES_ENDPOINT  = "OTEL_EXPORTER_OTLP_TRACES_ENDPOINT"
+	ENV_OTEL_METRICS_ENDPOINT = "OTEL_EXPORTER_OTLP_METRICS_ENDPOINT"
+	ENV_OTEL_HEADERS          = "OTEL_EXPORTER_OTLP_HEADERS"
+	ENV_OTEL_SERVICE_NAME     = "OTEL_SERVICE_NAME"
+	ENV_OTEL_SDK_DISABLED     = "OTEL_SDK_DISABLED"
+)
+
+// TELEMETRY_INTERVAL is the time between exports of the telemetry.
+const TELEMETRY_INTERVAL = 5 * time.Second
+
+// METRIC_DURATION is the histogram of the durations of the operations, in
+// seconds, by the name of their span.
+const METRIC_DURATION = "easycert.operation.duration"
+
+// durationBounds are the upper bounds of the buckets of METRIC_DURATION.
+var durationBounds = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// Kinds of span and codes of status of OTLP.
+const (
+	_SPAN_KIND_INTERNAL = 1
+	_SPAN_KIND_SERVER   = 2
+	_STATUS_ERROR       = 2
+)
+
+// tel is the exporter of the telemetry, or nil whether it is not configured.
+var tel *telemetry
+
+// span represents an operation traced.
+type span struct {
+	traceID  [16]byte
+	id       [8]byte
+	parentID [8]byte // zero in the root span
+	name     string
+	kind     int
+	start    time.Time
+	attrs    []otlpKeyValue
+}
+
+// startSpan starts the span of the operation `name`, child of `parent` or root
+// whether it is nil. It returns nil whether the telemetry is not enabled.
+func startSpan(parent *span, name string, kind int) *span {
+	if tel == nil {
+		return nil
+	}
+	s := &span{name: name, kind: kind, start: time.Now()}
+
+	if parent != nil {
+		s.traceID = parent.traceID
+		s.parentID = parent.id
+	} else {
+		rand.Read(s.traceID[:])
+	}
+	rand.Read(s.id[:])
+	return s
+}
+
+// setAttr sets an attribute of the span, whose value is a string or an integer.
+func (s *span) setAttr(key string, value interface{}) {
+	if s != nil {
+		s.attrs = append(s.attrs, otlpAttr(key, value))
+	}
+}
+
+// end ends the span, with the error of the operation.
+func (s *span) end(err error) {
+	if s != nil {
+		tel.record(s, time.Now(), err)
+	}
+}
+
+// traceStep runs the step `name` of an operation into a child span of
+// `parent`, returning its error.
+func traceStep(parent *span, name string, fn func() error) error {
+	s := startSpan(parent, name, _SPAN_KIND_INTERNAL)
+	err := fn()
+	s.end(err)
+	return err
+}
+
+// remoteSpan returns the span of the caller given in the header "traceparent"
+// of the W3C Trace Context, or nil whether it is not valid.
+func remoteSpan(traceparent string) *span {
+	parts := strings.Split(traceparent, "-")
+	if len(parts) != 4 || parts[0] != "00" || len(parts[1]) != 32 || len(parts[2]) != 16 {
+		return nil
+	}
+	s := new(span)
+
+	if _, err := hex.Decode(s.traceID[:], []byte(parts[1])); err != nil {
+		return nil
+	}
+	if _, err := hex.Decode(s.id[:], []byte(parts[2])); err != nil {
+		return nil
+	}
+	if s.traceID == [16]byte{} || s.id == [8]byte{} {
+		return nil
+	}
+	return s
+}
+
+type spanKey struct{}
+
+// spanOf returns the span of the request to the portal.
+func spanOf(r *http.Request) *span {
+	s, _ := r.Context().Value(spanKey{}).(*span)
+	return s
+}
+
+// statusWriter records the status code of the response.
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *statusWriter) WriteHeader(code int) {
+	w.status = code
+	w.ResponseWriter.WriteHeader(code)
+}
+
+// traced returns the handler of the `route` of the portal traced into a span
+// of server, continuing the trace of the caller.
+func traced(route string, h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		s := startSpan(remoteSpan(r.Header.Get("traceparent")), r.Method+" "+route, _SPAN_KIND_SERVER)
+		if s == nil {
+			h(w, r)
+			return
+		}
+		s.setAttr("http.request.method", r.Method)
+		s.setAttr("http.route", route)
+		s.setAttr("url.path", r.URL.Path)
+
+		sw := &statusWriter{w, http.StatusOK}
+		h(sw, r.WithContext(context.WithValue(r.Context(), spanKey{}, s)))
+
+		s.setAttr("http.response.status_code", sw.status)
+		var err error
+		if sw.status >= 500 {
+			err = fmt.Errorf("%d %s", sw.status, http.StatusText(sw.status))
+		}
+		s.end(err)
+	}
+}
+
+// == Exporter
+//
+
+// telemetry exports the spans and the metrics by OTLP.
+type telemetry struct {
+	tracesURL  string
+	metricsURL string
+	headers    map[string]string
+	resource   otlpResource
+	start      time.Time // start of the cumulative metrics
+	client     *http.Client
+
+	mu        sync.Mutex
+	spans     []otlpSpan
+	durations map[string]*histogram
+}
+
+// histogram is a histogram of durations, in seconds.
+type histogram struct {
+	counts []uint64 // by bucket; the last one is for values above the bounds
+	count  uint64
+	sum    float64
+}
+
+// newTelemetry returns the exporter configured in the environment, or nil
+// whether there is no endpoint or the SDK is disabled.
+func newTelemetry() *telemetry {
+	if v, _ := strconv.ParseBool(os.Getenv(ENV_OTEL_SDK_DISABLED)); v {
+		return nil
+	}
+	t := &telemetry{
+		tracesURL:  os.Getenv(ENV_OTEL_TRACES_ENDPOINT),
+		metricsURL: os.Getenv(ENV_OTEL_METRICS_ENDPOINT),
+		headers:    make(map[string]string),
+		start:      time.Now(),
+		client:     &http.Client{Timeout: 10 * time.Second},
+		durations:  make(map[string]*histogram),
+	}
+	if base := strings.TrimSuffix(os.Getenv(ENV_OTEL_ENDPOINT), "/"); base != "" {
+		if t.tracesURL == "" {
+			t.tracesURL = base + "/v1/traces"
+		}
+		if t.metricsURL == "" {
+			t.metricsURL = base + "/v1/metrics"
+		}
+	}
+	if t.tracesURL == "" && t.metricsURL == "" {
+		return nil
+	}
+
+	for _, v := range strings.Split(os.Getenv(ENV_OTEL_HEADERS), ",") {
+		if k, v, ok := strings.Cut(v, "="); ok {
+			t.headers[strings.TrimSpace(k)] = strings.TrimSpace(v)
+		}
+	}
+
+	service := os.Getenv(ENV_OTEL_SERVICE_NAME)
+	if service == "" {
+		service = SYSLOG_TAG
+	}
+	t.resource.Attributes = []otlpKeyValue{otlpAttr("service.name", service)}
+	return t
+}
+
+// run exports the telemetry periodically.
+func (t *telemetry) run() {
+	for range time.Tick(TELEMETRY_INTERVAL) {
+		if err := t.flush(); err != nil {
+			log.Print(err)
+		}
+	}
+}
+
+// record adds the span ended, and its duration to the histogram.
+func (t *telemetry) record(s *span, end time.Time, err error) {
+	v := otlpSpan{
+		TraceID:     hex.EncodeToString(s.traceID[:]),
+		SpanID:      hex.EncodeToString(s.id[:]),
+		Name:        s.name,
+		Kind:        s.kind,
+		StartTimeNs: strconv.FormatInt(s.start.UnixNano(), 10),
+		EndTimeNs:   strconv.FormatInt(end.UnixNano(), 10),
+		Attributes:  s.attrs,
+	}
+	if s.parentID != [8]byte{} {
+		v.ParentSpanID = hex.EncodeToString(s.parentID[:])
+	}
+	if err != nil {
+		v.Status = &otlpStatus{Code: _STATUS_ERROR, Message: err.Error()}
+	}
+	seconds := end.Sub(s.start).Seconds()
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.spans = append(t.spans, v)
+	h, ok := t.durations[s.name]
+	if !ok {
+		h = &histogram{counts: make([]uint64, len(durationBounds)+1)}
+		t.durations[s.name] = h
+	}
+	i := 0
+	for i < len(durationBounds) && seconds > durationBounds[i] {
+		i++
+	}
+	h.counts[i]++
+	h.count++
+	h.sum += seconds
+}
+
+// flush exports the spans ended since the last export, and the metrics.
+func (t *telemetry) flush() error {
+	now := strconv.FormatInt(time.Now().UnixNano(), 10)
+	start := strconv.FormatInt(t.start.UnixNano(), 10)
+	scope := otlpScope{Name: SYSLOG_TAG}
+
+	t.mu.Lock()
+	spans := t.spans
+	t.spans = nil
+
+	points := make([]otlpHistogramPoint, 0, len(t.durations))
+	for name, h := range t.durations {
+		counts := make([]string, len(h.counts))
+		for i, v := range h.counts {
+			counts[i] = strconv.FormatUint(v, 10)
+		}
+		points = append(points, otlpHistogramPoint{
+			Attributes:     []otlpKeyValue{otlpAttr("operation", name)},
+			StartTimeNs:    start,
+			TimeNs:         now,
+			Count:          strconv.FormatUint(h.count, 10),
+			Sum:            h.sum,
+			BucketCounts:   counts,
+			ExplicitBounds: durationBounds,
+		})
+	}
+	t.mu.Unlock()
+
+	if len(spans) != 0 && t.tracesURL != "" {
+		err := t.post(t.tracesURL, map[string]interface{}{
+			"resourceSpans": []interface{}{map[string]interface{}{
+				"resource": t.resource,
+				"scopeSpans": []interface{}{map[string]interface{}{
+					"scope": scope,
+					"spans": spans,
+				}},
+			}},
+		})
+		if err != nil {
+			return err
+		}
+	}
+	if len(points) != 0 && t.metricsURL != "" {
+		return t.post(t.metricsURL, map[string]interface{}{
+			"resourceMetrics": []interface{}{map[string]interface{}{
+				"resource": t.resource,
+				"scopeMetrics": []interface{}{map[string]interface{}{
+					"scope": scope,
+					"metrics": []interface{}{map[string]interface{}{
+						"name":        METRIC_DURATION,
+						"description": "Duration of the operations of the portal",
+						"unit":        "s",
+						"histogram": map[string]interface{}{
+							"aggregationTemporality": 2, // cumulative
+							"dataPoints":             points,
+						},
+					}},
+				}},
+			}},
+		})
+	}
+	return nil
+}
+
+// post sends the data in JSON format to the collector at `url`.
+func (t *telemetry) post(url string, data interface{}) error {
+	body, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range t.headers {
+		req.Header.Set(k, v)
+	}
+
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("OTLP export to %s: %s", url, resp.Status)
+	}
+	return nil
+}
+
+// == Encoding JSON of OTLP
+//
+// The integers of 64 bits are strings, like in the mapping of protobuf to JSON.
+
+type otlpKeyValue struct {
+	Key   string                 `json:"key"`
+	Value map[string]interface{} `json:"value"`
+}
+
+// otlpAttr returns the attribute with a value string or integer.
+func otlpAttr(key string, value interface{}) otlpKeyValue {
+	switch v := value.(type) {
+	case int:
+		return otlpKeyValue{key, map[string]interface{}{"intValue": strconv.Itoa(v)}}
+	default:
+		return otlpKeyValue{key, map[string]interface{}{"stringValue": fmt.Sprint(v)}}
+	}
+}
+
+type otlpResource struct {
+	Attributes []otlpKeyValue `json:"attributes"`
+}
+
+type otlpScope struct {
+	Name string `json:"name"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code"`
+	Message string `json:"message,omitempty"`
+}
+
+type otlpSpan struct {
+	TraceID      string         `json:"traceId"`
+	SpanID       string         `json:"spanId"`
+	ParentSpanID string         `json:"parentSpanId,omitempty"`
+	Name         string         `json:"name"`
+	Kind         int            `json:"kind"`
+	StartTimeNs  string         `json:"startTimeUnixNano"`
+	EndTimeNs    string         `json:"endTimeUnixNano"`
+	Attributes   []otlpKeyValue `json:"attributes,omitempty"`
+	Status       *otlpStatus    `json:"status,omitempty"`
+}
+
+type otlpHistogramPoint struct {
+	Attributes     []otlpKeyValue `json:"attributes"`
+	StartTimeNs    string         `json:"startTimeUnixNano"`
+	TimeNs         string         `json:"timeUnixNano"`
+	Count          string         `json:"count"`
+	Sum            float64        `json:"sum"`
+	BucketCounts   []string       `json:"bucketCounts"`
+	ExplicitBounds []float64      `json:"explicitBounds"`
+}
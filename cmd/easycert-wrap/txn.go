@@ -0,0 +1,181 @@
+// Copyright 2014 Jonas mg
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+// Transactions, so a failed issuance does not leave stray files nor a
+// half-updated database.
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+)
+
+// issuance records the files created while a certificate is issued, and the
+// state of the database of the CA before of signing, to undo all whether some
+// step fails.
+type issuance struct {
+	files    []string          // files and directories created
+	renames  [][2]string       // files moved, from and to
+	db       map[string][]byte // content of the database; nil whether it did not exist
+	newCerts map[string]bool   // certificates in the directory of new certificates
+}
+
+// curIssuance is the issuance in progress, if any.
+var curIssuance *issuance
+
+// beginIssuance starts an issuance, or returns the one in progress so that a
+// request and its signing ("req -sign") are a single transaction.
+func beginIssuance() *issuance {
+	if curIssuance == nil {
+		curIssuance = new(issuance)
+	}
+	return curIssuance
+}
+
+// addRename records a file moved by the issuance.
+func (t *issuance) addRename(from, to string) {
+	if t != nil {
+		t.renames = append(t.renames, [2]string{from, to})
+	}
+}
+
+// commitIssuance ends the issuance in progress, keeping its files.
+func commitIssuance() {
+	curIssuance = nil
+}
+
+// addFile records a file or directory created by the issuance. The files of
+// the database are not recorded, since they are restored instead of removed.
+func (t *issuance) addFile(file string) {
+	if t == nil {
+		return
+	}
+	if _, ok := t.db[file]; ok {
+		return
+	}
+	t.files = append(t.files, file)
+}
+
+// saveDatabase records the state of the database of the CA, before of being
+// modified by OpenSSL, once its files are written from the database.
+func (t *issuance) saveDatabase() error {
+	if t == nil || t.db != nil {
+		return nil
+	}
+	if _, err := loadDatabase(); err != nil {
+		return err
+	}
+	db := make(map[string][]byte)
+
+	for _, v := range []string{File.Index, File.Index + ".attr", File.Serial, File.CRLNumber, File.CRL} {
+		// With the backup done by OpenSSL.
+		for _, file := range []string{v, v + ".old"} {
+			data, err := os.ReadFile(file)
+			if err != nil && !os.IsNotExist(err) {
+				return err
+			}
+			db[file] = data
+		}
+	}
+
+	entries, err := os.ReadDir(Dir.NewCert)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	t.newCerts = make(map[string]bool)
+	for _, v := range entries {
+		t.newCerts[v.Name()] = true
+	}
+
+	t.db = db
+	return nil
+}
+
+// rollback removes the files created by the issuance, in reverse order, moves
+// back the files moved, and restores the database of the CA.
+func (t *issuance) rollback() {
+	if t == nil {
+		return
+	}
+	curIssuance = nil
+	fmt.Fprint(os.Stderr, "\n== Rollback\n")
+
+	if t.db != nil {
+		t.restoreDatabase()
+	}
+
+	for i := len(t.files) - 1; i >= 0; i-- {
+		err := os.Remove(t.files[i])
+		if err == nil {
+			fmt.Fprintf(os.Stderr, "- Removed:\t%q\n", t.files[i])
+		} else if !os.IsNotExist(err) {
+			log.Print(err)
+		}
+	}
+	for i := len(t.renames) - 1; i >= 0; i-- {
+		v := t.renames[i]
+		if err := os.Rename(v[1], v[0]); err == nil {
+			fmt.Fprintf(os.Stderr, "- Moved back:\t%q\n", v[0])
+		} else {
+			log.Print(err)
+		}
+	}
+}
+
+// restoreDatabase restores the database of the CA saved by saveDatabase.
+func (t *issuance) restoreDatabase() {
+	for file, data := range t.db {
+		var err error
+
+		if data == nil {
+			err = os.Remove(file)
+			if os.IsNotExist(err) {
+				err = nil
+			}
+		} else {
+			err = writeFileAtomic(file, data, 0644)
+		}
+		if err != nil {
+			log.Print(err)
+		}
+	}
+	// Whether it was stored before of failing.
+	if issuerCA == NAME_CA && t.db[File.Index] != nil {
+		if err := storeDatabase(); err != nil {
+			log.Print(err)
+		}
+	}
+
+	entries, err := os.ReadDir(Dir.NewCert)
+	if err != nil {
+		return
+	}
+	for _, v := range entries {
+		if !t.newCerts[v.Name()] {
+			if err = os.Remove(filepath.Join(Dir.NewCert, v.Name())); err != nil {
+				log.Print(err)
+			}
+		}
+	}
+	fmt.Fprint(os.Stderr, "- Restored:\tdatabase of the CA\n")
+}
+
+// fatal is like log.Fatal, but it rolls back the issuance in progress.
+func fatal(v ...interface{}) {
+	curIssuance.rollback()
+	curBatch.abort()
+	log.Fatal(v...)
+}
+
+// fatalf is like log.Fatalf, but it rolls back the issuance in progress.
+func fatalf(format string, v ...interface{}) {
+	curIssuance.rollback()
+	curBatch.abort()
+	log.Fatalf(format, v...)
+}
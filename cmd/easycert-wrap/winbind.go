@@ -0,0 +1,206 @@
+// Copyright 2014 Jonas mg
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+// Binding of the certificates to the services of Windows, IIS, WinRM and the
+// domain controllers of Active Directory, through PowerShell.
+
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Services of Windows where the certificate is bound.
+const (
+	SERVICE_IIS   = "iis"
+	SERVICE_WINRM = "winrm"
+	SERVICE_DC    = "dc"
+)
+
+// Environment variables with the PKCS#12 bundle imported by the script of
+// PowerShell, so the password is not shown in the list of processes.
+const (
+	_ENV_PFX_FILE = "EASYCERT_PFX_FILE"
+	_ENV_PFX_PASS = "EASYCERT_PFX_PASS"
+
+	// Certificates of the root CA and of the issuer, trusted by a domain
+	// controller.
+	_ENV_ROOT_FILE   = "EASYCERT_ROOT_FILE"
+	_ENV_ISSUER_FILE = "EASYCERT_ISSUER_FILE"
+)
+
+// _PS_IMPORT imports the bundle into the personal store of the machine.
+const _PS_IMPORT = `$ErrorActionPreference = 'Stop'
+$pass = ConvertTo-SecureString $env:` + _ENV_PFX_PASS + ` -AsPlainText -Force
+Import-PfxCertificate -FilePath $env:` + _ENV_PFX_FILE + ` -CertStoreLocation Cert:\LocalMachine\My -Password $pass | Out-Null
+`
+
+// Bind binds the certificate `name` to the service `service` of Windows: the
+// HTTPS binding of the IIS site `site` at `port`, the HTTPS listener of WinRM,
+// or LDAPS and PKINIT of a domain controller. The script of PowerShell is printed instead of run whether dryRun is
+// set.
+func Bind(name, service, site string, port int, dryRun bool) {
+	cert, err := parseCertFile(File.Cert)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if cert.IsCA {
+		log.Fatal("The certificate of a CA is not bound to a service")
+	}
+	if _, err = os.Stat(File.Key); err != nil {
+		log.Fatal(err)
+	}
+
+	thumbprint := certThumbprint(cert)
+	var script string
+	switch service {
+	case SERVICE_IIS:
+		script = iisScript(site, port, thumbprint)
+	case SERVICE_WINRM:
+		script = winrmScript(winrmHostName(cert), thumbprint)
+	case SERVICE_DC:
+		if certProtocol(cert) != PROTOCOL_DC {
+			log.Fatalf("Certificate not of domain controller: %q\n\n  Use \"req -protocol dc\"", name)
+		}
+		script = dcScript()
+	}
+	if dryRun {
+		fmt.Print(script)
+		return
+	}
+
+	dir, err := os.MkdirTemp("", "easycert-")
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	pass := make([]byte, 16)
+	if _, err = rand.Read(pass); err != nil {
+		log.Fatal(err)
+	}
+	pfx := filepath.Join(dir, name+EXT_PKCS12)
+	os.Setenv(_ENV_PFX_FILE, pfx)
+	os.Setenv(_ENV_PFX_PASS, hex.EncodeToString(pass))
+
+	args := []string{"pkcs12", "-export", "-in", File.Cert, "-inkey", File.Key, "-name", name,
+		"-passout", "env:" + _ENV_PFX_PASS, "-out", pfx}
+
+	var chain []byte
+	issuers := chainOf(cert, chainCerts())
+	for _, v := range issuers {
+		chain = append(chain, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: v.Cert.Raw})...)
+	}
+	if service == SERVICE_DC {
+		if len(issuers) == 0 {
+			log.Fatalf("CA certificate not found of %q", name)
+		}
+		for _, v := range []struct {
+			env, name string
+			cert      *x509.Certificate
+		}{
+			{_ENV_ISSUER_FILE, "issuer", issuers[0].Cert},
+			{_ENV_ROOT_FILE, "root", issuers[len(issuers)-1].Cert},
+		} {
+			file := filepath.Join(dir, v.name+EXT_CERT)
+			if err = os.WriteFile(file, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: v.cert.Raw}), 0600); err != nil {
+				log.Fatal(err)
+			}
+			os.Setenv(v.env, file)
+		}
+	}
+	if len(chain) != 0 {
+		chainFile := filepath.Join(dir, "chain"+EXT_CERT)
+		if err = os.WriteFile(chainFile, chain, 0600); err != nil {
+			log.Fatal(err)
+		}
+		args = append(args, "-certfile", chainFile)
+	}
+	openssl(args...)
+
+	// The bundle is removed before of exiting on error.
+	err = runPowerShell(script)
+	os.RemoveAll(dir)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	fmt.Printf("\n== Bound\n")
+	switch service {
+	case SERVICE_IIS:
+		fmt.Printf("- IIS site:\t%q (port %d)\n", site, port)
+	case SERVICE_WINRM:
+		fmt.Printf("- WinRM:\tHTTPS listener\n")
+	case SERVICE_DC:
+		fmt.Printf("- Domain controller:\tLDAPS and PKINIT\n")
+	}
+	fmt.Printf("- Thumbprint:\t%s\n", thumbprint)
+}
+
+// certThumbprint returns the thumbprint of the certificate like Windows: the
+// SHA-1 hash in hexadecimal, in capital letters.
+func certThumbprint(cert *x509.Certificate) string {
+	return fmt.Sprintf("%X", sha1.Sum(cert.Raw))
+}
+
+// winrmHostName returns the host name of the listener of WinRM, which has to
+// match the certificate: the first DNS name, or else the common name.
+func winrmHostName(cert *x509.Certificate) string {
+	if len(cert.DNSNames) != 0 {
+		return cert.DNSNames[0]
+	}
+	return cert.Subject.CommonName
+}
+
+// iisScript returns the script which imports the certificate and binds it to
+// HTTPS of the IIS site, creating the binding whether it does not exist. A
+// certificate bound before, like the one renewed, is replaced.
+func iisScript(site string, port int, thumbprint string) string {
+	binding := fmt.Sprintf("Get-WebBinding -Name %s -Protocol https -Port %d", psQuote(site), port)
+
+	return _PS_IMPORT + fmt.Sprintf(`Import-Module WebAdministration
+if (-not (%s)) {
+	New-WebBinding -Name %s -Protocol https -Port %d
+}
+(%s).AddSslCertificate(%s, 'My')
+`, binding, psQuote(site), port, binding, psQuote(thumbprint))
+}
+
+// winrmScript returns the script which imports the certificate and creates the
+// HTTPS listener of WinRM with it, replacing the one which exists.
+func winrmScript(hostName, thumbprint string) string {
+	return _PS_IMPORT + fmt.Sprintf(`Get-ChildItem WSMan:\localhost\Listener | Where-Object { $_.Keys -contains 'Transport=HTTPS' } | Remove-Item -Recurse -Force
+New-Item -Path WSMan:\localhost\Listener -Transport HTTPS -Address * -HostName %s -CertificateThumbPrint %s -Force | Out-Null
+`, psQuote(hostName), psQuote(thumbprint))
+}
+
+// dcScript returns the script which imports the certificate of the domain
+// controller, trusts its root CA and adds its issuer to the store NTAuth of the
+// machine, required by PKINIT; then Active Directory is notified to load the
+// certificate for LDAPS, without restarting.
+func dcScript() string {
+	return _PS_IMPORT + `Import-Certificate -FilePath $env:` + _ENV_ROOT_FILE + ` -CertStoreLocation Cert:\LocalMachine\Root | Out-Null
+certutil -enterprise -f -addstore NTAuth $env:` + _ENV_ISSUER_FILE + ` | Out-Null
+if ($LASTEXITCODE -ne 0) { throw "certutil: the issuer was not added to NTAuth" }
+$rootDSE = [ADSI]'LDAP://localhost/RootDSE'
+$rootDSE.Put('renewServerCertificate', 1)
+$rootDSE.SetInfo()
+`
+}
+
+// psQuote returns the string quoted for PowerShell, where the single quotes
+// are escaped by doubling them.
+func psQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", "''") + "'"
+}
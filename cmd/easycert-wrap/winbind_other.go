@@ -0,0 +1,16 @@
+// Copyright 2014 Jonas mg
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+//go:build !windows
+
+package main
+
+import "errors"
+
+// runPowerShell fails since IIS and WinRM are only available in Windows.
+func runPowerShell(script string) error {
+	return errors.New("the binding to IIS and WinRM is only supported in Windows")
+}
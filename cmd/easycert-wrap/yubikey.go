@@ -0,0 +1,217 @@
+// Copyright 2014 Jonas mg
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+// Private key of the root CA in a slot PIV of a YubiKey: it is generated by
+// "ykman" into the YubiKey, and OpenSSL signs with it through PKCS#11, so it is
+// never written in the private directory.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+const (
+	CMD_YKMAN   = "ykman"
+	EXT_YUBIKEY = ".yubikey"
+
+	// ENV_YUBIKEY_PIN is the environment variable with the PIN of the
+	// YubiKey, used to sign without prompting.
+	ENV_YUBIKEY_PIN = "EASYCERT_YUBIKEY_PIN"
+
+	// ENV_PKCS11_MODULE is the environment variable of the provider "pkcs11"
+	// of OpenSSL with the PKCS#11 module.
+	ENV_PKCS11_MODULE = "PKCS11_PROVIDER_MODULE"
+
+	// DEFAULT_PKCS11_MODULE is the PKCS#11 module of the YubiKeys, from
+	// yubico-piv-tool.
+	DEFAULT_PKCS11_MODULE = "libykcs11.so"
+)
+
+var errYubiKeyNative = errors.New("the native backend can not sign with the CA's private key in a YubiKey")
+
+var (
+	IsYubiKey = flag.Bool("yubikey", false, "generate the CA's private key in a YubiKey")
+	PIVSlot   = flag.String("slot", "9c", "slot PIV of the YubiKey: 9a, 9c, 9d or 9e")
+)
+
+// pivSlots maps the slots PIV to the IDs of their keys in the PKCS#11 module.
+var pivSlots = map[string]string{"9a": "01", "9c": "02", "9d": "03", "9e": "04"}
+
+// yubiKeyCA represents the CA's private key in a YubiKey. It is stored in the
+// private directory, in place of the key.
+type yubiKeyCA struct {
+	Serial string `json:"serial"`
+	Slot   string `json:"slot"`
+	Module string `json:"module"` // PKCS#11
+}
+
+// yubiKeyFile returns the file of the YubiKey of the root CA.
+func yubiKeyFile() string {
+	return filepath.Join(Dir.Key, NAME_CA+EXT_YUBIKEY)
+}
+
+// loadYubiKey returns the YubiKey with the private key of the CA in use, or nil
+// whether it is in a file, like the ones of the intermediate CAs.
+func loadYubiKey() *yubiKeyCA {
+	if issuerCA != NAME_CA {
+		return nil
+	}
+	data, err := os.ReadFile(yubiKeyFile())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		fatal(err)
+	}
+	y := new(yubiKeyCA)
+	if err = json.Unmarshal(data, y); err != nil {
+		fatalf("%s: %s", yubiKeyFile(), err)
+	}
+	if _, ok := pivSlots[y.Slot]; !ok {
+		fatalf("%s: invalid slot: %q", yubiKeyFile(), y.Slot)
+	}
+	return y
+}
+
+// uri returns the PKCS#11 URI of the private key (RFC 7512), in the token of
+// the YubiKey with the serial number.
+func (y *yubiKeyCA) uri() string {
+	return "pkcs11:token=YubiKey%20PIV%20%23" + y.Serial + ";id=%" + pivSlots[y.Slot] + ";type=private"
+}
+
+// caKeyArgs returns the OpenSSL's options to sign with the CA's private key:
+// the option `opt` with the key `file`, unless it is empty because the key is
+// the one of the configuration, and the passphrase like in caPassArgs.
+//
+// With the key in a YubiKey, `opt` is its PKCS#11 URI, loaded by the provider
+// "pkcs11", and the PIN is got from the environment variable ENV_YUBIKEY_PIN
+// whether it is set, else it is prompted at every signing.
+func caKeyArgs(opt, file string) []string {
+	y := loadYubiKey()
+	if y == nil {
+		var args []string
+		if file != "" {
+			args = []string{opt, file}
+		}
+		return append(args, caPassArgs("-passin")...)
+	}
+
+	if os.Getenv(ENV_PKCS11_MODULE) == "" {
+		os.Setenv(ENV_PKCS11_MODULE, y.Module)
+	}
+	args := []string{"-provider", "pkcs11", "-provider", "default", opt, y.uri()}
+	if os.Getenv(ENV_YUBIKEY_PIN) == "" {
+		if batchMode() {
+			fatalf("Batch mode: the PIN of the YubiKey has to be set in %s", ENV_YUBIKEY_PIN)
+		}
+		return args
+	}
+	return append(args, "-passin", "env:"+ENV_YUBIKEY_PIN)
+}
+
+// checkYubiKey checks the flags to generate the CA's private key in a YubiKey.
+func checkYubiKey() error {
+	if !*IsYubiKey {
+		return nil
+	}
+	if *Intermediate != "" {
+		return errors.New("Flag -yubikey is only used by the root CA")
+	}
+	if nativeBackend() {
+		return errYubiKeyNative
+	}
+	if _, ok := pivSlots[*PIVSlot]; !ok {
+		return fmt.Errorf("Invalid slot PIV: %q; it has to be 9a, 9c, 9d or 9e", *PIVSlot)
+	}
+	_, err := ykmanAlgorithm(&KeySpec)
+	return err
+}
+
+// ykmanAlgorithm returns the algorithm of "ykman" of the key.
+func ykmanAlgorithm(k *keySpec) (string, error) {
+	if k.Type == KEY_TYPE_ECDSA {
+		switch k.Curve {
+		case "p256":
+			return "ECCP256", nil
+		case "p384":
+			return "ECCP384", nil
+		}
+		return "", fmt.Errorf("The YubiKey does not support the curve %q", k.Curve)
+	}
+	if k.RSASize > 4096 {
+		return "", fmt.Errorf("The YubiKey does not support RSA keys of %d bits", k.RSASize)
+	}
+	return "RSA" + strconv.Itoa(k.RSASize), nil
+}
+
+// newYubiKeyCA generates the CA's private key into the YubiKey, which is
+// recorded in the issuance `tx`, and writes the self-signed certificate of the
+// CA in `certFile` with the configuration `config`.
+func newYubiKeyCA(tx *issuance, config, certFile string) {
+	serials := strings.Fields(string(execCmd(nil, CMD_YKMAN, "list", "--serials")))
+	if len(serials) != 1 {
+		fatalf("It has to be connected one YubiKey, found %d", len(serials))
+	}
+	algorithm, err := ykmanAlgorithm(&KeySpec)
+	if err != nil {
+		fatal(err)
+	}
+	module := os.Getenv(ENV_PKCS11_MODULE)
+	if module == "" {
+		module = DEFAULT_PKCS11_MODULE
+	}
+	y := &yubiKeyCA{Serial: serials[0], Slot: *PIVSlot, Module: module}
+
+	data, err := json.MarshalIndent(y, "", "\t")
+	if err != nil {
+		fatal(err)
+	}
+	if err = writeFileAtomic(yubiKeyFile(), append(data, '\n'), 0644); err != nil {
+		fatal(err)
+	}
+	tx.addFile(yubiKeyFile())
+
+	pubFile := mustTempFile(File.Key)
+	defer os.Remove(pubFile)
+	ykman := []string{"--device", y.Serial, "piv"}
+
+	// The PIN is required at every signing. The temporary certificate makes
+	// the key visible through PKCS#11 until the one of the CA is imported.
+	fmt.Printf("%s", execCmd(os.Stdin, CMD_YKMAN, append(ykman, "keys", "generate",
+		"--algorithm", algorithm, "--pin-policy", "ALWAYS", y.Slot, pubFile)...))
+	fmt.Printf("%s", execCmd(os.Stdin, CMD_YKMAN, append(ykman, "certificates", "generate",
+		"--subject", "CN=easycert", y.Slot, pubFile)...))
+
+	opensslArgs := []string{"req", "-new", "-config", config, "-out", File.Request}
+	opensslArgs = append(opensslArgs, caKeyArgs("-key", "")...)
+	opensslArgs = append(opensslArgs, fipsDigestArgs("req")...)
+	if batchMode() {
+		opensslArgs = append(opensslArgs, "-batch", "-subj", caBatchSubject())
+	}
+	fmt.Printf("%s", openssl(opensslArgs...))
+
+	fmt.Print("\n== Sign\n\n")
+
+	opensslArgs = []string{"ca", "-selfsign", "-batch", "-create_serial",
+		"-config", config, "-in", File.Request, "-out", certFile,
+		"-days", strconv.Itoa(365 * *Years),
+		"-extensions", "v3_ca",
+	}
+	opensslArgs = append(opensslArgs, caKeyArgs("-keyfile", "")...)
+	opensslArgs = append(opensslArgs, fipsDigestArgs("ca")...)
+	fmt.Printf("%s", openssl(opensslArgs...))
+
+	fmt.Printf("%s", execCmd(os.Stdin, CMD_YKMAN, append(ykman, "certificates", "import",
+		y.Slot, certFile)...))
+}
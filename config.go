@@ -6,54 +6,72 @@
 
 package easycert
 
-import "os"
-
-// Title for the common elements of a distinguished name (DN).
-var (
-	Country            = "Country Name (2 letter code)"
-	Organization       = "Organization Name (eg, company)"
-	OrganizationalUnit = "Organizational Unit Name (eg, section)"
-
-	Locality = "Locality Name (eg, city)"
-	Province = "Province Name (eg, state in USA)"
+import (
+	"crypto/x509"
+	"time"
+)
 
-	StreetAddress = "Street Address"
-	PostalCode    = "Postal Code"
+// Name represents the common elements of a distinguished name (DN).
+type Name struct {
+	Country            string // Country Name (2 letter code)
+	Province           string // Province Name (eg, state in USA)
+	Locality           string // Locality Name (eg, city)
+	Organization       string // Organization Name (eg, company)
+	OrganizationalUnit string // Organizational Unit Name (eg, section)
+	CommonName         string // Common Name (e.g. server FQDN or YOUR name)
+}
 
-	CommonName = "Common Name (e.g. server FQDN or YOUR name)"
+// Default validity of the certificates.
+const (
+	DEFAULT_CA_DAYS   = 3650
+	DEFAULT_CERT_DAYS = 365
 )
 
-type CertAuth struct {
-	KeyUsage    []string
-	ExtKeyUsage []string
+// CAOptions are the options to create a CA.
+type CAOptions struct {
+	Key  *KeyOptions // Key to generate; the default one whether it is nil.
+	Days int         // Validity; DEFAULT_CA_DAYS whether it is zero.
 
-	BasicConstraintsValid bool
-	IsCA                  bool
+	// Passphrase to encrypt the CA's private key; it is required.
+	Passphrase string
 }
 
-type config struct {
-	ca CertAuth
-}
+// RequestOptions are the options to create a certificate request.
+type RequestOptions struct {
+	// Subject of the request; the name of the request is used like common
+	// name whether it is empty.
+	Subject Name
+
+	// Host names and IP addresses the certificate is valid for.
+	Hosts []string
 
-// check checks that the configuration is correct.
-func (cfg config) check() error {
-	return nil
+	Key *KeyOptions // Key to generate; the default one whether it is nil.
 }
 
-func t() error {
-	var cfg config
+// SignOptions are the options to sign a certificate request.
+type SignOptions struct {
+	Days     int       // Validity; DEFAULT_CERT_DAYS whether it is zero.
+	NotAfter time.Time // End of the validity, instead of Days whether it is set.
 
-	configData, err := os.ReadFile("data/easycert.yaml")
-	if err != nil {
-		return err
-	}
+	// Subject in DER, instead of the one of the request under the policy
+	// "policy_anything" whether it is nil.
+	Subject []byte
 
-	if err = goyaml.Unmarshal(configData, &cfg); err != nil {
-		return
-	}
-	if err = cfg.check(); err != nil {
-		return err
-	}
+	// Usages of the key. Whether they are not set, the certificate is for a
+	// TLS server and client.
+	KeyUsage    x509.KeyUsage
+	ExtKeyUsage []x509.ExtKeyUsage
 
-	return nil
+	// Template has the extensions of the certificate, like the subject
+	// alternative names and the usages of the key, instead of the ones of the
+	// request and the options whether it is not nil. Its serial number,
+	// subject, validity, keys and basic constraints are set by Sign.
+	Template *x509.Certificate
+}
+
+func (o *SignOptions) days() int {
+	if o.Days == 0 {
+		return DEFAULT_CERT_DAYS
+	}
+	return o.Days
 }
@@ -0,0 +1,112 @@
+// Copyright 2014 Jonas mg
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+// Package easycert handles a certificates directory of EasyCert from Go,
+// without OpenSSL: it creates the CA, the certificate requests and the
+// certificates signed by the CA, and gets their information.
+//
+// The layout and the database are the ones of the command easycert-wrap, so a
+// directory can be handled by both. The functions return the errors, instead
+// of exiting like the command.
+//
+//	s, err := easycert.Init(store.Dir("/srv/pki"))
+//	ca, err := s.CreateCA(easycert.Name{Organization: "Acme"}, &easycert.CAOptions{Passphrase: pass})
+//	req, err := s.NewRequest("web", &easycert.RequestOptions{Hosts: []string{"www.acme.com"}})
+//	cert, err := ca.Sign(req, nil)
+package easycert
+
+import (
+	"crypto"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/fs"
+	"strings"
+
+	"github.com/tredoe/easycert/store"
+)
+
+// FILE_CRLNUMBER has the number of the next revocation list.
+const FILE_CRLNUMBER = "crlnumber"
+
+// Store represents a certificates directory.
+type Store struct {
+	fs store.Store
+}
+
+// Open returns the certificates directory stored in `fsys`, which has to be
+// initialized.
+func Open(fsys store.Store) (*Store, error) {
+	if _, err := fs.Stat(fsys, store.FILE_INDEX); err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, errors.New("certificates directory not initialized")
+		}
+		return nil, err
+	}
+	return &Store{fs: fsys}, nil
+}
+
+// Init initializes the database of a new certificates directory into `fsys`.
+func Init(fsys store.Store) (*Store, error) {
+	if _, err := fs.Stat(fsys, store.FILE_INDEX); err == nil {
+		return nil, errors.New("certificates directory already initialized")
+	}
+
+	for _, v := range []struct {
+		name string
+		data string
+	}{
+		{store.FILE_SERIAL, "01\n"},
+		{FILE_CRLNUMBER, "01\n"},
+		{store.FILE_INDEX, ""}, // the last one, since Open checks it
+	} {
+		if err := fsys.WriteFile(v.name, []byte(v.data), 0644); err != nil {
+			return nil, err
+		}
+	}
+	return &Store{fs: fsys}, nil
+}
+
+// FS returns the storage of the certificates directory, to use it with the
+// package store.
+func (s *Store) FS() store.Store { return s.fs }
+
+// Cert returns the certificate `name`.
+func (s *Store) Cert(name string) (*x509.Certificate, error) {
+	return store.ReadCert(s.fs, name)
+}
+
+// Key returns the private key `name`, decrypted with the passphrase whether it
+// is encrypted.
+func (s *Store) Key(name, pass string) (crypto.Signer, error) {
+	data, err := fs.ReadFile(s.fs, store.KeyFile(name))
+	if err != nil {
+		return nil, err
+	}
+	key, err := ParseKey(data, pass)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", store.KeyFile(name), err)
+	}
+	return key, nil
+}
+
+// writeKey writes the private key `name`, encrypted whether the passphrase is
+// not empty.
+func (s *Store) writeKey(name string, key crypto.Signer, pass string) error {
+	data, err := MarshalKey(key, pass)
+	if err != nil {
+		return err
+	}
+	return s.fs.WriteFile(store.KeyFile(name), data, 0600)
+}
+
+// checkName checks that the name is valid for the files of a certificate.
+func checkName(name string) error {
+	if name == "" || !fs.ValidPath(name) || strings.ContainsAny(name, "/\\") {
+		return fmt.Errorf("invalid name: %q", name)
+	}
+	return nil
+}
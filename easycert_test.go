@@ -0,0 +1,183 @@
+// Copyright 2014 Jonas mg
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package easycert
+
+import (
+	"crypto/x509"
+	"io/fs"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/tredoe/easycert/store"
+)
+
+const testPass = "ca secret"
+
+func TestStore(t *testing.T) {
+	fsys := store.NewMem()
+	if _, err := Open(fsys); err == nil {
+		t.Fatal("open without init: got no error")
+	}
+	s, err := Init(fsys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = Init(fsys); err == nil {
+		t.Error("init twice: got no error")
+	}
+	if s, err = Open(fsys); err != nil {
+		t.Fatal(err)
+	}
+
+	// CA
+
+	ca, err := s.CreateCA(Name{Country: "ES", Organization: "Acme"}, &CAOptions{
+		Key: &KeyOptions{Type: KEY_ECDSA}, Passphrase: testPass,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ca.Cert.Subject.CommonName != "Acme CA" || !ca.Cert.IsCA {
+		t.Errorf("CA: got %q, IsCA %v", ca.Cert.Subject.CommonName, ca.Cert.IsCA)
+	}
+	if _, err = s.CreateCA(Name{}, &CAOptions{Passphrase: testPass}); err == nil {
+		t.Error("CA twice: got no error")
+	}
+	if _, err = s.LoadCA("wrong"); err == nil {
+		t.Error("CA with wrong passphrase: got no error")
+	}
+	if ca, err = s.LoadCA(testPass); err != nil {
+		t.Fatal(err)
+	}
+
+	// Request and certificate
+
+	req, err := s.NewRequest("web", &RequestOptions{
+		Subject: Name{Country: "ES", Locality: "Madrid", Organization: "Acme"},
+		Hosts:   []string{"www.example.com", "127.0.0.1"},
+		Key:     &KeyOptions{Type: KEY_ECDSA},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if req, err = s.Request("web"); err != nil {
+		t.Fatal(err)
+	}
+	cert, err := ca.Sign(req, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cert.ExtKeyUsage) != 2 || cert.ExtKeyUsage[0] != x509.ExtKeyUsageServerAuth {
+		t.Errorf("extended key usage: got %v", cert.ExtKeyUsage)
+	}
+	if _, err = ca.Sign(req, nil); err == nil || !strings.Contains(err.Error(), "already a certificate") {
+		t.Errorf("sign twice: got %v", err)
+	}
+	if err = s.Check("web"); err != nil {
+		t.Error(err)
+	}
+
+	info, err := s.Info("web")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Subject != "C = ES, L = Madrid, O = Acme, CN = web" || info.Issuer != "C = ES, O = Acme, CN = Acme CA" {
+		t.Errorf("info: got subject %q, issuer %q", info.Subject, info.Issuer)
+	}
+	if info.Serial != "02" || info.Status != STATUS_VALID {
+		t.Errorf("info: got serial %q, status %q", info.Serial, info.Status)
+	}
+	if strings.Join(info.Hosts, ",") != "www.example.com,127.0.0.1" {
+		t.Errorf("info: got hosts %q", info.Hosts)
+	}
+
+	// Database, like OpenSSL.
+
+	index, err := fs.ReadFile(fsys, store.FILE_INDEX)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(index)), "\n")
+	if len(lines) != 2 || !strings.HasSuffix(lines[1], "\t02\tunknown\t/C=ES/L=Madrid/O=Acme/CN=web") {
+		t.Errorf("index: got %q", index)
+	}
+	if serial, _ := fs.ReadFile(fsys, store.FILE_SERIAL); string(serial) != "03\n" {
+		t.Errorf("serial: got %q", serial)
+	}
+	if _, err = fs.Stat(fsys, "newcerts/02.pem"); err != nil {
+		t.Error(err)
+	}
+
+	// Private key which does not match.
+
+	if _, err = s.NewRequest("api", nil); err != nil {
+		t.Fatal(err)
+	}
+	key, _ := fs.ReadFile(fsys, store.KeyFile("api"))
+	if err = fsys.WriteFile(store.KeyFile("web"), key, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err = s.Check("web"); err == nil {
+		t.Error("check with other key: got no error")
+	}
+}
+
+func TestSigner(t *testing.T) {
+	s, err := Init(store.NewMem())
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := GenerateKey(&KeyOptions{Type: KEY_ECDSA})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = s.CreateCASigner(Name{Organization: "Acme"}, key, 0); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = s.Key(store.NAME_CA, ""); err == nil {
+		t.Error("CA with signer: got the private key in the store")
+	}
+	other, _ := GenerateKey(&KeyOptions{Type: KEY_ECDSA})
+	if _, err = s.LoadCASigner(other); err == nil {
+		t.Error("CA with other signer: got no error")
+	}
+	ca, err := s.LoadCASigner(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The subject, the validity and the extensions of the options.
+
+	req, err := s.NewRequest("release", &RequestOptions{Hosts: []string{"www.example.com"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	subject, err := (&Name{CommonName: "Release"}).Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	notAfter := time.Now().AddDate(0, 1, 0).UTC().Truncate(time.Second)
+	cert, err := ca.Sign(req, &SignOptions{
+		Subject:  subject,
+		NotAfter: notAfter,
+		Template: &x509.Certificate{
+			KeyUsage:    x509.KeyUsageDigitalSignature,
+			ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageCodeSigning},
+			IsCA:        true,
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cert.Subject.CommonName != "Release" || !cert.NotAfter.Equal(notAfter) || cert.IsCA {
+		t.Errorf("got subject %q, NotAfter %v, IsCA %v", cert.Subject.CommonName, cert.NotAfter, cert.IsCA)
+	}
+	if len(cert.DNSNames) != 0 || len(cert.ExtKeyUsage) != 1 || cert.ExtKeyUsage[0] != x509.ExtKeyUsageCodeSigning {
+		t.Errorf("got hosts %q, extended key usage %v", cert.DNSNames, cert.ExtKeyUsage)
+	}
+}
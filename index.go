@@ -0,0 +1,186 @@
+// Copyright 2014 Jonas mg
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+// Database of OpenSSL ("index.txt"), with the certificates issued by the CA.
+
+package easycert
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/fs"
+	"math/big"
+	"path"
+	"strings"
+
+	"github.com/tredoe/easycert/store"
+)
+
+// Status of the certificates in the database.
+const (
+	STATUS_VALID   = "V"
+	STATUS_REVOKED = "R"
+	STATUS_EXPIRED = "E"
+)
+
+// _INDEX_TIME is the format of the dates in the database.
+const _INDEX_TIME = "060102150405Z"
+
+// indexEntry is a line of the database, where the fields are separated by
+// tabs.
+type indexEntry struct {
+	Status     string
+	Expiry     string
+	Revocation string // Date and reason, separated by commas.
+	Serial     string // In hexadecimal.
+	File       string // Always "unknown".
+	Subject    string
+}
+
+// readIndex returns the entries of the database.
+func (s *Store) readIndex() ([]*indexEntry, error) {
+	data, err := fs.ReadFile(s.fs, store.FILE_INDEX)
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []*indexEntry
+	for i, line := range strings.Split(string(data), "\n") {
+		if line == "" {
+			continue
+		}
+		field := strings.SplitN(line, "\t", 6)
+		if len(field) != 6 {
+			return nil, fmt.Errorf("%s:%d: wrong number of fields", store.FILE_INDEX, i+1)
+		}
+		entries = append(entries, &indexEntry{
+			field[0], field[1], field[2], field[3], field[4], field[5],
+		})
+	}
+	return entries, nil
+}
+
+// writeIndex writes the entries to the database.
+func (s *Store) writeIndex(entries []*indexEntry) error {
+	var b strings.Builder
+
+	for _, v := range entries {
+		b.WriteString(strings.Join([]string{
+			v.Status, v.Expiry, v.Revocation, v.Serial, v.File, v.Subject,
+		}, "\t"))
+		b.WriteByte('\n')
+	}
+	return s.fs.WriteFile(store.FILE_INDEX, []byte(b.String()), 0644)
+}
+
+// readSerial returns the serial number for the next certificate.
+func (s *Store) readSerial() (*big.Int, error) {
+	data, err := fs.ReadFile(s.fs, store.FILE_SERIAL)
+	if err != nil {
+		return nil, err
+	}
+	serial, ok := new(big.Int).SetString(strings.TrimSpace(string(data)), 16)
+	if !ok {
+		return nil, fmt.Errorf("%s: wrong serial number", store.FILE_SERIAL)
+	}
+	return serial, nil
+}
+
+// checkUniqueSubject fails whether there is a valid certificate with the
+// subject, unless the database allows several ones ("unique_subject = no").
+func (s *Store) checkUniqueSubject(subject string) error {
+	attr, err := fs.ReadFile(s.fs, store.FILE_INDEX+".attr")
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	if strings.Contains(string(attr), "unique_subject = no") {
+		return nil
+	}
+
+	entries, err := s.readIndex()
+	if err != nil {
+		return err
+	}
+	for _, v := range entries {
+		if v.Status == STATUS_VALID && v.Subject == subject {
+			return fmt.Errorf("there is already a certificate for %s (serial %s)", subject, v.Serial)
+		}
+	}
+	return nil
+}
+
+// record writes the certificate `name` and records it in the database like
+// OpenSSL: the entry of the index, the copy into "newcerts" and the next
+// serial number.
+func (s *Store) record(der []byte, name string) (*x509.Certificate, error) {
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+	subject, err := NameOneline(cert.RawSubject)
+	if err != nil {
+		return nil, err
+	}
+	entries, err := s.readIndex()
+	if err != nil {
+		return nil, err
+	}
+
+	expiry := cert.NotAfter.UTC().Format(_INDEX_TIME)
+	if cert.NotAfter.UTC().Year() >= 2050 {
+		expiry = cert.NotAfter.UTC().Format("20" + _INDEX_TIME)
+	}
+	serial := SerialHex(cert.SerialNumber)
+	entries = append(entries, &indexEntry{
+		STATUS_VALID, expiry, "", serial, "unknown", subject,
+	})
+
+	data := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+
+	if err = s.fs.WriteFile(path.Join(store.DIR_NEWCERT, serial+".pem"), data, 0644); err != nil {
+		return nil, err
+	}
+	if err = s.writeIndex(entries); err != nil {
+		return nil, err
+	}
+	next := new(big.Int).Add(cert.SerialNumber, big.NewInt(1))
+	if err = s.fs.WriteFile(store.FILE_SERIAL, []byte(SerialHex(next)+"\n"), 0644); err != nil {
+		return nil, err
+	}
+	if err = s.fs.WriteFile(store.CertFile(name), data, 0644); err != nil {
+		return nil, err
+	}
+	return cert, nil
+}
+
+// status returns the status of the certificate in the database, or an empty
+// string whether it is not found.
+func (s *Store) status(cert *x509.Certificate) (string, error) {
+	entries, err := s.readIndex()
+	if err != nil {
+		return "", err
+	}
+	hex := SerialHex(cert.SerialNumber)
+
+	for _, v := range entries {
+		if strings.EqualFold(v.Serial, hex) {
+			return v.Status, nil
+		}
+	}
+	return "", nil
+}
+
+// SerialHex returns the serial number in hexadecimal like OpenSSL: in capital
+// letters, with an even number of digits.
+func SerialHex(n *big.Int) string {
+	s := fmt.Sprintf("%X", n)
+	if len(s)%2 != 0 {
+		s = "0" + s
+	}
+	return s
+}
@@ -0,0 +1,105 @@
+// Copyright 2014 Jonas mg
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package easycert
+
+import (
+	"crypto"
+	"errors"
+	"fmt"
+	"io/fs"
+	"time"
+
+	"github.com/tredoe/easycert/store"
+)
+
+// Info represents the information of a certificate, in the formats printed by
+// OpenSSL.
+type Info struct {
+	Subject   string // Like "C = ES, O = Acme, CN = web".
+	Issuer    string
+	Serial    string // In hexadecimal.
+	Hash      string // Hash of the subject, like "openssl x509 -hash".
+	NotBefore time.Time
+	NotAfter  time.Time
+	Hosts     []string // Host names and IP addresses.
+	IsCA      bool
+
+	// Status in the database (STATUS_VALID, STATUS_REVOKED or STATUS_EXPIRED),
+	// or empty whether the certificate was not issued by the CA.
+	Status string
+}
+
+// Info returns the information of the certificate `name`.
+func (s *Store) Info(name string) (*Info, error) {
+	cert, err := s.Cert(name)
+	if err != nil {
+		return nil, err
+	}
+	info := &Info{
+		Serial:    SerialHex(cert.SerialNumber),
+		NotBefore: cert.NotBefore,
+		NotAfter:  cert.NotAfter,
+		Hosts:     append([]string(nil), cert.DNSNames...),
+		IsCA:      cert.IsCA,
+	}
+	for _, v := range cert.IPAddresses {
+		info.Hosts = append(info.Hosts, v.String())
+	}
+
+	if info.Subject, err = NameString(cert.RawSubject); err != nil {
+		return nil, err
+	}
+	if info.Issuer, err = NameString(cert.RawIssuer); err != nil {
+		return nil, err
+	}
+	hash, err := NameHash(cert.RawSubject)
+	if err != nil {
+		return nil, err
+	}
+	info.Hash = fmt.Sprintf("%08x", hash)
+
+	if info.Status, err = s.status(cert); err != nil {
+		return nil, err
+	}
+	return info, nil
+}
+
+// Check checks the certificate `name`: that it is verified by the CA, that it
+// is not revoked, and that its private key, whether it is in the certificates
+// directory, matches the certificate.
+func (s *Store) Check(name string) error {
+	cert, err := s.Cert(name)
+	if err != nil {
+		return err
+	}
+	if _, err = store.Verify(s.fs, cert, store.VerifyOptions{}); err != nil {
+		return fmt.Errorf("%s: %s", name, err)
+	}
+
+	status, err := s.status(cert)
+	if err != nil {
+		return err
+	}
+	if status == STATUS_REVOKED {
+		return fmt.Errorf("%s: certificate revoked", name)
+	}
+
+	if name == store.NAME_CA {
+		return nil // its key is encrypted
+	}
+	key, err := s.Key(name, "")
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+		return err
+	}
+	if pub, ok := key.Public().(interface{ Equal(crypto.PublicKey) bool }); !ok || !pub.Equal(cert.PublicKey) {
+		return fmt.Errorf("%s: the private key does not match the certificate", name)
+	}
+	return nil
+}
@@ -0,0 +1,143 @@
+// Copyright 2014 Jonas mg
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package easycert
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/pem"
+	"errors"
+	"fmt"
+)
+
+// Types of key to generate.
+const (
+	KEY_RSA   = "rsa"
+	KEY_ECDSA = "ecdsa"
+)
+
+// Default key, like the one of the command easycert-wrap.
+const (
+	DEFAULT_KEY_TYPE = KEY_RSA
+	DEFAULT_RSA_SIZE = 2048
+)
+
+// KeyOptions represents the key to generate.
+type KeyOptions struct {
+	Type    string         // KEY_RSA or KEY_ECDSA; KEY_RSA whether it is empty.
+	RSASize int            // Size in bits of a RSA key; 2048 whether it is zero.
+	Curve   elliptic.Curve // Curve of an ECDSA key; P-256 whether it is nil.
+}
+
+// GenerateKey generates a private key with the options, or with the default
+// ones whether `opts` is nil.
+func GenerateKey(opts *KeyOptions) (crypto.Signer, error) {
+	if opts == nil {
+		opts = &KeyOptions{}
+	}
+
+	switch opts.Type {
+	case KEY_RSA, "":
+		size := opts.RSASize
+		if size == 0 {
+			size = DEFAULT_RSA_SIZE
+		}
+		if size < 2048 || size%1024 != 0 {
+			return nil, fmt.Errorf("invalid size of RSA key: %d", size)
+		}
+		return rsa.GenerateKey(rand.Reader, size)
+	case KEY_ECDSA:
+		curve := opts.Curve
+		if curve == nil {
+			curve = elliptic.P256()
+		}
+		return ecdsa.GenerateKey(curve, rand.Reader)
+	}
+	return nil, fmt.Errorf("invalid key type %q: it has to be %q or %q", opts.Type, KEY_RSA, KEY_ECDSA)
+}
+
+// KeyID returns the identifier of the public key like OpenSSL: the SHA-1 of
+// the bits of the key.
+func KeyID(pub crypto.PublicKey) ([]byte, error) {
+	der, err := x509.MarshalPKIXPublicKey(pub)
+	if err != nil {
+		return nil, err
+	}
+	var spki struct {
+		Algorithm pkix.AlgorithmIdentifier
+		PublicKey asn1.BitString
+	}
+	if _, err = asn1.Unmarshal(der, &spki); err != nil {
+		return nil, err
+	}
+	sum := sha1.Sum(spki.PublicKey.Bytes)
+	return sum[:], nil
+}
+
+// MarshalKey returns the private key in PKCS#8 and PEM format, encrypted
+// whether the passphrase is not empty.
+func MarshalKey(key crypto.Signer, pass string) ([]byte, error) {
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	block := &pem.Block{Type: "PRIVATE KEY", Bytes: der}
+
+	if pass != "" {
+		if block.Bytes, err = EncryptPKCS8(der, pass); err != nil {
+			return nil, err
+		}
+		block.Type = PEM_ENCRYPTED_KEY
+	}
+	return pem.EncodeToMemory(block), nil
+}
+
+// ParseKey returns the private key in PEM format, decrypted with the
+// passphrase whether it is encrypted in PKCS#8.
+func ParseKey(data []byte, pass string) (crypto.Signer, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("no private key in PEM format")
+	}
+
+	var err error
+	der := block.Bytes
+	switch block.Type {
+	case PEM_ENCRYPTED_KEY:
+		if der, err = DecryptPKCS8(der, pass); err != nil {
+			return nil, err
+		}
+		fallthrough
+	case "PRIVATE KEY":
+		key, err := x509.ParsePKCS8PrivateKey(der)
+		if err != nil {
+			return nil, err
+		}
+		if signer, ok := key.(crypto.Signer); ok {
+			return signer, nil
+		}
+		return nil, fmt.Errorf("private key of type not supported: %T", key)
+	case "RSA PRIVATE KEY":
+		if _, ok := block.Headers["Proc-Type"]; ok {
+			return nil, errors.New("private key encrypted in the legacy format of OpenSSL")
+		}
+		return x509.ParsePKCS1PrivateKey(der)
+	case "EC PRIVATE KEY":
+		if _, ok := block.Headers["Proc-Type"]; ok {
+			return nil, errors.New("private key encrypted in the legacy format of OpenSSL")
+		}
+		return x509.ParseECPrivateKey(der)
+	}
+	return nil, fmt.Errorf("private key in format not supported: %s", block.Type)
+}
@@ -0,0 +1,338 @@
+// Copyright 2014 Jonas mg
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+// Distinguished names in the formats of OpenSSL, so the certificates are
+// handled like the ones created by "openssl ca".
+
+package easycert
+
+import (
+	"crypto/sha1"
+	"encoding/asn1"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strings"
+	"unicode/utf16"
+)
+
+// nameAttr is an attribute of a distinguished name, whose value keeps the
+// type of string.
+type nameAttr struct {
+	Type  asn1.ObjectIdentifier
+	Value asn1.RawValue
+}
+
+// rdnSET is a relative distinguished name.
+type rdnSET []nameAttr
+
+// Short names of the attributes, like OpenSSL.
+var nameAttrs = []struct {
+	oid   asn1.ObjectIdentifier
+	short string
+}{
+	{asn1.ObjectIdentifier{2, 5, 4, 6}, "C"},
+	{asn1.ObjectIdentifier{2, 5, 4, 8}, "ST"},
+	{asn1.ObjectIdentifier{2, 5, 4, 7}, "L"},
+	{asn1.ObjectIdentifier{2, 5, 4, 10}, "O"},
+	{asn1.ObjectIdentifier{2, 5, 4, 11}, "OU"},
+	{asn1.ObjectIdentifier{2, 5, 4, 3}, "CN"},
+	{asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 1}, "emailAddress"},
+	{asn1.ObjectIdentifier{2, 5, 4, 5}, "serialNumber"},
+	{asn1.ObjectIdentifier{2, 5, 4, 9}, "street"},
+	{asn1.ObjectIdentifier{2, 5, 4, 17}, "postalCode"},
+	{asn1.ObjectIdentifier{2, 5, 4, 12}, "title"},
+	{asn1.ObjectIdentifier{2, 5, 4, 4}, "SN"},
+	{asn1.ObjectIdentifier{2, 5, 4, 42}, "GN"},
+	{asn1.ObjectIdentifier{0, 9, 2342, 19200300, 100, 1, 25}, "DC"},
+	{asn1.ObjectIdentifier{0, 9, 2342, 19200300, 100, 1, 1}, "UID"},
+}
+
+// _POLICY_ATTRS is the number of attributes of the policy "policy_anything",
+// the first ones of nameAttrs, which are the only ones kept in the subject of
+// the certificates signed.
+const _POLICY_ATTRS = 7
+
+// shortName returns the short name of the attribute, or its OID.
+func shortName(oid asn1.ObjectIdentifier) string {
+	for _, v := range nameAttrs {
+		if v.oid.Equal(oid) {
+			return v.short
+		}
+	}
+	return oid.String()
+}
+
+// parseName returns the relative distinguished names of a name in DER format.
+func parseName(der []byte) ([]rdnSET, error) {
+	var name []rdnSET
+	rest, err := asn1.Unmarshal(der, &name)
+	if err != nil {
+		return nil, err
+	}
+	if len(rest) != 0 {
+		return nil, errors.New("trailing data after the name")
+	}
+	return name, nil
+}
+
+// attrText returns the text of the value of an attribute, and whether it is a
+// string converted to canonical form by OpenSSL.
+func attrText(v asn1.RawValue) (text string, canon bool, ok bool) {
+	if v.Class != asn1.ClassUniversal {
+		return "", false, false
+	}
+	switch v.Tag {
+	case asn1.TagUTF8String, asn1.TagPrintableString, asn1.TagIA5String, 26: // VisibleString
+		return string(v.Bytes), true, true
+	case asn1.TagNumericString:
+		return string(v.Bytes), false, true
+	case asn1.TagT61String:
+		r := make([]rune, len(v.Bytes))
+		for i, b := range v.Bytes {
+			r[i] = rune(b)
+		}
+		return string(r), true, true
+	case asn1.TagBMPString:
+		if len(v.Bytes)%2 != 0 {
+			return "", false, false
+		}
+		u := make([]uint16, len(v.Bytes)/2)
+		for i := range u {
+			u[i] = binary.BigEndian.Uint16(v.Bytes[2*i:])
+		}
+		return string(utf16.Decode(u)), true, true
+	case 28: // UniversalString
+		if len(v.Bytes)%4 != 0 {
+			return "", false, false
+		}
+		r := make([]rune, len(v.Bytes)/4)
+		for i := range r {
+			r[i] = rune(binary.BigEndian.Uint32(v.Bytes[4*i:]))
+		}
+		return string(r), true, true
+	}
+	return "", false, false
+}
+
+// NameString returns the name in the format printed by OpenSSL, like
+// "C = ES, O = Acme, CN = web".
+func NameString(der []byte) (string, error) {
+	name, err := parseName(der)
+	if err != nil {
+		return "", err
+	}
+	var b strings.Builder
+
+	for i, rdn := range name {
+		if i != 0 {
+			b.WriteString(", ")
+		}
+		for j, attr := range rdn {
+			if j != 0 {
+				b.WriteString(" + ")
+			}
+			b.WriteString(shortName(attr.Type) + " = ")
+
+			text, _, ok := attrText(attr.Value)
+			if !ok {
+				fmt.Fprintf(&b, "#%X", attr.Value.FullBytes)
+				continue
+			}
+			b.WriteString(escapeValue(text))
+		}
+	}
+	return b.String(), nil
+}
+
+// escapeValue escapes the value of an attribute like OpenSSL: it is quoted
+// whether it has special characters, and the control characters and the bytes
+// out of ASCII are given in hexadecimal.
+func escapeValue(s string) string {
+	quote := strings.ContainsAny(s, `,+"\<>;`)
+	var b strings.Builder
+
+	if quote {
+		b.WriteByte('"')
+	}
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+
+		switch {
+		case c < 0x20 || c >= 0x7f:
+			fmt.Fprintf(&b, `\%02X`, c)
+		case c == '"' || c == '\\':
+			b.WriteByte('\\')
+			b.WriteByte(c)
+		case !quote && strings.IndexByte(`,+<>;`, c) != -1,
+			!quote && i == 0 && (c == '#' || c == ' '),
+			!quote && i == len(s)-1 && c == ' ':
+			b.WriteByte('\\')
+			b.WriteByte(c)
+		default:
+			b.WriteByte(c)
+		}
+	}
+	if quote {
+		b.WriteByte('"')
+	}
+	return b.String()
+}
+
+// NameOneline returns the name in the format of the database of OpenSSL, like
+// "/C=ES/O=Acme/CN=web".
+func NameOneline(der []byte) (string, error) {
+	name, err := parseName(der)
+	if err != nil {
+		return "", err
+	}
+	var b strings.Builder
+
+	for _, rdn := range name {
+		for _, attr := range rdn {
+			b.WriteString("/" + shortName(attr.Type) + "=")
+
+			text, _, ok := attrText(attr.Value)
+			if !ok {
+				fmt.Fprintf(&b, "#%X", attr.Value.FullBytes)
+				continue
+			}
+			for i := 0; i < len(text); i++ {
+				if c := text[i]; c < 0x20 || c >= 0x7f {
+					fmt.Fprintf(&b, `\x%02X`, c)
+				} else {
+					b.WriteByte(c)
+				}
+			}
+		}
+	}
+	return b.String(), nil
+}
+
+// NameSubj returns the name in the format of the option "-subj" of OpenSSL,
+// like "/C=ES/O=Acme/CN=web", where the attributes of a multi-valued RDN are
+// joined by "+", and the special characters are escaped by backslash.
+func NameSubj(der []byte) (string, error) {
+	name, err := parseName(der)
+	if err != nil {
+		return "", err
+	}
+	escape := strings.NewReplacer(`\`, `\\`, "/", `\/`, "+", `\+`)
+	var b strings.Builder
+
+	for _, rdn := range name {
+		for j, attr := range rdn {
+			if j == 0 {
+				b.WriteByte('/')
+			} else {
+				b.WriteByte('+')
+			}
+			text, _, ok := attrText(attr.Value)
+			if !ok {
+				return "", fmt.Errorf("value of attribute %s not in text", shortName(attr.Type))
+			}
+			b.WriteString(shortName(attr.Type) + "=" + escape.Replace(text))
+		}
+	}
+	return b.String(), nil
+}
+
+// NameHash returns the hash of the name like OpenSSL, used to look for the
+// certificates into a directory: the first 4 bytes, in little endian, of the
+// SHA-1 of the canonical encoding of the name, where the strings are in UTF-8,
+// in lower case and without extra whitespace.
+func NameHash(der []byte) (uint32, error) {
+	name, err := parseName(der)
+	if err != nil {
+		return 0, err
+	}
+	var canon []byte
+
+	for _, rdn := range name {
+		set := make(rdnSET, len(rdn))
+
+		for i, attr := range rdn {
+			set[i] = attr
+			text, isCanon, ok := attrText(attr.Value)
+			if !ok || !isCanon {
+				continue
+			}
+			text = strings.Join(strings.FieldsFunc(text, isSpace), " ")
+			low := []byte(text)
+			for j, c := range low {
+				if c >= 'A' && c <= 'Z' {
+					low[j] = c + 'a' - 'A'
+				}
+			}
+			set[i].Value = asn1.RawValue{Class: asn1.ClassUniversal, Tag: asn1.TagUTF8String, Bytes: low}
+		}
+		b, err := asn1.Marshal(set)
+		if err != nil {
+			return 0, err
+		}
+		canon = append(canon, b...)
+	}
+
+	sum := sha1.Sum(canon)
+	return binary.LittleEndian.Uint32(sum[:4]), nil
+}
+
+// isSpace reports whether the character is a whitespace for OpenSSL.
+func isSpace(r rune) bool {
+	return r == ' ' || (r >= '\t' && r <= '\r')
+}
+
+// Marshal returns the name in DER format, with the attributes not empty and
+// in the types of string used by OpenSSL.
+func (n *Name) Marshal() ([]byte, error) {
+	values := []string{
+		n.Country, n.Province, n.Locality,
+		n.Organization, n.OrganizationalUnit, n.CommonName,
+	}
+	var name []rdnSET
+
+	for i, v := range values {
+		if v == "" {
+			continue
+		}
+		tag := asn1.TagUTF8String
+		if i == 0 {
+			tag = asn1.TagPrintableString
+		}
+		name = append(name, rdnSET{{
+			Type:  nameAttrs[i].oid,
+			Value: asn1.RawValue{Class: asn1.ClassUniversal, Tag: tag, Bytes: []byte(v)},
+		}})
+	}
+	return asn1.Marshal(name)
+}
+
+// PolicySubject returns the subject of the request with the attributes of the
+// policy "policy_anything", in its order, like OpenSSL does; the common name
+// is required.
+func PolicySubject(der []byte) ([]byte, error) {
+	name, err := parseName(der)
+	if err != nil {
+		return nil, err
+	}
+	var out []rdnSET
+	hasCN := false
+
+	for _, policy := range nameAttrs[:_POLICY_ATTRS] {
+		for _, rdn := range name {
+			for _, attr := range rdn {
+				if attr.Type.Equal(policy.oid) {
+					out = append(out, rdnSET{attr})
+					hasCN = hasCN || policy.short == "CN"
+				}
+			}
+		}
+	}
+	if !hasCN {
+		return nil, errors.New("the commonName field needed to be supplied and was missing")
+	}
+	return asn1.Marshal(out)
+}
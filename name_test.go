@@ -0,0 +1,73 @@
+// Copyright 2014 Jonas mg
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package easycert
+
+import "testing"
+
+func TestName(t *testing.T) {
+	name := &Name{Country: "ES", Organization: "Acme, Inc.", CommonName: "Web  Server"}
+	der, err := name.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Values printed by OpenSSL for the same subject.
+	if s, err := NameString(der); err != nil {
+		t.Fatal(err)
+	} else if s != `C = ES, O = "Acme, Inc.", CN = Web  Server` {
+		t.Errorf("NameString: got %q", s)
+	}
+	if s, err := NameOneline(der); err != nil {
+		t.Fatal(err)
+	} else if s != "/C=ES/O=Acme, Inc./CN=Web  Server" {
+		t.Errorf("NameOneline: got %q", s)
+	}
+	if s, err := NameSubj(der); err != nil {
+		t.Fatal(err)
+	} else if s != "/C=ES/O=Acme, Inc./CN=Web  Server" {
+		t.Errorf("NameSubj: got %q", s)
+	}
+	if hash, err := NameHash(der); err != nil {
+		t.Fatal(err)
+	} else if hash != 0xf6706a66 {
+		t.Errorf("NameHash: got %08x", hash)
+	}
+}
+
+func TestNameSubj(t *testing.T) {
+	der, err := (&Name{Organization: `A/B+C\D`, CommonName: "web"}).Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s, err := NameSubj(der); err != nil {
+		t.Fatal(err)
+	} else if s != `/O=A\/B\+C\\D/CN=web` {
+		t.Errorf("got %q", s)
+	}
+}
+
+func TestPolicySubject(t *testing.T) {
+	der, err := (&Name{Organization: "Acme", Locality: "Madrid"}).Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = PolicySubject(der); err == nil {
+		t.Error("subject without common name: got no error")
+	}
+
+	der, err = (&Name{Organization: "Acme", CommonName: "web", Locality: "Madrid"}).Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	policy, err := PolicySubject(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s, _ := NameString(policy); s != "L = Madrid, O = Acme, CN = web" {
+		t.Errorf("got %q", s)
+	}
+}
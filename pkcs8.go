@@ -0,0 +1,188 @@
+// Copyright 2014 Jonas mg
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package easycert
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/des"
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"errors"
+	"fmt"
+	"hash"
+)
+
+// Private keys encrypted in PKCS#8 with PBES2 (RFC 8018), like OpenSSL writes
+// them: the key derived by PBKDF2 encrypts with AES or Triple DES (the default
+// of "openssl req") in mode CBC.
+
+// PEM_ENCRYPTED_KEY is the type of the block in PEM format of a private key
+// encrypted in PKCS#8.
+const PEM_ENCRYPTED_KEY = "ENCRYPTED PRIVATE KEY"
+
+// _PBKDF2_ITERATIONS is the number of iterations of PBKDF2 to encrypt.
+const _PBKDF2_ITERATIONS = 600000
+
+var (
+	oidPBES2          = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 5, 13}
+	oidPBKDF2         = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 5, 12}
+	oidHMACWithSHA1   = asn1.ObjectIdentifier{1, 2, 840, 113549, 2, 7}
+	oidHMACWithSHA256 = asn1.ObjectIdentifier{1, 2, 840, 113549, 2, 9}
+	oidAES128CBC      = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 2}
+	oidAES192CBC      = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 22}
+	oidAES256CBC      = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 42}
+	oidDESEDE3CBC     = asn1.ObjectIdentifier{1, 2, 840, 113549, 3, 7}
+)
+
+// ErrPassphrase is returned when the passphrase does not decrypt the key.
+var ErrPassphrase = errors.New("wrong passphrase of the private key")
+
+type encryptedPrivateKeyInfo struct {
+	Algo pkix.AlgorithmIdentifier
+	Data []byte
+}
+
+type pbes2Params struct {
+	KDF    pkix.AlgorithmIdentifier
+	Cipher pkix.AlgorithmIdentifier
+}
+
+type pbkdf2Params struct {
+	Salt       []byte
+	Iterations int
+	KeyLength  int                      `asn1:"optional"`
+	PRF        pkix.AlgorithmIdentifier `asn1:"optional"`
+}
+
+// EncryptPKCS8 encrypts the private key in PKCS#8 with the passphrase, using
+// PBKDF2 with HMAC-SHA256 and AES-256-CBC.
+func EncryptPKCS8(key []byte, pass string) ([]byte, error) {
+	salt := make([]byte, 16)
+	iv := make([]byte, aes.BlockSize)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	if _, err := rand.Read(iv); err != nil {
+		return nil, err
+	}
+
+	kdf, err := asn1.Marshal(pbkdf2Params{
+		Salt:       salt,
+		Iterations: _PBKDF2_ITERATIONS,
+		PRF:        pkix.AlgorithmIdentifier{Algorithm: oidHMACWithSHA256, Parameters: asn1.NullRawValue},
+	})
+	if err != nil {
+		return nil, err
+	}
+	ivParam, err := asn1.Marshal(iv)
+	if err != nil {
+		return nil, err
+	}
+	params, err := asn1.Marshal(pbes2Params{
+		KDF:    pkix.AlgorithmIdentifier{Algorithm: oidPBKDF2, Parameters: asn1.RawValue{FullBytes: kdf}},
+		Cipher: pkix.AlgorithmIdentifier{Algorithm: oidAES256CBC, Parameters: asn1.RawValue{FullBytes: ivParam}},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	dk, err := pbkdf2.Key(sha256.New, pass, salt, _PBKDF2_ITERATIONS, 32)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(dk)
+	if err != nil {
+		return nil, err
+	}
+	pad := aes.BlockSize - len(key)%aes.BlockSize
+	data := append(append([]byte{}, key...), bytes.Repeat([]byte{byte(pad)}, pad)...)
+	cipher.NewCBCEncrypter(block, iv).CryptBlocks(data, data)
+
+	return asn1.Marshal(encryptedPrivateKeyInfo{
+		Algo: pkix.AlgorithmIdentifier{Algorithm: oidPBES2, Parameters: asn1.RawValue{FullBytes: params}},
+		Data: data,
+	})
+}
+
+// DecryptPKCS8 returns the private key in PKCS#8 encrypted with PBES2.
+func DecryptPKCS8(der []byte, pass string) ([]byte, error) {
+	var info encryptedPrivateKeyInfo
+	if _, err := asn1.Unmarshal(der, &info); err != nil {
+		return nil, err
+	}
+	if !info.Algo.Algorithm.Equal(oidPBES2) {
+		return nil, fmt.Errorf("private key encrypted with an algorithm not supported: %s", info.Algo.Algorithm)
+	}
+	var params pbes2Params
+	if _, err := asn1.Unmarshal(info.Algo.Parameters.FullBytes, &params); err != nil {
+		return nil, err
+	}
+	if !params.KDF.Algorithm.Equal(oidPBKDF2) {
+		return nil, fmt.Errorf("private key derived with an algorithm not supported: %s", params.KDF.Algorithm)
+	}
+	var kdf pbkdf2Params
+	if _, err := asn1.Unmarshal(params.KDF.Parameters.FullBytes, &kdf); err != nil {
+		return nil, err
+	}
+
+	var h func() hash.Hash
+	switch {
+	case kdf.PRF.Algorithm == nil, kdf.PRF.Algorithm.Equal(oidHMACWithSHA1):
+		h = sha1.New
+	case kdf.PRF.Algorithm.Equal(oidHMACWithSHA256):
+		h = sha256.New
+	default:
+		return nil, fmt.Errorf("private key derived with a function not supported: %s", kdf.PRF.Algorithm)
+	}
+
+	size := 0
+	newCipher := aes.NewCipher
+	switch {
+	case params.Cipher.Algorithm.Equal(oidAES128CBC):
+		size = 16
+	case params.Cipher.Algorithm.Equal(oidAES192CBC):
+		size = 24
+	case params.Cipher.Algorithm.Equal(oidAES256CBC):
+		size = 32
+	case params.Cipher.Algorithm.Equal(oidDESEDE3CBC):
+		size = 24
+		newCipher = des.NewTripleDESCipher
+	default:
+		return nil, fmt.Errorf("private key encrypted with a cipher not supported: %s", params.Cipher.Algorithm)
+	}
+
+	dk, err := pbkdf2.Key(h, pass, kdf.Salt, kdf.Iterations, size)
+	if err != nil {
+		return nil, err
+	}
+	block, err := newCipher(dk)
+	if err != nil {
+		return nil, err
+	}
+	var iv []byte
+	if _, err := asn1.Unmarshal(params.Cipher.Parameters.FullBytes, &iv); err != nil {
+		return nil, err
+	}
+	bs := block.BlockSize()
+	if len(iv) != bs || len(info.Data) == 0 || len(info.Data)%bs != 0 {
+		return nil, errors.New("private key encrypted with wrong parameters")
+	}
+	data := make([]byte, len(info.Data))
+	cipher.NewCBCDecrypter(block, iv).CryptBlocks(data, info.Data)
+
+	pad := int(data[len(data)-1])
+	if pad == 0 || pad > bs || !bytes.Equal(data[len(data)-pad:], bytes.Repeat([]byte{byte(pad)}, pad)) {
+		return nil, ErrPassphrase
+	}
+	return data[:len(data)-pad], nil
+}
@@ -0,0 +1,36 @@
+// Copyright 2014 Jonas mg
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package easycert
+
+import (
+	"crypto"
+	"crypto/elliptic"
+	"testing"
+)
+
+func TestKeyPKCS8(t *testing.T) {
+	key, err := GenerateKey(&KeyOptions{Type: KEY_ECDSA, Curve: elliptic.P384()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := MarshalKey(key, "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = ParseKey(data, "wrong"); err == nil {
+		t.Error("wrong passphrase: got no error")
+	}
+	got, err := ParseKey(data, "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pub := got.Public().(interface{ Equal(crypto.PublicKey) bool })
+	if !pub.Equal(key.Public()) {
+		t.Error("key decrypted does not match")
+	}
+}
@@ -0,0 +1,98 @@
+// Copyright 2014 Jonas mg
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package easycert
+
+import (
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"io/fs"
+	"net"
+	"strings"
+
+	"github.com/tredoe/easycert/store"
+)
+
+// Request represents a certificate request, pending of being signed by the
+// CA.
+type Request struct {
+	Name string // Name of the files of the request, its key and certificate.
+	CSR  *x509.CertificateRequest
+}
+
+// NewRequest creates the certificate request `name` with a new private key,
+// which is written without encryption, like the one of a server.
+func (s *Store) NewRequest(name string, opts *RequestOptions) (*Request, error) {
+	if err := checkName(name); err != nil {
+		return nil, err
+	}
+	if name == store.NAME_CA {
+		return nil, fmt.Errorf("name reserved for the CA: %q", name)
+	}
+	if _, err := fs.Stat(s.fs, store.CertFile(name)); err == nil {
+		return nil, fmt.Errorf("the certificate exists: %q", name)
+	}
+	if opts == nil {
+		opts = &RequestOptions{}
+	}
+
+	subject := opts.Subject
+	if subject.CommonName == "" {
+		subject.CommonName = name
+	}
+	rawSubject, err := subject.Marshal()
+	if err != nil {
+		return nil, err
+	}
+
+	tmpl := &x509.CertificateRequest{RawSubject: rawSubject}
+	for _, v := range opts.Hosts {
+		if v = strings.TrimSpace(v); v == "" {
+			continue
+		}
+		if ip := net.ParseIP(v); ip != nil {
+			tmpl.IPAddresses = append(tmpl.IPAddresses, ip)
+		} else {
+			tmpl.DNSNames = append(tmpl.DNSNames, v)
+		}
+	}
+
+	key, err := GenerateKey(opts.Key)
+	if err != nil {
+		return nil, err
+	}
+	der, err := x509.CreateCertificateRequest(rand.Reader, tmpl, key)
+	if err != nil {
+		return nil, err
+	}
+	csr, err := x509.ParseCertificateRequest(der)
+	if err != nil {
+		return nil, err
+	}
+
+	if err = s.writeKey(name, key, ""); err != nil {
+		return nil, err
+	}
+	data := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: der})
+	if err = s.fs.WriteFile(store.RequestFile(name), data, 0644); err != nil {
+		return nil, err
+	}
+	return &Request{Name: name, CSR: csr}, nil
+}
+
+// Request returns the certificate request `name`.
+func (s *Store) Request(name string) (*Request, error) {
+	if err := checkName(name); err != nil {
+		return nil, err
+	}
+	csr, err := store.ReadRequest(s.fs, name)
+	if err != nil {
+		return nil, err
+	}
+	return &Request{Name: name, CSR: csr}, nil
+}
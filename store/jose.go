@@ -0,0 +1,81 @@
+// Copyright 2014 Jonas mg
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package store
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io/fs"
+)
+
+// Values of the headers of JOSE (RFC 7515) which bind the key of a JWS to a
+// certificate: "x5c", the chain of certificates, and "x5t#S256", the SHA-256
+// thumbprint of the certificate.
+
+// X5C returns the value of the header "x5c" for the certificate `name`: the
+// certificate and its issuers, in DER format encoded in base64, without the
+// root since it has to be trusted by the verifier.
+func X5C(fsys fs.FS, name string) ([]string, error) {
+	cert, err := ReadCert(fsys, name)
+	if err != nil {
+		return nil, err
+	}
+	chain, err := Chain(fsys, name)
+	if err != nil {
+		return nil, err
+	}
+
+	x5c := []string{base64.StdEncoding.EncodeToString(cert.Raw)}
+	for _, v := range chain {
+		if bytes.Equal(v.Cert.RawIssuer, v.Cert.RawSubject) {
+			break
+		}
+		x5c = append(x5c, base64.StdEncoding.EncodeToString(v.Cert.Raw))
+	}
+	return x5c, nil
+}
+
+// X5TS256 returns the value of the header "x5t#S256" of the certificate: the
+// SHA-256 hash of its DER encoding, in base64url without padding.
+func X5TS256(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.Raw)
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// VerifyX5C verifies the chain of a header "x5c" against the roots of trust
+// given in `opts`, using the rest of certificates of the chain and the CAs of
+// the certificates directory like intermediates. It returns the chain from the
+// certificate, whose key has to verify the JWS, up to a root.
+//
+// Whether `x5t` is not empty, it has to be the thumbprint of the certificate,
+// from the header "x5t#S256".
+func VerifyX5C(fsys fs.FS, x5c []string, x5t string, opts VerifyOptions) ([]*x509.Certificate, error) {
+	if len(x5c) == 0 {
+		return nil, errors.New("x5c: no certificate")
+	}
+
+	certs := make([]*x509.Certificate, len(x5c))
+	for i, v := range x5c {
+		// Standard base64, not base64url (RFC 7515, section 4.1.6).
+		der, err := base64.StdEncoding.DecodeString(v)
+		if err != nil {
+			return nil, fmt.Errorf("x5c[%d]: %s", i, err)
+		}
+		if certs[i], err = x509.ParseCertificate(der); err != nil {
+			return nil, fmt.Errorf("x5c[%d]: %s", i, err)
+		}
+	}
+
+	if x5t != "" && x5t != X5TS256(certs[0]) {
+		return nil, errors.New("x5t#S256: thumbprint does not match the certificate")
+	}
+	return verify(fsys, certs[0], certs[1:], opts)
+}
@@ -0,0 +1,52 @@
+// Copyright 2014 Jonas mg
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package store
+
+import (
+	"testing"
+	"testing/fstest"
+)
+
+func TestJOSE(t *testing.T) {
+	fsys := newTestFS(t)
+
+	x5c, err := X5C(fsys, "web")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(x5c) != 2 {
+		t.Fatalf("x5c: got %d certificates, want the certificate and the intermediate CA", len(x5c))
+	}
+	web, err := ReadCert(fsys, "web")
+	if err != nil {
+		t.Fatal(err)
+	}
+	x5t := X5TS256(web)
+
+	// The intermediate CA is got from the chain, not from the directory.
+	onlyCA := fstest.MapFS{CertFile(NAME_CA): fsys[CertFile(NAME_CA)]}
+	chain, err := VerifyX5C(onlyCA, x5c, x5t, VerifyOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(chain) != 3 || chain[0].Subject.CommonName != "web" {
+		t.Errorf("got chain of %d certificates, from %q", len(chain), chain[0].Subject.CommonName)
+	}
+
+	if _, err = VerifyX5C(onlyCA, x5c[:1], "", VerifyOptions{}); err == nil {
+		t.Error("x5c without intermediate: got no error")
+	}
+	if _, err = VerifyX5C(onlyCA, x5c, X5TS256(chain[1]), VerifyOptions{}); err == nil {
+		t.Error("x5t#S256 of another certificate: got no error")
+	}
+	if _, err = VerifyX5C(onlyCA, []string{"-_-"}, "", VerifyOptions{}); err == nil {
+		t.Error("x5c in base64url: got no error")
+	}
+	if _, err = VerifyX5C(newTestFS(t), x5c, "", VerifyOptions{}); err == nil {
+		t.Error("x5c of another CA: got no error")
+	}
+}
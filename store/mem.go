@@ -0,0 +1,243 @@
+// Copyright 2014 Jonas mg
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package store
+
+import (
+	"bytes"
+	"io"
+	"io/fs"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Mem is a certificates directory kept in memory, which is never written to
+// disk. It is useful for tests and for ephemeral certificates.
+//
+// The directories exist while they have some file.
+type Mem struct {
+	mu    sync.RWMutex
+	files map[string]*memData
+}
+
+// memData represents the content of a file.
+type memData struct {
+	data    []byte
+	perm    fs.FileMode
+	modTime time.Time
+}
+
+// NewMem returns an empty certificates directory in memory.
+func NewMem() *Mem {
+	return &Mem{files: make(map[string]*memData)}
+}
+
+func (m *Mem) WriteFile(name string, data []byte, perm fs.FileMode) error {
+	if !fs.ValidPath(name) || name == "." {
+		return &fs.PathError{Op: "write", Path: name, Err: fs.ErrInvalid}
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.isDir(name) {
+		return &fs.PathError{Op: "write", Path: name, Err: fs.ErrExist}
+	}
+	for dir := path.Dir(name); dir != "."; dir = path.Dir(dir) {
+		if _, ok := m.files[dir]; ok {
+			return &fs.PathError{Op: "write", Path: name, Err: fs.ErrInvalid}
+		}
+	}
+
+	m.files[name] = &memData{
+		data:    append([]byte(nil), data...),
+		perm:    perm.Perm(),
+		modTime: time.Now(),
+	}
+	return nil
+}
+
+func (m *Mem) Remove(name string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.files[name]; !ok {
+		return &fs.PathError{Op: "remove", Path: name, Err: fs.ErrNotExist}
+	}
+	delete(m.files, name)
+	return nil
+}
+
+func (m *Mem) ReadFile(name string) ([]byte, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "read", Path: name, Err: fs.ErrInvalid}
+	}
+
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	f, ok := m.files[name]
+	if !ok {
+		return nil, &fs.PathError{Op: "read", Path: name, Err: fs.ErrNotExist}
+	}
+	return append([]byte(nil), f.data...), nil
+}
+
+func (m *Mem) Open(name string) (fs.File, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrInvalid}
+	}
+
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	if f, ok := m.files[name]; ok {
+		return &memFile{
+			Reader: bytes.NewReader(append([]byte(nil), f.data...)),
+			info:   memInfo{path.Base(name), f},
+		}, nil
+	}
+	if !m.isDir(name) {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+	}
+	return &memDir{
+		info:    memInfo{path.Base(name), nil},
+		entries: m.readDir(name),
+	}, nil
+}
+
+func (m *Mem) ReadDir(name string) ([]fs.DirEntry, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: fs.ErrInvalid}
+	}
+
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	if !m.isDir(name) {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: fs.ErrNotExist}
+	}
+	return m.readDir(name), nil
+}
+
+// isDir reports whether `name` is a directory, which is whether it has files.
+func (m *Mem) isDir(name string) bool {
+	if name == "." {
+		return true
+	}
+	prefix := name + "/"
+	for v := range m.files {
+		if strings.HasPrefix(v, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// readDir returns the entries of the directory, sorted by name.
+func (m *Mem) readDir(name string) []fs.DirEntry {
+	prefix := name + "/"
+	if name == "." {
+		prefix = ""
+	}
+
+	seen := make(map[string]bool)
+	var entries []fs.DirEntry
+
+	for v, f := range m.files {
+		if !strings.HasPrefix(v, prefix) {
+			continue
+		}
+		elem := v[len(prefix):]
+
+		if i := strings.IndexByte(elem, '/'); i != -1 { // directory
+			elem = elem[:i]
+			if !seen[elem] {
+				seen[elem] = true
+				entries = append(entries, fs.FileInfoToDirEntry(memInfo{elem, nil}))
+			}
+		} else {
+			entries = append(entries, fs.FileInfoToDirEntry(memInfo{elem, f}))
+		}
+	}
+
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name() < entries[j].Name() })
+	return entries
+}
+
+// memInfo implements fs.FileInfo; it is a directory whether `f` is nil.
+type memInfo struct {
+	name string
+	f    *memData
+}
+
+func (i memInfo) Name() string     { return i.name }
+func (i memInfo) Sys() interface{} { return nil }
+
+func (i memInfo) Size() int64 {
+	if i.f == nil {
+		return 0
+	}
+	return int64(len(i.f.data))
+}
+
+func (i memInfo) Mode() fs.FileMode {
+	if i.f == nil {
+		return fs.ModeDir | 0755
+	}
+	return i.f.perm
+}
+
+func (i memInfo) ModTime() time.Time {
+	if i.f == nil {
+		return time.Time{}
+	}
+	return i.f.modTime
+}
+
+func (i memInfo) IsDir() bool { return i.f == nil }
+
+// memFile is a file opened for reading.
+type memFile struct {
+	*bytes.Reader
+	info memInfo
+}
+
+func (f *memFile) Stat() (fs.FileInfo, error) { return f.info, nil }
+func (f *memFile) Close() error               { return nil }
+
+// memDir is a directory opened for reading.
+type memDir struct {
+	info    memInfo
+	entries []fs.DirEntry
+	offset  int
+}
+
+func (d *memDir) Stat() (fs.FileInfo, error) { return d.info, nil }
+func (d *memDir) Close() error               { return nil }
+
+func (d *memDir) Read([]byte) (int, error) {
+	return 0, &fs.PathError{Op: "read", Path: d.info.name, Err: fs.ErrInvalid}
+}
+
+func (d *memDir) ReadDir(n int) ([]fs.DirEntry, error) {
+	rest := d.entries[d.offset:]
+	if n <= 0 {
+		d.offset = len(d.entries)
+		return rest, nil
+	}
+	if len(rest) == 0 {
+		return nil, io.EOF
+	}
+	if n > len(rest) {
+		n = len(rest)
+	}
+	d.offset += n
+	return rest[:n], nil
+}
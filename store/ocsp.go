@@ -0,0 +1,245 @@
+// Copyright 2014 Jonas mg
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package store
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"time"
+)
+
+// Client of the Online Certificate Status Protocol (RFC 6960), enough to know
+// the status of a certificate.
+
+// OCSP_MAX_SIZE is the maximum size of a response of an OCSP responder.
+const OCSP_MAX_SIZE = 1 << 20
+
+// OCSP_DEFAULT_UPDATE is the time to keep a response without a next update.
+const OCSP_DEFAULT_UPDATE = time.Hour
+
+var (
+	oidSHA1          = asn1.ObjectIdentifier{1, 3, 14, 3, 2, 26}
+	oidOCSPBasic     = asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 48, 1, 1}
+	errOCSPMalformed = errors.New("ocsp: malformed response")
+)
+
+// signatureAlgorithms maps the algorithms which can sign an OCSP response.
+var signatureAlgorithms = map[string]x509.SignatureAlgorithm{
+	"1.2.840.113549.1.1.5":  x509.SHA1WithRSA,
+	"1.2.840.113549.1.1.11": x509.SHA256WithRSA,
+	"1.2.840.113549.1.1.12": x509.SHA384WithRSA,
+	"1.2.840.113549.1.1.13": x509.SHA512WithRSA,
+	"1.2.840.10045.4.1":     x509.ECDSAWithSHA1,
+	"1.2.840.10045.4.3.2":   x509.ECDSAWithSHA256,
+	"1.2.840.10045.4.3.3":   x509.ECDSAWithSHA384,
+	"1.2.840.10045.4.3.4":   x509.ECDSAWithSHA512,
+	"1.3.101.112":           x509.PureEd25519,
+}
+
+// Status of a certificate in an OCSP response.
+const (
+	_OCSP_GOOD = iota
+	_OCSP_REVOKED
+	_OCSP_UNKNOWN
+)
+
+type ocspCertID struct {
+	HashAlgorithm pkix.AlgorithmIdentifier
+	NameHash      []byte
+	IssuerKeyHash []byte
+	SerialNumber  *big.Int
+}
+
+type ocspRequest struct {
+	TBSRequest struct {
+		RequestList []struct {
+			Cert ocspCertID
+		}
+	}
+}
+
+type ocspResponse struct {
+	Status   asn1.Enumerated
+	Response struct {
+		ResponseType asn1.ObjectIdentifier
+		Response     []byte
+	} `asn1:"explicit,tag:0,optional"`
+}
+
+type ocspBasicResponse struct {
+	TBSResponseData    ocspResponseData
+	SignatureAlgorithm pkix.AlgorithmIdentifier
+	Signature          asn1.BitString
+	Certificates       []asn1.RawValue `asn1:"explicit,tag:0,optional"`
+}
+
+type ocspResponseData struct {
+	Raw                asn1.RawContent
+	Version            int `asn1:"optional,default:0,explicit,tag:0"`
+	RawResponderID     asn1.RawValue
+	ProducedAt         time.Time `asn1:"generalized"`
+	Responses          []ocspSingleResponse
+	ResponseExtensions []pkix.Extension `asn1:"explicit,tag:1,optional"`
+}
+
+type ocspSingleResponse struct {
+	CertID  ocspCertID
+	Good    asn1.Flag `asn1:"tag:0,optional"`
+	Revoked struct {
+		RevocationTime time.Time       `asn1:"generalized"`
+		Reason         asn1.Enumerated `asn1:"explicit,tag:0,optional"`
+	} `asn1:"tag:1,optional"`
+	Unknown          asn1.Flag        `asn1:"tag:2,optional"`
+	ThisUpdate       time.Time        `asn1:"generalized"`
+	NextUpdate       time.Time        `asn1:"generalized,explicit,tag:0,optional"`
+	SingleExtensions []pkix.Extension `asn1:"explicit,tag:1,optional"`
+}
+
+// ocspStatus represents the status of a certificate got from the responder.
+type ocspStatus struct {
+	Status     int
+	ThisUpdate time.Time
+	NextUpdate time.Time
+}
+
+// newOCSPCertID returns the identifier of the certificate for its issuer.
+func newOCSPCertID(cert, issuer *x509.Certificate) (ocspCertID, error) {
+	var spki struct {
+		Algorithm pkix.AlgorithmIdentifier
+		PublicKey asn1.BitString
+	}
+	if _, err := asn1.Unmarshal(issuer.RawSubjectPublicKeyInfo, &spki); err != nil {
+		return ocspCertID{}, err
+	}
+	nameHash := sha1.Sum(issuer.RawSubject)
+	keyHash := sha1.Sum(spki.PublicKey.RightAlign())
+
+	return ocspCertID{
+		HashAlgorithm: pkix.AlgorithmIdentifier{
+			Algorithm:  oidSHA1,
+			Parameters: asn1.RawValue{Tag: asn1.TagNull},
+		},
+		NameHash:      nameHash[:],
+		IssuerKeyHash: keyHash[:],
+		SerialNumber:  cert.SerialNumber,
+	}, nil
+}
+
+// queryOCSP asks the status of the certificate to its OCSP responder. The
+// response has to be signed by the issuer or by a responder delegated by it.
+func queryOCSP(client *http.Client, cert, issuer *x509.Certificate) (*ocspStatus, error) {
+	if len(cert.OCSPServer) == 0 {
+		return nil, fmt.Errorf("ocsp: certificate without responder: %q", cert.Subject.CommonName)
+	}
+	id, err := newOCSPCertID(cert, issuer)
+	if err != nil {
+		return nil, err
+	}
+
+	var req ocspRequest
+	req.TBSRequest.RequestList = append(req.TBSRequest.RequestList, struct{ Cert ocspCertID }{id})
+	der, err := asn1.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+
+	url := cert.OCSPServer[0]
+	resp, err := client.Post(url, "application/ocsp-request", bytes.NewReader(der))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("ocsp: %s: %s", url, resp.Status)
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, OCSP_MAX_SIZE+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > OCSP_MAX_SIZE {
+		return nil, fmt.Errorf("ocsp: %s: response bigger than %d bytes", url, OCSP_MAX_SIZE)
+	}
+	return parseOCSP(data, id, issuer)
+}
+
+// parseOCSP returns the status of the certificate `id` in the response,
+// checking its signature.
+func parseOCSP(data []byte, id ocspCertID, issuer *x509.Certificate) (*ocspStatus, error) {
+	var resp ocspResponse
+	if rest, err := asn1.Unmarshal(data, &resp); err != nil || len(rest) != 0 {
+		return nil, errOCSPMalformed
+	}
+	if resp.Status != 0 {
+		return nil, fmt.Errorf("ocsp: responder error, status %d", resp.Status)
+	}
+	if !resp.Response.ResponseType.Equal(oidOCSPBasic) {
+		return nil, errOCSPMalformed
+	}
+
+	var basic ocspBasicResponse
+	if rest, err := asn1.Unmarshal(resp.Response.Response, &basic); err != nil || len(rest) != 0 {
+		return nil, errOCSPMalformed
+	}
+
+	algo, ok := signatureAlgorithms[basic.SignatureAlgorithm.Algorithm.String()]
+	if !ok {
+		return nil, fmt.Errorf("ocsp: unsupported signature algorithm: %s", basic.SignatureAlgorithm.Algorithm)
+	}
+	signer := issuer
+	if len(basic.Certificates) != 0 {
+		var err error
+		if signer, err = x509.ParseCertificate(basic.Certificates[0].FullBytes); err != nil {
+			return nil, err
+		}
+		if !bytes.Equal(signer.Raw, issuer.Raw) {
+			if err := signer.CheckSignatureFrom(issuer); err != nil {
+				return nil, fmt.Errorf("ocsp: responder not delegated by the issuer: %s", err)
+			}
+			delegated := false
+			for _, v := range signer.ExtKeyUsage {
+				delegated = delegated || v == x509.ExtKeyUsageOCSPSigning
+			}
+			if !delegated {
+				return nil, errors.New("ocsp: responder without the usage OCSP signing")
+			}
+		}
+	}
+	if err := signer.CheckSignature(algo, basic.TBSResponseData.Raw, basic.Signature.RightAlign()); err != nil {
+		return nil, fmt.Errorf("ocsp: wrong signature: %s", err)
+	}
+
+	for _, v := range basic.TBSResponseData.Responses {
+		if v.CertID.SerialNumber.Cmp(id.SerialNumber) != 0 ||
+			!bytes.Equal(v.CertID.NameHash, id.NameHash) ||
+			!bytes.Equal(v.CertID.IssuerKeyHash, id.IssuerKeyHash) {
+			continue
+		}
+
+		status := &ocspStatus{Status: _OCSP_UNKNOWN, ThisUpdate: v.ThisUpdate, NextUpdate: v.NextUpdate}
+		if v.Good {
+			status.Status = _OCSP_GOOD
+		} else if !v.Revoked.RevocationTime.IsZero() {
+			status.Status = _OCSP_REVOKED
+		}
+
+		now := time.Now()
+		if v.ThisUpdate.After(now) || (!v.NextUpdate.IsZero() && v.NextUpdate.Before(now)) {
+			return nil, errors.New("ocsp: response out of date")
+		}
+		return status, nil
+	}
+	return nil, errors.New("ocsp: response without the certificate")
+}
@@ -0,0 +1,88 @@
+// Copyright 2014 Jonas mg
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package store
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io/fs"
+	"strings"
+	"time"
+)
+
+// Pins of the public keys, to identify the peers by their keys instead of by
+// their names, like the nameless certificates issued with "req -spki".
+
+// PIN_PREFIX is the prefix of a pin, followed by the SHA-256 hash in base64 of
+// the SubjectPublicKeyInfo of the key.
+const PIN_PREFIX = "sha256/"
+
+var errPinned = errors.New("public key of the peer not pinned")
+
+// SPKIPin returns the pin of the public key in DER format (the field
+// RawSubjectPublicKeyInfo of a certificate or of a request).
+func SPKIPin(spki []byte) string {
+	sum := sha256.Sum256(spki)
+	return PIN_PREFIX + base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// CheckPin checks the format of the pin.
+func CheckPin(pin string) error {
+	hash, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(pin, PIN_PREFIX))
+	if !strings.HasPrefix(pin, PIN_PREFIX) || err != nil || len(hash) != sha256.Size {
+		return fmt.Errorf("wrong pin: %q; it has to be %q followed by the SHA-256 hash in base64", pin, PIN_PREFIX)
+	}
+	return nil
+}
+
+// Pins returns the pins of the public keys of the certificates `names`.
+func Pins(fsys fs.FS, names ...string) ([]string, error) {
+	pins := make([]string, len(names))
+
+	for i, v := range names {
+		cert, err := ReadCert(fsys, v)
+		if err != nil {
+			return nil, err
+		}
+		pins[i] = SPKIPin(cert.RawSubjectPublicKeyInfo)
+	}
+	return pins, nil
+}
+
+// verifyPins returns a function to use in tls.Config.VerifyPeerCertificate,
+// which verifies the certificate of the peer only by the pin of its public key
+// and its period of validity.
+func verifyPins(pins []string) (func([][]byte, [][]*x509.Certificate) error, error) {
+	pinned := make(map[string]bool, len(pins))
+	for _, v := range pins {
+		if err := CheckPin(v); err != nil {
+			return nil, err
+		}
+		pinned[v] = true
+	}
+
+	return func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+		if len(rawCerts) == 0 {
+			return errors.New("no certificate of the peer")
+		}
+		cert, err := x509.ParseCertificate(rawCerts[0])
+		if err != nil {
+			return err
+		}
+
+		if now := time.Now(); now.Before(cert.NotBefore) || now.After(cert.NotAfter) {
+			return x509.CertificateInvalidError{Cert: cert, Reason: x509.Expired}
+		}
+		if pin := SPKIPin(cert.RawSubjectPublicKeyInfo); !pinned[pin] {
+			return fmt.Errorf("%w: %s", errPinned, pin)
+		}
+		return nil
+	}, nil
+}
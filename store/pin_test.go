@@ -0,0 +1,66 @@
+// Copyright 2014 Jonas mg
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package store
+
+import (
+	"crypto/tls"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestPins(t *testing.T) {
+	fsys := newTestFS(t)
+
+	pins, err := Pins(fsys, "web")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pins) != 1 || !strings.HasPrefix(pins[0], PIN_PREFIX) {
+		t.Fatalf("got pins %v", pins)
+	}
+	if err = CheckPin(pins[0]); err != nil {
+		t.Error(err)
+	}
+	for _, v := range []string{"", "sha256/", "sha1/" + pins[0][len(PIN_PREFIX):], pins[0][:20]} {
+		if CheckPin(v) == nil {
+			t.Errorf("CheckPin(%q): got no error", v)
+		}
+	}
+
+	web, err := KeyPair(fsys, "web")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sub, err := KeyPair(fsys, "sub")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Only the pin is checked, even without CA in the directory.
+	verify, err := VerifyPeer(nil, PeerOptions{Pins: pins})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = verify(web.Certificate, nil); err != nil {
+		t.Errorf("pinned: %s", err)
+	}
+	if err = verify(sub.Certificate, nil); !errors.Is(err, errPinned) {
+		t.Errorf("not pinned: got error %v", err)
+	}
+
+	if _, err = VerifyPeer(nil, PeerOptions{Pins: []string{"wrong"}}); err == nil {
+		t.Error("wrong pin: got no error")
+	}
+
+	// The server is identified by its key, without names.
+	server := &tls.Config{Certificates: []tls.Certificate{web}, SessionTicketsDisabled: true}
+	client := &tls.Config{InsecureSkipVerify: true, VerifyPeerCertificate: verify}
+	if err = handshake(server, client); err != nil {
+		t.Errorf("handshake with pinned server: %s", err)
+	}
+}
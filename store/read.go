@@ -0,0 +1,284 @@
+// Copyright 2014 Jonas mg
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package store
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"io/fs"
+	"path"
+	"sort"
+)
+
+// The functions to read a certificates directory use fs.FS, so the
+// certificates can be loaded from a Store, from a directory embedded in the
+// program (embed.FS), from a zip archive (zip.Reader) or from any other file
+// system.
+
+// Cert represents a certificate of the certificates directory.
+type Cert struct {
+	Name string // Name without extension.
+	Cert *x509.Certificate
+}
+
+// ParseCerts returns the certificates in PEM format found in data.
+func ParseCerts(data []byte) ([]*x509.Certificate, error) {
+	var certs []*x509.Certificate
+
+	for {
+		var block *pem.Block
+
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		certs = append(certs, cert)
+	}
+	return certs, nil
+}
+
+// ReadCertFile returns the first certificate of the file, in PEM format.
+func ReadCertFile(fsys fs.FS, name string) (*x509.Certificate, error) {
+	data, err := fs.ReadFile(fsys, name)
+	if err != nil {
+		return nil, err
+	}
+
+	certs, err := ParseCerts(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", name, err)
+	}
+	if len(certs) == 0 {
+		return nil, fmt.Errorf("no certificate in PEM format: %q", name)
+	}
+	return certs[0], nil
+}
+
+// ReadCert returns the certificate `name`.
+func ReadCert(fsys fs.FS, name string) (*x509.Certificate, error) {
+	return ReadCertFile(fsys, CertFile(name))
+}
+
+// ReadCerts returns the certificates of the certificates directory, sorted by
+// name.
+func ReadCerts(fsys fs.FS) ([]*Cert, error) {
+	match, err := fs.Glob(fsys, path.Join(DIR_CERT, "*"+EXT_CERT))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(match)
+
+	certs := make([]*Cert, 0, len(match))
+	for _, v := range match {
+		cert, err := ReadCertFile(fsys, v)
+		if err != nil {
+			return nil, err
+		}
+
+		name := path.Base(v)
+		certs = append(certs, &Cert{Name: name[:len(name)-len(EXT_CERT)], Cert: cert})
+	}
+	return certs, nil
+}
+
+// ReadRequest returns the certificate request `name`, pending of being signed.
+func ReadRequest(fsys fs.FS, name string) (*x509.CertificateRequest, error) {
+	data, err := fs.ReadFile(fsys, RequestFile(name))
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != "CERTIFICATE REQUEST" {
+		return nil, fmt.Errorf("no certificate request in PEM format: %q", RequestFile(name))
+	}
+	return x509.ParseCertificateRequest(block.Bytes)
+}
+
+// ReadCRL returns the revocation list of the CA `name`, in PEM or DER format.
+func ReadCRL(fsys fs.FS, name string) (*x509.RevocationList, error) {
+	data, err := fs.ReadFile(fsys, CRLFile(name))
+	if err != nil {
+		return nil, err
+	}
+
+	if block, _ := pem.Decode(data); block != nil {
+		if block.Type != "X509 CRL" {
+			return nil, fmt.Errorf("no revocation list in PEM format: %q", CRLFile(name))
+		}
+		data = block.Bytes
+	}
+	return x509.ParseRevocationList(data)
+}
+
+// Chain returns the issuers of the certificate `name` found in the certificates
+// directory, from the nearest one up to the root.
+func Chain(fsys fs.FS, name string) ([]*Cert, error) {
+	cert, err := ReadCert(fsys, name)
+	if err != nil {
+		return nil, err
+	}
+	certs, err := ReadCerts(fsys)
+	if err != nil {
+		return nil, err
+	}
+
+	var chain []*Cert
+
+	for {
+		aki := cert.AuthorityKeyId
+		if len(aki) == 0 || bytes.Equal(aki, cert.SubjectKeyId) {
+			return chain, nil
+		}
+
+		var issuer *Cert
+		for _, v := range certs {
+			if bytes.Equal(aki, v.Cert.SubjectKeyId) {
+				issuer = v
+				break
+			}
+		}
+		if issuer == nil {
+			return chain, nil
+		}
+		for _, v := range chain {
+			if v == issuer { // loop
+				return chain, nil
+			}
+		}
+
+		chain = append(chain, issuer)
+		cert = issuer.Cert
+	}
+}
+
+// CertPool returns a pool with the certificates `names`, i.e. to be used like
+// roots of trust. The CA is used whether no name is given.
+func CertPool(fsys fs.FS, names ...string) (*x509.CertPool, error) {
+	if len(names) == 0 {
+		names = []string{NAME_CA}
+	}
+	pool := x509.NewCertPool()
+
+	for _, v := range names {
+		cert, err := ReadCert(fsys, v)
+		if err != nil {
+			return nil, err
+		}
+		pool.AddCert(cert)
+	}
+	return pool, nil
+}
+
+// VerifyOptions are the options to verify a certificate against the
+// certificates directory.
+type VerifyOptions struct {
+	// Names of the certificates used like roots of trust. The CA is used
+	// whether it is empty, unless SystemRoots is set.
+	Roots []string
+
+	// Whether the root certificates of the operating system are trusted too,
+	// so certificates not issued by the certificates directory can be checked.
+	SystemRoots bool
+
+	// Host name that the certificate has to be valid for, if any.
+	DNSName string
+}
+
+// Verify verifies the certificate against the roots of trust given in `opts`,
+// using the CAs of the certificates directory like intermediates. It returns
+// the chain from the certificate up to a root.
+func Verify(fsys fs.FS, cert *x509.Certificate, opts VerifyOptions) ([]*x509.Certificate, error) {
+	return verify(fsys, cert, nil, opts)
+}
+
+// verify is like Verify, with the certificates `extra` used like intermediates
+// too, i.e. the ones sent by the peer.
+func verify(fsys fs.FS, cert *x509.Certificate, extra []*x509.Certificate, opts VerifyOptions) ([]*x509.Certificate, error) {
+	var roots *x509.CertPool
+	var err error
+
+	if opts.SystemRoots {
+		if roots, err = x509.SystemCertPool(); err != nil {
+			return nil, err
+		}
+		for _, v := range opts.Roots {
+			root, err := ReadCert(fsys, v)
+			if err != nil {
+				return nil, err
+			}
+			roots.AddCert(root)
+		}
+	} else if roots, err = CertPool(fsys, opts.Roots...); err != nil {
+		return nil, err
+	}
+
+	certs, err := ReadCerts(fsys)
+	if err != nil {
+		return nil, err
+	}
+	intermediates := x509.NewCertPool()
+	for _, v := range certs {
+		if v.Cert.IsCA {
+			intermediates.AddCert(v.Cert)
+		}
+	}
+	for _, v := range extra {
+		intermediates.AddCert(v)
+	}
+
+	chains, err := cert.Verify(x509.VerifyOptions{
+		Roots:         roots,
+		Intermediates: intermediates,
+		DNSName:       opts.DNSName,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+	})
+	if err != nil {
+		return nil, err
+	}
+	return chains[0], nil
+}
+
+// KeyPair returns the certificate `name` with its private key, and the chain
+// of issuers, to be used in a TLS configuration.
+func KeyPair(fsys fs.FS, name string) (tls.Certificate, error) {
+	certPEM, err := fs.ReadFile(fsys, CertFile(name))
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	keyPEM, err := fs.ReadFile(fsys, KeyFile(name))
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	pair, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	chain, err := Chain(fsys, name)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	for _, v := range chain {
+		if !bytes.Equal(v.Cert.RawSubject, v.Cert.RawIssuer) { // not the root
+			pair.Certificate = append(pair.Certificate, v.Cert.Raw)
+		}
+	}
+	return pair, nil
+}
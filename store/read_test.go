@@ -0,0 +1,178 @@
+// Copyright 2014 Jonas mg
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package store
+
+import (
+	"archive/zip"
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"testing"
+	"testing/fstest"
+	"time"
+)
+
+// newTestFS returns a certificates directory with a CA, an intermediate CA and
+// a server certificate.
+func newTestFS(t *testing.T) fstest.MapFS {
+	fsys := make(fstest.MapFS)
+
+	var parent *x509.Certificate
+	var parentKey *ecdsa.PrivateKey
+
+	for i, name := range []string{NAME_CA, "sub", "web"} {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tmpl := &x509.Certificate{
+			SerialNumber:          big.NewInt(int64(i + 1)),
+			Subject:               pkix.Name{CommonName: name},
+			NotBefore:             time.Now().Add(-time.Hour),
+			NotAfter:              time.Now().Add(time.Hour),
+			SubjectKeyId:          []byte{byte(i + 1)},
+			BasicConstraintsValid: true,
+			IsCA:                  name != "web",
+			KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign | x509.KeyUsageDigitalSignature,
+			DNSNames:              []string{name + ".example.com"},
+		}
+		if parent == nil {
+			parent, parentKey = tmpl, key
+		}
+
+		der, err := x509.CreateCertificate(rand.Reader, tmpl, parent, key.Public(), parentKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		fsys[CertFile(name)] = &fstest.MapFile{
+			Data: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		}
+		fsys[KeyFile(name)] = &fstest.MapFile{
+			Data: pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER}),
+		}
+
+		if parent, err = x509.ParseCertificate(der); err != nil {
+			t.Fatal(err)
+		}
+		parentKey = key
+	}
+	return fsys
+}
+
+func TestRead(t *testing.T) {
+	fsys := newTestFS(t)
+
+	certs, err := ReadCerts(fsys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(certs) != 3 || certs[0].Name != NAME_CA || certs[2].Name != "web" {
+		t.Fatalf("got %d certificates", len(certs))
+	}
+
+	chain, err := Chain(fsys, "web")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(chain) != 2 || chain[0].Name != "sub" || chain[1].Name != NAME_CA {
+		t.Errorf("wrong chain: %v", chain)
+	}
+
+	pool, err := CertPool(fsys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pair, err := KeyPair(fsys, "web")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pair.Certificate) != 2 {
+		t.Fatalf("got %d certificates in the key pair, want 2", len(pair.Certificate))
+	}
+
+	leaf, err := x509.ParseCertificate(pair.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	inter := x509.NewCertPool()
+	inter.AddCert(chain[0].Cert)
+	if _, err = leaf.Verify(x509.VerifyOptions{
+		Roots:         pool,
+		Intermediates: inter,
+		DNSName:       "web.example.com",
+	}); err != nil {
+		t.Error(err)
+	}
+
+	if _, err = ReadCert(fsys, "none"); err == nil {
+		t.Error("certificate not found: got no error")
+	}
+}
+
+func TestVerify(t *testing.T) {
+	fsys := newTestFS(t)
+
+	web, err := ReadCert(fsys, "web")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	chain, err := Verify(fsys, web, VerifyOptions{DNSName: "web.example.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(chain) != 3 {
+		t.Errorf("got %d certificates in the chain, want 3", len(chain))
+	}
+	if _, err = Verify(fsys, web, VerifyOptions{SystemRoots: true, Roots: []string{NAME_CA}}); err != nil {
+		t.Error(err)
+	}
+
+	if _, err = Verify(fsys, web, VerifyOptions{SystemRoots: true}); err == nil {
+		t.Error("certificate verified against the system roots only: got no error")
+	}
+	if _, err = Verify(fsys, web, VerifyOptions{DNSName: "other.example.com"}); err == nil {
+		t.Error("wrong host name: got no error")
+	}
+}
+
+// The certificates can be read from an archive.
+func TestReadZip(t *testing.T) {
+	var buf bytes.Buffer
+
+	zw := zip.NewWriter(&buf)
+	for name, f := range newTestFS(t) {
+		w, err := zw.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err = w.Write(f.Data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	zr, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = KeyPair(zr, "web"); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,131 @@
+// Copyright 2014 Jonas mg
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+// Package store handles a certificates directory of EasyCert, stored on disk
+// or in memory.
+//
+// The names of the files are slash-separated paths relative to the root of the
+// certificates directory, like in the package io/fs.
+package store
+
+import (
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+)
+
+// Layout of the certificates directory.
+const (
+	DIR_CERT    = "certs"    // Certificates.
+	DIR_KEY     = "private"  // Private keys.
+	DIR_NEWCERT = "newcerts" // Certificates signed by the CA, by serial number.
+	DIR_REVOK   = "crl"      // Certificate revocation lists.
+
+	FILE_INDEX  = "index.txt" // Database of OpenSSL.
+	FILE_SERIAL = "serial"    // Next serial number.
+
+	EXT_CERT    = ".crt"
+	EXT_KEY     = ".key"
+	EXT_REQUEST = ".csr"
+	EXT_REVOK   = ".crl"
+
+	NAME_CA = "ca" // Name for files related to the CA.
+)
+
+// CertFile returns the name of the file of the certificate `name`.
+func CertFile(name string) string {
+	return path.Join(DIR_CERT, name+EXT_CERT)
+}
+
+// KeyFile returns the name of the file of the private key `name`.
+func KeyFile(name string) string {
+	return path.Join(DIR_KEY, name+EXT_KEY)
+}
+
+// CRLFile returns the name of the file of the revocation list of the CA `name`.
+func CRLFile(name string) string {
+	return path.Join(DIR_REVOK, name+EXT_REVOK)
+}
+
+// RequestFile returns the name of the file of the certificate request `name`.
+func RequestFile(name string) string {
+	return name + EXT_REQUEST
+}
+
+// Store represents the storage of a certificates directory.
+type Store interface {
+	fs.FS
+
+	// WriteFile writes the data to the file, replacing it whether it exists.
+	// The directories are created as needed.
+	WriteFile(name string, data []byte, perm fs.FileMode) error
+
+	// Remove removes the file.
+	Remove(name string) error
+}
+
+// == Directory
+//
+
+// Dir is a certificates directory on disk.
+type Dir string
+
+func (d Dir) Open(name string) (fs.File, error) {
+	return os.DirFS(string(d)).Open(name)
+}
+
+// WriteFile writes the data to a temporary file which is renamed to the file,
+// once it is on disk, so the file is never truncated.
+func (d Dir) WriteFile(name string, data []byte, perm fs.FileMode) error {
+	file, err := d.path("write", name)
+	if err != nil {
+		return err
+	}
+	if err = os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+		return err
+	}
+
+	f, err := os.CreateTemp(filepath.Dir(file), "."+filepath.Base(file)+".tmp-")
+	if err != nil {
+		return err
+	}
+	tmp := f.Name()
+
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	if errClose := f.Close(); err == nil {
+		err = errClose
+	}
+	if err == nil {
+		err = os.Chmod(tmp, perm)
+	}
+	if err == nil {
+		err = os.Rename(tmp, file)
+	}
+	if err != nil {
+		os.Remove(tmp)
+	}
+	return err
+}
+
+func (d Dir) Remove(name string) error {
+	file, err := d.path("remove", name)
+	if err != nil {
+		return err
+	}
+	return os.Remove(file)
+}
+
+// path returns the path on disk of the file `name`.
+func (d Dir) path(op, name string) (string, error) {
+	if !fs.ValidPath(name) || name == "." {
+		return "", &fs.PathError{Op: op, Path: name, Err: fs.ErrInvalid}
+	}
+	return filepath.Join(string(d), filepath.FromSlash(name)), nil
+}
@@ -0,0 +1,62 @@
+// Copyright 2014 Jonas mg
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package store
+
+import (
+	"bytes"
+	"errors"
+	"io/fs"
+	"testing"
+	"testing/fstest"
+)
+
+var testFiles = map[string]string{
+	CertFile(NAME_CA):  "ca cert",
+	KeyFile(NAME_CA):   "ca key",
+	CertFile("web"):    "web cert",
+	RequestFile("app"): "app request",
+	FILE_INDEX:         "",
+}
+
+func testStore(t *testing.T, s Store) {
+	for name, data := range testFiles {
+		if err := s.WriteFile(name, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	expected := make([]string, 0, len(testFiles))
+	for name := range testFiles {
+		expected = append(expected, name)
+	}
+	if err := fstest.TestFS(s, expected...); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.WriteFile(CertFile("web"), []byte("new"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := fs.ReadFile(s, CertFile("web")); err != nil || !bytes.Equal(data, []byte("new")) {
+		t.Errorf("file not replaced: %q, %v", data, err)
+	}
+
+	if err := s.Remove(CertFile("web")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fs.Stat(s, CertFile("web")); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("file removed: got %v", err)
+	}
+
+	for _, name := range []string{"", "/abs", "../up", "certs/../ca"} {
+		if err := s.WriteFile(name, nil, 0644); err == nil {
+			t.Errorf("write to %q: got no error", name)
+		}
+	}
+}
+
+func TestDir(t *testing.T) { testStore(t, Dir(t.TempDir())) }
+func TestMem(t *testing.T) { testStore(t, NewMem()) }
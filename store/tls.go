@@ -0,0 +1,344 @@
+// Copyright 2014 Jonas mg
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package store
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrRevoked is returned whether a certificate of the chain is revoked.
+var ErrRevoked = errors.New("certificate revoked")
+
+// ClientPolicy represents the policy of the client certificates for a server
+// name.
+type ClientPolicy struct {
+	// Names of the CAs whose client certificates are accepted. The CA is used
+	// whether it is empty.
+	CAs []string
+
+	// Whether the client certificate is optional, else it is required.
+	Optional bool
+}
+
+// GetConfigForClient returns a function to use in tls.Config.GetConfigForClient,
+// which enforces the policy of the server name (SNI) requested by the client,
+// or the one of the empty name whether there is no policy for it; the
+// configuration `base` is used unchanged whether neither exists.
+//
+// The client certificates have to be issued by the CAs of the policy, and they
+// are checked against the revocation lists of their issuers found in the
+// certificates directory, which are read again whether they are modified.
+//
+//	cfg := &tls.Config{Certificates: []tls.Certificate{pair}}
+//	cfg.GetConfigForClient, err = store.GetConfigForClient(dir, cfg, policies)
+func GetConfigForClient(fsys fs.FS, base *tls.Config, policies map[string]ClientPolicy) (func(*tls.ClientHelloInfo) (*tls.Config, error), error) {
+	if base == nil {
+		base = new(tls.Config)
+	}
+	crls, err := newCRLCache(fsys)
+	if err != nil {
+		return nil, err
+	}
+	configs := make(map[string]*tls.Config, len(policies))
+
+	for name, policy := range policies {
+		pool, err := CertPool(fsys, policy.CAs...)
+		if err != nil {
+			return nil, err
+		}
+
+		cfg := base.Clone()
+		cfg.GetConfigForClient = nil
+		cfg.ClientCAs = pool
+		cfg.ClientAuth = tls.RequireAndVerifyClientCert
+		if policy.Optional {
+			cfg.ClientAuth = tls.VerifyClientCertIfGiven
+		}
+
+		verify := base.VerifyConnection
+		cfg.VerifyConnection = func(cs tls.ConnectionState) error {
+			if verify != nil {
+				if err := verify(cs); err != nil {
+					return err
+				}
+			}
+			if len(cs.VerifiedChains) == 0 { // no certificate
+				return nil
+			}
+			return crls.check(cs.VerifiedChains[0])
+		}
+
+		configs[strings.ToLower(name)] = cfg
+	}
+
+	return func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+		if cfg, ok := configs[strings.ToLower(hello.ServerName)]; ok {
+			return cfg, nil
+		}
+		return configs[""], nil
+	}, nil
+}
+
+// PeerOptions are the options to verify the certificate of a peer.
+type PeerOptions struct {
+	// Names of the CAs trusted. The CA is used whether it is empty.
+	CAs []string
+
+	// Whether the status of the certificate of the peer is queried to the OCSP
+	// responder listed in it, if any. A certificate whose status is not good,
+	// or a responder which can not be reached, fails the verification.
+	OCSP bool
+
+	// Client to query the OCSP responders; one with a timeout of 10 seconds is
+	// used whether it is nil.
+	Client *http.Client
+
+	// Pins of the public keys accepted (see SPKIPin). Whether it is set, the
+	// peer is verified only by the pin of its certificate and its period of
+	// validity, without CAs nor revocation, like for the nameless certificates
+	// of the internal services; then the clients have to set
+	// tls.Config.InsecureSkipVerify, since there is no name to verify.
+	Pins []string
+}
+
+// VerifyPeer returns a function to use in tls.Config.VerifyPeerCertificate,
+// which verifies the chain of the peer against the CAs of the certificates
+// directory and the revocation lists of its issuers, and the status in OCSP
+// whether it is set in `opts`. The responses of OCSP are kept until their next
+// update. Whether the pins are set in `opts`, only they are checked.
+//
+// It can be used by the servers, to verify the clients, and by the clients, to
+// verify the servers; the host name is not checked, so the clients have to keep
+// the verification of tls.Config.
+func VerifyPeer(fsys fs.FS, opts PeerOptions) (func([][]byte, [][]*x509.Certificate) error, error) {
+	if len(opts.Pins) != 0 {
+		return verifyPins(opts.Pins)
+	}
+	roots, err := CertPool(fsys, opts.CAs...)
+	if err != nil {
+		return nil, err
+	}
+	crls, err := newCRLCache(fsys)
+	if err != nil {
+		return nil, err
+	}
+	client := opts.Client
+	if client == nil {
+		client = &http.Client{Timeout: 10 * time.Second}
+	}
+	responses := newOCSPCache(client)
+
+	return func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+		if len(rawCerts) == 0 {
+			return errors.New("no certificate of the peer")
+		}
+
+		certs := make([]*x509.Certificate, len(rawCerts))
+		for i, v := range rawCerts {
+			if certs[i], err = x509.ParseCertificate(v); err != nil {
+				return err
+			}
+		}
+		intermediates := x509.NewCertPool()
+		for _, v := range certs[1:] {
+			intermediates.AddCert(v)
+		}
+		for _, v := range crls.cas {
+			intermediates.AddCert(v.Cert)
+		}
+
+		chains, err := certs[0].Verify(x509.VerifyOptions{
+			Roots:         roots,
+			Intermediates: intermediates,
+			KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+		})
+		if err != nil {
+			return err
+		}
+		chain := chains[0]
+		if err = crls.check(chain); err != nil {
+			return err
+		}
+
+		if opts.OCSP && len(chain) > 1 && len(chain[0].OCSPServer) != 0 {
+			return responses.check(chain[0], chain[1])
+		}
+		return nil
+	}, nil
+}
+
+// == OCSP
+//
+
+// ocspCache keeps the status of the certificates got from the OCSP responders
+// until their next update.
+type ocspCache struct {
+	client *http.Client
+
+	mu     sync.Mutex
+	status map[string]*ocspStatus // By serial number.
+}
+
+func newOCSPCache(client *http.Client) *ocspCache {
+	return &ocspCache{client: client, status: make(map[string]*ocspStatus)}
+}
+
+// check checks that the status of the certificate is good.
+func (c *ocspCache) check(cert, issuer *x509.Certificate) error {
+	key := cert.SerialNumber.String()
+
+	c.mu.Lock()
+	status, ok := c.status[key]
+	c.mu.Unlock()
+
+	if !ok || time.Now().After(status.expiry()) {
+		var err error
+		if status, err = queryOCSP(c.client, cert, issuer); err != nil {
+			return err
+		}
+		c.mu.Lock()
+		c.status[key] = status
+		c.mu.Unlock()
+	}
+
+	switch status.Status {
+	case _OCSP_GOOD:
+		return nil
+	case _OCSP_REVOKED:
+		return fmt.Errorf("%w in OCSP: %q (serial %X)", ErrRevoked, cert.Subject.CommonName, cert.SerialNumber)
+	}
+	return fmt.Errorf("ocsp: unknown status of the certificate: %q (serial %X)",
+		cert.Subject.CommonName, cert.SerialNumber)
+}
+
+// expiry returns the time until the status can be used.
+func (s *ocspStatus) expiry() time.Time {
+	if s.NextUpdate.IsZero() {
+		return s.ThisUpdate.Add(OCSP_DEFAULT_UPDATE)
+	}
+	return s.NextUpdate
+}
+
+// == Revocation lists
+//
+
+// crlCache keeps the revocation lists of the CAs of the certificates
+// directory, reading them again whether they are modified.
+type crlCache struct {
+	fsys fs.FS
+	cas  []*Cert
+
+	mu    sync.Mutex
+	lists map[string]*cachedCRL // By name of the CA.
+}
+
+// cachedCRL represents the serial numbers revoked in a revocation list.
+type cachedCRL struct {
+	modTime    time.Time
+	nextUpdate time.Time
+	revoked    map[string]bool
+}
+
+// newCRLCache returns a cache of the revocation lists of the CAs of the
+// certificates directory.
+func newCRLCache(fsys fs.FS) (*crlCache, error) {
+	certs, err := ReadCerts(fsys)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &crlCache{fsys: fsys, lists: make(map[string]*cachedCRL)}
+	for _, v := range certs {
+		if v.Cert.IsCA {
+			c.cas = append(c.cas, v)
+		}
+	}
+	return c, nil
+}
+
+// check checks that no certificate of the chain, from the leaf up to the root,
+// is revoked in the revocation list of its issuer. A certificate is not checked
+// whether its issuer is not a CA of the certificates directory or it has not a
+// revocation list.
+func (c *crlCache) check(chain []*x509.Certificate) error {
+	for i := 0; i < len(chain)-1; i++ {
+		cert, issuer := chain[i], chain[i+1]
+
+		var name string
+		for _, v := range c.cas {
+			if bytes.Equal(v.Cert.Raw, issuer.Raw) {
+				name = v.Name
+				break
+			}
+		}
+		if name == "" {
+			continue
+		}
+
+		list, err := c.load(name, issuer)
+		if err != nil {
+			return err
+		}
+		if list == nil {
+			continue
+		}
+		if !list.nextUpdate.IsZero() && time.Now().After(list.nextUpdate) {
+			return fmt.Errorf("revocation list expired: %q", CRLFile(name))
+		}
+		if list.revoked[cert.SerialNumber.String()] {
+			return fmt.Errorf("%w: %q (serial %X)", ErrRevoked, cert.Subject.CommonName, cert.SerialNumber)
+		}
+	}
+	return nil
+}
+
+// load returns the revocation list of the CA `name`, verifying its signature
+// by `issuer`. It returns nil whether the CA has not a revocation list.
+func (c *crlCache) load(name string, issuer *x509.Certificate) (*cachedCRL, error) {
+	info, err := fs.Stat(c.fsys, CRLFile(name))
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if v, ok := c.lists[name]; ok && v.modTime.Equal(info.ModTime()) {
+		return v, nil
+	}
+
+	crl, err := ReadCRL(c.fsys, name)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", CRLFile(name), err)
+	}
+	if err = crl.CheckSignatureFrom(issuer); err != nil {
+		return nil, fmt.Errorf("%s: %s", CRLFile(name), err)
+	}
+
+	v := &cachedCRL{
+		modTime:    info.ModTime(),
+		nextUpdate: crl.NextUpdate,
+		revoked:    make(map[string]bool, len(crl.RevokedCertificateEntries)),
+	}
+	for _, e := range crl.RevokedCertificateEntries {
+		v.revoked[e.SerialNumber.String()] = true
+	}
+	c.lists[name] = v
+	return v, nil
+}
@@ -0,0 +1,287 @@
+// Copyright 2014 Jonas mg
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package store
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/pem"
+	"errors"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"testing/fstest"
+	"time"
+)
+
+// handshake runs a TLS handshake between the server and the client, returning
+// the error of the server whether any.
+func handshake(server, client *tls.Config) error {
+	c1, c2 := net.Pipe()
+	errc := make(chan error, 1)
+
+	go func() {
+		errc <- tls.Server(c1, server).Handshake()
+		c1.Close()
+	}()
+	errClient := tls.Client(c2, client).Handshake()
+	c2.Close()
+
+	if err := <-errc; err != nil {
+		return err
+	}
+	return errClient
+}
+
+// writeTestCRL writes the revocation list of the CA `name` with the serial
+// numbers revoked.
+func writeTestCRL(t *testing.T, fsys fstest.MapFS, name string, serials ...int64) {
+	pair, err := KeyPair(fsys, name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	issuer, err := ReadCert(fsys, name)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tmpl := &x509.RevocationList{
+		Number:     big.NewInt(time.Now().UnixNano()),
+		ThisUpdate: time.Now().Add(-time.Minute),
+		NextUpdate: time.Now().Add(time.Hour),
+	}
+	for _, v := range serials {
+		tmpl.RevokedCertificateEntries = append(tmpl.RevokedCertificateEntries,
+			x509.RevocationListEntry{SerialNumber: big.NewInt(v), RevocationTime: time.Now()})
+	}
+
+	der, err := x509.CreateRevocationList(rand.Reader, tmpl, issuer, pair.PrivateKey.(crypto.Signer))
+	if err != nil {
+		t.Fatal(err)
+	}
+	fsys[CRLFile(name)] = &fstest.MapFile{
+		Data:    pem.EncodeToMemory(&pem.Block{Type: "X509 CRL", Bytes: der}),
+		ModTime: time.Now(),
+	}
+}
+
+func TestGetConfigForClient(t *testing.T) {
+	fsys := newTestFS(t)
+	writeTestCRL(t, fsys, "sub")
+
+	pair, err := KeyPair(fsys, "web")
+	if err != nil {
+		t.Fatal(err)
+	}
+	roots, err := CertPool(fsys)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := &tls.Config{Certificates: []tls.Certificate{pair}, SessionTicketsDisabled: true}
+	server.GetConfigForClient, err = GetConfigForClient(fsys, server, map[string]ClientPolicy{
+		"web.example.com": {},
+		"api.example.com": {Optional: true},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client := func(name string, withCert bool) *tls.Config {
+		cfg := &tls.Config{RootCAs: roots, ServerName: "web.example.com"}
+		if name != "" {
+			cfg.ServerName = name
+			cfg.InsecureSkipVerify = true // the server certificate is for "web"
+		}
+		if withCert {
+			cfg.Certificates = []tls.Certificate{pair}
+		}
+		return cfg
+	}
+
+	if err = handshake(server, client("", true)); err != nil {
+		t.Errorf("client certificate valid: %s", err)
+	}
+	if err = handshake(server, client("", false)); err == nil {
+		t.Error("client certificate required: got no error")
+	}
+	if err = handshake(server, client("api.example.com", false)); err != nil {
+		t.Errorf("client certificate optional: %s", err)
+	}
+	if err = handshake(server, client("other.example.com", false)); err != nil {
+		t.Errorf("server name without policy: %s", err)
+	}
+
+	// The revocation list is read again once it is modified.
+	writeTestCRL(t, fsys, "sub", 3)
+	if err = handshake(server, client("", true)); err == nil || !strings.Contains(err.Error(), ErrRevoked.Error()) {
+		t.Errorf("client certificate revoked: got error %v", err)
+	}
+	if err = handshake(server, client("api.example.com", true)); err == nil {
+		t.Error("client certificate optional but revoked: got no error")
+	}
+}
+
+// ocspResponder returns a responder which signs the status of the serial
+// numbers in `status` with the key of the CA `name`.
+func ocspResponder(t *testing.T, fsys fstest.MapFS, name string, status map[int64]int) *httptest.Server {
+	pair, err := KeyPair(fsys, name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	issuer, err := ReadCert(fsys, name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer := pair.PrivateKey.(crypto.Signer)
+
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		var req ocspRequest
+		if _, err := asn1.Unmarshal(body, &req); err != nil || len(req.TBSRequest.RequestList) == 0 {
+			http.Error(w, "malformed request", http.StatusBadRequest)
+			return
+		}
+		id := req.TBSRequest.RequestList[0].Cert
+		now := time.Now()
+
+		single := ocspSingleResponse{
+			CertID:     id,
+			ThisUpdate: now.Add(-time.Minute).UTC(),
+			NextUpdate: now.Add(time.Hour).UTC(),
+		}
+		switch st, ok := status[id.SerialNumber.Int64()]; {
+		case !ok || st == _OCSP_UNKNOWN:
+			single.Unknown = true
+		case st == _OCSP_GOOD:
+			single.Good = true
+		case st == _OCSP_REVOKED:
+			single.Revoked.RevocationTime = now.UTC()
+		}
+
+		tbs := ocspResponseData{
+			RawResponderID: asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 1, IsCompound: true, Bytes: issuer.RawSubject},
+			ProducedAt:     now.UTC(),
+			Responses:      []ocspSingleResponse{single},
+		}
+		tbsDER, err := asn1.Marshal(tbs)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		sum := sha256.Sum256(tbsDER)
+		sig, err := signer.Sign(rand.Reader, sum[:], crypto.SHA256)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		basic := ocspBasicResponse{
+			TBSResponseData:    ocspResponseData{Raw: tbsDER},
+			SignatureAlgorithm: pkix.AlgorithmIdentifier{Algorithm: asn1.ObjectIdentifier{1, 2, 840, 10045, 4, 3, 2}},
+			Signature:          asn1.BitString{Bytes: sig, BitLength: len(sig) * 8},
+		}
+		var resp ocspResponse
+		resp.Response.ResponseType = oidOCSPBasic
+		if resp.Response.Response, err = asn1.Marshal(basic); err != nil {
+			t.Error(err)
+			return
+		}
+		data, err := asn1.Marshal(resp)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/ocsp-response")
+		w.Write(data)
+	}))
+}
+
+func TestVerifyPeer(t *testing.T) {
+	fsys := newTestFS(t)
+	server := ocspResponder(t, fsys, "sub", map[int64]int{
+		10: _OCSP_GOOD,
+		11: _OCSP_REVOKED,
+	})
+	defer server.Close()
+
+	pair, err := KeyPair(fsys, "sub")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sub, err := ReadCert(fsys, "sub")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// leaf returns a certificate issued by "sub" with the responder of OCSP.
+	leaf := func(serial int64) [][]byte {
+		tmpl := &x509.Certificate{
+			SerialNumber: big.NewInt(serial),
+			Subject:      pkix.Name{CommonName: "app"},
+			NotBefore:    time.Now().Add(-time.Hour),
+			NotAfter:     time.Now().Add(time.Hour),
+			KeyUsage:     x509.KeyUsageDigitalSignature,
+			OCSPServer:   []string{server.URL},
+		}
+		signer := pair.PrivateKey.(crypto.Signer)
+		der, err := x509.CreateCertificate(rand.Reader, tmpl, sub, signer.Public(), signer)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return [][]byte{der, sub.Raw}
+	}
+
+	verify, err := VerifyPeer(fsys, PeerOptions{OCSP: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = verify(leaf(10), nil); err != nil {
+		t.Errorf("status good: %s", err)
+	}
+	if err = verify(leaf(11), nil); !errors.Is(err, ErrRevoked) {
+		t.Errorf("status revoked: got error %v", err)
+	}
+	if err = verify(leaf(12), nil); err == nil {
+		t.Error("status unknown: got no error")
+	}
+	if err = verify(nil, nil); err == nil {
+		t.Error("without certificates: got no error")
+	}
+
+	// Without OCSP, only the chain and the revocation list are checked.
+	verify, err = VerifyPeer(fsys, PeerOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = verify(leaf(11), nil); err != nil {
+		t.Errorf("without OCSP: %s", err)
+	}
+	writeTestCRL(t, fsys, "sub", 11)
+	if err = verify(leaf(11), nil); !errors.Is(err, ErrRevoked) {
+		t.Errorf("revoked in the CRL: got error %v", err)
+	}
+
+	// A chain of another CA is not trusted.
+	other := newTestFS(t)
+	web, err := KeyPair(other, "web")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = verify(web.Certificate, nil); err == nil {
+		t.Error("chain of another CA: got no error")
+	}
+}